@@ -0,0 +1,130 @@
+// Package avisos manda al organizador un mensaje por cada venta confirmada, por
+// un bot de Telegram o un webhook entrante compatible con Slack.
+package avisos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/tracing"
+)
+
+var tracer = otel.Tracer("PaymentsGo/internal/avisos")
+
+// Venta son los datos del aviso; Email ya viene enmascarado y Monto formateado
+type Venta struct {
+	Rifa    string
+	Numeros int
+	Email   string
+	Monto   string
+}
+
+// Texto es el mensaje en texto plano, igual para los dos canales
+func (v Venta) Texto() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "🎟️ Venta confirmada\nRifa: %s\nNúmeros: %d\n", v.Rifa, v.Numeros)
+	if v.Email != "" {
+		fmt.Fprintf(&b, "Comprador: %s\n", v.Email)
+	}
+	if v.Monto != "" {
+		fmt.Fprintf(&b, "Monto: %s\n", v.Monto)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// El cliente no usa el transporte de otelhttp: la URL lleva el token del bot
+// (o es el secreto del webhook) y quedaría en los atributos del span
+var cliente = &http.Client{Timeout: 10 * time.Second}
+
+// Telegram manda el aviso con sendMessage de la API de bots
+type Telegram struct {
+	token  string
+	chatID string
+}
+
+func NewTelegram(token string, chatID string) *Telegram {
+	return &Telegram{token: token, chatID: chatID}
+}
+
+func (t *Telegram) Nombre() string {
+	return "telegram"
+}
+
+func (t *Telegram) Notificar(ctx context.Context, texto string) (err error) {
+	ctx, span := tracer.Start(ctx, "telegram.sendMessage", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+
+	cuerpo, err := publicar(ctx, "https://api.telegram.org/bot"+t.token+"/sendMessage", map[string]string{"chat_id": t.chatID, "text": texto})
+	if err == nil {
+		return nil
+	}
+	// Telegram explica el error en description (p. ej. "chat not found")
+	var respuesta struct {
+		Description string `json:"description"`
+	}
+	if json.Unmarshal(cuerpo, &respuesta) == nil && respuesta.Description != "" {
+		return fmt.Errorf("%w: %s", err, respuesta.Description)
+	}
+	return err
+}
+
+// Slack manda el aviso a un webhook entrante; Mattermost, Discord (con /slack)
+// y Rocket.Chat aceptan el mismo cuerpo
+type Slack struct {
+	url string
+}
+
+func NewSlack(url string) *Slack {
+	return &Slack{url: url}
+}
+
+func (s *Slack) Nombre() string {
+	return "slack"
+}
+
+func (s *Slack) Notificar(ctx context.Context, texto string) (err error) {
+	ctx, span := tracer.Start(ctx, "slack.webhook", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+
+	_, err = publicar(ctx, s.url, map[string]string{"text": texto})
+	return err
+}
+
+// publicar hace el POST JSON y devuelve el cuerpo de la respuesta. Los errores
+// de red no incluyen la URL para no dejar el token en los logs.
+func publicar(ctx context.Context, destino string, payload interface{}) ([]byte, error) {
+	datos, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, destino, bytes.NewReader(datos))
+	if err != nil {
+		return nil, errors.New("URL de aviso inválida")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cliente.Do(req)
+	if err != nil {
+		var errURL *url.Error
+		if errors.As(err, &errURL) {
+			return nil, errURL.Err
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	cuerpo, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		return cuerpo, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return cuerpo, nil
+}
@@ -0,0 +1,135 @@
+// Package captcha valida del lado del servidor los tokens de Cloudflare
+// Turnstile o de reCAPTCHA que el frontend manda con la compra.
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/tracing"
+)
+
+var tracer = otel.Tracer("PaymentsGo/internal/captcha")
+
+const (
+	Turnstile = "turnstile"
+	Recaptcha = "recaptcha"
+)
+
+// Las dos APIs reciben lo mismo (secret, response, remoteip) y responden casi
+// igual; reCAPTCHA v3 agrega score
+var urlsSiteverify = map[string]string{
+	Turnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	Recaptcha: "https://www.google.com/recaptcha/api/siteverify",
+}
+
+// ErrTokenInvalido es un token vacío, vencido, repetido o de otro sitio; el
+// proveedor respondió, así que no es una caída
+type ErrTokenInvalido struct {
+	Codigos []string
+}
+
+func (e *ErrTokenInvalido) Error() string {
+	if len(e.Codigos) == 0 {
+		return "captcha inválido"
+	}
+	return "captcha inválido: " + strings.Join(e.Codigos, ", ")
+}
+
+// Resultado es lo que respondió el proveedor para un token válido. Score sólo
+// viene de reCAPTCHA v3 (0 es bot, 1 es humano); TieneScore dice si vino.
+type Resultado struct {
+	Proveedor  string
+	Hostname   string
+	Action     string
+	Score      float64
+	TieneScore bool
+}
+
+// Verificador llama a siteverify con un timeout propio, para que una caída del
+// proveedor no deje colgada la compra
+type Verificador struct {
+	proveedor string
+	secreto   string
+	// minScore rechaza los tokens de reCAPTCHA v3 con score menor
+	minScore float64
+	cliente  *http.Client
+}
+
+func NewVerificador(proveedor string, secreto string, minScore float64, timeout time.Duration) *Verificador {
+	return &Verificador{
+		proveedor: proveedor,
+		secreto:   secreto,
+		minScore:  minScore,
+		cliente:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Verificar devuelve *ErrTokenInvalido si el proveedor rechazó el token; otro
+// error es que no se pudo preguntar (timeout, 5xx, respuesta ilegible)
+func (v *Verificador) Verificar(ctx context.Context, token string, ip string) (_ *Resultado, err error) {
+	ctx, span := tracer.Start(ctx, v.proveedor+".siteverify", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+
+	if token == "" {
+		return nil, &ErrTokenInvalido{Codigos: []string{"missing-input-response"}}
+	}
+	formulario := url.Values{"secret": {v.secreto}, "response": {token}}
+	if ip != "" {
+		formulario.Set("remoteip", ip)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlsSiteverify[v.proveedor], strings.NewReader(formulario.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.cliente.Do(req)
+	if err != nil {
+		// El cuerpo lleva el secreto, pero url.Error sólo trae la URL
+		return nil, fmt.Errorf("siteverify: %w", err)
+	}
+	defer resp.Body.Close()
+	cuerpo, _ := io.ReadAll(io.LimitReader(resp.Body, 8192))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("siteverify: status %d", resp.StatusCode)
+	}
+
+	var respuesta struct {
+		Success  bool     `json:"success"`
+		Hostname string   `json:"hostname"`
+		Action   string   `json:"action"`
+		Score    *float64 `json:"score"`
+		Codigos  []string `json:"error-codes"`
+	}
+	if err := json.Unmarshal(cuerpo, &respuesta); err != nil {
+		return nil, fmt.Errorf("siteverify: respuesta inválida: %w", err)
+	}
+	if !respuesta.Success {
+		// internal-error es del proveedor, no del token: cuenta como caída
+		for _, c := range respuesta.Codigos {
+			if c == "internal-error" {
+				return nil, errors.New("siteverify: internal-error")
+			}
+		}
+		return nil, &ErrTokenInvalido{Codigos: respuesta.Codigos}
+	}
+
+	resultado := &Resultado{Proveedor: v.proveedor, Hostname: respuesta.Hostname, Action: respuesta.Action}
+	if respuesta.Score != nil {
+		resultado.Score, resultado.TieneScore = *respuesta.Score, true
+		if resultado.Score < v.minScore {
+			return resultado, &ErrTokenInvalido{Codigos: []string{fmt.Sprintf("score %.1f < %.1f", resultado.Score, v.minScore)}}
+		}
+	}
+	return resultado, nil
+}
@@ -0,0 +1,833 @@
+// Package config lee la configuración del entorno una sola vez al arrancar.
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	// Las zonas de DIGEST_TIMEZONE no dependen de que la imagen traiga tzdata
+	_ "time/tzdata"
+)
+
+// Config es la configuración del servicio. Load la arma desde las variables de
+// entorno; después nadie más lee el entorno, salvo el SDK de OpenTelemetry,
+// que lee sus variables OTEL_* estándar.
+type Config struct {
+	Port                string
+	ShutdownGracePeriod time.Duration
+	LogLevel            slog.Level
+	// LogFormat "json" usa el handler JSON de slog; cualquier otro valor, texto
+	LogFormat string
+	// DebugHTTPLogging (DEBUG_HTTP_LOGGING=on) registra los cuerpos de petición
+	// y respuesta de la API, con emails y tokens tapados; nunca los de webhooks
+	DebugHTTPLogging bool
+	// AccessLogExclude son las rutas que no salen en el access log, para que
+	// los probes no lo llenen (ACCESS_LOG_EXCLUDE, por defecto /healthz,/readyz)
+	AccessLogExclude []string
+	// TracingEnabled se activa con OTEL_EXPORTER_OTLP_ENDPOINT (o el de trazas)
+	// y se apaga con OTEL_SDK_DISABLED=true
+	TracingEnabled bool
+
+	SupabaseURL         string
+	SupabaseServiceRole string
+	SupabaseJWTSecret   string
+	// StoreBackend es supabase (todo por PostgREST) o postgres: las reservas y
+	// el registro de tickets van en transacciones por DatabaseURL, la conexión
+	// directa al mismo Postgres
+	StoreBackend string
+	DatabaseURL  string
+	// MigrateOnStart (MIGRATE_ON_START=true) aplica al arrancar las migraciones
+	// pendientes de internal/store/migraciones por DatabaseURL
+	MigrateOnStart bool
+	// RegisterTicketsRPC registra los tickets con la función register_tickets
+	// (migración 0007_register_tickets.sql); REGISTER_TICKETS_RPC=off vuelve
+	// a validar e insertar en dos pasos
+	RegisterTicketsRPC bool
+	// RifaIDFormat es cómo son los IDs de rifa que aceptan los endpoints de
+	// compra: uuid (por defecto), int (un identity) o slug (letras, dígitos, - y _)
+	RifaIDFormat string
+
+	StripeSecretKey string
+	// StripeWebhookSecrets son los secretos del endpoint que validan la firma
+	// del webhook, el vigente primero (ver secretosWebhook)
+	StripeWebhookSecrets []string
+	// StripeWebhookTolerance es cuánto puede tener de vieja la firma de un
+	// evento (STRIPE_WEBHOOK_TOLERANCE, 5m como stripe-go); más para un reloj
+	// desfasado
+	StripeWebhookTolerance time.Duration
+	// StripeWebhookStrict (STRIPE_WEBHOOK_STRICT=on) responde 400 a los tipos
+	// de evento que el webhook no maneja en lugar de ignorarlos con 200, para
+	// notar en staging un endpoint suscrito a eventos de más
+	StripeWebhookStrict bool
+	// StripePublishableKey es la clave pk_ que GET /payments/config le pasa al
+	// frontend para iniciar Stripe.js
+	StripePublishableKey string
+	// PaymentMethodTypes fija los métodos de pago en lugar de dejar que Stripe elija
+	PaymentMethodTypes []string
+	// AutomaticPaymentMethods (AUTOMATIC_PAYMENT_METHODS=off lo apaga) deja que
+	// Stripe ofrezca los métodos activos en el Dashboard, Apple Pay y Google Pay
+	// incluidos; apagado y sin PAYMENT_METHOD_TYPES se cobra sólo con tarjeta
+	AutomaticPaymentMethods bool
+	// MerchantDisplayName es el comercio que muestra la hoja de Apple Pay y
+	// Google Pay; por defecto EMAIL_FROM_NAME
+	MerchantDisplayName string
+	// StatementDescriptorSuffix es la plantilla del sufijo; {title} es el título de la rifa
+	StatementDescriptorSuffix string
+	// StatementDescriptorPrefix es el prefijo configurado en la cuenta de Stripe
+	StatementDescriptorPrefix string
+	// PlatformFeePercent es la comisión que se queda la plataforma en las rifas
+	// con organizer_stripe_account (p. ej. 5 o 2.5)
+	PlatformFeePercent float64
+	// ReferralCommissionPercent es la comisión del referente sobre lo cobrado
+	// en las ventas con su código, salvo que referrers traiga la suya
+	ReferralCommissionPercent float64
+
+	// PayPal es opcional: sin PayPalClientID los endpoints de PayPal responden
+	// 503. PayPalWebhookID es el ID del webhook en el panel de PayPal, con el
+	// que se verifica la firma; PayPalSandbox sale de PAYPAL_ENV=sandbox.
+	PayPalClientID     string
+	PayPalClientSecret string
+	PayPalWebhookID    string
+	PayPalSandbox      bool
+
+	// MercadoPago también es opcional. MercadoPagoWebhookSecret es la clave
+	// secreta del webhook (valida x-signature); MercadoPagoNotificationURL va
+	// en cada preferencia y MercadoPagoReturnURL es adonde vuelve el comprador.
+	MercadoPagoAccessToken     string
+	MercadoPagoWebhookSecret   string
+	MercadoPagoNotificationURL string
+	MercadoPagoReturnURL       string
+
+	ResendAPIKey    string
+	OrganizerEmail  string
+	PaymentRetryURL string
+	VIPThreshold    int
+	// WaitlistClaimURL es el enlace del correo de la lista de espera, con
+	// {rifaId} y {number}; WaitlistClaimTTL es cuánto se le guarda el número
+	// ofrecido al primero de la lista antes de pasar al siguiente
+	WaitlistClaimURL string
+	WaitlistClaimTTL time.Duration
+	// EmailResendsPerHour es cuántas veces por hora POST /admin/emails/resend
+	// puede reenviar la confirmación al mismo email
+	EmailResendsPerHour int
+	// PrivacyTombstoneProfileID es el perfil sin datos personales al que pasan
+	// los tickets en POST /admin/privacy/delete; vacío desactiva el endpoint
+	PrivacyTombstoneProfileID string
+	// DigestTime es la hora "HH:MM" del resumen diario a OrganizerEmail, en
+	// DigestLocation; vacío lo desactiva
+	DigestTime     string
+	DigestLocation *time.Location
+	// ResendWebhookSecret (whsec_...) valida POST /email/webhook; vacío lo desactiva
+	ResendWebhookSecret string
+
+	// Avisos de venta al organizador; cada canal es opcional
+	TelegramBotToken string
+	TelegramChatID   string
+	SlackWebhookURL  string
+
+	// SMTP es el respaldo de Resend; sin SMTPHost no hay respaldo
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUser     string
+	SMTPPassword string
+	// MailFailoverThreshold son las fallas seguidas de Resend que abren el
+	// circuito; MailFailoverCooldown es cuánto va todo por SMTP antes de volver a probar
+	MailFailoverThreshold int
+	MailFailoverCooldown  time.Duration
+
+	// Marca global de los correos; rifa_branding la cambia por rifa
+	EmailFromName    string
+	EmailFromAddress string
+	EmailReplyTo     string
+	EmailLogoURL     string
+	EmailAccentColor string
+	// EmailVerifiedDomains son los dominios verificados en Resend: el remitente
+	// de una rifa fuera de ellos se descarta. Sin la variable sólo vale el
+	// dominio de EMAIL_FROM_ADDRESS.
+	EmailVerifiedDomains []string
+
+	// TicketSigningSecret firma los enlaces de verificación de los tickets;
+	// vacío los desactiva
+	TicketSigningSecret string
+	// TicketVerifyURL es la plantilla del enlace del correo; {token} es el token firmado
+	TicketVerifyURL string
+	// TicketTokenTTL es cuánto vale un enlace de verificación
+	TicketTokenTTL time.Duration
+
+	// Datos del negocio impresos en el recibo PDF
+	ReceiptBusinessName    string
+	ReceiptBusinessAddress string
+	ReceiptFooter          string
+
+	// AdminAPIKeys son las claves de X-Admin-Key, de ADMIN_API_KEYS y de
+	// ADMIN_API_KEY; sin ninguna los endpoints de administración responden 401
+	AdminAPIKeys   []ClaveAdmin
+	AllowedOrigins []string
+	TrustedProxies []*net.IPNet
+	AllowAnonymous bool
+
+	// CaptchaProvider es turnstile o recaptcha; vacío (u off) no pide captcha
+	// en create-intent
+	CaptchaProvider string
+	CaptchaSecret   string
+	// CaptchaMinScore es el score mínimo de reCAPTCHA v3
+	CaptchaMinScore float64
+	// CaptchaTimeout limita la llamada a siteverify
+	CaptchaTimeout time.Duration
+	// CaptchaFailOpen acepta la compra si siteverify no responde
+	// (CAPTCHA_ON_ERROR=open); con closed se rechaza
+	CaptchaFailOpen bool
+
+	// EmailValidation revisa el email del comprador (sintaxis, dominios
+	// temporales y MX) antes de cobrar; EMAIL_VALIDATION=off lo salta
+	EmailValidation bool
+	// EmailMXTimeout es cuánto se espera al DNS; al vencer se acepta el email
+	EmailMXTimeout time.Duration
+	// DisposableDomains son los dominios temporales de DISPOSABLE_DOMAINS_FILE,
+	// que se suman a la lista incluida
+	DisposableDomains []string
+
+	RateLimitPerMinute     int
+	RateLimitBurst         int
+	GiftRateLimitPerMinute int
+	GiftRateLimitBurst     int
+
+	// AnnounceRatePerSecond es el máximo de correos por segundo al anunciar un
+	// sorteo; Resend limita las peticiones por segundo de la cuenta
+	AnnounceRatePerSecond int
+
+	// Circuito de Supabase: se abre con SupabaseBreakerFailures fallas seguidas
+	// o con SupabaseBreakerErrorRate por ciento de fallas en las últimas
+	// llamadas, y queda abierto SupabaseBreakerOpen
+	SupabaseBreakerFailures  int
+	SupabaseBreakerErrorRate float64
+	SupabaseBreakerOpen      time.Duration
+
+	// CreateIntentTimeout y WebhookTimeout son el plazo de create-intent y el
+	// de procesar un webhook (la petición o el trabajo encolado); al vencer se
+	// responde 504
+	CreateIntentTimeout time.Duration
+	WebhookTimeout      time.Duration
+
+	// WebhookWorkers son los workers que procesan los eventos encolados por el webhook
+	WebhookWorkers int
+
+	// RifaCacheTTL es cuánto se guardan en memoria las rifas de los endpoints públicos
+	RifaCacheTTL time.Duration
+	// BlocklistCacheTTL es cuánto se recuerda si un comprador está en blocked_buyers
+	BlocklistCacheTTL time.Duration
+	// ProgressCacheTTL es cuánto se sirve sin recalcular GET /rifas/{id}/progress;
+	// después se sirve el viejo mientras se recalcula
+	ProgressCacheTTL time.Duration
+	// EventsMaxSubscribers es cuántos clientes puede tener GET
+	// /rifas/{id}/events por rifa en cada instancia
+	EventsMaxSubscribers int
+
+	MaxNumerosPerPurchase int
+	ReservationTTL        time.Duration
+	AsyncReservation      time.Duration
+	// ReservationSweepInterval es cada cuánto se liberan las reservas vencidas
+	ReservationSweepInterval time.Duration
+	// PriceUnit es la unidad de las rifas sin price_unit: "major" o "minor"
+	PriceUnit string
+	// PriceAuthority es contra qué precio el webhook verifica lo cobrado antes
+	// de registrar los tickets: "draft" el total que guardó el borrador al
+	// crear el intent, "current" el precio actual de la rifa. Una diferencia de
+	// más de PriceMismatchTolerance (unidades menores) va a price_mismatches.
+	PriceAuthority         string
+	PriceMismatchTolerance int64
+
+	// Pago en cuotas: InstallmentMinUnitPrice es el precio por número desde el
+	// que se ofrecen, en la unidad menor de la moneda de la rifa. El saldo se
+	// paga dentro de InstallmentWindow o antes del sorteo; si vence, se
+	// devuelven las cuotas menos InstallmentCancelFeePercent.
+	// InstallmentPaymentURL es el enlace del correo para pagar la siguiente
+	// cuota, con {draftId}.
+	InstallmentMinUnitPrice     int64
+	InstallmentWindow           time.Duration
+	InstallmentCancelFeePercent float64
+	InstallmentPaymentURL       string
+
+	// Sandbox: con STRIPE_TEST_SECRET_KEY el checkout también corre contra la
+	// cuenta de prueba de Stripe, en las tablas *_sandbox y mandando todos los
+	// correos a SandboxEmail. SandboxMode (SANDBOX_MODE=on) manda ahí todas las
+	// compras; si no, sólo las que traen en X-Sandbox uno de SandboxAdminTokens.
+	SandboxMode              bool
+	StripeTestSecretKey      string
+	StripeTestWebhookSecret  string
+	StripeTestPublishableKey string
+	SandboxAdminTokens       []string
+	SandboxEmail             string
+}
+
+// SandboxConfigurado dice si hay con qué atender compras de prueba
+func (c *Config) SandboxConfigurado() bool {
+	return c.StripeTestSecretKey != ""
+}
+
+// ClaveAdmin es una clave de X-Admin-Key. Label es lo que queda en audit_log
+// (nunca el secreto); una de sólo lectura sirve para GET y HEAD.
+type ClaveAdmin struct {
+	Label    string
+	Secret   string
+	ReadOnly bool
+}
+
+// ErrConfig junta todo lo que falta o es inválido, para corregirlo de una vez
+type ErrConfig struct {
+	Problemas []string
+}
+
+func (e *ErrConfig) Error() string {
+	return "configuración inválida: " + strings.Join(e.Problemas, "; ")
+}
+
+// Load lee la configuración del entorno. Los secretos también se pueden dar
+// como archivo con el sufijo _FILE (p. ej. STRIPE_SECRET_KEY_FILE), como los
+// montan Docker y Kubernetes. Con problemas devuelve igual la configuración
+// leída junto a un *ErrConfig, así main puede configurar el logger antes de salir.
+func Load() (*Config, error) {
+	l := &lector{}
+	cfg := &Config{
+		Port:                l.texto("PORT", "8080"),
+		ShutdownGracePeriod: l.duracion("SHUTDOWN_GRACE_PERIOD", 15*time.Second),
+		LogFormat:           l.texto("LOG_FORMAT", "text"),
+
+		SupabaseURL:         l.requerido("SUPABASE_URL"),
+		SupabaseServiceRole: l.secreto("SUPABASE_SERVICE_ROLE", true),
+		SupabaseJWTSecret:   l.secreto("SUPABASE_JWT_SECRET", true),
+		StoreBackend:        strings.ToLower(l.texto("STORE_BACKEND", "supabase")),
+		DatabaseURL:         l.secreto("DATABASE_URL", false),
+		RifaIDFormat:        strings.ToLower(l.texto("RIFA_ID_FORMAT", "uuid")),
+
+		StripeSecretKey:           l.secreto("STRIPE_SECRET_KEY", true),
+		StripeWebhookSecrets:      l.secretosWebhook(),
+		StripeWebhookTolerance:    l.duracion("STRIPE_WEBHOOK_TOLERANCE", 5*time.Minute),
+		StripePublishableKey:      l.texto("STRIPE_PUBLISHABLE_KEY", ""),
+		PaymentMethodTypes:        l.lista("PAYMENT_METHOD_TYPES"),
+		StatementDescriptorSuffix: l.texto("STATEMENT_DESCRIPTOR_SUFFIX", "{title}"),
+		StatementDescriptorPrefix: l.texto("STATEMENT_DESCRIPTOR_PREFIX", ""),
+		PlatformFeePercent:        l.porcentaje("PLATFORM_FEE_PERCENT", 0),
+		ReferralCommissionPercent: l.porcentaje("REFERRAL_COMMISSION_PERCENT", 10),
+
+		PayPalClientID:     l.texto("PAYPAL_CLIENT_ID", ""),
+		PayPalClientSecret: l.secreto("PAYPAL_CLIENT_SECRET", false),
+		PayPalWebhookID:    l.texto("PAYPAL_WEBHOOK_ID", ""),
+
+		MercadoPagoAccessToken:     l.secreto("MERCADOPAGO_ACCESS_TOKEN", false),
+		MercadoPagoWebhookSecret:   l.secreto("MERCADOPAGO_WEBHOOK_SECRET", false),
+		MercadoPagoNotificationURL: l.texto("MERCADOPAGO_NOTIFICATION_URL", ""),
+		MercadoPagoReturnURL:       l.texto("MERCADOPAGO_RETURN_URL", ""),
+
+		ResendAPIKey:        l.secreto("RESEND_API_KEY", true),
+		ResendWebhookSecret: l.secreto("RESEND_WEBHOOK_SECRET", false),
+		OrganizerEmail:      l.texto("ORGANIZER_EMAIL", ""),
+		PaymentRetryURL:     l.texto("PAYMENT_RETRY_URL", ""),
+		VIPThreshold:        l.entero("VIP_THRESHOLD", 20),
+		WaitlistClaimURL:    l.texto("WAITLIST_CLAIM_URL", ""),
+		WaitlistClaimTTL:    l.duracion("WAITLIST_CLAIM_TTL", 2*time.Hour),
+		EmailResendsPerHour: l.entero("EMAIL_RESENDS_PER_HOUR", 3),
+
+		PrivacyTombstoneProfileID: l.texto("PRIVACY_TOMBSTONE_PROFILE_ID", ""),
+
+		TelegramBotToken: l.secreto("TELEGRAM_BOT_TOKEN", false),
+		TelegramChatID:   l.texto("TELEGRAM_CHAT_ID", ""),
+		SlackWebhookURL:  l.secreto("SLACK_WEBHOOK_URL", false),
+
+		SMTPHost:              l.texto("SMTP_HOST", ""),
+		SMTPPort:              l.entero("SMTP_PORT", 587),
+		SMTPUser:              l.texto("SMTP_USER", ""),
+		SMTPPassword:          l.secreto("SMTP_PASSWORD", false),
+		MailFailoverThreshold: l.entero("MAIL_FAILOVER_THRESHOLD", 3),
+		MailFailoverCooldown:  l.duracion("MAIL_FAILOVER_COOLDOWN", time.Minute),
+
+		EmailFromName:    l.texto("EMAIL_FROM_NAME", "Twins Rifas"),
+		EmailFromAddress: strings.ToLower(l.texto("EMAIL_FROM_ADDRESS", "onboarding@resend.dev")),
+		EmailReplyTo:     l.texto("EMAIL_REPLY_TO", ""),
+		EmailLogoURL:     l.texto("EMAIL_LOGO_URL", ""),
+		EmailAccentColor: l.texto("EMAIL_ACCENT_COLOR", "#ff5252"),
+
+		TicketSigningSecret: l.secreto("TICKET_SIGNING_SECRET", false),
+		TicketVerifyURL:     l.texto("TICKET_VERIFY_URL", ""),
+		TicketTokenTTL:      l.duracion("TICKET_TOKEN_TTL", 365*24*time.Hour),
+
+		ReceiptBusinessName:    l.texto("RECEIPT_BUSINESS_NAME", "Twins Rifas"),
+		ReceiptBusinessAddress: l.texto("RECEIPT_BUSINESS_ADDRESS", ""),
+		ReceiptFooter:          l.texto("RECEIPT_FOOTER", ""),
+
+		AdminAPIKeys:   l.clavesAdmin(),
+		AllowAnonymous: l.texto("ALLOW_ANONYMOUS", "") == "true",
+
+		RateLimitPerMinute:     l.entero("RATE_LIMIT_PER_MINUTE", 10),
+		RateLimitBurst:         l.entero("RATE_LIMIT_BURST", 5),
+		GiftRateLimitPerMinute: l.entero("GIFT_RATE_LIMIT_PER_MINUTE", 1),
+		GiftRateLimitBurst:     l.entero("GIFT_RATE_LIMIT_BURST", 3),
+
+		AnnounceRatePerSecond: l.entero("ANNOUNCE_RATE_PER_SECOND", 2),
+
+		SupabaseBreakerFailures:  l.entero("SUPABASE_BREAKER_FAILURES", 5),
+		SupabaseBreakerErrorRate: l.porcentaje("SUPABASE_BREAKER_ERROR_RATE", 50),
+		SupabaseBreakerOpen:      l.duracion("SUPABASE_BREAKER_OPEN", 30*time.Second),
+
+		CreateIntentTimeout: l.duracion("CREATE_INTENT_TIMEOUT", 10*time.Second),
+		WebhookTimeout:      l.duracion("WEBHOOK_TIMEOUT", 20*time.Second),
+
+		WebhookWorkers: l.entero("WEBHOOK_WORKERS", 4),
+
+		RifaCacheTTL:      l.duracion("RIFA_CACHE_TTL", 60*time.Second),
+		BlocklistCacheTTL: l.duracion("BLOCKLIST_CACHE_TTL", 30*time.Second),
+		ProgressCacheTTL:  l.duracion("PROGRESS_CACHE_TTL", 5*time.Second),
+
+		EventsMaxSubscribers: l.entero("EVENTS_MAX_SUBSCRIBERS", 200),
+
+		MaxNumerosPerPurchase:  l.entero("MAX_NUMEROS_PER_PURCHASE", 100),
+		ReservationTTL:         time.Duration(l.entero("RESERVATION_TTL_MINUTES", 15)) * time.Minute,
+		AsyncReservation:       time.Duration(l.entero("ASYNC_RESERVATION_HOURS", 72)) * time.Hour,
+		PriceUnit:              strings.ToLower(l.texto("PRICE_UNIT", "major")),
+		PriceAuthority:         strings.ToLower(l.texto("PRICE_AUTHORITY", "draft")),
+		PriceMismatchTolerance: int64(l.entero("PRICE_MISMATCH_TOLERANCE", 1)),
+
+		InstallmentMinUnitPrice:     int64(l.entero("INSTALLMENT_MIN_UNIT_PRICE", 10000)),
+		InstallmentWindow:           l.duracion("INSTALLMENT_WINDOW", 30*24*time.Hour),
+		InstallmentCancelFeePercent: l.porcentaje("INSTALLMENT_CANCEL_FEE_PERCENT", 5),
+		InstallmentPaymentURL:       l.texto("INSTALLMENT_PAYMENT_URL", ""),
+	}
+	for _, o := range l.lista("ALLOWED_ORIGINS") {
+		cfg.AllowedOrigins = append(cfg.AllowedOrigins, strings.TrimSuffix(o, "/"))
+	}
+	cfg.TrustedProxies = l.redes("TRUSTED_PROXIES")
+	for _, d := range l.lista("EMAIL_VERIFIED_DOMAINS") {
+		cfg.EmailVerifiedDomains = append(cfg.EmailVerifiedDomains, strings.ToLower(d))
+	}
+	if len(cfg.EmailVerifiedDomains) == 0 {
+		_, dominio, _ := strings.Cut(cfg.EmailFromAddress, "@")
+		cfg.EmailVerifiedDomains = []string{dominio}
+	}
+	cfg.DigestTime = l.texto("DIGEST_TIME", "21:00")
+	if strings.EqualFold(cfg.DigestTime, "off") {
+		cfg.DigestTime = ""
+	}
+	if _, _, ok := HoraDelDia(cfg.DigestTime); cfg.DigestTime != "" && !ok {
+		l.problema(fmt.Sprintf("DIGEST_TIME debe ser HH:MM (p. ej. 21:00) u off, no %q", cfg.DigestTime))
+	}
+	zona := l.texto("DIGEST_TIMEZONE", "America/Mexico_City")
+	if loc, err := time.LoadLocation(zona); err != nil {
+		l.problema(fmt.Sprintf("DIGEST_TIMEZONE no es una zona horaria IANA válida: %q", zona))
+		cfg.DigestLocation = time.UTC
+	} else {
+		cfg.DigestLocation = loc
+	}
+	switch entorno := strings.ToLower(l.texto("PAYPAL_ENV", "live")); entorno {
+	case "live", "sandbox":
+		cfg.PayPalSandbox = entorno == "sandbox"
+	default:
+		l.problema(fmt.Sprintf("PAYPAL_ENV debe ser live o sandbox, no %q", entorno))
+	}
+	switch cfg.CaptchaProvider = strings.ToLower(l.texto("CAPTCHA_PROVIDER", "")); cfg.CaptchaProvider {
+	case "", "off":
+		cfg.CaptchaProvider = ""
+	case "turnstile", "recaptcha":
+		cfg.CaptchaSecret = l.secreto("CAPTCHA_SECRET", true)
+	default:
+		l.problema(fmt.Sprintf("CAPTCHA_PROVIDER debe ser turnstile, recaptcha u off, no %q", cfg.CaptchaProvider))
+	}
+	cfg.CaptchaMinScore = 0.5
+	if v := l.texto("CAPTCHA_MIN_SCORE", ""); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil || f < 0 || f > 1 {
+			l.problema(fmt.Sprintf("CAPTCHA_MIN_SCORE debe estar entre 0 y 1, no %q", v))
+		} else {
+			cfg.CaptchaMinScore = f
+		}
+	}
+	cfg.CaptchaTimeout = l.duracion("CAPTCHA_TIMEOUT", 3*time.Second)
+	switch v := strings.ToLower(l.texto("CAPTCHA_ON_ERROR", "open")); v {
+	case "open", "closed":
+		cfg.CaptchaFailOpen = v == "open"
+	default:
+		l.problema(fmt.Sprintf("CAPTCHA_ON_ERROR debe ser open o closed, no %q", v))
+	}
+	switch v := strings.ToLower(l.texto("EMAIL_VALIDATION", "on")); v {
+	case "on", "off":
+		cfg.EmailValidation = v == "on"
+	default:
+		l.problema(fmt.Sprintf("EMAIL_VALIDATION debe ser on u off, no %q", v))
+	}
+	switch v := strings.ToLower(l.texto("STRIPE_WEBHOOK_STRICT", "off")); v {
+	case "on", "off":
+		cfg.StripeWebhookStrict = v == "on"
+	default:
+		l.problema(fmt.Sprintf("STRIPE_WEBHOOK_STRICT debe ser on u off, no %q", v))
+	}
+	cfg.EmailMXTimeout = l.duracion("EMAIL_MX_TIMEOUT", 2*time.Second)
+	switch v := strings.ToLower(l.texto("AUTOMATIC_PAYMENT_METHODS", "on")); v {
+	case "on", "off":
+		cfg.AutomaticPaymentMethods = v == "on"
+	default:
+		l.problema(fmt.Sprintf("AUTOMATIC_PAYMENT_METHODS debe ser on u off, no %q", v))
+	}
+	if !cfg.AutomaticPaymentMethods && len(cfg.PaymentMethodTypes) == 0 {
+		cfg.PaymentMethodTypes = []string{"card"}
+	}
+	if cfg.StripePublishableKey != "" && !strings.HasPrefix(cfg.StripePublishableKey, "pk_") {
+		l.problema("STRIPE_PUBLISHABLE_KEY debe empezar con pk_")
+	}
+	cfg.MerchantDisplayName = l.texto("MERCHANT_DISPLAY_NAME", cfg.EmailFromName)
+	switch v := strings.ToLower(l.texto("SANDBOX_MODE", "off")); v {
+	case "on", "off":
+		cfg.SandboxMode = v == "on"
+	default:
+		l.problema(fmt.Sprintf("SANDBOX_MODE debe ser on u off, no %q", v))
+	}
+	cfg.StripeTestSecretKey = l.secreto("STRIPE_TEST_SECRET_KEY", false)
+	cfg.StripeTestWebhookSecret = l.secreto("STRIPE_TEST_WEBHOOK_SECRET", false)
+	cfg.StripeTestPublishableKey = l.texto("STRIPE_TEST_PUBLISHABLE_KEY", "")
+	cfg.SandboxAdminTokens = l.lista("SANDBOX_ADMIN_TOKENS")
+	cfg.SandboxEmail = l.texto("SANDBOX_EMAIL", "")
+	if archivo := l.texto("DISPOSABLE_DOMAINS_FILE", ""); archivo != "" {
+		if contenido, err := os.ReadFile(archivo); err != nil {
+			l.problema(fmt.Sprintf("DISPOSABLE_DOMAINS_FILE: %v", err))
+		} else {
+			// Un dominio por línea; # empieza un comentario
+			for _, linea := range strings.Split(string(contenido), "\n") {
+				linea, _, _ = strings.Cut(linea, "#")
+				if d := strings.ToLower(strings.TrimSpace(linea)); d != "" {
+					cfg.DisposableDomains = append(cfg.DisposableDomains, d)
+				}
+			}
+		}
+	}
+	cfg.ReservationSweepInterval = l.duracion("RESERVATION_SWEEP_INTERVAL", time.Minute)
+	otlp := l.texto("OTEL_EXPORTER_OTLP_ENDPOINT", "") != "" || l.texto("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "") != ""
+	cfg.TracingEnabled = otlp && !strings.EqualFold(l.texto("OTEL_SDK_DISABLED", ""), "true")
+
+	if cfg.SupabaseURL != "" {
+		if u, err := url.Parse(cfg.SupabaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			l.problema("SUPABASE_URL no es una URL http(s) válida")
+		}
+	}
+	switch v := strings.ToLower(l.texto("REGISTER_TICKETS_RPC", "on")); v {
+	case "on", "off":
+		cfg.RegisterTicketsRPC = v == "on"
+	default:
+		l.problema(fmt.Sprintf("REGISTER_TICKETS_RPC debe ser on u off, no %q", v))
+	}
+	switch v := strings.ToLower(l.texto("MIGRATE_ON_START", "false")); v {
+	case "true", "false":
+		cfg.MigrateOnStart = v == "true"
+		if cfg.MigrateOnStart && cfg.DatabaseURL == "" {
+			l.problema("MIGRATE_ON_START=true necesita DATABASE_URL")
+		}
+	default:
+		l.problema(fmt.Sprintf("MIGRATE_ON_START debe ser true o false, no %q", v))
+	}
+	switch cfg.StoreBackend {
+	case "supabase":
+	case "postgres":
+		if cfg.DatabaseURL == "" {
+			l.problema("STORE_BACKEND=postgres necesita DATABASE_URL")
+		}
+	default:
+		l.problema(fmt.Sprintf("STORE_BACKEND debe ser supabase o postgres, no %q", cfg.StoreBackend))
+	}
+	if cfg.RifaIDFormat != "uuid" && cfg.RifaIDFormat != "int" && cfg.RifaIDFormat != "slug" {
+		l.problema(fmt.Sprintf("RIFA_ID_FORMAT debe ser uuid, int o slug, no %q", cfg.RifaIDFormat))
+	}
+	if cfg.PriceUnit != "major" && cfg.PriceUnit != "minor" {
+		l.problema(fmt.Sprintf("PRICE_UNIT debe ser major o minor, no %q", cfg.PriceUnit))
+	}
+	if cfg.PriceAuthority != "draft" && cfg.PriceAuthority != "current" {
+		l.problema(fmt.Sprintf("PRICE_AUTHORITY debe ser draft o current, no %q", cfg.PriceAuthority))
+	}
+	if _, err := mail.ParseAddress(cfg.EmailFromAddress); err != nil {
+		l.problema(fmt.Sprintf("EMAIL_FROM_ADDRESS no es un email válido: %q", cfg.EmailFromAddress))
+	} else if !cfg.RemitenteVerificado(cfg.EmailFromAddress) {
+		l.problema(fmt.Sprintf("el dominio de EMAIL_FROM_ADDRESS no está en EMAIL_VERIFIED_DOMAINS: %q", cfg.EmailFromAddress))
+	}
+	if (cfg.SandboxMode || len(cfg.SandboxAdminTokens) > 0) && !cfg.SandboxConfigurado() {
+		l.problema("SANDBOX_MODE y SANDBOX_ADMIN_TOKENS necesitan STRIPE_TEST_SECRET_KEY")
+	}
+	if cfg.SandboxConfigurado() {
+		if !strings.HasPrefix(cfg.StripeTestSecretKey, "sk_test_") {
+			l.problema("STRIPE_TEST_SECRET_KEY debe empezar con sk_test_")
+		}
+		if strings.HasPrefix(cfg.StripeSecretKey, "sk_test_") {
+			// Los eventos se separan por livemode: con las dos de prueba todo iría al sandbox
+			l.problema("con STRIPE_TEST_SECRET_KEY, STRIPE_SECRET_KEY tiene que ser la clave live")
+		}
+		if cfg.StripeTestWebhookSecret == "" {
+			l.problema("STRIPE_TEST_SECRET_KEY necesita STRIPE_TEST_WEBHOOK_SECRET")
+		}
+		if cfg.StripeTestPublishableKey != "" && !strings.HasPrefix(cfg.StripeTestPublishableKey, "pk_test_") {
+			l.problema("STRIPE_TEST_PUBLISHABLE_KEY debe empezar con pk_test_")
+		}
+		if _, err := mail.ParseAddress(cfg.SandboxEmail); err != nil {
+			l.problema(fmt.Sprintf("SANDBOX_EMAIL debe ser el buzón que recibe los correos del sandbox, no %q", cfg.SandboxEmail))
+		}
+	}
+	if (cfg.TelegramBotToken == "") != (cfg.TelegramChatID == "") {
+		l.problema("TELEGRAM_BOT_TOKEN y TELEGRAM_CHAT_ID van juntas")
+	}
+	if cfg.PayPalClientID != "" || cfg.PayPalClientSecret != "" || cfg.PayPalWebhookID != "" {
+		if cfg.PayPalClientID == "" || cfg.PayPalClientSecret == "" || cfg.PayPalWebhookID == "" {
+			l.problema("PAYPAL_CLIENT_ID, PAYPAL_CLIENT_SECRET y PAYPAL_WEBHOOK_ID van juntas")
+		}
+	}
+	if (cfg.MercadoPagoAccessToken == "") != (cfg.MercadoPagoWebhookSecret == "") {
+		l.problema("MERCADOPAGO_ACCESS_TOKEN y MERCADOPAGO_WEBHOOK_SECRET van juntas")
+	}
+	if cfg.MercadoPagoNotificationURL != "" {
+		if u, err := url.Parse(cfg.MercadoPagoNotificationURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			l.problema("MERCADOPAGO_NOTIFICATION_URL no es una URL https válida")
+		}
+	}
+	if cfg.SlackWebhookURL != "" {
+		if u, err := url.Parse(cfg.SlackWebhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			l.problema("SLACK_WEBHOOK_URL no es una URL https válida")
+		}
+	}
+	if !ColorValido(cfg.EmailAccentColor) {
+		l.problema(fmt.Sprintf("EMAIL_ACCENT_COLOR debe ser un color hexadecimal (p. ej. #ff5252), no %q", cfg.EmailAccentColor))
+	}
+	switch v := strings.ToLower(l.texto("DEBUG_HTTP_LOGGING", "off")); v {
+	case "on", "off":
+		cfg.DebugHTTPLogging = v == "on"
+	default:
+		l.problema(fmt.Sprintf("DEBUG_HTTP_LOGGING debe ser on u off, no %q", v))
+	}
+	for _, ruta := range strings.Split(l.texto("ACCESS_LOG_EXCLUDE", "/healthz,/readyz"), ",") {
+		if ruta = strings.TrimSpace(ruta); ruta != "" {
+			cfg.AccessLogExclude = append(cfg.AccessLogExclude, ruta)
+		}
+	}
+	if err := cfg.LogLevel.UnmarshalText([]byte(l.texto("LOG_LEVEL", "info"))); err != nil {
+		l.problema(fmt.Sprintf("LOG_LEVEL debe ser debug, info, warn o error, no %q", os.Getenv("LOG_LEVEL")))
+	}
+	if _, err := strconv.Atoi(cfg.Port); err != nil {
+		l.problema(fmt.Sprintf("PORT debe ser un número, no %q", cfg.Port))
+	}
+
+	if len(l.problemas) > 0 {
+		return cfg, &ErrConfig{Problemas: l.problemas}
+	}
+	return cfg, nil
+}
+
+// RemitenteVerificado dice si el email es de uno de EmailVerifiedDomains;
+// Resend rechaza los envíos desde dominios que no verificó
+func (c *Config) RemitenteVerificado(email string) bool {
+	_, dominio, ok := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	return ok && slices.Contains(c.EmailVerifiedDomains, dominio)
+}
+
+// HoraDelDia separa "HH:MM" en hora y minuto
+func HoraDelDia(hhmm string) (hora int, minuto int, ok bool) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, 0, false
+	}
+	return t.Hour(), t.Minute(), true
+}
+
+// ColorValido acepta colores hexadecimales #rgb o #rrggbb, lo único que se
+// escribe tal cual en el estilo de los correos
+func ColorValido(color string) bool {
+	hex, ok := strings.CutPrefix(color, "#")
+	if !ok || (len(hex) != 3 && len(hex) != 6) {
+		return false
+	}
+	_, err := strconv.ParseUint(hex, 16, 32)
+	return err == nil
+}
+
+// lector acumula los problemas en lugar de cortar en el primero
+type lector struct {
+	problemas []string
+}
+
+func (l *lector) problema(p string) {
+	l.problemas = append(l.problemas, p)
+}
+
+// texto lee una variable; vacía cuenta como no definida, como hasta ahora
+func (l *lector) texto(nombre string, porDefecto string) string {
+	if v := strings.TrimSpace(os.Getenv(nombre)); v != "" {
+		return v
+	}
+	return porDefecto
+}
+
+func (l *lector) requerido(nombre string) string {
+	v := l.texto(nombre, "")
+	if v == "" {
+		l.problema(nombre + " es obligatoria")
+	}
+	return v
+}
+
+// secreto lee NOMBRE o el archivo de NOMBRE_FILE; definir las dos es un error
+// para que no haya dudas de cuál se usa
+func (l *lector) secreto(nombre string, obligatorio bool) string {
+	v := l.texto(nombre, "")
+	archivo := l.texto(nombre+"_FILE", "")
+	if archivo != "" {
+		if v != "" {
+			l.problema(fmt.Sprintf("%s y %s_FILE están definidas, usa sólo una", nombre, nombre))
+			return v
+		}
+		contenido, err := os.ReadFile(archivo)
+		if err != nil {
+			l.problema(fmt.Sprintf("%s_FILE: %v", nombre, err))
+			return ""
+		}
+		v = strings.TrimSpace(string(contenido))
+		if v == "" && obligatorio {
+			l.problema(fmt.Sprintf("%s_FILE apunta a un archivo vacío", nombre))
+		}
+		return v
+	}
+	if v == "" && obligatorio {
+		l.problema(fmt.Sprintf("%s (o %s_FILE) es obligatoria", nombre, nombre))
+	}
+	return v
+}
+
+func (l *lector) entero(nombre string, porDefecto int) int {
+	v := l.texto(nombre, "")
+	if v == "" {
+		return porDefecto
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		l.problema(fmt.Sprintf("%s debe ser un entero positivo, no %q", nombre, v))
+		return porDefecto
+	}
+	return n
+}
+
+// porcentaje acepta decimales entre 0 y 100
+func (l *lector) porcentaje(nombre string, porDefecto float64) float64 {
+	v := l.texto(nombre, "")
+	if v == "" {
+		return porDefecto
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		l.problema(fmt.Sprintf("%s debe ser un porcentaje entre 0 y 100, no %q", nombre, v))
+		return porDefecto
+	}
+	return p
+}
+
+func (l *lector) duracion(nombre string, porDefecto time.Duration) time.Duration {
+	v := l.texto(nombre, "")
+	if v == "" {
+		return porDefecto
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		l.problema(fmt.Sprintf("%s debe ser una duración positiva (p. ej. 30s), no %q", nombre, v))
+		return porDefecto
+	}
+	return d
+}
+
+// lista separa por comas e ignora los elementos vacíos
+func (l *lector) lista(nombre string) []string {
+	var elementos []string
+	for _, e := range strings.Split(os.Getenv(nombre), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			elementos = append(elementos, e)
+		}
+	}
+	return elementos
+}
+
+// clavesAdmin lee ADMIN_API_KEYS, claves label:secreto separadas por coma con
+// un :read opcional para las de sólo lectura (o :write, el valor por defecto).
+// Varias a la vez permiten rotar: se agrega la nueva, se migran los clientes y
+// se quita la vieja. ADMIN_API_KEY, la clave única de antes, sigue valiendo
+// como la clave default.
+func (l *lector) clavesAdmin() []ClaveAdmin {
+	var claves []ClaveAdmin
+	if clave := l.secreto("ADMIN_API_KEY", false); clave != "" {
+		claves = append(claves, ClaveAdmin{Label: "default", Secret: clave})
+	}
+	for _, e := range strings.Split(l.secreto("ADMIN_API_KEYS", false), ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		partes := strings.Split(e, ":")
+		if len(partes) < 2 || len(partes) > 3 || partes[0] == "" || partes[1] == "" {
+			// Sin mostrar el valor: lleva el secreto
+			l.problema(fmt.Sprintf("ADMIN_API_KEYS: cada clave es label:secreto o label:secreto:read (clave %d)", len(claves)+1))
+			continue
+		}
+		clave := ClaveAdmin{Label: partes[0], Secret: partes[1]}
+		if len(partes) == 3 {
+			switch partes[2] {
+			case "read":
+				clave.ReadOnly = true
+			case "write":
+			default:
+				l.problema(fmt.Sprintf("ADMIN_API_KEYS: el alcance de %q debe ser read o write, no %q", clave.Label, partes[2]))
+				continue
+			}
+		}
+		for _, otra := range claves {
+			if otra.Label == clave.Label {
+				l.problema(fmt.Sprintf("ADMIN_API_KEYS: la etiqueta %q está repetida", clave.Label))
+			}
+		}
+		claves = append(claves, clave)
+	}
+	return claves
+}
+
+// secretosWebhook lee STRIPE_WEBHOOK_SECRETS, los whsec_ separados por coma, y
+// después STRIPE_WEBHOOK_SECRET, el único de antes. Para rotar el secreto en
+// Stripe se pone el nuevo primero y el viejo sigue validando los eventos
+// firmados con él hasta que se quita.
+func (l *lector) secretosWebhook() []string {
+	var secretos []string
+	for _, e := range strings.Split(l.secreto("STRIPE_WEBHOOK_SECRETS", false), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			secretos = append(secretos, e)
+		}
+	}
+	if secreto := l.secreto("STRIPE_WEBHOOK_SECRET", false); secreto != "" && !slices.Contains(secretos, secreto) {
+		secretos = append(secretos, secreto)
+	}
+	if len(secretos) == 0 {
+		l.problema("STRIPE_WEBHOOK_SECRET o STRIPE_WEBHOOK_SECRETS es obligatoria")
+	}
+	return secretos
+}
+
+// redes lee IPs o CIDRs separados por coma; una IP sola es una red /32 o /128
+func (l *lector) redes(nombre string) []*net.IPNet {
+	var redes []*net.IPNet
+	for _, p := range l.lista(nombre) {
+		cidr := p
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, red, err := net.ParseCIDR(cidr)
+		if err != nil {
+			l.problema(fmt.Sprintf("%s contiene un valor inválido: %q", nombre, p))
+			continue
+		}
+		redes = append(redes, red)
+	}
+	return redes
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+type claveAcceso struct{}
+
+// registroAcceso junta lo que los handlers agregan a la línea del access log
+// de su petición (p. ej. el tipo de evento del webhook, que sólo se sabe
+// después de validar la firma)
+type registroAcceso struct {
+	mu    sync.Mutex
+	attrs []any
+}
+
+// anotarAcceso agrega attrs a la línea del access log de la petición; fuera de
+// WithAccessLog no hace nada
+func anotarAcceso(ctx context.Context, attrs ...any) {
+	registro, ok := ctx.Value(claveAcceso{}).(*registroAcceso)
+	if !ok {
+		return
+	}
+	registro.mu.Lock()
+	registro.attrs = append(registro.attrs, attrs...)
+	registro.mu.Unlock()
+}
+
+// WithAccessLog escribe una línea por petición con método, ruta (sin query,
+// que puede traer client_secret), status, duración, bytes de la respuesta, IP
+// del cliente y request ID, en el formato de LOG_FORMAT. Nunca registra
+// cuerpos: para eso está WithDebugHTTP. Las rutas de ACCESS_LOG_EXCLUDE no se
+// registran. Va dentro de WithRequestID y por fuera de WithRecovery, así el
+// 500 de un panic también queda.
+func (s *Server) WithAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(s.cfg.AccessLogExclude, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		registro := &registroAcceso{}
+		rw := &respuestaMedida{ResponseWriter: w}
+		inicio := time.Now()
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				// Un handler que no escribe nada responde 200; uno que entró en
+				// pánico después de escribir corta la conexión y queda el suyo
+				status = http.StatusOK
+			}
+			attrs := []any{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", status,
+				"duracion_ms", float64(time.Since(inicio).Microseconds()) / 1000,
+				"bytes", rw.bytes,
+				"ip", s.ipCliente(r),
+			}
+			registro.mu.Lock()
+			attrs = append(attrs, registro.attrs...)
+			registro.mu.Unlock()
+			slog.InfoContext(r.Context(), "http", attrs...)
+		}()
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), claveAcceso{}, registro)))
+	})
+}
+
+// respuestaMedida guarda el primer status y cuántos bytes se escribieron, sin
+// cambiar lo que recibe el cliente. http.Error y writeJSON pasan por
+// WriteHeader; un Write sin WriteHeader es un 200.
+type respuestaMedida struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *respuestaMedida) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *respuestaMedida) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap deja que http.ResponseController llegue al Flusher (eventos y CSV)
+func (r *respuestaMedida) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
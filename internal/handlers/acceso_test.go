@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"PaymentsGo/internal/config"
+)
+
+// lineasAcceso cambia el logger por defecto por uno JSON en memoria mientras
+// dura la prueba y devuelve cada línea decodificada
+func lineasAcceso(t *testing.T) func() []map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	anterior := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(anterior) })
+	return func() []map[string]any {
+		var lineas []map[string]any
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var linea map[string]any
+			if err := dec.Decode(&linea); err != nil {
+				t.Fatalf("línea de log inválida: %v", err)
+			}
+			lineas = append(lineas, linea)
+		}
+		return lineas
+	}
+}
+
+func TestWithAccessLog(t *testing.T) {
+	s := &Server{cfg: &config.Config{AccessLogExclude: []string{"/healthz"}}}
+	casos := []struct {
+		nombre  string
+		ruta    string
+		handler http.HandlerFunc
+		status  float64
+		bytes   float64
+	}{
+		{nombre: "http.Error", ruta: "/payments/status", handler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no", http.StatusNotFound)
+		}, status: http.StatusNotFound, bytes: 3},
+		{nombre: "writeJSON", ruta: "/payments/config", handler: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"a": "b"})
+		}, status: http.StatusTooManyRequests, bytes: 10},
+		{nombre: "Write sin WriteHeader", ruta: "/version", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}, status: http.StatusOK, bytes: 2},
+		{nombre: "sin respuesta", ruta: "/payments/webhook", handler: func(w http.ResponseWriter, r *http.Request) {
+			anotarAcceso(r.Context(), "stripe_event_type", "payment_intent.succeeded")
+		}, status: http.StatusOK},
+		{nombre: "segundo WriteHeader", ruta: "/payments/cancel", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, status: http.StatusAccepted},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			leer := lineasAcceso(t)
+			req := httptest.NewRequest(http.MethodPost, c.ruta+"?client_secret=pi_secreto", nil)
+			s.WithAccessLog(c.handler).ServeHTTP(httptest.NewRecorder(), req)
+
+			lineas := leer()
+			if len(lineas) != 1 {
+				t.Fatalf("líneas = %v, se esperaba una", lineas)
+			}
+			linea := lineas[0]
+			if linea["path"] != c.ruta {
+				t.Errorf("path = %v, se esperaba %q sin la query", linea["path"], c.ruta)
+			}
+			if linea["status"] != c.status {
+				t.Errorf("status = %v, se esperaba %v", linea["status"], c.status)
+			}
+			if linea["bytes"] != c.bytes {
+				t.Errorf("bytes = %v, se esperaba %v", linea["bytes"], c.bytes)
+			}
+			if linea["ip"] != "192.0.2.1" {
+				t.Errorf("ip = %v", linea["ip"])
+			}
+			if c.ruta == "/payments/webhook" && linea["stripe_event_type"] != "payment_intent.succeeded" {
+				t.Errorf("stripe_event_type = %v", linea["stripe_event_type"])
+			}
+		})
+	}
+
+	t.Run("ruta excluida", func(t *testing.T) {
+		leer := lineasAcceso(t)
+		s.WithAccessLog(http.HandlerFunc(Healthz)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if lineas := leer(); len(lineas) != 0 {
+			t.Errorf("el probe dejó %v", lineas)
+		}
+	})
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+// RequireAdmin protege los endpoints de administración con la cabecera
+// X-Admin-Key, comparada en tiempo constante contra cada clave de
+// ADMIN_API_KEYS. Una clave de sólo lectura sólo pasa con GET y HEAD: con otro
+// método es un 403. Lo que audita el handler queda con actor admin y la
+// etiqueta de la clave.
+func (s *Server) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clave, ok := s.claveAdmin(r.Header.Get("X-Admin-Key"))
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{
+				Error: "No autorizado",
+				Code:  "UNAUTHORIZED",
+			})
+			return
+		}
+		if clave.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			slog.WarnContext(r.Context(), "clave de administración de sólo lectura en un endpoint de escritura", "key", clave.Label, "method", r.Method, "path", r.URL.Path)
+			writeJSON(w, http.StatusForbidden, model.ErrorResponse{
+				Error: "La clave es de sólo lectura",
+				Code:  "ADMIN_READ_ONLY",
+			})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(conActorAdmin(r.Context(), clave.Label)))
+	}
+}
+
+// claveAdmin busca la clave que coincide con recibida. Compara contra todas
+// aunque ya haya encontrado una, para que el tiempo no diga cuál coincidió.
+func (s *Server) claveAdmin(recibida string) (config.ClaveAdmin, bool) {
+	var encontrada config.ClaveAdmin
+	ok := false
+	for _, clave := range s.cfg.AdminAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(recibida), []byte(clave.Secret)) == 1 {
+			encontrada, ok = clave, true
+		}
+	}
+	return encontrada, ok && recibida != ""
+}
+
+// RetryEmailFailures reenvía los correos guardados en email_failures. Los que
+// salen bien se eliminan; los que fallan de nuevo quedan con el último error.
+func (s *Server) RetryEmailFailures(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	fallos, err := s.db.PendingEmailFailures(ctx, 100)
+	if err != nil {
+		slog.ErrorContext(ctx, "error leyendo email_failures", logging.ConError(err)...)
+		http.Error(w, "Error leyendo correos pendientes", 500)
+		return
+	}
+
+	enviados, fallidos := 0, 0
+	for _, f := range fallos {
+		items := f.Items
+		if len(items) == 0 {
+			items = []model.ItemCompra{{RifaTitle: f.RifaTitle, Numeros: f.Numeros}}
+		}
+		var err error
+		if f.GiftFrom != "" {
+			err = s.enviarCorreoRegalo(ctx, f.Email, f.RecipientName, f.GiftFrom, items)
+		} else {
+			err = s.enviarCorreoConfirmacion(ctx, f.Email, f.Locale, items, f.Amount, f.Discount, f.Currency)
+		}
+		if err != nil {
+			fallidos++
+			slog.WarnContext(ctx, "reintento de correo falló", logging.ConError(err, "email_failure_id", f.ID)...)
+			if err := s.db.UpdateEmailFailure(ctx, f.ID, err.Error()); err != nil {
+				slog.WarnContext(ctx, "no se pudo actualizar el correo fallido", logging.ConError(err, "email_failure_id", f.ID)...)
+			}
+			continue
+		}
+		enviados++
+		if err := s.db.DeleteEmailFailure(ctx, f.ID); err != nil {
+			slog.WarnContext(ctx, "no se pudo eliminar el correo fallido", logging.ConError(err, "email_failure_id", f.ID)...)
+		}
+	}
+
+	slog.InfoContext(ctx, "reintento de correos completado", "enviados", enviados, "fallidos", fallidos)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action: model.AuditoriaReintentoCorreos,
+		Detail: map[string]interface{}{"processed": len(fallos), "sent": enviados, "failed": fallidos},
+	})
+	writeJSON(w, http.StatusOK, map[string]int{
+		"processed": len(fallos),
+		"sent":      enviados,
+		"failed":    fallidos,
+	})
+}
+
+// TestMailRequest es el cuerpo (opcional) de POST /admin/mail/test; sin to
+// el correo va a ORGANIZER_EMAIL
+type TestMailRequest struct {
+	To string `json:"to"`
+}
+
+// TestMailResponse dice por qué proveedor salió el correo de prueba
+type TestMailResponse struct {
+	Provider string `json:"provider"`
+	To       string `json:"to"`
+}
+
+// TestMail manda un correo de prueba por el proveedor activo (Resend, o SMTP
+// con el circuito abierto) sin pasar al otro si falla, para revisar el
+// proveedor que están usando los correos ahora.
+func (s *Server) TestMail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req TestMailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+	destinatario := strings.TrimSpace(req.To)
+	if destinatario == "" {
+		destinatario = s.cfg.OrganizerEmail
+	}
+	if !emailValido(destinatario) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error: "Falta un email válido en to (o ORGANIZER_EMAIL)",
+			Code:  "INVALID_EMAIL",
+		})
+		return
+	}
+
+	html, texto, err := mail.RenderizarCorreo("prueba", nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "error renderizando el correo de prueba", logging.ConError(err)...)
+		http.Error(w, "Error armando el correo", 500)
+		return
+	}
+	proveedor, err := s.correo.Probar(ctx, s.marcaGlobal(), destinatario, "Correo de prueba", html, texto)
+	if err != nil {
+		slog.WarnContext(ctx, "falló el correo de prueba", logging.ConError(err, "proveedor", proveedor)...)
+		writeJSON(w, http.StatusBadGateway, model.ErrorResponse{
+			Error:   "El proveedor de correo rechazó el envío",
+			Code:    "MAIL_FAILED",
+			Details: map[string]string{"provider": proveedor, "cause": err.Error()},
+		})
+		return
+	}
+	slog.InfoContext(ctx, "correo de prueba enviado", "proveedor", proveedor, "email", logging.EnmascararEmail(destinatario))
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action: model.AuditoriaCorreoPrueba,
+		Detail: map[string]interface{}{"email": destinatario, "provider": proveedor},
+	})
+	writeJSON(w, http.StatusOK, TestMailResponse{Provider: proveedor, To: destinatario})
+}
+
+// ResumenVentas es el resumen de GET /admin/rifas/{id}/tickets; GrossAmount va
+// en la unidad menor de la moneda
+type ResumenVentas struct {
+	TotalSold        int    `json:"totalSold"`
+	GrossAmount      int64  `json:"grossAmount"`
+	Currency         string `json:"currency"`
+	NumbersRemaining int    `json:"numbersRemaining"`
+	// OrganizerAccount y PlatformFee sólo vienen si la rifa cobra a una cuenta
+	// conectada; PlatformFee es la comisión estimada sobre GrossAmount
+	OrganizerAccount string `json:"organizerAccount,omitempty"`
+	PlatformFee      int64  `json:"platformFee,omitempty"`
+}
+
+// TicketsAdminResponse es la respuesta de GET /admin/rifas/{id}/tickets
+type TicketsAdminResponse struct {
+	Tickets []model.TicketAdmin `json:"tickets"`
+	Summary ResumenVentas       `json:"summary"`
+	Page    int                 `json:"page"`
+	Limit   int                 `json:"limit"`
+	HasMore bool                `json:"hasMore"`
+}
+
+// ListRifaTickets lista los tickets vendidos de una rifa. Query params: page
+// (desde 1), limit (máximo 500), email y number para filtrar. El resumen
+// siempre es de toda la rifa, sin filtros.
+func (s *Server) ListRifaTickets(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+	rifa, err := s.db.GetRifa(ctx, rifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, rifaID, err)
+		return
+	}
+
+	q := r.URL.Query()
+	pagina := enteroPositivo(q.Get("page"), 1)
+	limite := min(enteroPositivo(q.Get("limit"), 50), 500)
+	filtro := model.FiltroTickets{
+		Email: strings.TrimSpace(q.Get("email")),
+		// Se pide uno de más para saber si hay otra página
+		Limit:  limite + 1,
+		Offset: (pagina - 1) * limite,
+	}
+	if n := q.Get("number"); n != "" {
+		numero, err := strconv.Atoi(n)
+		if err != nil || numero <= 0 {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "number inválido", Code: "INVALID_FILTER"})
+			return
+		}
+		filtro.Number = numero
+	}
+
+	tickets, err := s.db.ListTickets(ctx, rifaID, filtro)
+	if err != nil {
+		slog.ErrorContext(ctx, "error listando tickets", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error listando tickets", 500)
+		return
+	}
+	hayMas := len(tickets) > limite
+	if hayMas {
+		tickets = tickets[:limite]
+	}
+	s.marcarEmailsNoEntregables(ctx, tickets)
+
+	resumen, err := s.resumenVentas(ctx, rifa)
+	if err != nil {
+		slog.ErrorContext(ctx, "error calculando el resumen de ventas", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error calculando el resumen", 500)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TicketsAdminResponse{
+		Tickets: tickets,
+		Summary: *resumen,
+		Page:    pagina,
+		Limit:   limite,
+		HasMore: hayMas,
+	})
+}
+
+// resumenVentas cuenta los vendidos y estima el bruto con el precio actual de la rifa
+func (s *Server) resumenVentas(ctx context.Context, rifa *model.Rifa) (*ResumenVentas, error) {
+	vendidos, err := s.db.SoldNumbers(ctx, rifa.ID)
+	if err != nil {
+		return nil, err
+	}
+	moneda := payments.NormalizarMoneda(rifa.Currency)
+	unidad, err := payments.UnidadPrecio(rifa, s.cfg.PriceUnit)
+	if err != nil {
+		return nil, err
+	}
+	bruto, err := payments.MontoStripe(rifa.Price, len(vendidos), moneda, unidad)
+	if err != nil {
+		return nil, err
+	}
+	resumen := &ResumenVentas{
+		TotalSold:        len(vendidos),
+		GrossAmount:      bruto,
+		Currency:         moneda,
+		NumbersRemaining: max(rifa.TotalNumbers-len(vendidos), 0),
+	}
+	if rifa.OrganizerStripeAccount != "" {
+		resumen.OrganizerAccount = rifa.OrganizerStripeAccount
+		resumen.PlatformFee = payments.ComisionPlataforma(bruto, s.cfg.PlatformFeePercent)
+	}
+	return resumen, nil
+}
+
+// marcarEmailsNoEntregables pone EmailUndeliverable en los tickets cuyo
+// comprador tuvo un rebote. Si la consulta falla la lista sale sin la marca.
+func (s *Server) marcarEmailsNoEntregables(ctx context.Context, tickets []model.TicketAdmin) {
+	var emails []string
+	for _, t := range tickets {
+		if t.Email != "" && !slices.Contains(emails, strings.ToLower(t.Email)) {
+			emails = append(emails, strings.ToLower(t.Email))
+		}
+	}
+	marcados, err := s.db.UndeliverableEmails(ctx, emails)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudieron leer los emails no entregables", logging.ConError(err)...)
+		return
+	}
+	for i := range tickets {
+		tickets[i].EmailUndeliverable = marcados[strings.ToLower(tickets[i].Email)]
+	}
+}
+
+// enteroPositivo interpreta un query param; si falta o no es > 0 usa porDefecto
+func enteroPositivo(valor string, porDefecto int) int {
+	if n, err := strconv.Atoi(valor); err == nil && n > 0 {
+		return n
+	}
+	return porDefecto
+}
+
+// paginaExport es el tamaño de cada consulta a Supabase durante el export;
+// PostgREST corta las respuestas grandes (max-rows suele ser 1000)
+const paginaExport = 1000
+
+// ExportRifaCSV descarga los tickets vendidos de la rifa como CSV para el
+// sorteo presencial. Se escribe página por página a medida que llegan de
+// Supabase, sin cargar toda la rifa en memoria.
+func (s *Server) ExportRifaCSV(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+	rifa, err := s.db.GetRifa(ctx, rifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, rifaID, err)
+		return
+	}
+
+	// La primera página se pide antes de escribir las cabeceras para poder
+	// responder 500 si Supabase falla
+	filtro := model.FiltroTickets{SoloVigentes: true, Limit: paginaExport}
+	tickets, err := s.db.ListTickets(ctx, rifaID, filtro)
+	if err != nil {
+		slog.ErrorContext(ctx, "error exportando tickets", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error exportando tickets", 500)
+		return
+	}
+
+	nombre := fmt.Sprintf("rifa-%s-participantes.csv", nombreArchivo(rifa.Title))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": nombre}))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// WriteTimeout del servidor es para toda la respuesta; cada página renueva
+	// el plazo para que una rifa grande no se corte a la mitad
+	rc := http.NewResponseController(w)
+	csvw := csv.NewWriter(w)
+	csvw.Write([]string{"number", "buyer_email", "user_id", "purchased_at", "payment_intent_id", "payment_provider", "organizer_account", "amount_paid", "currency"})
+	filas := 0
+	for len(tickets) > 0 {
+		rc.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		for _, t := range tickets {
+			// Los tickets anteriores a paid_at sólo tienen created_at
+			compradoEn := t.PaidAt
+			if compradoEn == "" {
+				compradoEn = t.CreatedAt
+			}
+			csvw.Write([]string{strconv.Itoa(t.Number), t.Email, t.ProfileID, compradoEn, t.PaymentIntentID, t.PaymentProvider, t.OrganizerAccount, strconv.FormatInt(t.AmountPaid, 10), t.Currency})
+		}
+		filas += len(tickets)
+		csvw.Flush()
+		if err := csvw.Error(); err != nil {
+			slog.WarnContext(ctx, "export interrumpido por el cliente", logging.ConError(err, "rifa_id", rifaID, "filas", filas)...)
+			return
+		}
+		if len(tickets) < paginaExport {
+			break
+		}
+
+		filtro.DespuesDe = tickets[len(tickets)-1].Number
+		if tickets, err = s.db.ListTickets(ctx, rifaID, filtro); err != nil {
+			// El status ya se envió: el CSV queda incompleto y sólo lo dice el log
+			slog.ErrorContext(ctx, "error exportando tickets a mitad del CSV", logging.ConError(err, "rifa_id", rifaID, "filas", filas)...)
+			return
+		}
+	}
+
+	slog.InfoContext(ctx, "export de participantes", "rifa_id", rifaID, "filas", filas)
+}
+
+// nombreArchivo deja el título apto para un nombre de archivo: minúsculas,
+// letras y dígitos (con tildes), y guiones en lugar de lo demás
+func nombreArchivo(titulo string) string {
+	var b strings.Builder
+	guion := false
+	for _, c := range strings.ToLower(titulo) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			b.WriteRune(c)
+			guion = false
+		} else if !guion && b.Len() > 0 {
+			b.WriteByte('-')
+			guion = true
+		}
+	}
+	if nombre := strings.TrimSuffix(b.String(), "-"); nombre != "" {
+		return nombre
+	}
+	return "sin-titulo"
+}
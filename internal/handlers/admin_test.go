@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/model"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	s := &Server{cfg: &config.Config{AdminAPIKeys: []config.ClaveAdmin{
+		{Label: "vieja", Secret: "secreto-viejo"},
+		{Label: "nueva", Secret: "secreto-nuevo"},
+		{Label: "tablero", Secret: "secreto-lectura", ReadOnly: true},
+	}}}
+	casos := []struct {
+		nombre string
+		metodo string
+		clave  string
+		status int
+		code   string
+		actor  string
+	}{
+		{nombre: "sin cabecera", metodo: http.MethodGet, status: http.StatusUnauthorized, code: "UNAUTHORIZED"},
+		{nombre: "clave incorrecta", metodo: http.MethodGet, clave: "secreto-otro", status: http.StatusUnauthorized, code: "UNAUTHORIZED"},
+		{nombre: "prefijo de una clave", metodo: http.MethodGet, clave: "secreto-nue", status: http.StatusUnauthorized, code: "UNAUTHORIZED"},
+		{nombre: "clave vieja durante la rotación", metodo: http.MethodPost, clave: "secreto-viejo", status: http.StatusOK, actor: "vieja"},
+		{nombre: "clave nueva durante la rotación", metodo: http.MethodPost, clave: "secreto-nuevo", status: http.StatusOK, actor: "nueva"},
+		{nombre: "sólo lectura con GET", metodo: http.MethodGet, clave: "secreto-lectura", status: http.StatusOK, actor: "tablero"},
+		{nombre: "sólo lectura con HEAD", metodo: http.MethodHead, clave: "secreto-lectura", status: http.StatusOK, actor: "tablero"},
+		{nombre: "sólo lectura con POST", metodo: http.MethodPost, clave: "secreto-lectura", status: http.StatusForbidden, code: "ADMIN_READ_ONLY"},
+		{nombre: "sólo lectura con DELETE", metodo: http.MethodDelete, clave: "secreto-lectura", status: http.StatusForbidden, code: "ADMIN_READ_ONLY"},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			r := httptest.NewRequest(c.metodo, "/admin/audit", nil)
+			if c.clave != "" {
+				r.Header.Set("X-Admin-Key", c.clave)
+			}
+			w := httptest.NewRecorder()
+			var actor, actorID string
+			s.RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
+				actor, actorID = actorDe(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})(w, r)
+
+			if w.Code != c.status {
+				t.Fatalf("status = %d, se esperaba %d (%s)", w.Code, c.status, w.Body.String())
+			}
+			if c.code == "" {
+				if actor != model.ActorAdmin || actorID != c.actor {
+					t.Errorf("actor = %q/%q, se esperaba %q/%q", actor, actorID, model.ActorAdmin, c.actor)
+				}
+				return
+			}
+			if actor != "" {
+				t.Errorf("el handler corrió con %s", c.nombre)
+			}
+			var e model.ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+				t.Fatalf("la respuesta no es un ErrorResponse: %v (%s)", err, w.Body.String())
+			}
+			if e.Code != c.code {
+				t.Errorf("code = %q, se esperaba %q", e.Code, c.code)
+			}
+		})
+	}
+}
+
+func TestRequireAdminSinClaves(t *testing.T) {
+	s := &Server{cfg: &config.Config{}}
+	r := httptest.NewRequest(http.MethodGet, "/admin/audit", nil)
+	w := httptest.NewRecorder()
+	s.RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("el handler corrió sin claves configuradas")
+	})(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, se esperaba 401", w.Code)
+	}
+}
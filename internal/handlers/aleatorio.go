@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"PaymentsGo/internal/model"
+)
+
+// intentosAleatorios es cuántas veces se vuelve a sortear si otra compra
+// reservó alguno de los números antes que nosotros
+const intentosAleatorios = 3
+
+// ErrNumerosInsuficientes indica que la rifa no tiene tantos números libres como se pidieron
+type ErrNumerosInsuficientes struct {
+	Solicitados int
+	Disponibles int
+}
+
+func (e *ErrNumerosInsuficientes) Error() string {
+	return fmt.Sprintf("se pidieron %d números y quedan %d disponibles", e.Solicitados, e.Disponibles)
+}
+
+// elegirNumerosAleatorios sortea cantidad números libres de la rifa con
+// crypto/rand. excluir son números que ya se sabe que están tomados (p. ej. los
+// de una colisión al reservar) aunque la consulta todavía no los muestre.
+// La exclusividad real la da el unique de ticket_reservation al reservar.
+func (s *Server) elegirNumerosAleatorios(ctx context.Context, rifa *model.Rifa, cantidad int, excluir []int) ([]int, error) {
+	estado, err := s.estadoNumeros(ctx, rifa)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", model.ErrDisponibilidadNoVerificada, err)
+	}
+
+	excluido := map[int]bool{}
+	for _, n := range excluir {
+		excluido[n] = true
+	}
+	libres := make([]int, 0, len(estado.Available))
+	for _, n := range estado.Available {
+		if !excluido[n] {
+			libres = append(libres, n)
+		}
+	}
+	if len(libres) < cantidad {
+		return nil, &ErrNumerosInsuficientes{Solicitados: cantidad, Disponibles: len(libres)}
+	}
+
+	// Fisher-Yates parcial: sólo se mezclan las primeras cantidad posiciones
+	for i := 0; i < cantidad; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(len(libres)-i)))
+		if err != nil {
+			return nil, err
+		}
+		k := i + int(j.Int64())
+		libres[i], libres[k] = libres[k], libres[i]
+	}
+	elegidos := append([]int(nil), libres[:cantidad]...)
+	sort.Ints(elegidos)
+	return elegidos, nil
+}
+
+func responderNumerosInsuficientes(w http.ResponseWriter, e *ErrNumerosInsuficientes) {
+	writeJSON(w, http.StatusConflict, model.ErrorResponse{
+		Error:   fmt.Sprintf("Sólo quedan %d números disponibles", e.Disponibles),
+		Code:    "NOT_ENOUGH_NUMBERS",
+		Details: map[string]int{"disponibles": e.Disponibles, "solicitados": e.Solicitados},
+	})
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// loteAnuncios es cada cuántos correos se renueva el plazo de escritura de la
+// respuesta y se registra el avance
+const loteAnuncios = 50
+
+// AnnounceResponse es la respuesta de POST /admin/rifas/{id}/announce
+type AnnounceResponse struct {
+	RifaID        string `json:"rifaId"`
+	WinningNumber int    `json:"winningNumber"`
+	Sent          int    `json:"sent"`
+	Failed        int    `json:"failed"`
+	Skipped       int    `json:"skipped"`
+}
+
+// destinatarioAnuncio es un comprador distinto de la rifa con sus números
+type destinatarioAnuncio struct {
+	email   string
+	tipo    string
+	numeros []int
+}
+
+// AnnounceDraw anuncia el último sorteo de la rifa: felicita al ganador y le
+// avisa el número ganador a cada uno de los demás compradores. Los correos
+// salen de a uno, a ANNOUNCE_RATE_PER_SECOND como máximo, y cada uno queda en
+// draw_notifications antes de enviarse, así que repetir la llamada (después de
+// una caída o de un error) sólo manda los que faltan y reintenta los failed.
+// skipped cuenta los ya enviados, los compradores sin email y los envíos que
+// quedaron en sending porque el proceso se cayó a la mitad.
+func (s *Server) AnnounceDraw(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+	rifa, err := s.db.GetRifa(ctx, rifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, rifaID, err)
+		return
+	}
+	sorteo, err := s.db.LatestDraw(ctx, rifaID)
+	if errors.Is(err, model.ErrSorteoNoEncontrado) {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{
+			Error: "La rifa todavía no tiene sorteo",
+			Code:  "NOT_DRAWN",
+		})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando sorteos", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error consultando sorteos", 500)
+		return
+	}
+	tickets, err := s.todosLosTickets(ctx, rifaID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error leyendo tickets para el anuncio", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error leyendo tickets", 500)
+		return
+	}
+
+	destinatarios, sinEmail := destinatariosAnuncio(sorteo, tickets)
+	if len(destinatarios) == 0 || destinatarios[0].tipo != model.NotificacionGanador {
+		// El ticket ganador ya no está vigente (reembolsado o disputado después del sorteo)
+		slog.WarnContext(ctx, "el anuncio no tiene a quién felicitar", "rifa_id", rifaID, "winning_number", sorteo.WinningNumber)
+	}
+	resumen := AnnounceResponse{RifaID: rifaID, WinningNumber: sorteo.WinningNumber, Skipped: sinEmail}
+
+	// Si el admin corta la petición se deja de reservar correos, pero el que
+	// está en curso termina y queda registrado
+	trabajo := context.WithoutCancel(ctx)
+	rc := http.NewResponseController(w)
+	ritmo := time.NewTicker(time.Second / time.Duration(s.cfg.AnnounceRatePerSecond))
+	defer ritmo.Stop()
+	for i, d := range destinatarios {
+		if ctx.Err() != nil {
+			slog.WarnContext(ctx, "anuncio interrumpido", "rifa_id", rifaID, "pendientes", len(destinatarios)-i)
+			break
+		}
+		if i%loteAnuncios == 0 {
+			rc.SetWriteDeadline(time.Now().Add(2 * time.Minute))
+			if i > 0 {
+				slog.InfoContext(ctx, "anuncio en curso", "rifa_id", rifaID, "procesados", i, "total", len(destinatarios))
+			}
+		}
+
+		n := &model.NotificacionSorteo{DrawID: sorteo.ID, Email: d.email, Kind: d.tipo}
+		reservado, err := s.db.ClaimDrawNotification(trabajo, n)
+		if err != nil {
+			resumen.Failed++
+			slog.WarnContext(ctx, "no se pudo registrar la notificación", logging.ConError(err, "rifa_id", rifaID, "email", logging.EnmascararEmail(d.email))...)
+			continue
+		}
+		if !reservado {
+			resumen.Skipped++
+			continue
+		}
+
+		<-ritmo.C
+		if d.tipo == model.NotificacionGanador {
+			err = s.enviarCorreoGanador(trabajo, d.email, rifa.ID, rifa.Title, sorteo.WinningNumber)
+		} else {
+			err = s.enviarCorreoAnuncio(trabajo, d.email, rifa.ID, rifa.Title, sorteo.WinningNumber, d.numeros)
+		}
+		n.Status = model.NotificacionEnviada
+		if err != nil {
+			resumen.Failed++
+			n.Status, n.LastError = model.NotificacionFallida, err.Error()
+			slog.WarnContext(ctx, "error enviando el anuncio del sorteo", logging.ConError(err, "rifa_id", rifaID, "kind", d.tipo, "email", logging.EnmascararEmail(d.email))...)
+		} else {
+			resumen.Sent++
+		}
+		if err := s.db.FinishDrawNotification(trabajo, n); err != nil {
+			// Queda en sending: la próxima llamada no lo reenvía aunque haya fallado
+			slog.ErrorContext(ctx, "no se pudo guardar el resultado de la notificación", logging.ConError(err, "rifa_id", rifaID, "email", logging.EnmascararEmail(d.email), "status", n.Status)...)
+		}
+	}
+
+	slog.InfoContext(ctx, "anuncio del sorteo terminado", "rifa_id", rifaID, "draw_id", sorteo.ID, "sent", resumen.Sent, "failed", resumen.Failed, "skipped", resumen.Skipped)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:   model.AuditoriaAnuncioSorteo,
+		RifaID:   rifaID,
+		EntityID: strconv.FormatInt(sorteo.ID, 10),
+		Detail:   map[string]interface{}{"winning_number": sorteo.WinningNumber, "sent": resumen.Sent, "failed": resumen.Failed, "skipped": resumen.Skipped},
+	})
+	writeJSON(w, http.StatusOK, resumen)
+}
+
+// destinatariosAnuncio agrupa los tickets por email (sin distinguir
+// mayúsculas) con el ganador primero. Devuelve también cuántos compradores no
+// tienen email.
+func destinatariosAnuncio(sorteo *model.Sorteo, tickets []model.TicketAdmin) ([]destinatarioAnuncio, int) {
+	var destinatarios []destinatarioAnuncio
+	indice := map[string]int{}
+	sinEmail := map[string]bool{}
+	for _, t := range tickets {
+		if t.Email == "" {
+			sinEmail[t.ProfileID] = true
+			continue
+		}
+		clave := strings.ToLower(t.Email)
+		i, ok := indice[clave]
+		if !ok {
+			i = len(destinatarios)
+			indice[clave] = i
+			destinatarios = append(destinatarios, destinatarioAnuncio{email: t.Email, tipo: model.NotificacionParticipante})
+		}
+		destinatarios[i].numeros = append(destinatarios[i].numeros, t.Number)
+		if t.Number == sorteo.WinningNumber {
+			destinatarios[i].tipo = model.NotificacionGanador
+		}
+	}
+	for i, d := range destinatarios {
+		if d.tipo == model.NotificacionGanador {
+			destinatarios[0], destinatarios[i] = destinatarios[i], destinatarios[0]
+			break
+		}
+	}
+	return destinatarios, len(sinEmail)
+}
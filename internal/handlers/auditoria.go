@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/metrics"
+	"PaymentsGo/internal/model"
+)
+
+const (
+	// capacidadAuditoria es cuántas entradas esperan al escritor; con el canal
+	// lleno se descartan en vez de frenar la petición
+	capacidadAuditoria = 1000
+	// maxLoteAuditoria es cuántas entradas van como mucho en un insert
+	maxLoteAuditoria = 100
+	plazoAuditoria   = 5 * time.Second
+)
+
+var auditoriasDescartadas = metrics.NewCounter("audit_log_dropped_total", "Entradas de audit_log perdidas por la cola llena o porque Supabase no las aceptó")
+
+type claveAdmin struct{}
+
+// conActorAdmin marca el contexto de una petición que pasó RequireAdmin con
+// la etiqueta de la clave que usó
+func conActorAdmin(ctx context.Context, etiqueta string) context.Context {
+	return context.WithValue(ctx, claveAdmin{}, etiqueta)
+}
+
+// actorDe deduce quién hace la acción: admin (con la etiqueta de su clave) si
+// pasó RequireAdmin, el usuario del JWT si hay uno y, si no, el sistema
+// (webhooks, barridos, workers)
+func actorDe(ctx context.Context) (string, string) {
+	if etiqueta, ok := ctx.Value(claveAdmin{}).(string); ok {
+		return model.ActorAdmin, etiqueta
+	}
+	if u := usuarioDe(ctx); u != nil {
+		return model.ActorUsuario, u.Sub
+	}
+	return model.ActorSistema, ""
+}
+
+// auditar deja la entrada en la cola de audit_log sin esperar a Supabase: si
+// la cola está llena la entrada se pierde y sólo queda en
+// audit_log_dropped_total, nunca rompe el flujo que la registra. Sin Actor se
+// usa actorDe.
+func (s *Server) auditar(ctx context.Context, entrada model.EntradaAuditoria) {
+	if entrada.Actor == "" {
+		entrada.Actor, entrada.ActorID = actorDe(ctx)
+	}
+	entrada.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	select {
+	case s.auditoria <- entrada:
+	default:
+		auditoriasDescartadas.Inc()
+		slog.WarnContext(ctx, "cola de auditoría llena, entrada descartada", "action", entrada.Action, "payment_intent_id", entrada.PaymentIntentID)
+	}
+}
+
+// auditarIntentCreado registra la compra recién guardada, de Stripe o de otro
+// proveedor, con actor el comprador que la pidió
+func (s *Server) auditarIntentCreado(ctx context.Context, compra *model.PurchaseDraft, proveedor string, moneda string) {
+	numeros := map[string][]int{}
+	for _, item := range itemsDeCompra(compra) {
+		numeros[item.RifaID] = item.Numeros
+	}
+	s.auditar(ctx, model.EntradaAuditoria{
+		Actor:           model.ActorUsuario,
+		ActorID:         compra.UserID,
+		Action:          model.AuditoriaIntentCreado,
+		RifaID:          compra.RifaID,
+		PaymentIntentID: compra.PaymentIntentID,
+		EntityID:        compra.ID,
+		Detail: map[string]interface{}{
+			"provider":   proveedor,
+			"numeros":    numeros,
+			"amount":     compra.Amount,
+			"currency":   moneda,
+			"promo_code": compra.PromoCode,
+			"discount":   compra.Discount,
+			"gift":       compra.RecipientEmail != "",
+		},
+	})
+}
+
+// IniciarAuditoria arranca el escritor de audit_log, que junta lo que haya en
+// la cola en inserts de hasta maxLoteAuditoria entradas. Para con ctx; lo que
+// quede en la cola lo escribe VaciarAuditoria.
+func (s *Server) IniciarAuditoria(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entrada := <-s.auditoria:
+				s.escribirAuditoria(ctx, s.loteAuditoria(entrada))
+			}
+		}
+	}()
+}
+
+// VaciarAuditoria escribe lo que quedó en la cola al apagar, después de los
+// correos en segundo plano, que también auditan
+func (s *Server) VaciarAuditoria(ctx context.Context) {
+	for {
+		select {
+		case entrada := <-s.auditoria:
+			s.escribirAuditoria(ctx, s.loteAuditoria(entrada))
+		default:
+			return
+		}
+	}
+}
+
+// loteAuditoria agrega a primera las entradas que ya esperan en la cola
+func (s *Server) loteAuditoria(primera model.EntradaAuditoria) []model.EntradaAuditoria {
+	lote := []model.EntradaAuditoria{primera}
+	for len(lote) < maxLoteAuditoria {
+		select {
+		case entrada := <-s.auditoria:
+			lote = append(lote, entrada)
+		default:
+			return lote
+		}
+	}
+	return lote
+}
+
+func (s *Server) escribirAuditoria(ctx context.Context, lote []model.EntradaAuditoria) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), plazoAuditoria)
+	defer cancel()
+	if err := s.db.RecordAuditEntries(ctx, lote); err != nil {
+		auditoriasDescartadas.Add(int64(len(lote)))
+		acciones := make([]string, len(lote))
+		for i, e := range lote {
+			acciones[i] = e.Action
+		}
+		slog.ErrorContext(ctx, "no se pudo escribir audit_log", logging.ConError(err, "entradas", len(lote), "acciones", acciones)...)
+	}
+}
+
+// AuditLogResponse es la respuesta de GET /admin/audit
+type AuditLogResponse struct {
+	Entries []model.EntradaAuditoria `json:"entries"`
+	Page    int                      `json:"page"`
+	Limit   int                      `json:"limit"`
+	HasMore bool                     `json:"hasMore"`
+}
+
+// ListAuditLog lista audit_log de lo más reciente a lo más viejo. Query
+// params: rifaId, from y to (AAAA-MM-DD o RFC 3339; to es exclusivo y una
+// fecha sola incluye el día entero), page y limit (máximo 500).
+func (s *Server) ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	pagina := enteroPositivo(q.Get("page"), 1)
+	limite := min(enteroPositivo(q.Get("limit"), 100), 500)
+	filtro := model.FiltroAuditoria{
+		RifaID: strings.TrimSpace(q.Get("rifaId")),
+		// Se pide uno de más para saber si hay otra página
+		Limit:  limite + 1,
+		Offset: (pagina - 1) * limite,
+	}
+	var ok bool
+	if filtro.Desde, ok = fechaFiltro(q.Get("from"), false); !ok {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "from debe ser AAAA-MM-DD o RFC 3339", Code: "INVALID_FILTER"})
+		return
+	}
+	if filtro.Hasta, ok = fechaFiltro(q.Get("to"), true); !ok {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "to debe ser AAAA-MM-DD o RFC 3339", Code: "INVALID_FILTER"})
+		return
+	}
+	if !filtro.Desde.IsZero() && !filtro.Hasta.IsZero() && !filtro.Desde.Before(filtro.Hasta) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "from debe ser anterior a to", Code: "INVALID_FILTER"})
+		return
+	}
+
+	entradas, err := s.db.ListAuditEntries(ctx, filtro)
+	if err != nil {
+		slog.ErrorContext(ctx, "error listando audit_log", logging.ConError(err, "rifa_id", filtro.RifaID)...)
+		http.Error(w, "Error listando la auditoría", 500)
+		return
+	}
+	hayMas := len(entradas) > limite
+	if hayMas {
+		entradas = entradas[:limite]
+	}
+	if entradas == nil {
+		entradas = []model.EntradaAuditoria{}
+	}
+	writeJSON(w, http.StatusOK, AuditLogResponse{Entries: entradas, Page: pagina, Limit: limite, HasMore: hayMas})
+}
+
+// fechaFiltro interpreta from/to; vacío no filtra. Una fecha sola es el
+// comienzo del día en UTC, o el del día siguiente si es el final del rango.
+func fechaFiltro(valor string, final bool) (time.Time, bool) {
+	if valor == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse(time.RFC3339, valor); err == nil {
+		return t, true
+	}
+	t, err := time.Parse(time.DateOnly, valor)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if final {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, true
+}
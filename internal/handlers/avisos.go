@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/avisos"
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+// avisarVenta deja en el outbox la venta confirmada, una entrada por canal: un
+// canal caído se reintenta solo, sin frenar al worker del webhook ni a los
+// otros canales.
+func (s *Server) avisarVenta(ctx context.Context, compra *model.PurchaseDraft, items []model.ItemCompra, monto int64, moneda stripe.Currency) error {
+	if len(s.avisos) == 0 {
+		return nil
+	}
+	titulos := make([]string, 0, len(items))
+	for _, item := range items {
+		titulos = append(titulos, item.RifaTitle)
+	}
+	venta := avisos.Venta{
+		Rifa:    strings.Join(titulos, ", "),
+		Numeros: totalNumeros(items),
+		Email:   logging.EnmascararEmail(compra.Email),
+		Monto:   payments.FormatearMonto(monto, string(moneda)),
+	}
+	texto := venta.Texto()
+
+	entradas := make([]model.OutboxEntry, 0, len(s.avisos))
+	for _, canal := range s.avisos {
+		clave := compra.PaymentIntentID + ":" + canal.Nombre()
+		entradas = append(entradas, nuevaSalida(ctx, salidaAvisoVenta, clave, "", datosAvisoSalida{Canal: canal.Nombre(), Texto: texto}))
+	}
+	if err := s.encolarSalidas(ctx, entradas...); err != nil {
+		slog.ErrorContext(ctx, "error encolando el aviso de venta", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		return err
+	}
+	return nil
+}
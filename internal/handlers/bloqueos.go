@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// maxEntradasBloqueos limita el cache: con muchos compradores distintos se
+// vacía entero en vez de crecer sin fin
+const maxEntradasBloqueos = 10000
+
+// cacheBloqueos recuerda por un rato si un (email, usuario) está en
+// blocked_buyers, para no consultar Supabase en cada create-intent. Se vacía
+// cuando este proceso agrega o quita un bloqueo; otra instancia lo ve al vencer.
+type cacheBloqueos struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[string]entradaBloqueo
+}
+
+type entradaBloqueo struct {
+	bloqueado bool
+	vence     time.Time
+}
+
+func nuevoCacheBloqueos(ttl time.Duration) *cacheBloqueos {
+	return &cacheBloqueos{ttl: ttl, items: make(map[string]entradaBloqueo)}
+}
+
+func (c *cacheBloqueos) obtener(clave string, ahora time.Time) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[clave]
+	if !ok || !ahora.Before(e.vence) {
+		return false, false
+	}
+	return e.bloqueado, true
+}
+
+func (c *cacheBloqueos) guardar(clave string, bloqueado bool, ahora time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.items) >= maxEntradasBloqueos {
+		c.items = make(map[string]entradaBloqueo)
+	}
+	c.items[clave] = entradaBloqueo{bloqueado: bloqueado, vence: ahora.Add(c.ttl)}
+}
+
+func (c *cacheBloqueos) invalidar() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]entradaBloqueo)
+}
+
+// normalizarEmailBloqueo es el email con que se guarda y se busca un bloqueo:
+// en minúsculas y, en Gmail, sin puntos ni +alias en la parte local, que
+// Gmail ignora (Juan.Perez+rifa@gmail.com es juanperez@gmail.com)
+func normalizarEmailBloqueo(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	local, dominio, ok := strings.Cut(email, "@")
+	if !ok {
+		return email
+	}
+	if dominio != "gmail.com" && dominio != "googlemail.com" {
+		return email
+	}
+	local, _, _ = strings.Cut(local, "+")
+	return strings.ReplaceAll(local, ".", "") + "@gmail.com"
+}
+
+// compradorBloqueado consulta blocked_buyers pasando por el cache; los errores
+// de Supabase no se guardan
+func (s *Server) compradorBloqueado(ctx context.Context, email string, userID string) (bool, error) {
+	email = normalizarEmailBloqueo(email)
+	clave := email + "|" + userID
+	ahora := time.Now()
+	if bloqueado, ok := s.bloqueos.obtener(clave, ahora); ok {
+		return bloqueado, nil
+	}
+	bloqueado, err := s.db.IsBuyerBlocked(ctx, email, userID)
+	if err != nil {
+		return false, err
+	}
+	s.bloqueos.guardar(clave, bloqueado, ahora)
+	return bloqueado, nil
+}
+
+// verificarCompradorNoBloqueado responde 403 BUYER_BLOCKED si el comprador
+// está en blocked_buyers. Devuelve false si ya respondió con un error.
+func (s *Server) verificarCompradorNoBloqueado(ctx context.Context, w http.ResponseWriter, req *model.PaymentRequest) bool {
+	bloqueado, err := s.compradorBloqueado(ctx, req.Email, req.UserId)
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando compradores bloqueados", logging.ConError(err, "rifa_id", req.RifaID)...)
+		responderDisponibilidadNoVerificada(w, err)
+		return false
+	}
+	if bloqueado {
+		slog.WarnContext(ctx, "compra de un comprador bloqueado", "rifa_id", req.RifaID, "user_id", req.UserId, "email", logging.EnmascararEmail(req.Email))
+		writeJSON(w, http.StatusForbidden, model.ErrorResponse{
+			Error: "No puedes hacer compras. Contacta al organizador.",
+			Code:  "BUYER_BLOCKED",
+		})
+		return false
+	}
+	return true
+}
+
+// bloquearComprador guarda el bloqueo con el email normalizado, vacía el cache
+// y lo audita, sea a mano o por una disputa
+func (s *Server) bloquearComprador(ctx context.Context, bloqueo *model.CompradorBloqueado) error {
+	bloqueo.Email = normalizarEmailBloqueo(bloqueo.Email)
+	if err := s.db.BlockBuyer(ctx, bloqueo); err != nil {
+		return err
+	}
+	s.bloqueos.invalidar()
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaBloqueo,
+		PaymentIntentID: bloqueo.PaymentIntentID,
+		Detail:          map[string]interface{}{"email": bloqueo.Email, "user_id": bloqueo.UserID, "reason": bloqueo.Reason},
+	})
+	return nil
+}
+
+// BlockBuyerRequest es el cuerpo de POST /admin/blocklist
+type BlockBuyerRequest struct {
+	Email  string `json:"email"`
+	UserID string `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+// BlocklistResponse es la respuesta de GET /admin/blocklist
+type BlocklistResponse struct {
+	Buyers []model.CompradorBloqueado `json:"buyers"`
+	Count  int                        `json:"count"`
+}
+
+// ListBlockedBuyers lista los bloqueos, los más recientes primero; ?email=
+// filtra por comprador con la misma normalización que el chequeo
+func (s *Server) ListBlockedBuyers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ""
+	if e := r.URL.Query().Get("email"); e != "" {
+		email = normalizarEmailBloqueo(e)
+	}
+	bloqueos, err := s.db.ListBlockedBuyers(ctx, email)
+	if err != nil {
+		slog.ErrorContext(ctx, "error listando compradores bloqueados", logging.ConError(err)...)
+		http.Error(w, "Error listando bloqueos", 500)
+		return
+	}
+	if bloqueos == nil {
+		bloqueos = []model.CompradorBloqueado{}
+	}
+	writeJSON(w, http.StatusOK, BlocklistResponse{Buyers: bloqueos, Count: len(bloqueos)})
+}
+
+// BlockBuyer bloquea a mano un email, un usuario o los dos
+func (s *Server) BlockBuyer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req BlockBuyerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	req.UserID = strings.TrimSpace(req.UserID)
+	if req.Email == "" && req.UserID == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta email o userId", Code: "BUYER_REQUIRED"})
+		return
+	}
+	if req.Email != "" && !emailValido(req.Email) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El email no es válido", Code: "INVALID_EMAIL"})
+		return
+	}
+	motivo := strings.TrimSpace(req.Reason)
+	if motivo == "" {
+		motivo = "manual"
+	}
+
+	bloqueo := &model.CompradorBloqueado{Email: req.Email, UserID: req.UserID, Reason: motivo}
+	if err := s.bloquearComprador(ctx, bloqueo); err != nil {
+		slog.ErrorContext(ctx, "error bloqueando comprador", logging.ConError(err, "user_id", req.UserID, "email", logging.EnmascararEmail(req.Email))...)
+		http.Error(w, "Error bloqueando al comprador", 500)
+		return
+	}
+	slog.InfoContext(ctx, "comprador bloqueado a mano", "user_id", bloqueo.UserID, "email", logging.EnmascararEmail(bloqueo.Email), "reason", motivo)
+	writeJSON(w, http.StatusCreated, bloqueo)
+}
+
+// UnblockBuyer borra un bloqueo por su id
+func (s *Server) UnblockBuyer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "id inválido", Code: "INVALID_ID"})
+		return
+	}
+	borrado, err := s.db.UnblockBuyer(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, "error desbloqueando comprador", logging.ConError(err, "id", id)...)
+		http.Error(w, "Error desbloqueando al comprador", 500)
+		return
+	}
+	if !borrado {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "Bloqueo no encontrado", Code: "NOT_FOUND"})
+		return
+	}
+	s.bloqueos.invalidar()
+	slog.InfoContext(ctx, "comprador desbloqueado", "id", id)
+	s.auditar(ctx, model.EntradaAuditoria{Action: model.AuditoriaDesbloqueo, EntityID: strconv.FormatInt(id, 10)})
+	w.WriteHeader(http.StatusNoContent)
+}
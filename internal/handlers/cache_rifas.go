@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// ttlRifaNoEncontrada es cuánto se recuerda un 404: corto, para que una rifa
+// recién creada aparezca enseguida
+const ttlRifaNoEncontrada = 5 * time.Second
+
+// cacheRifas guarda en memoria las rifas que leen los endpoints públicos
+// (cotizar, crear el intent, ver los números). Una entrada sin rifa es una
+// rifa que no existe. Los errores de Supabase no se guardan.
+type cacheRifas struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[string]entradaRifa
+}
+
+type entradaRifa struct {
+	rifa  *model.Rifa
+	vence time.Time
+}
+
+func nuevoCacheRifas(ttl time.Duration) *cacheRifas {
+	return &cacheRifas{ttl: ttl, items: make(map[string]entradaRifa)}
+}
+
+// obtener devuelve una copia, así quien la recibe puede modificarla sin tocar
+// la del cache
+func (c *cacheRifas) obtener(id string, ahora time.Time) (*model.Rifa, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok || !ahora.Before(e.vence) {
+		return nil, false
+	}
+	if e.rifa == nil {
+		return nil, true
+	}
+	rifa := *e.rifa
+	return &rifa, true
+}
+
+func (c *cacheRifas) guardar(id string, rifa *model.Rifa, ahora time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rifa == nil {
+		c.items[id] = entradaRifa{vence: ahora.Add(ttlRifaNoEncontrada)}
+		return
+	}
+	copia := *rifa
+	c.items[id] = entradaRifa{rifa: &copia, vence: ahora.Add(c.ttl)}
+}
+
+// invalidar borra la rifa del cache, o todas si id está vacío. Devuelve cuántas borró.
+func (c *cacheRifas) invalidar(id string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == "" {
+		n := len(c.items)
+		c.items = make(map[string]entradaRifa)
+		return n
+	}
+	if _, ok := c.items[id]; !ok {
+		return 0
+	}
+	delete(c.items, id)
+	return 1
+}
+
+// rifa lee la rifa pasando por el cache; un ErrRifaNoEncontrada también se
+// guarda, con ttlRifaNoEncontrada
+func (s *Server) rifa(ctx context.Context, id string) (*model.Rifa, error) {
+	ahora := time.Now()
+	if rifa, ok := s.rifas.obtener(id, ahora); ok {
+		if rifa == nil {
+			return nil, model.ErrRifaNoEncontrada
+		}
+		return rifa, nil
+	}
+	rifa, err := s.db.GetRifa(ctx, id)
+	switch {
+	case err == nil:
+		s.rifas.guardar(id, rifa, ahora)
+	case errors.Is(err, model.ErrRifaNoEncontrada):
+		s.rifas.guardar(id, nil, ahora)
+	}
+	return rifa, err
+}
+
+// refrescarRifa vuelve a leer la rifa de Supabase y la deja en el cache. La
+// usan los chequeos que están por rechazar una compra con datos de la rifa
+// (cerrada, límite por usuario) por si el cache quedó viejo después de
+// editarla. Devuelve false si la lectura falla; el chequeo sigue con la que tenía.
+func (s *Server) refrescarRifa(ctx context.Context, rifa *model.Rifa) bool {
+	s.rifas.invalidar(rifa.ID)
+	fresca, err := s.rifa(ctx, rifa.ID)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo refrescar la rifa", logging.ConError(err, "rifa_id", rifa.ID)...)
+		return false
+	}
+	*rifa = *fresca
+	return true
+}
+
+// InvalidateCacheRequest es el cuerpo (opcional) de POST /admin/cache/invalidate.
+// Sin rifaId se vacía todo el cache.
+type InvalidateCacheRequest struct {
+	RifaID string `json:"rifaId"`
+}
+
+// InvalidateCache borra rifas del cache, p. ej. después de editar un precio
+func (s *Server) InvalidateCache(w http.ResponseWriter, r *http.Request) {
+	var req InvalidateCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+	n := s.rifas.invalidar(req.RifaID)
+	slog.InfoContext(r.Context(), "cache de rifas invalidado", "rifa_id", req.RifaID, "invalidadas", n)
+	s.auditar(r.Context(), model.EntradaAuditoria{
+		Action: model.AuditoriaCacheInvalidado,
+		RifaID: req.RifaID,
+		Detail: map[string]interface{}{"invalidated": n},
+	})
+	writeJSON(w, http.StatusOK, map[string]int{"invalidated": n})
+}
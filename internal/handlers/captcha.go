@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"PaymentsGo/internal/captcha"
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// verificarCaptcha valida req.CaptchaToken antes de crear el intent. Un token
+// que falta o que el proveedor rechaza responde 403 CAPTCHA_FAILED; si
+// siteverify no responde decide CAPTCHA_ON_ERROR. Sin captcha configurado
+// devuelve nil y true. Devuelve false si ya respondió con un error.
+func (s *Server) verificarCaptcha(w http.ResponseWriter, r *http.Request, req *model.PaymentRequest) (*captcha.Resultado, bool) {
+	if s.captcha == nil {
+		return nil, true
+	}
+	ctx := r.Context()
+	resultado, err := s.captcha.Verificar(ctx, req.CaptchaToken, s.ipCliente(r))
+	var invalido *captcha.ErrTokenInvalido
+	switch {
+	case errors.As(err, &invalido):
+		args := []any{"rifa_id", req.RifaID, "email", logging.EnmascararEmail(req.Email), "codes", invalido.Codigos}
+		if resultado != nil {
+			args = append(args, "hostname", resultado.Hostname, "score", resultado.Score)
+		}
+		slog.WarnContext(ctx, "captcha rechazado", args...)
+		writeJSON(w, http.StatusForbidden, model.ErrorResponse{Error: "No pudimos verificar que no eres un robot, intenta de nuevo", Code: "CAPTCHA_FAILED"})
+		return nil, false
+	case err != nil && s.cfg.CaptchaFailOpen:
+		slog.WarnContext(ctx, "captcha sin verificar, se acepta la compra", logging.ConError(err, "rifa_id", req.RifaID)...)
+		return nil, true
+	case err != nil:
+		slog.ErrorContext(ctx, "captcha sin verificar", logging.ConError(err, "rifa_id", req.RifaID)...)
+		writeJSON(w, http.StatusServiceUnavailable, model.ErrorResponse{Error: "No pudimos verificar el captcha, intenta en unos minutos", Code: "CAPTCHA_UNAVAILABLE"})
+		return nil, false
+	}
+	slog.InfoContext(ctx, "captcha verificado", "rifa_id", req.RifaID, "provider", resultado.Proveedor, "hostname", resultado.Hostname, "score", resultado.Score, "action", resultado.Action)
+	return resultado, true
+}
+
+// metadataCaptcha deja el resultado en la metadata del intent para revisar
+// fraudes desde Stripe; sin resultado (captcha apagado o sin verificar) no
+// agrega nada
+func metadataCaptcha(metadata map[string]string, resultado *captcha.Resultado) map[string]string {
+	if resultado == nil {
+		return metadata
+	}
+	metadata["captcha_provider"] = resultado.Proveedor
+	metadata["captcha_hostname"] = resultado.Hostname
+	if resultado.TieneScore {
+		metadata["captcha_score"] = strconv.FormatFloat(resultado.Score, 'f', 1, 64)
+	}
+	return metadata
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/store"
+	"PaymentsGo/internal/tracing"
+)
+
+// ProblemaItem explica por qué una rifa del carrito no se puede comprar; va en
+// los Details de CART_CONFLICT
+type ProblemaItem struct {
+	RifaID     string                  `json:"rifaId"`
+	Code       string                  `json:"code"`
+	Error      string                  `json:"error"`
+	Numeros    []int                   `json:"numeros,omitempty"`
+	Rechazados []model.NumeroRechazado `json:"rechazados,omitempty"`
+}
+
+// itemsDeCompra devuelve las rifas de la compra; las compras de una sola rifa
+// no guardan items y se ven como un carrito de un elemento
+func itemsDeCompra(compra *model.PurchaseDraft) []model.ItemCompra {
+	if len(compra.Items) > 0 {
+		return compra.Items
+	}
+	return []model.ItemCompra{{
+		RifaID:     compra.RifaID,
+		RifaTitle:  compra.RifaTitle,
+		Numeros:    compra.Numeros,
+		Amount:     compra.Amount,
+		TierMinQty: compra.TierMinQty,
+		UnitPrice:  compra.UnitPrice,
+	}}
+}
+
+func totalNumeros(items []model.ItemCompra) int {
+	total := 0
+	for _, item := range items {
+		total += len(item.Numeros)
+	}
+	return total
+}
+
+// crearIntentCarrito es CreatePaymentIntent para un carrito: valida cada rifa
+// por separado y, si alguna no se puede comprar, rechaza todo con 409
+// CART_CONFLICT y el detalle por rifa. No admite números al azar.
+func (s *Server) crearIntentCarrito(w http.ResponseWriter, r *http.Request, req *model.PaymentRequest) {
+	ctx := r.Context()
+	if req.Installments > 1 {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Un carrito no se puede pagar en cuotas", Code: "INSTALLMENTS_NOT_AVAILABLE"})
+		return
+	}
+
+	total := 0
+	for _, item := range req.Items {
+		total += len(item.Numeros)
+	}
+	if max := s.cfg.MaxNumerosPerPurchase; total > max {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error:   fmt.Sprintf("Máximo %d números por compra", max),
+			Code:    "TOO_MANY_NUMBERS",
+			Details: map[string]int{"max": max, "recibidos": total},
+		})
+		return
+	}
+
+	var problemas []ProblemaItem
+	rifas := make([]*model.Rifa, len(req.Items))
+	vistas := map[string]bool{}
+	for i, item := range req.Items {
+		switch {
+		case vistas[item.RifaID]:
+			problemas = append(problemas, ProblemaItem{RifaID: item.RifaID, Code: "DUPLICATE_RIFA", Error: "La rifa está más de una vez en el carrito"})
+			continue
+		case len(item.Numeros) == 0:
+			problemas = append(problemas, ProblemaItem{RifaID: item.RifaID, Code: "EMPTY_SELECTION", Error: "Debes seleccionar al menos un número"})
+			continue
+		}
+		vistas[item.RifaID] = true
+
+		rifa, err := s.rifa(ctx, item.RifaID)
+		if errors.Is(err, model.ErrRifaNoEncontrada) {
+			problemas = append(problemas, ProblemaItem{RifaID: item.RifaID, Code: "RIFA_NOT_FOUND", Error: "Rifa no encontrada"})
+			continue
+		}
+		if err != nil {
+			responderErrorRifa(ctx, w, item.RifaID, err)
+			return
+		}
+		rifas[i] = rifa
+	}
+	if len(problemas) > 0 {
+		responderConflictoCarrito(ctx, w, problemas)
+		return
+	}
+
+	// El comprador tiene que poder comprar en todas las rifas (p. ej. un
+	// invitado sólo si todas lo permiten)
+	for _, rifa := range rifas {
+		if !s.identificarComprador(w, r, req, rifa) {
+			return
+		}
+	}
+	req.RifaID = rifas[0].ID
+	if !s.verificarCompradorNoBloqueado(ctx, w, req) {
+		return
+	}
+	if !s.verificarEmailComprador(ctx, w, req) {
+		return
+	}
+	resultadoCaptcha, ok := s.verificarCaptcha(w, r, req)
+	if !ok {
+		return
+	}
+	if !s.validarRegalo(ctx, w, req) {
+		return
+	}
+	if !s.validarReferido(ctx, w, req) {
+		return
+	}
+
+	moneda := payments.NormalizarMoneda(rifas[0].Currency)
+	for _, rifa := range rifas[1:] {
+		if payments.NormalizarMoneda(rifa.Currency) != moneda {
+			slog.InfoContext(ctx, "carrito con monedas distintas", "rifa_id", rifa.ID, "currency", rifa.Currency, "esperada", moneda)
+			writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+				Error: "Todas las rifas del carrito deben cobrarse en la misma moneda",
+				Code:  "MIXED_CURRENCIES",
+			})
+			return
+		}
+		// Un intent tiene un solo destino: no se puede repartir entre organizadores
+		if rifa.OrganizerStripeAccount != rifas[0].OrganizerStripeAccount {
+			slog.InfoContext(ctx, "carrito con organizadores distintos", "rifa_id", rifa.ID, "organizer_account", rifa.OrganizerStripeAccount, "esperada", rifas[0].OrganizerStripeAccount)
+			writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+				Error: "Todas las rifas del carrito deben ser del mismo organizador",
+				Code:  "MIXED_ORGANIZERS",
+			})
+			return
+		}
+	}
+
+	var montoTotal int64
+	items := make([]model.ItemCompra, len(rifas))
+	titulos := make([]string, len(rifas))
+	for i, rifa := range rifas {
+		cotizacion, ok := s.cotizar(ctx, w, rifa, len(req.Items[i].Numeros))
+		if !ok {
+			return
+		}
+		if montoTotal > math.MaxInt64-cotizacion.Amount {
+			slog.ErrorContext(ctx, "error calculando el monto", logging.ConError(payments.ErrMontoDesbordado, "rifa_id", rifa.ID)...)
+			http.Error(w, "Error calculando el monto", 500)
+			return
+		}
+		montoTotal += cotizacion.Amount
+		items[i] = model.ItemCompra{
+			RifaID:     rifa.ID,
+			RifaTitle:  rifa.Title,
+			Numeros:    req.Items[i].Numeros,
+			Amount:     cotizacion.Amount,
+			TierMinQty: cotizacion.tramoMinimo(),
+			UnitPrice:  cotizacion.PricePerNumber,
+		}
+		titulos[i] = rifa.Title
+	}
+
+	var descuento int64
+	if req.PromoCode != "" {
+		rifaIDs := make([]string, len(items))
+		for i, item := range items {
+			rifaIDs[i] = item.RifaID
+		}
+		codigo, ok := s.cargarCodigoPromo(ctx, w, req.PromoCode, rifaIDs)
+		if !ok {
+			return
+		}
+		descuento = aplicarCodigoCarrito(codigo, items)
+		montoTotal -= descuento
+		slog.InfoContext(ctx, "código promocional aplicado", "rifa_id", req.RifaID, "code", req.PromoCode, "discount", descuento, "amount", montoTotal)
+	}
+	if !verificarMontoMinimo(ctx, w, montoTotal, moneda) {
+		return
+	}
+
+	claveIdempotencia := claveIdempotenciaCarrito(r.Header.Get("Idempotency-Key"), req)
+	compraID := uuidDesdeClave(claveIdempotencia)
+	// Un reintento del mismo carrito recibe el mismo clientSecret; sus propias
+	// reservas harían que CheckNumbers reporte los números como ocupados
+	if _, ok := s.compraGratisPrevia(ctx, compraID); ok && montoTotal == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"free": true, "reused": true})
+		return
+	}
+	if compra, secreto, ok := s.compraReutilizablePorID(ctx, compraID); ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"clientSecret": secreto, "expiresAt": compra.ExpiresAt, "reused": true})
+		return
+	}
+
+	for i, rifa := range rifas {
+		problema, err := s.problemaItem(ctx, rifa, items[i].Numeros, req.UserId)
+		if err != nil {
+			slog.ErrorContext(ctx, "error validando el carrito", logging.ConError(err, "rifa_id", rifa.ID)...)
+			responderDisponibilidadNoVerificada(w, err)
+			return
+		}
+		if problema != nil {
+			problemas = append(problemas, *problema)
+		}
+	}
+	if len(problemas) > 0 {
+		responderConflictoCarrito(ctx, w, problemas)
+		return
+	}
+
+	titulo := strings.Join(titulos, ", ")
+	pi := intentGratis(compraID, moneda)
+	if montoTotal > 0 {
+		params := s.paramsIntent(montoTotal, moneda, req.Email, titulo, metadataCaptcha(s.metadataRiesgo(r, req.UserId, map[string]string{
+			"rifa_id":            req.RifaID,
+			"purchase_intent_id": compraID,
+		}), resultadoCaptcha))
+		s.cobrarParaOrganizador(params, rifas[0].OrganizerStripeAccount, montoTotal)
+		params.SetIdempotencyKey(claveIdempotencia)
+
+		var err error
+		if pi, err = s.pagos.CreateIntent(ctx, params); err != nil {
+			slog.ErrorContext(ctx, "error creando PaymentIntent", logging.ConError(err, "rifa_id", req.RifaID, "rifas", len(items))...)
+			responderErrorCreacionIntent(w, err, moneda)
+			return
+		}
+	}
+
+	// Todas las rifas se reservan con el mismo intent; si una falla se liberan
+	// las que ya se reservaron y el intent se cancela
+	for _, item := range items {
+		err := s.reservarNumeros(ctx, item.RifaID, item.Numeros, req.UserId, pi.ID)
+		if err == nil {
+			continue
+		}
+		s.deshacerIntent(ctx, pi.ID)
+		var conflicto *model.ErrNumerosOcupados
+		if errors.As(err, &conflicto) {
+			responderConflictoCarrito(ctx, w, []ProblemaItem{{
+				RifaID:  item.RifaID,
+				Code:    "NUMBERS_TAKEN",
+				Error:   "Algunos números ya no están disponibles",
+				Numeros: conflicto.Numeros,
+			}})
+			return
+		}
+		if errors.Is(err, model.ErrDisponibilidadNoVerificada) {
+			slog.ErrorContext(ctx, "error verificando conflicto de reserva", logging.ConError(err, "rifa_id", item.RifaID, "payment_intent_id", pi.ID)...)
+			responderDisponibilidadNoVerificada(w, err)
+			return
+		}
+		slog.ErrorContext(ctx, "error reservando números", logging.ConError(err, "rifa_id", item.RifaID, "payment_intent_id", pi.ID)...)
+		http.Error(w, "Error reservando números", 500)
+		return
+	}
+	if !s.reservarCanjeOCancelar(ctx, w, req.PromoCode, pi.ID) {
+		return
+	}
+
+	compra := &model.PurchaseDraft{
+		ID:              compraID,
+		PaymentIntentID: pi.ID,
+		RifaID:          req.RifaID,
+		RifaTitle:       titulo,
+		UserID:          req.UserId,
+		Email:           req.Email,
+		Amount:          montoTotal,
+		ExpiresAt:       time.Now().UTC().Add(s.cfg.ReservationTTL).Format(time.RFC3339),
+		Items:           items,
+		PromoCode:       req.PromoCode,
+		ReferralCode:    req.ReferralCode,
+		Discount:        descuento,
+		RecipientEmail:  req.RecipientEmail,
+		RecipientName:   req.RecipientName,
+		Locale:          mail.ElegirIdioma(req.Locale),
+	}
+	if err := s.db.SavePurchaseDraft(ctx, compra); err != nil {
+		slog.ErrorContext(ctx, "error guardando la compra", logging.ConError(err, "rifa_id", req.RifaID, "payment_intent_id", pi.ID)...)
+		s.deshacerIntent(ctx, pi.ID)
+		http.Error(w, "Error guardando la compra", 500)
+		return
+	}
+	s.auditarIntentCreado(ctx, compra, model.ProveedorStripe, string(moneda))
+
+	if esIntentGratis(pi.ID) {
+		if s.completarCompraGratis(ctx, w, compra, moneda) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"free": true})
+		}
+		return
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(tracing.RifaID.String(req.RifaID), tracing.PaymentIntentID.String(pi.ID))
+	slog.InfoContext(ctx, "intent de carrito creado", "rifa_id", req.RifaID, "rifas", len(items), "payment_intent_id", pi.ID, "email", logging.EnmascararEmail(req.Email), "amount", montoTotal, "currency", moneda)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clientSecret": pi.ClientSecret, "expiresAt": compra.ExpiresAt})
+}
+
+// problemaItem hace con una rifa del carrito las mismas validaciones que la
+// compra de una sola rifa, pero sin responder: devuelve el problema o nil. El
+// error es sólo para fallos al consultar la disponibilidad.
+func (s *Server) problemaItem(ctx context.Context, rifa *model.Rifa, numeros []int, userID string) (*ProblemaItem, error) {
+	if !rifaAbierta(rifa, time.Now()) {
+		return &ProblemaItem{RifaID: rifa.ID, Code: "RIFA_CLOSED", Error: "Esta rifa ya no está a la venta"}, nil
+	}
+	if !proveedorPermitido(rifa, model.ProveedorStripe) {
+		return &ProblemaItem{RifaID: rifa.ID, Code: "PROVIDER_NOT_ALLOWED", Error: "Esta rifa no acepta este medio de pago"}, nil
+	}
+	if rechazados := validarSeleccion(rifa, numeros); len(rechazados) > 0 {
+		return &ProblemaItem{RifaID: rifa.ID, Code: "INVALID_NUMBERS", Error: "Algunos números no son válidos", Rechazados: rechazados}, nil
+	}
+
+	vendidos, err := s.db.SoldNumbers(ctx, rifa.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(vendidos) >= rifa.TotalNumbers {
+		return &ProblemaItem{RifaID: rifa.ID, Code: "RIFA_SOLD_OUT", Error: "Ya se vendieron todos los números de esta rifa"}, nil
+	}
+	ocupados, err := s.db.CheckNumbers(ctx, rifa.ID, numeros)
+	if err != nil {
+		return nil, err
+	}
+	if len(ocupados) > 0 {
+		return &ProblemaItem{RifaID: rifa.ID, Code: "NUMBERS_TAKEN", Error: "Algunos números ya no están disponibles", Numeros: ocupados}, nil
+	}
+
+	restantes, err := s.numerosRestantesUsuario(ctx, rifa, userID, "")
+	if err != nil {
+		return nil, err
+	}
+	if restantes >= 0 && len(numeros) > restantes {
+		return &ProblemaItem{RifaID: rifa.ID, Code: "LIMIT_EXCEEDED", Error: fmt.Sprintf("Sólo puedes comprar %d números más en esta rifa", restantes)}, nil
+	}
+	return nil, nil
+}
+
+func responderConflictoCarrito(ctx context.Context, w http.ResponseWriter, problemas []ProblemaItem) {
+	slog.InfoContext(ctx, "carrito rechazado", "rifas_con_problemas", len(problemas), "code", problemas[0].Code)
+	writeJSON(w, http.StatusConflict, model.ErrorResponse{
+		Error:   "Algunas rifas del carrito no se pueden comprar",
+		Code:    "CART_CONFLICT",
+		Details: map[string][]ProblemaItem{"items": problemas},
+	})
+}
+
+// claveIdempotenciaCarrito es claveIdempotenciaCompra para un carrito: mezcla
+// el comprador y cada rifa con sus números, en orden, así el mismo carrito
+// armado en otro orden da la misma clave
+func claveIdempotenciaCarrito(cabecera string, req *model.PaymentRequest) string {
+	comprador := req.UserId
+	if comprador == "" {
+		comprador = strings.ToLower(req.Email)
+	}
+	partes := make([]string, len(req.Items))
+	for i, item := range req.Items {
+		numeros := append([]int(nil), item.Numeros...)
+		sort.Ints(numeros)
+		partes[i] = item.RifaID + ":" + store.ListaNumeros(numeros)
+	}
+	sort.Strings(partes)
+
+	base := comprador + "|carrito|" + strings.Join(partes, ";")
+	if req.PromoCode != "" {
+		base += "|promo:" + req.PromoCode
+	}
+	if req.RecipientEmail != "" {
+		base += "|regalo:" + strings.ToLower(req.RecipientEmail)
+	}
+	if cabecera != "" {
+		base = "cabecera:" + cabecera + "|" + base
+	} else {
+		base = fmt.Sprintf("auto:%d|%s", time.Now().Unix()/300, base)
+	}
+	suma := sha256.Sum256([]byte(base))
+	return "create-intent-" + hex.EncodeToString(suma[:])
+}
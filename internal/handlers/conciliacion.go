@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/tracing"
+)
+
+// IntentSinTickets es un intent cobrado en Stripe que no tiene tickets en Supabase
+type IntentSinTickets struct {
+	PaymentIntentID string `json:"paymentIntentId"`
+	RifaID          string `json:"rifaId"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	CreatedAt       string `json:"createdAt"`
+	// Fixed y FixError sólo vienen con ?fix=true
+	Fixed    bool   `json:"fixed,omitempty"`
+	FixError string `json:"fixError,omitempty"`
+}
+
+// TicketsSinPago son los tickets vigentes de un intent que en Stripe no está
+// cobrado; StripeStatus es "refunded" si el cargo se devolvió y "missing" si
+// Stripe no conoce el intent
+type TicketsSinPago struct {
+	PaymentIntentID string   `json:"paymentIntentId"`
+	StripeStatus    string   `json:"stripeStatus"`
+	RifaIDs         []string `json:"rifaIds"`
+	TicketIDs       []int64  `json:"ticketIds"`
+}
+
+// ReconcileReport es la respuesta de POST /admin/reconcile
+type ReconcileReport struct {
+	Since            string             `json:"since"`
+	CheckedIntents   int                `json:"checkedIntents"`
+	CheckedTickets   int                `json:"checkedTickets"`
+	PaidUnregistered []IntentSinTickets `json:"paidUnregistered"`
+	RegisteredUnpaid []TicketsSinPago   `json:"registeredUnpaid"`
+	Fixed            int                `json:"fixed"`
+}
+
+// Reconcile compara los intents de rifas creados en Stripe desde
+// ?since=AAAA-MM-DD con los tickets registrados desde esa fecha, para
+// encontrar pagos que el webhook no llegó a registrar y tickets cuyo pago no
+// está cobrado. Con ?fix=true registra los que faltan desde el borrador de la
+// compra. El reporte también se manda a ORGANIZER_EMAIL.
+func (s *Server) Reconcile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	desde, err := time.Parse(time.DateOnly, r.URL.Query().Get("since"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error: "since debe ser una fecha AAAA-MM-DD",
+			Code:  "INVALID_SINCE",
+		})
+		return
+	}
+	arreglar := r.URL.Query().Get("fix") == "true"
+
+	reporte, err := s.conciliar(ctx, desde, arreglar)
+	if err != nil {
+		slog.ErrorContext(ctx, "error conciliando pagos", logging.ConError(err, "since", reporte.Since)...)
+		http.Error(w, "Error conciliando pagos", 500)
+		return
+	}
+	slog.InfoContext(ctx, "conciliación completada", "since", reporte.Since, "intents", reporte.CheckedIntents, "tickets", reporte.CheckedTickets,
+		"pagados_sin_tickets", len(reporte.PaidUnregistered), "tickets_sin_pago", len(reporte.RegisteredUnpaid), "arreglados", reporte.Fixed)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action: model.AuditoriaConciliacion,
+		Detail: map[string]interface{}{
+			"since":             reporte.Since,
+			"fix":               arreglar,
+			"checked_intents":   reporte.CheckedIntents,
+			"checked_tickets":   reporte.CheckedTickets,
+			"paid_unregistered": len(reporte.PaidUnregistered),
+			"registered_unpaid": len(reporte.RegisteredUnpaid),
+			"fixed":             reporte.Fixed,
+		},
+	})
+
+	enSegundoPlano(ctx, func(ctx context.Context) {
+		if err := s.enviarReporteConciliacion(ctx, reporte); err != nil {
+			slog.WarnContext(ctx, "error enviando el reporte de conciliación", logging.ConError(err)...)
+		}
+	})
+	writeJSON(w, http.StatusOK, reporte)
+}
+
+// conciliar arma el reporte de Reconcile. Los intents cobrados sin tickets
+// vigentes se confirman con PaymentIntentTickets, que también ve los
+// reembolsados; los tickets de intents que no salieron en la lista (p. ej. un
+// OXXO creado antes de desde y pagado después) se consultan uno por uno.
+func (s *Server) conciliar(ctx context.Context, desde time.Time, arreglar bool) (_ *ReconcileReport, err error) {
+	ctx, span := tracer.Start(ctx, "conciliar")
+	defer func() { tracing.Fin(span, err) }()
+
+	reporte := &ReconcileReport{
+		Since:            desde.Format(time.DateOnly),
+		PaidUnregistered: []IntentSinTickets{},
+		RegisteredUnpaid: []TicketsSinPago{},
+	}
+
+	vendidos, err := s.db.TicketsSoldSince(ctx, desde)
+	if err != nil {
+		return reporte, fmt.Errorf("tickets: %w", err)
+	}
+	porIntent := map[string][]model.TicketVendido{}
+	for _, t := range vendidos {
+		// Las compras gratis, las ventas manuales, PayPal y MercadoPago no pasan por Stripe
+		if t.PaymentIntentID == "" || esIntentGratis(t.PaymentIntentID) || esPagoManual(t.PaymentIntentID) || esPagoPayPal(t.PaymentIntentID) || esPagoMercadoPago(t.PaymentIntentID) {
+			continue
+		}
+		porIntent[t.PaymentIntentID] = append(porIntent[t.PaymentIntentID], t)
+	}
+	reporte.CheckedTickets = len(vendidos)
+
+	params := &stripe.PaymentIntentListParams{CreatedRange: &stripe.RangeQueryParams{GreaterThanOrEqual: desde.Unix()}}
+	params.Limit = stripe.Int64(100)
+	params.AddExpand("data.latest_charge")
+	listados := map[string]*stripe.PaymentIntent{}
+	var sinTickets []*stripe.PaymentIntent
+	err = s.pagos.ListIntents(ctx, params, func(pi *stripe.PaymentIntent) error {
+		if pi.Metadata["rifa_id"] == "" || esCuotaPosterior(pi) {
+			// La cuenta de Stripe puede tener cobros que no son de rifas, y las
+			// cuotas posteriores abonan a los tickets de la primera
+			return nil
+		}
+		reporte.CheckedIntents++
+		listados[pi.ID] = pi
+		if estadoCobro(pi) == string(stripe.PaymentIntentStatusSucceeded) && len(porIntent[pi.ID]) == 0 {
+			sinTickets = append(sinTickets, pi)
+		}
+		return nil
+	})
+	if err != nil {
+		return reporte, fmt.Errorf("stripe: %w", err)
+	}
+
+	for _, pi := range sinTickets {
+		tickets, err := s.db.PaymentIntentTickets(ctx, pi.ID)
+		if err != nil {
+			return reporte, fmt.Errorf("tickets del intent %s: %w", pi.ID, err)
+		}
+		if len(tickets) > 0 {
+			continue
+		}
+		faltante := IntentSinTickets{
+			PaymentIntentID: pi.ID,
+			RifaID:          pi.Metadata["rifa_id"],
+			Amount:          pi.Amount,
+			Currency:        string(pi.Currency),
+			CreatedAt:       time.Unix(pi.Created, 0).UTC().Format(time.RFC3339),
+		}
+		if arreglar {
+			if err := s.registrarFaltante(ctx, pi); err != nil {
+				slog.WarnContext(ctx, "la conciliación no pudo registrar los tickets", logging.ConError(err, "payment_intent_id", pi.ID)...)
+				faltante.FixError = err.Error()
+			} else {
+				faltante.Fixed = true
+				reporte.Fixed++
+			}
+		}
+		reporte.PaidUnregistered = append(reporte.PaidUnregistered, faltante)
+	}
+
+	ids := make([]string, 0, len(porIntent))
+	for id := range porIntent {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		pi, ok := listados[id]
+		if !ok {
+			consulta := &stripe.PaymentIntentParams{}
+			consulta.AddExpand("latest_charge")
+			pi, err = s.pagos.GetIntent(ctx, id, consulta)
+			var stripeErr *stripe.Error
+			if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+				pi, err = nil, nil
+			}
+			if err != nil {
+				return reporte, fmt.Errorf("stripe %s: %w", id, err)
+			}
+		}
+		estado := "missing"
+		if pi != nil {
+			estado = estadoCobro(pi)
+		}
+		if estado == string(stripe.PaymentIntentStatusSucceeded) {
+			continue
+		}
+		reporte.RegisteredUnpaid = append(reporte.RegisteredUnpaid, ticketsSinPago(id, estado, porIntent[id]))
+	}
+	return reporte, nil
+}
+
+// estadoCobro es el status del intent, salvo que su cargo se haya devuelto
+// entero: un intent reembolsado sigue en succeeded
+func estadoCobro(pi *stripe.PaymentIntent) string {
+	if pi.LatestCharge != nil && pi.LatestCharge.Refunded {
+		return "refunded"
+	}
+	return string(pi.Status)
+}
+
+func ticketsSinPago(paymentIntentID string, estado string, tickets []model.TicketVendido) TicketsSinPago {
+	fila := TicketsSinPago{PaymentIntentID: paymentIntentID, StripeStatus: estado}
+	rifas := map[string]bool{}
+	for _, t := range tickets {
+		fila.TicketIDs = append(fila.TicketIDs, t.ID)
+		if !rifas[t.RifaID] {
+			rifas[t.RifaID] = true
+			fila.RifaIDs = append(fila.RifaIDs, t.RifaID)
+		}
+	}
+	return fila
+}
+
+// registrarFaltante hace con el intent lo que el webhook no llegó a hacer:
+// registra los tickets desde el borrador de la compra, confirma el código
+// promocional y manda los correos. No revisa max_per_user ni reembolsa: si
+// los números ya no están libres devuelve el error y lo decide administración.
+func (s *Server) registrarFaltante(ctx context.Context, pi *stripe.PaymentIntent) error {
+	compra, err := s.cargarCompra(ctx, pi)
+	if err != nil {
+		return fmt.Errorf("compra: %w", err)
+	}
+	pagado := time.Unix(pi.Created, 0)
+	if pi.LatestCharge != nil && pi.LatestCharge.Created > 0 {
+		pagado = time.Unix(pi.LatestCharge.Created, 0)
+	}
+	revision, err := s.revisionDeIntent(ctx, pi.ID)
+	if err != nil {
+		return fmt.Errorf("revisión: %w", err)
+	}
+	if revisionRechazada(revision) {
+		return s.rechazarCompra(ctx, compra, pi.ID, revision)
+	}
+	pago := pagoStripe(compra, pi, pagado)
+	pago.OnHold = retieneCompra(revision)
+	items, err := s.registrarTickets(ctx, compra, pago)
+	if err != nil {
+		return err
+	}
+	if compra.PromoCode != "" {
+		if err := s.db.RedeemPromoCode(ctx, compra.PromoCode, pi.ID); err != nil {
+			slog.WarnContext(ctx, "error confirmando el canje del código", logging.ConError(err, "code", compra.PromoCode, "payment_intent_id", pi.ID)...)
+		}
+	}
+	slog.InfoContext(ctx, "tickets registrados por la conciliación", "payment_intent_id", pi.ID, "rifa_id", compra.RifaID, "numeros", totalNumeros(items))
+	if pago.OnHold {
+		// Como en el webhook, la confirmación espera a review.closed
+		return nil
+	}
+	if compra.Installments > 1 {
+		return s.iniciarCuotas(ctx, compra, pi, pagado)
+	}
+	if err := s.acreditarReferido(ctx, compra, pi.Amount, string(pi.Currency)); err != nil {
+		slog.WarnContext(ctx, "error acreditando la comisión de referido", logging.ConError(err, "referral_code", compra.ReferralCode, "payment_intent_id", pi.ID)...)
+	}
+	return s.enviarCorreosCompra(ctx, compra, items, pi.Amount, pi.Currency)
+}
+
+// enviarReporteConciliacion manda el reporte a ORGANIZER_EMAIL, una línea por diferencia
+func (s *Server) enviarReporteConciliacion(ctx context.Context, reporte *ReconcileReport) error {
+	diferencias := len(reporte.PaidUnregistered) + len(reporte.RegisteredUnpaid)
+	detalles := []string{fmt.Sprintf("Desde el %s: %d intents y %d tickets revisados.", reporte.Since, reporte.CheckedIntents, reporte.CheckedTickets)}
+	if diferencias == 0 {
+		detalles = append(detalles, "No hay diferencias.")
+	}
+	for _, f := range reporte.PaidUnregistered {
+		linea := fmt.Sprintf("Cobrado sin tickets: %s (rifa %s, %s)", f.PaymentIntentID, f.RifaID, payments.FormatearMonto(f.Amount, f.Currency))
+		if f.Fixed {
+			linea += ", registrado ahora"
+		} else if f.FixError != "" {
+			linea += ", no se pudo registrar: " + f.FixError
+		}
+		detalles = append(detalles, linea)
+	}
+	for _, t := range reporte.RegisteredUnpaid {
+		detalles = append(detalles, fmt.Sprintf("Tickets sin pago: %s (%s en Stripe, %d tickets)", t.PaymentIntentID, t.StripeStatus, len(t.TicketIDs)))
+	}
+	return s.enviarAvisoOrganizador(ctx, fmt.Sprintf("Conciliación con Stripe: %d diferencias", diferencias), "Conciliación de pagos", detalles)
+}
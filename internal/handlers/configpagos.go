@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+)
+
+// billeteras son las que el Payment Request Button puede mostrar; las dos
+// cobran como tarjeta
+var billeteras = []string{"apple_pay", "google_pay"}
+
+// PaymentConfigResponse es la respuesta de GET /payments/config
+type PaymentConfigResponse struct {
+	PublishableKey      string `json:"publishableKey"`
+	MerchantDisplayName string `json:"merchantDisplayName"`
+	// Wallets queda vacío si los métodos de pago no incluyen tarjeta
+	Wallets []string `json:"wallets"`
+	// AutomaticPaymentMethods dice si Stripe elige los métodos; si no,
+	// PaymentMethodTypes es la lista fija
+	AutomaticPaymentMethods bool     `json:"automaticPaymentMethods"`
+	PaymentMethodTypes      []string `json:"paymentMethodTypes,omitempty"`
+}
+
+// PaymentConfig le da al frontend lo necesario para iniciar Stripe.js y el
+// Payment Request Button sin dejarlo fijo en el código. Que la billetera
+// aparezca depende además del dispositivo y, en Apple Pay, del dominio
+// verificado en Stripe.
+func (s *Server) PaymentConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	respuesta := PaymentConfigResponse{
+		PublishableKey:          s.cfg.StripePublishableKey,
+		MerchantDisplayName:     s.cfg.MerchantDisplayName,
+		Wallets:                 []string{},
+		AutomaticPaymentMethods: len(s.cfg.PaymentMethodTypes) == 0,
+		PaymentMethodTypes:      s.cfg.PaymentMethodTypes,
+	}
+	if respuesta.AutomaticPaymentMethods || slices.Contains(s.cfg.PaymentMethodTypes, "card") {
+		respuesta.Wallets = billeteras
+	}
+	writeJSON(w, http.StatusOK, respuesta)
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// toleranciaFirmaCorreo es cuánto puede diferir svix-timestamp del reloj; fuera
+// de ese margen el webhook se rechaza para que no se pueda repetir uno viejo
+const toleranciaFirmaCorreo = 5 * time.Minute
+
+var errFirmaCorreo = errors.New("firma de svix inválida")
+
+// verificarFirmaSvix valida las cabeceras svix-* como lo hace la librería de
+// Svix: la firma es el HMAC-SHA256 de "id.timestamp.cuerpo" con el secreto
+// whsec_ decodificado, y svix-signature puede traer varias "v1,<base64>"
+// separadas por espacios (durante una rotación del secreto).
+func verificarFirmaSvix(secreto string, id string, timestamp string, firmas string, cuerpo []byte, ahora time.Time) error {
+	clave, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secreto, "whsec_"))
+	if err != nil {
+		return errors.New("RESEND_WEBHOOK_SECRET no es un secreto whsec_ válido")
+	}
+	segundos, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || id == "" {
+		return errFirmaCorreo
+	}
+	if diferencia := ahora.Sub(time.Unix(segundos, 0)); diferencia > toleranciaFirmaCorreo || diferencia < -toleranciaFirmaCorreo {
+		return errFirmaCorreo
+	}
+
+	mac := hmac.New(sha256.New, clave)
+	mac.Write([]byte(id + "." + timestamp + "."))
+	mac.Write(cuerpo)
+	esperada := mac.Sum(nil)
+	for _, f := range strings.Fields(firmas) {
+		version, firma, ok := strings.Cut(f, ",")
+		if !ok || version != "v1" {
+			continue
+		}
+		recibida, err := base64.StdEncoding.DecodeString(firma)
+		if err == nil && hmac.Equal(recibida, esperada) {
+			return nil
+		}
+	}
+	return errFirmaCorreo
+}
+
+// eventoResend es lo que se usa del cuerpo de los webhooks de Resend
+type eventoResend struct {
+	Type      string `json:"type"`
+	CreatedAt string `json:"created_at"`
+	Data      struct {
+		EmailID string   `json:"email_id"`
+		To      []string `json:"to"`
+		Bounce  *struct {
+			Type    string `json:"type"`
+			SubType string `json:"subType"`
+			Message string `json:"message"`
+		} `json:"bounce"`
+	} `json:"data"`
+}
+
+// HandleResendWebhook registra en email_events la entrega, los rebotes y las
+// quejas de los correos. Un rebote que no es temporal marca el email del
+// comprador en undeliverable_emails para que administración vea que nunca le
+// llegó el recibo. Los demás tipos de evento se aceptan y se ignoran; si
+// Supabase falla responde 500 para que Resend lo reintente.
+func (s *Server) HandleResendWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.cfg.ResendWebhookSecret == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 65536)
+	cuerpo, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.WarnContext(ctx, "error leyendo el webhook de Resend", logging.ConError(err)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	svixID := r.Header.Get("svix-id")
+	if err := verificarFirmaSvix(s.cfg.ResendWebhookSecret, svixID, r.Header.Get("svix-timestamp"), r.Header.Get("svix-signature"), cuerpo, time.Now()); err != nil {
+		slog.WarnContext(ctx, "falló la validación del webhook de Resend", logging.ConError(err, "svix_id", svixID)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var evento eventoResend
+	if err := json.Unmarshal(cuerpo, &evento); err != nil || evento.Data.EmailID == "" {
+		slog.WarnContext(ctx, "webhook de Resend sin email_id", "svix_id", svixID, "type", evento.Type)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch evento.Type {
+	case model.EventoCorreoEntregado, model.EventoCorreoRebotado, model.EventoCorreoQueja:
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	fila := &model.EventoCorreo{
+		MessageID:  evento.Data.EmailID,
+		Type:       evento.Type,
+		OccurredAt: evento.CreatedAt,
+	}
+	if len(evento.Data.To) > 0 {
+		fila.Email = strings.ToLower(evento.Data.To[0])
+	}
+	if fila.OccurredAt == "" {
+		fila.OccurredAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	rebote := evento.Data.Bounce
+	if rebote != nil {
+		fila.Detail = strings.TrimSpace(rebote.Type + " " + rebote.SubType + ": " + rebote.Message)
+	}
+	if err := s.db.RecordEmailEvent(ctx, fila); err != nil {
+		slog.ErrorContext(ctx, "no se pudo guardar el evento de correo", logging.ConError(err, "message_id", fila.MessageID, "type", fila.Type)...)
+		http.Error(w, "Error guardando el evento", 500)
+		return
+	}
+	slog.InfoContext(ctx, "evento de correo", "message_id", fila.MessageID, "type", fila.Type, "email", logging.EnmascararEmail(fila.Email))
+
+	if evento.Type == model.EventoCorreoRebotado && fila.Email != "" && (rebote == nil || !strings.EqualFold(rebote.Type, "Transient")) {
+		motivo := fila.Detail
+		if motivo == "" {
+			motivo = "bounced"
+		}
+		if err := s.db.FlagUndeliverableEmail(ctx, fila.Email, motivo, fila.MessageID); err != nil {
+			slog.ErrorContext(ctx, "no se pudo marcar el email que rebotó", logging.ConError(err, "message_id", fila.MessageID)...)
+			http.Error(w, "Error marcando el email", 500)
+			return
+		}
+		slog.WarnContext(ctx, "correo rebotado: email marcado como no entregable", "message_id", fila.MessageID, "email", logging.EnmascararEmail(fila.Email))
+	}
+	w.WriteHeader(http.StatusOK)
+}
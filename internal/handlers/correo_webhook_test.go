@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// firmaSvix es la cabecera v1,<base64> que manda Svix para el cuerpo
+func firmaSvix(clave []byte, id string, timestamp string, cuerpo string) string {
+	mac := hmac.New(sha256.New, clave)
+	mac.Write([]byte(id + "." + timestamp + "." + cuerpo))
+	return "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerificarFirmaSvix(t *testing.T) {
+	clave := []byte("clave de prueba del webhook")
+	secreto := "whsec_" + base64.StdEncoding.EncodeToString(clave)
+	ahora := time.Unix(1_760_000_000, 0)
+	ts := strconv.FormatInt(ahora.Unix(), 10)
+	viejo := strconv.FormatInt(ahora.Add(-6*time.Minute).Unix(), 10)
+	const cuerpo = `{"type":"email.delivered","data":{"email_id":"msg_1"}}`
+	buena := firmaSvix(clave, "msg_1", ts, cuerpo)
+
+	casos := []struct {
+		nombre    string
+		timestamp string
+		firmas    string
+		valida    bool
+	}{
+		{nombre: "firma buena", timestamp: ts, firmas: buena, valida: true},
+		{nombre: "buena entre varias", timestamp: ts, firmas: firmaSvix([]byte("secreto anterior"), "msg_1", ts, cuerpo) + " v2,abc " + buena, valida: true},
+		{nombre: "fuera de la tolerancia", timestamp: viejo, firmas: firmaSvix(clave, "msg_1", viejo, cuerpo)},
+		{nombre: "firma de otro cuerpo", timestamp: ts, firmas: firmaSvix(clave, "msg_1", ts, `{"type":"email.bounced"}`)},
+		{nombre: "firma que no es base64", timestamp: ts, firmas: "v1,%%%"},
+		{nombre: "sin firma", timestamp: ts},
+		{nombre: "timestamp inválido", timestamp: "ayer", firmas: buena},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			err := verificarFirmaSvix(secreto, "msg_1", c.timestamp, c.firmas, []byte(cuerpo), ahora)
+			if c.valida && err != nil {
+				t.Fatalf("rechazada: %v", err)
+			}
+			if !c.valida && !errors.Is(err, errFirmaCorreo) {
+				t.Fatalf("err = %v, se esperaba errFirmaCorreo", err)
+			}
+		})
+	}
+}
+
+func TestHandleResendWebhookFirma(t *testing.T) {
+	clave := []byte("clave de prueba del webhook")
+	casos := []struct {
+		nombre  string
+		secreto string
+		firma   string
+		status  int
+	}{
+		{nombre: "sin RESEND_WEBHOOK_SECRET", firma: "v1,abc", status: http.StatusServiceUnavailable},
+		{nombre: "firma inválida", secreto: "whsec_" + base64.StdEncoding.EncodeToString(clave), firma: "v1,abc", status: http.StatusBadRequest},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			// Un Store sin métodos: sin secreto o con la firma inválida no se debe tocar la base
+			s := servidorPrueba(&storeCompras{}, &pagosFalsos{}, &correoFalso{})
+			s.cfg.ResendWebhookSecret = c.secreto
+			r := httptest.NewRequest(http.MethodPost, "/email/webhook", strings.NewReader(`{"type":"email.delivered","data":{"email_id":"msg_1"}}`))
+			r.Header.Set("svix-id", "msg_1")
+			r.Header.Set("svix-timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+			r.Header.Set("svix-signature", c.firma)
+			w := httptest.NewRecorder()
+			s.HandleResendWebhook(w, r)
+
+			if w.Code != c.status {
+				t.Errorf("status = %d, se esperaba %d", w.Code, c.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/tracing"
+)
+
+// enviarCorreo renderiza la plantilla y la envía con el remitente de la plataforma
+func (s *Server) enviarCorreo(ctx context.Context, destinatario string, asunto string, plantilla string, datos interface{}, adjuntos ...mail.Adjunto) error {
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, s.marcaGlobal(), destinatario, asunto, plantilla, datos, adjuntos...)
+}
+
+// enviarCorreoEn es enviarCorreo con las plantillas de un idioma y el
+// remitente de marca; la marca de la plantilla va aparte, en datos
+func (s *Server) enviarCorreoEn(ctx context.Context, idioma string, marca mail.Marca, destinatario string, asunto string, plantilla string, datos interface{}, adjuntos ...mail.Adjunto) error {
+	_, err := s.enviarCorreoID(ctx, idioma, marca, destinatario, asunto, plantilla, datos, adjuntos...)
+	return err
+}
+
+// enviarCorreoID es enviarCorreoEn devolviendo el ID del mensaje en Resend
+func (s *Server) enviarCorreoID(ctx context.Context, idioma string, marca mail.Marca, destinatario string, asunto string, plantilla string, datos interface{}, adjuntos ...mail.Adjunto) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "enviarCorreo", trace.WithAttributes(attribute.String("plantilla", plantilla), attribute.String("idioma", idioma)))
+	defer func() { tracing.Fin(span, err) }()
+
+	html, texto, err := mail.RenderizarCorreoEn(idioma, plantilla, datos)
+	if err != nil {
+		return "", fmt.Errorf("plantilla %s: %w", plantilla, err)
+	}
+
+	id, err := s.correo.Send(ctx, marca, destinatario, asunto, html, texto, adjuntos...)
+	if err != nil {
+		return "", err
+	}
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:   model.AuditoriaCorreoEnviado,
+		EntityID: id,
+		Detail:   map[string]interface{}{"template": plantilla, "email": destinatario, "subject": asunto, "attachments": len(adjuntos)},
+	})
+	return id, nil
+}
+
+// enviarCorreoConfirmacion envía los números al comprador, con una sección por
+// rifa, en el idioma del locale de la compra (español si no hay o no está
+// traducido). Las compras de VIP_THRESHOLD números o más reciben la versión VIP.
+// El monto va en unidades menores; si es 0 (correos viejos sin monto) no se
+// muestra. Con descuento se muestran también el precio original y lo descontado.
+// adjuntos se suman a los códigos QR (p. ej. el recibo PDF).
+func (s *Server) enviarCorreoConfirmacion(ctx context.Context, destinatario string, locale string, items []model.ItemCompra, monto int64, descuento int64, moneda string, adjuntos ...mail.Adjunto) error {
+	idioma := mail.ElegirIdioma(locale)
+	datos := mail.DatosConfirmacion{
+		Marca:     s.marcaItems(ctx, items),
+		VIP:       totalNumeros(items) >= s.cfg.VIPThreshold,
+		Secciones: mail.SeccionesCorreo(items),
+		Fecha:     mail.FormatearFechaEn(idioma, time.Now()),
+	}
+	for i, item := range items {
+		if item.TierMinQty > 0 {
+			datos.Secciones[i].TramoMinimo = item.TierMinQty
+			datos.Secciones[i].PrecioTramo = mail.FormatearMontoEn(idioma, item.UnitPrice, moneda)
+		}
+	}
+	adjuntos = append(adjuntarCodigosQR(ctx, datos.Secciones), adjuntos...)
+	if monto > 0 {
+		datos.Monto = mail.FormatearMontoEn(idioma, monto, moneda)
+	}
+	if descuento > 0 {
+		datos.Subtotal = mail.FormatearMontoEn(idioma, monto+descuento, moneda)
+		datos.Descuento = mail.FormatearMontoEn(idioma, descuento, moneda)
+	}
+	asunto := mail.Asunto(idioma, "confirmacion")
+	if datos.VIP {
+		asunto = mail.Asunto(idioma, "confirmacion_vip")
+	}
+
+	id, err := s.enviarCorreoID(ctx, idioma, datos.Marca, destinatario, asunto, "confirmacion", datos, adjuntos...)
+	if err != nil || id == "" {
+		return err
+	}
+	// Con el ID, los webhooks de Resend dicen si el correo llegó
+	evento := &model.EventoCorreo{
+		MessageID:  id,
+		Type:       model.EventoCorreoEnviado,
+		Email:      strings.ToLower(destinatario),
+		Template:   "confirmacion",
+		OccurredAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := s.db.RecordEmailEvent(ctx, evento); err != nil {
+		slog.WarnContext(ctx, "no se pudo guardar el envío del correo", logging.ConError(err, "message_id", id)...)
+	}
+	return nil
+}
+
+// adjuntarCodigosQR genera un QR inline por cada sección con enlace de
+// verificación y apunta la sección a su adjunto. Si un QR no se puede generar
+// esa sección va sin él: el correo sale igual, con el enlace en texto.
+func adjuntarCodigosQR(ctx context.Context, secciones []mail.SeccionCorreo) []mail.Adjunto {
+	var adjuntos []mail.Adjunto
+	for i := range secciones {
+		if secciones[i].Verificacion == "" {
+			continue
+		}
+		png, err := mail.CodigoQR(secciones[i].Verificacion)
+		if err != nil {
+			slog.WarnContext(ctx, "no se pudo generar el código QR", logging.ConError(err, "rifa_title", secciones[i].RifaNombre)...)
+			continue
+		}
+		cid := fmt.Sprintf("qr-%d", i+1)
+		adjuntos = append(adjuntos, mail.Adjunto{Nombre: cid + ".png", ContentType: "image/png", Contenido: png, ContentID: cid})
+		secciones[i].QR = cid
+	}
+	return adjuntos
+}
+
+// intentosCorreo y esperaInicialCorreo controlan los reintentos de reintentarCorreo
+const (
+	intentosCorreo      = 3
+	esperaInicialCorreo = 2 * time.Second
+)
+
+// reintentarCorreo llama a enviar hasta intentosCorreo veces con backoff
+// exponencial y devuelve el último error
+func reintentarCorreo(ctx context.Context, destinatario string, enviar func() error) error {
+	espera := esperaInicialCorreo
+	var err error
+	for intento := 1; intento <= intentosCorreo; intento++ {
+		if err = enviar(); err == nil {
+			return nil
+		}
+		slog.WarnContext(ctx, "error enviando correo", logging.ConError(err, "email", logging.EnmascararEmail(destinatario), "intento", intento, "max_intentos", intentosCorreo)...)
+		if intento < intentosCorreo {
+			time.Sleep(espera)
+			espera *= 2
+		}
+	}
+	return err
+}
+
+// enviarCorreoRegalo le manda los números al destinatario de un regalo;
+// remitente es el email del comprador
+func (s *Server) enviarCorreoRegalo(ctx context.Context, destinatario string, nombre string, remitente string, items []model.ItemCompra) error {
+	datos := mail.DatosRegalo{Marca: s.marcaItems(ctx, items), Nombre: nombre, Remitente: remitente, Secciones: mail.SeccionesCorreo(items)}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "🎁 Te regalaron números", "regalo", datos)
+}
+
+// enviarReciboRegalo es el comprobante corto que recibe quien regaló
+func (s *Server) enviarReciboRegalo(ctx context.Context, destinatario string, regalado string, items []model.ItemCompra, monto int64, descuento int64, moneda string) error {
+	datos := mail.DatosReciboRegalo{Marca: s.marcaItems(ctx, items), Destinatario: regalado, Secciones: mail.SeccionesCorreo(items)}
+	if monto > 0 {
+		datos.Monto = payments.FormatearMonto(monto, moneda)
+	}
+	if descuento > 0 {
+		datos.Subtotal = payments.FormatearMonto(monto+descuento, moneda)
+		datos.Descuento = payments.FormatearMonto(descuento, moneda)
+	}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "Tu regalo fue enviado", "recibo_regalo", datos)
+}
+
+// enviarNotificacionOrganizador avisa a ORGANIZER_EMAIL de una compra grande.
+// No hace nada si la variable no está configurada.
+func (s *Server) enviarNotificacionOrganizador(ctx context.Context, comprador string, rifaNombre string, cantidad int, monto int64, moneda stripe.Currency) error {
+	organizador := s.cfg.OrganizerEmail
+	if organizador == "" {
+		return nil
+	}
+
+	datos := mail.DatosOrganizador{
+		Comprador:  comprador,
+		RifaNombre: rifaNombre,
+		Cantidad:   cantidad,
+		Monto:      payments.FormatearMonto(monto, string(moneda)),
+	}
+	return s.enviarCorreo(ctx, organizador, fmt.Sprintf("Compra de %d números en %s", cantidad, rifaNombre), "organizador", datos)
+}
+
+// enviarAvisoOrganizador manda a ORGANIZER_EMAIL un aviso interno (reembolsos,
+// disputas). No hace nada si la variable no está configurada.
+func (s *Server) enviarAvisoOrganizador(ctx context.Context, asunto string, titulo string, detalles []string) error {
+	organizador := s.cfg.OrganizerEmail
+	if organizador == "" {
+		return nil
+	}
+	return s.enviarCorreo(ctx, organizador, asunto, "aviso_organizador", mail.DatosAvisoOrganizador{Titulo: titulo, Detalles: detalles})
+}
+
+// enviarCorreoReembolso se disculpa con el cliente cuando no se pudieron
+// registrar sus números y se le devolvió el pago. motivo completa la frase
+// "No pudimos registrar tus números ...", p. ej. "porque ya no estaban disponibles".
+func (s *Server) enviarCorreoReembolso(ctx context.Context, destinatario string, items []model.ItemCompra, motivo string) error {
+	datos := mail.DatosReembolso{Marca: s.marcaItems(ctx, items), Secciones: mail.SeccionesCorreo(items), Motivo: motivo}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "Reembolso de tu compra", "reembolso", datos)
+}
+
+// enviarCorreoReembolsoConfirmado avisa al comprador de un reembolso hecho
+// desde administración; monto va en la unidad menor de la moneda
+func (s *Server) enviarCorreoReembolsoConfirmado(ctx context.Context, destinatario string, rifaID string, rifaNombre string, numeros []int, monto int64, moneda string) error {
+	datos := mail.DatosReembolsoConfirmado{Marca: s.marcaRifa(ctx, rifaID), RifaNombre: rifaNombre, Numeros: mail.FormatearNumeros(numeros), Monto: payments.FormatearMonto(monto, moneda)}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "Tu reembolso fue procesado", "reembolso_confirmado", datos)
+}
+
+// enviarCorreoPagoFallido avisa al comprador que su pago no se completó.
+// Si PAYMENT_RETRY_URL está configurada se incluye un enlace para reintentar
+// ({rifaId} se reemplaza por el ID de la rifa).
+func (s *Server) enviarCorreoPagoFallido(ctx context.Context, destinatario string, rifaID string, rifaNombre string) error {
+	datos := mail.DatosPagoFallido{Marca: s.marcaRifa(ctx, rifaID), RifaNombre: rifaNombre}
+	if retryURL := s.cfg.PaymentRetryURL; retryURL != "" {
+		datos.Enlace = strings.ReplaceAll(retryURL, "{rifaId}", rifaID)
+	}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "Tu pago no se completó", "pago_fallido", datos)
+}
+
+// enviarCorreoPagoRechazado avisa al comprador que su pago no pasó la
+// revisión y que los números se liberaron
+func (s *Server) enviarCorreoPagoRechazado(ctx context.Context, destinatario string, items []model.ItemCompra) error {
+	datos := mail.DatosPagoRechazado{Marca: s.marcaItems(ctx, items), Secciones: mail.SeccionesCorreo(items)}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "Tu pago fue rechazado", "pago_rechazado", datos)
+}
+
+// enviarCorreoGanador felicita al dueño del número ganador
+func (s *Server) enviarCorreoGanador(ctx context.Context, destinatario string, rifaID string, rifaNombre string, numero int) error {
+	datos := mail.DatosGanador{Marca: s.marcaRifa(ctx, rifaID), RifaNombre: rifaNombre, Numero: numero}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "🎉 ¡Ganaste "+rifaNombre+"!", "ganador", datos)
+}
+
+// enviarCorreoAnuncio avisa a un comprador que no ganó cuál fue el número
+// ganador; numeros son los que compró en la rifa
+func (s *Server) enviarCorreoAnuncio(ctx context.Context, destinatario string, rifaID string, rifaNombre string, ganador int, numeros []int) error {
+	datos := mail.DatosAnuncioSorteo{Marca: s.marcaRifa(ctx, rifaID), RifaNombre: rifaNombre, Numero: ganador, Numeros: mail.FormatearNumeros(numeros)}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "Resultado del sorteo de "+rifaNombre, "anuncio_sorteo", datos)
+}
+
+// enviarCorreoEspera le avisa al primero de la lista de espera que el número
+// se liberó y hasta cuándo es el primero. Si WAITLIST_CLAIM_URL está
+// configurada va el enlace para comprarlo ({rifaId} y {number}).
+func (s *Server) enviarCorreoEspera(ctx context.Context, destinatario string, rifaID string, rifaNombre string, numero int, vence time.Time) error {
+	vence = vence.In(s.cfg.DigestLocation)
+	datos := mail.DatosEsperaDisponible{
+		Marca:      s.marcaRifa(ctx, rifaID),
+		RifaNombre: rifaNombre,
+		Numero:     numero,
+		Vence:      mail.FormatearFechaEn(mail.IdiomaPorDefecto, vence) + " a las " + vence.Format("15:04 MST"),
+	}
+	if claimURL := s.cfg.WaitlistClaimURL; claimURL != "" {
+		datos.Enlace = strings.NewReplacer("{rifaId}", rifaID, "{number}", strconv.Itoa(numero)).Replace(claimURL)
+	}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, "Se liberó tu número de "+rifaNombre, "espera_disponible", datos)
+}
+
+// enviarCorreoTransferencia le avisa a un dueño del ticket que cambió de
+// cuenta: recibido es el correo al nuevo, con el enlace para verificarlo
+func (s *Server) enviarCorreoTransferencia(ctx context.Context, destinatario string, rifaID string, rifaNombre string, numero int, recibido bool, enlace string) error {
+	datos := mail.DatosTicketTransferido{
+		Marca:      s.marcaRifa(ctx, rifaID),
+		RifaNombre: rifaNombre,
+		Numero:     numero,
+		Recibido:   recibido,
+		Enlace:     enlace,
+	}
+	asunto := "Transferiste tu número de " + rifaNombre
+	if recibido {
+		asunto = "Te transfirieron un número de " + rifaNombre
+	}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, destinatario, asunto, "ticket_transferido", datos)
+}
+
+// enviarCorreoCuotaPagada confirma una cuota intermedia del plan de compra con
+// lo pagado, el saldo y el plazo. Si INSTALLMENT_PAYMENT_URL está configurada
+// va el enlace para pagar la siguiente ({draftId} es el ID del borrador).
+func (s *Server) enviarCorreoCuotaPagada(ctx context.Context, compra *model.PurchaseDraft, pagado int64, moneda string, vence time.Time) error {
+	vence = vence.In(s.cfg.DigestLocation)
+	datos := mail.DatosCuotaPagada{
+		Marca:      s.marcaRifa(ctx, compra.RifaID),
+		RifaNombre: compra.RifaTitle,
+		Numeros:    mail.FormatearNumeros(compra.Numeros),
+		Cuota:      compra.InstallmentsPaid,
+		Cuotas:     compra.Installments,
+		Pagado:     payments.FormatearMonto(pagado, moneda),
+		Saldo:      payments.FormatearMonto(compra.Amount-pagado, moneda),
+		Vence:      mail.FormatearFechaEn(mail.IdiomaPorDefecto, vence) + " a las " + vence.Format("15:04 MST"),
+	}
+	if pagoURL := s.cfg.InstallmentPaymentURL; pagoURL != "" {
+		datos.Enlace = strings.ReplaceAll(pagoURL, "{draftId}", compra.ID)
+	}
+	asunto := fmt.Sprintf("Recibimos tu cuota %d de %d para %s", datos.Cuota, datos.Cuotas, compra.RifaTitle)
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, compra.Email, asunto, "cuota_pagada", datos)
+}
+
+// enviarCorreoCuotasVencidas avisa que el plan venció, los números se
+// liberaron y cuánto se devuelve; comision es lo que se retuvo
+func (s *Server) enviarCorreoCuotasVencidas(ctx context.Context, compra *model.PurchaseDraft, devuelto int64, comision int64, moneda string) error {
+	datos := mail.DatosCuotasVencidas{
+		Marca:      s.marcaRifa(ctx, compra.RifaID),
+		RifaNombre: compra.RifaTitle,
+		Numeros:    mail.FormatearNumeros(compra.Numeros),
+		Devuelto:   payments.FormatearMonto(devuelto, moneda),
+	}
+	if comision > 0 {
+		datos.Comision = payments.FormatearMonto(comision, moneda)
+	}
+	return s.enviarCorreoEn(ctx, mail.IdiomaPorDefecto, datos.Marca, compra.Email, "Tu plan de cuotas de "+compra.RifaTitle+" venció", "cuotas_vencidas", datos)
+}
@@ -0,0 +1,495 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/store"
+)
+
+// maxCuotas es el máximo de cuotas de un plan
+const maxCuotas = 3
+
+// loteCuotasVencidas es cuántos planes vencidos se cancelan por barrido
+const loteCuotasVencidas = 100
+
+// montoCuota es lo que se cobra en la cuota k (desde 1) de un plan de n
+// cuotas por total; el resto de la división va en la primera
+func montoCuota(total int64, n int, k int) int64 {
+	base := total / int64(n)
+	if k == 1 {
+		return total - base*int64(n-1)
+	}
+	return base
+}
+
+// pagadoHastaCuota es lo que lleva pagado el plan al completar la cuota k
+func pagadoHastaCuota(total int64, n int, k int) int64 {
+	return total - (total/int64(n))*int64(n-k)
+}
+
+// cuotaDeIntent es el número de cuota que cobra el intent, 0 si no es de un plan
+func cuotaDeIntent(pi *stripe.PaymentIntent) int {
+	k, _ := strconv.Atoi(pi.Metadata["installment"])
+	return k
+}
+
+// esCuotaPosterior dice si el intent cobra la segunda cuota o una siguiente:
+// esos intents no tienen tickets propios, abonan a los de la primera
+func esCuotaPosterior(pi *stripe.PaymentIntent) bool {
+	return cuotaDeIntent(pi) > 1
+}
+
+// validarCuotas revisa Installments: 2 o 3 cuotas, con sesión iniciada, un
+// precio por número desde INSTALLMENT_MIN_UNIT_PRICE y cada cuota sobre el
+// mínimo de Stripe. Installments 1 es un pago único. Devuelve false si ya
+// respondió con un error.
+func (s *Server) validarCuotas(ctx context.Context, w http.ResponseWriter, req *model.PaymentRequest, cotizacion *Cotizacion, monto int64) bool {
+	if req.Installments <= 1 {
+		req.Installments = 0
+		return true
+	}
+	if req.Installments > maxCuotas {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error:   fmt.Sprintf("El pago se puede dividir en hasta %d cuotas", maxCuotas),
+			Code:    "INVALID_INSTALLMENTS",
+			Details: map[string]int{"max": maxCuotas},
+		})
+		return false
+	}
+	if req.UserId == "" {
+		// El enlace de la siguiente cuota se pide con sesión
+		writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Error: "Inicia sesión para pagar en cuotas", Code: "UNAUTHORIZED"})
+		return false
+	}
+	if cotizacion.PricePerNumber < s.cfg.InstallmentMinUnitPrice || monto == 0 {
+		slog.InfoContext(ctx, "cuotas rechazadas por precio", "rifa_id", req.RifaID, "price_per_number", cotizacion.PricePerNumber, "minimo", s.cfg.InstallmentMinUnitPrice)
+		writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Error:   "Esta rifa no admite pago en cuotas",
+			Code:    "INSTALLMENTS_NOT_AVAILABLE",
+			Details: map[string]interface{}{"minUnitPrice": s.cfg.InstallmentMinUnitPrice, "currency": cotizacion.Currency},
+		})
+		return false
+	}
+	return verificarMontoMinimo(ctx, w, montoCuota(monto, req.Installments, req.Installments), cotizacion.Currency)
+}
+
+// conPlanCuotas le agrega a la respuesta de create-intent de una compra en
+// cuotas el draftId con el que se piden las siguientes y el monto de la primera
+func conPlanCuotas(respuesta map[string]interface{}, compra *model.PurchaseDraft) map[string]interface{} {
+	if compra.Installments > 1 {
+		respuesta["draftId"] = compra.ID
+		respuesta["installments"] = compra.Installments
+		respuesta["amount"] = montoCuota(compra.Amount, compra.Installments, 1)
+	}
+	return respuesta
+}
+
+// vencimientoCuotas es el plazo para terminar de pagar un plan que empezó en
+// inicio: INSTALLMENT_WINDOW, o antes si el sorteo es antes
+func (s *Server) vencimientoCuotas(ctx context.Context, rifaID string, inicio time.Time) time.Time {
+	vence := inicio.Add(s.cfg.InstallmentWindow)
+	rifa, err := s.db.GetRifa(ctx, rifaID)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo leer la fecha del sorteo para el plan de cuotas", logging.ConError(err, "rifa_id", rifaID)...)
+		return vence
+	}
+	if sorteo, ok := fechaSorteo(rifa.DrawDate); ok && sorteo.Before(vence) {
+		return sorteo
+	}
+	return vence
+}
+
+// iniciarCuotas activa el plan de una compra en cuotas cuando se paga la
+// primera: los tickets ya quedaron partially_paid con el saldo. Avisa al
+// comprador con el enlace de la siguiente cuota. Un reintento del evento
+// encuentra el plan ya activo y no hace nada.
+func (s *Server) iniciarCuotas(ctx context.Context, compra *model.PurchaseDraft, pi *stripe.PaymentIntent, pagado time.Time) error {
+	vence := s.vencimientoCuotas(ctx, compra.RifaID, pagado)
+	cambio := model.CambioPlanCuotas{
+		InstallmentsPaid:   1,
+		InstallmentIntents: []string{pi.ID},
+		InstallmentDueAt:   vence.UTC().Format(time.RFC3339),
+		InstallmentStatus:  model.PlanCuotasActivo,
+	}
+	iniciado, err := s.db.UpdateInstallmentPlan(ctx, compra.ID, "", 0, cambio)
+	if err != nil {
+		return err
+	}
+	if !iniciado {
+		slog.InfoContext(ctx, "el plan de cuotas ya estaba activo", "purchase_intent_id", compra.ID, "payment_intent_id", pi.ID)
+		return nil
+	}
+	compra.InstallmentsPaid = 1
+	compra.InstallmentIntents = cambio.InstallmentIntents
+	compra.InstallmentDueAt = cambio.InstallmentDueAt
+	compra.InstallmentStatus = model.PlanCuotasActivo
+	s.registrarCuota(ctx, compra, pi, vence)
+	return nil
+}
+
+// procesarCuota abona el pago de una cuota posterior a los tickets de la
+// primera. Con la última los tickets pasan a pagados y recién entonces van la
+// confirmación, la comisión del referido y el aviso de venta. Si el plan ya
+// venció o la cuota no es la que sigue, el pago se devuelve entero.
+func (s *Server) procesarCuota(ctx context.Context, pi *stripe.PaymentIntent) error {
+	k := cuotaDeIntent(pi)
+	compra, err := s.cargarCompra(ctx, pi)
+	if errors.Is(err, model.ErrCompraNoEncontrada) {
+		slog.ErrorContext(ctx, "cuota pagada sin borrador, reembolsando", "payment_intent_id", pi.ID, "purchase_intent_id", pi.Metadata["purchase_intent_id"])
+		return s.reembolsarCuota(ctx, pi, pi.Amount, "cuota_sin_plan")
+	}
+	if err != nil {
+		return err
+	}
+	n := compra.Installments
+	if slices.Contains(compra.InstallmentIntents, pi.ID) {
+		// Otra entrega del evento: de la última cuota sólo falta lo que pudo
+		// fallar después de cerrar el plan
+		if k == n {
+			return s.acreditarReferido(ctx, compra, compra.Amount, string(pi.Currency))
+		}
+		return nil
+	}
+	if compra.InstallmentStatus != model.PlanCuotasActivo || k != compra.InstallmentsPaid+1 {
+		slog.WarnContext(ctx, "cuota fuera del plan, reembolsando", "payment_intent_id", pi.ID, "purchase_intent_id", compra.ID, "installment", k, "installments_paid", compra.InstallmentsPaid, "status", compra.InstallmentStatus)
+		return s.reembolsarCuota(ctx, pi, pi.Amount, "cuota_fuera_de_plan")
+	}
+
+	pagado := pagadoHastaCuota(compra.Amount, n, k)
+	if err := s.db.UpdateInstallmentTickets(ctx, compra.PaymentIntentID, compra.RifaID, compra.Numeros, pagado, compra.Amount); err != nil {
+		return fmt.Errorf("tickets de la cuota: %w", err)
+	}
+	sinSiguiente := ""
+	cambio := model.CambioPlanCuotas{
+		InstallmentsPaid:      k,
+		InstallmentIntents:    append(slices.Clone(compra.InstallmentIntents), pi.ID),
+		NextInstallmentIntent: &sinSiguiente,
+		InstallmentStatus:     model.PlanCuotasActivo,
+	}
+	if k == n {
+		cambio.InstallmentStatus = model.PlanCuotasPagado
+	}
+	abonado, err := s.db.UpdateInstallmentPlan(ctx, compra.ID, model.PlanCuotasActivo, k-1, cambio)
+	if err != nil {
+		return err
+	}
+	if !abonado {
+		// El barrido empezó a cancelar el plan después de leerlo, u otra
+		// entrega del mismo evento ganó
+		actual, err := s.db.GetPurchaseDraftByID(ctx, compra.ID)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(actual.InstallmentIntents, pi.ID) {
+			return nil
+		}
+		slog.WarnContext(ctx, "el plan de cuotas cambió mientras se abonaba, reembolsando", "payment_intent_id", pi.ID, "purchase_intent_id", compra.ID, "status", actual.InstallmentStatus)
+		return s.reembolsarCuota(ctx, pi, pi.Amount, "cuota_fuera_de_plan")
+	}
+	compra.InstallmentsPaid = k
+	compra.InstallmentIntents = cambio.InstallmentIntents
+	compra.InstallmentStatus = cambio.InstallmentStatus
+
+	vence, _ := time.Parse(time.RFC3339, compra.InstallmentDueAt)
+	s.registrarCuota(ctx, compra, pi, vence)
+	if k < n {
+		return nil
+	}
+
+	slog.InfoContext(ctx, "plan de cuotas completado", "purchase_intent_id", compra.ID, "payment_intent_id", compra.PaymentIntentID, "amount", compra.Amount)
+	items := append([]model.ItemCompra(nil), itemsDeCompra(compra)...)
+	for i := range items {
+		items[i].VerifyURL = s.enlaceVerificacion(compra.PaymentIntentID, items[i])
+	}
+	if err := s.acreditarReferido(ctx, compra, compra.Amount, string(pi.Currency)); err != nil {
+		slog.ErrorContext(ctx, "error acreditando la comisión de referido", logging.ConError(err, "referral_code", compra.ReferralCode, "payment_intent_id", compra.PaymentIntentID)...)
+		return err
+	}
+	if err := s.enviarCorreosCompra(ctx, compra, items, compra.Amount, pi.Currency); err != nil {
+		return err
+	}
+	return s.avisarVenta(ctx, compra, items, compra.Amount, pi.Currency)
+}
+
+// registrarCuota audita la cuota que se acaba de abonar y, si no es la
+// última, le manda al comprador lo pagado y el enlace de la siguiente
+func (s *Server) registrarCuota(ctx context.Context, compra *model.PurchaseDraft, pi *stripe.PaymentIntent, vence time.Time) {
+	pagado := pagadoHastaCuota(compra.Amount, compra.Installments, compra.InstallmentsPaid)
+	slog.InfoContext(ctx, "cuota pagada", "purchase_intent_id", compra.ID, "payment_intent_id", pi.ID, "installment", compra.InstallmentsPaid, "installments", compra.Installments, "paid", pagado)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaCuotaPagada,
+		RifaID:          compra.RifaID,
+		PaymentIntentID: compra.PaymentIntentID,
+		EntityID:        pi.ID,
+		Detail: map[string]interface{}{
+			"installment":  compra.InstallmentsPaid,
+			"installments": compra.Installments,
+			"amount":       pi.Amount,
+			"paid":         pagado,
+			"balance_due":  compra.Amount - pagado,
+			"currency":     pi.Currency,
+		},
+	})
+	if compra.InstallmentsPaid >= compra.Installments || compra.Email == "" {
+		return
+	}
+	moneda := string(pi.Currency)
+	enSegundoPlano(ctx, func(ctx context.Context) {
+		err := reintentarCorreo(ctx, compra.Email, func() error {
+			return s.enviarCorreoCuotaPagada(ctx, compra, pagado, moneda, vence)
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "no se pudo enviar el correo de la cuota", logging.ConError(err, "purchase_intent_id", compra.ID, "email", logging.EnmascararEmail(compra.Email))...)
+		}
+	})
+}
+
+// reembolsarCuota devuelve monto del intent de una cuota; monto es menor que
+// lo cobrado cuando se retiene la comisión de cancelación. La idempotency key
+// es por intent, así un barrido repetido no devuelve dos veces.
+func (s *Server) reembolsarCuota(ctx context.Context, pi *stripe.PaymentIntent, monto int64, motivo string) error {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(pi.ID),
+		Amount:        stripe.Int64(monto),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+	}
+	revertirTransferencia(params, pi)
+	params.SetIdempotencyKey("refund-cuotas-" + pi.ID)
+
+	r, err := s.pagos.CreateRefund(ctx, params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeChargeAlreadyRefunded {
+			slog.InfoContext(ctx, "la cuota ya estaba reembolsada", "payment_intent_id", pi.ID)
+			return nil
+		}
+		return fmt.Errorf("reembolso de la cuota %s: %w", pi.ID, err)
+	}
+	slog.InfoContext(ctx, "cuota reembolsada", "refund_id", r.ID, "payment_intent_id", pi.ID, "amount", r.Amount, "reason", motivo)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaReembolso,
+		RifaID:          pi.Metadata["rifa_id"],
+		PaymentIntentID: pi.ID,
+		EntityID:        r.ID,
+		Detail:          map[string]interface{}{"amount": r.Amount, "currency": r.Currency, "reason": motivo, "provider": model.ProveedorStripe},
+	})
+	return nil
+}
+
+// SiguienteCuotaResponse es la respuesta de GET /payments/installment/{draftId}/next.
+// BalanceDue es el saldo antes de pagar esta cuota.
+type SiguienteCuotaResponse struct {
+	PaymentIntentID string `json:"paymentIntentId"`
+	ClientSecret    string `json:"clientSecret"`
+	Installment     int    `json:"installment"`
+	Installments    int    `json:"installments"`
+	Amount          int64  `json:"amount"`
+	BalanceDue      int64  `json:"balanceDue"`
+	Currency        string `json:"currency"`
+	DueAt           string `json:"dueAt"`
+	Reused          bool   `json:"reused,omitempty"`
+}
+
+// NextInstallment es GET /payments/installment/{draftId}/next: crea (o
+// retoma, si todavía se puede pagar) el PaymentIntent de la siguiente cuota
+// del plan del usuario. El webhook de ese intent abona la cuota a los tickets.
+func (s *Server) NextInstallment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	usuario := usuarioDe(ctx)
+	if usuario == nil {
+		writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Error: "Inicia sesión para pagar tu cuota", Code: "UNAUTHORIZED"})
+		return
+	}
+	compraID := r.PathValue("draftId")
+	compra, err := s.db.GetPurchaseDraftByID(ctx, compraID)
+	if err != nil && !errors.Is(err, model.ErrCompraNoEncontrada) {
+		slog.ErrorContext(ctx, "error buscando el plan de cuotas", logging.ConError(err, "purchase_intent_id", compraID)...)
+		http.Error(w, "Error buscando tu compra", 500)
+		return
+	}
+	// Un plan ajeno responde igual que uno inexistente
+	if err != nil || compra.UserID != usuario.Sub || compra.Installments < 2 {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "No hay un plan de cuotas con ese ID", Code: "NOT_FOUND"})
+		return
+	}
+
+	vence, _ := time.Parse(time.RFC3339, compra.InstallmentDueAt)
+	switch {
+	case compra.InstallmentStatus == "":
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{Error: "Todavía no se confirmó el pago de la primera cuota", Code: "FIRST_INSTALLMENT_PENDING"})
+		return
+	case compra.InstallmentStatus == model.PlanCuotasPagado:
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{Error: "El plan ya está pagado", Code: "ALREADY_PAID"})
+		return
+	case compra.InstallmentStatus != model.PlanCuotasActivo || !time.Now().Before(vence):
+		writeJSON(w, http.StatusGone, model.ErrorResponse{
+			Error:   "El plazo para pagar las cuotas venció; los números se liberan y se devuelve lo pagado",
+			Code:    "INSTALLMENT_EXPIRED",
+			Details: map[string]string{"dueAt": compra.InstallmentDueAt},
+		})
+		return
+	}
+
+	rifa, err := s.rifa(ctx, compra.RifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, compra.RifaID, err)
+		return
+	}
+	k, n := compra.InstallmentsPaid+1, compra.Installments
+	respuesta := SiguienteCuotaResponse{
+		Installment:  k,
+		Installments: n,
+		Amount:       montoCuota(compra.Amount, n, k),
+		BalanceDue:   compra.Amount - pagadoHastaCuota(compra.Amount, n, compra.InstallmentsPaid),
+		Currency:     payments.NormalizarMoneda(rifa.Currency),
+		DueAt:        compra.InstallmentDueAt,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if compra.NextInstallmentIntent != "" {
+		if pi, ok := s.intentPagable(ctx, &model.PurchaseDraft{PaymentIntentID: compra.NextInstallmentIntent}); ok {
+			respuesta.PaymentIntentID, respuesta.ClientSecret, respuesta.Reused = pi.ID, pi.ClientSecret, true
+			writeJSON(w, http.StatusOK, respuesta)
+			return
+		}
+	}
+
+	params := s.paramsIntent(respuesta.Amount, respuesta.Currency, compra.Email, rifa.Title, s.metadataRiesgo(r, usuario.Sub, map[string]string{
+		"rifa_id":            compra.RifaID,
+		"purchase_intent_id": compra.ID,
+		"installment":        strconv.Itoa(k),
+		"installments":       strconv.Itoa(n),
+	}))
+	s.cobrarParaOrganizador(params, rifa.OrganizerStripeAccount, respuesta.Amount)
+	// Con el intent anterior en la clave, uno cancelado no vuelve a salir de
+	// la idempotencia de Stripe
+	params.SetIdempotencyKey(fmt.Sprintf("installment-%s-%d-%s", compra.ID, k, compra.NextInstallmentIntent))
+	pi, err := s.pagos.CreateIntent(ctx, params)
+	if err != nil {
+		slog.ErrorContext(ctx, "error creando el intent de la cuota", logging.ConError(err, "purchase_intent_id", compra.ID, "installment", k)...)
+		responderErrorCreacionIntent(w, err, respuesta.Currency)
+		return
+	}
+	guardado, err := s.db.UpdateInstallmentPlan(ctx, compra.ID, model.PlanCuotasActivo, compra.InstallmentsPaid, model.CambioPlanCuotas{NextInstallmentIntent: &pi.ID})
+	if err != nil || !guardado {
+		// Sin guardar el intent, su pago no tendría a qué plan abonarse si el
+		// plan cambió; se cancela y el frontend vuelve a pedirlo
+		if err != nil {
+			slog.ErrorContext(ctx, "error guardando el intent de la cuota", logging.ConError(err, "purchase_intent_id", compra.ID, "payment_intent_id", pi.ID)...)
+		}
+		s.cancelarIntent(ctx, pi.ID)
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{Error: "El plan cambió mientras se preparaba la cuota; vuelve a intentarlo", Code: "INSTALLMENT_CONFLICT"})
+		return
+	}
+	slog.InfoContext(ctx, "intent de cuota creado", "purchase_intent_id", compra.ID, "payment_intent_id", pi.ID, "installment", k, "amount", respuesta.Amount)
+	respuesta.PaymentIntentID, respuesta.ClientSecret = pi.ID, pi.ClientSecret
+	writeJSON(w, http.StatusOK, respuesta)
+}
+
+// barrerCuotas cancela los planes de cuotas vencidos sin pagar
+func (s *Server) barrerCuotas(ctx context.Context) {
+	planes, err := s.db.OverdueInstallmentPlans(ctx, time.Now(), loteCuotasVencidas)
+	if err != nil {
+		slog.WarnContext(ctx, "error buscando planes de cuotas vencidos", logging.ConError(err)...)
+		return
+	}
+	for i := range planes {
+		if err := s.cancelarCuotas(ctx, &planes[i]); err != nil {
+			slog.WarnContext(ctx, "no se pudo cancelar el plan de cuotas vencido", logging.ConError(err, "purchase_intent_id", planes[i].ID)...)
+		}
+	}
+}
+
+// cancelarCuotas cierra un plan vencido: cancela el intent de la cuota
+// pendiente, libera los números y devuelve cada cuota pagada menos
+// INSTALLMENT_CANCEL_FEE_PERCENT. El plan queda canceling hasta terminar, así
+// un fallo a la mitad lo retoma el próximo barrido; una cuota que se pague
+// mientras tanto la devuelve procesarCuota.
+func (s *Server) cancelarCuotas(ctx context.Context, compra *model.PurchaseDraft) error {
+	if compra.InstallmentStatus == model.PlanCuotasActivo {
+		tomado, err := s.db.UpdateInstallmentPlan(ctx, compra.ID, model.PlanCuotasActivo, compra.InstallmentsPaid, model.CambioPlanCuotas{InstallmentStatus: model.PlanCuotasCancelando})
+		if err != nil || !tomado {
+			// Sin tomarlo es que se acaba de pagar una cuota: lo revisa el próximo barrido
+			return err
+		}
+	}
+	if compra.NextInstallmentIntent != "" {
+		s.cancelarIntent(ctx, compra.NextInstallmentIntent)
+	}
+	if err := s.db.SetTicketsStatus(ctx, compra.PaymentIntentID, nil, store.EstadoTicketReembolsado); err != nil {
+		return fmt.Errorf("tickets: %w", err)
+	}
+
+	var devuelto, retenido int64
+	var moneda string
+	for _, id := range compra.InstallmentIntents {
+		consulta := &stripe.PaymentIntentParams{}
+		consulta.AddExpand("latest_charge")
+		pi, err := s.pagos.GetIntent(ctx, id, consulta)
+		if err != nil {
+			return fmt.Errorf("stripe %s: %w", id, err)
+		}
+		moneda = string(pi.Currency)
+		comision := int64(math.Round(float64(pi.Amount) * s.cfg.InstallmentCancelFeePercent / 100))
+		devuelto += pi.Amount - comision
+		retenido += comision
+		if pi.LatestCharge != nil && pi.LatestCharge.AmountRefunded > 0 {
+			// Ya se devolvió en un barrido anterior, quizá pasadas las 24 horas
+			// de la idempotency key
+			continue
+		}
+		if pi.Amount-comision > 0 {
+			if err := s.reembolsarCuota(ctx, pi, pi.Amount-comision, "plan_cuotas_vencido"); err != nil {
+				return err
+			}
+		}
+	}
+
+	cerrado, err := s.db.UpdateInstallmentPlan(ctx, compra.ID, model.PlanCuotasCancelando, compra.InstallmentsPaid, model.CambioPlanCuotas{InstallmentStatus: model.PlanCuotasCancelado})
+	if err != nil || !cerrado {
+		return err
+	}
+	slog.InfoContext(ctx, "plan de cuotas vencido cancelado", "purchase_intent_id", compra.ID, "payment_intent_id", compra.PaymentIntentID, "installments_paid", compra.InstallmentsPaid, "refunded", devuelto, "fee", retenido)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaCuotasVencidas,
+		RifaID:          compra.RifaID,
+		PaymentIntentID: compra.PaymentIntentID,
+		EntityID:        compra.ID,
+		Detail: map[string]interface{}{
+			"numeros":           compra.Numeros,
+			"installments_paid": compra.InstallmentsPaid,
+			"refunded":          devuelto,
+			"fee":               retenido,
+			"currency":          moneda,
+		},
+	})
+	s.liberarNumeros(ctx, compra.RifaID, compra.Numeros)
+	if compra.Email != "" {
+		enSegundoPlano(ctx, func(ctx context.Context) {
+			err := reintentarCorreo(ctx, compra.Email, func() error {
+				return s.enviarCorreoCuotasVencidas(ctx, compra, devuelto, retenido, moneda)
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "no se pudo avisar el vencimiento del plan de cuotas", logging.ConError(err, "purchase_intent_id", compra.ID, "email", logging.EnmascararEmail(compra.Email))...)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/store"
+)
+
+// procesarCargoReembolsado sincroniza los tickets con un reembolso hecho fuera
+// de la API (p. ej. desde el dashboard de Stripe). Un reembolso total marca
+// todos los tickets del intent; uno parcial no se puede asociar a números, así
+// que si no lo explica un reembolso administrativo se avisa al organizador.
+func (s *Server) procesarCargoReembolsado(ctx context.Context, cargo *stripe.Charge) error {
+	if cargo.PaymentIntent == nil || cargo.PaymentIntent.ID == "" {
+		slog.InfoContext(ctx, "reembolso de un cargo sin PaymentIntent", "charge_id", cargo.ID)
+		return nil
+	}
+	piID := cargo.PaymentIntent.ID
+	// AmountRefunded es acumulado: cubre también los reembolsos administrativos,
+	// que llegan aquí con los tickets ya marcados
+	if err := s.descontarReferido(ctx, piID, cargo.AmountRefunded); err != nil {
+		return fmt.Errorf("descontando la comisión de referido: %w", err)
+	}
+
+	tickets, err := s.db.PaymentIntentTickets(ctx, piID)
+	if err != nil {
+		return err
+	}
+	var vigentes []int
+	var liberados []model.TicketAdmin
+	var yaReembolsado int64
+	for _, t := range tickets {
+		if t.Status == store.EstadoTicketReembolsado {
+			yaReembolsado += t.AmountPaid
+		} else {
+			vigentes = append(vigentes, t.Number)
+			liberados = append(liberados, t)
+		}
+	}
+	if len(vigentes) == 0 {
+		// Sin tickets vigentes: fue un reembolso administrativo o la compensación
+		// de un registro fallido, ya está todo al día
+		return nil
+	}
+
+	if cargo.Refunded {
+		if err := s.db.SetTicketsStatus(ctx, piID, nil, store.EstadoTicketReembolsado); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "tickets marcados como reembolsados", "payment_intent_id", piID, "numeros", vigentes)
+		s.liberarTickets(ctx, liberados)
+		s.avisarOrganizadorEnSegundoPlano(ctx, fmt.Sprintf("Reembolso total de %s", piID), "Reembolso desde Stripe", []string{
+			"PaymentIntent: " + piID,
+			"Monto reembolsado: " + payments.FormatearMonto(cargo.AmountRefunded, string(cargo.Currency)),
+			"Números liberados: " + mail.FormatearNumeros(vigentes),
+		})
+		return nil
+	}
+
+	if cargo.AmountRefunded > yaReembolsado {
+		slog.WarnContext(ctx, "reembolso parcial sin números asociados", "payment_intent_id", piID, "amount_refunded", cargo.AmountRefunded)
+		s.avisarOrganizadorEnSegundoPlano(ctx, fmt.Sprintf("Reembolso parcial de %s para revisar", piID), "Reembolso parcial desde Stripe", []string{
+			"PaymentIntent: " + piID,
+			"Monto reembolsado: " + payments.FormatearMonto(cargo.AmountRefunded, string(cargo.Currency)),
+			"Números todavía vigentes: " + mail.FormatearNumeros(vigentes),
+			"Usa POST /admin/payments/{id}/refund con los números para liberarlos.",
+		})
+	}
+	return nil
+}
+
+// procesarDisputa marca los tickets del intent como disputados (no pueden
+// ganar pero siguen ocupando el número), bloquea al comprador en blocked_buyers
+// y avisa al organizador.
+func (s *Server) procesarDisputa(ctx context.Context, disputa *stripe.Dispute) error {
+	if disputa.PaymentIntent == nil || disputa.PaymentIntent.ID == "" {
+		slog.WarnContext(ctx, "disputa de un cargo sin PaymentIntent", "dispute_id", disputa.ID)
+		return nil
+	}
+
+	pi, err := s.pagos.GetIntent(ctx, disputa.PaymentIntent.ID, nil)
+	if err != nil {
+		return fmt.Errorf("consultando el intent disputado: %w", err)
+	}
+	if err := s.db.SetTicketsStatus(ctx, pi.ID, nil, store.EstadoTicketDisputado); err != nil {
+		return err
+	}
+	if err := s.descontarReferido(ctx, pi.ID, pi.Amount); err != nil {
+		return fmt.Errorf("descontando la comisión de referido: %w", err)
+	}
+
+	compra, err := s.cargarCompra(ctx, pi)
+	if err != nil {
+		return fmt.Errorf("cargando la compra disputada: %w", err)
+	}
+	if compra.PaymentIntentID != pi.ID {
+		// Una cuota posterior no tiene tickets: los del plan son de la primera
+		if err := s.db.SetTicketsStatus(ctx, compra.PaymentIntentID, nil, store.EstadoTicketDisputado); err != nil {
+			return err
+		}
+	}
+	motivo := "disputa " + string(disputa.Reason)
+	if err := s.bloquearComprador(ctx, &model.CompradorBloqueado{Email: compra.Email, UserID: compra.UserID, PaymentIntentID: pi.ID, Reason: motivo}); err != nil {
+		return err
+	}
+	slog.WarnContext(ctx, "compra disputada, comprador bloqueado", "payment_intent_id", pi.ID, "dispute_id", disputa.ID, "reason", disputa.Reason, "email", logging.EnmascararEmail(compra.Email))
+
+	detalles := []string{
+		"Rifa: " + compra.RifaTitle,
+		"Comprador: " + compra.Email,
+		"PaymentIntent: " + pi.ID,
+		"Disputa: " + disputa.ID + " (" + string(disputa.Reason) + ")",
+		"Monto: " + payments.FormatearMonto(disputa.Amount, string(disputa.Currency)),
+	}
+	for _, item := range itemsDeCompra(compra) {
+		detalles = append(detalles, "Números en "+item.RifaTitle+": "+mail.FormatearNumeros(item.Numeros))
+	}
+	s.avisarOrganizadorEnSegundoPlano(ctx, fmt.Sprintf("Disputa en %s", compra.RifaTitle), "Disputa (contracargo)", detalles)
+	return nil
+}
+
+func (s *Server) avisarOrganizadorEnSegundoPlano(ctx context.Context, asunto string, titulo string, detalles []string) {
+	enSegundoPlano(ctx, func(ctx context.Context) {
+		if err := s.enviarAvisoOrganizador(ctx, asunto, titulo, detalles); err != nil {
+			slog.WarnContext(ctx, "error avisando al organizador", logging.ConError(err, "asunto", asunto)...)
+		}
+	})
+}
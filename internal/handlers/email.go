@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// dominiosDesechables es la lista base de dominios de correos temporales, uno
+// por línea; DISPOSABLE_DOMAINS_FILE agrega más sin recompilar
+//
+//go:embed dominios_desechables.txt
+var dominiosDesechables string
+
+const (
+	// ttlMX es cuánto se recuerda si un dominio recibe correo
+	ttlMX = time.Hour
+	// maxEntradasMX limita el cache igual que maxEntradasBloqueos
+	maxEntradasMX = 10000
+)
+
+// verificadorEmail decide si vale la pena mandar los números a un email: que
+// el dominio no sea de correos temporales y que tenga MX (o A/AAAA, que
+// también recibe correo). Las respuestas del DNS se guardan por ttlMX; los
+// errores transitorios no se guardan y dejan pasar el email.
+type verificadorEmail struct {
+	desechables map[string]bool
+	timeout     time.Duration
+	resolver    *net.Resolver
+
+	mu    sync.Mutex
+	items map[string]entradaMX
+}
+
+type entradaMX struct {
+	recibe bool
+	vence  time.Time
+}
+
+func nuevoVerificadorEmail(cfg *config.Config) *verificadorEmail {
+	v := &verificadorEmail{
+		desechables: make(map[string]bool),
+		timeout:     cfg.EmailMXTimeout,
+		resolver:    net.DefaultResolver,
+		items:       make(map[string]entradaMX),
+	}
+	for _, d := range strings.Fields(dominiosDesechables) {
+		v.desechables[strings.ToLower(d)] = true
+	}
+	for _, d := range cfg.DisposableDomains {
+		v.desechables[d] = true
+	}
+	return v
+}
+
+// desechable también reconoce los subdominios (x.mailinator.com)
+func (v *verificadorEmail) desechable(dominio string) bool {
+	for {
+		if v.desechables[dominio] {
+			return true
+		}
+		_, padre, ok := strings.Cut(dominio, ".")
+		if !ok || !strings.Contains(padre, ".") {
+			return false
+		}
+		dominio = padre
+	}
+}
+
+// recibeCorreo consulta el DNS pasando por el cache. Sólo un dominio que no
+// existe, sin MX ni A/AAAA o con MX nulo (RFC 7505) se da por inválido; un
+// timeout o un error del resolver deja pasar el email.
+func (v *verificadorEmail) recibeCorreo(ctx context.Context, dominio string) bool {
+	ahora := time.Now()
+	v.mu.Lock()
+	e, ok := v.items[dominio]
+	v.mu.Unlock()
+	if ok && ahora.Before(e.vence) {
+		return e.recibe
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+	recibe, seguro := v.consultarDNS(ctx, dominio)
+	if !seguro {
+		slog.WarnContext(ctx, "no se pudo consultar el MX, se acepta el email", "domain", dominio)
+		return true
+	}
+
+	v.mu.Lock()
+	if len(v.items) >= maxEntradasMX {
+		v.items = make(map[string]entradaMX)
+	}
+	v.items[dominio] = entradaMX{recibe: recibe, vence: ahora.Add(ttlMX)}
+	v.mu.Unlock()
+	return recibe
+}
+
+// consultarDNS devuelve seguro en false si la respuesta no es definitiva
+func (v *verificadorEmail) consultarDNS(ctx context.Context, dominio string) (recibe bool, seguro bool) {
+	mx, err := v.resolver.LookupMX(ctx, dominio)
+	if err == nil {
+		// MX nulo: el dominio declara que no recibe correo
+		if len(mx) == 1 && mx[0].Host == "." {
+			return false, true
+		}
+		return len(mx) > 0, true
+	}
+	if !dnsNoEncontrado(err) {
+		return false, false
+	}
+	// Sin MX el correo va a la dirección del dominio (RFC 5321)
+	if _, err := v.resolver.LookupHost(ctx, dominio); err != nil {
+		return false, dnsNoEncontrado(err)
+	}
+	return true, true
+}
+
+func dnsNoEncontrado(err error) bool {
+	var errDNS *net.DNSError
+	return errors.As(err, &errDNS) && errDNS.IsNotFound
+}
+
+// verificarEmailComprador responde 422 EMAIL_INVALID o EMAIL_DISPOSABLE si no
+// tiene sentido mandar los números a req.Email. Sin email (un usuario sin
+// correo en la sesión) o con EMAIL_VALIDATION=off no revisa nada. Llamar
+// después de identificarComprador. Devuelve false si ya respondió con un error.
+func (s *Server) verificarEmailComprador(ctx context.Context, w http.ResponseWriter, req *model.PaymentRequest) bool {
+	if !s.cfg.EmailValidation || req.Email == "" {
+		return true
+	}
+	if !emailValido(req.Email) {
+		writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{Error: "El email no es válido", Code: "EMAIL_INVALID"})
+		return false
+	}
+	_, dominio, _ := strings.Cut(req.Email, "@")
+	dominio = strings.TrimSuffix(strings.ToLower(dominio), ".")
+	if s.emails.desechable(dominio) {
+		slog.InfoContext(ctx, "email temporal rechazado", "rifa_id", req.RifaID, "email", logging.EnmascararEmail(req.Email))
+		writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Error: "No aceptamos correos temporales: usa un email donde puedas recibir tus números",
+			Code:  "EMAIL_DISPOSABLE",
+		})
+		return false
+	}
+	if !s.emails.recibeCorreo(ctx, dominio) {
+		slog.InfoContext(ctx, "email sin servidor de correo rechazado", "rifa_id", req.RifaID, "email", logging.EnmascararEmail(req.Email))
+		writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Error: "El dominio del email no recibe correos, revisa que esté bien escrito",
+			Code:  "EMAIL_INVALID",
+		})
+		return false
+	}
+	return true
+}
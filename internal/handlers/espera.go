@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// loteEsperaVencida es cuántos ofrecimientos vencidos de la lista de espera
+// se pasan al siguiente por barrido
+const loteEsperaVencida = 100
+
+// WaitlistRequest es el cuerpo de POST /rifas/{id}/waitlist
+type WaitlistRequest struct {
+	Numero int `json:"numero"`
+}
+
+// EntradaWaitlist es una entrada de la lista de espera del usuario.
+// ClaimExpiresAt es hasta cuándo tiene el número ofrecido; sólo en notified.
+type EntradaWaitlist struct {
+	Number         int        `json:"number"`
+	Status         string     `json:"status"`
+	JoinedAt       *time.Time `json:"joinedAt,omitempty"`
+	ClaimExpiresAt *time.Time `json:"claimExpiresAt,omitempty"`
+}
+
+// WaitlistResponse es la respuesta de GET /rifas/{id}/waitlist
+type WaitlistResponse struct {
+	RifaID  string            `json:"rifaId"`
+	Entries []EntradaWaitlist `json:"entries"`
+}
+
+func entradaWaitlist(e model.EntradaEspera) EntradaWaitlist {
+	return EntradaWaitlist{Number: e.Number, Status: e.Status, JoinedAt: e.CreatedAt, ClaimExpiresAt: e.ClaimExpiresAt}
+}
+
+// Waitlist es /rifas/{id}/waitlist para el usuario del JWT: POST lo anota
+// para un número vendido o reservado, GET lista sus entradas en la rifa y
+// DELETE ?number= cancela una. Cuando el número se libera (reembolso o reserva
+// vencida) se le ofrece por correo al primero de la lista.
+func (s *Server) Waitlist(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	usuario := usuarioDe(ctx)
+	if usuario == nil {
+		writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Error: "Inicia sesión para usar la lista de espera", Code: "UNAUTHORIZED"})
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		s.unirseEspera(w, r, usuario)
+	case http.MethodGet:
+		s.listarEspera(w, r, usuario)
+	case http.MethodDelete:
+		s.cancelarEspera(w, r, usuario)
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) unirseEspera(w http.ResponseWriter, r *http.Request, usuario *UsuarioAutenticado) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+	if usuario.Email == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Tu cuenta no tiene un email para avisarte", Code: "EMAIL_REQUIRED"})
+		return
+	}
+	var req WaitlistRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCuerpoJSON)).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+
+	rifa, err := s.rifa(ctx, rifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, rifaID, err)
+		return
+	}
+	// Una rifa agotada sí acepta la lista de espera: es justo cuando sirve
+	if !rifaAbierta(rifa, time.Now()) {
+		writeJSON(w, http.StatusGone, model.ErrorResponse{Error: "Esta rifa ya no está a la venta", Code: "RIFA_CLOSED"})
+		return
+	}
+	if !validarNumerosSeleccionados(ctx, w, rifa, []int{req.Numero}) {
+		return
+	}
+	ocupados, err := s.db.CheckNumbers(ctx, rifa.ID, []int{req.Numero})
+	if err != nil {
+		slog.ErrorContext(ctx, "error validando el número de la lista de espera", logging.ConError(err, "rifa_id", rifa.ID)...)
+		responderDisponibilidadNoVerificada(w, err)
+		return
+	}
+	if len(ocupados) == 0 {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{
+			Error:   "Ese número está disponible: cómpralo directamente",
+			Code:    "NUMBER_AVAILABLE",
+			Details: map[string]int{"numero": req.Numero},
+		})
+		return
+	}
+
+	entrada, err := s.db.AddWaitlistEntry(ctx, &model.EntradaEspera{
+		RifaID: rifa.ID,
+		Number: req.Numero,
+		UserID: usuario.Sub,
+		Email:  usuario.Email,
+	})
+	if errors.Is(err, model.ErrYaEnEspera) {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{Error: "Ya estás en la lista de espera de ese número", Code: "ALREADY_WAITLISTED"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error anotando en la lista de espera", logging.ConError(err, "rifa_id", rifa.ID, "user_id", usuario.Sub)...)
+		http.Error(w, "Error guardando la lista de espera", 500)
+		return
+	}
+	slog.InfoContext(ctx, "anotado en la lista de espera", "rifa_id", rifa.ID, "numero", req.Numero, "user_id", usuario.Sub)
+	writeJSON(w, http.StatusCreated, entradaWaitlist(*entrada))
+}
+
+func (s *Server) listarEspera(w http.ResponseWriter, r *http.Request, usuario *UsuarioAutenticado) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+	entradas, err := s.db.UserWaitlist(ctx, rifaID, usuario.Sub)
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando la lista de espera", logging.ConError(err, "rifa_id", rifaID, "user_id", usuario.Sub)...)
+		http.Error(w, "Error consultando la lista de espera", 500)
+		return
+	}
+	respuesta := WaitlistResponse{RifaID: rifaID, Entries: make([]EntradaWaitlist, len(entradas))}
+	for i, e := range entradas {
+		respuesta.Entries[i] = entradaWaitlist(e)
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	writeJSON(w, http.StatusOK, respuesta)
+}
+
+func (s *Server) cancelarEspera(w http.ResponseWriter, r *http.Request, usuario *UsuarioAutenticado) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+	numero, err := strconv.Atoi(r.URL.Query().Get("number"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta el número a cancelar (?number=)", Code: "INVALID_NUMBERS"})
+		return
+	}
+	borrada, err := s.db.CancelWaitlistEntry(ctx, rifaID, usuario.Sub, numero)
+	if err != nil {
+		slog.ErrorContext(ctx, "error cancelando la lista de espera", logging.ConError(err, "rifa_id", rifaID, "user_id", usuario.Sub)...)
+		http.Error(w, "Error cancelando la lista de espera", 500)
+		return
+	}
+	if !borrada {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "No estás en la lista de espera de ese número", Code: "NOT_FOUND"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// liberarNumeros avisa que los números volvieron a estar disponibles: a los
+// streams de la rifa enseguida y, en segundo plano, al primero de la lista de
+// espera de cada número
+func (s *Server) liberarNumeros(ctx context.Context, rifaID string, numeros []int) {
+	if len(numeros) == 0 {
+		return
+	}
+	s.publicarNumeros(rifaID, EventoNumeroLiberado, numeros)
+	enSegundoPlano(ctx, func(ctx context.Context) {
+		for _, n := range numeros {
+			s.avisarEspera(ctx, rifaID, n)
+		}
+	})
+}
+
+// liberarTickets es liberarNumeros para los tickets reembolsados de un intent,
+// que en un carrito son de varias rifas
+func (s *Server) liberarTickets(ctx context.Context, tickets []model.TicketAdmin) {
+	porRifa := map[string][]int{}
+	for _, t := range tickets {
+		porRifa[t.RifaID] = append(porRifa[t.RifaID], t.Number)
+	}
+	for rifaID, numeros := range porRifa {
+		s.liberarNumeros(ctx, rifaID, numeros)
+	}
+}
+
+// avisarEspera le ofrece el número al primero de su lista de espera, si lo hay
+// y el número sigue libre. Mientras el primero tenga el ofrecimiento vigente no
+// se avisa a nadie más; al vencer lo pasa al siguiente barrerEspera.
+func (s *Server) avisarEspera(ctx context.Context, rifaID string, numero int) {
+	entrada, err := s.db.NextWaitlistEntry(ctx, rifaID, numero)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo consultar la lista de espera", logging.ConError(err, "rifa_id", rifaID, "numero", numero)...)
+		return
+	}
+	if entrada == nil || entrada.Status != model.EsperaPendiente {
+		return
+	}
+	// Otra compra pudo tomarlo entre la liberación y este punto
+	ocupados, err := s.db.CheckNumbers(ctx, rifaID, []int{numero})
+	if err != nil || len(ocupados) > 0 {
+		return
+	}
+	rifa, err := s.rifa(ctx, rifaID)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo leer la rifa para la lista de espera", logging.ConError(err, "rifa_id", rifaID)...)
+		return
+	}
+
+	vence := time.Now().Add(s.cfg.WaitlistClaimTTL)
+	marcada, err := s.db.MarkWaitlistNotified(ctx, entrada.ID, vence)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo marcar la lista de espera", logging.ConError(err, "rifa_id", rifaID, "numero", numero)...)
+		return
+	}
+	if !marcada {
+		// Otra instancia ya avisó, o el usuario canceló
+		return
+	}
+	err = reintentarCorreo(ctx, entrada.Email, func() error {
+		return s.enviarCorreoEspera(ctx, entrada.Email, rifa.ID, rifa.Title, numero, vence)
+	})
+	if err != nil {
+		// La entrada queda notified: al vencer el plazo se avisa al siguiente
+		slog.ErrorContext(ctx, "no se pudo avisar a la lista de espera", logging.ConError(err, "rifa_id", rifaID, "numero", numero, "email", logging.EnmascararEmail(entrada.Email))...)
+		return
+	}
+	slog.InfoContext(ctx, "número ofrecido a la lista de espera", "rifa_id", rifaID, "numero", numero, "user_id", entrada.UserID)
+}
+
+// barrerEspera vence los ofrecimientos de la lista de espera cuyo plazo pasó
+// y, si el número sigue libre, se lo ofrece al siguiente
+func (s *Server) barrerEspera(ctx context.Context) {
+	vencidas, err := s.db.ExpiredWaitlistClaims(ctx, loteEsperaVencida)
+	if err != nil {
+		slog.WarnContext(ctx, "error buscando ofrecimientos vencidos de la lista de espera", logging.ConError(err)...)
+		return
+	}
+	for _, e := range vencidas {
+		vencida, err := s.db.ExpireWaitlistEntry(ctx, e.ID)
+		if err != nil {
+			slog.WarnContext(ctx, "no se pudo vencer la entrada de la lista de espera", logging.ConError(err, "rifa_id", e.RifaID, "numero", e.Number)...)
+			continue
+		}
+		if vencida {
+			s.avisarEspera(ctx, e.RifaID, e.Number)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// EstadoPago es la respuesta de GET /payments/status/{paymentIntentId}
+type EstadoPago struct {
+	StripeStatus      stripe.PaymentIntentStatus `json:"stripeStatus"`
+	TicketsRegistered bool                       `json:"ticketsRegistered"`
+	Numbers           []int                      `json:"numbers"`
+}
+
+// PaymentStatus permite al frontend hacer polling hasta que el webhook
+// registre los tickets. Hay que presentar el client secret del intent
+// (cabecera X-Client-Secret o ?client_secret=) o el JWT de su dueño; en
+// cualquier otro caso se responde 404, igual que si el intent no existiera.
+func (s *Server) PaymentStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	id := r.PathValue("paymentIntentId")
+	noEncontrado := func() {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "Intento de pago no encontrado", Code: "NOT_FOUND"})
+	}
+
+	pi, err := s.pagos.GetIntent(ctx, id, nil)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+			noEncontrado()
+			return
+		}
+		slog.ErrorContext(ctx, "error consultando PaymentIntent", logging.ConError(err, "payment_intent_id", id)...)
+		http.Error(w, "Error Stripe", 500)
+		return
+	}
+
+	if !s.puedeVerIntent(r, pi) {
+		slog.WarnContext(ctx, "consulta de estado sin credenciales válidas", "payment_intent_id", id)
+		noEncontrado()
+		return
+	}
+
+	numeros, err := s.db.TicketsByPaymentIntent(ctx, pi.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando tickets del intent", logging.ConError(err, "payment_intent_id", pi.ID)...)
+		http.Error(w, "Error consultando tickets", 500)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, EstadoPago{
+		StripeStatus:      pi.Status,
+		TicketsRegistered: len(numeros) > 0,
+		Numbers:           numeros,
+	})
+}
+
+// puedeVerIntent acepta el client secret del intent o una sesión del usuario
+// que creó la compra
+func (s *Server) puedeVerIntent(r *http.Request, pi *stripe.PaymentIntent) bool {
+	secreto := r.Header.Get("X-Client-Secret")
+	if secreto == "" {
+		secreto = r.URL.Query().Get("client_secret")
+	}
+	if secreto != "" && subtle.ConstantTimeCompare([]byte(secreto), []byte(pi.ClientSecret)) == 1 {
+		return true
+	}
+
+	usuario := usuarioDe(r.Context())
+	if usuario == nil {
+		return false
+	}
+	compra, err := s.cargarCompra(r.Context(), pi)
+	return err == nil && compra.UserID != "" && compra.UserID == usuario.Sub
+}
+
+// maxBorradoresPendientes es cuántos borradores vigentes se revisan en Stripe
+// al buscar uno para retomar
+const maxBorradoresPendientes = 5
+
+// IntentPendiente es la respuesta de GET /payments/intent. Numeros son los de
+// la rifa pedida, también si el borrador es un carrito; Amount es el total.
+type IntentPendiente struct {
+	PaymentIntentID string `json:"paymentIntentId"`
+	ClientSecret    string `json:"clientSecret"`
+	RifaID          string `json:"rifaId"`
+	Numeros         []int  `json:"numeros"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	ExpiresAt       string `json:"expiresAt"`
+}
+
+// PendingIntent es GET /payments/intent?rifaId=&userId=: devuelve el borrador
+// vigente más reciente del usuario en la rifa con el clientSecret recién leído
+// de Stripe, para que el frontend retome el pago después de recargar la página
+// en vez de crear otro intent. Los borradores cuyo intent ya se canceló, se
+// pagó o está en proceso no cuentan; sin ninguno se responde 404.
+func (s *Server) PendingIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	usuario := usuarioDe(ctx)
+	if usuario == nil {
+		writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Error: "Inicia sesión para retomar tu compra", Code: "UNAUTHORIZED"})
+		return
+	}
+	q := r.URL.Query()
+	rifaID := q.Get("rifaId")
+	if rifaID == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta rifaId", Code: "RIFA_REQUIRED"})
+		return
+	}
+	// userId es opcional; si viene tiene que ser el del JWT, como en la compra
+	if userID := q.Get("userId"); userID != "" && userID != usuario.Sub {
+		writeJSON(w, http.StatusForbidden, model.ErrorResponse{Error: "userId no coincide con la sesión", Code: "FORBIDDEN"})
+		return
+	}
+
+	borradores, err := s.db.OpenPurchaseDrafts(ctx, rifaID, usuario.Sub, maxBorradoresPendientes)
+	if err != nil {
+		slog.ErrorContext(ctx, "error buscando borradores pendientes", logging.ConError(err, "rifa_id", rifaID, "user_id", usuario.Sub)...)
+		http.Error(w, "Error buscando tu compra", 500)
+		return
+	}
+	for i := range borradores {
+		compra := &borradores[i]
+		pi, ok := s.intentPagable(ctx, compra)
+		if !ok {
+			continue
+		}
+		numeros := compra.Numeros
+		for _, item := range compra.Items {
+			if item.RifaID == rifaID {
+				numeros = item.Numeros
+			}
+		}
+		slog.InfoContext(ctx, "intent retomado", "rifa_id", rifaID, "payment_intent_id", pi.ID)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, IntentPendiente{
+			PaymentIntentID: pi.ID,
+			ClientSecret:    pi.ClientSecret,
+			RifaID:          rifaID,
+			Numeros:         numeros,
+			Amount:          compra.Amount,
+			Currency:        string(pi.Currency),
+			ExpiresAt:       compra.ExpiresAt,
+		})
+		return
+	}
+	writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "No hay una compra pendiente para retomar", Code: "NOT_FOUND"})
+}
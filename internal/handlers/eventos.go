@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/metrics"
+	"PaymentsGo/internal/model"
+)
+
+// Eventos de GET /rifas/{id}/events
+const (
+	EventoNumeroTomado   = "number_taken"
+	EventoNumeroLiberado = "number_released"
+	// EventoSnapshot es el estado completo que recibe quien reconecta con
+	// Last-Event-ID, por los eventos que se perdió mientras no estaba
+	EventoSnapshot = "snapshot"
+)
+
+const (
+	// latidoEventos es cada cuánto se manda un comentario para que proxies y
+	// balanceadores no corten la conexión por inactividad
+	latidoEventos = 25 * time.Second
+	// bufferSuscriptor son los eventos pendientes de un cliente lento; si se
+	// llena se lo desconecta y al reconectar recibe el snapshot
+	bufferSuscriptor = 32
+)
+
+var suscriptoresEventos = metrics.NewGauge("rifa_events_subscribers", "Clientes conectados a GET /rifas/{id}/events")
+
+type eventoNumeros struct {
+	id      uint64
+	tipo    string
+	numeros []int
+}
+
+type suscriptor struct {
+	canal chan eventoNumeros
+}
+
+// hubRifas reparte los cambios de números entre los clientes de cada rifa.
+// Es de este proceso: con varias instancias, un cliente sólo ve lo que pasa en
+// la suya y el snapshot al reconectar cubre el resto.
+type hubRifas struct {
+	mu         sync.Mutex
+	maxPorRifa int
+	rifas      map[string]map[*suscriptor]bool
+	ultimoID   uint64
+	cerrado    bool
+}
+
+func nuevoHubRifas(maxPorRifa int) *hubRifas {
+	return &hubRifas{maxPorRifa: maxPorRifa, rifas: make(map[string]map[*suscriptor]bool)}
+}
+
+// suscribir registra un cliente; false si la rifa ya tiene maxPorRifa o el
+// servidor se está apagando
+func (h *hubRifas) suscribir(rifaID string) (*suscriptor, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cerrado || len(h.rifas[rifaID]) >= h.maxPorRifa {
+		return nil, false
+	}
+	if h.rifas[rifaID] == nil {
+		h.rifas[rifaID] = make(map[*suscriptor]bool)
+	}
+	sub := &suscriptor{canal: make(chan eventoNumeros, bufferSuscriptor)}
+	h.rifas[rifaID][sub] = true
+	suscriptoresEventos.Add(1)
+	return sub, true
+}
+
+// desuscribir saca al cliente; no hace nada si publicar o cerrar ya lo sacaron
+func (h *hubRifas) desuscribir(rifaID string, sub *suscriptor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.quitar(rifaID, sub)
+}
+
+// quitar cierra el canal del cliente; se llama con mu tomado
+func (h *hubRifas) quitar(rifaID string, sub *suscriptor) {
+	subs := h.rifas[rifaID]
+	if !subs[sub] {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.rifas, rifaID)
+	}
+	close(sub.canal)
+	suscriptoresEventos.Add(-1)
+}
+
+// publicar manda el evento a los clientes de la rifa sin esperar a ninguno
+func (h *hubRifas) publicar(rifaID string, tipo string, numeros []int) {
+	if len(numeros) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ultimoID++
+	evento := eventoNumeros{id: h.ultimoID, tipo: tipo, numeros: numeros}
+	for sub := range h.rifas[rifaID] {
+		select {
+		case sub.canal <- evento:
+		default:
+			h.quitar(rifaID, sub)
+		}
+	}
+}
+
+func (h *hubRifas) idActual() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ultimoID
+}
+
+// cerrar desconecta a todos; Shutdown no cancela el contexto de las
+// peticiones y sin esto esperaría a los streams hasta agotar la gracia
+func (h *hubRifas) cerrar() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cerrado = true
+	for rifaID, subs := range h.rifas {
+		for sub := range subs {
+			h.quitar(rifaID, sub)
+		}
+	}
+}
+
+// CerrarEventos corta los streams de GET /rifas/{id}/events al apagar
+// (http.Server.RegisterOnShutdown)
+func (s *Server) CerrarEventos() {
+	s.eventos.cerrar()
+}
+
+// publicarNumeros avisa a los clientes de la rifa que los números se tomaron
+// o se liberaron
+func (s *Server) publicarNumeros(rifaID string, tipo string, numeros []int) {
+	s.eventos.publicar(rifaID, tipo, numeros)
+}
+
+// StreamEventosRifa es GET /rifas/{id}/events: un stream SSE con
+// number_taken cuando se reservan números o se registran tickets y
+// number_released cuando el barrido libera una reserva vencida. Quien
+// reconecta con Last-Event-ID recibe antes un snapshot con el estado de todos
+// los números.
+func (s *Server) StreamEventosRifa(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+	rifa, err := s.rifa(ctx, rifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, rifaID, err)
+		return
+	}
+	sub, ok := s.eventos.suscribir(rifa.ID)
+	if !ok {
+		w.Header().Set("Retry-After", "30")
+		writeJSON(w, http.StatusServiceUnavailable, model.ErrorResponse{
+			Error: "Hay demasiados clientes conectados a esta rifa, intenta en unos segundos",
+			Code:  "TOO_MANY_SUBSCRIBERS",
+		})
+		return
+	}
+	defer s.eventos.desuscribir(rifa.ID, sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Sin esto nginx junta los eventos en su buffer
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// enviar escribe y hace flush, renovando el WriteTimeout del servidor,
+	// que si no cortaría el stream a los 30 segundos
+	enviar := func(texto string) bool {
+		rc.SetWriteDeadline(time.Now().Add(2 * latidoEventos))
+		if _, err := fmt.Fprint(w, texto); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	if r.Header.Get("Last-Event-ID") != "" {
+		// El ID se toma antes de leer: un evento que llegue durante la lectura
+		// se repite después del snapshot, no se pierde
+		id := s.eventos.idActual()
+		estado, err := s.estadoNumeros(ctx, rifa)
+		if err != nil {
+			slog.WarnContext(ctx, "no se pudo armar el snapshot de números", logging.ConError(err, "rifa_id", rifa.ID)...)
+			return
+		}
+		datos, _ := json.Marshal(estado)
+		if !enviar(textoEvento(id, EventoSnapshot, datos)) {
+			return
+		}
+	} else if !enviar(": conectado\n\n") {
+		return
+	}
+
+	latido := time.NewTicker(latidoEventos)
+	defer latido.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-latido.C:
+			if !enviar(": ping\n\n") {
+				return
+			}
+		case evento, abierto := <-sub.canal:
+			if !abierto {
+				// Cliente lento o servidor apagándose: el navegador reconecta solo
+				return
+			}
+			datos, _ := json.Marshal(map[string][]int{"numeros": evento.numeros})
+			if !enviar(textoEvento(evento.id, evento.tipo, datos)) {
+				return
+			}
+		}
+	}
+}
+
+func textoEvento(id uint64, tipo string, datos []byte) string {
+	return "id: " + strconv.FormatUint(id, 10) + "\nevent: " + tipo + "\ndata: " + string(datos) + "\n\n"
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+// Una compra de monto 0 (rifa gratis o código del 100%) no pasa por Stripe:
+// sus reservas y tickets usan un payment_intent_id sintético con este prefijo.
+const prefijoCompraGratis = "free_"
+
+func esIntentGratis(paymentIntentID string) bool {
+	return strings.HasPrefix(paymentIntentID, prefijoCompraGratis)
+}
+
+// intentGratis es el intent que ocupa el lugar del de Stripe en una compra
+// gratis; el ID sale del borrador, así un reintento usa el mismo
+func intentGratis(compraID string, moneda string) *stripe.PaymentIntent {
+	return &stripe.PaymentIntent{
+		ID:       prefijoCompraGratis + compraID,
+		Currency: stripe.Currency(moneda),
+		Status:   stripe.PaymentIntentStatusSucceeded,
+	}
+}
+
+// verificarMontoMinimo responde 422 AMOUNT_TOO_SMALL si el monto no es 0 pero
+// no llega al cargo mínimo de Stripe para la moneda. Devuelve false si ya
+// respondió con un error.
+func verificarMontoMinimo(ctx context.Context, w http.ResponseWriter, monto int64, moneda string) bool {
+	minimo, ok := payments.MinimoStripe(moneda)
+	if monto == 0 || !ok || monto >= minimo {
+		return true
+	}
+	slog.InfoContext(ctx, "monto por debajo del mínimo de Stripe", "amount", monto, "currency", moneda, "minimo", minimo)
+	responderMontoInsuficiente(w, moneda)
+	return false
+}
+
+// responderMontoInsuficiente responde 422 AMOUNT_TOO_SMALL con el mínimo de la
+// moneda si se conoce
+func responderMontoInsuficiente(w http.ResponseWriter, moneda string) {
+	respuesta := model.ErrorResponse{
+		Error: "El monto es menor al pago mínimo que acepta la pasarela",
+		Code:  "AMOUNT_TOO_SMALL",
+	}
+	if minimo, ok := payments.MinimoStripe(moneda); ok {
+		respuesta.Error = fmt.Sprintf("El pago mínimo es de %s", payments.FormatearMonto(minimo, moneda))
+		respuesta.Details = map[string]interface{}{"minimum": minimo, "currency": payments.NormalizarMoneda(moneda)}
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, respuesta)
+}
+
+// compraGratisPrevia devuelve el borrador de una compra gratis ya registrada
+// con el mismo ID, para responder igual a un reintento. Si el registro falló la
+// primera vez el borrador existe pero sin tickets, y se reintenta.
+func (s *Server) compraGratisPrevia(ctx context.Context, compraID string) (*model.PurchaseDraft, bool) {
+	compra, err := s.db.GetPurchaseDraftByID(ctx, compraID)
+	if err != nil {
+		if !errors.Is(err, model.ErrCompraNoEncontrada) {
+			slog.WarnContext(ctx, "error buscando compra previa", logging.ConError(err, "purchase_intent_id", compraID)...)
+		}
+		return nil, false
+	}
+	if !esIntentGratis(compra.PaymentIntentID) {
+		return nil, false
+	}
+	tickets, err := s.db.PaymentIntentTickets(ctx, compra.PaymentIntentID)
+	if err != nil {
+		slog.WarnContext(ctx, "error consultando tickets de la compra previa", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		return nil, false
+	}
+	if len(tickets) == 0 {
+		return nil, false
+	}
+	return compra, true
+}
+
+// completarCompraGratis hace lo que haría el webhook con un pago exitoso:
+// registra los tickets, confirma el canje del código y manda los correos. Las
+// reservas y el borrador ya tienen que estar guardados. Devuelve false si ya
+// respondió con un error.
+func (s *Server) completarCompraGratis(ctx context.Context, w http.ResponseWriter, compra *model.PurchaseDraft, moneda string) bool {
+	items, err := s.registrarTickets(ctx, compra, model.PagoTickets{
+		PaymentIntentID: compra.PaymentIntentID,
+		Currency:        moneda,
+		PaidAt:          time.Now(),
+	})
+	if err != nil {
+		ctx, cancel := contextoCompensacion(ctx)
+		defer cancel()
+		if err := s.db.ReleaseReservations(ctx, compra.PaymentIntentID); err != nil {
+			slog.WarnContext(ctx, "no se pudieron liberar las reservas", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		}
+		if err := s.db.ReleasePromoRedemption(ctx, compra.PaymentIntentID); err != nil {
+			slog.WarnContext(ctx, "no se pudo liberar el canje del código", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		}
+		// Las rifas del carrito que alcanzaron a registrarse se borran: no hubo
+		// cobro que conservar y así un reintento con la misma clave empieza de cero
+		if err := s.db.DeleteTickets(ctx, compra.PaymentIntentID); err != nil {
+			slog.WarnContext(ctx, "no se pudieron borrar los tickets parciales", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		}
+		var ocupados *model.ErrNumerosOcupados
+		if errors.As(err, &ocupados) {
+			slog.InfoContext(ctx, "números ocupados al registrar compra gratis", "payment_intent_id", compra.PaymentIntentID, "numeros", ocupados.Numeros)
+			responderNumerosOcupados(w, ocupados.Numeros)
+			return false
+		}
+		slog.ErrorContext(ctx, "error registrando compra gratis", logging.ConError(err, "rifa_id", compra.RifaID, "payment_intent_id", compra.PaymentIntentID)...)
+		http.Error(w, "Error registrando los números", 500)
+		return false
+	}
+
+	if compra.PromoCode != "" {
+		// Los tickets ya quedaron: si esto falla el canje pendiente vence solo y
+		// el conteo del código queda corto
+		if err := s.db.RedeemPromoCode(ctx, compra.PromoCode, compra.PaymentIntentID); err != nil {
+			slog.ErrorContext(ctx, "error confirmando el canje del código", logging.ConError(err, "code", compra.PromoCode, "payment_intent_id", compra.PaymentIntentID)...)
+		}
+	}
+
+	slog.InfoContext(ctx, "compra gratis registrada", "rifa_id", compra.RifaID, "payment_intent_id", compra.PaymentIntentID, "email", logging.EnmascararEmail(compra.Email))
+	// Los números ya son suyos: si el outbox falla el correo se reenvía desde
+	// POST /admin/emails/resend
+	s.enviarCorreosCompra(ctx, compra, items, 0, stripe.Currency(moneda))
+	return true
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"PaymentsGo/internal/model"
+)
+
+func TestVerificarMontoMinimo(t *testing.T) {
+	casos := []struct {
+		nombre string
+		monto  int64
+		moneda string
+		pasa   bool
+	}{
+		{nombre: "gratis", monto: 0, moneda: "usd", pasa: true},
+		{nombre: "usd debajo", monto: 49, moneda: "usd"},
+		{nombre: "usd en el mínimo", monto: 50, moneda: "usd", pasa: true},
+		{nombre: "usd arriba", monto: 51, moneda: "usd", pasa: true},
+		{nombre: "moneda vacía es usd", monto: 49, moneda: ""},
+		{nombre: "mxn debajo", monto: 999, moneda: "mxn"},
+		{nombre: "mxn en el mínimo", monto: 1000, moneda: "mxn", pasa: true},
+		{nombre: "mxn arriba", monto: 1001, moneda: "MXN", pasa: true},
+		{nombre: "jpy debajo", monto: 49, moneda: "jpy"},
+		{nombre: "jpy en el mínimo", monto: 50, moneda: "jpy", pasa: true},
+		{nombre: "jpy arriba", monto: 51, moneda: "jpy", pasa: true},
+		// sin mínimo conocido lo decide Stripe al crear el intent
+		{nombre: "moneda sin mínimo", monto: 1, moneda: "cop", pasa: true},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if pasa := verificarMontoMinimo(context.Background(), w, c.monto, c.moneda); pasa != c.pasa {
+				t.Fatalf("verificarMontoMinimo = %v, se esperaba %v", pasa, c.pasa)
+			}
+			if c.pasa {
+				if w.Body.Len() != 0 {
+					t.Errorf("respondió %d aunque el monto pasa", w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, se esperaba 422", w.Code)
+			}
+			var respuesta model.ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &respuesta); err != nil {
+				t.Fatal(err)
+			}
+			detalles, _ := respuesta.Details.(map[string]interface{})
+			if respuesta.Code != "AMOUNT_TOO_SMALL" || detalles["minimum"] == nil || detalles["currency"] == nil {
+				t.Errorf("respuesta = %+v", respuesta)
+			}
+		})
+	}
+}
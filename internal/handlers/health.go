@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EstadoReadiness es la respuesta de GET /readyz
+type EstadoReadiness struct {
+	Ready   bool              `json:"ready"`
+	Checks  map[string]string `json:"checks"`
+	Checked time.Time         `json:"checkedAt"`
+	Cached  bool              `json:"cached"`
+}
+
+const (
+	timeoutReadiness = 2 * time.Second
+	cacheReadiness   = 10 * time.Second
+)
+
+var (
+	readinessMu     sync.Mutex
+	ultimaReadiness *EstadoReadiness
+)
+
+// Healthz sólo indica que el proceso responde
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// Readyz comprueba Supabase y Stripe. El resultado se guarda ~10s para que el
+// intervalo del probe no genere carga sobre las dependencias.
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	estado := s.verificarDependencias(r.Context())
+
+	status := http.StatusOK
+	if !estado.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, estado)
+}
+
+func (s *Server) verificarDependencias(ctx context.Context) EstadoReadiness {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+
+	if ultimaReadiness != nil && time.Since(ultimaReadiness.Checked) < cacheReadiness {
+		copia := *ultimaReadiness
+		copia.Cached = true
+		return copia
+	}
+
+	estado := &EstadoReadiness{
+		Ready:   true,
+		Checks:  map[string]string{},
+		Checked: time.Now().UTC(),
+	}
+
+	if err := s.verificarSupabase(ctx); err != nil {
+		estado.Ready = false
+		estado.Checks["supabase"] = err.Error()
+	} else {
+		estado.Checks["supabase"] = "ok"
+	}
+
+	// El circuito no cambia Ready: abierto, el ping de arriba ya falla
+	estado.Checks["supabase_circuit"] = s.db.CircuitState()
+
+	if err := s.verificarStripe(ctx); err != nil {
+		estado.Ready = false
+		estado.Checks["stripe"] = err.Error()
+	} else {
+		estado.Checks["stripe"] = "ok"
+	}
+
+	ultimaReadiness = estado
+	return *estado
+}
+
+func (s *Server) verificarSupabase(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, timeoutReadiness)
+	defer cancel()
+	return s.db.Ping(ctx)
+}
+
+func (s *Server) verificarStripe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, timeoutReadiness)
+	defer cancel()
+	return s.pagos.Ping(ctx)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// NumeroComprado es un número de la respuesta de GET /payments/my-tickets
+type NumeroComprado struct {
+	Number      int    `json:"number"`
+	PurchasedAt string `json:"purchasedAt"`
+}
+
+// RifaComprada agrupa los números del usuario en una rifa
+type RifaComprada struct {
+	RifaID   string           `json:"rifaId"`
+	Title    string           `json:"title"`
+	DrawDate string           `json:"drawDate,omitempty"`
+	Numbers  []NumeroComprado `json:"numbers"`
+}
+
+// MyTickets devuelve los tickets del usuario de la sesión agrupados por rifa,
+// en el orden en que compró. Sin compras responde un arreglo vacío.
+func (s *Server) MyTickets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	usuario := usuarioDe(ctx)
+	if usuario == nil {
+		writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Error: "Inicia sesión para ver tus números", Code: "UNAUTHORIZED"})
+		return
+	}
+
+	tickets, err := s.db.UserTickets(ctx, usuario.Sub)
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando tickets del usuario", logging.ConError(err, "user_id", usuario.Sub)...)
+		http.Error(w, "Error consultando tus números", 500)
+		return
+	}
+
+	rifas := []*RifaComprada{}
+	porRifa := map[string]*RifaComprada{}
+	for _, t := range tickets {
+		grupo, ok := porRifa[t.RifaID]
+		if !ok {
+			grupo = &RifaComprada{RifaID: t.RifaID, Title: t.RifaTitle, DrawDate: t.DrawDate}
+			porRifa[t.RifaID] = grupo
+			rifas = append(rifas, grupo)
+		}
+		grupo.Numbers = append(grupo.Numbers, NumeroComprado{Number: t.Number, PurchasedAt: t.CreatedAt})
+	}
+
+	// Es información personal: que no la guarde ningún proxy
+	w.Header().Set("Cache-Control", "private, no-store")
+	writeJSON(w, http.StatusOK, rifas)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"PaymentsGo/internal/model"
+)
+
+// patronUUID es un UUID canónico en minúsculas, como los de Postgres y los
+// sub de Supabase Auth
+var patronUUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// patronesRifaID son los formatos de RIFA_ID_FORMAT
+var patronesRifaID = map[string]*regexp.Regexp{
+	"uuid": patronUUID,
+	"int":  regexp.MustCompile(`^[1-9][0-9]{0,18}$`),
+	"slug": regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`),
+}
+
+// normalizarRifaID quita los espacios (y pasa a minúsculas un UUID) y dice si
+// el ID tiene el formato de RIFA_ID_FORMAT
+func (s *Server) normalizarRifaID(id string) (string, bool) {
+	id = strings.TrimSpace(id)
+	patron, ok := patronesRifaID[s.cfg.RifaIDFormat]
+	if !ok {
+		patron = patronUUID
+	}
+	if patron == patronUUID {
+		id = strings.ToLower(id)
+	}
+	return id, patron.MatchString(id)
+}
+
+// normalizarUserID hace lo mismo con un userId, que siempre es el UUID del
+// usuario en Supabase Auth; vacío es una compra sin sesión
+func normalizarUserID(id string) (string, bool) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	return id, id == "" || patronUUID.MatchString(id)
+}
+
+// validarIDsCompra normaliza rifaId (o el de cada item del carrito) y userId
+// del cuerpo antes de que lleguen a una consulta, y responde 400 INVALID_ID
+// con el campo que no tiene el formato. Devuelve false si ya respondió.
+func (s *Server) validarIDsCompra(w http.ResponseWriter, req *model.PaymentRequest) bool {
+	var ok bool
+	if req.UserId, ok = normalizarUserID(req.UserId); !ok {
+		responderIDInvalido(w, "userId")
+		return false
+	}
+	// Un carrito ignora rifaId, pero si viene igual se valida: no todos los
+	// endpoints que reciben este cuerpo aceptan items
+	if len(req.Items) == 0 || req.RifaID != "" {
+		if req.RifaID, ok = s.normalizarRifaID(req.RifaID); !ok {
+			responderIDInvalido(w, "rifaId")
+			return false
+		}
+	}
+	for i := range req.Items {
+		if req.Items[i].RifaID, ok = s.normalizarRifaID(req.Items[i].RifaID); !ok {
+			responderIDInvalido(w, "items.rifaId")
+			return false
+		}
+	}
+	return true
+}
+
+func responderIDInvalido(w http.ResponseWriter, campo string) {
+	writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+		Error:   "id inválido",
+		Code:    "INVALID_ID",
+		Details: map[string]string{"campo": campo},
+	})
+}
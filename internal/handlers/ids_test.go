@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/model"
+)
+
+func TestValidarIDsCompra(t *testing.T) {
+	const rifa = "0b6e7c1a-3f2d-4c5e-9a8b-1d2e3f4a5b6c"
+	casos := []struct {
+		nombre  string
+		formato string
+		req     model.PaymentRequest
+		campo   string
+		rifaID  string
+	}{
+		{nombre: "uuid", req: model.PaymentRequest{RifaID: rifa, UserId: rifa}, rifaID: rifa},
+		{nombre: "uuid con espacios y mayúsculas", req: model.PaymentRequest{RifaID: " 0B6E7C1A-3F2D-4C5E-9A8B-1D2E3F4A5B6C "}, rifaID: rifa},
+		{nombre: "filtro inyectado", req: model.PaymentRequest{RifaID: rifa + "&status=eq.draft"}, campo: "rifaId"},
+		{nombre: "vacío", req: model.PaymentRequest{}, campo: "rifaId"},
+		{nombre: "userId inválido", req: model.PaymentRequest{RifaID: rifa, UserId: "a,b"}, campo: "userId"},
+		{nombre: "item del carrito", req: model.PaymentRequest{Items: []model.ItemCarrito{{RifaID: rifa}, {RifaID: "x)"}}}, campo: "items.rifaId"},
+		{nombre: "int", formato: "int", req: model.PaymentRequest{RifaID: "42"}, rifaID: "42"},
+		{nombre: "int con letras", formato: "int", req: model.PaymentRequest{RifaID: "42abc"}, campo: "rifaId"},
+		{nombre: "slug", formato: "slug", req: model.PaymentRequest{RifaID: "rifa-navidad_2026"}, rifaID: "rifa-navidad_2026"},
+		{nombre: "slug con punto", formato: "slug", req: model.PaymentRequest{RifaID: "a.b"}, campo: "rifaId"},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			s := &Server{cfg: &config.Config{RifaIDFormat: c.formato}}
+			w := httptest.NewRecorder()
+			ok := s.validarIDsCompra(w, &c.req)
+			if c.campo == "" {
+				if !ok {
+					t.Fatalf("rechazado: %s", w.Body)
+				}
+				if c.req.RifaID != c.rifaID {
+					t.Errorf("rifaId = %q, se esperaba %q", c.req.RifaID, c.rifaID)
+				}
+				return
+			}
+			if ok || w.Code != http.StatusBadRequest {
+				t.Fatalf("ok = %v, status = %d; se esperaba 400", ok, w.Code)
+			}
+			var resp struct {
+				Code    string            `json:"code"`
+				Details map[string]string `json:"details"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != "INVALID_ID" || resp.Details["campo"] != c.campo {
+				t.Errorf("respuesta = %+v, se esperaba INVALID_ID en %s", resp, c.campo)
+			}
+		})
+	}
+}
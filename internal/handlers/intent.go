@@ -0,0 +1,1063 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/store"
+	"PaymentsGo/internal/tracing"
+)
+
+// paramsIntent arma los parámetros comunes de un PaymentIntent de compra
+func (s *Server) paramsIntent(monto int64, moneda string, email string, titulo string, metadata map[string]string) *stripe.PaymentIntentParams {
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(monto),
+		Currency: stripe.String(moneda),
+		// Métodos automáticos: Stripe ofrece Apple Pay y Google Pay donde el
+		// dispositivo los tenga. Un pago con billetera es un cargo de tarjeta, así
+		// que el recibo y el descriptor de abajo le aplican igual.
+		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		},
+		Metadata: metadata,
+	}
+	if email != "" {
+		params.ReceiptEmail = stripe.String(email)
+	}
+	if sufijo := sufijoDescriptor(titulo, s.cfg.StatementDescriptorSuffix, s.cfg.StatementDescriptorPrefix); sufijo != "" {
+		params.StatementDescriptorSuffix = stripe.String(sufijo)
+	}
+	// Con PAYMENT_METHOD_TYPES (p. ej. "card,oxxo") o AUTOMATIC_PAYMENT_METHODS=off
+	// (que deja sólo "card") se fija la lista en lugar de dejar que Stripe elija;
+	// las dos opciones no se pueden combinar
+	if len(s.cfg.PaymentMethodTypes) > 0 {
+		params.AutomaticPaymentMethods = nil
+		params.PaymentMethodTypes = stripe.StringSlice(s.cfg.PaymentMethodTypes)
+	}
+	return params
+}
+
+// responderErrorCreacionIntent distingue un parámetro que Stripe no acepta
+// (configuración de la rifa) de una caída de Stripe. Un monto bajo el mínimo
+// en una moneda sin mínimo fijo (ver MinimoStripe) sólo lo detecta Stripe.
+func responderErrorCreacionIntent(w http.ResponseWriter, err error, moneda string) {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeAmountTooSmall {
+		responderMontoInsuficiente(w, moneda)
+		return
+	}
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest {
+		writeJSON(w, http.StatusBadGateway, model.ErrorResponse{
+			Error:   "Stripe rechazó los datos del pago",
+			Code:    "STRIPE_INVALID_REQUEST",
+			Details: map[string]string{"param": stripeErr.Param},
+		})
+		return
+	}
+	http.Error(w, "Error Stripe", 500)
+}
+
+// sinTildes pasa las letras con tilde a su versión sin tilde; el descriptor del
+// extracto sólo admite caracteres latinos básicos
+var sinTildes = strings.NewReplacer(
+	"á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ü", "u", "ñ", "n",
+	"Á", "A", "É", "E", "Í", "I", "Ó", "O", "Ú", "U", "Ü", "U", "Ñ", "N",
+)
+
+// sufijoDescriptor arma el statement_descriptor_suffix a partir de la
+// plantilla STATEMENT_DESCRIPTOR_SUFFIX ({title} se reemplaza por el título de
+// la rifa). Stripe limita prefijo + "* " + sufijo a 22 caracteres, prohíbe
+// < > \ ' " * y exige al menos una letra; si no queda ninguna se omite. prefijo
+// es STATEMENT_DESCRIPTOR_PREFIX, el configurado en la cuenta de Stripe.
+func sufijoDescriptor(titulo string, plantilla string, prefijo string) string {
+	texto := sinTildes.Replace(strings.ReplaceAll(plantilla, "{title}", titulo))
+
+	var b strings.Builder
+	for _, c := range strings.ToUpper(texto) {
+		if c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(" -.&#", c) {
+			b.WriteRune(c)
+		}
+	}
+
+	maximo := 22
+	if prefijo != "" {
+		maximo -= len(prefijo) + 2
+	}
+	sufijo := strings.Join(strings.Fields(b.String()), " ")
+	if len(sufijo) > maximo {
+		sufijo = strings.TrimSpace(sufijo[:max(maximo, 0)])
+	}
+	if !strings.ContainsFunc(sufijo, func(c rune) bool { return c >= 'A' && c <= 'Z' }) {
+		return ""
+	}
+	return sufijo
+}
+
+// margenConfirmacionOXXO cubre la demora entre que el cliente paga el voucher y
+// Stripe confirma el pago (hasta un día hábil después del vencimiento)
+const margenConfirmacionOXXO = 72 * time.Hour
+
+// vencimientoReservaAsincrona calcula hasta cuándo reservar los números de un
+// intent con pago asíncrono. Un voucher de OXXO dura hasta su vencimiento más
+// el margen de confirmación; un intent en processing, ASYNC_RESERVATION_HOURS
+// (72 por defecto). Otros requires_action (3D Secure) no extienden la reserva.
+func (s *Server) vencimientoReservaAsincrona(pi *stripe.PaymentIntent, ahora time.Time) (time.Time, bool) {
+	switch pi.Status {
+	case stripe.PaymentIntentStatusProcessing:
+		return ahora.Add(s.cfg.AsyncReservation), true
+	case stripe.PaymentIntentStatusRequiresAction:
+		if pi.NextAction != nil && pi.NextAction.OXXODisplayDetails != nil && pi.NextAction.OXXODisplayDetails.ExpiresAfter > 0 {
+			return time.Unix(pi.NextAction.OXXODisplayDetails.ExpiresAfter, 0).Add(margenConfirmacionOXXO), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 1. Crear el Intento de Pago (ACTUALIZADO PARA APPLE PAY)
+func (s *Server) CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var req model.PaymentRequest
+	if !decodificarJSON(w, r, &req) {
+		return
+	}
+	if !s.validarIDsCompra(w, &req) {
+		return
+	}
+	req.PromoCode = normalizarCodigo(req.PromoCode)
+
+	if len(req.Items) > 0 {
+		s.crearIntentCarrito(w, r, &req)
+		return
+	}
+
+	if !s.validarCantidad(w, &req) {
+		return
+	}
+	aleatorio := len(req.Numeros) == 0
+
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(tracing.RifaID.String(req.RifaID))
+	rifa, err := s.rifa(ctx, req.RifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, req.RifaID, err)
+		return
+	}
+
+	if !s.verificarRifaAbierta(ctx, w, rifa) {
+		return
+	}
+	if !verificarProveedor(ctx, w, rifa, model.ProveedorStripe) {
+		return
+	}
+
+	if !s.identificarComprador(w, r, &req, rifa) {
+		return
+	}
+
+	if !s.verificarCompradorNoBloqueado(ctx, w, &req) {
+		return
+	}
+	if !s.verificarEmailComprador(ctx, w, &req) {
+		return
+	}
+	resultadoCaptcha, ok := s.verificarCaptcha(w, r, &req)
+	if !ok {
+		return
+	}
+	if !s.validarRegalo(ctx, w, &req) {
+		return
+	}
+	if !s.validarReferido(ctx, w, &req) {
+		return
+	}
+
+	cotizacion, ok := s.cotizar(ctx, w, rifa, cantidadSolicitada(&req))
+	if !ok {
+		return
+	}
+	moneda, montoTotal := cotizacion.Currency, cotizacion.Amount
+
+	var descuento int64
+	if req.PromoCode != "" {
+		codigo, ok := s.cargarCodigoPromo(ctx, w, req.PromoCode, []string{rifa.ID})
+		if !ok {
+			return
+		}
+		descuento = descuentoCodigo(codigo, montoTotal)
+		montoTotal -= descuento
+		slog.InfoContext(ctx, "código promocional aplicado", "rifa_id", req.RifaID, "code", req.PromoCode, "discount", descuento, "amount", montoTotal)
+	}
+	if !verificarMontoMinimo(ctx, w, montoTotal, moneda) {
+		return
+	}
+	if !s.validarCuotas(ctx, w, &req, cotizacion, montoTotal) {
+		return
+	}
+
+	if !validarNumerosSeleccionados(ctx, w, rifa, req.Numeros) {
+		return
+	}
+
+	claveIdempotencia := claveIdempotenciaCompra(r.Header.Get("Idempotency-Key"), &req)
+	// El ID del borrador sale de la clave para que un reintento mande a Stripe
+	// exactamente los mismos parámetros
+	compraID := uuidDesdeClave(claveIdempotencia)
+
+	if montoTotal == 0 {
+		if compra, ok := s.compraGratisPrevia(ctx, compraID); ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{"free": true, "numeros": compra.Numeros, "reused": true})
+			return
+		}
+	}
+
+	if aleatorio {
+		// Con la misma Idempotency-Key el borrador ya existe y tiene los números
+		// que se sortearon la primera vez
+		if compra, secreto, ok := s.compraReutilizablePorID(ctx, compraID); ok {
+			json.NewEncoder(w).Encode(conPlanCuotas(map[string]interface{}{"clientSecret": secreto, "numeros": compra.Numeros, "expiresAt": compra.ExpiresAt, "reused": true}, compra))
+			return
+		}
+		numeros, err := s.elegirNumerosAleatorios(ctx, rifa, req.Cantidad, nil)
+		var insuficientes *ErrNumerosInsuficientes
+		if errors.As(err, &insuficientes) {
+			slog.InfoContext(ctx, "no hay suficientes números disponibles", "rifa_id", req.RifaID, "cantidad", req.Cantidad, "disponibles", insuficientes.Disponibles)
+			responderNumerosInsuficientes(w, insuficientes)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "error sorteando números", logging.ConError(err, "rifa_id", req.RifaID)...)
+			responderDisponibilidadNoVerificada(w, err)
+			return
+		}
+		req.Numeros = numeros
+	} else {
+		// Un reintento del frontend de una compra que ya tiene intent y reserva
+		// vigentes recibe el mismo clientSecret; sus propias reservas harían que
+		// CheckNumbers los reporte como ocupados.
+		if compra, secreto, ok := s.intentReutilizable(ctx, &req); ok {
+			json.NewEncoder(w).Encode(conPlanCuotas(map[string]interface{}{"clientSecret": secreto, "expiresAt": compra.ExpiresAt, "reused": true}, compra))
+			return
+		}
+
+		ocupados, err := s.db.CheckNumbers(ctx, req.RifaID, req.Numeros)
+		if err != nil {
+			slog.ErrorContext(ctx, "error validando números", logging.ConError(err, "rifa_id", req.RifaID)...)
+			responderDisponibilidadNoVerificada(w, err)
+			return
+		}
+		if len(ocupados) > 0 {
+			slog.InfoContext(ctx, "números ocupados", "rifa_id", req.RifaID, "numeros", ocupados)
+			responderNumerosOcupados(w, ocupados)
+			return
+		}
+	}
+
+	if !s.verificarLimitePorUsuario(ctx, w, rifa, &req) {
+		return
+	}
+
+	// Una compra gratis no pasa por Stripe, pero reserva y registra igual
+	pi := intentGratis(compraID, moneda)
+	if montoTotal > 0 {
+		metadata := map[string]string{
+			"rifa_id":            req.RifaID,
+			"purchase_intent_id": compraID,
+		}
+		// Con cuotas este intent cobra sólo la primera
+		montoIntent := montoTotal
+		if req.Installments > 1 {
+			montoIntent = montoCuota(montoTotal, req.Installments, 1)
+			metadata["installment"] = "1"
+			metadata["installments"] = strconv.Itoa(req.Installments)
+		}
+		params := s.paramsIntent(montoIntent, moneda, req.Email, rifa.Title, metadataCaptcha(s.metadataRiesgo(r, req.UserId, metadata), resultadoCaptcha))
+		s.cobrarParaOrganizador(params, rifa.OrganizerStripeAccount, montoIntent)
+		params.SetIdempotencyKey(claveIdempotencia)
+
+		if pi, err = s.pagos.CreateIntent(ctx, params); err != nil {
+			slog.ErrorContext(ctx, "error creando PaymentIntent", logging.ConError(err, "rifa_id", req.RifaID)...)
+			responderErrorCreacionIntent(w, err, moneda)
+			return
+		}
+	}
+
+	// Reservamos los números antes de entregar el clientSecret; si alguien se
+	// adelantó entre la validación y este punto, el intent se cancela. Si Stripe
+	// devolvió un intent que ya reservó estos números (reintento simultáneo),
+	// ReserveNumbers no lo cuenta como conflicto.
+	err = s.reservarNumeros(ctx, req.RifaID, req.Numeros, req.UserId, pi.ID)
+	var conflicto *model.ErrNumerosOcupados
+	// En modo aleatorio otra compra pudo llevarse alguno de los números sorteados
+	// entre la consulta y la reserva: se sortean otros sin tocar el intent, el
+	// monto sólo depende de la cantidad.
+	for intento := 1; aleatorio && errors.As(err, &conflicto) && intento < intentosAleatorios; intento++ {
+		slog.InfoContext(ctx, "colisión en números aleatorios", "rifa_id", req.RifaID, "payment_intent_id", pi.ID, "intento", intento)
+		numeros, errSorteo := s.elegirNumerosAleatorios(ctx, rifa, req.Cantidad, conflicto.Numeros)
+		if errSorteo != nil {
+			err = errSorteo
+			break
+		}
+		req.Numeros = numeros
+		err = s.reservarNumeros(ctx, req.RifaID, req.Numeros, req.UserId, pi.ID)
+	}
+	if err != nil {
+		s.cancelarIntent(ctx, pi.ID)
+		var insuficientes *ErrNumerosInsuficientes
+		if errors.As(err, &insuficientes) {
+			responderNumerosInsuficientes(w, insuficientes)
+			return
+		}
+		if errors.As(err, &conflicto) {
+			slog.InfoContext(ctx, "conflicto reservando números", "rifa_id", req.RifaID, "payment_intent_id", pi.ID, "numeros", conflicto.Numeros)
+			responderNumerosOcupados(w, conflicto.Numeros)
+			return
+		}
+		if errors.Is(err, model.ErrDisponibilidadNoVerificada) {
+			slog.ErrorContext(ctx, "error verificando conflicto de reserva", logging.ConError(err, "rifa_id", req.RifaID, "payment_intent_id", pi.ID)...)
+			responderDisponibilidadNoVerificada(w, err)
+			return
+		}
+		slog.ErrorContext(ctx, "error reservando números", logging.ConError(err, "rifa_id", req.RifaID, "payment_intent_id", pi.ID)...)
+		http.Error(w, "Error reservando números", 500)
+		return
+	}
+	if !s.reservarCanjeOCancelar(ctx, w, req.PromoCode, pi.ID) {
+		return
+	}
+
+	compra := &model.PurchaseDraft{
+		ID:              compraID,
+		PaymentIntentID: pi.ID,
+		RifaID:          req.RifaID,
+		RifaTitle:       rifa.Title,
+		Numeros:         req.Numeros,
+		UserID:          req.UserId,
+		Email:           req.Email,
+		Amount:          montoTotal,
+		ExpiresAt:       time.Now().UTC().Add(s.cfg.ReservationTTL).Format(time.RFC3339),
+		PromoCode:       req.PromoCode,
+		Discount:        descuento,
+		ReferralCode:    req.ReferralCode,
+		TierMinQty:      cotizacion.tramoMinimo(),
+		UnitPrice:       cotizacion.PricePerNumber,
+		RecipientEmail:  req.RecipientEmail,
+		RecipientName:   req.RecipientName,
+		Locale:          mail.ElegirIdioma(req.Locale),
+		Installments:    req.Installments,
+	}
+	if err := s.db.SavePurchaseDraft(ctx, compra); err != nil {
+		slog.ErrorContext(ctx, "error guardando la compra", logging.ConError(err, "rifa_id", req.RifaID, "payment_intent_id", pi.ID)...)
+		s.deshacerIntent(ctx, pi.ID)
+		http.Error(w, "Error guardando la compra", 500)
+		return
+	}
+	s.auditarIntentCreado(ctx, compra, model.ProveedorStripe, string(moneda))
+
+	if esIntentGratis(pi.ID) {
+		if !s.completarCompraGratis(ctx, w, compra, moneda) {
+			return
+		}
+		respuesta := map[string]interface{}{"free": true}
+		if aleatorio {
+			respuesta["numeros"] = req.Numeros
+		}
+		json.NewEncoder(w).Encode(respuesta)
+		return
+	}
+
+	span.SetAttributes(tracing.PaymentIntentID.String(pi.ID))
+	slog.InfoContext(ctx, "intent creado", "rifa_id", req.RifaID, "payment_intent_id", pi.ID, "email", logging.EnmascararEmail(req.Email), "amount", montoTotal, "currency", moneda, "api_version", versionAPI(ctx))
+	// Es la respuesta de la v1; una v2 que cambie su forma decide aquí con versionAPI
+	// expiresAt es cuándo vence la reserva; después el barrido cancela el
+	// intent si no se pagó
+	respuesta := map[string]interface{}{"clientSecret": pi.ClientSecret, "expiresAt": compra.ExpiresAt}
+	if aleatorio {
+		respuesta["numeros"] = req.Numeros
+	}
+	json.NewEncoder(w).Encode(conPlanCuotas(respuesta, compra))
+}
+
+// reservarCanjeOCancelar deja pendiente el canje del código (si hay) para el
+// intent; si no se puede, cancela el intent, libera las reservas y responde 500.
+// Devuelve false si ya respondió con un error.
+func (s *Server) reservarCanjeOCancelar(ctx context.Context, w http.ResponseWriter, codigo string, paymentIntentID string) bool {
+	if codigo == "" {
+		return true
+	}
+	err := s.reservarCanje(ctx, codigo, paymentIntentID)
+	if err == nil {
+		return true
+	}
+	slog.ErrorContext(ctx, "error reservando el canje del código", logging.ConError(err, "code", codigo, "payment_intent_id", paymentIntentID)...)
+	s.deshacerIntent(ctx, paymentIntentID)
+	http.Error(w, "Error aplicando el código", 500)
+	return false
+}
+
+// validarCantidad rechaza una selección vacía (sin números ni cantidad) o más
+// grande que MAX_NUMEROS_PER_PURCHASE. Devuelve false si ya respondió con un error.
+func (s *Server) validarCantidad(w http.ResponseWriter, req *model.PaymentRequest) bool {
+	cantidad := cantidadSolicitada(req)
+	if cantidad <= 0 {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error: "Debes seleccionar al menos un número",
+			Code:  "EMPTY_SELECTION",
+		})
+		return false
+	}
+	if max := s.cfg.MaxNumerosPerPurchase; cantidad > max {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error:   fmt.Sprintf("Máximo %d números por compra", max),
+			Code:    "TOO_MANY_NUMBERS",
+			Details: map[string]int{"max": max, "recibidos": cantidad},
+		})
+		return false
+	}
+	return true
+}
+
+// cantidadSolicitada es la cantidad de números de la compra: los elegidos o,
+// si no eligió ninguno, los que pidió al azar
+func cantidadSolicitada(req *model.PaymentRequest) int {
+	if len(req.Numeros) > 0 {
+		return len(req.Numeros)
+	}
+	return req.Cantidad
+}
+
+// validarNumerosSeleccionados responde 400 INVALID_NUMBERS si hay duplicados o
+// números fuera de rango. Devuelve false si ya respondió con un error.
+func validarNumerosSeleccionados(ctx context.Context, w http.ResponseWriter, rifa *model.Rifa, numeros []int) bool {
+	rechazados := validarSeleccion(rifa, numeros)
+	if len(rechazados) == 0 {
+		return true
+	}
+	slog.WarnContext(ctx, "números inválidos", "rifa_id", rifa.ID, "rechazados", len(rechazados))
+	writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+		Error:   "Algunos números no son válidos",
+		Code:    "INVALID_NUMBERS",
+		Details: map[string][]model.NumeroRechazado{"rechazados": rechazados},
+	})
+	return false
+}
+
+// Cotizacion es el precio de una selección, en la unidad menor de la moneda.
+// Tier es el tramo de price_tiers aplicado, si alguno mejora el precio fijo.
+type Cotizacion struct {
+	Amount         int64        `json:"amount"`
+	Currency       string       `json:"currency"`
+	PricePerNumber int64        `json:"pricePerNumber"`
+	Count          int          `json:"count"`
+	Tier           *TramoPrecio `json:"tier,omitempty"`
+}
+
+// tramoMinimo es el MinQty del tramo aplicado, 0 con el precio fijo
+func (c *Cotizacion) tramoMinimo() int {
+	if c.Tier == nil {
+		return 0
+	}
+	return c.Tier.MinQty
+}
+
+// errMonedaNoSoportada es la moneda de una rifa que Stripe no cobra
+var errMonedaNoSoportada = errors.New("moneda no soportada por Stripe")
+
+// cotizar calcula el monto de cantidad números de la rifa. Una moneda no
+// soportada por Stripe es un 422; un price_unit inválido o un desborde, un 500.
+// Devuelve false si ya respondió con un error.
+func (s *Server) cotizar(ctx context.Context, w http.ResponseWriter, rifa *model.Rifa, cantidad int) (*Cotizacion, bool) {
+	cotizacion, err := s.calcularCotizacion(ctx, rifa, cantidad)
+	if errors.Is(err, errMonedaNoSoportada) {
+		slog.ErrorContext(ctx, "moneda no soportada por Stripe", "rifa_id", rifa.ID, "currency", rifa.Currency)
+		writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Error: fmt.Sprintf("La rifa está configurada con una moneda no soportada (%s)", rifa.Currency),
+			Code:  "UNSUPPORTED_CURRENCY",
+		})
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error calculando el monto", logging.ConError(err, "rifa_id", rifa.ID, "price", rifa.Price, "cantidad", cantidad)...)
+		http.Error(w, "Error calculando el monto", 500)
+		return nil, false
+	}
+	return cotizacion, true
+}
+
+// calcularCotizacion es cotizar sin responder, para quien no tiene una
+// petición que rechazar (el webhook al verificar el monto cobrado)
+func (s *Server) calcularCotizacion(ctx context.Context, rifa *model.Rifa, cantidad int) (*Cotizacion, error) {
+	moneda := payments.NormalizarMoneda(rifa.Currency)
+	if !payments.MonedaSoportada(moneda) {
+		return nil, fmt.Errorf("%w: %s", errMonedaNoSoportada, rifa.Currency)
+	}
+	unidad, err := payments.UnidadPrecio(rifa, s.cfg.PriceUnit)
+	if err != nil {
+		return nil, fmt.Errorf("rifa mal configurada: %w", err)
+	}
+	tramo, precio := tramoAplicable(tramosPrecio(ctx, rifa), rifa.Price, cantidad)
+	unitario, err := payments.MontoStripe(precio, 1, moneda, unidad)
+	if err != nil {
+		return nil, err
+	}
+	total, err := payments.MontoStripe(precio, cantidad, moneda, unidad)
+	if err != nil {
+		return nil, err
+	}
+	cotizacion := &Cotizacion{Amount: total, Currency: moneda, PricePerNumber: unitario, Count: cantidad, Tier: tramo}
+	slog.InfoContext(ctx, "monto calculado", "rifa_id", rifa.ID, "amount", total, "currency", moneda, "price", precio, "price_unit", unidad, "cantidad", cantidad, "tier_min_qty", cotizacion.tramoMinimo())
+	return cotizacion, nil
+}
+
+// claveIdempotenciaCompra arma la clave que se manda a Stripe al crear el
+// intent. Si el frontend manda Idempotency-Key se usa esa; si no, se deriva de
+// la compra con una ventana de 5 minutos. En ambos casos se mezclan el comprador,
+// la rifa y los números ordenados, así una clave reusada con otra selección no
+// choca con los parámetros que Stripe ya tiene guardados.
+func claveIdempotenciaCompra(cabecera string, req *model.PaymentRequest) string {
+	numeros := append([]int(nil), req.Numeros...)
+	sort.Ints(numeros)
+	comprador := req.UserId
+	if comprador == "" {
+		comprador = strings.ToLower(req.Email)
+	}
+	seleccion := store.ListaNumeros(numeros)
+	if len(numeros) == 0 {
+		seleccion = "cantidad:" + strconv.Itoa(req.Cantidad)
+	}
+	base := fmt.Sprintf("%s|%s|%s", comprador, req.RifaID, seleccion)
+	if req.PromoCode != "" {
+		// El código cambia el monto: con y sin código son intents distintos
+		base += "|promo:" + req.PromoCode
+	}
+	if req.RecipientEmail != "" {
+		base += "|regalo:" + strings.ToLower(req.RecipientEmail)
+	}
+	if req.Installments > 1 {
+		// La primera cuota cobra otro monto que el pago único
+		base += "|cuotas:" + strconv.Itoa(req.Installments)
+	}
+	switch {
+	case cabecera != "":
+		base = "cabecera:" + cabecera + "|" + base
+	case len(numeros) == 0:
+		// Sin cabecera, dos compras al azar de la misma cantidad son compras
+		// distintas: no se deduplican
+		base = "aleatorio:" + logging.NuevoUUID() + "|" + base
+	default:
+		base = fmt.Sprintf("auto:%d|%s", time.Now().Unix()/300, base)
+	}
+	suma := sha256.Sum256([]byte(base))
+	return "create-intent-" + hex.EncodeToString(suma[:])
+}
+
+// uuidDesdeClave da un UUID v4 estable para la misma clave
+func uuidDesdeClave(clave string) string {
+	suma := sha256.Sum256([]byte(clave))
+	b := suma[:16]
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// intentReutilizable busca entre los borradores vigentes del comprador en la
+// rifa uno que sea la misma compra (los mismos números, código, regalo y
+// cuotas) y devuelve el clientSecret de su intent si todavía se puede pagar:
+// es el doble clic en "Pagar". Los que comparten números con la selección sin
+// ser la misma compra se descartan (descartarCompraSolapada), porque sus
+// reservas harían que CheckNumbers reporte los números como ocupados. Un
+// error al buscar no bloquea la compra: se crea un intent nuevo.
+func (s *Server) intentReutilizable(ctx context.Context, req *model.PaymentRequest) (*model.PurchaseDraft, string, bool) {
+	borradores, err := s.db.BuyerOpenPurchaseDrafts(ctx, req.RifaID, req.UserId, req.Email)
+	if err != nil {
+		slog.WarnContext(ctx, "error buscando compra previa", logging.ConError(err, "rifa_id", req.RifaID)...)
+		return nil, "", false
+	}
+	var solapadas []*model.PurchaseDraft
+	for i := range borradores {
+		compra := &borradores[i]
+		switch relacionCompra(compra, req) {
+		case compraIgual:
+			if secreto, ok := s.secretoSiPagable(ctx, compra); ok {
+				return compra, secreto, true
+			}
+		case compraSolapada:
+			solapadas = append(solapadas, compra)
+		}
+	}
+	for _, compra := range solapadas {
+		s.descartarCompraSolapada(ctx, compra)
+	}
+	return nil, "", false
+}
+
+// Cómo se relaciona un borrador con la selección de una compra nueva
+const (
+	compraAjena    = iota // no comparte números
+	compraIgual           // la misma compra, que se puede reutilizar
+	compraSolapada        // comparte números pero es otra compra
+)
+
+// relacionCompra compara el borrador con la selección en la rifa de req. Un
+// carrito nunca es la misma compra que una de una sola rifa.
+func relacionCompra(compra *model.PurchaseDraft, req *model.PaymentRequest) int {
+	guardados := compra.Numeros
+	if len(compra.Items) > 0 {
+		guardados = nil
+		for _, item := range compra.Items {
+			if item.RifaID == req.RifaID {
+				guardados = append(guardados, item.Numeros...)
+			}
+		}
+	}
+	pedidos := map[int]bool{}
+	for _, n := range req.Numeros {
+		pedidos[n] = true
+	}
+	comunes := 0
+	for _, n := range guardados {
+		if pedidos[n] {
+			comunes++
+		}
+	}
+	switch {
+	case comunes == 0:
+		return compraAjena
+	case len(compra.Items) == 0 && comunes == len(guardados) && comunes == len(pedidos) &&
+		compra.PromoCode == req.PromoCode && strings.EqualFold(compra.RecipientEmail, req.RecipientEmail) && compra.Installments == req.Installments:
+		return compraIgual
+	default:
+		return compraSolapada
+	}
+}
+
+// descartarCompraSolapada cancela el intent de un borrador que choca con la
+// selección nueva y libera sus reservas antes de que se verifique la
+// disponibilidad. Sólo si el intent sigue esperando el pago: uno en proceso
+// se deja, y la compra nueva recibe el 409 de los números ocupados. Si Stripe
+// no lo cancela las reservas también se quedan, porque la otra pestaña
+// todavía puede pagarlo.
+func (s *Server) descartarCompraSolapada(ctx context.Context, compra *model.PurchaseDraft) {
+	pi, ok := s.intentPagable(ctx, compra)
+	if !ok {
+		return
+	}
+	if _, err := s.pagos.CancelIntent(ctx, pi.ID, nil); err != nil {
+		slog.WarnContext(ctx, "no se pudo cancelar el intent previo", logging.ConError(err, "payment_intent_id", pi.ID)...)
+		return
+	}
+	if err := s.db.ReleaseReservations(ctx, pi.ID); err != nil {
+		slog.WarnContext(ctx, "no se pudieron liberar las reservas", logging.ConError(err, "payment_intent_id", pi.ID)...)
+		return
+	}
+	slog.InfoContext(ctx, "intent previo descartado por una selección que comparte números", "rifa_id", compra.RifaID, "payment_intent_id", pi.ID)
+}
+
+// compraReutilizablePorID es la variante para compras al azar: el borrador se
+// busca por el ID que sale de la Idempotency-Key.
+func (s *Server) compraReutilizablePorID(ctx context.Context, compraID string) (*model.PurchaseDraft, string, bool) {
+	compra, err := s.db.GetPurchaseDraftByID(ctx, compraID)
+	if err != nil {
+		if !errors.Is(err, model.ErrCompraNoEncontrada) {
+			slog.WarnContext(ctx, "error buscando compra previa", logging.ConError(err, "purchase_intent_id", compraID)...)
+		}
+		return nil, "", false
+	}
+	secreto, ok := s.secretoSiPagable(ctx, compra)
+	return compra, secreto, ok
+}
+
+// secretoSiPagable devuelve el clientSecret del intent del borrador si todavía
+// está esperando el pago
+func (s *Server) secretoSiPagable(ctx context.Context, compra *model.PurchaseDraft) (string, bool) {
+	pi, ok := s.intentPagable(ctx, compra)
+	if !ok {
+		return "", false
+	}
+	slog.InfoContext(ctx, "intent reutilizado", "rifa_id", compra.RifaID, "payment_intent_id", pi.ID)
+	return pi.ClientSecret, true
+}
+
+// intentPagable lee de Stripe el intent del borrador y lo devuelve si todavía
+// espera el pago; los cancelados, pagados o en proceso no se pueden retomar
+func (s *Server) intentPagable(ctx context.Context, compra *model.PurchaseDraft) (*stripe.PaymentIntent, bool) {
+	if esIntentGratis(compra.PaymentIntentID) || esPagoPayPal(compra.PaymentIntentID) || esPagoMercadoPago(compra.PaymentIntentID) {
+		return nil, false
+	}
+	pi, err := s.pagos.GetIntent(ctx, compra.PaymentIntentID, nil)
+	if err != nil {
+		slog.WarnContext(ctx, "error consultando intent previo", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		return nil, false
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod,
+		stripe.PaymentIntentStatusRequiresConfirmation,
+		stripe.PaymentIntentStatusRequiresAction:
+		return pi, true
+	}
+	return nil, false
+}
+
+// identificarComprador toma userId y email del JWT para que no se puedan
+// suplantar. Sin sesión, sólo se acepta la compra como invitado si
+// ALLOW_ANONYMOUS está activo y la rifa lo permite; en ese caso se usa el email
+// del cuerpo. Devuelve false si ya respondió con un error.
+func (s *Server) identificarComprador(w http.ResponseWriter, r *http.Request, req *model.PaymentRequest, rifa *model.Rifa) bool {
+	usuario := usuarioDe(r.Context())
+	if usuario == nil {
+		if !s.cfg.AllowAnonymous || !rifa.AllowAnonymous {
+			writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Error: "Debes iniciar sesión para comprar", Code: "UNAUTHORIZED"})
+			return false
+		}
+		if req.Email == "" {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El email es obligatorio", Code: "EMAIL_REQUIRED"})
+			return false
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if !emailValido(req.Email) {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El email no es válido", Code: "INVALID_EMAIL"})
+			return false
+		}
+		req.UserId = ""
+		return true
+	}
+
+	if (req.UserId != "" && req.UserId != usuario.Sub) ||
+		(req.Email != "" && usuario.Email != "" && !strings.EqualFold(req.Email, usuario.Email)) {
+		slog.WarnContext(r.Context(), "userId/email no coinciden con la sesión", "user_id", usuario.Sub, "rifa_id", rifa.ID)
+		writeJSON(w, http.StatusForbidden, model.ErrorResponse{Error: "Los datos no coinciden con tu sesión", Code: "FORBIDDEN"})
+		return false
+	}
+	req.UserId = usuario.Sub
+	if usuario.Email != "" {
+		req.Email = usuario.Email
+	}
+	return true
+}
+
+// validarSeleccion revisa duplicados y que cada número esté dentro del rango de la rifa
+func validarSeleccion(rifa *model.Rifa, numeros []int) []model.NumeroRechazado {
+	var rechazados []model.NumeroRechazado
+	vistos := map[int]bool{}
+	for _, n := range numeros {
+		switch {
+		case vistos[n]:
+			rechazados = append(rechazados, model.NumeroRechazado{Numero: n, Motivo: "duplicado"})
+		case n < 1 || (rifa.TotalNumbers > 0 && n > rifa.TotalNumbers):
+			rechazados = append(rechazados, model.NumeroRechazado{
+				Numero: n,
+				Motivo: fmt.Sprintf("fuera de rango (1-%d)", rifa.TotalNumbers),
+			})
+		}
+		vistos[n] = true
+	}
+	return rechazados
+}
+
+// rifaAbierta indica si la rifa acepta compras: status "active" (o vacío en las
+// rifas viejas) y la fecha del sorteo todavía no pasó.
+func rifaAbierta(rifa *model.Rifa, ahora time.Time) bool {
+	if rifa.Status != "" && !strings.EqualFold(rifa.Status, "active") {
+		return false
+	}
+	if sorteo, ok := fechaSorteo(rifa.DrawDate); ok && !ahora.Before(sorteo) {
+		return false
+	}
+	return true
+}
+
+// fechaSorteo interpreta draw_date, que según la columna llega como timestamptz
+// o como fecha sola (en ese caso el sorteo es al final del día, en UTC)
+func fechaSorteo(valor string) (time.Time, bool) {
+	if valor == "" {
+		return time.Time{}, false
+	}
+	for _, formato := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999"} {
+		if t, err := time.Parse(formato, valor); err == nil {
+			return t, true
+		}
+	}
+	if t, err := time.Parse(time.DateOnly, valor); err == nil {
+		return t.Add(24 * time.Hour), true
+	}
+	return time.Time{}, false
+}
+
+// verificarRifaAbierta responde 410 RIFA_CLOSED si la rifa está pausada o ya se
+// sorteó, y 410 RIFA_SOLD_OUT si ya se vendieron todos los números. El webhook
+// no la usa: un intent creado antes del cambio de estado se registra igual.
+// Devuelve false si ya respondió con un error.
+func (s *Server) verificarRifaAbierta(ctx context.Context, w http.ResponseWriter, rifa *model.Rifa) bool {
+	// La rifa puede venir del cache: antes de rechazar se vuelve a leer por si
+	// se reabrió o se agregaron números
+	if !rifaAbierta(rifa, time.Now()) && (!s.refrescarRifa(ctx, rifa) || !rifaAbierta(rifa, time.Now())) {
+		slog.InfoContext(ctx, "rifa cerrada", "rifa_id", rifa.ID, "status", rifa.Status, "draw_date", rifa.DrawDate)
+		writeJSON(w, http.StatusGone, model.ErrorResponse{
+			Error: "Esta rifa ya no está a la venta",
+			Code:  "RIFA_CLOSED",
+		})
+		return false
+	}
+
+	vendidos, err := s.db.SoldNumbers(ctx, rifa.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando números vendidos", logging.ConError(err, "rifa_id", rifa.ID)...)
+		responderDisponibilidadNoVerificada(w, err)
+		return false
+	}
+	if len(vendidos) >= rifa.TotalNumbers && (!s.refrescarRifa(ctx, rifa) || len(vendidos) >= rifa.TotalNumbers) {
+		slog.InfoContext(ctx, "rifa agotada", "rifa_id", rifa.ID, "vendidos", len(vendidos), "total", rifa.TotalNumbers)
+		writeJSON(w, http.StatusGone, model.ErrorResponse{
+			Error: "Ya se vendieron todos los números de esta rifa",
+			Code:  "RIFA_SOLD_OUT",
+		})
+		return false
+	}
+	return true
+}
+
+// ErrLimitePorUsuario indica que la compra supera el max_per_user de la rifa
+var ErrLimitePorUsuario = errors.New("límite de números por usuario excedido")
+
+// numerosRestantesUsuario es cuántos números más puede comprar el usuario en la
+// rifa según max_per_user, contando sus tickets y reservas vigentes salvo las del
+// intent excluirPI. Devuelve -1 si la rifa no tiene límite. Los invitados no se
+// pueden identificar entre compras, así que a ellos sólo se les limita cada compra.
+func (s *Server) numerosRestantesUsuario(ctx context.Context, rifa *model.Rifa, userID string, excluirPI string) (int, error) {
+	if rifa.MaxPerUser <= 0 {
+		return -1, nil
+	}
+	if userID == "" {
+		return rifa.MaxPerUser, nil
+	}
+	tiene, err := s.db.CountUserNumbers(ctx, rifa.ID, userID, excluirPI)
+	if err != nil {
+		return 0, err
+	}
+	return max(rifa.MaxPerUser-tiene, 0), nil
+}
+
+// verificarLimitePorUsuario responde 409 LIMIT_EXCEEDED si la compra deja al
+// usuario por encima de max_per_user. Dos intents simultáneos pueden pasar los
+// dos; el webhook vuelve a verificar antes de registrar los tickets.
+// Devuelve false si ya respondió con un error.
+func (s *Server) verificarLimitePorUsuario(ctx context.Context, w http.ResponseWriter, rifa *model.Rifa, req *model.PaymentRequest) bool {
+	restantes, err := s.numerosRestantesUsuario(ctx, rifa, req.UserId, "")
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando números del usuario", logging.ConError(err, "rifa_id", rifa.ID, "user_id", req.UserId)...)
+		responderDisponibilidadNoVerificada(w, err)
+		return false
+	}
+	if restantes < 0 || len(req.Numeros) <= restantes {
+		return true
+	}
+	// Con max_per_user viejo en el cache el 409 sería falso: se recalcula con la rifa fresca
+	maximo := rifa.MaxPerUser
+	if s.refrescarRifa(ctx, rifa) && rifa.MaxPerUser != maximo {
+		return s.verificarLimitePorUsuario(ctx, w, rifa, req)
+	}
+	slog.InfoContext(ctx, "límite por usuario excedido", "rifa_id", rifa.ID, "user_id", req.UserId, "max_per_user", rifa.MaxPerUser, "restantes", restantes, "solicitados", len(req.Numeros))
+	writeJSON(w, http.StatusConflict, model.ErrorResponse{
+		Error:   fmt.Sprintf("Sólo puedes comprar %d números más en esta rifa", restantes),
+		Code:    "LIMIT_EXCEEDED",
+		Details: map[string]int{"max": rifa.MaxPerUser, "restantes": restantes},
+	})
+	return false
+}
+
+func responderErrorRifa(ctx context.Context, w http.ResponseWriter, rifaID string, err error) {
+	if errors.Is(err, model.ErrRifaNoEncontrada) {
+		slog.InfoContext(ctx, "rifa no encontrada", "rifa_id", rifaID)
+		http.Error(w, "Rifa no encontrada", 404)
+		return
+	}
+	slog.ErrorContext(ctx, "error consultando rifa", logging.ConError(err, "rifa_id", rifaID)...)
+	if responderCircuitoAbierto(w, err) {
+		return
+	}
+	http.Error(w, "Error consultando la rifa", 500)
+}
+
+// responderCircuitoAbierto responde 503 SERVICE_UNAVAILABLE, con Retry-After
+// hasta que el circuito vuelva a probar, si err es *store.ErrCircuitoAbierto.
+// Devuelve false si es otro error y no respondió.
+func responderCircuitoAbierto(w http.ResponseWriter, err error) bool {
+	var abierto *store.ErrCircuitoAbierto
+	if !errors.As(err, &abierto) {
+		return false
+	}
+	segundos := int(math.Ceil(abierto.ReintentarEn.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(segundos, 1)))
+	writeJSON(w, http.StatusServiceUnavailable, model.ErrorResponse{
+		Error: "El servicio no está disponible en este momento, intenta en unos segundos",
+		Code:  "SERVICE_UNAVAILABLE",
+	})
+	return true
+}
+
+func responderNumerosOcupados(w http.ResponseWriter, numeros []int) {
+	writeJSON(w, http.StatusConflict, model.ErrorResponse{
+		Error:   "Algunos números ya no están disponibles",
+		Code:    "NUMBERS_TAKEN",
+		Details: map[string][]int{"numeros": numeros},
+	})
+}
+
+// responderDisponibilidadNoVerificada responde 503: el cliente puede reintentar,
+// a diferencia del 409 de números ocupados. err es el error de Supabase, que
+// con el circuito abierto cambia el código.
+func responderDisponibilidadNoVerificada(w http.ResponseWriter, err error) {
+	if responderCircuitoAbierto(w, err) {
+		return
+	}
+	w.Header().Set("Retry-After", "5")
+	writeJSON(w, http.StatusServiceUnavailable, model.ErrorResponse{
+		Error: "No pudimos verificar la disponibilidad, intenta de nuevo",
+		Code:  "AVAILABILITY_UNVERIFIED",
+	})
+}
+
+func (s *Server) cancelarIntent(ctx context.Context, id string) {
+	if esIntentGratis(id) || esPagoPayPal(id) || esPagoMercadoPago(id) {
+		// Una orden de PayPal o una preferencia de MercadoPago sin pagar vence sola
+		return
+	}
+	ctx, cancel := contextoCompensacion(ctx)
+	defer cancel()
+	if _, err := s.pagos.CancelIntent(ctx, id, nil); err != nil {
+		// Sin clientSecret nadie puede pagarlo; si igual se cobra, lo encuentra
+		// la conciliación
+		slog.ErrorContext(ctx, "no se pudo cancelar el intent", logging.ConError(err, "payment_intent_id", id)...)
+	}
+}
+
+// plazoCompensacion es lo que tiene deshacer una compra a medias
+const plazoCompensacion = 5 * time.Second
+
+// contextoCompensacion es el contexto para deshacer lo que alcanzó a hacer una
+// petición que falló: sigue aunque la petición haya vencido (WithDeadline) o
+// el cliente se haya ido, con un plazo propio
+func contextoCompensacion(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), plazoCompensacion)
+}
+
+// deshacerIntent cancela el intent y libera sus reservas, cuando la compra
+// falló después de reservar
+func (s *Server) deshacerIntent(ctx context.Context, id string) {
+	s.cancelarIntent(ctx, id)
+	ctx, cancel := contextoCompensacion(ctx)
+	defer cancel()
+	if err := s.db.ReleaseReservations(ctx, id); err != nil {
+		slog.WarnContext(ctx, "no se pudieron liberar las reservas", logging.ConError(err, "payment_intent_id", id)...)
+	}
+}
+
+// CancelRequest es el cuerpo de POST /payments/cancel-intent. Una compra con
+// sesión se cancela con la sesión del mismo usuario; la de un invitado, con el
+// clientSecret que recibió al crearla.
+type CancelRequest struct {
+	PaymentIntentID string `json:"paymentIntentId"`
+	ClientSecret    string `json:"clientSecret"`
+}
+
+// Cancelar un intento de pago abandonado para que el usuario pueda elegir otros números
+func (s *Server) CancelPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var req CancelRequest
+	if !decodificarJSON(w, r, &req) {
+		return
+	}
+	if req.PaymentIntentID == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta paymentIntentId", Code: "PAYMENT_INTENT_REQUIRED"})
+		return
+	}
+
+	ctx := r.Context()
+	pi, err := s.pagos.GetIntent(ctx, req.PaymentIntentID, nil)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+			http.Error(w, "Intento de pago no encontrado", 404)
+			return
+		}
+		slog.ErrorContext(ctx, "error consultando PaymentIntent", logging.ConError(err, "payment_intent_id", req.PaymentIntentID)...)
+		http.Error(w, "Error Stripe", 500)
+		return
+	}
+
+	compra, err := s.cargarCompra(ctx, pi)
+	if err != nil {
+		slog.ErrorContext(ctx, "error cargando la compra", logging.ConError(err, "payment_intent_id", pi.ID)...)
+		http.Error(w, "Intento de pago no encontrado", 404)
+		return
+	}
+	if !verificarDuenoCompra(w, r, &req, compra, pi) {
+		return
+	}
+
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{Error: "El pago ya se completó", Code: "PAYMENT_SUCCEEDED"})
+		return
+	case stripe.PaymentIntentStatusCanceled:
+		// Ya estaba cancelado; sólo nos aseguramos de liberar los números
+	default:
+		if _, err := s.pagos.CancelIntent(ctx, pi.ID, nil); err != nil {
+			slog.ErrorContext(ctx, "error cancelando el intent", logging.ConError(err, "payment_intent_id", pi.ID)...)
+			http.Error(w, "Error Stripe", 500)
+			return
+		}
+	}
+
+	if err := s.db.ReleaseReservations(ctx, pi.ID); err != nil {
+		slog.ErrorContext(ctx, "error liberando reservas", logging.ConError(err, "payment_intent_id", pi.ID)...)
+		http.Error(w, "Error liberando números", 500)
+		return
+	}
+
+	slog.InfoContext(ctx, "intent cancelado por el usuario", "rifa_id", compra.RifaID, "payment_intent_id", pi.ID)
+	writeJSON(w, http.StatusOK, map[string]bool{"canceled": true})
+}
+
+// verificarDuenoCompra responde 401 si la compra es de un usuario y no hay
+// sesión, y 403 si la sesión es de otro usuario o, en una compra de invitado,
+// si el clientSecret no es el del intent. Devuelve false si ya respondió.
+func verificarDuenoCompra(w http.ResponseWriter, r *http.Request, req *CancelRequest, compra *model.PurchaseDraft, pi *stripe.PaymentIntent) bool {
+	ctx := r.Context()
+	if compra.UserID != "" {
+		usuario := usuarioDe(ctx)
+		if usuario == nil {
+			writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Error: "Debes iniciar sesión para cancelar esta compra", Code: "UNAUTHORIZED"})
+			return false
+		}
+		if usuario.Sub != compra.UserID {
+			slog.WarnContext(ctx, "intento de cancelar el intent de otro usuario", "user_id", usuario.Sub, "payment_intent_id", pi.ID)
+			writeJSON(w, http.StatusForbidden, model.ErrorResponse{Error: "El intento de pago no te pertenece", Code: "FORBIDDEN"})
+			return false
+		}
+		return true
+	}
+	if req.ClientSecret == "" || subtle.ConstantTimeCompare([]byte(req.ClientSecret), []byte(pi.ClientSecret)) != 1 {
+		slog.WarnContext(ctx, "cancelación de una compra de invitado sin el clientSecret", "payment_intent_id", pi.ID)
+		writeJSON(w, http.StatusForbidden, model.ErrorResponse{Error: "El intento de pago no te pertenece", Code: "FORBIDDEN"})
+		return false
+	}
+	return true
+}
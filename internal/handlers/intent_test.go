@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/model"
+)
+
+// storeBorradores es un Store con los borradores vigentes del comprador; anota
+// qué reservas se liberan
+type storeBorradores struct {
+	Store
+	borradores []model.PurchaseDraft
+	liberadas  []string
+}
+
+func (f *storeBorradores) BuyerOpenPurchaseDrafts(_ context.Context, _, _, _ string) ([]model.PurchaseDraft, error) {
+	return f.borradores, nil
+}
+
+func (f *storeBorradores) ReleaseReservations(_ context.Context, paymentIntentID string) error {
+	f.liberadas = append(f.liberadas, paymentIntentID)
+	return nil
+}
+
+// pagosPrueba devuelve todos los intents esperando el pago y anota los cancelados
+type pagosPrueba struct {
+	PaymentProvider
+	cancelados []string
+}
+
+func (p *pagosPrueba) GetIntent(_ context.Context, id string, _ *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return &stripe.PaymentIntent{ID: id, ClientSecret: id + "_secret", Status: stripe.PaymentIntentStatusRequiresPaymentMethod}, nil
+}
+
+func (p *pagosPrueba) CancelIntent(_ context.Context, id string, _ *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	p.cancelados = append(p.cancelados, id)
+	return &stripe.PaymentIntent{ID: id, Status: stripe.PaymentIntentStatusCanceled}, nil
+}
+
+func TestIntentReutilizable(t *testing.T) {
+	previo := model.PurchaseDraft{RifaID: "r1", PaymentIntentID: "pi_previo", Numeros: []int{3, 1, 2}}
+	casos := []struct {
+		nombre     string
+		numeros    []int
+		promo      string
+		reutiliza  bool
+		cancelados []string
+	}{
+		{nombre: "misma selección en otro orden", numeros: []int{1, 2, 3}, reutiliza: true},
+		{nombre: "superconjunto", numeros: []int{1, 2, 3, 4}, cancelados: []string{"pi_previo"}},
+		{nombre: "subconjunto", numeros: []int{2, 3}, cancelados: []string{"pi_previo"}},
+		{nombre: "mismos números con otro código", numeros: []int{1, 2, 3}, promo: "VERANO", cancelados: []string{"pi_previo"}},
+		{nombre: "disjuntos", numeros: []int{7, 8}},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			db := &storeBorradores{borradores: []model.PurchaseDraft{previo}}
+			pagos := &pagosPrueba{}
+			s := &Server{cfg: &config.Config{}, db: db, pagos: pagos}
+			req := &model.PaymentRequest{RifaID: "r1", UserId: "u1", Numeros: c.numeros, PromoCode: c.promo}
+
+			compra, secreto, ok := s.intentReutilizable(context.Background(), req)
+			if ok != c.reutiliza {
+				t.Fatalf("reutilizado = %v, se esperaba %v", ok, c.reutiliza)
+			}
+			if ok && (compra.PaymentIntentID != "pi_previo" || secreto != "pi_previo_secret") {
+				t.Errorf("reutilizó %q con %q", compra.PaymentIntentID, secreto)
+			}
+			if !slices.Equal(pagos.cancelados, c.cancelados) {
+				t.Errorf("cancelados = %v, se esperaba %v", pagos.cancelados, c.cancelados)
+			}
+			if !slices.Equal(db.liberadas, c.cancelados) {
+				t.Errorf("reservas liberadas = %v, se esperaba %v", db.liberadas, c.cancelados)
+			}
+		})
+	}
+}
+
+// storeCancelacion es un Store con el borrador de un intent; anota qué
+// reservas se liberan
+type storeCancelacion struct {
+	Store
+	compra    model.PurchaseDraft
+	liberadas []string
+}
+
+func (f *storeCancelacion) GetPurchaseDraft(_ context.Context, _ string) (*model.PurchaseDraft, error) {
+	compra := f.compra
+	return &compra, nil
+}
+
+func (f *storeCancelacion) ReleaseReservations(_ context.Context, paymentIntentID string) error {
+	f.liberadas = append(f.liberadas, paymentIntentID)
+	return nil
+}
+
+// pagosCancelacion es pagosPrueba con intents que apuntan a su borrador
+type pagosCancelacion struct {
+	pagosPrueba
+}
+
+func (p *pagosCancelacion) GetIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	pi, err := p.pagosPrueba.GetIntent(ctx, id, params)
+	pi.Metadata = map[string]string{"purchase_intent_id": "b1"}
+	return pi, err
+}
+
+func TestCancelPaymentIntent(t *testing.T) {
+	casos := []struct {
+		nombre  string
+		dueno   string
+		sesion  string
+		cuerpo  string
+		status  int
+		cancela bool
+	}{
+		{nombre: "con la sesión del dueño", dueno: usuarioPrueba, sesion: usuarioPrueba, cuerpo: `{"paymentIntentId":"pi_1"}`, status: http.StatusOK, cancela: true},
+		{nombre: "compra de usuario sin sesión", dueno: usuarioPrueba, cuerpo: `{"paymentIntentId":"pi_1"}`, status: http.StatusUnauthorized},
+		{nombre: "compra de usuario con el clientSecret sin sesión", dueno: usuarioPrueba, cuerpo: `{"paymentIntentId":"pi_1","clientSecret":"pi_1_secret"}`, status: http.StatusUnauthorized},
+		{nombre: "sesión de otro usuario", dueno: usuarioPrueba, sesion: "6e2f3a4b-5c6d-4e7f-8a9b-0c1d2e3f4a5b", cuerpo: `{"paymentIntentId":"pi_1"}`, status: http.StatusForbidden},
+		{nombre: "invitado con el clientSecret", cuerpo: `{"paymentIntentId":"pi_1","clientSecret":"pi_1_secret"}`, status: http.StatusOK, cancela: true},
+		{nombre: "invitado sin clientSecret", cuerpo: `{"paymentIntentId":"pi_1"}`, status: http.StatusForbidden},
+		{nombre: "invitado con otro clientSecret", cuerpo: `{"paymentIntentId":"pi_1","clientSecret":"pi_2_secret"}`, status: http.StatusForbidden},
+		{nombre: "invitado con una sesión cualquiera", sesion: usuarioPrueba, cuerpo: `{"paymentIntentId":"pi_1"}`, status: http.StatusForbidden},
+		{nombre: "sin paymentIntentId", cuerpo: `{}`, status: http.StatusBadRequest},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			db := &storeCancelacion{compra: model.PurchaseDraft{ID: "b1", PaymentIntentID: "pi_1", RifaID: "r1", UserID: c.dueno}}
+			pagos := &pagosCancelacion{}
+			s := &Server{cfg: &config.Config{}, db: db, pagos: pagos}
+			r := httptest.NewRequest(http.MethodPost, "/payments/cancel-intent", strings.NewReader(c.cuerpo))
+			if c.sesion != "" {
+				r = r.WithContext(context.WithValue(r.Context(), claveUsuario{}, &UsuarioAutenticado{Sub: c.sesion}))
+			}
+			w := httptest.NewRecorder()
+			s.CancelPaymentIntent(w, r)
+
+			if w.Code != c.status {
+				t.Fatalf("status = %d, se esperaba %d (%s)", w.Code, c.status, w.Body.String())
+			}
+			var cancelados []string
+			if c.cancela {
+				cancelados = []string{"pi_1"}
+			}
+			if !slices.Equal(pagos.cancelados, cancelados) || !slices.Equal(db.liberadas, cancelados) {
+				t.Errorf("cancelados = %v, liberadas = %v; se esperaba %v", pagos.cancelados, db.liberadas, cancelados)
+			}
+		})
+	}
+}
+
+func TestIdentificarCompradorInvitado(t *testing.T) {
+	casos := []struct {
+		nombre      string
+		anonimo     bool
+		rifaAnonimo bool
+		email       string
+		status      int
+		code        string
+	}{
+		{nombre: "invitado", anonimo: true, rifaAnonimo: true, email: " ana@example.com ", status: http.StatusOK},
+		{nombre: "ALLOW_ANONYMOUS apagado", rifaAnonimo: true, email: "ana@example.com", status: http.StatusUnauthorized, code: "UNAUTHORIZED"},
+		{nombre: "la rifa no acepta invitados", anonimo: true, email: "ana@example.com", status: http.StatusUnauthorized, code: "UNAUTHORIZED"},
+		{nombre: "sin email", anonimo: true, rifaAnonimo: true, status: http.StatusBadRequest, code: "EMAIL_REQUIRED"},
+		{nombre: "email inválido", anonimo: true, rifaAnonimo: true, email: "ana@", status: http.StatusBadRequest, code: "INVALID_EMAIL"},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			s := &Server{cfg: &config.Config{AllowAnonymous: c.anonimo}}
+			rifa := &model.Rifa{ID: rifaPrueba, AllowAnonymous: c.rifaAnonimo}
+			// Un UserId en el cuerpo no le da dueño a la compra sin sesión
+			req := &model.PaymentRequest{UserId: usuarioPrueba, Email: c.email}
+			w := httptest.NewRecorder()
+			ok := s.identificarComprador(w, httptest.NewRequest(http.MethodPost, "/payments/create-intent", nil), req, rifa)
+
+			if ok != (c.status == http.StatusOK) || w.Code != c.status {
+				t.Fatalf("ok = %v, status = %d, se esperaba %d (%s)", ok, w.Code, c.status, w.Body.String())
+			}
+			if !ok {
+				if !strings.Contains(w.Body.String(), `"code":"`+c.code+`"`) {
+					t.Errorf("respuesta = %s, se esperaba code %s", w.Body.String(), c.code)
+				}
+				return
+			}
+			if req.UserId != "" || req.Email != "ana@example.com" {
+				t.Errorf("UserId = %q, Email = %q; se esperaba un invitado con ana@example.com", req.UserId, req.Email)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+// prefijoPagoManual distingue el payment_intent_id de una venta manual, que
+// no existe en Stripe
+const prefijoPagoManual = "manual_"
+
+func esPagoManual(paymentIntentID string) bool {
+	return strings.HasPrefix(paymentIntentID, prefijoPagoManual)
+}
+
+// ManualTicketsRequest es el cuerpo de POST /admin/tickets/manual
+type ManualTicketsRequest struct {
+	RifaID  string `json:"rifaId"`
+	Numeros []int  `json:"numeros"`
+	Email   string `json:"email"`
+	UserID  string `json:"userId,omitempty"`
+	// PaymentMethod es cómo se pagó ("zelle", "efectivo"); Reference el número
+	// de la transferencia, que puede faltar en un pago en efectivo
+	PaymentMethod string `json:"paymentMethod"`
+	Reference     string `json:"reference,omitempty"`
+	Locale        string `json:"locale,omitempty"`
+}
+
+// ManualTicketsResponse es la respuesta de POST /admin/tickets/manual
+type ManualTicketsResponse struct {
+	PaymentID string  `json:"paymentId"`
+	RifaID    string  `json:"rifaId"`
+	Numbers   []int   `json:"numbers"`
+	TicketIDs []int64 `json:"ticketIds"`
+	Amount    int64   `json:"amount"`
+	Currency  string  `json:"currency"`
+}
+
+// RegisterManualTickets registra una venta cobrada fuera de Stripe (efectivo,
+// Zelle, transferencia) con las mismas validaciones que una compra: la rifa
+// abierta, los números en rango y libres, y el monto según el precio de la
+// rifa. Los tickets llevan payment_method "manual" y el comprador recibe la
+// confirmación de siempre. Un número ocupado responde 409 con los números,
+// para elegir otros en el momento.
+func (s *Server) RegisterManualTickets(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ManualTicketsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	req.PaymentMethod = strings.ToLower(strings.TrimSpace(req.PaymentMethod))
+	req.Reference = strings.TrimSpace(req.Reference)
+	if !emailValido(req.Email) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El email no es válido", Code: "INVALID_EMAIL"})
+		return
+	}
+	if req.PaymentMethod == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta paymentMethod (p. ej. zelle, efectivo)", Code: "PAYMENT_METHOD_REQUIRED"})
+		return
+	}
+	if len(req.Numeros) == 0 {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Faltan los números vendidos", Code: "INVALID_NUMBERS"})
+		return
+	}
+
+	rifa, err := s.rifa(ctx, req.RifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, req.RifaID, err)
+		return
+	}
+	if !s.verificarRifaAbierta(ctx, w, rifa) {
+		return
+	}
+	if !validarNumerosSeleccionados(ctx, w, rifa, req.Numeros) {
+		return
+	}
+	cotizacion, ok := s.cotizar(ctx, w, rifa, len(req.Numeros))
+	if !ok {
+		return
+	}
+
+	ocupados, err := s.db.CheckNumbers(ctx, rifa.ID, req.Numeros)
+	if err != nil {
+		slog.ErrorContext(ctx, "error validando números", logging.ConError(err, "rifa_id", rifa.ID)...)
+		responderDisponibilidadNoVerificada(w, err)
+		return
+	}
+	if len(ocupados) > 0 {
+		slog.InfoContext(ctx, "números ocupados en venta manual", "rifa_id", rifa.ID, "numeros", ocupados)
+		responderNumerosOcupados(w, ocupados)
+		return
+	}
+
+	compra := &model.PurchaseDraft{
+		PaymentIntentID: prefijoPagoManual + logging.NuevoUUID(),
+		RifaID:          rifa.ID,
+		RifaTitle:       rifa.Title,
+		Numeros:         req.Numeros,
+		UserID:          req.UserID,
+		Email:           req.Email,
+		Amount:          cotizacion.Amount,
+		Locale:          mail.ElegirIdioma(req.Locale),
+	}
+	items, err := s.registrarTickets(ctx, compra, model.PagoTickets{
+		PaymentIntentID: compra.PaymentIntentID,
+		Amount:          cotizacion.Amount,
+		Currency:        cotizacion.Currency,
+		PaidAt:          time.Now(),
+		Method:          model.MetodoPagoManual,
+		Label:           req.PaymentMethod,
+		Reference:       req.Reference,
+	})
+	if err != nil {
+		// Si alcanzó a entrar algún lote se borra: la venta no quedó registrada
+		if err := s.db.DeleteTickets(ctx, compra.PaymentIntentID); err != nil {
+			slog.WarnContext(ctx, "no se pudieron borrar los tickets parciales", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		}
+		var ocupados *model.ErrNumerosOcupados
+		if errors.As(err, &ocupados) {
+			slog.InfoContext(ctx, "números ocupados al registrar venta manual", "rifa_id", rifa.ID, "numeros", ocupados.Numeros)
+			responderNumerosOcupados(w, ocupados.Numeros)
+			return
+		}
+		slog.ErrorContext(ctx, "error registrando venta manual", logging.ConError(err, "rifa_id", rifa.ID, "payment_intent_id", compra.PaymentIntentID)...)
+		http.Error(w, "Error registrando los números", 500)
+		return
+	}
+
+	slog.InfoContext(ctx, "venta manual registrada", "rifa_id", rifa.ID, "payment_intent_id", compra.PaymentIntentID, "metodo", req.PaymentMethod,
+		"numeros", len(req.Numeros), "amount", payments.FormatearMonto(cotizacion.Amount, cotizacion.Currency), "email", logging.EnmascararEmail(req.Email))
+	// Si el outbox falla queda en el log y la venta se responde igual: el
+	// correo se reenvía desde POST /admin/emails/resend
+	s.enviarCorreosCompra(ctx, compra, items, cotizacion.Amount, stripe.Currency(cotizacion.Currency))
+
+	writeJSON(w, http.StatusCreated, ManualTicketsResponse{
+		PaymentID: compra.PaymentIntentID,
+		RifaID:    rifa.ID,
+		Numbers:   req.Numeros,
+		TicketIDs: items[0].TicketIDs,
+		Amount:    cotizacion.Amount,
+		Currency:  cotizacion.Currency,
+	})
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+)
+
+// marcaGlobal es la de EMAIL_*; la llevan los correos internos y los de rifas
+// sin rifa_branding
+func (s *Server) marcaGlobal() mail.Marca {
+	return mail.Marca{
+		NombreRemitente: s.cfg.EmailFromName,
+		EmailRemitente:  s.cfg.EmailFromAddress,
+		ResponderA:      s.cfg.EmailReplyTo,
+		Logo:            s.cfg.EmailLogoURL,
+		Color:           s.cfg.EmailAccentColor,
+	}
+}
+
+// marcaRifa pone la rifa_branding de la rifa sobre la marca global. Un valor
+// inválido se descarta con un aviso y queda el global, así un dato mal cargado
+// no hace que Resend rechace el correo. Si la rifa no se puede leer, sale con
+// la marca global.
+func (s *Server) marcaRifa(ctx context.Context, rifaID string) mail.Marca {
+	marca := s.marcaGlobal()
+	if rifaID == "" {
+		return marca
+	}
+	rifa, err := s.rifa(ctx, rifaID)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo leer la marca de la rifa", logging.ConError(err, "rifa_id", rifaID)...)
+		return marca
+	}
+	b := rifa.Branding
+	if b == nil {
+		return marca
+	}
+
+	if b.FromName != "" {
+		marca.NombreRemitente = b.FromName
+	}
+	if b.FromEmail != "" {
+		if emailValido(strings.TrimSpace(b.FromEmail)) && s.cfg.RemitenteVerificado(b.FromEmail) {
+			marca.EmailRemitente = strings.ToLower(strings.TrimSpace(b.FromEmail))
+		} else {
+			slog.WarnContext(ctx, "remitente de la rifa fuera de los dominios verificados", "rifa_id", rifaID, "from_email", b.FromEmail)
+		}
+	}
+	if b.ReplyTo != "" {
+		if emailValido(strings.TrimSpace(b.ReplyTo)) {
+			marca.ResponderA = strings.TrimSpace(b.ReplyTo)
+		} else {
+			slog.WarnContext(ctx, "reply_to inválido en rifa_branding", "rifa_id", rifaID)
+		}
+	}
+	if b.LogoURL != "" {
+		if u, err := url.Parse(b.LogoURL); err == nil && u.Scheme == "https" && u.Host != "" {
+			marca.Logo = b.LogoURL
+		} else {
+			slog.WarnContext(ctx, "logo_url inválido en rifa_branding", "rifa_id", rifaID, "logo_url", b.LogoURL)
+		}
+	}
+	if b.AccentColor != "" {
+		if config.ColorValido(b.AccentColor) {
+			marca.Color = b.AccentColor
+		} else {
+			slog.WarnContext(ctx, "accent_color inválido en rifa_branding", "rifa_id", rifaID, "accent_color", b.AccentColor)
+		}
+	}
+	return marca
+}
+
+// marcaItems es la marca de las rifas de la compra. Un carrito con rifas de
+// organizadores distintos sale con la marca global.
+func (s *Server) marcaItems(ctx context.Context, items []model.ItemCompra) mail.Marca {
+	if len(items) == 0 {
+		return s.marcaGlobal()
+	}
+	marca := s.marcaRifa(ctx, items[0].RifaID)
+	for _, item := range items[1:] {
+		if item.RifaID != items[0].RifaID && s.marcaRifa(ctx, item.RifaID) != marca {
+			return s.marcaGlobal()
+		}
+	}
+	return marca
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+// prefijoMercadoPago va delante del ID del borrador (el external_reference de
+// la preferencia) en payment_intent_id. El ID del pago no sirve: no existe
+// hasta que el comprador paga.
+const prefijoMercadoPago = "mercadopago_"
+
+func esPagoMercadoPago(paymentIntentID string) bool {
+	return strings.HasPrefix(paymentIntentID, prefijoMercadoPago)
+}
+
+// CreateMercadoPagoPreference es CreatePaymentIntent para MercadoPago: valida
+// la compra con prepararCompraExterna, reserva los números y crea la
+// preferencia de Checkout Pro con external_reference en el ID del borrador. El
+// frontend manda al comprador a initPoint y el registro lo hace
+// HandleMercadoPagoWebhook.
+func (s *Server) CreateMercadoPagoPreference(w http.ResponseWriter, r *http.Request) {
+	if s.mercadopago == nil {
+		responderProveedorDesactivado(w, "MercadoPago")
+		return
+	}
+	c, ok := s.prepararCompraExterna(w, r, model.ProveedorMercadoPago)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	moneda := c.cotizacion.Currency
+	if !payments.MonedaMercadoPago(moneda) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error: "MercadoPago no cobra en " + strings.ToUpper(moneda),
+			Code:  "CURRENCY_NOT_SUPPORTED",
+		})
+		return
+	}
+
+	// Se reserva antes de crear la preferencia: el pago puede llegar en cuanto
+	// el comprador abre el checkout
+	id := prefijoMercadoPago + c.id
+	if !s.guardarCompraExterna(ctx, w, c, id) {
+		return
+	}
+	preferencia, err := s.mercadopago.CreatePreference(ctx, payments.NuevaPreferenciaMP{
+		Monto:             c.monto,
+		Moneda:            moneda,
+		Titulo:            c.rifa.Title,
+		Email:             c.req.Email,
+		ExternalReference: c.id,
+		NotificationURL:   s.cfg.MercadoPagoNotificationURL,
+		ReturnURL:         s.cfg.MercadoPagoReturnURL,
+		Vence:             time.Now().Add(s.cfg.ReservationTTL),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "error creando la preferencia de MercadoPago", logging.ConError(err, "rifa_id", c.rifa.ID, "payment_intent_id", id)...)
+		s.deshacerIntent(ctx, id)
+		ctxCompensacion, cancel := contextoCompensacion(ctx)
+		defer cancel()
+		if err := s.db.ReleasePromoRedemption(ctxCompensacion, id); err != nil {
+			slog.WarnContext(ctx, "no se pudo liberar el canje del código", logging.ConError(err, "payment_intent_id", id)...)
+		}
+		if errors.Is(err, payments.ErrMonedaMercadoPago) {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+				Error: "MercadoPago no puede cobrar este monto",
+				Code:  "AMOUNT_NOT_SUPPORTED",
+			})
+			return
+		}
+		writeJSON(w, http.StatusBadGateway, model.ErrorResponse{
+			Error: "No pudimos crear el pago en MercadoPago, intenta de nuevo",
+			Code:  "MERCADOPAGO_ERROR",
+		})
+		return
+	}
+
+	slog.InfoContext(ctx, "preferencia de MercadoPago creada", "rifa_id", c.rifa.ID, "payment_intent_id", id, "preference_id", preferencia.ID,
+		"email", logging.EnmascararEmail(c.req.Email), "amount", c.monto, "currency", moneda)
+	writeJSON(w, http.StatusOK, map[string]string{"preferenceId": preferencia.ID, "initPoint": preferencia.InitPoint})
+}
+
+// HandleMercadoPagoWebhook recibe las notificaciones de pagos. Valida
+// x-signature con el data.id de la URL, lee el pago de la API (la notificación
+// no trae el estado) y registra los tickets cuando está approved. Los demás
+// estados se ignoran: si el comprador no vuelve a intentar, el barrido libera
+// la reserva. Un error transitorio responde 500 y MercadoPago reintenta.
+func (s *Server) HandleMercadoPagoWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.mercadopago == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 65536)
+	cuerpo, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.WarnContext(ctx, "error leyendo el webhook de MercadoPago", logging.ConError(err)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var aviso struct {
+		Type   string `json:"type"`
+		Action string `json:"action"`
+		Data   struct {
+			// Viene como texto o como número según la versión de la notificación
+			ID json.RawMessage `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(cuerpo, &aviso); err != nil {
+		slog.WarnContext(ctx, "webhook de MercadoPago inválido", logging.ConError(err)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	consulta := r.URL.Query()
+	dataID := consulta.Get("data.id")
+	if dataID == "" {
+		dataID = strings.Trim(string(aviso.Data.ID), `"`)
+	}
+	if err := s.mercadopago.VerifyWebhook(r.Header, dataID); err != nil {
+		slog.WarnContext(ctx, "falló la validación del webhook de MercadoPago", logging.ConError(err, "data_id", dataID)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tipo := aviso.Type
+	if tipo == "" {
+		tipo = consulta.Get("type")
+	}
+	if tipo != "payment" || dataID == "" {
+		slog.DebugContext(ctx, "notificación de MercadoPago ignorada", "type", tipo, "action", aviso.Action)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	pago, err := s.mercadopago.GetPayment(ctx, dataID)
+	var errMP *payments.ErrMercadoPago
+	if errors.As(err, &errMP) && errMP.Status == http.StatusNotFound {
+		// Las notificaciones de prueba del panel traen IDs que no existen
+		slog.WarnContext(ctx, "pago de MercadoPago inexistente", "payment_id", dataID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando el pago de MercadoPago", logging.ConError(err, "payment_id", dataID)...)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if pago.Status != payments.PagoMercadoPagoAprobado {
+		slog.InfoContext(ctx, "pago de MercadoPago sin aprobar", "payment_id", pago.ID, "status", pago.Status, "status_detail", pago.StatusDetail, "external_reference", pago.ExternalReference)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if pago.ExternalReference == "" {
+		// Un cobro de la cuenta que no salió de una preferencia nuestra
+		slog.WarnContext(ctx, "pago de MercadoPago sin external_reference", "payment_id", pago.ID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := s.registrarPagoMercadoPago(ctx, pago); err != nil {
+		slog.ErrorContext(ctx, "error procesando el webhook de MercadoPago", logging.ConError(err, "payment_id", pago.ID, "external_reference", pago.ExternalReference)...)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// registrarPagoMercadoPago registra el pago aprobado con registrarCobroExterno
+func (s *Server) registrarPagoMercadoPago(ctx context.Context, pago *payments.PagoMP) error {
+	return s.registrarCobroExterno(ctx, cobroExterno{
+		PaymentID:  prefijoMercadoPago + pago.ExternalReference,
+		Proveedor:  model.ProveedorMercadoPago,
+		Referencia: pago.ID,
+		Monto:      pago.Monto,
+		Moneda:     pago.Moneda,
+		Pagado:     pago.Aprobado,
+		reembolsar: func(ctx context.Context) error {
+			return s.mercadopago.RefundPayment(ctx, pago.ID, "refund-registro-"+pago.ID)
+		},
+	})
+}
+
+// preferenciaAbandonada es reservaAbandonada para una compra de MercadoPago:
+// se libera si ninguno de sus pagos está aprobado o en curso
+func (s *Server) preferenciaAbandonada(ctx context.Context, externalReference string) (bool, error) {
+	if s.mercadopago == nil {
+		return false, nil
+	}
+	pagos, err := s.mercadopago.SearchPayments(ctx, externalReference)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range pagos {
+		switch p.Status {
+		case payments.PagoMercadoPagoAprobado, payments.PagoMercadoPagoPendiente, payments.PagoMercadoPagoEnProceso, payments.PagoMercadoPagoAutorizado:
+			// pending es p. ej. un pago en efectivo en OXXO o Rapipago, que
+			// MercadoPago cancela solo si vence
+			return false, nil
+		}
+	}
+	return true, nil
+}
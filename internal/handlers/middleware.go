@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/metrics"
+	"PaymentsGo/internal/model"
+)
+
+// origenPermitido compara con ALLOWED_ORIGINS. Se admite un comodín de
+// subdominio como https://*.twinsrifas.com
+func (s *Server) origenPermitido(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, patron := range s.cfg.AllowedOrigins {
+		if patron == origin {
+			return true
+		}
+		if prefijo, sufijo, ok := strings.Cut(patron, "*"); ok {
+			if len(origin) > len(prefijo)+len(sufijo) &&
+				strings.HasPrefix(origin, prefijo) && strings.HasSuffix(origin, sufijo) &&
+				!strings.Contains(origin[len(prefijo):len(origin)-len(sufijo)], "/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) EnableCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); s.origenPermitido(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-Client-Secret, X-Sandbox")
+			w.Header().Set("Access-Control-Max-Age", "600")
+		}
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// EnablePublicCORS es el CORS de los endpoints que otros sitios pueden
+// incrustar: cualquier origen, sólo GET y sin credenciales, aparte de
+// ALLOWED_ORIGINS
+func EnablePublicCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "600")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// --- Middleware CSP (ACTUALIZADO PARA APPLE PAY) ---
+func WithCSP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy",
+			"default-src 'self'; "+
+				"script-src 'self' https://js.stripe.com https://m.stripe.network 'unsafe-inline'; "+
+				"style-src 'self' https://js.stripe.com 'unsafe-inline'; "+
+				// Se agregan dominios de Apple para frames
+				"frame-src https://js.stripe.com https://m.stripe.network https://applepay.apple.com; "+
+				// Se agregan gateways de Apple para la conexión
+				"connect-src 'self' https://api.stripe.com https://m.stripe.network https://apple-pay-gateway.apple.com;")
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// maxCuerpoJSON es el cuerpo más grande que acepta WithJSONPost; una compra
+// con MAX_NUMEROS_PER_PURCHASE números ocupa mucho menos
+const maxCuerpoJSON = 16 << 10
+
+// WithJSONPost es la entrada de los endpoints que reciben un JSON: sólo acepta
+// POST (405 con Allow), con Content-Type application/json (415) y un cuerpo de
+// hasta maxCuerpoJSON (413). Va dentro de EnableCORS, que ya respondió el
+// preflight OPTIONS. El handler lee el cuerpo con decodificarJSON.
+func WithJSONPost(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			writeJSON(w, http.StatusMethodNotAllowed, model.ErrorResponse{Error: "Método no permitido", Code: "METHOD_NOT_ALLOWED"})
+			return
+		}
+		if tipo, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || tipo != "application/json" {
+			writeJSON(w, http.StatusUnsupportedMediaType, model.ErrorResponse{Error: "El cuerpo debe ser application/json", Code: "UNSUPPORTED_MEDIA_TYPE"})
+			return
+		}
+		if r.ContentLength > maxCuerpoJSON {
+			responderCuerpoDemasiadoGrande(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxCuerpoJSON)
+		next(w, r)
+	}
+}
+
+// decodificarJSON lee el cuerpo en destino; pasado el límite de WithJSONPost
+// responde 413 y con un JSON inválido 400. Devuelve false si ya respondió con
+// un error.
+func decodificarJSON(w http.ResponseWriter, r *http.Request, destino interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(destino)
+	if err == nil {
+		return true
+	}
+	var grande *http.MaxBytesError
+	if errors.As(err, &grande) {
+		responderCuerpoDemasiadoGrande(w)
+		return false
+	}
+	slog.WarnContext(r.Context(), "error decodificando JSON", logging.ConError(err)...)
+	http.Error(w, "JSON inválido", 400)
+	return false
+}
+
+func responderCuerpoDemasiadoGrande(w http.ResponseWriter) {
+	writeJSON(w, http.StatusRequestEntityTooLarge, model.ErrorResponse{
+		Error:   "El cuerpo de la petición es demasiado grande",
+		Code:    "BODY_TOO_LARGE",
+		Details: map[string]int{"max_bytes": maxCuerpoJSON},
+	})
+}
+
+var panicsRecuperados = metrics.NewCounter("http_panics_total", "Panics atrapados por WithRecovery")
+
+// WithRecovery atrapa el panic de un handler: lo registra con el stack y el
+// request ID y responde 500 con el ErrorResponse de siempre, en lugar de que
+// net/http corte la conexión. En el webhook el 500 hace que Stripe reintente.
+// Va dentro de WithRequestID para que el log y la respuesta lleven el ID.
+func WithRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &respuestaVigilada{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			panicsRecuperados.Inc()
+			slog.ErrorContext(r.Context(), "panic en handler",
+				"panic", fmt.Sprint(p), "method", r.Method, "path", r.URL.Path, "stack", string(debug.Stack()))
+			if rw.escrito {
+				// Ya salió parte de la respuesta y no se puede cambiar el status:
+				// cortar la conexión es mejor que dejar un cuerpo a medias
+				panic(http.ErrAbortHandler)
+			}
+			writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{
+				Error: "Error interno del servidor",
+				Code:  "INTERNAL_ERROR",
+			})
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// respuestaVigilada recuerda si el handler ya empezó a escribir la respuesta
+type respuestaVigilada struct {
+	http.ResponseWriter
+	escrito bool
+}
+
+func (r *respuestaVigilada) WriteHeader(status int) {
+	r.escrito = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *respuestaVigilada) Write(b []byte) (int, error) {
+	r.escrito = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap deja que http.ResponseController llegue al Flusher (export CSV)
+func (r *respuestaVigilada) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+var plazosAgotados = metrics.NewCounter("http_deadline_exceeded_total", "Peticiones que respondieron 504 por WithDeadline")
+
+// WithDeadline le pone un plazo al contexto de la petición, así Supabase,
+// Stripe y Resend cortan cuando vence o cuando el cliente se va. Si vence, el
+// 5xx con que responde el handler (un error de Supabase o Stripe por el
+// contexto) se cambia por 504 DEADLINE_EXCEEDED; lo que el handler alcanzó a
+// hacer lo deshace él mismo con contextoCompensacion.
+func WithDeadline(plazo time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), plazo)
+		defer cancel()
+		rw := &respuestaConPlazo{ResponseWriter: w, ctx: ctx}
+		next(rw, r.WithContext(ctx))
+		if !rw.escrito && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			rw.responderPlazoAgotado()
+		}
+		if rw.agotado {
+			plazosAgotados.Inc()
+			slog.WarnContext(ctx, "plazo de la petición agotado", "method", r.Method, "path", r.URL.Path, "plazo", plazo.String())
+		}
+	}
+}
+
+// respuestaConPlazo cambia por 504 un 5xx escrito después de vencido el plazo
+// y descarta el cuerpo que el handler iba a mandar con él
+type respuestaConPlazo struct {
+	http.ResponseWriter
+	ctx     context.Context
+	escrito bool
+	agotado bool
+}
+
+func (r *respuestaConPlazo) WriteHeader(status int) {
+	if r.escrito {
+		return
+	}
+	if status >= 500 && errors.Is(r.ctx.Err(), context.DeadlineExceeded) {
+		r.responderPlazoAgotado()
+		return
+	}
+	r.escrito = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *respuestaConPlazo) Write(b []byte) (int, error) {
+	if !r.escrito {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.agotado {
+		return len(b), nil
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *respuestaConPlazo) responderPlazoAgotado() {
+	r.escrito, r.agotado = true, true
+	writeJSON(r.ResponseWriter, http.StatusGatewayTimeout, model.ErrorResponse{
+		Error: "La operación tardó demasiado, intenta de nuevo",
+		Code:  "DEADLINE_EXCEEDED",
+	})
+}
+
+func (r *respuestaConPlazo) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// maxCuerpoDepuracion es lo más que WithDebugHTTP copia de cada cuerpo; uno
+// más grande se registra sólo como tamaño
+const maxCuerpoDepuracion = maxCuerpoJSON
+
+// WithDebugHTTP (DEBUG_HTTP_LOGGING=on) registra cada petición de la API con
+// los cuerpos de entrada y salida pasados por logging.LimpiarJSON. Los
+// webhooks no pasan por acá: de ellos sólo se registran el ID y el tipo del
+// evento, también con el modo activo.
+func WithDebugHTTP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/webhook") {
+			next(w, r)
+			return
+		}
+		var peticion []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			peticion, _ = io.ReadAll(io.LimitReader(r.Body, maxCuerpoDepuracion+1))
+			// El handler lee el cuerpo completo: lo copiado y lo que quedó sin leer
+			r.Body = cuerpoReleido{io.MultiReader(bytes.NewReader(peticion), r.Body), r.Body}
+		}
+		rw := &respuestaCopiada{ResponseWriter: w, status: http.StatusOK}
+		inicio := time.Now()
+		next(rw, r)
+		slog.InfoContext(r.Context(), "http debug", "method", r.Method, "path", r.URL.Path, "status", rw.status,
+			"duracion", time.Since(inicio).String(), "request_body", cuerpoDepuracion(peticion), "response_body", cuerpoDepuracion(rw.copia.Bytes()))
+	}
+}
+
+func cuerpoDepuracion(cuerpo []byte) string {
+	if len(cuerpo) > maxCuerpoDepuracion {
+		return fmt.Sprintf("[más de %d bytes]", maxCuerpoDepuracion)
+	}
+	return logging.LimpiarJSON(cuerpo)
+}
+
+type cuerpoReleido struct {
+	io.Reader
+	io.Closer
+}
+
+// respuestaCopiada guarda el status y hasta maxCuerpoDepuracion+1 bytes de la
+// respuesta, sin cambiar lo que recibe el cliente
+type respuestaCopiada struct {
+	http.ResponseWriter
+	status  int
+	escrito bool
+	copia   bytes.Buffer
+}
+
+func (r *respuestaCopiada) WriteHeader(status int) {
+	if !r.escrito {
+		r.status, r.escrito = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *respuestaCopiada) Write(b []byte) (int, error) {
+	r.escrito = true
+	if falta := maxCuerpoDepuracion + 1 - r.copia.Len(); falta > 0 {
+		r.copia.Write(b[:min(len(b), falta)])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *respuestaCopiada) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
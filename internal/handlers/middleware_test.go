@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// handlerEco decodifica el cuerpo como lo hacen los endpoints y responde 200
+func handlerEco(w http.ResponseWriter, r *http.Request) {
+	var req model.PaymentRequest
+	if !decodificarJSON(w, r, &req) {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// sinLongitud esconde el largo del cuerpo, como una petición chunked, para que
+// sólo MaxBytesReader pueda detectar que es demasiado grande
+type sinLongitud struct {
+	io.Reader
+}
+
+func TestWithJSONPost(t *testing.T) {
+	grande := `{"rifaId":"` + strings.Repeat("x", maxCuerpoJSON) + `"}`
+	casos := []struct {
+		nombre      string
+		metodo      string
+		contentType string
+		cuerpo      io.Reader
+		status      int
+		code        string
+	}{
+		{nombre: "GET", metodo: http.MethodGet, status: http.StatusMethodNotAllowed, code: "METHOD_NOT_ALLOWED"},
+		{nombre: "PUT", metodo: http.MethodPut, contentType: "application/json", cuerpo: strings.NewReader(`{}`), status: http.StatusMethodNotAllowed, code: "METHOD_NOT_ALLOWED"},
+		{nombre: "sin Content-Type", metodo: http.MethodPost, cuerpo: strings.NewReader(`{}`), status: http.StatusUnsupportedMediaType, code: "UNSUPPORTED_MEDIA_TYPE"},
+		{nombre: "text/plain", metodo: http.MethodPost, contentType: "text/plain", cuerpo: strings.NewReader(`{}`), status: http.StatusUnsupportedMediaType, code: "UNSUPPORTED_MEDIA_TYPE"},
+		{nombre: "formulario", metodo: http.MethodPost, contentType: "application/x-www-form-urlencoded", cuerpo: strings.NewReader(`a=1`), status: http.StatusUnsupportedMediaType, code: "UNSUPPORTED_MEDIA_TYPE"},
+		{nombre: "Content-Length grande", metodo: http.MethodPost, contentType: "application/json", cuerpo: strings.NewReader(grande), status: http.StatusRequestEntityTooLarge, code: "BODY_TOO_LARGE"},
+		{nombre: "chunked grande", metodo: http.MethodPost, contentType: "application/json", cuerpo: sinLongitud{strings.NewReader(grande)}, status: http.StatusRequestEntityTooLarge, code: "BODY_TOO_LARGE"},
+		{nombre: "JSON inválido", metodo: http.MethodPost, contentType: "application/json", cuerpo: strings.NewReader(`{`), status: http.StatusBadRequest},
+		{nombre: "válido", metodo: http.MethodPost, contentType: "application/json", cuerpo: strings.NewReader(`{"rifaId":"r1"}`), status: http.StatusOK},
+		{nombre: "válido con charset", metodo: http.MethodPost, contentType: "application/json; charset=utf-8", cuerpo: strings.NewReader(`{"rifaId":"r1"}`), status: http.StatusOK},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			r := httptest.NewRequest(c.metodo, "/payments/create-intent", c.cuerpo)
+			if c.contentType != "" {
+				r.Header.Set("Content-Type", c.contentType)
+			}
+			w := httptest.NewRecorder()
+			WithJSONPost(handlerEco)(w, r)
+
+			if w.Code != c.status {
+				t.Fatalf("status = %d, se esperaba %d (%s)", w.Code, c.status, w.Body.String())
+			}
+			if c.status == http.StatusMethodNotAllowed {
+				if allow := w.Header().Get("Allow"); allow != "POST, OPTIONS" {
+					t.Errorf("Allow = %q, se esperaba \"POST, OPTIONS\"", allow)
+				}
+			}
+			if c.code == "" {
+				return
+			}
+			var e model.ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+				t.Fatalf("la respuesta no es un ErrorResponse: %v (%s)", err, w.Body.String())
+			}
+			if e.Code != c.code {
+				t.Errorf("code = %q, se esperaba %q", e.Code, c.code)
+			}
+		})
+	}
+}
+
+func TestWithRecovery(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/explota", func(w http.ResponseWriter, r *http.Request) {
+		panic("falla de prueba")
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := logging.WithRequestID(WithRecovery(mux))
+	antes := panicsRecuperados.Value()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/explota", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, se esperaba 500", w.Code)
+	}
+	var respuesta model.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &respuesta); err != nil {
+		t.Fatalf("cuerpo no es JSON: %v (%s)", err, w.Body.String())
+	}
+	if respuesta.Code != "INTERNAL_ERROR" {
+		t.Errorf("code = %q, se esperaba INTERNAL_ERROR", respuesta.Code)
+	}
+	if id := w.Header().Get(logging.CabeceraRequestID); id == "" || respuesta.RequestID != id {
+		t.Errorf("requestId = %q, se esperaba el de la cabecera %q", respuesta.RequestID, id)
+	}
+	if despues := panicsRecuperados.Value(); despues != antes+1 {
+		t.Errorf("http_panics_total = %v, se esperaba %v", despues, antes+1)
+	}
+
+	// el panic no tumba el mux: la siguiente petición se atiende normal
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status después del panic = %d, se esperaba 200", w.Code)
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+// montoEsperado es lo que tenía que cobrar el intent de la compra según
+// PRICE_AUTHORITY: con draft, el total que guardó el borrador al crearlo; con
+// current, lo que cuestan hoy los números de cada rifa menos el descuento que
+// se aplicó entonces. En un plan de cuotas es la primera.
+func (s *Server) montoEsperado(ctx context.Context, compra *model.PurchaseDraft) (int64, error) {
+	total := compra.Amount
+	if s.cfg.PriceAuthority == "current" {
+		total = 0
+		for _, item := range itemsDeCompra(compra) {
+			rifa, err := s.db.GetRifa(ctx, item.RifaID)
+			if err != nil {
+				return 0, err
+			}
+			cotizacion, err := s.calcularCotizacion(ctx, rifa, len(item.Numeros))
+			if err != nil {
+				return 0, fmt.Errorf("rifa %s: %w", item.RifaID, err)
+			}
+			total += cotizacion.Amount
+		}
+		total = max(total-compra.Discount, 0)
+	}
+	if compra.Installments > 1 {
+		return montoCuota(total, compra.Installments, 1), nil
+	}
+	return total, nil
+}
+
+// retenerDiferenciaPrecio compara lo que cobró pi con montoEsperado. Si se
+// aleja más que PriceMismatchTolerance guarda la compra en price_mismatches,
+// avisa al organizador y devuelve true: los tickets no se registran y los
+// números siguen reservados (el barrido no libera los de un intent pagado).
+func (s *Server) retenerDiferenciaPrecio(ctx context.Context, compra *model.PurchaseDraft, pi *stripe.PaymentIntent) (bool, error) {
+	esperado, err := s.montoEsperado(ctx, compra)
+	if err != nil {
+		return false, fmt.Errorf("monto esperado: %w", err)
+	}
+	diferencia := pi.Amount - esperado
+	if max(diferencia, -diferencia) <= s.cfg.PriceMismatchTolerance {
+		return false, nil
+	}
+
+	items := itemsDeCompra(compra)
+	if err := s.db.RecordPriceMismatch(ctx, &model.DiferenciaPrecio{
+		PaymentIntentID: pi.ID,
+		PurchaseID:      compra.ID,
+		RifaID:          compra.RifaID,
+		Email:           compra.Email,
+		Items:           items,
+		ExpectedAmount:  esperado,
+		PaidAmount:      pi.Amount,
+		Currency:        string(pi.Currency),
+		Authority:       s.cfg.PriceAuthority,
+	}); err != nil {
+		return false, fmt.Errorf("price_mismatches: %w", err)
+	}
+	slog.WarnContext(ctx, "el monto cobrado no coincide con el precio, tickets retenidos", "payment_intent_id", pi.ID, "rifa_id", compra.RifaID, "expected_amount", esperado, "paid_amount", pi.Amount, "authority", s.cfg.PriceAuthority, "email", logging.EnmascararEmail(compra.Email))
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaDiferenciaPrecio,
+		RifaID:          compra.RifaID,
+		PaymentIntentID: pi.ID,
+		Detail:          map[string]interface{}{"expected_amount": esperado, "paid_amount": pi.Amount, "currency": pi.Currency, "authority": s.cfg.PriceAuthority},
+	})
+
+	detalles := []string{
+		"Rifa: " + compra.RifaTitle,
+		"Comprador: " + compra.Email,
+		"PaymentIntent: " + pi.ID,
+		"Cobrado: " + payments.FormatearMonto(pi.Amount, string(pi.Currency)),
+		"Esperado: " + payments.FormatearMonto(esperado, string(pi.Currency)) + " (precio " + s.cfg.PriceAuthority + ")",
+	}
+	for _, item := range items {
+		detalles = append(detalles, "Números en "+item.RifaTitle+": "+mail.FormatearNumeros(item.Numeros))
+	}
+	detalles = append(detalles, "Los tickets no se registraron: registra los números o reembolsa el pago y marca la fila de price_mismatches como resuelta.")
+	s.avisarOrganizadorEnSegundoPlano(ctx, fmt.Sprintf("Pago con monto distinto en %s", compra.RifaTitle), "Monto cobrado distinto del precio", detalles)
+	return true, nil
+}
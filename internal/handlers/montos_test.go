@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/model"
+)
+
+// storePrecios es un Store con una sola rifa; anota las diferencias guardadas
+type storePrecios struct {
+	Store
+	rifa        model.Rifa
+	diferencias []model.DiferenciaPrecio
+}
+
+func (f *storePrecios) GetRifa(_ context.Context, _ string) (*model.Rifa, error) {
+	rifa := f.rifa
+	return &rifa, nil
+}
+
+func (f *storePrecios) RecordPriceMismatch(_ context.Context, diferencia *model.DiferenciaPrecio) error {
+	f.diferencias = append(f.diferencias, *diferencia)
+	return nil
+}
+
+func TestRetenerDiferenciaPrecio(t *testing.T) {
+	// 3 números a $10 MXN: 3000 centavos
+	compra := model.PurchaseDraft{ID: "b1", RifaID: "r1", Numeros: []int{1, 2, 3}, Amount: 3000}
+	casos := []struct {
+		nombre    string
+		autoridad string
+		precio    int64
+		descuento int64
+		cuotas    int
+		cobrado   int64
+		retenida  bool
+		esperado  int64
+	}{
+		{nombre: "coincide con el borrador", autoridad: "draft", precio: 10, cobrado: 3000},
+		{nombre: "dentro de la tolerancia", autoridad: "draft", precio: 10, cobrado: 2999},
+		{nombre: "menos que el borrador", autoridad: "draft", precio: 10, cobrado: 300, retenida: true, esperado: 3000},
+		{nombre: "más que el borrador", autoridad: "draft", precio: 10, cobrado: 3500, retenida: true, esperado: 3000},
+		{nombre: "borrador con precio nuevo en la rifa", autoridad: "draft", precio: 20, cobrado: 3000},
+		{nombre: "precio actual más alto", autoridad: "current", precio: 20, cobrado: 3000, retenida: true, esperado: 6000},
+		{nombre: "precio actual con descuento", autoridad: "current", precio: 20, descuento: 3000, cobrado: 3000},
+		{nombre: "primera cuota", autoridad: "draft", precio: 10, cuotas: 2, cobrado: 1500},
+		{nombre: "primera cuota por el total", autoridad: "draft", precio: 10, cuotas: 2, cobrado: 3000, retenida: true, esperado: 1500},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			db := &storePrecios{rifa: model.Rifa{ID: "r1", Price: c.precio, Currency: "mxn"}}
+			s := &Server{cfg: &config.Config{PriceAuthority: c.autoridad, PriceMismatchTolerance: 1, PriceUnit: "major"}, db: db}
+			compra := compra
+			compra.Discount, compra.Installments = c.descuento, c.cuotas
+			pi := &stripe.PaymentIntent{ID: "pi_1", Amount: c.cobrado, Currency: "mxn"}
+
+			retenida, err := s.retenerDiferenciaPrecio(context.Background(), &compra, pi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if retenida != c.retenida {
+				t.Fatalf("retenida = %v, se esperaba %v", retenida, c.retenida)
+			}
+			if !c.retenida {
+				if len(db.diferencias) > 0 {
+					t.Errorf("se guardó una diferencia: %+v", db.diferencias)
+				}
+				return
+			}
+			if len(db.diferencias) != 1 {
+				t.Fatalf("diferencias guardadas = %d, se esperaba 1", len(db.diferencias))
+			}
+			d := db.diferencias[0]
+			if d.ExpectedAmount != c.esperado || d.PaidAmount != c.cobrado || d.Authority != c.autoridad || d.PaymentIntentID != "pi_1" {
+				t.Errorf("diferencia = %+v, se esperaba %d contra %d", d, c.esperado, c.cobrado)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// EstadoNumeros es la respuesta de GET /rifas/{id}/numeros
+type EstadoNumeros struct {
+	Sold      []int `json:"sold"`
+	Reserved  []int `json:"reserved"`
+	Available []int `json:"available"`
+}
+
+// 3. Estado de los números de una rifa (vendidos, reservados y disponibles)
+func (s *Server) GetNumerosRifa(w http.ResponseWriter, r *http.Request) {
+	rifaID := r.PathValue("id")
+
+	ctx := r.Context()
+	rifa, err := s.rifa(ctx, rifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, rifaID, err)
+		return
+	}
+
+	estado, err := s.estadoNumeros(ctx, rifa)
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando números", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error consultando números", 500)
+		return
+	}
+
+	// TTL corto: el frontend puede hacer polling cada pocos segundos
+	w.Header().Set("Cache-Control", "public, max-age=5")
+	writeJSON(w, http.StatusOK, estado)
+}
+
+// estadoNumeros clasifica los números de la rifa (1..total_numbers)
+func (s *Server) estadoNumeros(ctx context.Context, rifa *model.Rifa) (*EstadoNumeros, error) {
+	vendidos, err := s.db.SoldNumbers(ctx, rifa.ID)
+	if err != nil {
+		return nil, err
+	}
+	reservados, err := s.db.ReservedNumbers(ctx, rifa.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ocupado := map[int]bool{}
+	estado := &EstadoNumeros{Sold: []int{}, Reserved: []int{}, Available: []int{}}
+	for _, n := range vendidos {
+		if !ocupado[n] {
+			ocupado[n] = true
+			estado.Sold = append(estado.Sold, n)
+		}
+	}
+	for _, n := range reservados {
+		if !ocupado[n] {
+			ocupado[n] = true
+			estado.Reserved = append(estado.Reserved, n)
+		}
+	}
+	for n := 1; n <= rifa.TotalNumbers; n++ {
+		if !ocupado[n] {
+			estado.Available = append(estado.Available, n)
+		}
+	}
+	sort.Ints(estado.Sold)
+	sort.Ints(estado.Reserved)
+	return estado, nil
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/payments"
+)
+
+// cobrarParaOrganizador convierte el intent en un destination charge a la
+// cuenta conectada del organizador: Stripe le transfiere el cobro menos la
+// comisión de PLATFORM_FEE_PERCENT. Sin cuenta el intent queda como siempre,
+// en la cuenta de la plataforma.
+func (s *Server) cobrarParaOrganizador(params *stripe.PaymentIntentParams, cuenta string, monto int64) {
+	if cuenta == "" {
+		return
+	}
+	params.TransferData = &stripe.PaymentIntentTransferDataParams{Destination: stripe.String(cuenta)}
+	if comision := payments.ComisionPlataforma(monto, s.cfg.PlatformFeePercent); comision > 0 {
+		params.ApplicationFeeAmount = stripe.Int64(comision)
+	}
+	params.Metadata["organizer_account"] = cuenta
+}
+
+// cuentaDestino es la cuenta conectada que recibe el cobro del intent; vacío
+// si el cobro es de la plataforma
+func cuentaDestino(pi *stripe.PaymentIntent) string {
+	if pi.TransferData == nil || pi.TransferData.Destination == nil {
+		return ""
+	}
+	return pi.TransferData.Destination.ID
+}
+
+// revertirTransferencia hace que el reembolso de un destination charge le
+// descuente el monto al organizador y devuelva la comisión en proporción; sin
+// esto el reembolso sale entero de la cuenta de la plataforma
+func revertirTransferencia(params *stripe.RefundParams, pi *stripe.PaymentIntent) {
+	if cuentaDestino(pi) == "" {
+		return
+	}
+	params.ReverseTransfer = stripe.Bool(true)
+	params.RefundApplicationFee = stripe.Bool(true)
+}
@@ -0,0 +1,365 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/metrics"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+)
+
+// Acciones del outbox (columna kind)
+const (
+	salidaConfirmacion = "purchase_confirmation"
+	salidaRegalo       = "gift_email"
+	salidaReciboRegalo = "gift_receipt"
+	salidaOrganizador  = "organizer_notification"
+	salidaAvisoVenta   = "sale_notice"
+	salidaReembolso    = "refund_email"
+	salidaPagoFallido  = "payment_failed_email"
+)
+
+// Reintentos de una entrada del outbox: la espera se duplica desde
+// esperaInicialSalida (30s, 1m, 2m...), unas 4 horas en total antes de darla
+// por muerta
+const (
+	intentosSalida      = 10
+	esperaInicialSalida = 30 * time.Second
+	// plazoSalida es cuánto queda tomada una entrada: si el proceso muere
+	// mientras la envía, otra instancia (o esta al reiniciar) la retoma después
+	plazoSalida = 2 * time.Minute
+	// intervaloSalidas es cada cuánto se busca en outbox si nadie avisó antes
+	intervaloSalidas = 15 * time.Second
+	loteSalidas      = 50
+)
+
+var (
+	salidasPendientes = metrics.NewGauge("outbox_depth", "Entradas pendientes del outbox")
+	salidaMasVieja    = metrics.NewGauge("outbox_oldest_pending_seconds", "Antigüedad en segundos de la entrada pendiente más vieja del outbox")
+	salidasMuertas    = metrics.NewCounter("outbox_dead_total", "Entradas del outbox que agotaron los reintentos")
+)
+
+// datosCompraSalida son los datos de los correos de una compra confirmada
+type datosCompraSalida struct {
+	Compra *model.PurchaseDraft `json:"compra"`
+	Items  []model.ItemCompra   `json:"items"`
+	Monto  int64                `json:"monto"`
+	Moneda string               `json:"moneda"`
+}
+
+type datosOrganizadorSalida struct {
+	Comprador string `json:"comprador"`
+	Rifa      string `json:"rifa"`
+	Cantidad  int    `json:"cantidad"`
+	Monto     int64  `json:"monto"`
+	Moneda    string `json:"moneda"`
+}
+
+// datosAvisoSalida es el aviso de venta para uno de los canales de s.avisos
+type datosAvisoSalida struct {
+	Canal string `json:"canal"`
+	Texto string `json:"texto"`
+}
+
+type datosReembolsoSalida struct {
+	Email  string             `json:"email"`
+	Items  []model.ItemCompra `json:"items"`
+	Motivo string             `json:"motivo"`
+}
+
+type datosPagoFallidoSalida struct {
+	Email     string `json:"email"`
+	RifaID    string `json:"rifa_id"`
+	RifaTitle string `json:"rifa_title"`
+}
+
+// nuevaSalida arma la entrada de la acción. clave identifica lo que la origina
+// (el payment intent, más el canal de un aviso): la misma acción con la misma
+// clave se escribe una sola vez. email es el cliente destinatario, si lo hay.
+func nuevaSalida(ctx context.Context, accion string, clave string, email string, datos interface{}) model.OutboxEntry {
+	// Los datos son structs propios sin canales ni funciones: Marshal no falla
+	payload, _ := json.Marshal(datos)
+	return model.OutboxEntry{
+		Kind:          accion,
+		DedupKey:      accion + ":" + clave,
+		Payload:       payload,
+		Email:         email,
+		RequestID:     logging.RequestIDDe(ctx),
+		Status:        model.SalidaPendiente,
+		NextAttemptAt: time.Now(),
+	}
+}
+
+// encolarSalidas guarda las entradas en outbox y despierta al despachador. Si
+// falla no se envía nada: el llamador devuelve el error para que su trabajo
+// se reintente, o lo deja en el log si ya respondió.
+func (s *Server) encolarSalidas(ctx context.Context, entradas ...model.OutboxEntry) error {
+	if len(entradas) == 0 {
+		return nil
+	}
+	if err := s.db.EnqueueOutbox(ctx, entradas); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	s.despertarOutbox()
+	return nil
+}
+
+// despertarOutbox hace que el despachador busque en outbox sin esperar a
+// intervaloSalidas
+func (s *Server) despertarOutbox() {
+	select {
+	case s.salidas <- struct{}{}:
+	default:
+	}
+}
+
+// IniciarOutbox arranca el despachador del outbox. El primer barrido corre
+// enseguida, así que lo que quedó pendiente antes de un reinicio sale al
+// arrancar. Cuando ctx se cancela deja de tomar entradas; la que está
+// enviando termina y se cuenta en TareasPendientes.
+func (s *Server) IniciarOutbox(ctx context.Context) {
+	go s.despacharSalidas(ctx)
+}
+
+func (s *Server) despacharSalidas(ctx context.Context) {
+	for {
+		s.medirOutbox(ctx)
+		entradas, err := s.db.DueOutbox(ctx, loteSalidas)
+		if err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "error buscando el outbox", logging.ConError(err)...)
+		}
+		for _, e := range entradas {
+			if ctx.Err() != nil {
+				return
+			}
+			TareasPendientes.Add(1)
+			s.despacharSalida(context.WithoutCancel(ctx), e)
+			TareasPendientes.Done()
+		}
+		// Un lote lleno puede tener más detrás: se sigue sin esperar
+		if len(entradas) == loteSalidas {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.salidas:
+		case <-time.After(intervaloSalidas):
+		}
+	}
+}
+
+// medirOutbox actualiza outbox_depth y outbox_oldest_pending_seconds. El
+// sandbox no las toca: son las de producción.
+func (s *Server) medirOutbox(ctx context.Context) {
+	if s.enSandbox {
+		return
+	}
+	pendientes, desde, err := s.db.OutboxBacklog(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.WarnContext(ctx, "error midiendo el outbox", logging.ConError(err)...)
+		}
+		return
+	}
+	salidasPendientes.Set(int64(pendientes))
+	if desde.IsZero() {
+		salidaMasVieja.Set(0)
+		return
+	}
+	salidaMasVieja.Set(int64(time.Since(desde).Seconds()))
+}
+
+// despacharSalida toma la entrada, ejecuta su acción y deja el resultado:
+// sent si salió bien, el próximo intento si no, y dead si agotó los intentos
+// o la acción no se puede ejecutar.
+func (s *Server) despacharSalida(ctx context.Context, entrada model.OutboxEntry) {
+	if entrada.RequestID != "" {
+		ctx = logging.ConRequestID(ctx, entrada.RequestID)
+	}
+	tomada, err := s.db.ClaimOutbox(ctx, &entrada, time.Now().Add(plazoSalida))
+	if err != nil || !tomada {
+		if err != nil {
+			slog.WarnContext(ctx, "no se pudo tomar la entrada del outbox", logging.ConError(err, "outbox_id", entrada.ID)...)
+		}
+		return
+	}
+
+	err = s.ejecutarSalida(ctx, entrada)
+	if err == nil {
+		ahora := time.Now()
+		entrada.Status = model.SalidaEnviada
+		entrada.LastError = ""
+		entrada.SentAt = &ahora
+		if err := s.db.UpdateOutbox(ctx, &entrada); err != nil {
+			// Queda pending con el plazo de la toma: se vuelve a enviar al vencer
+			slog.ErrorContext(ctx, "no se pudo marcar la entrada del outbox como enviada", logging.ConError(err, "outbox_id", entrada.ID, "kind", entrada.Kind)...)
+		}
+		return
+	}
+
+	var abierto *store.ErrCircuitoAbierto
+	if errors.As(err, &abierto) {
+		// Se reintenta cuando venza la toma; el intento ya quedó contado
+		slog.WarnContext(ctx, "entrada del outbox pospuesta con el circuito de Supabase abierto", "outbox_id", entrada.ID, "kind", entrada.Kind)
+		return
+	}
+	entrada.LastError = err.Error()
+	var permanenteErr errPermanente
+	if errors.As(err, &permanenteErr) || entrada.Attempts >= intentosSalida {
+		entrada.Status = model.SalidaMuerta
+		salidasMuertas.Inc()
+		slog.ErrorContext(ctx, "entrada del outbox abandonada", logging.ConError(err, "outbox_id", entrada.ID, "kind", entrada.Kind, "intentos", entrada.Attempts)...)
+	} else {
+		espera := esperaInicialSalida << (entrada.Attempts - 1)
+		entrada.NextAttemptAt = time.Now().Add(espera)
+		slog.WarnContext(ctx, "entrada del outbox falló, se reintentará", logging.ConError(err, "outbox_id", entrada.ID, "kind", entrada.Kind, "intento", entrada.Attempts, "espera", espera.String())...)
+	}
+	if err := s.db.UpdateOutbox(ctx, &entrada); err != nil {
+		slog.ErrorContext(ctx, "no se pudo actualizar la entrada del outbox", logging.ConError(err, "outbox_id", entrada.ID)...)
+	}
+}
+
+// ejecutarSalida hace una vez la acción de la entrada; los reintentos son del
+// despachador
+func (s *Server) ejecutarSalida(ctx context.Context, entrada model.OutboxEntry) error {
+	decodificar := func(destino interface{}) error {
+		if err := json.Unmarshal(entrada.Payload, destino); err != nil {
+			return permanente(fmt.Errorf("payload inválido: %w", err))
+		}
+		return nil
+	}
+	switch entrada.Kind {
+	case salidaConfirmacion:
+		var d datosCompraSalida
+		if err := decodificar(&d); err != nil {
+			return err
+		}
+		c := d.Compra
+		return s.enviarCorreoConfirmacion(ctx, c.Email, c.Locale, d.Items, d.Monto, c.Discount, d.Moneda, s.adjuntoRecibo(ctx, c, d.Items, d.Monto, d.Moneda)...)
+
+	case salidaRegalo:
+		var d datosCompraSalida
+		if err := decodificar(&d); err != nil {
+			return err
+		}
+		c := d.Compra
+		return s.enviarCorreoRegalo(ctx, c.RecipientEmail, c.RecipientName, c.Email, d.Items)
+
+	case salidaReciboRegalo:
+		var d datosCompraSalida
+		if err := decodificar(&d); err != nil {
+			return err
+		}
+		c := d.Compra
+		regalado := c.RecipientEmail
+		if c.RecipientName != "" {
+			regalado = c.RecipientName + " (" + c.RecipientEmail + ")"
+		}
+		return s.enviarReciboRegalo(ctx, c.Email, regalado, d.Items, d.Monto, c.Discount, d.Moneda)
+
+	case salidaOrganizador:
+		var d datosOrganizadorSalida
+		if err := decodificar(&d); err != nil {
+			return err
+		}
+		return s.enviarNotificacionOrganizador(ctx, d.Comprador, d.Rifa, d.Cantidad, d.Monto, stripe.Currency(d.Moneda))
+
+	case salidaAvisoVenta:
+		var d datosAvisoSalida
+		if err := decodificar(&d); err != nil {
+			return err
+		}
+		for _, canal := range s.avisos {
+			if canal.Nombre() == d.Canal {
+				return canal.Notificar(ctx, d.Texto)
+			}
+		}
+		return permanente(fmt.Errorf("el canal de avisos %q ya no está configurado", d.Canal))
+
+	case salidaReembolso:
+		var d datosReembolsoSalida
+		if err := decodificar(&d); err != nil {
+			return err
+		}
+		return s.enviarCorreoReembolso(ctx, d.Email, d.Items, d.Motivo)
+
+	case salidaPagoFallido:
+		var d datosPagoFallidoSalida
+		if err := decodificar(&d); err != nil {
+			return err
+		}
+		return s.enviarCorreoPagoFallido(ctx, d.Email, d.RifaID, d.RifaTitle)
+	}
+	return permanente(fmt.Errorf("acción de outbox desconocida %q", entrada.Kind))
+}
+
+// OutboxResponse es la respuesta de GET /admin/outbox
+type OutboxResponse struct {
+	Entries []model.OutboxEntry `json:"entries"`
+	Count   int                 `json:"count"`
+}
+
+// ListOutbox lista las entradas del outbox en ?status= (dead por defecto; también
+// pending o sent), las más nuevas primero
+func (s *Server) ListOutbox(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	estado := r.URL.Query().Get("status")
+	switch estado {
+	case "":
+		estado = model.SalidaMuerta
+	case model.SalidaPendiente, model.SalidaEnviada, model.SalidaMuerta:
+	default:
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "status debe ser pending, sent o dead", Code: "INVALID_STATUS"})
+		return
+	}
+	entradas, err := s.db.ListOutbox(ctx, estado, 200)
+	if err != nil {
+		slog.ErrorContext(ctx, "error listando el outbox", logging.ConError(err, "status", estado)...)
+		http.Error(w, "Error listando el outbox", 500)
+		return
+	}
+	if entradas == nil {
+		entradas = []model.OutboxEntry{}
+	}
+	writeJSON(w, http.StatusOK, OutboxResponse{Entries: entradas, Count: len(entradas)})
+}
+
+// RequeueOutbox vuelve a pendiente una entrada muerta del outbox, con los
+// intentos en cero, y despierta al despachador
+func (s *Server) RequeueOutbox(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "id inválido", Code: "INVALID_ID"})
+		return
+	}
+	entrada, err := s.db.RequeueOutbox(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, "error reencolando la entrada del outbox", logging.ConError(err, "outbox_id", id)...)
+		http.Error(w, "Error reencolando la entrada", 500)
+		return
+	}
+	if entrada == nil {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "Entrada muerta no encontrada", Code: "NOT_FOUND"})
+		return
+	}
+	s.despertarOutbox()
+	slog.InfoContext(ctx, "entrada del outbox reencolada", "outbox_id", id, "kind", entrada.Kind)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:   model.AuditoriaSalidaReencolada,
+		EntityID: strconv.FormatInt(id, 10),
+		Detail:   map[string]interface{}{"kind": entrada.Kind, "last_error": entrada.LastError},
+	})
+	writeJSON(w, http.StatusOK, entrada)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/model"
+)
+
+// storeOutbox es un Store que sólo atiende la toma y la actualización de
+// entradas del outbox; lo demás entra en pánico por el Store nil
+type storeOutbox struct {
+	Store
+	tomar       bool
+	actualizada *model.OutboxEntry
+}
+
+func (f *storeOutbox) ClaimOutbox(_ context.Context, entrada *model.OutboxEntry, hasta time.Time) (bool, error) {
+	if !f.tomar {
+		return false, nil
+	}
+	entrada.Attempts++
+	entrada.NextAttemptAt = hasta
+	return true, nil
+}
+
+func (f *storeOutbox) UpdateOutbox(_ context.Context, entrada *model.OutboxEntry) error {
+	copia := *entrada
+	f.actualizada = &copia
+	return nil
+}
+
+type canalPrueba struct {
+	err error
+}
+
+func (c canalPrueba) Nombre() string                              { return "prueba" }
+func (c canalPrueba) Notificar(_ context.Context, _ string) error { return c.err }
+
+func TestDespacharSalida(t *testing.T) {
+	aviso, _ := json.Marshal(datosAvisoSalida{Canal: "prueba", Texto: "venta"})
+	casos := []struct {
+		nombre    string
+		kind      string
+		payload   json.RawMessage
+		intentos  int
+		canal     error
+		tomar     bool
+		estado    string
+		reintenta bool
+	}{
+		{nombre: "enviada", kind: salidaAvisoVenta, payload: aviso, tomar: true, estado: model.SalidaEnviada},
+		{nombre: "falla y se reintenta", kind: salidaAvisoVenta, payload: aviso, canal: errors.New("telegram caído"), tomar: true, estado: model.SalidaPendiente, reintenta: true},
+		{nombre: "agota los intentos", kind: salidaAvisoVenta, payload: aviso, intentos: intentosSalida - 1, canal: errors.New("telegram caído"), tomar: true, estado: model.SalidaMuerta},
+		{nombre: "acción desconocida", kind: "fax", payload: aviso, tomar: true, estado: model.SalidaMuerta},
+		{nombre: "payload inválido", kind: salidaAvisoVenta, payload: json.RawMessage(`"x"`), tomar: true, estado: model.SalidaMuerta},
+		{nombre: "la tomó otra instancia", kind: salidaAvisoVenta, payload: aviso},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			db := &storeOutbox{tomar: c.tomar}
+			s := &Server{cfg: &config.Config{}, db: db, avisos: []Notifier{canalPrueba{err: c.canal}}}
+			antes := time.Now()
+			s.despacharSalida(context.Background(), model.OutboxEntry{ID: 7, Kind: c.kind, Payload: c.payload, Status: model.SalidaPendiente, Attempts: c.intentos})
+
+			if c.estado == "" {
+				if db.actualizada != nil {
+					t.Fatalf("se actualizó una entrada que no se tomó: %+v", db.actualizada)
+				}
+				return
+			}
+			e := db.actualizada
+			if e == nil {
+				t.Fatal("la entrada no se actualizó")
+			}
+			if e.Status != c.estado {
+				t.Errorf("status = %q, se esperaba %q (last_error %q)", e.Status, c.estado, e.LastError)
+			}
+			if e.Attempts != c.intentos+1 {
+				t.Errorf("attempts = %d, se esperaba %d", e.Attempts, c.intentos+1)
+			}
+			if c.estado == model.SalidaEnviada && (e.SentAt == nil || e.LastError != "") {
+				t.Errorf("enviada sin sent_at o con error: %+v", e)
+			}
+			if c.reintenta && e.NextAttemptAt.Sub(antes) < esperaInicialSalida {
+				t.Errorf("next_attempt_at = %v, se esperaba al menos %v después", e.NextAttemptAt, esperaInicialSalida)
+			}
+			if c.estado != model.SalidaEnviada && e.LastError == "" {
+				t.Error("falló sin last_error")
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+// prefijoPayPal va delante del ID de la orden en payment_intent_id, para que
+// reservas, borradores y tickets de PayPal no se confundan con intents de Stripe
+const prefijoPayPal = "paypal_"
+
+func esPagoPayPal(paymentIntentID string) bool {
+	return strings.HasPrefix(paymentIntentID, prefijoPayPal)
+}
+
+// CreatePayPalOrder es CreatePaymentIntent para PayPal: valida la compra con
+// prepararCompraExterna, crea la orden por el monto cotizado y reserva los
+// números bajo el ID de la orden. El frontend manda al comprador a approveUrl
+// (o usa orderId con el SDK de PayPal) y el registro lo hace HandlePayPalWebhook.
+func (s *Server) CreatePayPalOrder(w http.ResponseWriter, r *http.Request) {
+	if s.paypal == nil {
+		responderProveedorDesactivado(w, "PayPal")
+		return
+	}
+	c, ok := s.prepararCompraExterna(w, r, model.ProveedorPayPal)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	// Con el mismo PayPal-Request-Id PayPal devuelve la misma orden
+	orden, err := s.paypal.CreateOrder(ctx, payments.NuevaOrdenPayPal{
+		Monto:       c.monto,
+		Moneda:      c.cotizacion.Currency,
+		Descripcion: c.rifa.Title,
+		CustomID:    c.id,
+	}, c.id)
+	if err != nil {
+		slog.ErrorContext(ctx, "error creando la orden de PayPal", logging.ConError(err, "rifa_id", c.rifa.ID)...)
+		writeJSON(w, http.StatusBadGateway, model.ErrorResponse{
+			Error: "No pudimos crear el pago en PayPal, intenta de nuevo",
+			Code:  "PAYPAL_ERROR",
+		})
+		return
+	}
+	id := prefijoPayPal + orden.ID
+	if !s.guardarCompraExterna(ctx, w, c, id) {
+		return
+	}
+
+	slog.InfoContext(ctx, "orden de PayPal creada", "rifa_id", c.rifa.ID, "payment_intent_id", id, "email", logging.EnmascararEmail(c.req.Email), "amount", c.monto, "currency", c.cotizacion.Currency)
+	writeJSON(w, http.StatusOK, map[string]string{"orderId": orden.ID, "approveUrl": orden.Aprobar})
+}
+
+// HandlePayPalWebhook valida la firma con PayPal y registra los tickets de las
+// órdenes cobradas. CHECKOUT.ORDER.APPROVED captura la orden (el comprador ya
+// aprobó en PayPal) y PAYMENT.CAPTURE.COMPLETED llega cuando el cobro queda
+// hecho; los dos terminan en registrarPagoPayPal, que no repite una orden ya
+// registrada. Un error transitorio responde 500 y PayPal reintenta el webhook.
+func (s *Server) HandlePayPalWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.paypal == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 65536)
+	cuerpo, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.WarnContext(ctx, "error leyendo el webhook de PayPal", logging.ConError(err)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	evento, err := payments.ParsearEventoPayPal(cuerpo)
+	if err != nil {
+		slog.WarnContext(ctx, "webhook de PayPal inválido", logging.ConError(err)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := s.paypal.VerifyWebhook(ctx, r.Header, cuerpo); err != nil {
+		if errors.Is(err, payments.ErrFirmaPayPal) {
+			slog.WarnContext(ctx, "falló la validación del webhook de PayPal", logging.ConError(err, "event_id", evento.ID)...)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// PayPal no pudo verificar ahora; que reintente
+		slog.ErrorContext(ctx, "error verificando el webhook de PayPal", logging.ConError(err, "event_id", evento.ID)...)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	procesado, err := s.eventoProcesado(ctx, evento.ID)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo verificar el evento", logging.ConError(err, "event_id", evento.ID, "event_type", evento.Tipo)...)
+	}
+	if procesado {
+		slog.InfoContext(ctx, "event already processed", "event_id", evento.ID, "event_type", evento.Tipo)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := s.procesarEventoPayPal(ctx, evento); err != nil {
+		slog.ErrorContext(ctx, "error procesando el webhook de PayPal", logging.ConError(err, "event_id", evento.ID, "event_type", evento.Tipo, "order_id", evento.OrderID)...)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := s.marcarEventoProcesado(ctx, evento.ID, evento.Tipo); err != nil {
+		// Un reintento no registra dos veces: registrarPagoPayPal lo detecta
+		slog.WarnContext(ctx, "no se pudo marcar el evento como procesado", logging.ConError(err, "event_id", evento.ID)...)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) procesarEventoPayPal(ctx context.Context, evento *payments.EventoPayPal) error {
+	switch evento.Tipo {
+	case "CHECKOUT.ORDER.APPROVED":
+		orden, err := s.paypal.CaptureOrder(ctx, evento.OrderID, "capture-"+evento.OrderID)
+		if err != nil {
+			return fmt.Errorf("captura: %w", err)
+		}
+		if orden.Captura == nil || orden.Captura.Status != payments.CapturaPayPalCompletada {
+			// PENDING (p. ej. revisión de PayPal): se registra con PAYMENT.CAPTURE.COMPLETED
+			slog.InfoContext(ctx, "captura de PayPal pendiente", "order_id", orden.ID, "status", orden.Status)
+			return nil
+		}
+		return s.registrarPagoPayPal(ctx, orden.ID, orden.Captura)
+
+	case "PAYMENT.CAPTURE.COMPLETED":
+		return s.registrarPagoPayPal(ctx, evento.OrderID, evento.Captura)
+
+	case "PAYMENT.CAPTURE.DENIED":
+		id := prefijoPayPal + evento.OrderID
+		if err := s.db.ReleaseReservations(ctx, id); err != nil {
+			return err
+		}
+		if err := s.db.ReleasePromoRedemption(ctx, id); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "reservas liberadas", "payment_intent_id", id, "event_type", evento.Tipo)
+	}
+	return nil
+}
+
+// registrarPagoPayPal registra la captura con registrarCobroExterno; si hay
+// que devolverla, una captura ya devuelta (un reintento del webhook) no es un error
+func (s *Server) registrarPagoPayPal(ctx context.Context, orderID string, captura *payments.CapturaPayPal) error {
+	return s.registrarCobroExterno(ctx, cobroExterno{
+		PaymentID:  prefijoPayPal + orderID,
+		Proveedor:  model.ProveedorPayPal,
+		Referencia: captura.ID,
+		Monto:      captura.Monto,
+		Moneda:     captura.Moneda,
+		Pagado:     captura.Creada,
+		reembolsar: func(ctx context.Context) error {
+			err := s.paypal.RefundCapture(ctx, captura.ID, "refund-registro-"+captura.ID)
+			var errPayPal *payments.ErrPayPal
+			if errors.As(err, &errPayPal) && errPayPal.Issue == "CAPTURE_FULLY_REFUNDED" {
+				return nil
+			}
+			return err
+		},
+	})
+}
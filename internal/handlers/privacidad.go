@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// PrivacyDeleteRequest es el cuerpo de POST /admin/privacy/delete: el usuario
+// por su ID, su email o los dos
+type PrivacyDeleteRequest struct {
+	UserID string `json:"userId,omitempty"`
+	Email  string `json:"email,omitempty"`
+}
+
+// TicketAnonimizado es un ticket que pasó al perfil tombstone
+type TicketAnonimizado struct {
+	RifaID string `json:"rifaId"`
+	Number int    `json:"number"`
+}
+
+// DatosAnonimizados son las filas que se conservan sin el usuario
+type DatosAnonimizados struct {
+	Tickets []TicketAnonimizado `json:"tickets"`
+	Draws   int                 `json:"draws"`
+}
+
+// DatosEliminados son las filas borradas, por tabla
+type DatosEliminados struct {
+	PurchaseDrafts      int `json:"purchaseDrafts"`
+	GiftRecipients      int `json:"giftRecipients"`
+	EmailFailures       int `json:"emailFailures"`
+	Waitlist            int `json:"waitlist"`
+	EmailEvents         int `json:"emailEvents"`
+	UndeliverableEmails int `json:"undeliverableEmails"`
+	DrawNotifications   int `json:"drawNotifications"`
+	Outbox              int `json:"outbox"`
+}
+
+// DatoConservado es un dato del usuario que el servicio no borra, con el motivo
+type DatoConservado struct {
+	Data   string `json:"data"`
+	Reason string `json:"reason"`
+}
+
+// DatosStripe son los intents de Stripe del usuario: Stripe guarda el
+// receipt_email y no hay forma de quitarlo desde la API del intent
+type DatosStripe struct {
+	PaymentIntents []string `json:"paymentIntents"`
+	Note           string   `json:"note"`
+}
+
+// PrivacyDeleteResponse es el manifiesto de POST /admin/privacy/delete
+type PrivacyDeleteResponse struct {
+	UserID      string            `json:"userId,omitempty"`
+	TombstoneID string            `json:"tombstoneId"`
+	Anonymized  DatosAnonimizados `json:"anonymized"`
+	Removed     DatosEliminados   `json:"removed"`
+	Retained    []DatoConservado  `json:"retained"`
+	Stripe      DatosStripe       `json:"stripe"`
+}
+
+// datosConservados es lo que un pedido de supresión deja en su lugar
+var datosConservados = []DatoConservado{
+	{"profiles / auth.users", "la cuenta se borra en Supabase Auth, después de este pedido"},
+	{"receipts", "los recibos emitidos son registro contable"},
+	{"blocked_buyers", "el bloqueo por fraude o disputa se mantiene"},
+	{"audit_log", "es de sólo inserts: los correos enviados y los bloqueos quedan con el email en detail"},
+	{"ticket_reservation", "las reservas vencen solas y el barrido las borra"},
+}
+
+const notaStripe = "Stripe conserva el receipt_email y los datos de pago de estos intents, y la API no permite quitarlos de un intent pagado: la supresión se le pide a Stripe con esta lista"
+
+// DeletePersonalData atiende un pedido de supresión de datos (derecho al
+// olvido): sus tickets pasan al perfil PRIVACY_TOMBSTONE_PROFILE_ID, que
+// conserva número, rifa y pago para que los sorteos sigan verificables, y se
+// borran sus borradores de compra, correos fallidos, lista de espera, eventos y
+// rebotes de correo. Responde el manifiesto de lo que se tocó y de lo que
+// queda, incluidos los intents de Stripe. Un checkout en curso del usuario ya
+// no podrá registrar sus tickets: se pide después de que no tenga pagos abiertos.
+func (s *Server) DeletePersonalData(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tombstone := s.cfg.PrivacyTombstoneProfileID
+	if tombstone == "" {
+		writeJSON(w, http.StatusServiceUnavailable, model.ErrorResponse{
+			Error: "PRIVACY_TOMBSTONE_PROFILE_ID no está configurado",
+			Code:  "PRIVACY_DISABLED",
+		})
+		return
+	}
+	var req PrivacyDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+	req.UserID = strings.TrimSpace(req.UserID)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.UserID == "" && req.Email == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta userId o email", Code: "TARGET_REQUIRED"})
+		return
+	}
+	if req.Email != "" && !emailValido(req.Email) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El email no es válido", Code: "INVALID_EMAIL"})
+		return
+	}
+	if req.UserID == tombstone {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Ese es el perfil tombstone", Code: "INVALID_TARGET"})
+		return
+	}
+
+	// Con userId el email sale del perfil; con sólo email puede ser un invitado
+	userID, email := req.UserID, req.Email
+	perfil, err := s.db.GetProfile(ctx, req.UserID, req.Email)
+	switch {
+	case errors.Is(err, model.ErrPerfilNoEncontrado):
+		if req.UserID != "" {
+			writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "No hay cuenta con ese userId", Code: "PROFILE_NOT_FOUND"})
+			return
+		}
+	case err != nil:
+		slog.ErrorContext(ctx, "error buscando el perfil a suprimir", logging.ConError(err, "user_id", req.UserID)...)
+		http.Error(w, "Error consultando perfiles", 500)
+		return
+	default:
+		if req.UserID != "" && req.Email != "" && !strings.EqualFold(perfil.Email, req.Email) {
+			// Mejor frenar que borrar los datos de otra persona por un error de tipeo
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El email no es el de esa cuenta", Code: "IDENTITY_MISMATCH"})
+			return
+		}
+		if perfil.ID == tombstone {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Ese es el perfil tombstone", Code: "INVALID_TARGET"})
+			return
+		}
+		userID, email = perfil.ID, strings.ToLower(perfil.Email)
+	}
+
+	borrados, err := s.db.EraseUserData(ctx, userID, email, tombstone)
+	respuesta := manifiestoBorrado(userID, tombstone, borrados)
+	if err != nil {
+		slog.ErrorContext(ctx, "supresión de datos incompleta", logging.ConError(err, "user_id", userID, "email", logging.EnmascararEmail(email))...)
+		writeJSON(w, http.StatusInternalServerError, model.ErrorResponse{
+			Error:   "La supresión quedó a medias; repite el pedido para terminarla",
+			Code:    "ERASURE_INCOMPLETE",
+			Details: respuesta,
+		})
+		return
+	}
+
+	slog.InfoContext(ctx, "datos personales suprimidos", "user_id", userID, "email", logging.EnmascararEmail(email), "tickets", len(borrados.Tickets), "borradores", borrados.Borradores)
+	// Sin user_id ni email: la entrada de auditoría no puede volver a identificarlo
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:   model.AuditoriaDatosBorrados,
+		EntityID: tombstone,
+		Detail: map[string]interface{}{
+			"tickets":         len(borrados.Tickets),
+			"draws":           borrados.Sorteos,
+			"purchase_drafts": borrados.Borradores,
+			"email_failures":  borrados.FallosCorreo,
+			"waitlist":        borrados.Espera,
+		},
+	})
+	writeJSON(w, http.StatusOK, respuesta)
+}
+
+// manifiestoBorrado arma la respuesta con lo que hizo EraseUserData, que puede
+// ser parcial
+func manifiestoBorrado(userID string, tombstone string, borrados *model.DatosBorrados) PrivacyDeleteResponse {
+	respuesta := PrivacyDeleteResponse{
+		UserID:      userID,
+		TombstoneID: tombstone,
+		Anonymized:  DatosAnonimizados{Tickets: []TicketAnonimizado{}},
+		Retained:    datosConservados,
+		Stripe:      DatosStripe{PaymentIntents: []string{}, Note: notaStripe},
+	}
+	if borrados == nil {
+		return respuesta
+	}
+	intents := slices.Clone(borrados.PaymentIntentIDs)
+	for _, t := range borrados.Tickets {
+		respuesta.Anonymized.Tickets = append(respuesta.Anonymized.Tickets, TicketAnonimizado{RifaID: t.RifaID, Number: t.Number})
+		intents = append(intents, t.PaymentIntentID)
+	}
+	respuesta.Anonymized.Draws = borrados.Sorteos
+	respuesta.Removed = DatosEliminados{
+		PurchaseDrafts:      borrados.Borradores,
+		GiftRecipients:      borrados.Regalos,
+		EmailFailures:       borrados.FallosCorreo,
+		Waitlist:            borrados.Espera,
+		EmailEvents:         borrados.EventosCorreo,
+		UndeliverableEmails: borrados.Rebotes,
+		DrawNotifications:   borrados.NotificacionesSorteo,
+		Outbox:              borrados.Salidas,
+	}
+	// Sólo los de Stripe: PayPal, MercadoPago, las gratis y las manuales no
+	// tienen receipt_email en Stripe
+	slices.Sort(intents)
+	for _, id := range slices.Compact(intents) {
+		if strings.HasPrefix(id, "pi_") {
+			respuesta.Stripe.PaymentIntents = append(respuesta.Stripe.PaymentIntents, id)
+		}
+	}
+	return respuesta
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+const (
+	// maxObsoletoProgreso es cuánto después de vencer PROGRESS_CACHE_TTL se
+	// sigue sirviendo el progreso viejo mientras se recalcula; pasado eso se
+	// calcula en la petición
+	maxObsoletoProgreso = time.Minute
+	// maxEntradasProgreso limita el cache como maxEntradasBloqueos
+	maxEntradasProgreso = 10000
+	plazoProgreso       = 5 * time.Second
+)
+
+// ProgresoRifa es la respuesta de GET /rifas/{id}/progress
+type ProgresoRifa struct {
+	TotalNumbers int     `json:"totalNumbers"`
+	Sold         int     `json:"sold"`
+	Reserved     int     `json:"reserved"`
+	PercentSold  float64 `json:"percentSold"`
+	SoldOut      bool    `json:"soldOut"`
+}
+
+// cacheProgreso guarda el progreso de cada rifa. Vencido el ttl lo sigue
+// entregando hasta maxObsoletoProgreso, pero a la primera petición le pide
+// recalcularlo; las demás reciben el viejo sin sumar otro recálculo.
+type cacheProgreso struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[string]*entradaProgreso
+}
+
+type entradaProgreso struct {
+	progreso    ProgresoRifa
+	calculado   time.Time
+	refrescando bool
+}
+
+func nuevoCacheProgreso(ttl time.Duration) *cacheProgreso {
+	return &cacheProgreso{ttl: ttl, items: make(map[string]*entradaProgreso)}
+}
+
+// obtener devuelve el progreso guardado, si todavía se puede servir, y si
+// quien lo pidió tiene que recalcularlo
+func (c *cacheProgreso) obtener(id string, ahora time.Time) (progreso ProgresoRifa, ok bool, refrescar bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return ProgresoRifa{}, false, false
+	}
+	edad := ahora.Sub(e.calculado)
+	if edad >= c.ttl+maxObsoletoProgreso {
+		return ProgresoRifa{}, false, false
+	}
+	if edad >= c.ttl && !e.refrescando {
+		e.refrescando = true
+		refrescar = true
+	}
+	return e.progreso, true, refrescar
+}
+
+func (c *cacheProgreso) guardar(id string, progreso ProgresoRifa, ahora time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[id]; !ok && len(c.items) >= maxEntradasProgreso {
+		c.items = make(map[string]*entradaProgreso)
+	}
+	c.items[id] = &entradaProgreso{progreso: progreso, calculado: ahora}
+}
+
+// soltar deja que otra petición vuelva a intentar el recálculo que falló
+func (c *cacheProgreso) soltar(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[id]; ok {
+		e.refrescando = false
+	}
+}
+
+// GetProgresoRifa devuelve cuánto de la rifa está vendido, para la barra de
+// progreso de la landing. Se pide en cada visita, así que sale del cache de
+// progreso y, vencido, se sirve el anterior mientras se recalcula en segundo
+// plano. Va con EnablePublicCORS: otros sitios pueden mostrarla.
+func (s *Server) GetProgresoRifa(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+
+	progreso, ok, refrescar := s.progreso.obtener(rifaID, time.Now())
+	if refrescar {
+		enSegundoPlano(ctx, func(ctx context.Context) {
+			ctx, cancel := context.WithTimeout(ctx, plazoProgreso)
+			defer cancel()
+			if err := s.refrescarProgreso(ctx, rifaID); err != nil {
+				s.progreso.soltar(rifaID)
+				slog.WarnContext(ctx, "no se pudo recalcular el progreso de la rifa", logging.ConError(err, "rifa_id", rifaID)...)
+			}
+		})
+	}
+	if !ok {
+		rifa, err := s.rifa(ctx, rifaID)
+		if err != nil {
+			responderErrorRifa(ctx, w, rifaID, err)
+			return
+		}
+		calculado, err := s.calcularProgreso(ctx, rifa)
+		if err != nil {
+			slog.ErrorContext(ctx, "error calculando el progreso de la rifa", logging.ConError(err, "rifa_id", rifaID)...)
+			if responderCircuitoAbierto(w, err) {
+				return
+			}
+			http.Error(w, "Error consultando números", 500)
+			return
+		}
+		progreso = *calculado
+	}
+
+	segundos := int(s.cfg.ProgressCacheTTL.Seconds())
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", segundos, int(maxObsoletoProgreso.Seconds())))
+	writeJSON(w, http.StatusOK, progreso)
+}
+
+func (s *Server) refrescarProgreso(ctx context.Context, rifaID string) error {
+	rifa, err := s.rifa(ctx, rifaID)
+	if err != nil {
+		return err
+	}
+	_, err = s.calcularProgreso(ctx, rifa)
+	return err
+}
+
+// calcularProgreso cuenta vendidos y reservados como estadoNumeros y deja el
+// resultado en el cache
+func (s *Server) calcularProgreso(ctx context.Context, rifa *model.Rifa) (*ProgresoRifa, error) {
+	estado, err := s.estadoNumeros(ctx, rifa)
+	if err != nil {
+		return nil, err
+	}
+	progreso := &ProgresoRifa{
+		TotalNumbers: rifa.TotalNumbers,
+		Sold:         len(estado.Sold),
+		Reserved:     len(estado.Reserved),
+	}
+	if rifa.TotalNumbers > 0 {
+		progreso.PercentSold = math.Round(float64(progreso.Sold)*10000/float64(rifa.TotalNumbers)) / 100
+		progreso.SoldOut = progreso.Sold >= rifa.TotalNumbers
+	}
+	s.progreso.guardar(rifa.ID, *progreso, time.Now())
+	return progreso, nil
+}
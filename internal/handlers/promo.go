@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+func normalizarCodigo(codigo string) string {
+	return strings.ToUpper(strings.TrimSpace(codigo))
+}
+
+// motivoCodigoInvalido devuelve por qué el código no se puede usar en una
+// compra de las rifas dadas, o "" si se puede. Los canjes pendientes cuentan
+// para max_redemptions mientras su reserva esté vigente.
+func (s *Server) motivoCodigoInvalido(ctx context.Context, codigo *model.CodigoPromo, rifaIDs []string, ahora time.Time) (string, error) {
+	// expires_at es timestamptz, igual que draw_date
+	if vence, ok := fechaSorteo(codigo.ExpiresAt); ok && !ahora.Before(vence) {
+		return "expired", nil
+	}
+	if codigo.RifaID != "" && !slices.Contains(rifaIDs, codigo.RifaID) {
+		return "wrong_rifa", nil
+	}
+	if codigo.PercentOff <= 0 && codigo.AmountOff <= 0 {
+		return "no_discount", nil
+	}
+	if codigo.MaxRedemptions > 0 {
+		usados, err := s.db.CountPromoRedemptions(ctx, codigo.Code)
+		if err != nil {
+			return "", err
+		}
+		if usados >= codigo.MaxRedemptions {
+			return "exhausted", nil
+		}
+	}
+	return "", nil
+}
+
+// cargarCodigoPromo valida el código para la compra y responde 422
+// PROMO_INVALID si no existe, venció, se agotó o es de otra rifa. Dos compras
+// simultáneas pueden usar el último canje disponible. Devuelve false si ya
+// respondió con un error.
+func (s *Server) cargarCodigoPromo(ctx context.Context, w http.ResponseWriter, codigo string, rifaIDs []string) (*model.CodigoPromo, bool) {
+	promo, err := s.db.GetPromoCode(ctx, codigo)
+	motivo := ""
+	if errors.Is(err, model.ErrCodigoNoEncontrado) {
+		motivo, err = "not_found", nil
+	} else if err == nil {
+		motivo, err = s.motivoCodigoInvalido(ctx, promo, rifaIDs, time.Now())
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error validando código promocional", logging.ConError(err, "code", codigo)...)
+		http.Error(w, "Error validando el código", 500)
+		return nil, false
+	}
+	if motivo != "" {
+		slog.InfoContext(ctx, "código promocional rechazado", "code", codigo, "reason", motivo)
+		writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Error:   "El código promocional no es válido",
+			Code:    "PROMO_INVALID",
+			Details: map[string]string{"reason": motivo},
+		})
+		return nil, false
+	}
+	return promo, true
+}
+
+// descuentoCodigo es lo que el código descuenta de monto, sin pasarse del
+// monto. El porcentaje se redondea hacia abajo.
+func descuentoCodigo(codigo *model.CodigoPromo, monto int64) int64 {
+	var descuento int64
+	if codigo.PercentOff > 0 {
+		descuento = monto / 100 * int64(codigo.PercentOff)
+		descuento += monto % 100 * int64(codigo.PercentOff) / 100
+	} else {
+		descuento = codigo.AmountOff
+	}
+	return min(descuento, monto)
+}
+
+// aplicarCodigoCarrito descuenta el código de los items y devuelve el total
+// descontado. Un código de una rifa sólo toca ese item; uno general se reparte
+// en proporción al monto de cada item, así el amount_paid de los tickets suma
+// lo cobrado.
+func aplicarCodigoCarrito(codigo *model.CodigoPromo, items []model.ItemCompra) int64 {
+	if codigo.RifaID != "" {
+		for i := range items {
+			if items[i].RifaID == codigo.RifaID {
+				descuento := descuentoCodigo(codigo, items[i].Amount)
+				items[i].Amount -= descuento
+				return descuento
+			}
+		}
+		return 0
+	}
+
+	var subtotal int64
+	for _, item := range items {
+		subtotal += item.Amount
+	}
+	descuento := descuentoCodigo(codigo, subtotal)
+	if subtotal == 0 {
+		return 0
+	}
+	restante := descuento
+	for i := range items {
+		parte := int64(float64(descuento) * float64(items[i].Amount) / float64(subtotal))
+		parte = min(parte, restante, items[i].Amount)
+		items[i].Amount -= parte
+		restante -= parte
+	}
+	// El redondeo deja unos centavos que van a los primeros items con saldo
+	for i := range items {
+		parte := min(restante, items[i].Amount)
+		items[i].Amount -= parte
+		restante -= parte
+	}
+	return descuento
+}
+
+// reservarCanje deja pendiente el canje del código para el intent; el webhook
+// lo confirma cuando se paga o lo libera si el pago falla
+func (s *Server) reservarCanje(ctx context.Context, codigo string, paymentIntentID string) error {
+	return s.db.RecordPromoRedemption(ctx, codigo, paymentIntentID, time.Now().UTC().Add(s.cfg.ReservationTTL))
+}
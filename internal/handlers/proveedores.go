@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+// proveedorPermitido dice si la columna providers de la rifa acepta el proveedor
+func proveedorPermitido(rifa *model.Rifa, proveedor string) bool {
+	if len(rifa.Providers) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(rifa.Providers, func(p string) bool { return strings.EqualFold(strings.TrimSpace(p), proveedor) })
+}
+
+// verificarProveedor responde 400 PROVIDER_NOT_ALLOWED si la rifa no se cobra
+// con el proveedor del endpoint. Devuelve false si ya respondió con un error.
+func verificarProveedor(ctx context.Context, w http.ResponseWriter, rifa *model.Rifa, proveedor string) bool {
+	if proveedorPermitido(rifa, proveedor) {
+		return true
+	}
+	slog.InfoContext(ctx, "proveedor no habilitado en la rifa", "rifa_id", rifa.ID, "provider", proveedor, "providers", rifa.Providers)
+	writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+		Error:   "Esta rifa no acepta este medio de pago",
+		Code:    "PROVIDER_NOT_ALLOWED",
+		Details: map[string]interface{}{"providers": rifa.Providers},
+	})
+	return false
+}
+
+// proveedoresRifa son los proveedores configurados que la rifa acepta;
+// MercadoPago sólo si opera la moneda de la rifa
+func (s *Server) proveedoresRifa(rifa *model.Rifa) []string {
+	configurados := []string{model.ProveedorStripe}
+	if s.paypal != nil {
+		configurados = append(configurados, model.ProveedorPayPal)
+	}
+	if s.mercadopago != nil && payments.MonedaMercadoPago(rifa.Currency) {
+		configurados = append(configurados, model.ProveedorMercadoPago)
+	}
+	proveedores := []string{}
+	for _, p := range configurados {
+		if proveedorPermitido(rifa, p) {
+			proveedores = append(proveedores, p)
+		}
+	}
+	return proveedores
+}
+
+// responderProveedorDesactivado responde 503 cuando faltan las credenciales del proveedor
+func responderProveedorDesactivado(w http.ResponseWriter, proveedor string) {
+	writeJSON(w, http.StatusServiceUnavailable, model.ErrorResponse{
+		Error: proveedor + " no está disponible",
+		Code:  "PROVIDER_DISABLED",
+	})
+}
+
+// compraExterna es una compra ya validada para cobrarla fuera de Stripe
+type compraExterna struct {
+	proveedor  string
+	req        model.PaymentRequest
+	rifa       *model.Rifa
+	cotizacion *Cotizacion
+	monto      int64
+	descuento  int64
+	// id sale de la Idempotency-Key, separada por proveedor para que cambiar
+	// de medio de pago no reuse el borrador
+	id string
+}
+
+// prepararCompraExterna hace las validaciones de CreatePaymentIntent para un
+// proveedor que no es Stripe. Sólo admite números elegidos de una rifa: los
+// carritos, los regalos, la compra al azar y las cuotas siguen siendo de Stripe.
+// Devuelve false si ya respondió con un error.
+func (s *Server) prepararCompraExterna(w http.ResponseWriter, r *http.Request, proveedor string) (*compraExterna, bool) {
+	var req model.PaymentRequest
+	if !decodificarJSON(w, r, &req) {
+		return nil, false
+	}
+	if !s.validarIDsCompra(w, &req) {
+		return nil, false
+	}
+	req.PromoCode = normalizarCodigo(req.PromoCode)
+	if len(req.Items) > 0 || req.RecipientEmail != "" || (len(req.Numeros) == 0 && req.Cantidad > 0) || req.Installments > 1 {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error: "Con este medio de pago sólo se pueden comprar números elegidos de una rifa",
+			Code:  "PROVIDER_UNSUPPORTED",
+		})
+		return nil, false
+	}
+	if !s.validarCantidad(w, &req) {
+		return nil, false
+	}
+
+	ctx := r.Context()
+	rifa, err := s.rifa(ctx, req.RifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, req.RifaID, err)
+		return nil, false
+	}
+	if !s.verificarRifaAbierta(ctx, w, rifa) {
+		return nil, false
+	}
+	if !verificarProveedor(ctx, w, rifa, proveedor) {
+		return nil, false
+	}
+	if !s.identificarComprador(w, r, &req, rifa) {
+		return nil, false
+	}
+	if !s.verificarCompradorNoBloqueado(ctx, w, &req) {
+		return nil, false
+	}
+	if !s.verificarEmailComprador(ctx, w, &req) {
+		return nil, false
+	}
+	if !s.validarReferido(ctx, w, &req) {
+		return nil, false
+	}
+
+	cotizacion, ok := s.cotizar(ctx, w, rifa, len(req.Numeros))
+	if !ok {
+		return nil, false
+	}
+	compra := &compraExterna{proveedor: proveedor, rifa: rifa, cotizacion: cotizacion, monto: cotizacion.Amount}
+	if req.PromoCode != "" {
+		codigo, ok := s.cargarCodigoPromo(ctx, w, req.PromoCode, []string{rifa.ID})
+		if !ok {
+			return nil, false
+		}
+		compra.descuento = descuentoCodigo(codigo, compra.monto)
+		compra.monto -= compra.descuento
+	}
+	if compra.monto == 0 {
+		// Una compra gratis no tiene nada que cobrar
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error: "La compra es gratis: usa /payments/create-intent",
+			Code:  "FREE_PURCHASE",
+		})
+		return nil, false
+	}
+	if !validarNumerosSeleccionados(ctx, w, rifa, req.Numeros) {
+		return nil, false
+	}
+	if !s.verificarLimitePorUsuario(ctx, w, rifa, &req) {
+		return nil, false
+	}
+
+	ocupados, err := s.db.CheckNumbers(ctx, rifa.ID, req.Numeros)
+	if err != nil {
+		slog.ErrorContext(ctx, "error validando números", logging.ConError(err, "rifa_id", rifa.ID)...)
+		responderDisponibilidadNoVerificada(w, err)
+		return nil, false
+	}
+	if len(ocupados) > 0 {
+		slog.InfoContext(ctx, "números ocupados", "rifa_id", rifa.ID, "numeros", ocupados)
+		responderNumerosOcupados(w, ocupados)
+		return nil, false
+	}
+
+	compra.req = req
+	compra.id = uuidDesdeClave(proveedor + "|" + claveIdempotenciaCompra(r.Header.Get("Idempotency-Key"), &req))
+	return compra, true
+}
+
+// guardarCompraExterna reserva los números y el canje bajo paymentID y guarda
+// el borrador que después lee el webhook del proveedor. El cobro del lado del
+// proveedor vence solo, así que si algo falla basta con liberar lo reservado.
+// Devuelve false si ya respondió con un error.
+func (s *Server) guardarCompraExterna(ctx context.Context, w http.ResponseWriter, c *compraExterna, paymentID string) bool {
+	rifa, req := c.rifa, &c.req
+	if err := s.reservarNumeros(ctx, rifa.ID, req.Numeros, req.UserId, paymentID); err != nil {
+		var conflicto *model.ErrNumerosOcupados
+		if errors.As(err, &conflicto) {
+			slog.InfoContext(ctx, "conflicto reservando números", "rifa_id", rifa.ID, "payment_intent_id", paymentID, "numeros", conflicto.Numeros)
+			responderNumerosOcupados(w, conflicto.Numeros)
+			return false
+		}
+		if errors.Is(err, model.ErrDisponibilidadNoVerificada) {
+			slog.ErrorContext(ctx, "error verificando conflicto de reserva", logging.ConError(err, "rifa_id", rifa.ID, "payment_intent_id", paymentID)...)
+			responderDisponibilidadNoVerificada(w, err)
+			return false
+		}
+		slog.ErrorContext(ctx, "error reservando números", logging.ConError(err, "rifa_id", rifa.ID, "payment_intent_id", paymentID)...)
+		http.Error(w, "Error reservando números", 500)
+		return false
+	}
+	if !s.reservarCanjeOCancelar(ctx, w, req.PromoCode, paymentID) {
+		return false
+	}
+
+	compra := &model.PurchaseDraft{
+		ID:              c.id,
+		PaymentIntentID: paymentID,
+		RifaID:          rifa.ID,
+		RifaTitle:       rifa.Title,
+		Numeros:         req.Numeros,
+		UserID:          req.UserId,
+		Email:           req.Email,
+		Amount:          c.monto,
+		ExpiresAt:       time.Now().UTC().Add(s.cfg.ReservationTTL).Format(time.RFC3339),
+		PromoCode:       req.PromoCode,
+		Discount:        c.descuento,
+		ReferralCode:    req.ReferralCode,
+		TierMinQty:      c.cotizacion.tramoMinimo(),
+		UnitPrice:       c.cotizacion.PricePerNumber,
+		Locale:          mail.ElegirIdioma(req.Locale),
+	}
+	if err := s.db.SavePurchaseDraft(ctx, compra); err != nil {
+		slog.ErrorContext(ctx, "error guardando la compra", logging.ConError(err, "rifa_id", rifa.ID, "payment_intent_id", paymentID)...)
+		s.deshacerIntent(ctx, paymentID)
+		http.Error(w, "Error guardando la compra", 500)
+		return false
+	}
+	s.auditarIntentCreado(ctx, compra, c.proveedor, c.cotizacion.Currency)
+	return true
+}
+
+// cobroExterno es un pago confirmado por PayPal o MercadoPago. PaymentID es el
+// payment_intent_id con prefijo del borrador y Referencia el ID del cobro en
+// el proveedor (la captura o el pago), el que se devuelve con reembolsar.
+type cobroExterno struct {
+	PaymentID  string
+	Proveedor  string
+	Referencia string
+	Monto      int64
+	Moneda     string
+	Pagado     time.Time
+	reembolsar func(ctx context.Context) error
+}
+
+// registrarCobroExterno hace con un cobro de otro proveedor lo que el webhook
+// de Stripe hace con payment_intent.succeeded: revisa max_per_user, registra
+// los tickets con su payment_provider, confirma el canje y manda los correos.
+// Si los números ya no se pueden registrar devuelve el cobro. Un cobro cuyo
+// borrador no existe o que ya tiene tickets no es un error: los proveedores
+// avisan varias veces del mismo pago.
+func (s *Server) registrarCobroExterno(ctx context.Context, cobro cobroExterno) error {
+	id := cobro.PaymentID
+	compra, err := s.db.GetPurchaseDraft(ctx, id)
+	if errors.Is(err, model.ErrCompraNoEncontrada) {
+		// No es un cobro de este servicio (la cuenta del proveedor se comparte)
+		slog.WarnContext(ctx, "cobro sin borrador", "payment_intent_id", id, "provider", cobro.Proveedor, "referencia", cobro.Referencia)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	registrados, err := s.db.PaymentIntentTickets(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(registrados) > 0 {
+		slog.InfoContext(ctx, "cobro ya registrado", "payment_intent_id", id, "provider", cobro.Proveedor, "referencia", cobro.Referencia)
+		return nil
+	}
+	if cobro.Monto != compra.Amount {
+		slog.ErrorContext(ctx, "el monto cobrado no coincide con la compra", "payment_intent_id", id, "provider", cobro.Proveedor, "amount", cobro.Monto, "esperado", compra.Amount)
+	}
+
+	var items []model.ItemCompra
+	err = s.verificarLimiteEnWebhook(ctx, compra)
+	if err == nil {
+		pagado := cobro.Pagado
+		if pagado.IsZero() {
+			pagado = time.Now()
+		}
+		items, err = s.registrarTickets(ctx, compra, model.PagoTickets{
+			PaymentIntentID: id,
+			Amount:          cobro.Monto,
+			Currency:        cobro.Moneda,
+			PaidAt:          pagado,
+			Provider:        cobro.Proveedor,
+		})
+	}
+	if err != nil {
+		if errors.Is(err, ErrLimitePorUsuario) || esFalloPermanente(err) {
+			slog.ErrorContext(ctx, "registro imposible, reembolsando", logging.ConError(err, "rifa_id", compra.RifaID, "payment_intent_id", id, "provider", cobro.Proveedor)...)
+			return s.compensarCobroExterno(ctx, compra, cobro, err)
+		}
+		return fmt.Errorf("registro de tickets: %w", err)
+	}
+
+	if compra.PromoCode != "" {
+		if err := s.db.RedeemPromoCode(ctx, compra.PromoCode, id); err != nil {
+			return fmt.Errorf("canje del código: %w", err)
+		}
+	}
+	if err := s.acreditarReferido(ctx, compra, cobro.Monto, cobro.Moneda); err != nil {
+		return fmt.Errorf("comisión de referido: %w", err)
+	}
+	slog.InfoContext(ctx, "cobro registrado", "rifa_id", compra.RifaID, "payment_intent_id", id, "provider", cobro.Proveedor, "referencia", cobro.Referencia)
+	if err := s.enviarCorreosCompra(ctx, compra, items, cobro.Monto, stripe.Currency(cobro.Moneda)); err != nil {
+		return err
+	}
+	return s.avisarVenta(ctx, compra, items, cobro.Monto, stripe.Currency(cobro.Moneda))
+}
+
+// compensarCobroExterno devuelve el cobro y sigue como compensarRegistroFallido
+func (s *Server) compensarCobroExterno(ctx context.Context, compra *model.PurchaseDraft, cobro cobroExterno, causa error) error {
+	if err := cobro.reembolsar(ctx); err != nil {
+		return fmt.Errorf("reembolso: %w", err)
+	}
+	slog.InfoContext(ctx, "cobro reembolsado", "payment_intent_id", cobro.PaymentID, "provider", cobro.Proveedor, "referencia", cobro.Referencia)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaReembolso,
+		RifaID:          compra.RifaID,
+		PaymentIntentID: cobro.PaymentID,
+		EntityID:        cobro.Referencia,
+		Detail:          map[string]interface{}{"amount": cobro.Monto, "currency": cobro.Moneda, "reason": "registro_fallido", "provider": cobro.Proveedor},
+	})
+
+	fallo := falloRegistro(cobro.PaymentID, compra, cobro.Monto, causa)
+	fallo["metadata"] = map[string]string{"provider": cobro.Proveedor, "referencia": cobro.Referencia}
+	return s.deshacerRegistro(ctx, cobro.PaymentID, compra, fallo, causa)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// QuoteResponse es la respuesta de POST /payments/quote
+type QuoteResponse struct {
+	Cotizacion
+	UnavailableNumbers []int `json:"unavailableNumbers"`
+	// Providers son los medios de pago con que se puede comprar la rifa
+	Providers []string `json:"providers"`
+}
+
+// QuotePayment calcula el total de la selección sin tocar Stripe, para que el
+// checkout lo muestre antes de crear el intent. Recibe el mismo cuerpo que
+// create-intent; los números ocupados se listan en vez de responder 409 para
+// que el frontend los marque.
+func (s *Server) QuotePayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.PaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.WarnContext(r.Context(), "error decodificando JSON", logging.ConError(err)...)
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+	if !s.validarIDsCompra(w, &req) {
+		return
+	}
+	if !s.validarCantidad(w, &req) {
+		return
+	}
+
+	ctx := r.Context()
+	rifa, err := s.rifa(ctx, req.RifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, req.RifaID, err)
+		return
+	}
+	if !s.verificarRifaAbierta(ctx, w, rifa) {
+		return
+	}
+	if !validarNumerosSeleccionados(ctx, w, rifa, req.Numeros) {
+		return
+	}
+
+	cotizacion, ok := s.cotizar(ctx, w, rifa, cantidadSolicitada(&req))
+	if !ok {
+		return
+	}
+
+	// En una compra al azar no hay números que marcar
+	ocupados := []int{}
+	if len(req.Numeros) > 0 {
+		if ocupados, err = s.db.CheckNumbers(ctx, req.RifaID, req.Numeros); err != nil {
+			slog.ErrorContext(ctx, "error validando números", logging.ConError(err, "rifa_id", req.RifaID)...)
+			responderDisponibilidadNoVerificada(w, err)
+			return
+		}
+		if ocupados == nil {
+			ocupados = []int{}
+		}
+	}
+
+	// Mismo TTL que GET /rifas/{id}/numeros
+	w.Header().Set("Cache-Control", "public, max-age=5")
+	writeJSON(w, http.StatusOK, QuoteResponse{Cotizacion: *cotizacion, UnavailableNumbers: ocupados, Providers: s.proveedoresRifa(rifa)})
+}
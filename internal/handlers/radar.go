@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+)
+
+// maxValorMetadata es el largo máximo de un valor de metadata en Stripe
+const maxValorMetadata = 500
+
+// metadataRiesgo suma a la metadata del intent lo que usan las reglas de Radar
+// (::client_ip::, ::user_agent::, ::account_age_days::): la IP y el navegador
+// de quien compra y, si tiene cuenta, los días desde que la creó. Un invitado
+// no lleva account_age_days, y un perfil que no se puede leer no frena la
+// compra: sale sin ese dato.
+func (s *Server) metadataRiesgo(r *http.Request, userID string, metadata map[string]string) map[string]string {
+	metadata["client_ip"] = s.ipCliente(r)
+	if ua := r.UserAgent(); ua != "" {
+		if len(ua) > maxValorMetadata {
+			ua = strings.ToValidUTF8(ua[:maxValorMetadata], "")
+		}
+		metadata["user_agent"] = ua
+	}
+	if userID == "" {
+		return metadata
+	}
+	perfil, err := s.db.GetProfile(r.Context(), userID, "")
+	if err != nil {
+		slog.WarnContext(r.Context(), "no se pudo leer la antigüedad de la cuenta", logging.ConError(err, "user_id", userID)...)
+		return metadata
+	}
+	if !perfil.CreatedAt.IsZero() {
+		dias := int(time.Since(perfil.CreatedAt).Hours() / 24)
+		metadata["account_age_days"] = strconv.Itoa(max(dias, 0))
+	}
+	return metadata
+}
+
+// revisionDeIntent devuelve la revisión de Radar del último cargo del intent,
+// o nil si el cargo no pasó por revisión. El evento del intent trae sólo el ID
+// del cargo, así que se le pide a Stripe con la revisión expandida.
+func (s *Server) revisionDeIntent(ctx context.Context, paymentIntentID string) (*stripe.Review, error) {
+	consulta := &stripe.PaymentIntentParams{}
+	consulta.AddExpand("latest_charge.review")
+	pi, err := s.pagos.GetIntent(ctx, paymentIntentID, consulta)
+	if err != nil {
+		return nil, err
+	}
+	if pi.LatestCharge == nil {
+		return nil, nil
+	}
+	return pi.LatestCharge.Review, nil
+}
+
+// retieneCompra dice si la revisión deja los tickets on_hold al registrarlos.
+// Las de una regla de Radar se abren con el cargo, antes de confirmar nada; una
+// manual se abre desde el Dashboard sobre una compra ya confirmada, y
+// procesarRevisionAbierta retiene sus tickets sin frenar un correo que ya salió.
+func retieneCompra(revision *stripe.Review) bool {
+	return revision != nil && revision.Open && revision.Reason != stripe.ReviewReasonManual
+}
+
+// revisionRechazada dice si la revisión se cerró devolviendo o cancelando el
+// pago. Disputed la sigue charge.dispute.created y redacted no cambia el pago.
+func revisionRechazada(revision *stripe.Review) bool {
+	if revision == nil || revision.Open {
+		return false
+	}
+	switch revision.ClosedReason {
+	case stripe.ReviewClosedReasonRefunded, stripe.ReviewClosedReasonRefundedAsFraud,
+		stripe.ReviewClosedReasonCanceled, stripe.ReviewClosedReasonPaymentNeverSettled:
+		return true
+	}
+	return false
+}
+
+// intentDeRevision lee el intent del cargo en revisión y su compra. Devuelve
+// nil, nil si no hay nada que hacer: un cargo sin PaymentIntent o una cuota
+// posterior, cuyos tickets son los de la primera y ya están partially_paid.
+func (s *Server) intentDeRevision(ctx context.Context, revision *stripe.Review) (*stripe.PaymentIntent, *model.PurchaseDraft, error) {
+	if revision.PaymentIntent == nil || revision.PaymentIntent.ID == "" {
+		slog.InfoContext(ctx, "revisión de un cargo sin PaymentIntent", "review_id", revision.ID)
+		return nil, nil, nil
+	}
+	pi, err := s.pagos.GetIntent(ctx, revision.PaymentIntent.ID, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("consultando el intent en revisión: %w", err)
+	}
+	if esCuotaPosterior(pi) {
+		slog.WarnContext(ctx, "revisión de una cuota posterior, sin cambios en los tickets", "review_id", revision.ID, "payment_intent_id", pi.ID, "installment", pi.Metadata["installment"])
+		return nil, nil, nil
+	}
+	compra, err := s.cargarCompra(ctx, pi)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compra: %w", err)
+	}
+	return pi, compra, nil
+}
+
+// procesarRevisionAbierta retiene los tickets del intent mientras Radar los
+// revisa. Si el pago todavía no se registró no hay tickets: los registra
+// on_hold payment_intent.succeeded.
+func (s *Server) procesarRevisionAbierta(ctx context.Context, revision *stripe.Review) error {
+	if revision.PaymentIntent == nil || revision.PaymentIntent.ID == "" {
+		slog.InfoContext(ctx, "revisión de un cargo sin PaymentIntent", "review_id", revision.ID)
+		return nil
+	}
+	piID := revision.PaymentIntent.ID
+	retenidos, err := s.db.HoldTickets(ctx, piID)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "pago en revisión", "review_id", revision.ID, "payment_intent_id", piID, "reason", revision.Reason, "tickets_retenidos", retenidos)
+	return nil
+}
+
+// procesarRevisionCerrada sigue la decisión de la revisión: aprobada, los
+// tickets vuelven a contar y sigue la confirmación que se había frenado;
+// rechazada, se liberan y se le avisa al comprador.
+func (s *Server) procesarRevisionCerrada(ctx context.Context, revision *stripe.Review, cerrada time.Time) error {
+	aprobada := revision.ClosedReason == stripe.ReviewClosedReasonApproved
+	if !aprobada && !revisionRechazada(revision) {
+		slog.InfoContext(ctx, "revisión cerrada sin cambios en los tickets", "review_id", revision.ID, "closed_reason", revision.ClosedReason)
+		return nil
+	}
+	pi, compra, err := s.intentDeRevision(ctx, revision)
+	if err != nil || pi == nil {
+		return err
+	}
+	tickets, err := s.db.PaymentIntentTickets(ctx, pi.ID)
+	if err != nil {
+		return err
+	}
+	if len(tickets) == 0 {
+		// payment_intent.succeeded no llegó todavía: al llegar ve la revisión
+		// cerrada y registra o rechaza la compra
+		slog.InfoContext(ctx, "revisión cerrada antes de registrar el pago", "review_id", revision.ID, "payment_intent_id", pi.ID, "closed_reason", revision.ClosedReason)
+		return nil
+	}
+	if !aprobada {
+		return s.rechazarCompra(ctx, compra, pi.ID, revision)
+	}
+
+	liberados, err := s.db.ReleaseHeldTickets(ctx, pi.ID)
+	if err != nil {
+		return err
+	}
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaRevisionAprobada,
+		RifaID:          compra.RifaID,
+		PaymentIntentID: pi.ID,
+		EntityID:        revision.ID,
+		Detail:          map[string]interface{}{"reason": revision.Reason, "tickets": liberados},
+	})
+	slog.InfoContext(ctx, "revisión aprobada", "review_id", revision.ID, "payment_intent_id", pi.ID, "tickets_liberados", liberados)
+	if revision.Reason == stripe.ReviewReasonManual {
+		// La confirmación ya había salido cuando se pagó
+		return nil
+	}
+	// Los tickets ya están: insertarTickets sólo trae sus IDs para el correo
+	items, err := s.insertarTickets(ctx, compra, pagoStripe(compra, pi, cerrada))
+	if err != nil {
+		return err
+	}
+	return s.confirmarCompra(ctx, compra, pi, cerrada, items)
+}
+
+// rechazarCompra libera los números de una compra que la revisión rechazó y le
+// avisa al comprador. Stripe ya devolvió el pago, así que charge.refunded
+// llega sin tickets vigentes; si llegó antes, los números ya están libres y
+// sólo falta el aviso.
+func (s *Server) rechazarCompra(ctx context.Context, compra *model.PurchaseDraft, paymentIntentID string, revision *stripe.Review) error {
+	tickets, err := s.db.PaymentIntentTickets(ctx, paymentIntentID)
+	if err != nil {
+		return err
+	}
+	var vigentes []model.TicketAdmin
+	for _, t := range tickets {
+		if t.Status != store.EstadoTicketReembolsado {
+			vigentes = append(vigentes, t)
+		}
+	}
+	if len(vigentes) > 0 {
+		if err := s.db.SetTicketsStatus(ctx, paymentIntentID, nil, store.EstadoTicketReembolsado); err != nil {
+			return err
+		}
+		s.liberarTickets(ctx, vigentes)
+	}
+	if err := s.db.ReleaseReservations(ctx, paymentIntentID); err != nil {
+		return err
+	}
+	if err := s.db.ReleasePromoRedemption(ctx, paymentIntentID); err != nil {
+		return err
+	}
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaRevisionRechazada,
+		RifaID:          compra.RifaID,
+		PaymentIntentID: paymentIntentID,
+		EntityID:        revision.ID,
+		Detail:          map[string]interface{}{"closed_reason": revision.ClosedReason, "tickets": len(vigentes)},
+	})
+	slog.InfoContext(ctx, "revisión rechazada, números liberados", "review_id", revision.ID, "payment_intent_id", paymentIntentID, "closed_reason", revision.ClosedReason, "tickets", len(vigentes))
+
+	if compra.Email != "" {
+		enSegundoPlano(ctx, func(ctx context.Context) {
+			if err := s.enviarCorreoPagoRechazado(ctx, compra.Email, itemsDeCompra(compra)); err != nil {
+				slog.WarnContext(ctx, "error enviando correo de pago rechazado", logging.ConError(err, "payment_intent_id", paymentIntentID, "email", logging.EnmascararEmail(compra.Email))...)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"PaymentsGo/internal/model"
+)
+
+// limitador es un token bucket por clave (IP del cliente). Las cubetas sin
+// uso las elimina IniciarLimitadores para que la memoria no crezca sin límite.
+type limitador struct {
+	mu       sync.Mutex
+	tasa     float64 // tokens por segundo
+	rafaga   float64
+	cubetas  map[string]*cubeta
+	inactivo time.Duration
+}
+
+type cubeta struct {
+	tokens float64
+	ultimo time.Time
+}
+
+func nuevoLimitador(porMinuto int, rafaga int) *limitador {
+	return crearLimitador(float64(porMinuto)/60, float64(rafaga), 10*time.Minute)
+}
+
+// nuevoLimitadorPorPeriodo deja cantidad usos por clave en cada periodo. Una
+// cubeta sin uso se borra recién después de un periodo: borrarla antes la
+// devolvería llena.
+func nuevoLimitadorPorPeriodo(cantidad int, periodo time.Duration) *limitador {
+	return crearLimitador(float64(cantidad)/periodo.Seconds(), float64(cantidad), max(periodo, 10*time.Minute))
+}
+
+func crearLimitador(tasa float64, rafaga float64, inactivo time.Duration) *limitador {
+	return &limitador{
+		tasa:     tasa,
+		rafaga:   rafaga,
+		cubetas:  make(map[string]*cubeta),
+		inactivo: inactivo,
+	}
+}
+
+// IniciarLimitadores borra cada minuto las cubetas sin uso de los rate limits
+// del servidor. Para con ctx.
+func (s *Server) IniciarLimitadores(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.limiteCreateIntent.limpiar()
+				s.limiteRegalos.limpiar()
+				s.limiteReenvios.limpiar()
+			}
+		}
+	}()
+}
+
+// Permitir consume un token; si no hay, devuelve cuánto falta para el siguiente
+func (l *limitador) Permitir(clave string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ahora := time.Now()
+	c, ok := l.cubetas[clave]
+	if !ok {
+		c = &cubeta{tokens: l.rafaga, ultimo: ahora}
+		l.cubetas[clave] = c
+	}
+
+	c.tokens = math.Min(l.rafaga, c.tokens+ahora.Sub(c.ultimo).Seconds()*l.tasa)
+	c.ultimo = ahora
+	if c.tokens >= 1 {
+		c.tokens--
+		return true, 0
+	}
+	espera := time.Duration((1 - c.tokens) / l.tasa * float64(time.Second))
+	return false, espera
+}
+
+func (l *limitador) limpiar() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limite := time.Now().Add(-l.inactivo)
+	for clave, c := range l.cubetas {
+		if c.ultimo.Before(limite) {
+			delete(l.cubetas, clave)
+		}
+	}
+}
+
+// responderRateLimit responde 429 con Retry-After en segundos enteros
+func responderRateLimit(w http.ResponseWriter, espera time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(espera.Seconds()))))
+	writeJSON(w, http.StatusTooManyRequests, model.ErrorResponse{
+		Error: "Demasiadas solicitudes, intenta de nuevo en unos segundos",
+		Code:  "RATE_LIMITED",
+	})
+}
+
+// WithRateLimit limita por IP del cliente con RATE_LIMIT_PER_MINUTE y RATE_LIMIT_BURST
+func (s *Server) WithRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := s.ipCliente(r)
+		if ok, espera := s.limiteCreateIntent.Permitir(ip); !ok {
+			slog.WarnContext(r.Context(), "rate limit excedido", "ip", ip, "path", r.URL.Path)
+			responderRateLimit(w, espera)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// esProxyConfiable indica si la IP es de TRUSTED_PROXIES: sólo si la conexión
+// llega desde uno de ellos se usa X-Forwarded-For
+func (s *Server) esProxyConfiable(ip net.IP) bool {
+	for _, red := range s.cfg.TrustedProxies {
+		if red.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipCliente recorre X-Forwarded-For de derecha a izquierda y devuelve la
+// primera IP que no es un proxy confiable.
+func (s *Server) ipCliente(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !s.esProxyConfiable(ip) {
+		return host
+	}
+
+	saltos := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(saltos) - 1; i >= 0; i-- {
+		candidata := net.ParseIP(strings.TrimSpace(saltos[i]))
+		if candidata == nil {
+			break
+		}
+		host = candidata.String()
+		if !s.esProxyConfiable(candidata) {
+			break
+		}
+	}
+	return host
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/recibos"
+)
+
+// adjuntoRecibo numera el recibo en receipts y genera el PDF para la
+// confirmación. Las compras gratis no llevan recibo. Si algo falla devuelve
+// nil y el correo sale sin el PDF.
+func (s *Server) adjuntoRecibo(ctx context.Context, compra *model.PurchaseDraft, items []model.ItemCompra, monto int64, moneda string) []mail.Adjunto {
+	if monto <= 0 {
+		return nil
+	}
+	fila, err := s.db.CreateReceipt(ctx, &model.Recibo{
+		PaymentIntentID: compra.PaymentIntentID,
+		Email:           compra.Email,
+		Amount:          monto,
+		Currency:        moneda,
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo numerar el recibo", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		return nil
+	}
+
+	fecha, err := time.Parse(time.RFC3339, fila.CreatedAt)
+	if err != nil {
+		fecha = time.Now()
+	}
+	recibo := &recibos.Recibo{
+		Numero:          fila.ID,
+		Negocio:         s.cfg.ReceiptBusinessName,
+		Direccion:       s.cfg.ReceiptBusinessAddress,
+		Pie:             s.cfg.ReceiptFooter,
+		Email:           compra.Email,
+		PaymentIntentID: compra.PaymentIntentID,
+		Fecha:           fecha.UTC(),
+		Moneda:          strings.ToUpper(moneda),
+		Total:           payments.FormatearMonto(monto, moneda),
+	}
+	if compra.Discount > 0 {
+		recibo.Subtotal = payments.FormatearMonto(monto+compra.Discount, moneda)
+		recibo.Descuento = payments.FormatearMonto(compra.Discount, moneda)
+	}
+	// Las líneas van a precio de lista: el Amount de cada item ya tiene
+	// restada su parte del descuento, que se muestra aparte
+	for _, item := range items {
+		cantidad := int64(max(len(item.Numeros), 1))
+		unitario := item.UnitPrice
+		importe := unitario * cantidad
+		if unitario == 0 {
+			importe = item.Amount
+			if len(items) == 1 {
+				importe = monto + compra.Discount
+			}
+			unitario = importe / cantidad
+		}
+		recibo.Lineas = append(recibo.Lineas, recibos.Linea{
+			RifaNombre:     item.RifaTitle,
+			Numeros:        mail.FormatearNumeros(item.Numeros),
+			Cantidad:       len(item.Numeros),
+			PrecioUnitario: payments.FormatearMonto(unitario, moneda),
+			Importe:        payments.FormatearMonto(importe, moneda),
+		})
+	}
+
+	pdf, err := recibos.Generar(recibo)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo generar el recibo", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID, "receipt", fila.ID)...)
+		return nil
+	}
+	return []mail.Adjunto{{Nombre: recibo.Nombre(), ContentType: "application/pdf", Contenido: pdf}}
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+)
+
+// RefundRequest es el cuerpo (opcional) de POST /admin/payments/{paymentIntentId}/refund.
+// Sin números se reembolsan todos los tickets vigentes del intent.
+type RefundRequest struct {
+	Numeros []int `json:"numeros"`
+}
+
+// RefundResponse es la respuesta del reembolso administrativo
+type RefundResponse struct {
+	RefundID         string `json:"refundId"`
+	Amount           int64  `json:"amount"`
+	Currency         string `json:"currency"`
+	NumerosLiberados []int  `json:"numerosLiberados"`
+}
+
+// RefundPayment reembolsa una compra (o parte de ella) desde administración,
+// marca los tickets como refunded para que sus números vuelvan a estar
+// disponibles y le avisa al comprador.
+func (s *Server) RefundPayment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("paymentIntentId")
+
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+
+	pi, err := s.pagos.GetIntent(ctx, id, nil)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+			writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "Intento de pago no encontrado", Code: "NOT_FOUND"})
+			return
+		}
+		slog.ErrorContext(ctx, "error consultando PaymentIntent", logging.ConError(err, "payment_intent_id", id)...)
+		http.Error(w, "Error Stripe", 500)
+		return
+	}
+
+	tickets, err := s.db.PaymentIntentTickets(ctx, pi.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando tickets del intent", logging.ConError(err, "payment_intent_id", pi.ID)...)
+		http.Error(w, "Error consultando tickets", 500)
+		return
+	}
+
+	seleccion, rechazados := ticketsAReembolsar(tickets, req.Numeros)
+	if len(rechazados) > 0 {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error:   "Algunos números no pertenecen a esta compra o ya fueron reembolsados",
+			Code:    "INVALID_NUMBERS",
+			Details: map[string][]int{"numeros": rechazados},
+		})
+		return
+	}
+	if len(seleccion) == 0 {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{Error: "La compra no tiene tickets para reembolsar", Code: "NOTHING_TO_REFUND"})
+		return
+	}
+
+	monto := montoReembolso(pi, tickets, seleccion)
+	numeros := make([]int, len(seleccion))
+	for i, t := range seleccion {
+		numeros[i] = t.Number
+	}
+
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(pi.ID),
+		Amount:        stripe.Int64(monto),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+		Metadata:      map[string]string{"numeros": store.ListaNumeros(numeros)},
+	}
+	revertirTransferencia(params, pi)
+	// Los mismos números del mismo intent sólo se reembolsan una vez
+	params.SetIdempotencyKey(fmt.Sprintf("refund-admin-%s-%s", pi.ID, store.ListaNumeros(numeros)))
+	reembolso, err := s.pagos.CreateRefund(ctx, params)
+	if err != nil {
+		slog.ErrorContext(ctx, "error creando reembolso", logging.ConError(err, "payment_intent_id", pi.ID, "amount", monto)...)
+		writeJSON(w, http.StatusBadGateway, model.ErrorResponse{Error: "Stripe rechazó el reembolso", Code: "REFUND_FAILED"})
+		return
+	}
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaReembolso,
+		RifaID:          pi.Metadata["rifa_id"],
+		PaymentIntentID: pi.ID,
+		EntityID:        reembolso.ID,
+		Detail:          map[string]interface{}{"amount": monto, "currency": pi.Currency, "numeros": numeros, "reason": "admin", "provider": model.ProveedorStripe},
+	})
+
+	if err := s.db.SetTicketsStatus(ctx, pi.ID, numeros, store.EstadoTicketReembolsado); err != nil {
+		// El dinero ya se devolvió: queda en el log para corregir los tickets a mano
+		slog.ErrorContext(ctx, "reembolso creado pero no se pudieron marcar los tickets", logging.ConError(err, "payment_intent_id", pi.ID, "refund_id", reembolso.ID, "numeros", numeros)...)
+		http.Error(w, "Reembolso creado, error actualizando tickets", 500)
+		return
+	}
+	s.liberarTickets(ctx, seleccion)
+	slog.InfoContext(ctx, "reembolso administrativo", "payment_intent_id", pi.ID, "refund_id", reembolso.ID, "amount", monto, "currency", pi.Currency, "numeros", numeros)
+
+	compra, err := s.cargarCompra(ctx, pi)
+	if err != nil {
+		slog.WarnContext(ctx, "no se encontró la compra para avisar del reembolso", logging.ConError(err, "payment_intent_id", pi.ID)...)
+	} else if compra.Email != "" {
+		enSegundoPlano(ctx, func(ctx context.Context) {
+			if err := s.enviarCorreoReembolsoConfirmado(ctx, compra.Email, compra.RifaID, compra.RifaTitle, numeros, monto, string(pi.Currency)); err != nil {
+				slog.WarnContext(ctx, "error enviando confirmación de reembolso", logging.ConError(err, "payment_intent_id", pi.ID, "email", logging.EnmascararEmail(compra.Email))...)
+			}
+		})
+	}
+
+	writeJSON(w, http.StatusOK, RefundResponse{
+		RefundID:         reembolso.ID,
+		Amount:           monto,
+		Currency:         string(pi.Currency),
+		NumerosLiberados: numeros,
+	})
+}
+
+// ticketsAReembolsar elige los tickets vigentes pedidos (todos si numeros está
+// vacío) y devuelve los números que no se pueden reembolsar
+func ticketsAReembolsar(tickets []model.TicketAdmin, numeros []int) (seleccion []model.TicketAdmin, rechazados []int) {
+	vigentes := map[int]model.TicketAdmin{}
+	for _, t := range tickets {
+		if t.Status != store.EstadoTicketReembolsado {
+			vigentes[t.Number] = t
+		}
+	}
+	if len(numeros) == 0 {
+		for _, t := range vigentes {
+			seleccion = append(seleccion, t)
+		}
+	} else {
+		vistos := map[int]bool{}
+		for _, n := range numeros {
+			t, ok := vigentes[n]
+			if !ok || vistos[n] {
+				rechazados = append(rechazados, n)
+				continue
+			}
+			vistos[n] = true
+			seleccion = append(seleccion, t)
+		}
+	}
+	sort.Slice(seleccion, func(i, j int) bool { return seleccion[i].Number < seleccion[j].Number })
+	return seleccion, rechazados
+}
+
+// montoReembolso suma lo que se pagó por cada ticket. Los tickets viejos no
+// tienen amount_paid y se reembolsan en proporción al total del intent.
+func montoReembolso(pi *stripe.PaymentIntent, tickets []model.TicketAdmin, seleccion []model.TicketAdmin) int64 {
+	var total int64
+	sinMonto := 0
+	for _, t := range seleccion {
+		if t.AmountPaid > 0 {
+			total += t.AmountPaid
+		} else {
+			sinMonto++
+		}
+	}
+	if sinMonto > 0 && len(tickets) > 0 {
+		total += pi.Amount * int64(sinMonto) / int64(len(tickets))
+	}
+	return total
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+)
+
+// maxTicketsReenvio es cuántos tickets del email se leen de la rifa al
+// reenviar; alcanza de sobra para una persona
+const maxTicketsReenvio = 1000
+
+// ResendEmailRequest es el cuerpo de POST /admin/emails/resend: el intent de
+// la compra, o el email del comprador con la rifa
+type ResendEmailRequest struct {
+	PaymentIntentID string `json:"paymentIntentId"`
+	Email           string `json:"email"`
+	RifaID          string `json:"rifaId"`
+}
+
+// ResendEmailResponse dice a quién se reenvió y qué números llevaba el correo
+type ResendEmailResponse struct {
+	To      string           `json:"to"`
+	Numeros map[string][]int `json:"numeros"`
+}
+
+// confirmacionReenvio es lo que hace falta para volver a armar la confirmación
+type confirmacionReenvio struct {
+	destinatario string
+	locale       string
+	items        []model.ItemCompra
+	monto        int64
+	descuento    int64
+	moneda       string
+}
+
+// ResendConfirmation vuelve a mandar la confirmación con los tickets vigentes
+// (ni reembolsados, ni disputados, ni con cuotas pendientes) que hay en Supabase, para el comprador que
+// no la encuentra. Con paymentIntentId va al email de la compra; con email y
+// rifaId, a ese email con todos sus números de la rifa. Cada email admite
+// EMAIL_RESENDS_PER_HOUR reenvíos por hora.
+func (s *Server) ResendConfirmation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ResendEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+	req.PaymentIntentID = strings.TrimSpace(req.PaymentIntentID)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	req.RifaID = strings.TrimSpace(req.RifaID)
+
+	var conf *confirmacionReenvio
+	var err error
+	switch {
+	case req.PaymentIntentID != "":
+		conf, err = s.confirmacionDeIntent(ctx, req.PaymentIntentID)
+	case req.Email != "" && req.RifaID != "":
+		if !emailValido(req.Email) {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El email no es válido", Code: "INVALID_EMAIL"})
+			return
+		}
+		conf, err = s.confirmacionDeEmail(ctx, req.Email, req.RifaID)
+	default:
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta paymentIntentId, o email y rifaId", Code: "TARGET_REQUIRED"})
+		return
+	}
+	if errors.Is(err, model.ErrCompraNoEncontrada) {
+		mensaje := "No hay tickets vigentes para ese intent; si fue una venta manual o una compra vieja, prueba con email y rifaId"
+		if req.PaymentIntentID == "" {
+			mensaje = "Ese email no tiene tickets vigentes en la rifa; revisa que sea el de la cuenta con la que compró"
+		}
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: mensaje, Code: "NO_TICKETS"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error buscando los tickets a reenviar", logging.ConError(err, "payment_intent_id", req.PaymentIntentID, "rifa_id", req.RifaID)...)
+		http.Error(w, "Error consultando tickets", 500)
+		return
+	}
+
+	if ok, espera := s.limiteReenvios.Permitir(strings.ToLower(conf.destinatario)); !ok {
+		slog.WarnContext(ctx, "límite de reenvíos excedido", "email", logging.EnmascararEmail(conf.destinatario))
+		responderRateLimit(w, espera)
+		return
+	}
+
+	if err := s.enviarCorreoConfirmacion(ctx, conf.destinatario, conf.locale, conf.items, conf.monto, conf.descuento, conf.moneda); err != nil {
+		slog.WarnContext(ctx, "falló el reenvío de la confirmación", logging.ConError(err, "payment_intent_id", req.PaymentIntentID, "email", logging.EnmascararEmail(conf.destinatario))...)
+		writeJSON(w, http.StatusBadGateway, model.ErrorResponse{Error: "El proveedor de correo rechazó el envío", Code: "MAIL_FAILED"})
+		return
+	}
+
+	respuesta := ResendEmailResponse{To: conf.destinatario, Numeros: map[string][]int{}}
+	for _, item := range conf.items {
+		respuesta.Numeros[item.RifaID] = append(respuesta.Numeros[item.RifaID], item.Numeros...)
+	}
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaCorreoReenviado,
+		RifaID:          conf.items[0].RifaID,
+		PaymentIntentID: req.PaymentIntentID,
+		Detail:          map[string]interface{}{"email": conf.destinatario, "numeros": respuesta.Numeros},
+	})
+	slog.InfoContext(ctx, "confirmación reenviada", "payment_intent_id", req.PaymentIntentID, "rifa_id", req.RifaID, "email", logging.EnmascararEmail(conf.destinatario))
+	writeJSON(w, http.StatusOK, respuesta)
+}
+
+// confirmacionDeIntent arma la confirmación con los tickets vigentes del
+// intent y el email, idioma y descuento de su borrador
+func (s *Server) confirmacionDeIntent(ctx context.Context, paymentIntentID string) (*confirmacionReenvio, error) {
+	tickets, err := s.db.PaymentIntentTickets(ctx, paymentIntentID)
+	if err != nil {
+		return nil, err
+	}
+	vigentes := ticketsVigentes(tickets)
+	if len(vigentes) == 0 {
+		return nil, model.ErrCompraNoEncontrada
+	}
+	compra, err := s.db.GetPurchaseDraft(ctx, paymentIntentID)
+	if err != nil {
+		return nil, err
+	}
+	if compra.Email == "" {
+		return nil, model.ErrCompraNoEncontrada
+	}
+	conf := s.confirmacionDeTickets(ctx, vigentes)
+	conf.destinatario = compra.Email
+	conf.locale = compra.Locale
+	if len(vigentes) == len(tickets) {
+		// Con un reembolso parcial el descuento ya no corresponde al total
+		conf.descuento = compra.Discount
+	}
+	return conf, nil
+}
+
+// confirmacionDeEmail arma la confirmación con todos los tickets vigentes del
+// email en la rifa, que pueden ser de varias compras
+func (s *Server) confirmacionDeEmail(ctx context.Context, email string, rifaID string) (*confirmacionReenvio, error) {
+	tickets, err := s.db.ListTickets(ctx, rifaID, model.FiltroTickets{Email: email, SoloVigentes: true, Limit: maxTicketsReenvio})
+	if err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return nil, model.ErrCompraNoEncontrada
+	}
+	for i := range tickets {
+		tickets[i].RifaID = rifaID
+	}
+	conf := s.confirmacionDeTickets(ctx, tickets)
+	conf.destinatario = email
+	return conf, nil
+}
+
+// confirmacionDeTickets junta los tickets en un item por rifa y compra, para
+// que cada sección tenga su enlace de verificación, y suma lo pagado
+func (s *Server) confirmacionDeTickets(ctx context.Context, tickets []model.TicketAdmin) *confirmacionReenvio {
+	conf := &confirmacionReenvio{moneda: tickets[0].Currency}
+	indice := map[[2]string]int{}
+	var intents []string
+	for _, t := range tickets {
+		clave := [2]string{t.RifaID, t.PaymentIntentID}
+		i, ok := indice[clave]
+		if !ok {
+			i = len(conf.items)
+			indice[clave] = i
+			conf.items = append(conf.items, model.ItemCompra{RifaID: t.RifaID})
+			intents = append(intents, t.PaymentIntentID)
+		}
+		conf.items[i].Numeros = append(conf.items[i].Numeros, t.Number)
+		conf.items[i].Amount += t.AmountPaid
+		conf.monto += t.AmountPaid
+	}
+	for i := range conf.items {
+		item := &conf.items[i]
+		if rifa, err := s.rifa(ctx, item.RifaID); err == nil {
+			item.RifaTitle = rifa.Title
+		} else {
+			slog.WarnContext(ctx, "no se pudo leer la rifa del reenvío", logging.ConError(err, "rifa_id", item.RifaID)...)
+		}
+		if intents[i] != "" {
+			// Los tickets viejos sin intent no tienen enlace de verificación
+			item.VerifyURL = s.enlaceVerificacion(intents[i], *item)
+		}
+	}
+	return conf
+}
+
+// ticketsVigentes descarta los reembolsados, los disputados, los que tienen
+// cuotas pendientes y los que están en revisión
+func ticketsVigentes(tickets []model.TicketAdmin) []model.TicketAdmin {
+	var vigentes []model.TicketAdmin
+	for _, t := range tickets {
+		if t.Status != store.EstadoTicketReembolsado && t.Status != store.EstadoTicketDisputado && t.Status != store.EstadoTicketPagoParcial && t.Status != store.EstadoTicketEnRevision {
+			vigentes = append(vigentes, t)
+		}
+	}
+	return vigentes
+}
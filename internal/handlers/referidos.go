@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// validarReferido revisa referralCode contra referrers y responde 422
+// REFERRAL_INVALID si no existe o está inactivo. Un código del propio
+// comprador no es un error: se descarta y la compra sigue sin comisión.
+// Llamar después de identificarComprador. Devuelve false si ya respondió.
+func (s *Server) validarReferido(ctx context.Context, w http.ResponseWriter, req *model.PaymentRequest) bool {
+	req.ReferralCode = normalizarCodigo(req.ReferralCode)
+	if req.ReferralCode == "" {
+		return true
+	}
+	referente, err := s.db.GetReferrer(ctx, req.ReferralCode)
+	if err != nil && !errors.Is(err, model.ErrReferenteNoEncontrado) {
+		slog.ErrorContext(ctx, "error validando código de referido", logging.ConError(err, "referral_code", req.ReferralCode)...)
+		http.Error(w, "Error validando el código de referido", 500)
+		return false
+	}
+	if err != nil || !referente.Active {
+		slog.InfoContext(ctx, "código de referido rechazado", "referral_code", req.ReferralCode)
+		writeJSON(w, http.StatusUnprocessableEntity, model.ErrorResponse{Error: "El código de referido no es válido", Code: "REFERRAL_INVALID"})
+		return false
+	}
+	if strings.EqualFold(strings.TrimSpace(referente.Email), strings.TrimSpace(req.Email)) {
+		slog.InfoContext(ctx, "autorreferido ignorado", "referral_code", req.ReferralCode, "email", logging.EnmascararEmail(req.Email))
+		req.ReferralCode = ""
+	}
+	return true
+}
+
+// comisionReferido es la comisión de monto con el porcentaje dado, redondeada
+// al entero más cercano
+func comisionReferido(monto int64, porcentaje float64) int64 {
+	return int64(math.Round(float64(monto) * porcentaje / 100))
+}
+
+// acreditarReferido guarda la comisión del referente por una venta confirmada.
+// Es idempotente: un reintento del webhook no duplica el crédito.
+func (s *Server) acreditarReferido(ctx context.Context, compra *model.PurchaseDraft, monto int64, moneda string) error {
+	if compra.ReferralCode == "" || monto <= 0 {
+		return nil
+	}
+	referente, err := s.db.GetReferrer(ctx, compra.ReferralCode)
+	if errors.Is(err, model.ErrReferenteNoEncontrado) {
+		slog.WarnContext(ctx, "el referente de la compra ya no existe", "referral_code", compra.ReferralCode, "payment_intent_id", compra.PaymentIntentID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	porcentaje := referente.CommissionPercent
+	if porcentaje <= 0 {
+		porcentaje = s.cfg.ReferralCommissionPercent
+	}
+	credito := &model.CreditoReferido{
+		Code:              referente.Code,
+		RifaID:            compra.RifaID,
+		PaymentIntentID:   compra.PaymentIntentID,
+		Amount:            monto,
+		Currency:          strings.ToLower(moneda),
+		CommissionPercent: porcentaje,
+		Commission:        comisionReferido(monto, porcentaje),
+	}
+	if err := s.db.RecordReferralCredit(ctx, credito); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "comisión de referido acreditada", "referral_code", credito.Code, "payment_intent_id", credito.PaymentIntentID, "commission", credito.Commission, "currency", credito.Currency)
+	return nil
+}
+
+// descontarReferido descuenta de la comisión del intent la parte que
+// corresponde a reembolsado, el total ya devuelto de la venta; con todo
+// devuelto (o una disputa) la comisión queda en cero. Sin crédito no hace nada.
+func (s *Server) descontarReferido(ctx context.Context, paymentIntentID string, reembolsado int64) error {
+	credito, err := s.db.GetReferralCredit(ctx, paymentIntentID)
+	if err != nil || credito == nil {
+		return err
+	}
+	descontado := credito.Commission
+	if reembolsado < credito.Amount {
+		descontado = int64(math.Round(float64(credito.Commission) * float64(reembolsado) / float64(credito.Amount)))
+	}
+	if descontado <= credito.ClawedBack {
+		return nil
+	}
+	if err := s.db.ClawBackReferralCredit(ctx, paymentIntentID, descontado); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "comisión de referido descontada", "referral_code", credito.Code, "payment_intent_id", paymentIntentID, "clawed_back", descontado, "commission", credito.Commission)
+	return nil
+}
+
+// ResumenReferidoMoneda son las ventas del código en una moneda; Earned es
+// Commission menos ClawedBack
+type ResumenReferidoMoneda struct {
+	Currency   string `json:"currency"`
+	Sales      int    `json:"sales"`
+	Amount     int64  `json:"amount"`
+	Commission int64  `json:"commission"`
+	ClawedBack int64  `json:"clawedBack"`
+	Earned     int64  `json:"earned"`
+}
+
+// ReferralSummaryResponse es la respuesta de GET /admin/referrals/{code}/summary
+type ReferralSummaryResponse struct {
+	Code   string                  `json:"code"`
+	Name   string                  `json:"name"`
+	Active bool                    `json:"active"`
+	Totals []ResumenReferidoMoneda `json:"totals"`
+}
+
+// ReferralSummary suma las ventas confirmadas con el código y la comisión
+// ganada, por moneda: una rifa en MXN y otra en USD no se pueden sumar.
+func (s *Server) ReferralSummary(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	codigo := normalizarCodigo(r.PathValue("code"))
+	referente, err := s.db.GetReferrer(ctx, codigo)
+	if errors.Is(err, model.ErrReferenteNoEncontrado) {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "No hay referente con ese código", Code: "NOT_FOUND"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando el referente", logging.ConError(err, "referral_code", codigo)...)
+		http.Error(w, "Error consultando el referente", 500)
+		return
+	}
+	creditos, err := s.db.ReferralCredits(ctx, referente.Code)
+	if err != nil {
+		slog.ErrorContext(ctx, "error consultando comisiones de referido", logging.ConError(err, "referral_code", referente.Code)...)
+		http.Error(w, "Error consultando comisiones", 500)
+		return
+	}
+
+	porMoneda := map[string]*ResumenReferidoMoneda{}
+	for _, c := range creditos {
+		total, ok := porMoneda[c.Currency]
+		if !ok {
+			total = &ResumenReferidoMoneda{Currency: c.Currency}
+			porMoneda[c.Currency] = total
+		}
+		total.Sales++
+		total.Amount += c.Amount
+		total.Commission += c.Commission
+		total.ClawedBack += c.ClawedBack
+		total.Earned += c.Commission - c.ClawedBack
+	}
+	respuesta := ReferralSummaryResponse{Code: referente.Code, Name: referente.Name, Active: referente.Active, Totals: []ResumenReferidoMoneda{}}
+	for _, total := range porMoneda {
+		respuesta.Totals = append(respuesta.Totals, *total)
+	}
+	sort.Slice(respuesta.Totals, func(i, j int) bool { return respuesta.Totals[i].Currency < respuesta.Totals[j].Currency })
+	writeJSON(w, http.StatusOK, respuesta)
+}
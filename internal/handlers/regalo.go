@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+const (
+	maxLargoEmail          = 254
+	maxLargoNombreRegalado = 80
+)
+
+// emailValido acepta sólo una dirección simple (sin nombre ni lista), como
+// la que se manda a Resend
+func emailValido(email string) bool {
+	if email == "" || len(email) > maxLargoEmail {
+		return false
+	}
+	direccion, err := mail.ParseAddress(email)
+	return err == nil && direccion.Name == "" && direccion.Address == email
+}
+
+// nombreValido rechaza nombres con saltos de línea o caracteres de control y
+// los que parecen enlaces: el nombre va dentro del correo al destinatario
+func nombreValido(nombre string) bool {
+	if utf8.RuneCountInString(nombre) > maxLargoNombreRegalado {
+		return false
+	}
+	if strings.ContainsFunc(nombre, unicode.IsControl) {
+		return false
+	}
+	minusculas := strings.ToLower(nombre)
+	return !strings.Contains(minusculas, "://") && !strings.Contains(minusculas, "www.")
+}
+
+// validarRegalo revisa recipientEmail y recipientName. Regalar exige sesión
+// (el invitado no tiene cuenta a la que atribuir el envío) y pasa por
+// limiteRegalos. Si el destinatario es el mismo comprador no es un regalo y
+// los campos se vacían. Llamar después de identificarComprador.
+// Devuelve false si ya respondió con un error.
+func (s *Server) validarRegalo(ctx context.Context, w http.ResponseWriter, req *model.PaymentRequest) bool {
+	req.RecipientEmail = strings.TrimSpace(req.RecipientEmail)
+	req.RecipientName = strings.TrimSpace(req.RecipientName)
+	if req.RecipientEmail == "" {
+		if req.RecipientName != "" {
+			writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta el email del destinatario", Code: "INVALID_RECIPIENT"})
+			return false
+		}
+		return true
+	}
+	if strings.EqualFold(req.RecipientEmail, req.Email) {
+		req.RecipientEmail, req.RecipientName = "", ""
+		return true
+	}
+
+	if req.UserId == "" {
+		writeJSON(w, http.StatusUnauthorized, model.ErrorResponse{Error: "Debes iniciar sesión para regalar números", Code: "UNAUTHORIZED"})
+		return false
+	}
+	if !emailValido(req.RecipientEmail) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error:   "El email del destinatario no es válido",
+			Code:    "INVALID_RECIPIENT",
+			Details: map[string]string{"field": "recipientEmail"},
+		})
+		return false
+	}
+	if !nombreValido(req.RecipientName) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{
+			Error:   "El nombre del destinatario no es válido",
+			Code:    "INVALID_RECIPIENT",
+			Details: map[string]string{"field": "recipientName"},
+		})
+		return false
+	}
+
+	if ok, espera := s.limiteRegalos.Permitir(req.UserId); !ok {
+		slog.WarnContext(ctx, "rate limit de regalos excedido", "user_id", req.UserId, "recipient", logging.EnmascararEmail(req.RecipientEmail))
+		responderRateLimit(w, espera)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/metrics"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/tracing"
+)
+
+// loteReservasVencidas es cuántas reservas vencidas se leen por barrido; las
+// que sobran quedan para el siguiente
+const loteReservasVencidas = 500
+
+var reservasLiberadas = metrics.NewCounter("reservations_released_total", "Números con reserva vencida liberados por el barrido")
+
+// IniciarBarridoReservas libera cada ReservationSweepInterval las reservas que
+// vencieron sin pago (checkouts abandonados), pasa al siguiente de la lista
+// de espera los ofrecimientos vencidos y cancela los planes de cuotas que
+// vencieron sin pagarse. Cuando ctx se cancela deja de
+// barrer; el barrido en curso se corta entre un intent y el siguiente y se
+// cuenta en TareasPendientes.
+func (s *Server) IniciarBarridoReservas(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.cfg.ReservationSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				TareasPendientes.Add(1)
+				s.barrerReservas(ctx)
+				s.barrerEspera(context.WithoutCancel(ctx))
+				s.barrerCuotas(context.WithoutCancel(ctx))
+				TareasPendientes.Done()
+			}
+		}
+	}()
+}
+
+// barrerReservas agrupa las reservas vencidas por intent y decide con el
+// estado en Stripe: las de un pago en processing o succeeded se dejan (el
+// webhook las extiende o las convierte en tickets); las demás se borran junto
+// con el canje pendiente del código, cancelando antes el intent si todavía
+// espera un método de pago.
+func (s *Server) barrerReservas(ctx context.Context) {
+	ctxTrabajo, span := tracer.Start(context.WithoutCancel(ctx), "reservations.sweep")
+	var err error
+	defer func() { tracing.Fin(span, err) }()
+
+	vencidas, err := s.db.ExpiredReservations(ctxTrabajo, loteReservasVencidas)
+	if err != nil {
+		slog.WarnContext(ctxTrabajo, "error buscando reservas vencidas", logging.ConError(err)...)
+		return
+	}
+	porIntent := map[string][]model.Reserva{}
+	var intents []string
+	for _, r := range vencidas {
+		if len(porIntent[r.PaymentIntentID]) == 0 {
+			intents = append(intents, r.PaymentIntentID)
+		}
+		porIntent[r.PaymentIntentID] = append(porIntent[r.PaymentIntentID], r)
+	}
+
+	liberados, omitidos := 0, 0
+	for _, id := range intents {
+		if ctx.Err() != nil {
+			break
+		}
+		liberar, err := s.reservaAbandonada(ctxTrabajo, id)
+		if err != nil {
+			slog.WarnContext(ctxTrabajo, "no se pudo revisar la reserva vencida", logging.ConError(err, "payment_intent_id", id)...)
+			continue
+		}
+		if !liberar {
+			omitidos++
+			continue
+		}
+		if err := s.db.ReleaseExpiredReservations(ctxTrabajo, id); err != nil {
+			slog.WarnContext(ctxTrabajo, "error liberando reservas vencidas", logging.ConError(err, "payment_intent_id", id)...)
+			continue
+		}
+		if err := s.db.ReleasePromoRedemption(ctxTrabajo, id); err != nil {
+			slog.WarnContext(ctxTrabajo, "no se pudo liberar el canje del código", logging.ConError(err, "payment_intent_id", id)...)
+		}
+		liberados += len(porIntent[id])
+		reservasLiberadas.Add(int64(len(porIntent[id])))
+		// Un intent del carrito puede tener números de varias rifas
+		porRifa := map[string][]int{}
+		for _, r := range porIntent[id] {
+			porRifa[r.RifaID] = append(porRifa[r.RifaID], r.Number)
+		}
+		for rifaID, numeros := range porRifa {
+			s.liberarNumeros(ctxTrabajo, rifaID, numeros)
+		}
+	}
+	if len(intents) > 0 {
+		slog.InfoContext(ctxTrabajo, "barrido de reservas vencidas",
+			"liberadas", liberados, "intents", len(intents), "omitidos", omitidos)
+	}
+}
+
+// reservarNumeros es ReserveNumbers avisando a GET /rifas/{id}/events
+func (s *Server) reservarNumeros(ctx context.Context, rifaID string, numeros []int, userID string, paymentIntentID string) error {
+	if err := s.db.ReserveNumbers(ctx, rifaID, numeros, userID, paymentIntentID); err != nil {
+		return err
+	}
+	s.publicarNumeros(rifaID, EventoNumeroTomado, numeros)
+	return nil
+}
+
+// reservaAbandonada dice si las reservas vencidas del intent se pueden
+// liberar, cancelando antes el intent si todavía se podía pagar
+func (s *Server) reservaAbandonada(ctx context.Context, id string) (bool, error) {
+	if esIntentGratis(id) {
+		// No pasó por Stripe: si quedó la reserva es que el registro nunca terminó
+		return true, nil
+	}
+	if esPagoPayPal(id) {
+		return s.ordenAbandonada(ctx, strings.TrimPrefix(id, prefijoPayPal))
+	}
+	if esPagoMercadoPago(id) {
+		return s.preferenciaAbandonada(ctx, strings.TrimPrefix(id, prefijoMercadoPago))
+	}
+	pi, err := s.pagos.GetIntent(ctx, id, nil)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.PaymentIntentStatusRequiresConfirmation:
+		// Si el cliente paga justo ahora la cancelación falla y se reintenta en
+		// el próximo barrido, ya con el nuevo estado
+		if _, err := s.pagos.CancelIntent(ctx, id, nil); err != nil {
+			return false, err
+		}
+		return true, nil
+	case stripe.PaymentIntentStatusCanceled:
+		return true, nil
+	default:
+		// processing y succeeded los resuelve el webhook; requires_action es un
+		// 3D Secure o un voucher en curso, que Stripe cancela si no se completa
+		return false, nil
+	}
+}
+
+// ordenAbandonada es reservaAbandonada para una orden de PayPal: una aprobada
+// o completada la resuelve el webhook, cualquier otra se puede liberar
+func (s *Server) ordenAbandonada(ctx context.Context, orderID string) (bool, error) {
+	if s.paypal == nil {
+		return false, nil
+	}
+	orden, err := s.paypal.GetOrder(ctx, orderID)
+	var errPayPal *payments.ErrPayPal
+	if errors.As(err, &errPayPal) && errPayPal.Status == http.StatusNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch orden.Status {
+	case payments.OrdenPayPalAprobada, payments.OrdenPayPalCompletada:
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// ReservaAdmin es una reserva con su estado al momento de la consulta
+type ReservaAdmin struct {
+	model.Reserva
+	Expired bool `json:"expired"`
+}
+
+// ReservationsAdminResponse es la respuesta de GET /admin/reservations
+type ReservationsAdminResponse struct {
+	Reservations []ReservaAdmin `json:"reservations"`
+	Count        int            `json:"count"`
+}
+
+// ListReservations muestra las reservas guardadas, incluidas las vencidas que
+// el barrido todavía no borró. Query params: rifaId y limit (máximo 1000).
+func (s *Server) ListReservations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	rifaID := strings.TrimSpace(q.Get("rifaId"))
+	limite := min(enteroPositivo(q.Get("limit"), 200), 1000)
+
+	reservas, err := s.db.ListReservations(ctx, rifaID, limite)
+	if err != nil {
+		slog.ErrorContext(ctx, "error listando reservas", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error listando reservas", 500)
+		return
+	}
+	ahora := time.Now()
+	respuesta := ReservationsAdminResponse{Reservations: make([]ReservaAdmin, len(reservas)), Count: len(reservas)}
+	for i, reserva := range reservas {
+		respuesta.Reservations[i] = ReservaAdmin{Reserva: reserva, Expired: !reserva.ExpiresAt.After(ahora)}
+	}
+	writeJSON(w, http.StatusOK, respuesta)
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/tracing"
+)
+
+// IniciarResumenDiario manda todos los días a DIGEST_TIME (en DIGEST_TIMEZONE)
+// el resumen de ventas a ORGANIZER_EMAIL. Si el servicio arranca después de la
+// hora, el de hoy sale al arrancar; digest_runs guarda los días enviados, así
+// un reinicio o una segunda instancia no lo repiten.
+func (s *Server) IniciarResumenDiario(ctx context.Context) {
+	hora, minuto, ok := config.HoraDelDia(s.cfg.DigestTime)
+	if !ok || s.cfg.OrganizerEmail == "" {
+		slog.Info("resumen diario desactivado: falta DIGEST_TIME u ORGANIZER_EMAIL")
+		return
+	}
+	loc := s.cfg.DigestLocation
+	go func() {
+		ahora := time.Now().In(loc)
+		siguiente := time.Date(ahora.Year(), ahora.Month(), ahora.Day(), hora, minuto, 0, 0, loc)
+		for {
+			timer := time.NewTimer(time.Until(siguiente))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				TareasPendientes.Add(1)
+				s.resumenProgramado(ctx, siguiente.Format(time.DateOnly))
+				TareasPendientes.Done()
+			}
+			// time.Date y no Add(24h), para que la hora se mantenga con el horario de verano
+			siguiente = time.Date(siguiente.Year(), siguiente.Month(), siguiente.Day()+1, hora, minuto, 0, 0, loc)
+		}
+	}()
+}
+
+// resumenProgramado reserva el día en digest_runs y manda el resumen; si el
+// envío falla libera la reserva para que lo reintente el próximo arranque
+func (s *Server) resumenProgramado(ctx context.Context, dia string) {
+	ctx, span := tracer.Start(context.WithoutCancel(ctx), "digest.run")
+	var err error
+	defer func() { tracing.Fin(span, err) }()
+
+	reservado, err := s.db.ClaimDigest(ctx, dia)
+	if err != nil {
+		slog.WarnContext(ctx, "no se pudo reservar el resumen diario", logging.ConError(err, "dia", dia)...)
+		return
+	}
+	if !reservado {
+		slog.InfoContext(ctx, "el resumen diario ya se envió", "dia", dia)
+		return
+	}
+	if _, err = s.enviarResumenDiario(ctx, time.Now()); err != nil {
+		slog.ErrorContext(ctx, "error enviando el resumen diario", logging.ConError(err, "dia", dia)...)
+		if err := s.db.ReleaseDigest(ctx, dia); err != nil {
+			slog.WarnContext(ctx, "no se pudo liberar el resumen diario", logging.ConError(err, "dia", dia)...)
+		}
+		return
+	}
+	slog.InfoContext(ctx, "resumen diario enviado", "dia", dia)
+}
+
+// resumenVentasDia agrupa por rifa y moneda los tickets registrados en las 24
+// horas anteriores a hasta; los montos salen de amount_paid de cada ticket
+func (s *Server) resumenVentasDia(ctx context.Context, hasta time.Time) (mail.DatosResumenDiario, error) {
+	datos := mail.DatosResumenDiario{Fecha: mail.FormatearFechaEn(mail.IdiomaPorDefecto, hasta.In(s.cfg.DigestLocation))}
+	vendidos, err := s.db.TicketsSoldSince(ctx, hasta.Add(-24*time.Hour))
+	if err != nil {
+		return datos, err
+	}
+
+	type clave struct{ rifa, moneda string }
+	type grupo struct {
+		nombre    string
+		moneda    string
+		numeros   int
+		recaudado int64
+	}
+	grupos := map[clave]*grupo{}
+	porMoneda := map[string]int64{}
+	for _, t := range vendidos {
+		moneda := payments.NormalizarMoneda(t.Currency)
+		k := clave{t.RifaID, moneda}
+		g := grupos[k]
+		if g == nil {
+			g = &grupo{nombre: t.RifaTitle, moneda: moneda}
+			grupos[k] = g
+		}
+		g.numeros++
+		g.recaudado += t.AmountPaid
+		porMoneda[moneda] += t.AmountPaid
+	}
+
+	ordenados := make([]*grupo, 0, len(grupos))
+	for _, g := range grupos {
+		ordenados = append(ordenados, g)
+	}
+	sort.Slice(ordenados, func(i, j int) bool {
+		if ordenados[i].recaudado != ordenados[j].recaudado {
+			return ordenados[i].recaudado > ordenados[j].recaudado
+		}
+		return ordenados[i].nombre < ordenados[j].nombre
+	})
+	for _, g := range ordenados {
+		datos.Rifas = append(datos.Rifas, mail.LineaResumen{Nombre: g.nombre, Numeros: g.numeros, Monto: payments.FormatearMonto(g.recaudado, g.moneda)})
+		datos.Numeros += g.numeros
+	}
+	monedas := make([]string, 0, len(porMoneda))
+	for m := range porMoneda {
+		monedas = append(monedas, m)
+	}
+	sort.Strings(monedas)
+	for _, m := range monedas {
+		datos.Totales = append(datos.Totales, payments.FormatearMonto(porMoneda[m], m))
+	}
+	return datos, nil
+}
+
+// enviarResumenDiario arma el resumen hasta el momento dado y lo manda a ORGANIZER_EMAIL
+func (s *Server) enviarResumenDiario(ctx context.Context, hasta time.Time) (mail.DatosResumenDiario, error) {
+	datos, err := s.resumenVentasDia(ctx, hasta)
+	if err != nil {
+		return datos, err
+	}
+	return datos, s.enviarCorreo(ctx, s.cfg.OrganizerEmail, "Resumen de ventas del "+datos.Fecha, "resumen_diario", datos)
+}
+
+// DigestResponse es la respuesta de POST /admin/digest/run
+type DigestResponse struct {
+	SentTo  string   `json:"sentTo"`
+	Rifas   int      `json:"rifas"`
+	Numbers int      `json:"numbers"`
+	Totals  []string `json:"totals"`
+}
+
+// RunDigest manda ahora el resumen de las últimas 24 horas, para probarlo. No
+// pasa por digest_runs: no cuenta como el envío programado del día.
+func (s *Server) RunDigest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.cfg.OrganizerEmail == "" {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{
+			Error: "ORGANIZER_EMAIL no está configurado",
+			Code:  "NO_ORGANIZER_EMAIL",
+		})
+		return
+	}
+	datos, err := s.enviarResumenDiario(ctx, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "error enviando el resumen a pedido", logging.ConError(err)...)
+		http.Error(w, "Error enviando el resumen", 500)
+		return
+	}
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action: model.AuditoriaResumen,
+		Detail: map[string]interface{}{"email": s.cfg.OrganizerEmail, "rifas": len(datos.Rifas), "numbers": datos.Numeros},
+	})
+	writeJSON(w, http.StatusOK, DigestResponse{
+		SentTo:  s.cfg.OrganizerEmail,
+		Rifas:   len(datos.Rifas),
+		Numbers: datos.Numeros,
+		Totals:  datos.Totales,
+	})
+}
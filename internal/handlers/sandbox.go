@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+)
+
+// CabeceraSandbox lleva uno de SANDBOX_ADMIN_TOKENS para que la petición vaya
+// al sandbox aunque SANDBOX_MODE esté apagado
+const CabeceraSandbox = "X-Sandbox"
+
+// ActivarSandbox arma el servidor que atiende las compras de prueba: db es el
+// cliente de las tablas _sandbox y pagos el de la cuenta de prueba de Stripe.
+// Sólo cobra con Stripe, no avisa las ventas y manda todos los correos a
+// SANDBOX_EMAIL. Devuelve el servidor para arrancar sus workers.
+func (s *Server) ActivarSandbox(db Store, pagos PaymentProvider) *Server {
+	cfg := *s.cfg
+	cfg.StripePublishableKey = cfg.StripeTestPublishableKey
+	correo := correoSandbox{Mailer: s.correo, destino: cfg.SandboxEmail}
+	s.sandbox = NewServer(&cfg, db, pagos, nil, nil, s.captcha, correo)
+	s.sandbox.enSandbox = true
+	return s.sandbox
+}
+
+// WithSandbox atiende la petición con el servidor del sandbox si SANDBOX_MODE
+// está encendido o la petición trae un token de SANDBOX_ADMIN_TOKENS en
+// X-Sandbox; si no, con s. Un X-Sandbox que no está en la lista es un 403,
+// así una demo mal configurada no termina cobrando de verdad.
+func (s *Server) WithSandbox(h func(*Server, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(CabeceraSandbox)
+		if token != "" && !s.tokenSandbox(token) {
+			slog.WarnContext(r.Context(), "X-Sandbox con un token no autorizado", "ip", s.ipCliente(r))
+			writeJSON(w, http.StatusForbidden, model.ErrorResponse{Error: "Token de sandbox no autorizado", Code: "SANDBOX_FORBIDDEN"})
+			return
+		}
+		if s.sandbox != nil && (s.cfg.SandboxMode || token != "") {
+			h(s.sandbox, w, r)
+			return
+		}
+		h(s, w, r)
+	}
+}
+
+// tokenSandbox dice si token está en SANDBOX_ADMIN_TOKENS
+func (s *Server) tokenSandbox(token string) bool {
+	if s.sandbox == nil {
+		return false
+	}
+	valido := false
+	for _, t := range s.cfg.SandboxAdminTokens {
+		// Se comparan todos para no revelar con el tiempo cuál coincide
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valido = true
+		}
+	}
+	return valido
+}
+
+// correoSandbox manda todos los correos del sandbox al buzón de SANDBOX_EMAIL,
+// con el asunto marcado, en lugar de a los compradores
+type correoSandbox struct {
+	Mailer
+	destino string
+}
+
+func (c correoSandbox) Send(ctx context.Context, marca mail.Marca, destinatario string, asunto string, html string, texto string, adjuntos ...mail.Adjunto) (string, error) {
+	return c.Mailer.Send(ctx, marca, c.destino, "[Sandbox] "+asunto, html, texto, adjuntos...)
+}
+
+func (c correoSandbox) Probar(ctx context.Context, marca mail.Marca, destinatario string, asunto string, html string, texto string) (string, error) {
+	return c.Mailer.Probar(ctx, marca, c.destino, "[Sandbox] "+asunto, html, texto)
+}
@@ -0,0 +1,309 @@
+// Package handlers tiene los endpoints HTTP, sus middlewares y la lógica de
+// compra que comparten (reservas, webhook, correos).
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"go.opentelemetry.io/otel"
+
+	"PaymentsGo/internal/captcha"
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/payments"
+)
+
+var tracer = otel.Tracer("PaymentsGo/internal/handlers")
+
+// TareasPendientes cuenta el trabajo en segundo plano (correos) que debe
+// terminar antes de que el proceso salga.
+var TareasPendientes sync.WaitGroup
+
+// enSegundoPlano ejecuta la tarea con un contexto que conserva los valores de
+// la petición (request ID) pero no se cancela cuando la petición termina.
+func enSegundoPlano(ctx context.Context, tarea func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+	TareasPendientes.Add(1)
+	go func() {
+		defer TareasPendientes.Done()
+		tarea(ctx)
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	// WithRequestID ya puso la cabecera; el frontend la muestra para soporte
+	if e, ok := v.(model.ErrorResponse); ok && e.RequestID == "" {
+		e.RequestID = w.Header().Get(logging.CabeceraRequestID)
+		v = e
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Server agrupa las dependencias externas de los handlers. main arma uno con
+// los clientes reales (Supabase, Stripe y Resend); cualquier implementación de
+// estas interfaces sirve para levantar los handlers sin esos servicios.
+type Server struct {
+	cfg   *config.Config
+	db    Store
+	pagos PaymentProvider
+	// paypal es nil si PayPal no está configurado
+	paypal PayPalProvider
+	// mercadopago es nil si MercadoPago no está configurado
+	mercadopago MercadoPagoProvider
+	// captcha es nil si CAPTCHA_PROVIDER no está configurado
+	captcha CaptchaVerifier
+	correo  Mailer
+	// avisos son los canales que reciben cada venta confirmada; puede no haber
+	avisos []Notifier
+
+	limiteCreateIntent *limitador
+	// limiteRegalos limita por usuario las compras con recipientEmail, para que
+	// el campo no sirva para mandar correos a terceros
+	limiteRegalos *limitador
+	// limiteReenvios limita por email los reenvíos de POST /admin/emails/resend
+	limiteReenvios *limitador
+	rifas          *cacheRifas
+	progreso       *cacheProgreso
+	eventos        *hubRifas
+	bloqueos       *cacheBloqueos
+	emails         *verificadorEmail
+	// procesados son los eventos de webhook que este servidor ya procesó; el
+	// del sandbox tiene el suyo, así un ID de prueba no tapa uno real
+	procesados *cacheEventos
+	// trabajos lleva los eventos del webhook a los workers de IniciarTrabajos
+	trabajos *colaTrabajos
+	// auditoria lleva las entradas de audit_log al escritor de IniciarAuditoria
+	auditoria chan model.EntradaAuditoria
+	// salidas despierta al despachador de IniciarOutbox cuando hay entradas nuevas
+	salidas chan struct{}
+	// enSandbox es true en el servidor que arma ActivarSandbox
+	enSandbox bool
+	// sandbox atiende las compras de prueba (ver ActivarSandbox); nil sin
+	// STRIPE_TEST_SECRET_KEY
+	sandbox *Server
+}
+
+func NewServer(cfg *config.Config, db Store, pagos PaymentProvider, paypal PayPalProvider, mercadopago MercadoPagoProvider, captcha CaptchaVerifier, correo Mailer, avisos ...Notifier) *Server {
+	if len(cfg.AllowedOrigins) == 0 {
+		slog.Warn("ALLOWED_ORIGINS vacío: ningún navegador recibirá cabeceras CORS")
+	}
+	if len(cfg.AdminAPIKeys) == 0 {
+		slog.Warn("ADMIN_API_KEYS vacío: los endpoints de administración responden 401")
+	}
+	return &Server{
+		cfg:                cfg,
+		db:                 db,
+		pagos:              pagos,
+		paypal:             paypal,
+		mercadopago:        mercadopago,
+		captcha:            captcha,
+		correo:             correo,
+		avisos:             avisos,
+		limiteCreateIntent: nuevoLimitador(cfg.RateLimitPerMinute, cfg.RateLimitBurst),
+		limiteRegalos:      nuevoLimitador(cfg.GiftRateLimitPerMinute, cfg.GiftRateLimitBurst),
+		limiteReenvios:     nuevoLimitadorPorPeriodo(cfg.EmailResendsPerHour, time.Hour),
+		rifas:              nuevoCacheRifas(cfg.RifaCacheTTL),
+		progreso:           nuevoCacheProgreso(cfg.ProgressCacheTTL),
+		eventos:            nuevoHubRifas(cfg.EventsMaxSubscribers),
+		bloqueos:           nuevoCacheBloqueos(cfg.BlocklistCacheTTL),
+		emails:             nuevoVerificadorEmail(cfg),
+		procesados:         nuevoCacheEventos(capacidadEventosProcesados),
+		trabajos:           nuevaColaTrabajos(capacidadCola),
+		auditoria:          make(chan model.EntradaAuditoria, capacidadAuditoria),
+		salidas:            make(chan struct{}, 1),
+	}
+}
+
+// Store es lo que los handlers usan de la base; la implementación real es
+// *SupabaseClient y los errores que se distinguen (ErrRifaNoEncontrada,
+// *ErrNumerosOcupados, ErrCompraNoEncontrada...) son los mismos.
+type Store interface {
+	Ping(ctx context.Context) error
+	// CircuitState es el estado del circuito que corta las llamadas cuando
+	// Supabase viene fallando; abierto, todo devuelve *store.ErrCircuitoAbierto
+	CircuitState() string
+
+	GetRifa(ctx context.Context, id string) (*model.Rifa, error)
+	SoldNumbers(ctx context.Context, rifaID string) ([]int, error)
+	ReservedNumbers(ctx context.Context, rifaID string) ([]int, error)
+	CheckNumbers(ctx context.Context, rifaID string, numeros []int) ([]int, error)
+	CountUserNumbers(ctx context.Context, rifaID string, userID string, excluirPI string) (int, error)
+
+	// Reservas y borradores de compra
+	ReserveNumbers(ctx context.Context, rifaID string, numeros []int, userID string, paymentIntentID string) error
+	ExtendReservations(ctx context.Context, paymentIntentID string, hasta time.Time) error
+	ReleaseReservations(ctx context.Context, paymentIntentID string) error
+	ListReservations(ctx context.Context, rifaID string, limite int) ([]model.Reserva, error)
+	ExpiredReservations(ctx context.Context, limite int) ([]model.Reserva, error)
+	ReleaseExpiredReservations(ctx context.Context, paymentIntentID string) error
+	SavePurchaseDraft(ctx context.Context, compra *model.PurchaseDraft) error
+	GetPurchaseDraft(ctx context.Context, paymentIntentID string) (*model.PurchaseDraft, error)
+	GetPurchaseDraftByID(ctx context.Context, id string) (*model.PurchaseDraft, error)
+	BuyerOpenPurchaseDrafts(ctx context.Context, rifaID, userID, email string) ([]model.PurchaseDraft, error)
+	OpenPurchaseDrafts(ctx context.Context, rifaID string, userID string, limite int) ([]model.PurchaseDraft, error)
+
+	// Cuotas
+	UpdateInstallmentPlan(ctx context.Context, compraID string, estado string, pagadas int, cambio model.CambioPlanCuotas) (bool, error)
+	OverdueInstallmentPlans(ctx context.Context, ahora time.Time, limite int) ([]model.PurchaseDraft, error)
+	UpdateInstallmentTickets(ctx context.Context, paymentIntentID string, rifaID string, numeros []int, pagado int64, total int64) error
+
+	// Tickets
+	InsertTickets(ctx context.Context, rifaID string, numeros []int, userID string, pago model.PagoTickets) ([]model.TicketRegistrado, error)
+	DeleteTickets(ctx context.Context, paymentIntentID string) error
+	SetTicketsStatus(ctx context.Context, paymentIntentID string, numeros []int, estado string) error
+	HoldTickets(ctx context.Context, paymentIntentID string) (int, error)
+	ReleaseHeldTickets(ctx context.Context, paymentIntentID string) (int, error)
+	TicketsByPaymentIntent(ctx context.Context, paymentIntentID string) ([]int, error)
+	PaymentIntentTickets(ctx context.Context, paymentIntentID string) ([]model.TicketAdmin, error)
+	VerifiableTickets(ctx context.Context, rifaID string, paymentIntentID string) ([]model.TicketVerificable, error)
+	ListTickets(ctx context.Context, rifaID string, filtro model.FiltroTickets) ([]model.TicketAdmin, error)
+	UserTickets(ctx context.Context, userID string) ([]model.TicketUsuario, error)
+	TransferTicket(ctx context.Context, rifaID string, numero int, deProfileID string, aProfileID string) (bool, error)
+	GetProfile(ctx context.Context, id string, email string) (*model.Perfil, error)
+	RecordFailedRegistration(ctx context.Context, fallo map[string]interface{}) error
+	RecordPriceMismatch(ctx context.Context, diferencia *model.DiferenciaPrecio) error
+	CreateReceipt(ctx context.Context, recibo *model.Recibo) (*model.Recibo, error)
+
+	// Códigos promocionales
+	GetPromoCode(ctx context.Context, codigo string) (*model.CodigoPromo, error)
+	CountPromoRedemptions(ctx context.Context, codigo string) (int, error)
+	RecordPromoRedemption(ctx context.Context, codigo string, paymentIntentID string, expira time.Time) error
+	RedeemPromoCode(ctx context.Context, codigo string, paymentIntentID string) error
+	ReleasePromoRedemption(ctx context.Context, paymentIntentID string) error
+
+	// Referidos
+	GetReferrer(ctx context.Context, codigo string) (*model.Referente, error)
+	RecordReferralCredit(ctx context.Context, credito *model.CreditoReferido) error
+	GetReferralCredit(ctx context.Context, paymentIntentID string) (*model.CreditoReferido, error)
+	ClawBackReferralCredit(ctx context.Context, paymentIntentID string, descontado int64) error
+	ReferralCredits(ctx context.Context, codigo string) ([]model.CreditoReferido, error)
+
+	// Webhook, disputas y sorteos
+	IsEventProcessed(ctx context.Context, eventID string) (bool, error)
+	MarkEventProcessed(ctx context.Context, eventID string, tipo string) error
+	BlockBuyer(ctx context.Context, bloqueo *model.CompradorBloqueado) error
+	IsBuyerBlocked(ctx context.Context, email string, userID string) (bool, error)
+	ListBlockedBuyers(ctx context.Context, email string) ([]model.CompradorBloqueado, error)
+	UnblockBuyer(ctx context.Context, id int64) (bool, error)
+	InsertDraw(ctx context.Context, sorteo *model.Sorteo) error
+	LatestDraw(ctx context.Context, rifaID string) (*model.Sorteo, error)
+	ClaimDrawNotification(ctx context.Context, n *model.NotificacionSorteo) (bool, error)
+	FinishDrawNotification(ctx context.Context, n *model.NotificacionSorteo) error
+
+	// Trabajos del webhook
+	EnqueueJob(ctx context.Context, trabajo *model.PendingJob) (*model.PendingJob, error)
+	DueJobs(ctx context.Context, limite int) ([]model.PendingJob, error)
+	UpdateJob(ctx context.Context, trabajo *model.PendingJob) error
+	DeleteJob(ctx context.Context, id int64) error
+
+	// Outbox de correos y avisos
+	EnqueueOutbox(ctx context.Context, entradas []model.OutboxEntry) error
+	DueOutbox(ctx context.Context, limite int) ([]model.OutboxEntry, error)
+	ClaimOutbox(ctx context.Context, entrada *model.OutboxEntry, hasta time.Time) (bool, error)
+	UpdateOutbox(ctx context.Context, entrada *model.OutboxEntry) error
+	ListOutbox(ctx context.Context, estado string, limite int) ([]model.OutboxEntry, error)
+	RequeueOutbox(ctx context.Context, id int64) (*model.OutboxEntry, error)
+	OutboxBacklog(ctx context.Context) (int, time.Time, error)
+
+	// Correos fallidos
+	RecordEmailFailure(ctx context.Context, fallo *model.EmailFailure) error
+	PendingEmailFailures(ctx context.Context, limite int) ([]model.EmailFailure, error)
+	UpdateEmailFailure(ctx context.Context, id int64, ultimoError string) error
+	DeleteEmailFailure(ctx context.Context, id int64) error
+
+	// Resumen diario
+	TicketsSoldSince(ctx context.Context, desde time.Time) ([]model.TicketVendido, error)
+	ClaimDigest(ctx context.Context, dia string) (bool, error)
+	ReleaseDigest(ctx context.Context, dia string) error
+
+	// Entrega de correos (webhooks de Resend)
+	RecordEmailEvent(ctx context.Context, evento *model.EventoCorreo) error
+	FlagUndeliverableEmail(ctx context.Context, email string, motivo string, messageID string) error
+	UndeliverableEmails(ctx context.Context, emails []string) (map[string]bool, error)
+
+	// Lista de espera de números vendidos
+	AddWaitlistEntry(ctx context.Context, entrada *model.EntradaEspera) (*model.EntradaEspera, error)
+	UserWaitlist(ctx context.Context, rifaID string, userID string) ([]model.EntradaEspera, error)
+	CancelWaitlistEntry(ctx context.Context, rifaID string, userID string, numero int) (bool, error)
+	NextWaitlistEntry(ctx context.Context, rifaID string, numero int) (*model.EntradaEspera, error)
+	MarkWaitlistNotified(ctx context.Context, id int64, hasta time.Time) (bool, error)
+	ExpiredWaitlistClaims(ctx context.Context, limite int) ([]model.EntradaEspera, error)
+	ExpireWaitlistEntry(ctx context.Context, id int64) (bool, error)
+
+	// Privacidad
+	EraseUserData(ctx context.Context, userID string, email string, tombstoneID string) (*model.DatosBorrados, error)
+
+	// Auditoría (audit_log, sólo inserts)
+	RecordAuditEntries(ctx context.Context, entradas []model.EntradaAuditoria) error
+	ListAuditEntries(ctx context.Context, filtro model.FiltroAuditoria) ([]model.EntradaAuditoria, error)
+}
+
+// PaymentProvider son las llamadas a Stripe. Los parámetros y errores son los
+// de stripe-go, así los handlers siguen leyendo *stripe.Error igual que antes;
+// el contexto reemplaza al params.Context que tenga el llamador (params puede
+// ser nil en Get y Cancel).
+type PaymentProvider interface {
+	CreateIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	GetIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	// ListIntents llama a fn con cada intent de la lista, página por página
+	ListIntents(ctx context.Context, params *stripe.PaymentIntentListParams, fn func(*stripe.PaymentIntent) error) error
+	CancelIntent(ctx context.Context, id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error)
+	CreateRefund(ctx context.Context, params *stripe.RefundParams) (*stripe.Refund, error)
+	// ConstructEvent valida la firma del webhook con el secreto del endpoint
+	ConstructEvent(ctx context.Context, payload []byte, signature string) (stripe.Event, error)
+	Ping(ctx context.Context) error
+}
+
+// PayPalProvider son las llamadas a la API de Orders de PayPal; la
+// implementación real es *payments.PayPal. Los montos van en la unidad menor,
+// como en Stripe.
+type PayPalProvider interface {
+	CreateOrder(ctx context.Context, orden payments.NuevaOrdenPayPal, requestID string) (*payments.OrdenPayPal, error)
+	GetOrder(ctx context.Context, id string) (*payments.OrdenPayPal, error)
+	CaptureOrder(ctx context.Context, id string, requestID string) (*payments.OrdenPayPal, error)
+	RefundCapture(ctx context.Context, captureID string, requestID string) error
+	// VerifyWebhook devuelve payments.ErrFirmaPayPal si la firma no es de PayPal
+	VerifyWebhook(ctx context.Context, cabeceras http.Header, cuerpo []byte) error
+}
+
+// MercadoPagoProvider son las llamadas a la API de Checkout Pro; la
+// implementación real es *payments.MercadoPago
+type MercadoPagoProvider interface {
+	CreatePreference(ctx context.Context, preferencia payments.NuevaPreferenciaMP) (*payments.PreferenciaMP, error)
+	GetPayment(ctx context.Context, id string) (*payments.PagoMP, error)
+	SearchPayments(ctx context.Context, externalReference string) ([]*payments.PagoMP, error)
+	RefundPayment(ctx context.Context, id string, claveIdempotencia string) error
+	// VerifyWebhook devuelve payments.ErrFirmaMercadoPago si x-signature no es válida
+	VerifyWebhook(cabeceras http.Header, dataID string) error
+}
+
+// CaptchaVerifier valida un token del widget de captcha; la implementación
+// real es *captcha.Verificador. Un token rechazado es *captcha.ErrTokenInvalido.
+type CaptchaVerifier interface {
+	Verificar(ctx context.Context, token string, ip string) (*captcha.Resultado, error)
+}
+
+// Notifier manda un aviso de texto al organizador (*avisos.Telegram, *avisos.Slack)
+type Notifier interface {
+	Nombre() string
+	Notificar(ctx context.Context, texto string) error
+}
+
+// Mailer envía un correo ya renderizado; las plantillas quedan de este lado.
+// La implementación real es *mail.FailoverMailer.
+type Mailer interface {
+	// Send devuelve el ID del mensaje en Resend, o "" si salió por SMTP
+	Send(ctx context.Context, marca mail.Marca, destinatario string, asunto string, html string, texto string, adjuntos ...mail.Adjunto) (string, error)
+	// Probar envía sólo por el proveedor activo y devuelve su nombre
+	Probar(ctx context.Context, marca mail.Marca, destinatario string, asunto string, html string, texto string) (string, error)
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"github.com/stripe/stripe-go/v84/webhook"
+
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/model"
+)
+
+// Estas pruebas llaman a los métodos del Server con peticiones armadas a mano:
+// cubren los handlers contra Store, PaymentProvider y Mailer falsos, no el
+// ruteo ni los middlewares de main.go.
+
+const (
+	rifaPrueba    = "0b7c6a52-3f1e-4d8a-9c2b-5e4f6a7b8c9d"
+	usuarioPrueba = "5d1e2f3a-4b5c-4d6e-8f7a-9b0c1d2e3f4a"
+	secretoPrueba = "whsec_prueba"
+)
+
+// storeCompras es un Store con una rifa a la venta para los handlers de
+// compra. errRifa y errNumeros simulan una caída de Supabase; anota las
+// reservas y borradores guardados.
+type storeCompras struct {
+	Store
+	ocupados   []int
+	errRifa    error
+	errNumeros error
+	reservados []int
+	borradores []model.PurchaseDraft
+}
+
+func (f *storeCompras) GetRifa(_ context.Context, id string) (*model.Rifa, error) {
+	if f.errRifa != nil {
+		return nil, f.errRifa
+	}
+	return &model.Rifa{ID: id, Title: "Rifa de prueba", Price: 5, Currency: "usd", TotalNumbers: 100, Status: "active"}, nil
+}
+
+func (f *storeCompras) SoldNumbers(_ context.Context, _ string) ([]int, error) {
+	return nil, nil
+}
+
+func (f *storeCompras) IsBuyerBlocked(_ context.Context, _, _ string) (bool, error) {
+	return false, nil
+}
+
+func (f *storeCompras) BuyerOpenPurchaseDrafts(_ context.Context, _, _, _ string) ([]model.PurchaseDraft, error) {
+	return nil, nil
+}
+
+func (f *storeCompras) CheckNumbers(_ context.Context, _ string, _ []int) ([]int, error) {
+	return f.ocupados, f.errNumeros
+}
+
+func (f *storeCompras) GetProfile(_ context.Context, id string, _ string) (*model.Perfil, error) {
+	return &model.Perfil{ID: id, CreatedAt: time.Now().AddDate(0, -1, 0)}, nil
+}
+
+func (f *storeCompras) ReserveNumbers(_ context.Context, _ string, numeros []int, _ string, _ string) error {
+	f.reservados = append(f.reservados, numeros...)
+	return nil
+}
+
+func (f *storeCompras) SavePurchaseDraft(_ context.Context, compra *model.PurchaseDraft) error {
+	f.borradores = append(f.borradores, *compra)
+	return nil
+}
+
+// storeCorreos es un Store con correos fallidos por reintentar; anota cuáles
+// se borraron y cuáles se actualizaron con el error nuevo
+type storeCorreos struct {
+	Store
+	fallos       []model.EmailFailure
+	borrados     []int64
+	actualizados []int64
+}
+
+func (f *storeCorreos) PendingEmailFailures(_ context.Context, _ int) ([]model.EmailFailure, error) {
+	return f.fallos, nil
+}
+
+func (f *storeCorreos) DeleteEmailFailure(_ context.Context, id int64) error {
+	f.borrados = append(f.borrados, id)
+	return nil
+}
+
+func (f *storeCorreos) RecordEmailEvent(_ context.Context, _ *model.EventoCorreo) error {
+	return nil
+}
+
+func (f *storeCorreos) UpdateEmailFailure(_ context.Context, id int64, _ string) error {
+	f.actualizados = append(f.actualizados, id)
+	return nil
+}
+
+// pagosFalsos crea intents sin llamar a Stripe y valida la firma del webhook
+// con secretoPrueba, como el PaymentProvider real
+type pagosFalsos struct {
+	PaymentProvider
+	creados []*stripe.PaymentIntentParams
+}
+
+func (p *pagosFalsos) CreateIntent(_ context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	p.creados = append(p.creados, params)
+	return &stripe.PaymentIntent{ID: "pi_prueba", ClientSecret: "pi_prueba_secret", Amount: *params.Amount, Currency: stripe.Currency(*params.Currency)}, nil
+}
+
+func (p *pagosFalsos) ConstructEvent(_ context.Context, payload []byte, signature string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, secretoPrueba)
+}
+
+// correoFalso anota los destinatarios; con err falla cada envío
+type correoFalso struct {
+	enviados []string
+	err      error
+}
+
+func (c *correoFalso) Send(_ context.Context, _ mail.Marca, destinatario string, _ string, _ string, _ string, _ ...mail.Adjunto) (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	c.enviados = append(c.enviados, destinatario)
+	return "msg_prueba", nil
+}
+
+func (c *correoFalso) Probar(ctx context.Context, marca mail.Marca, destinatario string, asunto string, html string, texto string) (string, error) {
+	_, err := c.Send(ctx, marca, destinatario, asunto, html, texto)
+	return "resend", err
+}
+
+func servidorPrueba(db Store, pagos PaymentProvider, correo Mailer) *Server {
+	cfg := &config.Config{MaxNumerosPerPurchase: 10, ReservationTTL: 15 * time.Minute, PriceUnit: "major"}
+	return NewServer(cfg, db, pagos, nil, nil, nil, correo)
+}
+
+// conSesion es la petición como la deja el middleware de sesión con un JWT válido
+func conSesion(r *http.Request) *http.Request {
+	usuario := &UsuarioAutenticado{Sub: usuarioPrueba, Email: "ana@example.com"}
+	return r.WithContext(context.WithValue(r.Context(), claveUsuario{}, usuario))
+}
+
+func TestCreatePaymentIntent(t *testing.T) {
+	casos := []struct {
+		nombre     string
+		ocupados   []int
+		errRifa    error
+		errNumeros error
+		status     int
+		code       string
+	}{
+		{nombre: "compra", status: http.StatusOK},
+		{nombre: "números ocupados", ocupados: []int{7}, status: http.StatusConflict, code: "NUMBERS_TAKEN"},
+		{nombre: "falla leyendo la rifa", errRifa: errors.New("conexión rechazada"), status: http.StatusInternalServerError},
+		{nombre: "falla verificando los números", errNumeros: errors.New("conexión rechazada"), status: http.StatusServiceUnavailable, code: "AVAILABILITY_UNVERIFIED"},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			db := &storeCompras{ocupados: c.ocupados, errRifa: c.errRifa, errNumeros: c.errNumeros}
+			pagos := &pagosFalsos{}
+			s := servidorPrueba(db, pagos, &correoFalso{})
+
+			cuerpo := `{"rifaId":"` + rifaPrueba + `","numeros":[7,12]}`
+			r := httptest.NewRequest(http.MethodPost, "/payments/create-intent", strings.NewReader(cuerpo))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			s.CreatePaymentIntent(w, conSesion(r))
+
+			if w.Code != c.status {
+				t.Fatalf("status = %d, se esperaba %d (%s)", w.Code, c.status, w.Body.String())
+			}
+			if c.status != http.StatusOK {
+				if c.code != "" {
+					var respuesta model.ErrorResponse
+					if err := json.Unmarshal(w.Body.Bytes(), &respuesta); err != nil || respuesta.Code != c.code {
+						t.Errorf("respuesta = %s, se esperaba code %s", w.Body.String(), c.code)
+					}
+				}
+				if len(pagos.creados) != 0 || len(db.reservados) != 0 {
+					t.Errorf("se creó el intent o se reservó igual: %d intents, reservados %v", len(pagos.creados), db.reservados)
+				}
+				return
+			}
+
+			var respuesta struct {
+				ClientSecret string `json:"clientSecret"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &respuesta); err != nil || respuesta.ClientSecret != "pi_prueba_secret" {
+				t.Errorf("respuesta = %s", w.Body.String())
+			}
+			if len(pagos.creados) != 1 || *pagos.creados[0].Amount != 1000 {
+				t.Fatalf("intents creados = %d, se esperaba uno de 1000 centavos", len(pagos.creados))
+			}
+			if !slices.Equal(db.reservados, []int{7, 12}) {
+				t.Errorf("reservados = %v", db.reservados)
+			}
+			if len(db.borradores) != 1 || db.borradores[0].PaymentIntentID != "pi_prueba" || db.borradores[0].UserID != usuarioPrueba {
+				t.Errorf("borradores = %+v", db.borradores)
+			}
+		})
+	}
+}
+
+func TestHandleStripeWebhookFirma(t *testing.T) {
+	payload := []byte(`{"id":"evt_1","object":"event","api_version":"` + stripe.APIVersion + `","type":"payment_intent.succeeded"}`)
+	casos := map[string]string{
+		"sin firma":       "",
+		"otro secreto":    webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: "whsec_otro"}).Header,
+		"firma alterada":  strings.Replace(webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secretoPrueba}).Header, "v1=", "v1=00", 1),
+		"firma no parsea": "basura",
+	}
+	for nombre, firma := range casos {
+		t.Run(nombre, func(t *testing.T) {
+			// Un Store sin métodos: con la firma inválida no se debe tocar la base
+			s := servidorPrueba(&storeCompras{}, &pagosFalsos{}, &correoFalso{})
+			r := httptest.NewRequest(http.MethodPost, "/payments/webhook", strings.NewReader(string(payload)))
+			r.Header.Set("Stripe-Signature", firma)
+			w := httptest.NewRecorder()
+			s.HandleStripeWebhook(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, se esperaba 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestRetryEmailFailures(t *testing.T) {
+	casos := []struct {
+		nombre       string
+		err          error
+		enviados     []string
+		borrados     []int64
+		actualizados []int64
+	}{
+		{nombre: "reenviado", enviados: []string{"ana@example.com"}, borrados: []int64{3}},
+		{nombre: "el proveedor rechaza", err: errors.New("dominio sin verificar"), actualizados: []int64{3}},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			db := &storeCorreos{fallos: []model.EmailFailure{{ID: 3, Email: "ana@example.com", RifaTitle: "Rifa de prueba", Numeros: []int{7}}}}
+			correo := &correoFalso{err: c.err}
+			s := servidorPrueba(db, &pagosFalsos{}, correo)
+			w := httptest.NewRecorder()
+			s.RetryEmailFailures(w, httptest.NewRequest(http.MethodPost, "/admin/emails/retry", nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, se esperaba 200 (%s)", w.Code, w.Body.String())
+			}
+			if !slices.Equal(correo.enviados, c.enviados) {
+				t.Errorf("enviados = %v, se esperaba %v", correo.enviados, c.enviados)
+			}
+			if !slices.Equal(db.borrados, c.borrados) || !slices.Equal(db.actualizados, c.actualizados) {
+				t.Errorf("borrados = %v, actualizados = %v", db.borrados, db.actualizados)
+			}
+		})
+	}
+}
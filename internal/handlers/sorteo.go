@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+)
+
+// DrawResponse es la respuesta de POST /admin/rifas/{id}/draw
+type DrawResponse struct {
+	RifaID        string `json:"rifaId"`
+	WinningNumber int    `json:"winningNumber"`
+	ProfileID     string `json:"profileId"`
+	Email         string `json:"email"`
+	DrawnAt       string `json:"drawnAt"`
+	Seed          string `json:"seed"`
+	TicketsHash   string `json:"ticketsHash"`
+	TotalTickets  int    `json:"totalTickets"`
+	Forced        bool   `json:"forced"`
+}
+
+// DrawRifa sortea el ganador de una rifa cerrada. Se niega a sortear dos
+// veces salvo con ?force=true; el sorteo anterior queda en draws para auditoría.
+// No manda correos: el ganador y los demás compradores se enteran con
+// POST /admin/rifas/{id}/announce.
+func (s *Server) DrawRifa(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rifaID := r.PathValue("id")
+	rifa, err := s.db.GetRifa(ctx, rifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, rifaID, err)
+		return
+	}
+	if !strings.EqualFold(rifa.Status, "closed") {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{
+			Error: "La rifa debe estar cerrada para sortear",
+			Code:  "RIFA_NOT_CLOSED",
+		})
+		return
+	}
+
+	forzar := r.URL.Query().Get("force") == "true"
+	anterior, err := s.db.LatestDraw(ctx, rifaID)
+	if err != nil && !errors.Is(err, model.ErrSorteoNoEncontrado) {
+		slog.ErrorContext(ctx, "error consultando sorteos", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error consultando sorteos", 500)
+		return
+	}
+	if anterior != nil && !forzar {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{
+			Error:   "La rifa ya tiene ganador; usa force=true para sortear de nuevo",
+			Code:    "ALREADY_DRAWN",
+			Details: map[string]interface{}{"winningNumber": anterior.WinningNumber, "drawnAt": anterior.DrawnAt},
+		})
+		return
+	}
+
+	tickets, err := s.todosLosTickets(ctx, rifaID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error leyendo tickets para el sorteo", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error leyendo tickets", 500)
+		return
+	}
+	if len(tickets) == 0 {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{
+			Error: "La rifa no tiene números vendidos",
+			Code:  "NO_TICKETS",
+		})
+		return
+	}
+
+	semilla := make([]byte, 32)
+	if _, err := rand.Read(semilla); err != nil {
+		slog.ErrorContext(ctx, "error generando la semilla", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error sorteando", 500)
+		return
+	}
+	huella, indice := verificarSorteo(hex.EncodeToString(semilla), tickets)
+	ganador := tickets[indice]
+
+	sorteo := &model.Sorteo{
+		RifaID:        rifaID,
+		WinningNumber: ganador.Number,
+		ProfileID:     ganador.ProfileID,
+		Email:         ganador.Email,
+		DrawnAt:       time.Now().UTC().Format(time.RFC3339),
+		Seed:          hex.EncodeToString(semilla),
+		TicketsHash:   huella,
+		TotalTickets:  len(tickets),
+		Forced:        anterior != nil,
+	}
+	if err := s.db.InsertDraw(ctx, sorteo); err != nil {
+		slog.ErrorContext(ctx, "error guardando el sorteo", logging.ConError(err, "rifa_id", rifaID)...)
+		http.Error(w, "Error guardando el sorteo", 500)
+		return
+	}
+	slog.InfoContext(ctx, "sorteo realizado", "rifa_id", rifaID, "winning_number", sorteo.WinningNumber, "profile_id", sorteo.ProfileID, "total_tickets", sorteo.TotalTickets, "forced", sorteo.Forced)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action: model.AuditoriaSorteo,
+		RifaID: rifaID,
+		Detail: map[string]interface{}{
+			"winning_number": sorteo.WinningNumber,
+			"profile_id":     sorteo.ProfileID,
+			"seed":           sorteo.Seed,
+			"tickets_hash":   sorteo.TicketsHash,
+			"total_tickets":  sorteo.TotalTickets,
+			"forced":         sorteo.Forced,
+		},
+	})
+
+	writeJSON(w, http.StatusOK, DrawResponse{
+		RifaID:        sorteo.RifaID,
+		WinningNumber: sorteo.WinningNumber,
+		ProfileID:     sorteo.ProfileID,
+		Email:         sorteo.Email,
+		DrawnAt:       sorteo.DrawnAt,
+		Seed:          sorteo.Seed,
+		TicketsHash:   sorteo.TicketsHash,
+		TotalTickets:  sorteo.TotalTickets,
+		Forced:        sorteo.Forced,
+	})
+}
+
+// verificarSorteo es el cálculo reproducible del ganador: tickets_hash es el
+// sha256 de los números vendidos ordenados y separados por coma, y el índice
+// ganador es sha256(seed + ":" + tickets_hash) como entero módulo la cantidad
+// de tickets. tickets debe venir ordenado por número.
+func verificarSorteo(semilla string, tickets []model.TicketAdmin) (huella string, indice int) {
+	numeros := make([]int, len(tickets))
+	for i, t := range tickets {
+		numeros[i] = t.Number
+	}
+	suma := sha256.Sum256([]byte(store.ListaNumeros(numeros)))
+	huella = hex.EncodeToString(suma[:])
+
+	mezcla := sha256.Sum256([]byte(semilla + ":" + huella))
+	n := new(big.Int).SetBytes(mezcla[:])
+	return huella, int(n.Mod(n, big.NewInt(int64(len(tickets)))).Int64())
+}
+
+// todosLosTickets lee todos los tickets de la rifa en páginas, ordenados por número
+func (s *Server) todosLosTickets(ctx context.Context, rifaID string) ([]model.TicketAdmin, error) {
+	var todos []model.TicketAdmin
+	filtro := model.FiltroTickets{SoloVigentes: true, Limit: paginaExport}
+	for {
+		pagina, err := s.db.ListTickets(ctx, rifaID, filtro)
+		if err != nil {
+			return nil, fmt.Errorf("tickets después del %d: %w", filtro.DespuesDe, err)
+		}
+		todos = append(todos, pagina...)
+		if len(pagina) < paginaExport {
+			return todos, nil
+		}
+		filtro.DespuesDe = pagina[len(pagina)-1].Number
+	}
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/metrics"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+	"PaymentsGo/internal/tracing"
+)
+
+// Reintentos de un trabajo del webhook: la espera se duplica en cada intento
+// (10s, 20s, 40s...), unos 20 minutos en total antes de abandonarlo
+const (
+	intentosTrabajo      = 8
+	esperaInicialTrabajo = 10 * time.Second
+	// intervaloBarrido es cada cuánto se buscan en pending_jobs los trabajos
+	// que vencieron su espera o que no entraron en la cola
+	intervaloBarrido = 10 * time.Second
+	capacidadCola    = 100
+	// maxRetenidos limita los eventos que se guardan en memoria mientras el
+	// circuito de Supabase está abierto
+	maxRetenidos = 1000
+)
+
+var (
+	trabajosEnCola   = metrics.NewGauge("webhook_queue_depth", "Trabajos del webhook en la cola o procesándose")
+	trabajosFallidos = metrics.NewCounter("webhook_jobs_failed_total", "Trabajos del webhook abandonados tras agotar los reintentos")
+	eventosRetenidos = metrics.NewGauge("webhook_events_held", "Eventos del webhook en memoria esperando que Supabase vuelva para guardarse en pending_jobs")
+)
+
+// errPermanente marca un error que no se arregla reintentando el trabajo
+type errPermanente struct {
+	error
+}
+
+func (e errPermanente) Unwrap() error {
+	return e.error
+}
+
+func permanente(err error) error {
+	return errPermanente{err}
+}
+
+// colaTrabajos lleva a los workers los trabajos de pending_jobs. La tabla es la
+// fuente de verdad: la cola sólo evita consultarla por cada evento, y un
+// trabajo que no entra se queda en la tabla hasta el próximo barrido.
+type colaTrabajos struct {
+	canal chan model.PendingJob
+
+	mu sync.Mutex
+	// enCurso son los trabajos que están en el canal o procesándose, para que
+	// el barrido no los encole dos veces
+	enCurso map[int64]bool
+	// retenidos son eventos que llegaron con el circuito de Supabase abierto y
+	// todavía no están en pending_jobs; se pierden si el proceso termina antes
+	retenidos []model.PendingJob
+}
+
+func nuevaColaTrabajos(capacidad int) *colaTrabajos {
+	return &colaTrabajos{canal: make(chan model.PendingJob, capacidad), enCurso: map[int64]bool{}}
+}
+
+// encolar no bloquea nunca: con la cola llena devuelve false
+func (c *colaTrabajos) encolar(trabajo model.PendingJob) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enCurso[trabajo.ID] {
+		return true
+	}
+	select {
+	case c.canal <- trabajo:
+		c.enCurso[trabajo.ID] = true
+		trabajosEnCola.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+// retener guarda en memoria un trabajo que no se pudo escribir en
+// pending_jobs; con maxRetenidos ya retenidos devuelve false
+func (c *colaTrabajos) retener(trabajo model.PendingJob) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range c.retenidos {
+		if t.EventID == trabajo.EventID {
+			return true
+		}
+	}
+	if len(c.retenidos) >= maxRetenidos {
+		return false
+	}
+	c.retenidos = append(c.retenidos, trabajo)
+	eventosRetenidos.Set(int64(len(c.retenidos)))
+	return true
+}
+
+// tomarRetenidos entrega los retenidos y deja la lista vacía
+func (c *colaTrabajos) tomarRetenidos() []model.PendingJob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	retenidos := c.retenidos
+	c.retenidos = nil
+	eventosRetenidos.Set(0)
+	return retenidos
+}
+
+func (c *colaTrabajos) terminar(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.enCurso, id)
+	trabajosEnCola.Add(-1)
+}
+
+// IniciarTrabajos arranca los workers del webhook y el barrido de
+// pending_jobs. El primer barrido corre enseguida, así que los trabajos que
+// quedaron sin terminar antes de un reinicio se retoman al arrancar. Cuando
+// ctx se cancela dejan de tomar trabajos; el que está en curso termina y se
+// cuenta en TareasPendientes.
+func (s *Server) IniciarTrabajos(ctx context.Context) {
+	for i := 0; i < s.cfg.WebhookWorkers; i++ {
+		go s.worker(ctx)
+	}
+	go s.barrerTrabajos(ctx)
+}
+
+func (s *Server) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case trabajo := <-s.trabajos.canal:
+			TareasPendientes.Add(1)
+			s.procesarTrabajo(context.WithoutCancel(ctx), trabajo)
+			TareasPendientes.Done()
+		}
+	}
+}
+
+func (s *Server) barrerTrabajos(ctx context.Context) {
+	for {
+		s.guardarRetenidos(ctx)
+		trabajos, err := s.db.DueJobs(ctx, capacidadCola)
+		if err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "error buscando trabajos pendientes", logging.ConError(err)...)
+		}
+		for _, t := range trabajos {
+			if !s.trabajos.encolar(t) {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if retenidos := s.trabajos.tomarRetenidos(); len(retenidos) > 0 {
+				// Stripe ya recibió 200: hay que reenviarlos desde el dashboard
+				ids := make([]string, len(retenidos))
+				for i, t := range retenidos {
+					ids[i] = t.EventID
+				}
+				slog.ErrorContext(ctx, "eventos del webhook retenidos sin guardar al apagar", "event_ids", ids)
+			}
+			return
+		case <-time.After(intervaloBarrido):
+		}
+	}
+}
+
+// guardarRetenidos pasa a pending_jobs los eventos retenidos con el circuito
+// abierto; los que no se pueden guardar esperan al próximo barrido
+func (s *Server) guardarRetenidos(ctx context.Context) {
+	retenidos := s.trabajos.tomarRetenidos()
+	for i, t := range retenidos {
+		trabajo, err := s.db.EnqueueJob(ctx, &t)
+		if err != nil {
+			for _, pendiente := range retenidos[i:] {
+				s.trabajos.retener(pendiente)
+			}
+			return
+		}
+		slog.InfoContext(ctx, "evento retenido guardado", "event_id", t.EventID, "event_type", t.EventType)
+		if trabajo != nil {
+			s.trabajos.encolar(*trabajo)
+		}
+	}
+}
+
+// procesarTrabajo procesa el evento guardado y deja el resultado en
+// pending_jobs: lo borra si salió bien, programa el próximo intento si no, y
+// lo marca failed (queda en la tabla para revisarlo) si agotó los intentos.
+func (s *Server) procesarTrabajo(ctx context.Context, trabajo model.PendingJob) {
+	defer s.trabajos.terminar(trabajo.ID)
+	if trabajo.RequestID != "" {
+		ctx = logging.ConRequestID(ctx, trabajo.RequestID)
+	}
+	ctx, span := tracer.Start(ctx, "webhook.job", trace.WithAttributes(
+		attribute.String("stripe.event_id", trabajo.EventID),
+		attribute.String("stripe.event_type", trabajo.EventType),
+		attribute.Int("intento", trabajo.Attempts+1),
+	))
+	// El plazo es sólo para el evento: el resultado se guarda aunque haya vencido
+	ctxEvento, cancel := context.WithTimeout(ctx, s.cfg.WebhookTimeout)
+	err := s.ejecutarTrabajo(ctxEvento, trabajo)
+	cancel()
+	tracing.Fin(span, err)
+
+	if err == nil {
+		if err := s.db.DeleteJob(ctx, trabajo.ID); err != nil {
+			// El evento ya quedó marcado: el próximo barrido lo encuentra procesado y lo borra
+			slog.WarnContext(ctx, "no se pudo borrar el trabajo terminado", logging.ConError(err, "event_id", trabajo.EventID)...)
+		}
+		return
+	}
+
+	var abierto *store.ErrCircuitoAbierto
+	if errors.As(err, &abierto) {
+		// No cuenta como intento: la fila sigue pending y el barrido la vuelve a
+		// tomar cuando Supabase responda
+		slog.WarnContext(ctx, "trabajo del webhook pospuesto con el circuito de Supabase abierto", "event_id", trabajo.EventID, "event_type", trabajo.EventType)
+		return
+	}
+	trabajo.Attempts++
+	trabajo.LastError = err.Error()
+	var permanenteErr errPermanente
+	if errors.As(err, &permanenteErr) || trabajo.Attempts >= intentosTrabajo {
+		trabajo.Status = model.TrabajoFallido
+		trabajosFallidos.Inc()
+		slog.ErrorContext(ctx, "trabajo del webhook abandonado", logging.ConError(err, "event_id", trabajo.EventID, "event_type", trabajo.EventType, "intentos", trabajo.Attempts)...)
+	} else {
+		espera := esperaInicialTrabajo << (trabajo.Attempts - 1)
+		trabajo.NextAttemptAt = time.Now().Add(espera)
+		slog.WarnContext(ctx, "trabajo del webhook falló, se reintentará", logging.ConError(err, "event_id", trabajo.EventID, "event_type", trabajo.EventType, "intento", trabajo.Attempts, "espera", espera.String())...)
+	}
+	if err := s.db.UpdateJob(ctx, &trabajo); err != nil {
+		// Sigue pending con la espera vieja: el barrido lo reintenta antes de tiempo
+		slog.ErrorContext(ctx, "no se pudo actualizar el trabajo", logging.ConError(err, "event_id", trabajo.EventID)...)
+	}
+}
+
+// ejecutarTrabajo procesa el evento salvo que ya esté en webhook_events, y lo
+// marca al terminar
+func (s *Server) ejecutarTrabajo(ctx context.Context, trabajo model.PendingJob) error {
+	procesado, err := s.eventoProcesado(ctx, trabajo.EventID)
+	if err != nil {
+		return fmt.Errorf("verificando el evento: %w", err)
+	}
+	if procesado {
+		return nil
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal(trabajo.Payload, &event); err != nil {
+		return permanente(fmt.Errorf("payload inválido: %w", err))
+	}
+	if err := s.procesarEvento(ctx, event); err != nil {
+		return err
+	}
+	if err := s.marcarEventoProcesado(ctx, event.ID, string(event.Type)); err != nil {
+		slog.WarnContext(ctx, "no se pudo marcar el evento como procesado", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+)
+
+// TramoPrecio es un elemento de la columna price_tiers: desde MinQty números
+// cada uno cuesta UnitPrice, en la misma unidad que price (ver UnidadPrecio).
+// "5 por $20" es {"minQty": 5, "unitPrice": 4}; como price, es entero, así que
+// "10 por $35" necesita price_unit "minor" ({"minQty": 10, "unitPrice": 350}).
+type TramoPrecio struct {
+	MinQty    int   `json:"minQty"`
+	UnitPrice int64 `json:"unitPrice"`
+}
+
+// tramosPrecio lee price_tiers. Un JSON ilegible no bloquea la venta: se
+// registra y la rifa se cobra con el precio fijo. Los tramos con cantidad o
+// precio inválidos se descartan.
+func tramosPrecio(ctx context.Context, rifa *model.Rifa) []TramoPrecio {
+	if len(rifa.PriceTiers) == 0 || string(rifa.PriceTiers) == "null" {
+		return nil
+	}
+	var tramos []TramoPrecio
+	if err := json.Unmarshal(rifa.PriceTiers, &tramos); err != nil {
+		slog.WarnContext(ctx, "price_tiers inválido, se usa el precio fijo", logging.ConError(err, "rifa_id", rifa.ID)...)
+		return nil
+	}
+	validos := tramos[:0]
+	for _, t := range tramos {
+		if t.MinQty < 1 || t.UnitPrice < 0 {
+			slog.WarnContext(ctx, "tramo de precio descartado", "rifa_id", rifa.ID, "min_qty", t.MinQty, "unit_price", t.UnitPrice)
+			continue
+		}
+		validos = append(validos, t)
+	}
+	return validos
+}
+
+// tramoAplicable elige el tramo con el precio unitario más bajo entre los que
+// alcanza la cantidad. Devuelve nil y el precio fijo si ninguno mejora price.
+func tramoAplicable(tramos []TramoPrecio, precioFijo int64, cantidad int) (*TramoPrecio, int64) {
+	var elegido *TramoPrecio
+	precio := precioFijo
+	for i, t := range tramos {
+		if t.MinQty <= cantidad && t.UnitPrice < precio {
+			elegido, precio = &tramos[i], t.UnitPrice
+		}
+	}
+	return elegido, precio
+}
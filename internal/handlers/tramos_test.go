@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"PaymentsGo/internal/model"
+)
+
+func TestTramoAplicable(t *testing.T) {
+	// en unidad menor: price 500, "5 por $20" y "10 por $35"
+	rifa := &model.Rifa{ID: "r1", PriceTiers: json.RawMessage(`[{"minQty":10,"unitPrice":350},{"minQty":5,"unitPrice":400}]`)}
+	tramos := tramosPrecio(context.Background(), rifa)
+	if len(tramos) != 2 {
+		t.Fatalf("tramos = %+v, se esperaban 2", tramos)
+	}
+	casos := []struct {
+		cantidad int
+		minQty   int
+		precio   int64
+	}{
+		{cantidad: 1, precio: 500},
+		{cantidad: 4, precio: 500},
+		{cantidad: 5, minQty: 5, precio: 400},
+		{cantidad: 6, minQty: 5, precio: 400},
+		{cantidad: 9, minQty: 5, precio: 400},
+		{cantidad: 10, minQty: 10, precio: 350},
+		{cantidad: 11, minQty: 10, precio: 350},
+	}
+	for _, c := range casos {
+		tramo, precio := tramoAplicable(tramos, 500, c.cantidad)
+		minQty := 0
+		if tramo != nil {
+			minQty = tramo.MinQty
+		}
+		if minQty != c.minQty || precio != c.precio {
+			t.Errorf("cantidad %d: tramo %d a %d, se esperaba tramo %d a %d", c.cantidad, minQty, precio, c.minQty, c.precio)
+		}
+	}
+
+	// un tramo más caro que price no se aplica
+	if tramo, precio := tramoAplicable([]TramoPrecio{{MinQty: 2, UnitPrice: 600}}, 500, 3); tramo != nil || precio != 500 {
+		t.Errorf("tramo más caro aplicado: %+v a %d", tramo, precio)
+	}
+}
+
+func TestTramosPrecioSinTramos(t *testing.T) {
+	casos := map[string]string{
+		"vacío":                     ``,
+		"null":                      `null`,
+		"lista vacía":               `[]`,
+		"JSON ilegible":             `[{"minQty":5,`,
+		"no es una lista":           `{"minQty":5,"unitPrice":4}`,
+		"tramos inválidos":          `[{"minQty":0,"unitPrice":4},{"minQty":5,"unitPrice":-1}]`,
+		"tipos que no corresponden": `[{"minQty":"5","unitPrice":4}]`,
+	}
+	for nombre, crudo := range casos {
+		t.Run(nombre, func(t *testing.T) {
+			rifa := &model.Rifa{ID: "r1", PriceTiers: json.RawMessage(crudo)}
+			tramos := tramosPrecio(context.Background(), rifa)
+			if len(tramos) != 0 {
+				t.Fatalf("tramos = %+v, no se esperaba ninguno", tramos)
+			}
+			// sin tramos se cobra el precio fijo
+			if tramo, precio := tramoAplicable(tramos, 500, 20); tramo != nil || precio != 500 {
+				t.Errorf("tramo %+v a %d, se esperaba el precio fijo", tramo, precio)
+			}
+		})
+	}
+}
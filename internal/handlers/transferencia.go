@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+)
+
+// TransferTicketRequest es el cuerpo de POST /admin/tickets/transfer. El nuevo
+// dueño va por toUserId o, si falta, por toEmail; tiene que tener cuenta.
+type TransferTicketRequest struct {
+	RifaID   string `json:"rifaId"`
+	Number   int    `json:"number"`
+	ToUserID string `json:"toUserId,omitempty"`
+	ToEmail  string `json:"toEmail,omitempty"`
+}
+
+// TransferTicketResponse es la respuesta de POST /admin/tickets/transfer
+type TransferTicketResponse struct {
+	RifaID        string `json:"rifaId"`
+	Number        int    `json:"number"`
+	FromProfileID string `json:"fromProfileId"`
+	ToProfileID   string `json:"toProfileId"`
+}
+
+// TransferTicket pasa un ticket vendido a otra cuenta, para el comprador que
+// le regala su número a alguien después de pagar. El ticket tiene que estar
+// vigente (ni reembolsado, ni disputado, ni con cuotas pendientes) y la rifa sin sortear. El cambio es
+// condicional sobre el dueño anterior: de dos transferencias simultáneas del
+// mismo ticket gana una y la otra recibe 409. Los dos dueños reciben un correo.
+func (s *Server) TransferTicket(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req TransferTicketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", 400)
+		return
+	}
+	req.ToUserID = strings.TrimSpace(req.ToUserID)
+	req.ToEmail = strings.ToLower(strings.TrimSpace(req.ToEmail))
+	if req.ToUserID == "" && req.ToEmail == "" {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "Falta el nuevo dueño (toUserId o toEmail)", Code: "RECIPIENT_REQUIRED"})
+		return
+	}
+	if req.ToUserID == "" && !emailValido(req.ToEmail) {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El email no es válido", Code: "INVALID_EMAIL"})
+		return
+	}
+
+	rifa, err := s.rifa(ctx, req.RifaID)
+	if err != nil {
+		responderErrorRifa(ctx, w, req.RifaID, err)
+		return
+	}
+	// También descarta el 0, que en FiltroTickets es sin filtro
+	if !validarNumerosSeleccionados(ctx, w, rifa, []int{req.Number}) {
+		return
+	}
+	sorteo, err := s.db.LatestDraw(ctx, rifa.ID)
+	if err != nil && !errors.Is(err, model.ErrSorteoNoEncontrado) {
+		slog.ErrorContext(ctx, "error consultando sorteos", logging.ConError(err, "rifa_id", rifa.ID)...)
+		http.Error(w, "Error consultando sorteos", 500)
+		return
+	}
+	if sorteo != nil {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{
+			Error:   "La rifa ya se sorteó: sus tickets no se pueden transferir",
+			Code:    "ALREADY_DRAWN",
+			Details: map[string]interface{}{"drawnAt": sorteo.DrawnAt},
+		})
+		return
+	}
+
+	tickets, err := s.db.ListTickets(ctx, rifa.ID, model.FiltroTickets{Number: req.Number, Limit: 1})
+	if err != nil {
+		slog.ErrorContext(ctx, "error buscando el ticket a transferir", logging.ConError(err, "rifa_id", rifa.ID, "numero", req.Number)...)
+		http.Error(w, "Error consultando tickets", 500)
+		return
+	}
+	if len(tickets) == 0 {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "Ese número no está vendido en la rifa", Code: "TICKET_NOT_FOUND"})
+		return
+	}
+	ticket := tickets[0]
+	if ticket.Status == store.EstadoTicketReembolsado || ticket.Status == store.EstadoTicketDisputado || ticket.Status == store.EstadoTicketPagoParcial || ticket.Status == store.EstadoTicketEnRevision {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{
+			Error:   "El ticket no está vigente",
+			Code:    "TICKET_NOT_TRANSFERABLE",
+			Details: map[string]string{"status": ticket.Status},
+		})
+		return
+	}
+
+	destino, err := s.db.GetProfile(ctx, req.ToUserID, req.ToEmail)
+	if errors.Is(err, model.ErrPerfilNoEncontrado) {
+		writeJSON(w, http.StatusNotFound, model.ErrorResponse{Error: "El nuevo dueño no tiene cuenta; tiene que registrarse primero", Code: "PROFILE_NOT_FOUND"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error buscando el perfil destino", logging.ConError(err, "rifa_id", rifa.ID)...)
+		http.Error(w, "Error consultando perfiles", 500)
+		return
+	}
+	if destino.ID == ticket.ProfileID {
+		writeJSON(w, http.StatusBadRequest, model.ErrorResponse{Error: "El ticket ya es de esa cuenta", Code: "SAME_OWNER"})
+		return
+	}
+
+	transferido, err := s.db.TransferTicket(ctx, rifa.ID, ticket.Number, ticket.ProfileID, destino.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error transfiriendo el ticket", logging.ConError(err, "rifa_id", rifa.ID, "numero", ticket.Number)...)
+		http.Error(w, "Error transfiriendo el ticket", 500)
+		return
+	}
+	if !transferido {
+		writeJSON(w, http.StatusConflict, model.ErrorResponse{Error: "El ticket cambió mientras se transfería; vuelve a consultarlo", Code: "TRANSFER_CONFLICT"})
+		return
+	}
+
+	slog.InfoContext(ctx, "ticket transferido", "rifa_id", rifa.ID, "numero", ticket.Number, "from_profile_id", ticket.ProfileID, "to_profile_id", destino.ID)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaTicketTransferido,
+		RifaID:          rifa.ID,
+		PaymentIntentID: ticket.PaymentIntentID,
+		Detail: map[string]interface{}{
+			"number":          ticket.Number,
+			"from_profile_id": ticket.ProfileID,
+			"to_profile_id":   destino.ID,
+		},
+	})
+	s.avisarTransferencia(ctx, rifa, ticket, destino.Email)
+
+	writeJSON(w, http.StatusOK, TransferTicketResponse{
+		RifaID:        rifa.ID,
+		Number:        ticket.Number,
+		FromProfileID: ticket.ProfileID,
+		ToProfileID:   destino.ID,
+	})
+}
+
+// avisarTransferencia manda en segundo plano el correo al dueño anterior y al
+// nuevo; sólo el del nuevo lleva el enlace de verificación
+func (s *Server) avisarTransferencia(ctx context.Context, rifa *model.Rifa, ticket model.TicketAdmin, nuevoEmail string) {
+	var enlace string
+	if ticket.PaymentIntentID != "" {
+		enlace = s.enlaceVerificacion(ticket.PaymentIntentID, model.ItemCompra{RifaID: rifa.ID, Numeros: []int{ticket.Number}})
+	}
+	enSegundoPlano(ctx, func(ctx context.Context) {
+		avisos := []struct {
+			email    string
+			recibido bool
+		}{{ticket.Email, false}, {nuevoEmail, true}}
+		for _, a := range avisos {
+			if a.email == "" {
+				continue
+			}
+			enlaceAviso := ""
+			if a.recibido {
+				enlaceAviso = enlace
+			}
+			err := reintentarCorreo(ctx, a.email, func() error {
+				return s.enviarCorreoTransferencia(ctx, a.email, rifa.ID, rifa.Title, ticket.Number, a.recibido, enlaceAviso)
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "no se pudo avisar la transferencia", logging.ConError(err, "rifa_id", rifa.ID, "numero", ticket.Number, "email", logging.EnmascararEmail(a.email))...)
+			}
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+)
+
+var errTokenExpirado = errors.New("token expirado")
+
+// tokenTickets es lo que firma el enlace de verificación del correo
+type tokenTickets struct {
+	PaymentIntentID string `json:"pi"`
+	RifaID          string `json:"rifa"`
+	Numeros         []int  `json:"n"`
+	Exp             int64  `json:"exp"`
+}
+
+// firmarTokenTickets arma payload.firma, los dos en base64url sin relleno; la
+// firma es el HMAC-SHA256 del payload ya codificado
+func firmarTokenTickets(t tokenTickets, secreto string) string {
+	payload, _ := json.Marshal(t)
+	segmento := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secreto))
+	mac.Write([]byte(segmento))
+	return segmento + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verificarTokenTickets devuelve errTokenInvalido si el token está mal formado
+// o alterado y errTokenExpirado si la firma es buena pero ya venció
+func verificarTokenTickets(token string, secreto string) (*tokenTickets, error) {
+	segmento, firmaB64, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errTokenInvalido
+	}
+	firma, err := base64.RawURLEncoding.DecodeString(firmaB64)
+	if err != nil {
+		return nil, errTokenInvalido
+	}
+	mac := hmac.New(sha256.New, []byte(secreto))
+	mac.Write([]byte(segmento))
+	if !hmac.Equal(firma, mac.Sum(nil)) {
+		return nil, errTokenInvalido
+	}
+
+	var t tokenTickets
+	if err := decodificarSegmento(segmento, &t); err != nil || t.PaymentIntentID == "" || t.RifaID == "" || len(t.Numeros) == 0 {
+		return nil, errTokenInvalido
+	}
+	if time.Now().Unix() >= t.Exp {
+		return nil, errTokenExpirado
+	}
+	return &t, nil
+}
+
+// enlaceVerificacion arma la URL del correo para los números del item, o
+// devuelve "" si la verificación no está configurada
+func (s *Server) enlaceVerificacion(paymentIntentID string, item model.ItemCompra) string {
+	if s.cfg.TicketSigningSecret == "" || s.cfg.TicketVerifyURL == "" {
+		return ""
+	}
+	token := firmarTokenTickets(tokenTickets{
+		PaymentIntentID: paymentIntentID,
+		RifaID:          item.RifaID,
+		Numeros:         item.Numeros,
+		Exp:             time.Now().Add(s.cfg.TicketTokenTTL).Unix(),
+	}, s.cfg.TicketSigningSecret)
+	return strings.ReplaceAll(s.cfg.TicketVerifyURL, "{token}", url.QueryEscape(token))
+}
+
+// Estado de cada número en la respuesta de GET /tickets/verify
+const (
+	verificacionValido      = "valid"
+	verificacionReembolsado = "refunded"
+	verificacionDisputado   = "disputed"
+	verificacionEnRevision  = "on_hold"
+	verificacionNoExiste    = "not_found"
+)
+
+// TicketVerificado es un número del token con su estado actual
+type TicketVerificado struct {
+	Number int    `json:"number"`
+	Status string `json:"status"`
+}
+
+// VerifyTicketsResponse es la respuesta de GET /tickets/verify. Con un token
+// alterado o vencido Valid es false, Reason dice por qué y no hay más datos.
+type VerifyTicketsResponse struct {
+	Valid     bool               `json:"valid"`
+	Reason    string             `json:"reason,omitempty"`
+	RifaID    string             `json:"rifaId,omitempty"`
+	RifaTitle string             `json:"rifaTitle,omitempty"`
+	Email     string             `json:"email,omitempty"`
+	Tickets   []TicketVerificado `json:"tickets,omitempty"`
+}
+
+// VerifyTickets comprueba el enlace del correo de confirmación: valida la firma
+// y responde los números del token con su estado actual y el email enmascarado
+// del comprador, para confirmar en el sorteo que una captura es auténtica.
+func (s *Server) VerifyTickets(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.cfg.TicketSigningSecret == "" {
+		writeJSON(w, http.StatusServiceUnavailable, model.ErrorResponse{
+			Error: "La verificación de tickets no está configurada",
+			Code:  "VERIFICATION_DISABLED",
+		})
+		return
+	}
+
+	t, err := verificarTokenTickets(r.URL.Query().Get("token"), s.cfg.TicketSigningSecret)
+	if err != nil {
+		motivo := "INVALID_TOKEN"
+		if errors.Is(err, errTokenExpirado) {
+			motivo = "EXPIRED_TOKEN"
+		}
+		slog.InfoContext(ctx, "token de verificación rechazado", "motivo", motivo)
+		writeJSON(w, http.StatusOK, VerifyTicketsResponse{Reason: motivo})
+		return
+	}
+
+	rifa, err := s.rifa(ctx, t.RifaID)
+	if errors.Is(err, model.ErrRifaNoEncontrada) {
+		writeJSON(w, http.StatusOK, VerifyTicketsResponse{Reason: "RIFA_NOT_FOUND"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error leyendo la rifa para verificar", logging.ConError(err, "rifa_id", t.RifaID)...)
+		http.Error(w, "Error verificando los tickets", 500)
+		return
+	}
+	registrados, err := s.db.VerifiableTickets(ctx, t.RifaID, t.PaymentIntentID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error leyendo tickets para verificar", logging.ConError(err, "rifa_id", t.RifaID, "payment_intent_id", t.PaymentIntentID)...)
+		http.Error(w, "Error verificando los tickets", 500)
+		return
+	}
+
+	respuesta := VerifyTicketsResponse{Valid: true, RifaID: rifa.ID, RifaTitle: rifa.Title}
+	for _, n := range t.Numeros {
+		estado := verificacionNoExiste
+		i := slices.IndexFunc(registrados, func(r model.TicketVerificable) bool { return r.Number == n })
+		if i >= 0 {
+			switch registrados[i].Status {
+			case store.EstadoTicketReembolsado:
+				estado = verificacionReembolsado
+			case store.EstadoTicketDisputado:
+				estado = verificacionDisputado
+			case store.EstadoTicketEnRevision:
+				estado = verificacionEnRevision
+			default:
+				estado = verificacionValido
+			}
+			if respuesta.Email == "" && registrados[i].Email != "" {
+				respuesta.Email = logging.EnmascararEmail(registrados[i].Email)
+			}
+		}
+		respuesta.Tickets = append(respuesta.Tickets, TicketVerificado{Number: n, Status: estado})
+	}
+	writeJSON(w, http.StatusOK, respuesta)
+}
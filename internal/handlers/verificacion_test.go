@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"PaymentsGo/internal/model"
+)
+
+// storeVerificacion es storeCompras con los tickets registrados del intent
+type storeVerificacion struct {
+	storeCompras
+	tickets []model.TicketVerificable
+}
+
+func (f *storeVerificacion) VerifiableTickets(_ context.Context, _ string, _ string) ([]model.TicketVerificable, error) {
+	return f.tickets, nil
+}
+
+// firmarSegmento firma un payload ya codificado como lo hace firmarTokenTickets
+func firmarSegmento(segmento string, secreto string) string {
+	mac := hmac.New(sha256.New, []byte(secreto))
+	mac.Write([]byte(segmento))
+	return segmento + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerificarTokenTickets(t *testing.T) {
+	const secreto = "secreto_de_tickets"
+	vigente := tokenTickets{PaymentIntentID: "pi_1", RifaID: rifaPrueba, Numeros: []int{7, 12}, Exp: time.Now().Add(time.Hour).Unix()}
+	bueno := firmarTokenTickets(vigente, secreto)
+
+	otrosNumeros := vigente
+	otrosNumeros.Numeros = []int{7, 12, 13}
+	payload, _ := json.Marshal(otrosNumeros)
+	_, firma, _ := strings.Cut(bueno, ".")
+	alterado := base64.RawURLEncoding.EncodeToString(payload) + "." + firma
+
+	vencido := vigente
+	vencido.Exp = time.Now().Add(-time.Minute).Unix()
+
+	casos := []struct {
+		nombre string
+		token  string
+		err    error
+		motivo string
+	}{
+		{nombre: "válido", token: bueno},
+		{nombre: "payload alterado", token: alterado, err: errTokenInvalido, motivo: "INVALID_TOKEN"},
+		{nombre: "otra clave", token: firmarTokenTickets(vigente, "otro_secreto"), err: errTokenInvalido, motivo: "INVALID_TOKEN"},
+		{nombre: "vencido", token: firmarTokenTickets(vencido, secreto), err: errTokenExpirado, motivo: "EXPIRED_TOKEN"},
+		{nombre: "firma que no es base64", token: strings.SplitN(bueno, ".", 2)[0] + ".%%%", err: errTokenInvalido, motivo: "INVALID_TOKEN"},
+		{nombre: "payload que no es base64", token: firmarSegmento("%%%", secreto), err: errTokenInvalido, motivo: "INVALID_TOKEN"},
+		{nombre: "sin firma", token: strings.SplitN(bueno, ".", 2)[0], err: errTokenInvalido, motivo: "INVALID_TOKEN"},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			token, err := verificarTokenTickets(c.token, secreto)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err = %v, se esperaba %v", err, c.err)
+			}
+			if c.err == nil && (token.PaymentIntentID != "pi_1" || token.RifaID != rifaPrueba || !slices.Equal(token.Numeros, []int{7, 12})) {
+				t.Errorf("token = %+v, se esperaba %+v", token, vigente)
+			}
+
+			db := &storeVerificacion{tickets: []model.TicketVerificable{{Number: 7, Status: "paid", Email: "ana@example.com"}, {Number: 12, Status: "paid", Email: "ana@example.com"}}}
+			s := servidorPrueba(db, &pagosFalsos{}, &correoFalso{})
+			s.cfg.TicketSigningSecret = secreto
+			w := httptest.NewRecorder()
+			s.VerifyTickets(w, httptest.NewRequest(http.MethodGet, "/tickets/verify?token="+url.QueryEscape(c.token), nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, se esperaba 200 (%s)", w.Code, w.Body.String())
+			}
+			var respuesta VerifyTicketsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &respuesta); err != nil {
+				t.Fatal(err)
+			}
+			if respuesta.Valid != (c.err == nil) || respuesta.Reason != c.motivo {
+				t.Errorf("respuesta = %+v, se esperaba valid %v con reason %q", respuesta, c.err == nil, c.motivo)
+			}
+			if c.err != nil && (respuesta.RifaID != "" || len(respuesta.Tickets) != 0) {
+				t.Errorf("un token rechazado devolvió datos: %+v", respuesta)
+			}
+			if c.err == nil && len(respuesta.Tickets) != 2 {
+				t.Errorf("tickets = %+v, se esperaban 7 y 12", respuesta.Tickets)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+)
+
+// APIv1 es la versión de las rutas bajo /v1 y de las sin prefijo, que son las
+// que usaban los clientes antes de versionar. Una /v2 agrega su constante,
+// entra en VersionesAPI y los handlers que cambian de forma preguntan
+// versionAPI.
+const APIv1 = 1
+
+// VersionesAPI son las versiones que sirve este binario, para GET /version
+var VersionesAPI = []string{"v1"}
+
+type claveVersion struct{}
+
+// WithAPIVersion deja en el contexto la versión de la API de la ruta y la
+// informa en la cabecera API-Version
+func WithAPIVersion(version int) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("API-Version", "v"+strconv.Itoa(version))
+			next(w, r.WithContext(context.WithValue(r.Context(), claveVersion{}, version)))
+		}
+	}
+}
+
+// versionAPI es la versión con que llegó la petición; una ruta registrada sin
+// WithAPIVersion es la v1
+func versionAPI(ctx context.Context) int {
+	if v, ok := ctx.Value(claveVersion{}).(int); ok {
+		return v
+	}
+	return APIv1
+}
+
+// InfoVersion es la respuesta de GET /version
+type InfoVersion struct {
+	Version     string   `json:"version"`
+	Commit      string   `json:"commit"`
+	APIVersions []string `json:"apiVersions"`
+}
+
+// Version responde GET /version. version y commit vienen de -ldflags; un
+// binario compilado sin ellos informa el commit que go build leyó de git.
+func Version(version string, commit string) http.HandlerFunc {
+	if commit == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, ajuste := range info.Settings {
+				if ajuste.Key == "vcs.revision" {
+					commit = ajuste.Value
+				}
+			}
+		}
+	}
+	respuesta := InfoVersion{Version: version, Commit: commit, APIVersions: VersionesAPI}
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, respuesta)
+	}
+}
@@ -0,0 +1,723 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/metrics"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/store"
+	"PaymentsGo/internal/tracing"
+)
+
+// 2. Webhook
+// HandleStripeWebhook sólo verifica la firma y encola el evento en
+// pending_jobs: responde 200 en cuanto queda guardado, y los workers de
+// trabajos.go lo procesan después con sus propios reintentos. Así una base
+// lenta no acerca la respuesta al timeout de Stripe.
+func (s *Server) HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
+
+	const MaxBodyBytes = int64(65536)
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.WarnContext(r.Context(), "error leyendo payload del webhook", logging.ConError(err)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	signature := r.Header.Get("Stripe-Signature")
+
+	event, err := s.pagos.ConstructEvent(r.Context(), payload, signature)
+	destino := s
+	if s.sandbox != nil {
+		// Los eventos de la cuenta de prueba vienen firmados con otro secreto
+		// y van al sandbox; livemode decide, no qué secreto validó
+		if err != nil {
+			event, err = s.sandbox.pagos.ConstructEvent(r.Context(), payload, signature)
+			if err == nil && event.Livemode {
+				err = errors.New("evento live firmado con el secreto de prueba")
+			}
+		}
+		if err == nil && !event.Livemode {
+			destino = s.sandbox
+		}
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "falló la validación del webhook", logging.ConError(err)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	destino.recibirEvento(w, r, event, payload)
+}
+
+// recibirEvento encola el evento ya validado para los workers de s
+func (s *Server) recibirEvento(w http.ResponseWriter, r *http.Request, event stripe.Event, payload []byte) {
+	ctx := r.Context()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("stripe.event_id", event.ID), attribute.String("stripe.event_type", string(event.Type)), attribute.Bool("stripe.livemode", event.Livemode))
+	anotarAcceso(ctx, "stripe_event_type", string(event.Type), "stripe_event_id", event.ID)
+	if !s.admitirEvento(ctx, w, event) {
+		return
+	}
+	procesado, err := s.eventoProcesado(ctx, event.ID)
+	if err != nil {
+		// Seguimos adelante: el worker vuelve a verificarlo antes de procesar
+		slog.WarnContext(ctx, "no se pudo verificar el evento", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+	}
+	if procesado {
+		slog.InfoContext(ctx, "event already processed", "event_id", event.ID, "event_type", event.Type)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	nuevo := model.PendingJob{
+		EventID:       event.ID,
+		EventType:     string(event.Type),
+		Payload:       payload,
+		RequestID:     w.Header().Get(logging.CabeceraRequestID),
+		Status:        model.TrabajoPendiente,
+		NextAttemptAt: time.Now(),
+	}
+	trabajo, err := s.db.EnqueueJob(ctx, &nuevo)
+	var abierto *store.ErrCircuitoAbierto
+	if errors.As(err, &abierto) && s.trabajos.retener(nuevo) {
+		// Los reintentos de Stripe se acaban; el barrido lo guarda cuando
+		// Supabase vuelva
+		slog.WarnContext(ctx, "Supabase no disponible: evento retenido en memoria", "event_id", event.ID, "event_type", event.Type)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		// Sin el evento guardado no hay quien lo procese: que Stripe lo reintente
+		slog.ErrorContext(ctx, "error encolando el evento", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if trabajo != nil {
+		// Si la cola está llena el trabajo queda en la tabla para el próximo barrido
+		s.trabajos.encolar(*trabajo)
+	} else {
+		slog.InfoContext(ctx, "evento ya encolado", "event_id", event.ID, "event_type", event.Type)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// eventosIgnorados cuenta por tipo los eventos que Stripe manda sin que el
+// webhook los maneje: un endpoint suscrito a "todos los eventos" se nota aquí
+var eventosIgnorados = metrics.NewCounterVec("webhook_events_ignored_total", "Eventos de Stripe recibidos de un tipo que el webhook no maneja", "type")
+
+// objetoEvento es dónde se decodifica event.Data.Raw en cada tipo de evento
+// que atiende procesarEvento; nil es un tipo que no se maneja
+func objetoEvento(tipo stripe.EventType) any {
+	switch tipo {
+	case "payment_intent.succeeded", "payment_intent.payment_failed", "payment_intent.canceled",
+		"payment_intent.processing", "payment_intent.requires_action":
+		return &stripe.PaymentIntent{}
+	case "review.opened", "review.closed":
+		return &stripe.Review{}
+	case "charge.refunded":
+		return &stripe.Charge{}
+	case "charge.dispute.created":
+		return &stripe.Dispute{}
+	}
+	return nil
+}
+
+// admitirEvento decide si el evento se encola. Un tipo que no se maneja se
+// cuenta y se responde 200, o 400 con StripeWebhookStrict; un objeto que no se
+// puede leer es 400, porque el worker lo abandonaría sin reintentar.
+// Devuelve false si ya respondió.
+func (s *Server) admitirEvento(ctx context.Context, w http.ResponseWriter, event stripe.Event) bool {
+	objeto := objetoEvento(event.Type)
+	if objeto == nil {
+		eventosIgnorados.Inc(string(event.Type))
+		if s.cfg.StripeWebhookStrict {
+			slog.WarnContext(ctx, "tipo de evento inesperado", "event_id", event.ID, "event_type", event.Type)
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		slog.InfoContext(ctx, "evento ignorado", "event_id", event.ID, "event_type", event.Type)
+		w.WriteHeader(http.StatusOK)
+		return false
+	}
+	err := errors.New("evento sin data")
+	if event.Data != nil {
+		err = json.Unmarshal(event.Data.Raw, objeto)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error parseando el objeto del evento", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// procesarEvento aplica los efectos del evento. Devuelve un error para que el
+// worker lo reintente, o uno marcado con permanente si reintentar no sirve.
+// Todo lo que hace tiene que poder repetirse: un trabajo que falló a la mitad
+// vuelve a empezar desde el principio.
+func (s *Server) procesarEvento(ctx context.Context, event stripe.Event) error {
+	switch event.Type {
+	case "payment_intent.succeeded":
+		var pi stripe.PaymentIntent
+		err := json.Unmarshal(event.Data.Raw, &pi)
+		if err != nil {
+			slog.ErrorContext(ctx, "error parseando PaymentIntent", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+			return permanente(err)
+		}
+		if esCuotaPosterior(&pi) {
+			if err := s.procesarCuota(ctx, &pi); err != nil {
+				slog.ErrorContext(ctx, "error procesando la cuota", logging.ConError(err, "payment_intent_id", pi.ID, "installment", pi.Metadata["installment"])...)
+				return err
+			}
+			break
+		}
+
+		compra, err := s.cargarCompra(ctx, &pi)
+		if err != nil {
+			slog.ErrorContext(ctx, "error cargando la compra", logging.ConError(err, "payment_intent_id", pi.ID, "event_type", event.Type)...)
+			return err
+		}
+
+		revision, err := s.revisionDeIntent(ctx, pi.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, "error consultando la revisión del cargo", logging.ConError(err, "payment_intent_id", pi.ID)...)
+			return err
+		}
+		if revisionRechazada(revision) {
+			// Radar la cerró antes de que llegara este evento: no hay tickets
+			if err := s.rechazarCompra(ctx, compra, pi.ID, revision); err != nil {
+				slog.ErrorContext(ctx, "error rechazando la compra revisada", logging.ConError(err, "payment_intent_id", pi.ID, "review_id", revision.ID)...)
+				return err
+			}
+			break
+		}
+
+		// Un intent cobrado por menos (o más) de lo que vale la compra no
+		// registra tickets: queda en price_mismatches para el organizador
+		if retenida, err := s.retenerDiferenciaPrecio(ctx, compra, &pi); err != nil || retenida {
+			if err != nil {
+				slog.ErrorContext(ctx, "error verificando el monto cobrado", logging.ConError(err, "payment_intent_id", pi.ID)...)
+			}
+			return err
+		}
+
+		// Si otro intent del mismo usuario se pagó primero, esta compra puede
+		// dejarlo por encima de max_per_user: se reembolsa en lugar de registrar
+		var items []model.ItemCompra
+		pago := pagoStripe(compra, &pi, time.Unix(event.Created, 0))
+		pago.OnHold = retieneCompra(revision)
+		err = s.verificarLimiteEnWebhook(ctx, compra)
+		if err == nil {
+			items, err = s.registrarTickets(ctx, compra, pago)
+		}
+		if err != nil {
+			if errors.Is(err, ErrLimitePorUsuario) || esFalloPermanente(err) {
+				// Reintentar no va a ayudar (p. ej. el número se vendió por otro canal):
+				// el cliente pagó y no tiene tickets, así que se le devuelve el dinero.
+				slog.ErrorContext(ctx, "registro imposible, reembolsando", logging.ConError(err, "rifa_id", compra.RifaID, "payment_intent_id", pi.ID)...)
+				if err := s.compensarRegistroFallido(ctx, &pi, compra, err); err != nil {
+					slog.ErrorContext(ctx, "error compensando registro fallido", logging.ConError(err, "rifa_id", compra.RifaID, "payment_intent_id", pi.ID)...)
+					return err
+				}
+				break
+			}
+			// Cortamos antes de enviar el correo para que el worker reintente el trabajo
+			slog.ErrorContext(ctx, "error registrando tickets", logging.ConError(err, "rifa_id", compra.RifaID, "payment_intent_id", pi.ID)...)
+			return err
+		}
+
+		if compra.PromoCode != "" {
+			// Los tickets ya quedaron; un reintento del evento no los duplica
+			if err := s.db.RedeemPromoCode(ctx, compra.PromoCode, pi.ID); err != nil {
+				slog.ErrorContext(ctx, "error confirmando el canje del código", logging.ConError(err, "code", compra.PromoCode, "payment_intent_id", pi.ID)...)
+				return err
+			}
+		}
+		if pago.OnHold {
+			// La confirmación espera a review.closed
+			slog.InfoContext(ctx, "tickets retenidos por la revisión de Radar", "payment_intent_id", pi.ID, "review_id", revision.ID)
+			break
+		}
+		if err := s.confirmarCompra(ctx, compra, &pi, time.Unix(event.Created, 0), items); err != nil {
+			return err
+		}
+
+	case "payment_intent.payment_failed", "payment_intent.canceled":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			slog.ErrorContext(ctx, "error parseando PaymentIntent", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+			return permanente(err)
+		}
+
+		// ReleaseReservations no falla si el intent nunca tuvo reservas (también
+		// llega aquí un voucher de OXXO que venció sin pagarse)
+		if err := s.db.ReleaseReservations(ctx, pi.ID); err != nil {
+			slog.ErrorContext(ctx, "error liberando reservas", logging.ConError(err, "payment_intent_id", pi.ID, "event_type", event.Type)...)
+			return err
+		}
+		if err := s.db.ReleasePromoRedemption(ctx, pi.ID); err != nil {
+			slog.ErrorContext(ctx, "error liberando el canje del código", logging.ConError(err, "payment_intent_id", pi.ID, "event_type", event.Type)...)
+			return err
+		}
+		slog.InfoContext(ctx, "reservas liberadas", "payment_intent_id", pi.ID, "event_type", event.Type)
+
+		// Una cuota fallida no libera nada: el plan sigue hasta su vencimiento
+		if event.Type == "payment_intent.payment_failed" && !esCuotaPosterior(&pi) {
+			compra, err := s.cargarCompra(ctx, &pi)
+			if err != nil {
+				slog.WarnContext(ctx, "no se pudo cargar la compra para avisar del fallo", logging.ConError(err, "payment_intent_id", pi.ID)...)
+				break
+			}
+			if compra.Email != "" {
+				datos := datosPagoFallidoSalida{Email: compra.Email, RifaID: compra.RifaID, RifaTitle: compra.RifaTitle}
+				if err := s.encolarSalidas(ctx, nuevaSalida(ctx, salidaPagoFallido, pi.ID, compra.Email, datos)); err != nil {
+					slog.ErrorContext(ctx, "error encolando el correo de pago fallido", logging.ConError(err, "payment_intent_id", pi.ID)...)
+					return err
+				}
+			}
+		}
+
+	case "payment_intent.processing", "payment_intent.requires_action":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			slog.ErrorContext(ctx, "error parseando PaymentIntent", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+			return permanente(err)
+		}
+		// Los pagos asíncronos (OXXO) se completan días después: la reserva tiene
+		// que durar hasta entonces para que nadie más compre esos números
+		hasta, ok := s.vencimientoReservaAsincrona(&pi, time.Now())
+		if !ok {
+			break
+		}
+		if err := s.db.ExtendReservations(ctx, pi.ID, hasta); err != nil {
+			slog.ErrorContext(ctx, "error extendiendo reservas", logging.ConError(err, "payment_intent_id", pi.ID, "event_type", event.Type)...)
+			return err
+		}
+		slog.InfoContext(ctx, "reservas extendidas por pago asíncrono", "payment_intent_id", pi.ID, "event_type", event.Type, "expires_at", hasta)
+
+	case "review.opened":
+		var revision stripe.Review
+		if err := json.Unmarshal(event.Data.Raw, &revision); err != nil {
+			slog.ErrorContext(ctx, "error parseando Review", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+			return permanente(err)
+		}
+		if err := s.procesarRevisionAbierta(ctx, &revision); err != nil {
+			slog.ErrorContext(ctx, "error reteniendo los tickets en revisión", logging.ConError(err, "review_id", revision.ID, "event_type", event.Type)...)
+			return err
+		}
+
+	case "review.closed":
+		var revision stripe.Review
+		if err := json.Unmarshal(event.Data.Raw, &revision); err != nil {
+			slog.ErrorContext(ctx, "error parseando Review", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+			return permanente(err)
+		}
+		if err := s.procesarRevisionCerrada(ctx, &revision, time.Unix(event.Created, 0)); err != nil {
+			slog.ErrorContext(ctx, "error procesando la revisión cerrada", logging.ConError(err, "review_id", revision.ID, "closed_reason", revision.ClosedReason)...)
+			return err
+		}
+
+	case "charge.refunded":
+		var cargo stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &cargo); err != nil {
+			slog.ErrorContext(ctx, "error parseando Charge", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+			return permanente(err)
+		}
+		if err := s.procesarCargoReembolsado(ctx, &cargo); err != nil {
+			slog.ErrorContext(ctx, "error procesando reembolso", logging.ConError(err, "charge_id", cargo.ID, "event_type", event.Type)...)
+			return err
+		}
+
+	case "charge.dispute.created":
+		var disputa stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &disputa); err != nil {
+			slog.ErrorContext(ctx, "error parseando Dispute", logging.ConError(err, "event_id", event.ID, "event_type", event.Type)...)
+			return permanente(err)
+		}
+		if err := s.procesarDisputa(ctx, &disputa); err != nil {
+			slog.ErrorContext(ctx, "error procesando disputa", logging.ConError(err, "dispute_id", disputa.ID, "event_type", event.Type)...)
+			return err
+		}
+
+	default:
+		// admitirEvento ya no los encola, pero pueden quedar trabajos de antes
+		slog.InfoContext(ctx, "evento ignorado", "event_id", event.ID, "event_type", event.Type)
+	}
+
+	return nil
+}
+
+// esFalloPermanente distingue los errores de Supabase que no se arreglan
+// reintentando (violaciones de constraint, datos inválidos) de los transitorios.
+func esFalloPermanente(err error) bool {
+	var ocupados *model.ErrNumerosOcupados
+	if errors.As(err, &ocupados) {
+		return true
+	}
+	var errSB *store.ErrSupabase
+	if !errors.As(err, &errSB) {
+		return false
+	}
+	return errSB.Status >= 400 && errSB.Status < 500 &&
+		errSB.Status != http.StatusRequestTimeout && errSB.Status != http.StatusTooManyRequests
+}
+
+// compensarRegistroFallido reembolsa el pago, deja constancia en
+// failed_registrations y avisa al cliente. Se puede re-ejecutar si Stripe
+// reintenta el evento: el reembolso usa una idempotency key por intent.
+func (s *Server) compensarRegistroFallido(ctx context.Context, pi *stripe.PaymentIntent, compra *model.PurchaseDraft, causa error) error {
+	reembolso, err := s.reembolsarIntent(ctx, pi)
+	if err != nil {
+		return fmt.Errorf("reembolso: %w", err)
+	}
+
+	fallo := falloRegistro(pi.ID, compra, pi.Amount, causa)
+	fallo["metadata"] = pi.Metadata
+	if reembolso != nil {
+		fallo["refund_id"] = reembolso.ID
+	}
+	return s.deshacerRegistro(ctx, pi.ID, compra, fallo, causa)
+}
+
+// falloRegistro es la fila de failed_registrations de un pago ya devuelto
+func falloRegistro(paymentIntentID string, compra *model.PurchaseDraft, monto int64, causa error) map[string]interface{} {
+	fallo := map[string]interface{}{
+		"payment_intent_id": paymentIntentID,
+		"rifa_id":           compra.RifaID,
+		"profile_id":        compra.UserID,
+		"email":             compra.Email,
+		"numeros":           compra.Numeros,
+		"amount":            monto,
+		"error":             causa.Error(),
+	}
+	if len(compra.Items) > 0 {
+		fallo["items"] = compra.Items
+	}
+	return fallo
+}
+
+// deshacerRegistro es lo que sigue al reembolso, sea de Stripe o de PayPal:
+// guarda el fallo, libera reservas y canje, marca los tickets parciales y
+// avisa al cliente
+func (s *Server) deshacerRegistro(ctx context.Context, paymentID string, compra *model.PurchaseDraft, fallo map[string]interface{}, causa error) error {
+	if err := s.db.RecordFailedRegistration(ctx, fallo); err != nil {
+		return fmt.Errorf("failed_registrations: %w", err)
+	}
+
+	if err := s.db.ReleaseReservations(ctx, paymentID); err != nil {
+		slog.WarnContext(ctx, "no se pudieron liberar las reservas", logging.ConError(err, "payment_intent_id", paymentID)...)
+	}
+	if err := s.db.ReleasePromoRedemption(ctx, paymentID); err != nil {
+		slog.WarnContext(ctx, "no se pudo liberar el canje del código", logging.ConError(err, "payment_intent_id", paymentID)...)
+	}
+	// En un carrito las primeras rifas pueden haber quedado registradas antes
+	// del fallo; con el pago devuelto esos tickets ya no valen
+	if err := s.db.SetTicketsStatus(ctx, paymentID, nil, store.EstadoTicketReembolsado); err != nil {
+		return fmt.Errorf("tickets parciales: %w", err)
+	}
+
+	if compra.Email != "" {
+		motivo := "porque ya no estaban disponibles"
+		if errors.Is(causa, ErrLimitePorUsuario) {
+			motivo = "porque superaban el límite de números por persona de la rifa"
+		}
+		datos := datosReembolsoSalida{Email: compra.Email, Items: itemsDeCompra(compra), Motivo: motivo}
+		// El reembolso ya salió: no se reintenta todo por el correo
+		if err := s.encolarSalidas(ctx, nuevaSalida(ctx, salidaReembolso, paymentID, compra.Email, datos)); err != nil {
+			slog.ErrorContext(ctx, "error encolando el correo de reembolso", logging.ConError(err, "payment_intent_id", paymentID, "email", logging.EnmascararEmail(compra.Email))...)
+		}
+	}
+	return nil
+}
+
+// verificarLimiteEnWebhook devuelve ErrLimitePorUsuario si registrar la compra
+// supera max_per_user. No cuenta los tickets ni la reserva del propio intent,
+// así un reintento del evento da el mismo resultado.
+func (s *Server) verificarLimiteEnWebhook(ctx context.Context, compra *model.PurchaseDraft) error {
+	for _, item := range itemsDeCompra(compra) {
+		rifa, err := s.db.GetRifa(ctx, item.RifaID)
+		if err != nil {
+			return err
+		}
+		restantes, err := s.numerosRestantesUsuario(ctx, rifa, compra.UserID, compra.PaymentIntentID)
+		if err != nil {
+			return err
+		}
+		if restantes >= 0 && len(item.Numeros) > restantes {
+			return fmt.Errorf("%w: rifa %s, max %d, restantes %d, solicitados %d", ErrLimitePorUsuario, rifa.ID, rifa.MaxPerUser, restantes, len(item.Numeros))
+		}
+	}
+	return nil
+}
+
+// registrarTickets inserta los tickets de cada rifa de la compra con lo que
+// se cobró por ella; pago.Amount es el total cobrado. Devuelve los items de la
+// compra con los IDs de sus tickets, para el correo de confirmación.
+func (s *Server) registrarTickets(ctx context.Context, compra *model.PurchaseDraft, pago model.PagoTickets) (_ []model.ItemCompra, err error) {
+	ctx, span := tracer.Start(ctx, "registrarTickets", trace.WithAttributes(tracing.RifaID.String(compra.RifaID), tracing.PaymentIntentID.String(compra.PaymentIntentID)))
+	defer func() { tracing.Fin(span, err) }()
+
+	items, err := s.insertarTickets(ctx, compra, pago)
+	if err != nil {
+		return nil, err
+	}
+	accion := model.AuditoriaTicketsRegistrados
+	if pago.Method == model.MetodoPagoManual {
+		accion = model.AuditoriaTicketsManuales
+	}
+	for _, item := range items {
+		s.publicarNumeros(item.RifaID, EventoNumeroTomado, item.Numeros)
+		s.auditar(ctx, model.EntradaAuditoria{
+			Action:          accion,
+			RifaID:          item.RifaID,
+			PaymentIntentID: pago.PaymentIntentID,
+			Detail: map[string]interface{}{
+				"numeros":    item.Numeros,
+				"ticket_ids": item.TicketIDs,
+				"amount":     item.Amount,
+				"paid":       pago.Amount,
+				"currency":   pago.Currency,
+				"provider":   pago.Provider,
+				"label":      pago.Label,
+				"reference":  pago.Reference,
+				"on_hold":    pago.OnHold,
+			},
+		})
+	}
+	return items, nil
+}
+
+// insertarTickets es la parte de registrarTickets que escribe en tikect, sin
+// eventos ni auditoría. Con los tickets ya registrados no inserta nada y sólo
+// devuelve sus IDs.
+func (s *Server) insertarTickets(ctx context.Context, compra *model.PurchaseDraft, pago model.PagoTickets) ([]model.ItemCompra, error) {
+	// Copia: itemsDeCompra puede devolver compra.Items
+	items := append([]model.ItemCompra(nil), itemsDeCompra(compra)...)
+	for i, item := range items {
+		pagoItem := pago
+		if len(items) > 1 {
+			// En un carrito cada rifa se lleva su parte; en una compra simple
+			// manda el monto cobrado: los intents viejos no guardan el del item
+			pagoItem.Amount = item.Amount
+		}
+		tickets, err := s.db.InsertTickets(ctx, item.RifaID, item.Numeros, compra.UserID, pagoItem)
+		if err != nil {
+			return nil, fmt.Errorf("rifa %s: %w", item.RifaID, err)
+		}
+		ids := make(map[int]int64, len(tickets))
+		for _, t := range tickets {
+			ids[t.Number] = t.ID
+		}
+		items[i].TicketIDs = make([]int64, len(item.Numeros))
+		for j, n := range item.Numeros {
+			items[i].TicketIDs[j] = ids[n]
+		}
+		items[i].VerifyURL = s.enlaceVerificacion(pago.PaymentIntentID, item)
+	}
+	return items, nil
+}
+
+// confirmarCompra es lo que sigue a registrar los tickets de un pago de
+// Stripe: con cuotas arranca el plan y la confirmación, la comisión y el aviso
+// de venta esperan a la última; si no, van ahora.
+func (s *Server) confirmarCompra(ctx context.Context, compra *model.PurchaseDraft, pi *stripe.PaymentIntent, pagado time.Time, items []model.ItemCompra) error {
+	if compra.Installments > 1 {
+		if err := s.iniciarCuotas(ctx, compra, pi, pagado); err != nil {
+			slog.ErrorContext(ctx, "error iniciando el plan de cuotas", logging.ConError(err, "purchase_intent_id", compra.ID, "payment_intent_id", pi.ID)...)
+			return err
+		}
+		return nil
+	}
+	if err := s.acreditarReferido(ctx, compra, pi.Amount, string(pi.Currency)); err != nil {
+		slog.ErrorContext(ctx, "error acreditando la comisión de referido", logging.ConError(err, "referral_code", compra.ReferralCode, "payment_intent_id", pi.ID)...)
+		return err
+	}
+	if err := s.enviarCorreosCompra(ctx, compra, items, pi.Amount, pi.Currency); err != nil {
+		return err
+	}
+	return s.avisarVenta(ctx, compra, items, pi.Amount, pi.Currency)
+}
+
+// enviarCorreosCompra deja en el outbox la confirmación (o el correo del
+// regalo y el comprobante) y el aviso al organizador si la compra es grande;
+// cada uno se envía y se reintenta por separado. items son los que devolvió
+// registrarTickets, con los IDs de los tickets.
+func (s *Server) enviarCorreosCompra(ctx context.Context, compra *model.PurchaseDraft, items []model.ItemCompra, monto int64, moneda stripe.Currency) error {
+	clave := compra.PaymentIntentID
+	datos := datosCompraSalida{Compra: compra, Items: items, Monto: monto, Moneda: string(moneda)}
+	var entradas []model.OutboxEntry
+	switch {
+	case compra.RecipientEmail != "":
+		entradas = append(entradas, nuevaSalida(ctx, salidaRegalo, clave, compra.RecipientEmail, datos))
+		if compra.Email != "" {
+			entradas = append(entradas, nuevaSalida(ctx, salidaReciboRegalo, clave, compra.Email, datos))
+		}
+	case compra.Email != "":
+		entradas = append(entradas, nuevaSalida(ctx, salidaConfirmacion, clave, compra.Email, datos))
+	}
+	if cantidad := totalNumeros(items); cantidad >= s.cfg.VIPThreshold && s.cfg.OrganizerEmail != "" {
+		organizador := datosOrganizadorSalida{Comprador: compra.Email, Rifa: compra.RifaTitle, Cantidad: cantidad, Monto: monto, Moneda: string(moneda)}
+		entradas = append(entradas, nuevaSalida(ctx, salidaOrganizador, clave, compra.Email, organizador))
+	}
+	if err := s.encolarSalidas(ctx, entradas...); err != nil {
+		slog.ErrorContext(ctx, "error encolando los correos de la compra", logging.ConError(err, "payment_intent_id", compra.PaymentIntentID)...)
+		return err
+	}
+	return nil
+}
+
+// pagoStripe es el pago con el que se registran los tickets de un intent de
+// Stripe; en la primera cuota de un plan lleva el saldo que falta
+func pagoStripe(compra *model.PurchaseDraft, pi *stripe.PaymentIntent, pagado time.Time) model.PagoTickets {
+	pago := model.PagoTickets{
+		PaymentIntentID:  pi.ID,
+		Amount:           pi.Amount,
+		Currency:         string(pi.Currency),
+		PaidAt:           pagado,
+		Provider:         model.ProveedorStripe,
+		OrganizerAccount: cuentaDestino(pi),
+	}
+	if compra.Installments > 1 {
+		pago.BalanceDue = compra.Amount - pi.Amount
+	}
+	return pago
+}
+
+// cargarCompra obtiene el borrador de la compra del intent. Los intents creados
+// antes de la tabla purchase_intent traen todo en la metadata.
+func (s *Server) cargarCompra(ctx context.Context, pi *stripe.PaymentIntent) (*model.PurchaseDraft, error) {
+	trace.SpanFromContext(ctx).SetAttributes(tracing.PaymentIntentID.String(pi.ID), tracing.RifaID.String(pi.Metadata["rifa_id"]))
+	if esCuotaPosterior(pi) {
+		// El borrador guarda el intent de la primera cuota
+		return s.db.GetPurchaseDraftByID(ctx, pi.Metadata["purchase_intent_id"])
+	}
+	if pi.Metadata["purchase_intent_id"] != "" {
+		return s.db.GetPurchaseDraft(ctx, pi.ID)
+	}
+
+	compra := &model.PurchaseDraft{
+		PaymentIntentID: pi.ID,
+		RifaID:          pi.Metadata["rifa_id"],
+		RifaTitle:       pi.Metadata["rifa_title"],
+		UserID:          pi.Metadata["user_id"],
+		Email:           pi.Metadata["user_email"],
+		Amount:          pi.Amount,
+	}
+	if err := json.Unmarshal([]byte(pi.Metadata["numeros"]), &compra.Numeros); err != nil {
+		return nil, fmt.Errorf("metadata numeros inválida: %w", err)
+	}
+	return compra, nil
+}
+
+// reembolsarIntent reembolsa el total del PaymentIntent. Devuelve nil, nil si
+// el cargo ya estaba reembolsado.
+func (s *Server) reembolsarIntent(ctx context.Context, pi *stripe.PaymentIntent) (*stripe.Refund, error) {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(pi.ID),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+	}
+	revertirTransferencia(params, pi)
+	params.SetIdempotencyKey("refund-registro-" + pi.ID)
+
+	r, err := s.pagos.CreateRefund(ctx, params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeChargeAlreadyRefunded {
+			slog.InfoContext(ctx, "el intent ya estaba reembolsado", "payment_intent_id", pi.ID)
+			return nil, nil
+		}
+		return nil, err
+	}
+	slog.InfoContext(ctx, "reembolso creado", "refund_id", r.ID, "payment_intent_id", pi.ID)
+	s.auditar(ctx, model.EntradaAuditoria{
+		Action:          model.AuditoriaReembolso,
+		RifaID:          pi.Metadata["rifa_id"],
+		PaymentIntentID: pi.ID,
+		EntityID:        r.ID,
+		Detail:          map[string]interface{}{"amount": r.Amount, "currency": r.Currency, "reason": "registro_fallido", "provider": model.ProveedorStripe},
+	})
+	return r, nil
+}
+
+// capacidadEventosProcesados es cuántos IDs de evento guarda el LRU de cada servidor
+const capacidadEventosProcesados = 1000
+
+// cacheEventos es un LRU en memoria con los IDs de eventos ya procesados, para
+// que los reintentos seguidos de Stripe no consulten Supabase cada vez.
+type cacheEventos struct {
+	mu        sync.Mutex
+	capacidad int
+	orden     *list.List
+	items     map[string]*list.Element
+}
+
+func nuevoCacheEventos(capacidad int) *cacheEventos {
+	return &cacheEventos{
+		capacidad: capacidad,
+		orden:     list.New(),
+		items:     make(map[string]*list.Element),
+	}
+}
+
+func (c *cacheEventos) Contiene(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[id]; ok {
+		c.orden.MoveToFront(el)
+		return true
+	}
+	return false
+}
+
+func (c *cacheEventos) Agregar(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[id]; ok {
+		c.orden.MoveToFront(el)
+		return
+	}
+	c.items[id] = c.orden.PushFront(id)
+	if c.orden.Len() > c.capacidad {
+		ultimo := c.orden.Back()
+		c.orden.Remove(ultimo)
+		delete(c.items, ultimo.Value.(string))
+	}
+}
+
+// eventoProcesado consulta primero el LRU y luego la tabla webhook_events
+func (s *Server) eventoProcesado(ctx context.Context, eventID string) (bool, error) {
+	if s.procesados.Contiene(eventID) {
+		return true, nil
+	}
+	procesado, err := s.db.IsEventProcessed(ctx, eventID)
+	if err != nil {
+		return false, err
+	}
+	if procesado {
+		s.procesados.Agregar(eventID)
+	}
+	return procesado, nil
+}
+
+func (s *Server) marcarEventoProcesado(ctx context.Context, eventID string, tipo string) error {
+	if err := s.db.MarkEventProcessed(ctx, eventID, tipo); err != nil {
+		return err
+	}
+	s.procesados.Agregar(eventID)
+	return nil
+}
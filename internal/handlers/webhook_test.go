@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stripe/stripe-go/v84"
+
+	"PaymentsGo/internal/config"
+)
+
+func TestAdmitirEvento(t *testing.T) {
+	casos := []struct {
+		nombre   string
+		tipo     stripe.EventType
+		data     *stripe.EventData
+		estricto bool
+		admite   bool
+		status   int
+		ignorado bool
+	}{
+		{nombre: "tipo manejado", tipo: "payment_intent.succeeded", data: &stripe.EventData{Raw: json.RawMessage(`{"id":"pi_1"}`)}, admite: true},
+		{nombre: "objeto ilegible", tipo: "charge.refunded", data: &stripe.EventData{Raw: json.RawMessage(`[1]`)}, status: http.StatusBadRequest},
+		{nombre: "sin data", tipo: "review.opened", status: http.StatusBadRequest},
+		{nombre: "tipo desconocido", tipo: "customer.created", data: &stripe.EventData{Raw: json.RawMessage(`{}`)}, status: http.StatusOK, ignorado: true},
+		{nombre: "tipo desconocido en modo estricto", tipo: "invoice.paid", data: &stripe.EventData{Raw: json.RawMessage(`{}`)}, estricto: true, status: http.StatusBadRequest, ignorado: true},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			s := &Server{cfg: &config.Config{StripeWebhookStrict: c.estricto}}
+			w := httptest.NewRecorder()
+			antes := eventosIgnorados.Value(string(c.tipo))
+			admite := s.admitirEvento(context.Background(), w, stripe.Event{ID: "evt_1", Type: c.tipo, Data: c.data})
+			if admite != c.admite {
+				t.Fatalf("admitido = %v, se esperaba %v", admite, c.admite)
+			}
+			if !admite && w.Code != c.status {
+				t.Errorf("status = %d, se esperaba %d", w.Code, c.status)
+			}
+			if contados := eventosIgnorados.Value(string(c.tipo)) - antes; contados != map[bool]int64{true: 1}[c.ignorado] {
+				t.Errorf("webhook_events_ignored_total subió %d", contados)
+			}
+		})
+	}
+}
+
+// storeEventos es un Store con la tabla webhook_events en un mapa
+type storeEventos struct {
+	Store
+	procesados map[string]bool
+	consultas  int
+}
+
+func (f *storeEventos) IsEventProcessed(_ context.Context, eventID string) (bool, error) {
+	f.consultas++
+	return f.procesados[eventID], nil
+}
+
+func (f *storeEventos) MarkEventProcessed(_ context.Context, eventID string, _ string) error {
+	f.procesados[eventID] = true
+	return nil
+}
+
+func TestEventosProcesadosPorServidor(t *testing.T) {
+	produccion := servidorPrueba(&storeEventos{procesados: map[string]bool{}}, &pagosFalsos{}, &correoFalso{})
+	db := &storeEventos{procesados: map[string]bool{}}
+	sandbox := produccion.ActivarSandbox(db, &pagosFalsos{})
+	ctx := context.Background()
+
+	if err := produccion.marcarEventoProcesado(ctx, "evt_1", "payment_intent.succeeded"); err != nil {
+		t.Fatal(err)
+	}
+	// El sandbox no ve en su LRU el evento del servidor real: va a su tabla
+	if procesado, err := sandbox.eventoProcesado(ctx, "evt_1"); err != nil || procesado || db.consultas != 1 {
+		t.Fatalf("procesado = %v, err = %v, consultas = %d; se esperaba que el sandbox consultara su tabla", procesado, err, db.consultas)
+	}
+	if err := sandbox.marcarEventoProcesado(ctx, "evt_1", "payment_intent.succeeded"); err != nil {
+		t.Fatal(err)
+	}
+	if procesado, err := sandbox.eventoProcesado(ctx, "evt_1"); err != nil || !procesado || db.consultas != 1 {
+		t.Errorf("procesado = %v, err = %v, consultas = %d; se esperaba el LRU del sandbox", procesado, err, db.consultas)
+	}
+}
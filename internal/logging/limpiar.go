@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Redactado reemplaza el valor de un campo secreto en LimpiarJSON
+const Redactado = "[redactado]"
+
+// fragmentosSecretos marcan un campo que no se registra ni enmascarado: se
+// comparan contra la clave en minúsculas y sin _ ni -, así clientSecret,
+// captcha_token y X-Api-Key caen igual
+var fragmentosSecretos = []string{"token", "secret", "password", "authorization", "apikey", "signature", "cvc", "cvv", "cardnumber"}
+
+// LimpiarJSON devuelve el cuerpo listo para un log: recorre objetos y arreglos
+// a cualquier profundidad, enmascara los campos de email, redacta los que
+// parecen secretos y deja metadata en sus claves, como politicaDatos. Lo que
+// no es JSON (un cuerpo cortado, un CSV) no se registra: sólo su tamaño.
+func LimpiarJSON(cuerpo []byte) string {
+	if len(bytes.TrimSpace(cuerpo)) == 0 {
+		return ""
+	}
+	dec := json.NewDecoder(bytes.NewReader(cuerpo))
+	// Con UseNumber los montos salen tal cual y no como float64
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return fmt.Sprintf("[%d bytes que no son JSON]", len(cuerpo))
+	}
+	limpio, err := json.Marshal(limpiarValor("", v))
+	if err != nil {
+		return fmt.Sprintf("[%d bytes que no se pudieron limpiar]", len(cuerpo))
+	}
+	return string(limpio)
+}
+
+// limpiarValor limpia v, que vino bajo clave; los elementos de un arreglo
+// heredan la clave del arreglo, así "emails": ["a@b.com"] también se enmascara
+func limpiarValor(clave string, v any) any {
+	switch {
+	case clave == "metadata":
+		if m, ok := v.(map[string]any); ok {
+			return clavesDe(m)
+		}
+	case esClaveSecreta(clave):
+		return Redactado
+	}
+	switch t := v.(type) {
+	case map[string]any:
+		for k, hijo := range t {
+			t[k] = limpiarValor(k, hijo)
+		}
+		return t
+	case []any:
+		for i, hijo := range t {
+			t[i] = limpiarValor(clave, hijo)
+		}
+		return t
+	case string:
+		if strings.Contains(strings.ToLower(clave), "email") {
+			return EnmascararEmail(t)
+		}
+	}
+	return v
+}
+
+func esClaveSecreta(clave string) bool {
+	clave = strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(clave))
+	for _, f := range fragmentosSecretos {
+		if strings.Contains(clave, f) {
+			return true
+		}
+	}
+	return false
+}
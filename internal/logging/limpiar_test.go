@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLimpiarJSON(t *testing.T) {
+	casos := []struct {
+		nombre string
+		cuerpo string
+		limpio string
+	}{
+		{
+			nombre: "campos planos",
+			cuerpo: `{"rifaId":"r1","email":"juan@example.com","captchaToken":"abc","clientSecret":"pi_1_secret_2","amount":15000}`,
+			limpio: `{"amount":15000,"captchaToken":"[redactado]","clientSecret":"[redactado]","email":"j***@example.com","rifaId":"r1"}`,
+		},
+		{
+			nombre: "objetos anidados",
+			cuerpo: `{"buyer":{"recipientEmail":"ana@example.com","auth":{"access_token":"t","refresh-token":"r"},"name":"Ana"}}`,
+			limpio: `{"buyer":{"auth":{"access_token":"[redactado]","refresh-token":"[redactado]"},"name":"Ana","recipientEmail":"a***@example.com"}}`,
+		},
+		{
+			nombre: "arreglos de objetos",
+			cuerpo: `{"items":[{"rifaId":"r1","numbers":[1,2]},{"rifaId":"r2","email":"b@x.com"}],"emails":["c@x.com","d@y.com"]}`,
+			limpio: `{"emails":["c***@x.com","d***@y.com"],"items":[{"numbers":[1,2],"rifaId":"r1"},{"email":"b***@x.com","rifaId":"r2"}]}`,
+		},
+		{
+			nombre: "arreglo en la raíz",
+			cuerpo: `[{"password":"x"},[{"email":"e@x.com"}],"suelto"]`,
+			limpio: `[{"password":"[redactado]"},[{"email":"e***@x.com"}],"suelto"]`,
+		},
+		{
+			nombre: "secreto con objeto adentro",
+			cuerpo: `{"apiKey":{"id":"k1","valor":"v"}}`,
+			limpio: `{"apiKey":"[redactado]"}`,
+		},
+		{
+			nombre: "metadata sólo con claves",
+			cuerpo: `{"metadata":{"user_id":"u1","rifa_id":"r1"},"nested":{"metadata":{"z":"1","a":"2"}}}`,
+			limpio: `{"metadata":["rifa_id","user_id"],"nested":{"metadata":["a","z"]}}`,
+		},
+		{
+			nombre: "montos sin redondear",
+			cuerpo: `{"amount":12345678901234567890}`,
+			limpio: `{"amount":12345678901234567890}`,
+		},
+		{nombre: "vacío", cuerpo: "  ", limpio: ""},
+		{nombre: "cortado", cuerpo: `{"email":"juan@exa`, limpio: "[18 bytes que no son JSON]"},
+		{nombre: "dos valores", cuerpo: `{} {}`, limpio: "[5 bytes que no son JSON]"},
+		{nombre: "CSV", cuerpo: "numero,email\n1,juan@example.com\n", limpio: "[32 bytes que no son JSON]"},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			if got := LimpiarJSON([]byte(c.cuerpo)); got != c.limpio {
+				t.Errorf("LimpiarJSON(%s)\n = %s\nse esperaba %s", c.cuerpo, got, c.limpio)
+			}
+		})
+	}
+}
+
+func TestPoliticaDatos(t *testing.T) {
+	var salida bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&salida, &slog.HandlerOptions{ReplaceAttr: politicaDatos}))
+	log.Info("compra",
+		"email", "juan@example.com",
+		"from_email", "rifas@example.com",
+		"metadata", map[string]string{"user_id": "u1", "rifa_id": "r1"},
+		slog.Group("comprador", "email", "ana@example.com"),
+	)
+
+	var linea map[string]any
+	if err := json.Unmarshal(salida.Bytes(), &linea); err != nil {
+		t.Fatalf("línea inválida %q: %v", salida.String(), err)
+	}
+	if strings.Contains(salida.String(), "juan@") || strings.Contains(salida.String(), "ana@") {
+		t.Errorf("quedó un email en claro: %s", salida.String())
+	}
+	if got := linea["email"]; got != "j***@example.com" {
+		t.Errorf("email = %v", got)
+	}
+	if got := linea["from_email"]; got != "r***@example.com" {
+		t.Errorf("from_email = %v", got)
+	}
+	if got := linea["metadata"]; !reflect.DeepEqual(got, []any{"rifa_id", "user_id"}) {
+		t.Errorf("metadata = %v", got)
+	}
+	// Un email ya enmascarado no cambia al pasar otra vez
+	if got := EnmascararEmail(EnmascararEmail("juan@example.com")); got != "j***@example.com" {
+		t.Errorf("enmascarar dos veces = %q", got)
+	}
+}
@@ -0,0 +1,161 @@
+// Package logging configura slog, propaga el request ID y tiene los helpers
+// para no escribir datos del comprador en claro.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/stripe/stripe-go/v84"
+)
+
+// ConfigurarLogger instala el logger por defecto con el nivel dado y formato
+// json o texto (LOG_LEVEL y LOG_FORMAT en config). Todas las líneas pasan por
+// politicaDatos.
+func ConfigurarLogger(nivel slog.Level, formato string) {
+	opciones := &slog.HandlerOptions{Level: nivel, ReplaceAttr: politicaDatos}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, opciones)
+	if strings.EqualFold(formato, "json") {
+		handler = slog.NewJSONHandler(os.Stdout, opciones)
+	}
+	slog.SetDefault(slog.New(handlerConRequestID{handler}))
+}
+
+const CabeceraRequestID = "X-Request-ID"
+
+type claveRequestID struct{}
+
+// WithRequestID toma el X-Request-ID entrante (o genera uno), lo guarda en el
+// contexto para los logs y lo devuelve en la respuesta.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(CabeceraRequestID)
+		if !requestIDValido(id) {
+			id = NuevoUUID()
+		}
+		w.Header().Set(CabeceraRequestID, id)
+		next.ServeHTTP(w, r.WithContext(ConRequestID(r.Context(), id)))
+	})
+}
+
+// requestIDValido evita que un cliente meta IDs enormes o con caracteres de control en los logs
+func requestIDValido(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c > unicode.MaxASCII || !unicode.IsPrint(c) || c == ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+// ConRequestID guarda el ID en el contexto, como WithRequestID. Lo usan las
+// tareas que no corren dentro de la petición que las originó.
+func ConRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, claveRequestID{}, id)
+}
+
+// RequestIDDe devuelve el ID que WithRequestID o ConRequestID dejaron en el
+// contexto, "" si no hay; sirve para guardarlo con lo que se procesa después
+func RequestIDDe(ctx context.Context) string {
+	id, _ := ctx.Value(claveRequestID{}).(string)
+	return id
+}
+
+// handlerConRequestID agrega request_id a cada línea que se emite con un
+// contexto de petición (slog.InfoContext, etc.).
+type handlerConRequestID struct {
+	slog.Handler
+}
+
+func (h handlerConRequestID) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDDe(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h handlerConRequestID) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handlerConRequestID{h.Handler.WithAttrs(attrs)}
+}
+
+func (h handlerConRequestID) WithGroup(name string) slog.Handler {
+	return handlerConRequestID{h.Handler.WithGroup(name)}
+}
+
+// politicaDatos es lo que nunca sale en claro en un log, aunque quien escribe
+// la línea se olvide: un atributo email (o *_email) se enmascara siempre y
+// metadata se reduce a sus claves, que sirven para depurar sin exponer valores
+func politicaDatos(_ []string, a slog.Attr) slog.Attr {
+	switch {
+	case esClaveEmail(a.Key) && a.Value.Kind() == slog.KindString:
+		return slog.String(a.Key, EnmascararEmail(a.Value.String()))
+	case a.Key == "metadata":
+		return slog.Any(a.Key, clavesDe(a.Value.Any()))
+	}
+	return a
+}
+
+func esClaveEmail(clave string) bool {
+	return clave == "email" || strings.HasSuffix(clave, "_email")
+}
+
+// clavesDe devuelve las claves ordenadas de un mapa con claves de texto
+// (map[string]string de Stripe, map[string]any de un JSON); cualquier otra
+// cosa no se registra
+func clavesDe(v any) []string {
+	m := reflect.ValueOf(v)
+	if m.Kind() != reflect.Map || m.Type().Key().Kind() != reflect.String {
+		return nil
+	}
+	claves := make([]string, 0, m.Len())
+	for _, k := range m.MapKeys() {
+		claves = append(claves, k.String())
+	}
+	sort.Strings(claves)
+	return claves
+}
+
+// EnmascararEmail deja sólo la primera letra del usuario: a***@dominio.com
+func EnmascararEmail(email string) string {
+	usuario, dominio, ok := strings.Cut(email, "@")
+	if !ok || usuario == "" {
+		return "***"
+	}
+	return usuario[:1] + "***@" + dominio
+}
+
+// ConError agrega el error a los atributos del log; para errores de Stripe
+// incluye el código y el request ID para cruzarlos con el dashboard.
+func ConError(err error, attrs ...any) []any {
+	attrs = append(attrs, "error", err)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		attrs = append(attrs,
+			"stripe_code", string(stripeErr.Code),
+			"stripe_request_id", stripeErr.RequestID,
+		)
+	}
+	return attrs
+}
+
+// NuevoUUID genera un UUID v4
+func NuevoUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
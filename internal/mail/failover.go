@@ -0,0 +1,113 @@
+package mail
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/metrics"
+)
+
+// Proveedor es un servicio de envío de correos (Resend, SMTP). Send devuelve
+// el ID del mensaje con el que llegan los webhooks del proveedor, o "" si no
+// tiene.
+type Proveedor interface {
+	Nombre() string
+	Send(ctx context.Context, marca Marca, destinatario string, asunto string, html string, texto string, adjuntos ...Adjunto) (string, error)
+}
+
+var (
+	correosPorRespaldo = metrics.NewCounter("emails_fallback_total", "Correos enviados por el proveedor de respaldo")
+	aperturasCircuito  = metrics.NewCounter("email_circuit_opened_total", "Veces que el proveedor principal de correo se dejó de usar por fallas seguidas")
+)
+
+// FailoverMailer manda por el proveedor principal y, si falla, por el de
+// respaldo. Tras fallasParaAbrir fallas seguidas del principal el circuito se
+// abre: durante pausa los correos van directo al respaldo y después el
+// siguiente envío vuelve a probar el principal. Sin respaldo se comporta como
+// el principal solo.
+type FailoverMailer struct {
+	principal       Proveedor
+	respaldo        Proveedor
+	fallasParaAbrir int
+	pausa           time.Duration
+
+	mu      sync.Mutex
+	fallas  int
+	abierto time.Time
+}
+
+func NewFailoverMailer(principal Proveedor, respaldo Proveedor, fallasParaAbrir int, pausa time.Duration) *FailoverMailer {
+	return &FailoverMailer{principal: principal, respaldo: respaldo, fallasParaAbrir: fallasParaAbrir, pausa: pausa}
+}
+
+// Activo es el proveedor que usa el próximo envío
+func (m *FailoverMailer) Activo() Proveedor {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.respaldo != nil && !m.abierto.IsZero() && time.Since(m.abierto) < m.pausa {
+		return m.respaldo
+	}
+	return m.principal
+}
+
+// Send prueba el proveedor activo y, si era el principal y falló, el respaldo.
+// Un principal que respondió con error puede haber entregado igual (p. ej. un
+// timeout), así que en ese caso raro el comprador recibe el correo dos veces.
+func (m *FailoverMailer) Send(ctx context.Context, marca Marca, destinatario string, asunto string, html string, texto string, adjuntos ...Adjunto) (string, error) {
+	activo := m.Activo()
+	if activo != m.principal {
+		id, err := activo.Send(ctx, marca, destinatario, asunto, html, texto, adjuntos...)
+		if err == nil {
+			correosPorRespaldo.Inc()
+			slog.InfoContext(ctx, "correo enviado por el respaldo con el circuito abierto", "proveedor", activo.Nombre())
+		}
+		return id, err
+	}
+
+	id, err := m.principal.Send(ctx, marca, destinatario, asunto, html, texto, adjuntos...)
+	m.registrar(ctx, err)
+	if err == nil || m.respaldo == nil {
+		return id, err
+	}
+	slog.WarnContext(ctx, "falló el proveedor de correo principal, se usa el respaldo", logging.ConError(err, "proveedor", m.principal.Nombre(), "respaldo", m.respaldo.Nombre())...)
+	id, err = m.respaldo.Send(ctx, marca, destinatario, asunto, html, texto, adjuntos...)
+	if err != nil {
+		return "", err
+	}
+	correosPorRespaldo.Inc()
+	slog.InfoContext(ctx, "correo enviado por el respaldo", "proveedor", m.respaldo.Nombre())
+	return id, nil
+}
+
+// Probar manda el correo sólo por el proveedor activo, sin pasar al otro, para
+// saber si ese proveedor funciona; devuelve su nombre
+func (m *FailoverMailer) Probar(ctx context.Context, marca Marca, destinatario string, asunto string, html string, texto string) (string, error) {
+	activo := m.Activo()
+	_, err := activo.Send(ctx, marca, destinatario, asunto, html, texto)
+	if activo == m.principal {
+		m.registrar(ctx, err)
+	}
+	return activo.Nombre(), err
+}
+
+// registrar cuenta las fallas seguidas del principal; un envío bueno cierra el circuito
+func (m *FailoverMailer) registrar(ctx context.Context, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.fallas = 0
+		m.abierto = time.Time{}
+		return
+	}
+	m.fallas++
+	if m.respaldo != nil && m.fallas >= m.fallasParaAbrir {
+		if m.abierto.IsZero() || time.Since(m.abierto) >= m.pausa {
+			aperturasCircuito.Inc()
+			slog.WarnContext(ctx, "circuito de correo abierto: se usa el respaldo", "proveedor", m.principal.Nombre(), "fallas", m.fallas, "pausa", m.pausa)
+		}
+		m.abierto = time.Now()
+	}
+}
@@ -0,0 +1,153 @@
+package mail
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"PaymentsGo/internal/payments"
+)
+
+// IdiomaPorDefecto es el de los correos sin locale o con uno que no está en idiomas
+const IdiomaPorDefecto = "es"
+
+// Idioma es lo que cambia de un idioma a otro en los correos. Sumar un idioma
+// es sumar su entrada en idiomas: las plantillas y los asuntos que no traduzca
+// salen en español.
+type Idioma struct {
+	// HTML y Texto redefinen con {{define}} las plantillas de mail.go, con el
+	// mismo nombre y los mismos datos
+	HTML  string
+	Texto string
+	// Asuntos por clave de correo (confirmacion, confirmacion_vip)
+	Asuntos map[string]string
+	// Miles y Decimal son los separadores de los montos
+	Miles   string
+	Decimal string
+	// Fecha es el formato de las fechas con {dia}, {mes} y {anio}; Meses son
+	// los nombres de enero a diciembre
+	Fecha string
+	Meses [12]string
+}
+
+var idiomas = map[string]Idioma{
+	"es": {
+		Asuntos: map[string]string{
+			"confirmacion":     "Tus números confirmados",
+			"confirmacion_vip": "⭐ Tus números VIP confirmados",
+		},
+		Miles:   ",",
+		Decimal: ".",
+		Fecha:   "{dia} de {mes} de {anio}",
+		Meses:   [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+	},
+	"en": {
+		HTML: `
+{{define "confirmacion"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	{{if .VIP}}<h2 style="color: #c9a227;">⭐ You're a VIP buyer!</h2>{{else}}<h2 style="color: {{.Color}};">Purchase successful!</h2>{{end}}
+	{{range .Secciones}}
+	<p>Your numbers for <b>{{.RifaNombre}}</b>:</p>
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numeros}}</h1>
+	{{if .Folios}}<p style="color: #888; font-size: 12px;">Ticket IDs: {{.Folios}}</p>{{end}}
+	{{if .QR}}<p style="text-align: center;"><img src="cid:{{.QR}}" alt="Verification QR code" width="200" height="200"></p>{{end}}
+	{{if .Verificacion}}<p style="font-size: 12px;"><a href="{{.Verificacion}}" style="color: #888;">Verify these numbers</a></p>{{end}}
+	{{if .TramoMinimo}}<p>Volume price ({{.TramoMinimo}} or more): {{.PrecioTramo}} per number</p>{{end}}
+	{{end}}
+	{{if .Descuento}}<p><b>Original price:</b> {{.Subtotal}}</p>
+	<p><b>Discount:</b> -{{.Descuento}}</p>{{end}}
+	{{if .Monto}}<p><b>Total paid:</b> {{.Monto}}</p>{{end}}
+	{{if .Fecha}}<p style="color: #888; font-size: 12px;">Confirmed on {{.Fecha}}</p>{{end}}
+</div>
+{{end}}
+`,
+		Texto: `
+{{define "confirmacion"}}{{if .VIP}}⭐ You're a VIP buyer!{{else}}Purchase successful!{{end}}
+{{range .Secciones}}
+Your numbers for {{.RifaNombre}}:
+# {{.Numeros}}
+{{if .Folios}}Ticket IDs: {{.Folios}}
+{{end}}{{if .Verificacion}}Verify these numbers: {{.Verificacion}}
+{{end}}{{if .TramoMinimo}}Volume price ({{.TramoMinimo}} or more): {{.PrecioTramo}} per number
+{{end}}{{end}}{{if .Descuento}}
+Original price: {{.Subtotal}}
+Discount: -{{.Descuento}}{{end}}{{if .Monto}}
+Total paid: {{.Monto}}
+{{end}}{{if .Fecha}}
+Confirmed on {{.Fecha}}
+{{end}}{{end}}
+`,
+		Asuntos: map[string]string{
+			"confirmacion":     "Your numbers are confirmed",
+			"confirmacion_vip": "⭐ Your VIP numbers are confirmed",
+		},
+		Miles:   ",",
+		Decimal: ".",
+		Fecha:   "{mes} {dia}, {anio}",
+		Meses:   [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+	},
+}
+
+type plantillasIdioma struct {
+	html  *template.Template
+	texto *texttemplate.Template
+}
+
+// plantillasIdiomas son las plantillas en español con las de cada idioma encima
+var plantillasIdiomas = compilarIdiomas()
+
+func compilarIdiomas() map[string]plantillasIdioma {
+	compiladas := make(map[string]plantillasIdioma, len(idiomas))
+	for codigo, idioma := range idiomas {
+		h := template.Must(plantillasHTML.Clone())
+		t := texttemplate.Must(plantillasTexto.Clone())
+		if idioma.HTML != "" {
+			template.Must(h.Parse(idioma.HTML))
+		}
+		if idioma.Texto != "" {
+			texttemplate.Must(t.Parse(idioma.Texto))
+		}
+		compiladas[codigo] = plantillasIdioma{html: h, texto: t}
+	}
+	return compiladas
+}
+
+// ElegirIdioma reduce un locale ("en-US", "EN", "es_MX") a un idioma de
+// idiomas; uno desconocido o vacío es IdiomaPorDefecto
+func ElegirIdioma(locale string) string {
+	codigo := strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(codigo, "-_"); i >= 0 {
+		codigo = codigo[:i]
+	}
+	if _, ok := idiomas[codigo]; ok {
+		return codigo
+	}
+	return IdiomaPorDefecto
+}
+
+// Asunto devuelve el asunto del correo en el idioma, o en español si el idioma no lo traduce
+func Asunto(idioma string, clave string) string {
+	if asunto, ok := idiomas[ElegirIdioma(idioma)].Asuntos[clave]; ok {
+		return asunto
+	}
+	return idiomas[IdiomaPorDefecto].Asuntos[clave]
+}
+
+// FormatearMontoEn formatea un monto en unidades menores con los separadores del idioma
+func FormatearMontoEn(idioma string, monto int64, moneda string) string {
+	i := idiomas[ElegirIdioma(idioma)]
+	return payments.FormatearMontoCon(monto, moneda, i.Miles, i.Decimal)
+}
+
+// FormatearFechaEn escribe la fecha (sin hora) en el formato del idioma
+func FormatearFechaEn(idioma string, fecha time.Time) string {
+	i := idiomas[ElegirIdioma(idioma)]
+	return strings.NewReplacer(
+		"{dia}", strconv.Itoa(fecha.Day()),
+		"{mes}", i.Meses[fecha.Month()-1],
+		"{anio}", strconv.Itoa(fecha.Year()),
+	).Replace(i.Fecha)
+}
@@ -0,0 +1,648 @@
+// Package mail tiene las plantillas de los correos y el envío con Resend.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	netmail "net/mail"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/resend/resend-go/v2"
+	"github.com/skip2/go-qrcode"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/tracing"
+)
+
+// Las plantillas HTML usan html/template para que los títulos de las rifas y
+// cualquier dato del comprador se escapen solos. Cada plantilla tiene su
+// versión en texto plano con el mismo nombre para los clientes que quitan el HTML.
+var plantillasHTML = template.Must(template.New("correos").Parse(`
+{{define "logo"}}{{if .Logo}}<p style="text-align: center;"><img src="{{.Logo}}" alt="{{.NombreRemitente}}" style="max-width: 200px; max-height: 80px;"></p>{{end}}{{end}}
+{{define "confirmacion"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	{{if .VIP}}<h2 style="color: #c9a227;">⭐ ¡Eres un comprador VIP!</h2>{{else}}<h2 style="color: {{.Color}};">¡Compra Exitosa!</h2>{{end}}
+	{{range .Secciones}}
+	<p>Tus números para <b>{{.RifaNombre}}</b>:</p>
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numeros}}</h1>
+	{{if .Folios}}<p style="color: #888; font-size: 12px;">Folios: {{.Folios}}</p>{{end}}
+	{{if .QR}}<p style="text-align: center;"><img src="cid:{{.QR}}" alt="Código QR de verificación" width="200" height="200"></p>{{end}}
+	{{if .Verificacion}}<p style="font-size: 12px;"><a href="{{.Verificacion}}" style="color: #888;">Verificar estos números</a></p>{{end}}
+	{{if .TramoMinimo}}<p>Precio por volumen ({{.TramoMinimo}} o más): {{.PrecioTramo}} por número</p>{{end}}
+	{{end}}
+	{{if .Descuento}}<p><b>Precio original:</b> {{.Subtotal}}</p>
+	<p><b>Descuento:</b> -{{.Descuento}}</p>{{end}}
+	{{if .Monto}}<p><b>Total pagado:</b> {{.Monto}}</p>{{end}}
+	{{if .Fecha}}<p style="color: #888; font-size: 12px;">Confirmado el {{.Fecha}}</p>{{end}}
+</div>
+{{end}}
+
+{{define "organizador"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px;">
+	<h2>Nueva compra grande</h2>
+	<p><b>Comprador:</b> {{.Comprador}}</p>
+	<p><b>Rifa:</b> {{.RifaNombre}}</p>
+	<p><b>Números:</b> {{.Cantidad}}</p>
+	<p><b>Total pagado:</b> {{.Monto}}</p>
+</div>
+{{end}}
+
+{{define "aviso_organizador"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px;">
+	<h2>{{.Titulo}}</h2>
+	{{range .Detalles}}<p>{{.}}</p>
+	{{end}}
+</div>
+{{end}}
+
+{{define "reembolso"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">Lo sentimos</h2>
+	<p>No pudimos registrar tus números {{.Motivo}}:</p>
+	{{range .Secciones}}<p><b>{{.RifaNombre}}</b>: # {{.Numeros}}</p>
+	{{end}}
+	<p>Te devolvimos el pago completo; puede tardar algunos días en verse en tu estado de cuenta.</p>
+</div>
+{{end}}
+
+{{define "reembolso_confirmado"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">Reembolso confirmado</h2>
+	<p>Te devolvimos <b>{{.Monto}}</b> por tus números <b># {{.Numeros}}</b> de <b>{{.RifaNombre}}</b>, que quedaron liberados.</p>
+	<p>Puede tardar algunos días en verse en tu estado de cuenta.</p>
+</div>
+{{end}}
+
+{{define "regalo"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">🎁 ¡Te regalaron números!</h2>
+	<p>{{if .Nombre}}Hola {{.Nombre}}, {{end}}<b>{{.Remitente}}</b> te regaló estos números:</p>
+	{{range .Secciones}}
+	<p>Para <b>{{.RifaNombre}}</b>:</p>
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numeros}}</h1>
+	{{if .Folios}}<p style="color: #888; font-size: 12px;">Folios: {{.Folios}}</p>{{end}}
+	{{if .Verificacion}}<p style="font-size: 12px;"><a href="{{.Verificacion}}" style="color: #888;">Verificar estos números</a></p>{{end}}
+	{{end}}
+	<p>Los números quedan a nombre de quien te los regaló: si alguno sale ganador, le avisaremos a esa persona.</p>
+</div>
+{{end}}
+
+{{define "recibo_regalo"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">¡Regalo enviado!</h2>
+	<p>Le enviamos a <b>{{.Destinatario}}</b> sus números:</p>
+	{{range .Secciones}}<p><b>{{.RifaNombre}}</b>: # {{.Numeros}}</p>
+	{{end}}
+	{{if .Descuento}}<p><b>Precio original:</b> {{.Subtotal}}</p>
+	<p><b>Descuento:</b> -{{.Descuento}}</p>{{end}}
+	{{if .Monto}}<p><b>Total pagado:</b> {{.Monto}}</p>{{end}}
+</div>
+{{end}}
+
+{{define "ganador"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: #c9a227;">🎉 ¡Ganaste!</h2>
+	<p>Tu número fue el ganador de <b>{{.RifaNombre}}</b>:</p>
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numero}}</h1>
+	<p>Pronto te contactaremos para coordinar la entrega del premio.</p>
+</div>
+{{end}}
+
+{{define "anuncio_sorteo"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">Ya tenemos ganador</h2>
+	<p>Se realizó el sorteo de <b>{{.RifaNombre}}</b> y el número ganador fue:</p>
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numero}}</h1>
+	{{if .Numeros}}<p>Tus números: {{.Numeros}}</p>{{end}}
+	<p>Esta vez no saliste ganador. ¡Gracias por participar!</p>
+</div>
+{{end}}
+
+{{define "resumen_diario"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px;">
+	<h2>Resumen de ventas del {{.Fecha}}</h2>
+	{{if .Rifas}}<table style="width: 100%; border-collapse: collapse;">
+		<tr><th style="text-align: left;">Rifa</th><th style="text-align: right;">Números</th><th style="text-align: right;">Monto</th></tr>
+		{{range .Rifas}}<tr><td>{{.Nombre}}</td><td style="text-align: right;">{{.Numeros}}</td><td style="text-align: right;">{{.Monto}}</td></tr>
+		{{end}}
+	</table>
+	<p><b>Total:</b> {{.Numeros}} números, {{range $i, $t := .Totales}}{{if $i}} + {{end}}{{$t}}{{end}}</p>
+	{{else}}<p>No hubo ventas en las últimas 24 horas.</p>{{end}}
+</div>
+{{end}}
+
+{{define "prueba"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px;">
+	<h2>Correo de prueba</h2>
+	<p>Si lees esto, el envío de correos funciona.</p>
+</div>
+{{end}}
+
+{{define "pago_fallido"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">Tu pago no se completó</h2>
+	<p>No pudimos procesar el pago de tus números para <b>{{.RifaNombre}}</b> y fueron liberados.</p>
+	{{if .Enlace}}<p><a href="{{.Enlace}}" style="color: {{.Color}};">Intentar de nuevo</a></p>{{end}}
+</div>
+{{end}}
+
+{{define "pago_rechazado"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">Tu pago fue rechazado</h2>
+	<p>Revisamos el pago de estos números y no pudimos aprobarlo, así que quedaron liberados:</p>
+	{{range .Secciones}}<p><b>{{.RifaNombre}}</b>: # {{.Numeros}}</p>
+	{{end}}
+	<p>Si se llegó a hacer el cargo, ya se devolvió completo; puede tardar algunos días en verse en tu estado de cuenta.</p>
+</div>
+{{end}}
+
+{{define "espera_disponible"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">¡Tu número se liberó!</h2>
+	<p>El número que esperabas de <b>{{.RifaNombre}}</b> volvió a estar disponible:</p>
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numero}}</h1>
+	<p>Eres el primero de la lista hasta el {{.Vence}}; después se le avisa a la siguiente persona. Se lo lleva quien lo pague primero.</p>
+	{{if .Enlace}}<p><a href="{{.Enlace}}" style="color: {{.Color}};">Comprar el número</a></p>{{end}}
+</div>
+{{end}}
+
+{{define "ticket_transferido"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	{{if .Recibido}}<h2 style="color: {{.Color}};">¡Te transfirieron un número!</h2>
+	<p>Este número de <b>{{.RifaNombre}}</b> ahora está a tu nombre y participa en el sorteo:</p>{{else}}<h2 style="color: {{.Color}};">Transferiste tu número</h2>
+	<p>Este número de <b>{{.RifaNombre}}</b> pasó a otra cuenta y ya no participa a tu nombre:</p>{{end}}
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numero}}</h1>
+	{{if .Enlace}}<p style="font-size: 12px;"><a href="{{.Enlace}}" style="color: #888;">Verificar este número</a></p>{{end}}
+	{{if not .Recibido}}<p style="color: #888; font-size: 12px;">Si no pediste este cambio, responde este correo.</p>{{end}}
+</div>
+{{end}}
+
+{{define "cuota_pagada"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">Recibimos tu cuota {{.Cuota}} de {{.Cuotas}}</h2>
+	<p>Tus números para <b>{{.RifaNombre}}</b> quedan apartados:</p>
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numeros}}</h1>
+	<p>Llevas pagado {{.Pagado}}. Falta {{.Saldo}}, que tienes que completar antes del {{.Vence}}; si no, los números se liberan y se te devuelve lo pagado menos una comisión.</p>
+	<p>Los números participan en el sorteo cuando termines de pagarlos.</p>
+	{{if .Enlace}}<p><a href="{{.Enlace}}" style="color: {{.Color}};">Pagar la siguiente cuota</a></p>{{end}}
+</div>
+{{end}}
+
+{{define "cuotas_vencidas"}}
+<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
+	{{template "logo" .}}
+	<h2 style="color: {{.Color}};">Tu plan de cuotas venció</h2>
+	<p>No se completó el pago de tus números para <b>{{.RifaNombre}}</b> a tiempo y fueron liberados:</p>
+	<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># {{.Numeros}}</h1>
+	<p>Te devolvemos {{.Devuelto}}{{if .Comision}} (lo pagado menos la comisión de cancelación de {{.Comision}}){{end}}. El reembolso puede tardar unos días en verse en tu estado de cuenta.</p>
+</div>
+{{end}}
+`))
+
+var plantillasTexto = texttemplate.Must(texttemplate.New("correos").Parse(`
+{{define "confirmacion"}}{{if .VIP}}⭐ ¡Eres un comprador VIP!{{else}}¡Compra Exitosa!{{end}}
+{{range .Secciones}}
+Tus números para {{.RifaNombre}}:
+# {{.Numeros}}
+{{if .Folios}}Folios: {{.Folios}}
+{{end}}{{if .Verificacion}}Verificar estos números: {{.Verificacion}}
+{{end}}{{if .TramoMinimo}}Precio por volumen ({{.TramoMinimo}} o más): {{.PrecioTramo}} por número
+{{end}}{{end}}{{if .Descuento}}
+Precio original: {{.Subtotal}}
+Descuento: -{{.Descuento}}{{end}}{{if .Monto}}
+Total pagado: {{.Monto}}
+{{end}}{{if .Fecha}}
+Confirmado el {{.Fecha}}
+{{end}}{{end}}
+
+{{define "organizador"}}Nueva compra grande
+
+Comprador: {{.Comprador}}
+Rifa: {{.RifaNombre}}
+Números: {{.Cantidad}}
+Total pagado: {{.Monto}}
+{{end}}
+
+{{define "aviso_organizador"}}{{.Titulo}}
+{{range .Detalles}}
+{{.}}{{end}}
+{{end}}
+
+{{define "reembolso"}}Lo sentimos
+
+No pudimos registrar tus números {{.Motivo}}:
+{{range .Secciones}}{{.RifaNombre}}: # {{.Numeros}}
+{{end}}
+Te devolvimos el pago completo; puede tardar algunos días en verse en tu estado de cuenta.
+{{end}}
+
+{{define "reembolso_confirmado"}}Reembolso confirmado
+
+Te devolvimos {{.Monto}} por tus números # {{.Numeros}} de {{.RifaNombre}}, que quedaron liberados.
+Puede tardar algunos días en verse en tu estado de cuenta.
+{{end}}
+
+{{define "regalo"}}¡Te regalaron números!
+
+{{if .Nombre}}Hola {{.Nombre}}, {{end}}{{.Remitente}} te regaló estos números:
+{{range .Secciones}}
+Para {{.RifaNombre}}:
+# {{.Numeros}}
+{{if .Folios}}Folios: {{.Folios}}
+{{end}}{{if .Verificacion}}Verificar estos números: {{.Verificacion}}
+{{end}}{{end}}
+Los números quedan a nombre de quien te los regaló: si alguno sale ganador, le avisaremos a esa persona.
+{{end}}
+
+{{define "recibo_regalo"}}¡Regalo enviado!
+
+Le enviamos a {{.Destinatario}} sus números:
+{{range .Secciones}}{{.RifaNombre}}: # {{.Numeros}}
+{{end}}{{if .Descuento}}
+Precio original: {{.Subtotal}}
+Descuento: -{{.Descuento}}{{end}}{{if .Monto}}
+Total pagado: {{.Monto}}
+{{end}}{{end}}
+
+{{define "ganador"}}¡Ganaste!
+
+Tu número fue el ganador de {{.RifaNombre}}:
+# {{.Numero}}
+
+Pronto te contactaremos para coordinar la entrega del premio.
+{{end}}
+
+{{define "anuncio_sorteo"}}Ya tenemos ganador
+
+Se realizó el sorteo de {{.RifaNombre}} y el número ganador fue:
+# {{.Numero}}
+{{if .Numeros}}
+Tus números: {{.Numeros}}
+{{end}}
+Esta vez no saliste ganador. ¡Gracias por participar!
+{{end}}
+
+{{define "resumen_diario"}}Resumen de ventas del {{.Fecha}}
+{{range .Rifas}}
+{{.Nombre}}: {{.Numeros}} números, {{.Monto}}{{end}}
+{{if .Rifas}}
+Total: {{.Numeros}} números, {{range $i, $t := .Totales}}{{if $i}} + {{end}}{{$t}}{{end}}
+{{else}}
+No hubo ventas en las últimas 24 horas.
+{{end}}{{end}}
+
+{{define "prueba"}}Correo de prueba
+
+Si lees esto, el envío de correos funciona.
+{{end}}
+
+{{define "pago_fallido"}}Tu pago no se completó
+
+No pudimos procesar el pago de tus números para {{.RifaNombre}} y fueron liberados.
+{{if .Enlace}}Intentar de nuevo: {{.Enlace}}
+{{end}}{{end}}
+
+{{define "pago_rechazado"}}Tu pago fue rechazado
+
+Revisamos el pago de estos números y no pudimos aprobarlo, así que quedaron liberados:
+{{range .Secciones}}{{.RifaNombre}}: # {{.Numeros}}
+{{end}}
+Si se llegó a hacer el cargo, ya se devolvió completo; puede tardar algunos días en verse en tu estado de cuenta.
+{{end}}
+
+{{define "espera_disponible"}}¡Tu número se liberó!
+
+El número que esperabas de {{.RifaNombre}} volvió a estar disponible:
+# {{.Numero}}
+
+Eres el primero de la lista hasta el {{.Vence}}; después se le avisa a la siguiente persona. Se lo lleva quien lo pague primero.
+{{if .Enlace}}Comprar el número: {{.Enlace}}
+{{end}}{{end}}
+
+{{define "ticket_transferido"}}{{if .Recibido}}¡Te transfirieron un número!
+
+Este número de {{.RifaNombre}} ahora está a tu nombre y participa en el sorteo:{{else}}Transferiste tu número
+
+Este número de {{.RifaNombre}} pasó a otra cuenta y ya no participa a tu nombre:{{end}}
+# {{.Numero}}
+{{if .Enlace}}
+Verificar este número: {{.Enlace}}
+{{end}}{{if not .Recibido}}
+Si no pediste este cambio, responde este correo.
+{{end}}{{end}}
+
+{{define "cuota_pagada"}}Recibimos tu cuota {{.Cuota}} de {{.Cuotas}}
+
+Tus números para {{.RifaNombre}} quedan apartados:
+# {{.Numeros}}
+
+Llevas pagado {{.Pagado}}. Falta {{.Saldo}}, que tienes que completar antes del {{.Vence}}; si no, los números se liberan y se te devuelve lo pagado menos una comisión.
+Los números participan en el sorteo cuando termines de pagarlos.
+{{if .Enlace}}Pagar la siguiente cuota: {{.Enlace}}
+{{end}}{{end}}
+
+{{define "cuotas_vencidas"}}Tu plan de cuotas venció
+
+No se completó el pago de tus números para {{.RifaNombre}} a tiempo y fueron liberados:
+# {{.Numeros}}
+
+Te devolvemos {{.Devuelto}}{{if .Comision}} (lo pagado menos la comisión de cancelación de {{.Comision}}){{end}}. El reembolso puede tardar unos días en verse en tu estado de cuenta.
+{{end}}
+`))
+
+// Marca es cómo se presenta el correo de una rifa: el remitente, el logo de
+// arriba y el color de los encabezados. Los datos de las plantillas para
+// compradores la embeben; las del organizador no la usan.
+type Marca struct {
+	NombreRemitente string
+	EmailRemitente  string
+	// ResponderA es el Reply-To; vacío si las respuestas van al remitente
+	ResponderA string
+	// Logo es la URL de la imagen; vacío si el correo va sin logo
+	Logo  string
+	Color string
+}
+
+// De es el From del correo, con el nombre entre comillas si hace falta
+func (m Marca) De() string {
+	return (&netmail.Address{Name: m.NombreRemitente, Address: m.EmailRemitente}).String()
+}
+
+// SeccionCorreo son los números de una rifa dentro de un correo; una compra
+// de carrito tiene una sección por rifa
+type SeccionCorreo struct {
+	RifaNombre string
+	Numeros    string
+	// Folios son los IDs de los tickets, en el orden de Numeros; vacío si la
+	// compra no los trae (correos reenviados desde email_failures viejos)
+	Folios string
+	// Verificacion es el enlace firmado para comprobar que los números son reales
+	Verificacion string
+	// QR es el content ID del adjunto con el código QR de Verificacion; sólo
+	// en la confirmación
+	QR string
+	// TramoMinimo y PrecioTramo son el precio por volumen aplicado (0 si fue
+	// el precio fijo); sólo en la confirmación
+	TramoMinimo int
+	PrecioTramo string
+}
+
+// DatosConfirmacion son los datos de la plantilla de confirmación. Los montos
+// y la fecha ya vienen formateados en el idioma del correo.
+type DatosConfirmacion struct {
+	Marca
+	VIP       bool
+	Secciones []SeccionCorreo
+	Subtotal  string
+	Descuento string
+	Monto     string
+	Fecha     string
+}
+
+type DatosRegalo struct {
+	Marca
+	Nombre    string
+	Remitente string
+	Secciones []SeccionCorreo
+}
+
+type DatosReciboRegalo struct {
+	Marca
+	Destinatario string
+	Secciones    []SeccionCorreo
+	Subtotal     string
+	Descuento    string
+	Monto        string
+}
+
+type DatosOrganizador struct {
+	Comprador  string
+	RifaNombre string
+	Cantidad   int
+	Monto      string
+}
+
+type DatosAvisoOrganizador struct {
+	Titulo   string
+	Detalles []string
+}
+
+type DatosReembolso struct {
+	Marca
+	Secciones []SeccionCorreo
+	Motivo    string
+}
+
+type DatosReembolsoConfirmado struct {
+	Marca
+	RifaNombre string
+	Numeros    string
+	Monto      string
+}
+
+type DatosGanador struct {
+	Marca
+	RifaNombre string
+	Numero     int
+}
+
+// DatosAnuncioSorteo es el aviso a los demás compradores; Numeros son los suyos
+type DatosAnuncioSorteo struct {
+	Marca
+	RifaNombre string
+	Numero     int
+	Numeros    string
+}
+
+// DatosResumenDiario es el resumen de ventas de las últimas 24 horas; hay una
+// línea por rifa y moneda, y Totales suma cada moneda por separado
+type DatosResumenDiario struct {
+	Fecha   string
+	Rifas   []LineaResumen
+	Numeros int
+	Totales []string
+}
+
+type LineaResumen struct {
+	Nombre  string
+	Numeros int
+	Monto   string
+}
+
+type DatosPagoFallido struct {
+	Marca
+	RifaNombre string
+	Enlace     string
+}
+
+// DatosPagoRechazado avisa que la revisión de Radar rechazó el pago
+type DatosPagoRechazado struct {
+	Marca
+	Secciones []SeccionCorreo
+}
+
+// DatosEsperaDisponible avisa al primero de la lista de espera que su número
+// se liberó; Vence es hasta cuándo es el primero, ya formateado
+type DatosEsperaDisponible struct {
+	Marca
+	RifaNombre string
+	Numero     int
+	Vence      string
+	Enlace     string
+}
+
+// DatosTicketTransferido avisa del cambio de dueño de un ticket: Recibido es
+// true en el correo al nuevo dueño, que lleva el Enlace de verificación
+type DatosTicketTransferido struct {
+	Marca
+	RifaNombre string
+	Numero     int
+	Recibido   bool
+	Enlace     string
+}
+
+// DatosCuotaPagada confirma una cuota que no es la última; Pagado y Saldo ya
+// vienen formateados y Enlace es para pagar la siguiente
+type DatosCuotaPagada struct {
+	Marca
+	RifaNombre string
+	Numeros    string
+	Cuota      int
+	Cuotas     int
+	Pagado     string
+	Saldo      string
+	Vence      string
+	Enlace     string
+}
+
+// DatosCuotasVencidas avisa que un plan de cuotas venció sin pagarse; Comision
+// vacío si no se cobró comisión de cancelación
+type DatosCuotasVencidas struct {
+	Marca
+	RifaNombre string
+	Numeros    string
+	Devuelto   string
+	Comision   string
+}
+
+// RenderizarCorreo ejecuta la plantilla HTML y la de texto con el mismo nombre
+func RenderizarCorreo(nombre string, datos interface{}) (html string, texto string, err error) {
+	return RenderizarCorreoEn(IdiomaPorDefecto, nombre, datos)
+}
+
+// RenderizarCorreoEn es RenderizarCorreo con las plantillas del idioma; las que
+// el idioma no traduce salen en español
+func RenderizarCorreoEn(idioma string, nombre string, datos interface{}) (html string, texto string, err error) {
+	p := plantillasIdiomas[ElegirIdioma(idioma)]
+	var h, t bytes.Buffer
+	if err := p.html.ExecuteTemplate(&h, nombre, datos); err != nil {
+		return "", "", err
+	}
+	if err := p.texto.ExecuteTemplate(&t, nombre, datos); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(h.String()), strings.TrimSpace(t.String()), nil
+}
+
+// Adjunto es un archivo del correo. Con ContentID va inline y el HTML lo
+// muestra con src="cid:<ContentID>".
+type Adjunto struct {
+	Nombre      string
+	ContentType string
+	Contenido   []byte
+	ContentID   string
+}
+
+// CodigoQR genera el PNG del código QR del enlace, para mostrarlo en la
+// entrada de un sorteo presencial
+func CodigoQR(enlace string) ([]byte, error) {
+	return qrcode.Encode(enlace, qrcode.Medium, 256)
+}
+
+var tracer = otel.Tracer("PaymentsGo/internal/mail")
+
+// ResendMailer es el proveedor principal
+type ResendMailer struct {
+	client *resend.Client
+}
+
+func NewResendMailer(apiKey string) *ResendMailer {
+	return &ResendMailer{client: resend.NewClient(apiKey)}
+}
+
+func (m *ResendMailer) Nombre() string {
+	return "resend"
+}
+
+// Send manda el correo por Resend con el remitente y el Reply-To de la marca y
+// devuelve el ID que Resend le asignó. El span no lleva el destinatario para no
+// dejar emails en las trazas.
+func (m *ResendMailer) Send(ctx context.Context, marca Marca, destinatario string, asunto string, html string, texto string, adjuntos ...Adjunto) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "resend.Send", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+	params := &resend.SendEmailRequest{
+		From:    marca.De(),
+		To:      []string{destinatario},
+		Subject: asunto,
+		Html:    html,
+		Text:    texto,
+		ReplyTo: marca.ResponderA,
+	}
+	for _, a := range adjuntos {
+		params.Attachments = append(params.Attachments, &resend.Attachment{
+			Content:     a.Contenido,
+			Filename:    a.Nombre,
+			ContentType: a.ContentType,
+			ContentId:   a.ContentID,
+		})
+	}
+
+	enviado, err := m.client.Emails.SendWithContext(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	span.SetAttributes(attribute.String("resend.email_id", enviado.Id))
+	return enviado.Id, nil
+}
+
+func FormatearNumeros(numeros []int) string {
+	return strings.Trim(strings.Join(strings.Fields(fmt.Sprint(numeros)), ", "), "[]")
+}
+
+func SeccionesCorreo(items []model.ItemCompra) []SeccionCorreo {
+	secciones := make([]SeccionCorreo, len(items))
+	for i, item := range items {
+		secciones[i] = SeccionCorreo{RifaNombre: item.RifaTitle, Numeros: FormatearNumeros(item.Numeros), Folios: formatearFolios(item.TicketIDs), Verificacion: item.VerifyURL}
+	}
+	return secciones
+}
+
+// formatearFolios omite los IDs en 0 (tickets que no se pudieron leer)
+func formatearFolios(ids []int64) string {
+	var folios []string
+	for _, id := range ids {
+		if id != 0 {
+			folios = append(folios, strconv.FormatInt(id, 10))
+		}
+	}
+	return strings.Join(folios, ", ")
+}
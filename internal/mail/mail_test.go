@@ -0,0 +1,35 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderizarCorreoEscapaElTitulo(t *testing.T) {
+	const titulo = "<script>alert(1)</script>"
+	datos := DatosConfirmacion{
+		Marca:     Marca{Color: "#ff5252"},
+		Secciones: []SeccionCorreo{{RifaNombre: titulo, Numeros: "7, 12"}},
+		Monto:     "$20.00 MXN",
+	}
+	for _, idioma := range []string{IdiomaPorDefecto, "en"} {
+		t.Run(idioma, func(t *testing.T) {
+			html, texto, err := RenderizarCorreoEn(idioma, "confirmacion", datos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(html, titulo) {
+				t.Errorf("el HTML trae el título sin escapar:\n%s", html)
+			}
+			if !strings.Contains(html, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+				t.Errorf("el HTML no trae el título escapado:\n%s", html)
+			}
+			// El texto plano va tal cual: no hay HTML que inyectar
+			for _, parte := range []string{titulo, "7, 12", "$20.00 MXN"} {
+				if !strings.Contains(texto, parte) {
+					t.Errorf("el texto no trae %q:\n%s", parte, texto)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/tracing"
+)
+
+// SMTPMailer manda por un servidor SMTP; es el respaldo de Resend. En el
+// puerto 465 la conexión es TLS desde el inicio; en los demás se usa STARTTLS
+// si el servidor lo ofrece.
+type SMTPMailer struct {
+	host     string
+	puerto   int
+	usuario  string
+	password string
+}
+
+func NewSMTPMailer(host string, puerto int, usuario string, password string) *SMTPMailer {
+	return &SMTPMailer{host: host, puerto: puerto, usuario: usuario, password: password}
+}
+
+func (m *SMTPMailer) Nombre() string {
+	return "smtp"
+}
+
+// Send arma el mensaje MIME y lo entrega. El contexto corta la conexión
+// completa, no sólo la del dial. No devuelve ID: el servidor SMTP no manda
+// webhooks de entrega.
+func (m *SMTPMailer) Send(ctx context.Context, marca Marca, destinatario string, asunto string, html string, texto string, adjuntos ...Adjunto) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "smtp.Send", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+
+	mensaje, err := mensajeMIME(marca, destinatario, asunto, html, texto, adjuntos)
+	if err != nil {
+		return "", err
+	}
+
+	direccion := net.JoinHostPort(m.host, strconv.Itoa(m.puerto))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", direccion)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if limite, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(limite)
+	}
+	tlsConfig := &tls.Config{ServerName: m.host}
+	if m.puerto == 465 {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return "", err
+		}
+	}
+	if m.usuario != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.usuario, m.password, m.host)); err != nil {
+			return "", err
+		}
+	}
+	if err := c.Mail(marca.EmailRemitente); err != nil {
+		return "", err
+	}
+	if err := c.Rcpt(destinatario); err != nil {
+		return "", err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(mensaje); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return "", c.Quit()
+}
+
+// mensajeMIME arma multipart/mixed con un multipart/related adentro (texto y
+// HTML como alternativas, más los adjuntos inline que el HTML usa por cid) y
+// los demás adjuntos después
+func mensajeMIME(marca Marca, destinatario string, asunto string, html string, texto string, adjuntos []Adjunto) ([]byte, error) {
+	var buf bytes.Buffer
+	mixto := multipart.NewWriter(&buf)
+	cabeceras := []string{
+		"From: " + marca.De(),
+		"To: " + destinatario,
+		"Subject: " + mime.QEncoding.Encode("utf-8", asunto),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + idMensaje(marca.EmailRemitente),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + mixto.Boundary(),
+	}
+	if marca.ResponderA != "" {
+		cabeceras = append(cabeceras, "Reply-To: "+marca.ResponderA)
+	}
+	for _, c := range cabeceras {
+		buf.WriteString(c + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	relacionado, err := subparte(mixto, "multipart/related")
+	if err != nil {
+		return nil, err
+	}
+	alternativo, err := subparte(relacionado, "multipart/alternative")
+	if err != nil {
+		return nil, err
+	}
+	for _, cuerpo := range []struct{ tipo, contenido string }{{"text/plain", texto}, {"text/html", html}} {
+		parte, err := alternativo.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {cuerpo.tipo + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(parte)
+		if _, err := qp.Write([]byte(cuerpo.contenido)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := alternativo.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, a := range adjuntos {
+		if a.ContentID != "" {
+			if err := escribirAdjunto(relacionado, a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := relacionado.Close(); err != nil {
+		return nil, err
+	}
+	for _, a := range adjuntos {
+		if a.ContentID == "" {
+			if err := escribirAdjunto(mixto, a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := mixto.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// subparte abre dentro de w una parte multipart del tipo y devuelve el writer
+// de sus partes
+func subparte(w *multipart.Writer, tipo string) (*multipart.Writer, error) {
+	limite := multipart.NewWriter(nil).Boundary()
+	parte, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {tipo + "; boundary=" + limite}})
+	if err != nil {
+		return nil, err
+	}
+	sub := multipart.NewWriter(parte)
+	return sub, sub.SetBoundary(limite)
+}
+
+// escribirAdjunto va en base64 con líneas de 76 caracteres, como pide MIME
+func escribirAdjunto(w *multipart.Writer, a Adjunto) error {
+	cabecera := textproto.MIMEHeader{
+		"Content-Type":              {a.ContentType},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if a.ContentID != "" {
+		cabecera.Set("Content-ID", "<"+a.ContentID+">")
+		cabecera.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": a.Nombre}))
+	} else {
+		cabecera.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Nombre}))
+	}
+	parte, err := w.CreatePart(cabecera)
+	if err != nil {
+		return err
+	}
+	codificado := base64.StdEncoding.EncodeToString(a.Contenido)
+	for len(codificado) > 76 {
+		if _, err := fmt.Fprintf(parte, "%s\r\n", codificado[:76]); err != nil {
+			return err
+		}
+		codificado = codificado[76:]
+	}
+	_, err = fmt.Fprintf(parte, "%s\r\n", codificado)
+	return err
+}
+
+func idMensaje(remitente string) string {
+	aleatorio := make([]byte, 12)
+	rand.Read(aleatorio)
+	_, dominio, _ := strings.Cut(remitente, "@")
+	return "<" + hex.EncodeToString(aleatorio) + "@" + dominio + ">"
+}
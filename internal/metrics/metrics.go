@@ -0,0 +1,155 @@
+// Package metrics lleva contadores en memoria y los expone en el formato de
+// texto de Prometheus en GET /metrics.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type metrica interface {
+	escribir(w io.Writer)
+}
+
+var (
+	mu          sync.Mutex
+	registradas = map[string]metrica{}
+)
+
+// registrar guarda la métrica con su nombre; dos con el mismo nombre son un
+// error de programación
+func registrar(nombre string, m metrica) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registradas[nombre]; ok {
+		panic("métrica duplicada: " + nombre)
+	}
+	registradas[nombre] = m
+}
+
+// Counter es un contador que sólo sube
+type Counter struct {
+	nombre string
+	ayuda  string
+	valor  atomic.Int64
+}
+
+func NewCounter(nombre string, ayuda string) *Counter {
+	c := &Counter{nombre: nombre, ayuda: ayuda}
+	registrar(nombre, c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.valor.Add(1)
+}
+
+// Add suma n, que no debe ser negativo
+func (c *Counter) Add(n int64) {
+	c.valor.Add(n)
+}
+
+func (c *Counter) Value() int64 {
+	return c.valor.Load()
+}
+
+func (c *Counter) escribir(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.nombre, c.ayuda, c.nombre, c.nombre, c.Value())
+}
+
+// CounterVec es un contador por cada valor de una etiqueta, p. ej. el tipo
+// de evento; cada valor nuevo aparece como una serie más
+type CounterVec struct {
+	nombre   string
+	ayuda    string
+	etiqueta string
+	mu       sync.Mutex
+	valores  map[string]int64
+}
+
+func NewCounterVec(nombre string, ayuda string, etiqueta string) *CounterVec {
+	c := &CounterVec{nombre: nombre, ayuda: ayuda, etiqueta: etiqueta, valores: map[string]int64{}}
+	registrar(nombre, c)
+	return c
+}
+
+func (c *CounterVec) Inc(valor string) {
+	c.mu.Lock()
+	c.valores[valor]++
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Value(valor string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.valores[valor]
+}
+
+func (c *CounterVec) escribir(w io.Writer) {
+	c.mu.Lock()
+	valores := make([]string, 0, len(c.valores))
+	for v := range c.valores {
+		valores = append(valores, v)
+	}
+	sort.Strings(valores)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.nombre, c.ayuda, c.nombre)
+	for _, v := range valores {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", c.nombre, c.etiqueta, strconv.Quote(v), c.valores[v])
+	}
+	c.mu.Unlock()
+}
+
+// Gauge es un valor que sube y baja, p. ej. el largo de una cola
+type Gauge struct {
+	nombre string
+	ayuda  string
+	valor  atomic.Int64
+}
+
+func NewGauge(nombre string, ayuda string) *Gauge {
+	g := &Gauge{nombre: nombre, ayuda: ayuda}
+	registrar(nombre, g)
+	return g
+}
+
+func (g *Gauge) Add(n int64) {
+	g.valor.Add(n)
+}
+
+// Set reemplaza el valor, para los gauges que son un estado y no un conteo
+func (g *Gauge) Set(n int64) {
+	g.valor.Store(n)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.valor.Load()
+}
+
+func (g *Gauge) escribir(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.nombre, g.ayuda, g.nombre, g.nombre, g.Value())
+}
+
+// Handler responde GET /metrics con todas las métricas ordenadas por nombre
+func Handler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	nombres := make([]string, 0, len(registradas))
+	for n := range registradas {
+		nombres = append(nombres, n)
+	}
+	sort.Strings(nombres)
+	metricas := make([]metrica, len(nombres))
+	for i, n := range nombres {
+		metricas[i] = registradas[n]
+	}
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricas {
+		m.escribir(w)
+	}
+}
@@ -0,0 +1,66 @@
+package model
+
+import "time"
+
+// Actores de EntradaAuditoria: el comprador autenticado, quien usó
+// X-Admin-Key, o el servicio mismo (webhooks, barridos, workers)
+const (
+	ActorUsuario = "user"
+	ActorAdmin   = "admin"
+	ActorSistema = "system"
+)
+
+// Acciones de EntradaAuditoria
+const (
+	AuditoriaIntentCreado       = "intent.created"
+	AuditoriaTicketsRegistrados = "tickets.registered"
+	AuditoriaCorreoEnviado      = "email.sent"
+	AuditoriaReembolso          = "refund.issued"
+	AuditoriaSorteo             = "draw.run"
+	AuditoriaAnuncioSorteo      = "draw.announced"
+	AuditoriaTicketsManuales    = "tickets.manual_added"
+	AuditoriaBloqueo            = "blocklist.added"
+	AuditoriaDesbloqueo         = "blocklist.removed"
+	AuditoriaConciliacion       = "payments.reconciled"
+	AuditoriaReintentoCorreos   = "email_failures.retried"
+	AuditoriaResumen            = "digest.run"
+	AuditoriaCacheInvalidado    = "cache.invalidated"
+	AuditoriaCorreoPrueba       = "email.test_sent"
+	AuditoriaCorreoReenviado    = "email.resent"
+	AuditoriaTicketTransferido  = "ticket.transferred"
+	AuditoriaDatosBorrados      = "privacy.erased"
+	AuditoriaCuotaPagada        = "installment.paid"
+	AuditoriaCuotasVencidas     = "installment.expired"
+	AuditoriaRevisionAprobada   = "review.approved"
+	AuditoriaRevisionRechazada  = "review.declined"
+	AuditoriaSalidaReencolada   = "outbox.requeued"
+	AuditoriaDiferenciaPrecio   = "payment.price_mismatch"
+)
+
+// EntradaAuditoria es una fila de audit_log, que sólo recibe inserts: la tabla
+// no tiene UPDATE ni DELETE para la clave del servicio. CreatedAt es cuándo
+// pasó la acción, no cuándo se escribió la fila, que va en segundo plano.
+// Detail lleva lo que hace falta para reconstruir la acción (números, montos,
+// IDs del proveedor) y depende de Action. ActorID es el ID del usuario o, con
+// actor admin, la etiqueta de la clave de X-Admin-Key.
+type EntradaAuditoria struct {
+	ID              int64                  `json:"id,omitempty"`
+	Actor           string                 `json:"actor"`
+	ActorID         string                 `json:"actor_id,omitempty"`
+	Action          string                 `json:"action"`
+	RifaID          string                 `json:"rifa_id,omitempty"`
+	PaymentIntentID string                 `json:"payment_intent_id,omitempty"`
+	EntityID        string                 `json:"entity_id,omitempty"`
+	Detail          map[string]interface{} `json:"detail,omitempty"`
+	CreatedAt       string                 `json:"created_at"`
+}
+
+// FiltroAuditoria son los filtros de GET /admin/audit; los ceros no filtran.
+// Hasta es exclusivo.
+type FiltroAuditoria struct {
+	RifaID string
+	Desde  time.Time
+	Hasta  time.Time
+	Limit  int
+	Offset int
+}
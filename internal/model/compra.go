@@ -0,0 +1,204 @@
+package model
+
+import "errors"
+
+// PaymentRequest es el cuerpo de POST /payments/create-intent
+type PaymentRequest struct {
+	RifaID  string `json:"rifaId"`
+	Numeros []int  `json:"numeros"`
+	UserId  string `json:"userId"`
+	Email   string `json:"email"`
+	// Cantidad pide ese número de boletos al azar; sólo se usa si Numeros viene vacío
+	Cantidad int `json:"cantidad,omitempty"`
+	// Items compra números de varias rifas en un solo pago; si viene, RifaID,
+	// Numeros y Cantidad se ignoran
+	Items []ItemCarrito `json:"items,omitempty"`
+	// PromoCode es un código de la tabla codes que descuenta del total
+	PromoCode string `json:"promoCode,omitempty"`
+	// ReferralCode es el código de un referente (tabla referrers); no descuenta,
+	// le acredita una comisión al referente
+	ReferralCode string `json:"referralCode,omitempty"`
+	// RecipientEmail regala los números: los tickets quedan a nombre del
+	// comprador pero la confirmación le llega al destinatario
+	RecipientEmail string `json:"recipientEmail,omitempty"`
+	RecipientName  string `json:"recipientName,omitempty"`
+	// Locale elige el idioma del correo de confirmación ("es", "en", "en-US"...);
+	// uno vacío o sin traducción es español
+	Locale string `json:"locale,omitempty"`
+	// CaptchaToken es el token de Turnstile o reCAPTCHA del widget del
+	// frontend; sólo se exige si CAPTCHA_PROVIDER está configurado
+	CaptchaToken string `json:"captchaToken,omitempty"`
+	// Installments divide el pago en 2 o 3 cuotas; sólo con Stripe, una sola
+	// rifa, sesión iniciada y un precio por número desde INSTALLMENT_MIN_UNIT_PRICE
+	Installments int `json:"installments,omitempty"`
+}
+
+// ItemCarrito es una rifa dentro de un carrito: CreatePaymentIntent recibe
+// varias y las cobra en un solo PaymentIntent
+type ItemCarrito struct {
+	RifaID  string `json:"rifaId"`
+	Numeros []int  `json:"numeros"`
+}
+
+// ItemCompra es una rifa del carrito tal como queda en el borrador; Amount es
+// lo que se cobra por sus números, en la unidad menor de la moneda
+type ItemCompra struct {
+	RifaID    string `json:"rifa_id"`
+	RifaTitle string `json:"rifa_title"`
+	Numeros   []int  `json:"numeros"`
+	Amount    int64  `json:"amount"`
+	// TierMinQty y UnitPrice son el tramo de price_tiers aplicado, como en PurchaseDraft
+	TierMinQty int   `json:"tier_min_qty,omitempty"`
+	UnitPrice  int64 `json:"unit_price,omitempty"`
+	// TicketIDs son los IDs de los tickets ya registrados, en el orden de
+	// Numeros; los llena registrarTickets para el correo de confirmación
+	TicketIDs []int64 `json:"ticket_ids,omitempty"`
+	// VerifyURL es el enlace firmado de GET /tickets/verify para estos números;
+	// vacío si TICKET_SIGNING_SECRET o TICKET_VERIFY_URL no están configuradas
+	VerifyURL string `json:"verify_url,omitempty"`
+}
+
+// PurchaseDraft es la compra pendiente guardada en la tabla purchase_intent.
+// La metadata de Stripe tiene un límite de 500 caracteres por valor, así que los
+// números viven aquí y el intent sólo lleva el ID del borrador y la rifa.
+type PurchaseDraft struct {
+	ID              string `json:"id"`
+	PaymentIntentID string `json:"payment_intent_id"`
+	RifaID          string `json:"rifa_id"`
+	RifaTitle       string `json:"rifa_title"`
+	Numeros         []int  `json:"numeros"`
+	UserID          string `json:"user_id"`
+	Email           string `json:"email"`
+	Amount          int64  `json:"amount"`
+	ExpiresAt       string `json:"expires_at,omitempty"`
+	// Items sólo está en las compras de carrito; RifaID es el de la primera rifa
+	// y Numeros queda vacío
+	Items []ItemCompra `json:"items,omitempty"`
+	// Discount es lo que descontó PromoCode: el precio original es Amount + Discount
+	PromoCode string `json:"promo_code,omitempty"`
+	Discount  int64  `json:"discount,omitempty"`
+	// ReferralCode es el código de referrers que trajo la compra; se acredita
+	// al confirmarse el pago
+	ReferralCode string `json:"referral_code,omitempty"`
+	// TierMinQty es el tramo de price_tiers que se aplicó (0 si fue el precio
+	// fijo) y UnitPrice el precio por número resultante, en unidades menores
+	TierMinQty int   `json:"tier_min_qty,omitempty"`
+	UnitPrice  int64 `json:"unit_price,omitempty"`
+	// RecipientEmail es el destinatario de un regalo; vacío si no lo es
+	RecipientEmail string `json:"recipient_email,omitempty"`
+	RecipientName  string `json:"recipient_name,omitempty"`
+	// Locale es el idioma del correo, ya reducido por mail.ElegirIdioma
+	Locale string `json:"locale,omitempty"`
+	// Plan de cuotas, sólo si Installments > 1: Amount es el total y
+	// PaymentIntentID el intent de la primera cuota, con el que se registran
+	// los tickets. InstallmentIntents son los intents ya pagados, en orden, y
+	// NextInstallmentIntent el de la siguiente cuota si ya se pidió.
+	Installments          int      `json:"installments,omitempty"`
+	InstallmentsPaid      int      `json:"installments_paid,omitempty"`
+	InstallmentIntents    []string `json:"installment_intents,omitempty"`
+	NextInstallmentIntent string   `json:"next_installment_intent,omitempty"`
+	InstallmentDueAt      string   `json:"installment_due_at,omitempty"`
+	InstallmentStatus     string   `json:"installment_status,omitempty"`
+}
+
+// EmailFailure es un correo de confirmación que no se pudo enviar tras los reintentos
+type EmailFailure struct {
+	ID        int64        `json:"id,omitempty"`
+	Email     string       `json:"email"`
+	RifaTitle string       `json:"rifa_title"`
+	Numeros   []int        `json:"numeros"`
+	Amount    int64        `json:"amount,omitempty"`
+	Currency  string       `json:"currency,omitempty"`
+	Discount  int64        `json:"discount,omitempty"`
+	Items     []ItemCompra `json:"items,omitempty"`
+	// GiftFrom es el comprador cuando Email es el destinatario de un regalo
+	GiftFrom      string `json:"gift_from,omitempty"`
+	RecipientName string `json:"recipient_name,omitempty"`
+	Locale        string `json:"locale,omitempty"`
+	LastError     string `json:"last_error"`
+}
+
+// Tipos de EventoCorreo. EventoCorreoEnviado lo registra el servicio al
+// entregarle el correo a Resend; los demás llegan por POST /email/webhook.
+const (
+	EventoCorreoEnviado   = "email.sent"
+	EventoCorreoEntregado = "email.delivered"
+	EventoCorreoRebotado  = "email.bounced"
+	EventoCorreoQueja     = "email.complained"
+)
+
+// EventoCorreo es una fila de email_events, única por (message_id, type) para
+// que un webhook repetido no la duplique. MessageID es el ID que devolvió Resend.
+type EventoCorreo struct {
+	MessageID  string `json:"message_id"`
+	Type       string `json:"type"`
+	Email      string `json:"email"`
+	Template   string `json:"template,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	OccurredAt string `json:"occurred_at"`
+}
+
+// ErrorResponse es el cuerpo JSON que devuelven los handlers cuando algo falla
+type ErrorResponse struct {
+	Error     string      `json:"error"`
+	Code      string      `json:"code,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+}
+
+// CodigoPromo es una fila de la tabla codes. Un código con rifa_id sólo vale
+// para esa rifa; percent_off y amount_off son excluyentes y amount_off va en la
+// unidad menor de la moneda de la rifa. max_redemptions en 0 es sin límite.
+type CodigoPromo struct {
+	Code           string `json:"code"`
+	RifaID         string `json:"rifa_id"`
+	PercentOff     int    `json:"percent_off"`
+	AmountOff      int64  `json:"amount_off"`
+	MaxRedemptions int    `json:"max_redemptions"`
+	ExpiresAt      string `json:"expires_at"`
+}
+
+var ErrCodigoNoEncontrado = errors.New("código promocional no encontrado")
+
+var ErrCompraNoEncontrada = errors.New("compra no encontrada")
+
+// Recibo es una fila de receipts: su ID es el número secuencial que va
+// impreso en el PDF, uno por PaymentIntent
+type Recibo struct {
+	ID              int64  `json:"id,omitempty"`
+	PaymentIntentID string `json:"payment_intent_id"`
+	Email           string `json:"email"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	CreatedAt       string `json:"created_at,omitempty"`
+}
+
+// CompradorBloqueado es una fila de blocked_buyers. Email va normalizado (en
+// minúsculas y, en Gmail, sin puntos ni +alias) y puede faltar si se bloquea
+// sólo el usuario; PaymentIntentID es la compra disputada si el bloqueo vino de una disputa.
+type CompradorBloqueado struct {
+	ID              int64  `json:"id,omitempty"`
+	Email           string `json:"email,omitempty"`
+	UserID          string `json:"user_id,omitempty"`
+	Reason          string `json:"reason"`
+	PaymentIntentID string `json:"payment_intent_id,omitempty"`
+	CreatedAt       string `json:"created_at,omitempty"`
+}
+
+// DiferenciaPrecio es una fila de price_mismatches: un pago de Stripe cuyo
+// monto no coincide con el precio esperado. La compra queda sin tickets, con
+// los números reservados, hasta que el organizador la resuelva. Authority es
+// el PRICE_AUTHORITY con que se calculó ExpectedAmount.
+type DiferenciaPrecio struct {
+	ID              int64        `json:"id,omitempty"`
+	PaymentIntentID string       `json:"payment_intent_id"`
+	PurchaseID      string       `json:"purchase_intent_id,omitempty"`
+	RifaID          string       `json:"rifa_id"`
+	Email           string       `json:"email,omitempty"`
+	Items           []ItemCompra `json:"items"`
+	ExpectedAmount  int64        `json:"expected_amount"`
+	PaidAmount      int64        `json:"paid_amount"`
+	Currency        string       `json:"currency"`
+	Authority       string       `json:"authority"`
+	CreatedAt       string       `json:"created_at,omitempty"`
+}
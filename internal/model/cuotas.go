@@ -0,0 +1,21 @@
+package model
+
+// Estados del plan de cuotas de un borrador (installment_status). Un plan
+// vencido pasa por PlanCuotasCancelando mientras se devuelven las cuotas, así
+// un barrido cortado a la mitad lo retoma.
+const (
+	PlanCuotasActivo     = "active"
+	PlanCuotasPagado     = "paid"
+	PlanCuotasCancelando = "canceling"
+	PlanCuotasCancelado  = "canceled"
+)
+
+// CambioPlanCuotas son las columnas del plan que cambia UpdateInstallmentPlan;
+// los campos vacíos no se tocan
+type CambioPlanCuotas struct {
+	InstallmentsPaid      int      `json:"installments_paid,omitempty"`
+	InstallmentIntents    []string `json:"installment_intents,omitempty"`
+	NextInstallmentIntent *string  `json:"next_installment_intent,omitempty"`
+	InstallmentDueAt      string   `json:"installment_due_at,omitempty"`
+	InstallmentStatus     string   `json:"installment_status,omitempty"`
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// Estados de EntradaEspera. Una entrada notified tiene el número ofrecido
+// hasta ClaimExpiresAt; después pasa a expired y se avisa a la siguiente.
+const (
+	EsperaPendiente  = "waiting"
+	EsperaNotificada = "notified"
+	EsperaVencida    = "expired"
+)
+
+// EntradaEspera es una fila de waitlist: un usuario que quiere un número ya
+// vendido o reservado. El unique es (rifa_id, number, user_id) mientras la
+// entrada está waiting o notified.
+type EntradaEspera struct {
+	ID             int64      `json:"id,omitempty"`
+	RifaID         string     `json:"rifa_id"`
+	Number         int        `json:"number"`
+	UserID         string     `json:"user_id"`
+	Email          string     `json:"email"`
+	Status         string     `json:"status"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	NotifiedAt     *time.Time `json:"notified_at,omitempty"`
+	ClaimExpiresAt *time.Time `json:"claim_expires_at,omitempty"`
+}
+
+// ErrYaEnEspera indica que el usuario ya espera ese número
+var ErrYaEnEspera = errors.New("el usuario ya está en la lista de espera del número")
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Estados de una entrada del outbox
+const (
+	SalidaPendiente = "pending"
+	SalidaEnviada   = "sent"
+	// SalidaMuerta agotó los intentos; se vuelve a encolar desde
+	// POST /admin/outbox/{id}/requeue
+	SalidaMuerta = "dead"
+)
+
+// OutboxEntry es un correo o aviso guardado en la tabla outbox junto con el
+// paso que lo origina (registrar los tickets, reembolsar) y que el despachador
+// ejecuta después. Kind dice qué acción es y Payload lleva sus datos;
+// dedup_key es unique para que un reintento del trabajo no lo duplique.
+type OutboxEntry struct {
+	ID       int64           `json:"id,omitempty"`
+	Kind     string          `json:"kind"`
+	DedupKey string          `json:"dedup_key"`
+	Payload  json.RawMessage `json:"payload"`
+	// Email es el del cliente que aparece en la entrada, para borrarla con sus
+	// datos. Sin omitempty: PostgREST pide las mismas claves en todo el lote.
+	Email         string    `json:"email"`
+	RequestID     string    `json:"request_id,omitempty"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	// CreatedAt lo pone Supabase
+	CreatedAt string     `json:"created_at,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+}
@@ -0,0 +1,23 @@
+package model
+
+// DatosBorrados es lo que tocó EraseUserData en cada tabla. Los tickets no se
+// borran: pasan al perfil tombstone y conservan número, rifa y pago, para que
+// el sorteo se pueda seguir verificando. Los contadores son filas.
+type DatosBorrados struct {
+	// Tickets son los que pasaron al tombstone, con rifa_id, number y
+	// payment_intent_id
+	Tickets []TicketAdmin
+	Sorteos int
+	// PaymentIntentIDs son los de los borradores eliminados, para pedir la
+	// redacción en el proveedor
+	PaymentIntentIDs     []string
+	Borradores           int
+	Regalos              int
+	FallosCorreo         int
+	Espera               int
+	EventosCorreo        int
+	Rebotes              int
+	NotificacionesSorteo int
+	// Salidas son las entradas del outbox dirigidas al email, enviadas o no
+	Salidas int
+}
@@ -0,0 +1,34 @@
+package model
+
+import "errors"
+
+// Referente es una fila de referrers: un embajador con su código. Un
+// CommissionPercent en 0 usa REFERRAL_COMMISSION_PERCENT.
+type Referente struct {
+	Code              string  `json:"code"`
+	Email             string  `json:"email"`
+	Name              string  `json:"name"`
+	CommissionPercent float64 `json:"commission_percent"`
+	Active            bool    `json:"active"`
+}
+
+// ErrReferenteNoEncontrado indica que no hay referente con ese código
+var ErrReferenteNoEncontrado = errors.New("referente no encontrado")
+
+// CreditoReferido es una fila de referral_credits, única por
+// payment_intent_id: la comisión de una venta confirmada con el código.
+// Amount es lo cobrado y Commission lo que le corresponde al referente, en la
+// unidad menor de Currency; ClawedBack es la parte de la comisión que se
+// descontó por reembolsos o disputas. En un carrito RifaID es la primera rifa.
+type CreditoReferido struct {
+	ID                int64   `json:"id,omitempty"`
+	Code              string  `json:"code"`
+	RifaID            string  `json:"rifa_id"`
+	PaymentIntentID   string  `json:"payment_intent_id"`
+	Amount            int64   `json:"amount"`
+	Currency          string  `json:"currency"`
+	CommissionPercent float64 `json:"commission_percent"`
+	Commission        int64   `json:"commission"`
+	ClawedBack        int64   `json:"clawed_back"`
+	CreatedAt         string  `json:"created_at,omitempty"`
+}
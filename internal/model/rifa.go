@@ -0,0 +1,117 @@
+// Package model tiene los tipos que comparten los demás paquetes: los cuerpos
+// JSON de la API y las filas de Supabase.
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type Rifa struct {
+	ID             string `json:"id"`
+	Price          int64  `json:"price"`
+	Title          string `json:"title"`
+	TotalNumbers   int    `json:"total_numbers"`
+	AllowAnonymous bool   `json:"allow_anonymous"`
+	Currency       string `json:"currency"`
+	PriceUnit      string `json:"price_unit"`
+	Status         string `json:"status"`
+	DrawDate       string `json:"draw_date"`
+	MaxPerUser     int    `json:"max_per_user"`
+	// PriceTiers es el JSON crudo de price_tiers; se interpreta con tramosPrecio
+	PriceTiers json.RawMessage `json:"price_tiers"`
+	// Providers son los proveedores de pago con que se puede comprar (columna
+	// text[] providers); vacío o null acepta todos los configurados
+	Providers []string `json:"providers"`
+	// OrganizerStripeAccount es la cuenta conectada (acct_...) del organizador
+	// que cobra la rifa; vacío cobra en la cuenta de la plataforma
+	OrganizerStripeAccount string `json:"organizer_stripe_account"`
+	// Branding es la fila de rifa_branding; nil si la rifa usa la marca global
+	Branding *MarcaRifa `json:"rifa_branding"`
+}
+
+// MarcaRifa es cómo se presentan los correos de una rifa de otro organizador.
+// Los campos vacíos toman el valor global de EMAIL_*.
+type MarcaRifa struct {
+	FromName    string `json:"from_name"`
+	FromEmail   string `json:"from_email"`
+	ReplyTo     string `json:"reply_to"`
+	LogoURL     string `json:"logo_url"`
+	AccentColor string `json:"accent_color"`
+}
+
+// NumeroRechazado describe por qué un número de la solicitud no es válido
+type NumeroRechazado struct {
+	Numero int    `json:"numero"`
+	Motivo string `json:"motivo"`
+}
+
+// ErrNumerosOcupados indica que otro usuario ya compró o reservó alguno de los números
+type ErrNumerosOcupados struct {
+	Numeros []int
+}
+
+func (e *ErrNumerosOcupados) Error() string {
+	return fmt.Sprintf("números no disponibles: %v", e.Numeros)
+}
+
+// ErrTicketsNoRegistrados indica que algunos lotes del insert de tickets
+// fallaron; Numeros son los que no quedaron registrados y Causa es el error
+// del primer lote que falló
+type ErrTicketsNoRegistrados struct {
+	Numeros []int
+	Causa   error
+}
+
+func (e *ErrTicketsNoRegistrados) Error() string {
+	return fmt.Sprintf("tickets sin registrar %v: %v", e.Numeros, e.Causa)
+}
+
+func (e *ErrTicketsNoRegistrados) Unwrap() error {
+	return e.Causa
+}
+
+// Sorteo es una fila de la tabla draws. Con Seed y la lista de números
+// vendidos cualquiera puede repetir el cálculo de verificarSorteo.
+type Sorteo struct {
+	ID            int64  `json:"id,omitempty"`
+	RifaID        string `json:"rifa_id"`
+	WinningNumber int    `json:"winning_number"`
+	ProfileID     string `json:"profile_id"`
+	Email         string `json:"-"`
+	DrawnAt       string `json:"drawn_at"`
+	Seed          string `json:"seed"`
+	TicketsHash   string `json:"tickets_hash"`
+	TotalTickets  int    `json:"total_tickets"`
+	Forced        bool   `json:"forced"`
+}
+
+// Tipos y estados de NotificacionSorteo
+const (
+	NotificacionGanador      = "winner"
+	NotificacionParticipante = "participant"
+
+	NotificacionEnviando = "sending"
+	NotificacionEnviada  = "sent"
+	NotificacionFallida  = "failed"
+)
+
+// NotificacionSorteo es una fila de draw_notifications: un correo del anuncio
+// de un sorteo, único por (draw_id, email, kind). Una fila en sending es un
+// envío que empezó y no se sabe si terminó (el proceso se cayó a la mitad).
+type NotificacionSorteo struct {
+	DrawID    int64  `json:"draw_id"`
+	Email     string `json:"email"`
+	Kind      string `json:"kind"`
+	Status    string `json:"status"`
+	LastError string `json:"last_error"`
+}
+
+var ErrSorteoNoEncontrado = errors.New("la rifa no tiene sorteo")
+
+var ErrRifaNoEncontrada = errors.New("rifa no encontrada")
+
+// ErrDisponibilidadNoVerificada indica que Supabase no respondió (o respondió algo
+// ilegible) al consultar los números, a diferencia de ErrNumerosOcupados.
+var ErrDisponibilidadNoVerificada = errors.New("no se pudo verificar la disponibilidad")
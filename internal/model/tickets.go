@@ -0,0 +1,128 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// Valores de payment_provider: quién cobró los tickets. Las compras gratis y
+// las ventas manuales no lo llevan.
+const (
+	ProveedorStripe      = "stripe"
+	ProveedorPayPal      = "paypal"
+	ProveedorMercadoPago = "mercadopago"
+)
+
+// MetodoPagoManual es el payment_method de los tickets de ventas en efectivo o
+// por transferencia, registradas con POST /admin/tickets/manual
+const MetodoPagoManual = "manual"
+
+// PagoTickets son los datos del cobro que se guardan en cada ticket
+type PagoTickets struct {
+	PaymentIntentID string
+	Amount          int64
+	Currency        string
+	PaidAt          time.Time
+	// Provider es ProveedorStripe, ProveedorPayPal o ProveedorMercadoPago
+	Provider string
+	// OrganizerAccount es la cuenta conectada de Stripe que recibió el cobro
+	OrganizerAccount string
+	// Method, Label y Reference sólo van en las ventas manuales: Method es
+	// MetodoPagoManual, Label cómo se pagó ("zelle", "efectivo") y Reference el
+	// número de la transferencia, si hay
+	Method    string
+	Label     string
+	Reference string
+	// BalanceDue es lo que falta pagar de una compra en cuotas; con saldo los
+	// tickets quedan partially_paid
+	BalanceDue int64
+	// OnHold registra los tickets como on_hold: el cargo está en revisión de
+	// Radar y no cuentan hasta que se apruebe
+	OnHold bool
+}
+
+// TicketRegistrado es un ticket recién confirmado; el ID va como folio en el correo
+type TicketRegistrado struct {
+	ID     int64 `json:"id"`
+	Number int   `json:"number"`
+}
+
+// TicketVerificable es un ticket leído para GET /tickets/verify; Email es el
+// del perfil del comprador
+type TicketVerificable struct {
+	Number int    `json:"number"`
+	Status string `json:"status"`
+	Email  string `json:"email"`
+}
+
+// Reserva es un número apartado en ticket_reservation mientras se paga
+type Reserva struct {
+	RifaID          string    `json:"rifa_id"`
+	Number          int       `json:"number"`
+	UserID          string    `json:"user_id"`
+	PaymentIntentID string    `json:"payment_intent_id"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// TicketAdmin es un ticket vendido con el email del comprador (de profiles)
+type TicketAdmin struct {
+	// RifaID sólo viene en PaymentIntentTickets: un carrito tiene varias rifas
+	RifaID          string `json:"rifa_id,omitempty"`
+	Number          int    `json:"number"`
+	ProfileID       string `json:"profile_id"`
+	Email           string `json:"email"`
+	CreatedAt       string `json:"created_at"`
+	PaymentIntentID string `json:"payment_intent_id"`
+	AmountPaid      int64  `json:"amount_paid"`
+	Currency        string `json:"currency"`
+	PaidAt          string `json:"paid_at"`
+	Status          string `json:"status"`
+	PaymentProvider string `json:"payment_provider"`
+	// OrganizerAccount es la cuenta de Stripe Connect del organizador; vacío
+	// si el cobro quedó en la cuenta de la plataforma
+	OrganizerAccount string `json:"organizer_account"`
+	// EmailUndeliverable es true si un correo al comprador rebotó
+	EmailUndeliverable bool `json:"email_undeliverable"`
+}
+
+// FiltroTickets son los filtros y la paginación de ListTickets; Number 0 es sin
+// filtro. DespuesDe pagina por número (keyset) en lugar de offset. SoloVigentes
+// descarta los reembolsados y disputados.
+type FiltroTickets struct {
+	Email        string
+	Number       int
+	DespuesDe    int
+	SoloVigentes bool
+	Limit        int
+	Offset       int
+}
+
+// TicketVendido es un ticket con lo que se pagó por él, para el resumen diario
+// y la conciliación con Stripe; AmountPaid va en la unidad menor de Currency
+type TicketVendido struct {
+	ID              int64  `json:"id"`
+	RifaID          string `json:"rifa_id"`
+	RifaTitle       string `json:"-"`
+	PaymentIntentID string `json:"payment_intent_id"`
+	AmountPaid      int64  `json:"amount_paid"`
+	Currency        string `json:"currency"`
+}
+
+// TicketUsuario es un ticket del usuario con los datos de su rifa
+type TicketUsuario struct {
+	Number    int
+	CreatedAt string
+	RifaID    string
+	RifaTitle string
+	DrawDate  string
+}
+
+// Perfil es una fila de profiles: la cuenta a la que pertenece un ticket
+type Perfil struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ErrPerfilNoEncontrado indica que no hay cuenta con ese ID o email
+var ErrPerfilNoEncontrado = errors.New("perfil no encontrado")
@@ -0,0 +1,28 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Estados de un trabajo de pending_jobs
+const (
+	TrabajoPendiente = "pending"
+	TrabajoFallido   = "failed"
+)
+
+// PendingJob es un evento del webhook guardado en pending_jobs hasta que un
+// worker lo procesa. Payload es el evento tal como lo mandó Stripe, con la
+// firma ya verificada; event_id es unique para que un reintento no lo duplique.
+type PendingJob struct {
+	ID        int64           `json:"id,omitempty"`
+	EventID   string          `json:"event_id"`
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload"`
+	// RequestID es el de la petición del webhook, para seguir el trabajo en los logs
+	RequestID     string    `json:"request_id,omitempty"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
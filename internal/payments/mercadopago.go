@@ -0,0 +1,365 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/tracing"
+)
+
+// Estados de un pago de MercadoPago que se usan del lado nuestro
+const (
+	PagoMercadoPagoAprobado   = "approved"
+	PagoMercadoPagoPendiente  = "pending"
+	PagoMercadoPagoEnProceso  = "in_process"
+	PagoMercadoPagoAutorizado = "authorized"
+)
+
+// ErrFirmaMercadoPago es un webhook cuyo x-signature no corresponde al secreto
+var ErrFirmaMercadoPago = errors.New("firma del webhook de MercadoPago inválida")
+
+// ErrMonedaMercadoPago es un monto que MercadoPago no puede cobrar: una moneda
+// que no opera o centavos en una que no los admite
+var ErrMonedaMercadoPago = errors.New("MercadoPago no puede cobrar este monto")
+
+// ErrMercadoPago es una respuesta de error de la API; Codigo es el primer
+// cause[].code o, si no hay, el campo error
+type ErrMercadoPago struct {
+	Status  int
+	Codigo  string
+	Mensaje string
+}
+
+func (e *ErrMercadoPago) Error() string {
+	return fmt.Sprintf("mercadopago %d %s: %s", e.Status, e.Codigo, e.Mensaje)
+}
+
+// decimalesMercadoPago son las monedas que cobra MercadoPago con los
+// decimales que acepta en unit_price. COP va sin decimales aunque en Stripe y
+// en la base tenga dos: el monto en centavos tiene que ser de pesos enteros.
+var decimalesMercadoPago = map[string]int{
+	"ars": 2, "brl": 2, "clp": 0, "cop": 0, "mxn": 2, "pen": 2, "uyu": 2,
+}
+
+// MonedaMercadoPago dice si MercadoPago opera la moneda
+func MonedaMercadoPago(moneda string) bool {
+	_, ok := decimalesMercadoPago[NormalizarMoneda(moneda)]
+	return ok
+}
+
+// NuevaPreferenciaMP es un checkout de un solo ítem. Monto va en la unidad
+// menor de Moneda (la de Stripe) y ExternalReference vuelve en cada pago.
+type NuevaPreferenciaMP struct {
+	Monto             int64
+	Moneda            string
+	Titulo            string
+	Email             string
+	ExternalReference string
+	// NotificationURL y ReturnURL son opcionales: sin la primera vale el
+	// webhook configurado en el panel de MercadoPago
+	NotificationURL string
+	ReturnURL       string
+	Vence           time.Time
+}
+
+// PreferenciaMP es el checkout creado; InitPoint es la URL a la que el
+// frontend manda al comprador
+type PreferenciaMP struct {
+	ID        string
+	InitPoint string
+}
+
+// PagoMP es lo que se usa de un pago; Monto va en la unidad menor de Moneda
+type PagoMP struct {
+	ID                string
+	Status            string
+	StatusDetail      string
+	ExternalReference string
+	Monto             int64
+	Moneda            string
+	Aprobado          time.Time
+}
+
+// MercadoPago habla con la API de Checkout Pro con el access token de la cuenta
+type MercadoPago struct {
+	base           string
+	token          string
+	secretoWebhook string
+	cliente        *http.Client
+}
+
+func NewMercadoPago(token string, secretoWebhook string) *MercadoPago {
+	return &MercadoPago{base: "https://api.mercadopago.com", token: token, secretoWebhook: secretoWebhook, cliente: &http.Client{Timeout: 15 * time.Second}}
+}
+
+// CreatePreference crea el checkout por el monto de la compra. Con Vence la
+// preferencia deja de aceptar pagos cuando se libera la reserva.
+func (m *MercadoPago) CreatePreference(ctx context.Context, p NuevaPreferenciaMP) (_ *PreferenciaMP, err error) {
+	ctx, span := tracer.Start(ctx, "mercadopago.preferences.create", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+
+	precio, err := valorMercadoPago(p.Monto, p.Moneda)
+	if err != nil {
+		return nil, err
+	}
+	cuerpo := map[string]interface{}{
+		"items": []interface{}{map[string]interface{}{
+			"title":       recortar(p.Titulo, 256),
+			"quantity":    1,
+			"unit_price":  precio,
+			"currency_id": strings.ToUpper(NormalizarMoneda(p.Moneda)),
+		}},
+		"external_reference": p.ExternalReference,
+		"payer":              map[string]string{"email": p.Email},
+	}
+	if p.NotificationURL != "" {
+		cuerpo["notification_url"] = p.NotificationURL
+	}
+	if p.ReturnURL != "" {
+		cuerpo["back_urls"] = map[string]string{"success": p.ReturnURL, "pending": p.ReturnURL, "failure": p.ReturnURL}
+		cuerpo["auto_return"] = "approved"
+	}
+	if !p.Vence.IsZero() {
+		cuerpo["expires"] = true
+		cuerpo["expiration_date_to"] = p.Vence.UTC().Format("2006-01-02T15:04:05.000-07:00")
+	}
+	var respuesta struct {
+		ID        string `json:"id"`
+		InitPoint string `json:"init_point"`
+	}
+	if err := m.llamar(ctx, http.MethodPost, "/checkout/preferences", cuerpo, "", &respuesta); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("mercadopago.preference_id", respuesta.ID))
+	return &PreferenciaMP{ID: respuesta.ID, InitPoint: respuesta.InitPoint}, nil
+}
+
+// GetPayment lee el pago que anuncia un webhook: el cuerpo de la notificación
+// sólo trae el ID, el estado hay que pedirlo
+func (m *MercadoPago) GetPayment(ctx context.Context, id string) (_ *PagoMP, err error) {
+	ctx, span := tracer.Start(ctx, "mercadopago.payments.get", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("mercadopago.payment_id", id)))
+	defer func() { tracing.Fin(span, err) }()
+
+	var respuesta pagoAPI
+	if err := m.llamar(ctx, http.MethodGet, "/v1/payments/"+url.PathEscape(id), nil, "", &respuesta); err != nil {
+		return nil, err
+	}
+	return respuesta.pago(), nil
+}
+
+// SearchPayments devuelve los pagos con ese external_reference; una misma
+// preferencia puede tener varios (p. ej. una tarjeta rechazada y después otra)
+func (m *MercadoPago) SearchPayments(ctx context.Context, externalReference string) (_ []*PagoMP, err error) {
+	ctx, span := tracer.Start(ctx, "mercadopago.payments.search", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+
+	var respuesta struct {
+		Results []pagoAPI `json:"results"`
+	}
+	consulta := url.Values{"external_reference": {externalReference}}
+	if err := m.llamar(ctx, http.MethodGet, "/v1/payments/search?"+consulta.Encode(), nil, "", &respuesta); err != nil {
+		return nil, err
+	}
+	pagos := make([]*PagoMP, 0, len(respuesta.Results))
+	for _, p := range respuesta.Results {
+		pagos = append(pagos, p.pago())
+	}
+	return pagos, nil
+}
+
+// RefundPayment devuelve el pago completo; claveIdempotencia va en
+// X-Idempotency-Key para que un reintento no intente devolverlo dos veces
+func (m *MercadoPago) RefundPayment(ctx context.Context, id string, claveIdempotencia string) (err error) {
+	ctx, span := tracer.Start(ctx, "mercadopago.payments.refund", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("mercadopago.payment_id", id)))
+	defer func() { tracing.Fin(span, err) }()
+	return m.llamar(ctx, http.MethodPost, "/v1/payments/"+url.PathEscape(id)+"/refunds", struct{}{}, claveIdempotencia, nil)
+}
+
+// toleranciaFirmaMercadoPago es cuánto puede diferir el ts de x-signature del
+// reloj; fuera de ese margen la notificación se rechaza para que no se pueda
+// repetir una vieja
+const toleranciaFirmaMercadoPago = 5 * time.Minute
+
+// VerifyWebhook valida x-signature ("ts=...,v1=...") con el secreto del
+// webhook. La firma es el HMAC-SHA256 de "id:<data.id>;request-id:<x-request-id>;ts:<ts>;",
+// donde dataID es el data.id de la URL de la notificación; ts va en
+// milisegundos y tiene que estar dentro de toleranciaFirmaMercadoPago.
+func (m *MercadoPago) VerifyWebhook(cabeceras http.Header, dataID string) error {
+	return m.verificarFirma(cabeceras, dataID, time.Now())
+}
+
+func (m *MercadoPago) verificarFirma(cabeceras http.Header, dataID string, ahora time.Time) error {
+	var ts, firma string
+	for _, parte := range strings.Split(cabeceras.Get("X-Signature"), ",") {
+		clave, valor, _ := strings.Cut(strings.TrimSpace(parte), "=")
+		switch clave {
+		case "ts":
+			ts = valor
+		case "v1":
+			firma = valor
+		}
+	}
+	if ts == "" || firma == "" {
+		return ErrFirmaMercadoPago
+	}
+	milisegundos, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrFirmaMercadoPago
+	}
+	if diferencia := ahora.Sub(time.UnixMilli(milisegundos)); diferencia > toleranciaFirmaMercadoPago || diferencia < -toleranciaFirmaMercadoPago {
+		return ErrFirmaMercadoPago
+	}
+	recibida, err := hex.DecodeString(firma)
+	if err != nil {
+		return ErrFirmaMercadoPago
+	}
+
+	var manifiesto strings.Builder
+	if dataID != "" {
+		// MercadoPago firma los IDs alfanuméricos en minúsculas
+		manifiesto.WriteString("id:" + strings.ToLower(dataID) + ";")
+	}
+	if id := cabeceras.Get("X-Request-Id"); id != "" {
+		manifiesto.WriteString("request-id:" + id + ";")
+	}
+	manifiesto.WriteString("ts:" + ts + ";")
+
+	mac := hmac.New(sha256.New, []byte(m.secretoWebhook))
+	mac.Write([]byte(manifiesto.String()))
+	if !hmac.Equal(recibida, mac.Sum(nil)) {
+		return ErrFirmaMercadoPago
+	}
+	return nil
+}
+
+// valorMercadoPago pasa el monto en la unidad menor de Stripe al unit_price
+// decimal de MercadoPago: 150050 MXN es 1500.50 y 1500000 COP es 15000
+func valorMercadoPago(monto int64, moneda string) (float64, error) {
+	decimales, ok := decimalesMercadoPago[NormalizarMoneda(moneda)]
+	if !ok {
+		return 0, fmt.Errorf("%w: moneda %s", ErrMonedaMercadoPago, moneda)
+	}
+	sobran := decimalesMoneda(moneda) - decimales
+	divisor := int64(math.Pow10(sobran))
+	if monto%divisor != 0 {
+		return 0, fmt.Errorf("%w: %s no admite centavos", ErrMonedaMercadoPago, strings.ToUpper(moneda))
+	}
+	valor, err := strconv.ParseFloat(valorDecimal(monto/divisor, decimales), 64)
+	if err != nil {
+		return 0, err
+	}
+	return valor, nil
+}
+
+// montoDesdeMercadoPago es la inversa de valorMercadoPago para transaction_amount
+func montoDesdeMercadoPago(valor float64, moneda string) int64 {
+	return int64(math.Round(valor * math.Pow10(decimalesMoneda(moneda))))
+}
+
+// valorDecimal escribe monto con la cantidad de decimales dada: 150050 con 2 es "1500.50"
+func valorDecimal(monto int64, decimales int) string {
+	if decimales == 0 {
+		return strconv.FormatInt(monto, 10)
+	}
+	base := int64(math.Pow10(decimales))
+	return fmt.Sprintf("%d.%0*d", monto/base, decimales, monto%base)
+}
+
+type pagoAPI struct {
+	ID                int64   `json:"id"`
+	Status            string  `json:"status"`
+	StatusDetail      string  `json:"status_detail"`
+	ExternalReference string  `json:"external_reference"`
+	TransactionAmount float64 `json:"transaction_amount"`
+	CurrencyID        string  `json:"currency_id"`
+	DateApproved      string  `json:"date_approved"`
+}
+
+func (p pagoAPI) pago() *PagoMP {
+	moneda := NormalizarMoneda(p.CurrencyID)
+	pago := &PagoMP{
+		ID:                strconv.FormatInt(p.ID, 10),
+		Status:            p.Status,
+		StatusDetail:      p.StatusDetail,
+		ExternalReference: p.ExternalReference,
+		Monto:             montoDesdeMercadoPago(p.TransactionAmount, moneda),
+		Moneda:            moneda,
+	}
+	// date_approved trae milisegundos y la zona de la cuenta (p. ej. -04:00)
+	if aprobado, err := time.Parse(time.RFC3339Nano, p.DateApproved); err == nil {
+		pago.Aprobado = aprobado
+	}
+	return pago
+}
+
+// llamar hace la petición con el access token; destino puede ser nil si no
+// interesa el cuerpo de la respuesta
+func (m *MercadoPago) llamar(ctx context.Context, metodo string, ruta string, payload interface{}, claveIdempotencia string, destino interface{}) error {
+	var cuerpo io.Reader
+	if payload != nil {
+		datos, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		cuerpo = bytes.NewReader(datos)
+	}
+	req, err := http.NewRequestWithContext(ctx, metodo, m.base+ruta, cuerpo)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Content-Type", "application/json")
+	if claveIdempotencia != "" {
+		req.Header.Set("X-Idempotency-Key", claveIdempotencia)
+	}
+
+	resp, err := m.cliente.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respuesta, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var detalle struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+			Cause   []struct {
+				Code        json.RawMessage `json:"code"`
+				Description string          `json:"description"`
+			} `json:"cause"`
+		}
+		json.Unmarshal(respuesta, &detalle)
+		e := &ErrMercadoPago{Status: resp.StatusCode, Codigo: detalle.Error, Mensaje: detalle.Message}
+		if len(detalle.Cause) > 0 {
+			// code viene como número o como texto según el endpoint
+			e.Codigo = strings.Trim(string(detalle.Cause[0].Code), `"`)
+			if detalle.Cause[0].Description != "" {
+				e.Mensaje = detalle.Cause[0].Description
+			}
+		}
+		return e
+	}
+	if destino == nil {
+		return nil
+	}
+	return json.Unmarshal(respuesta, destino)
+}
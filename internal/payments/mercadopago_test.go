@@ -0,0 +1,66 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMercadoPagoVerifyWebhook(t *testing.T) {
+	const secreto = "secreto_del_webhook"
+	ahora := time.UnixMilli(1_760_000_000_123)
+	ts := strconv.FormatInt(ahora.UnixMilli(), 10)
+	viejo := strconv.FormatInt(ahora.Add(-6*time.Minute).UnixMilli(), 10)
+	// hmacHex firma el manifiesto tal como lo arma MercadoPago
+	hmacHex := func(manifiesto string) string {
+		mac := hmac.New(sha256.New, []byte(secreto))
+		mac.Write([]byte(manifiesto))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	casos := []struct {
+		nombre    string
+		dataID    string
+		requestID string
+		firma     string
+		valida    bool
+	}{
+		{nombre: "con data.id y x-request-id", dataID: "123456", requestID: "req-1", firma: "ts=" + ts + ",v1=" + hmacHex("id:123456;request-id:req-1;ts:"+ts+";"), valida: true},
+		{nombre: "sin data.id", requestID: "req-1", firma: "ts=" + ts + ",v1=" + hmacHex("request-id:req-1;ts:"+ts+";"), valida: true},
+		{nombre: "sin x-request-id", dataID: "123456", firma: "ts=" + ts + ",v1=" + hmacHex("id:123456;ts:"+ts+";"), valida: true},
+		{nombre: "sin data.id ni x-request-id", firma: "ts=" + ts + ",v1=" + hmacHex("ts:"+ts+";"), valida: true},
+		{nombre: "data.id alfanumérico en minúsculas", dataID: "ABC123", firma: "ts=" + ts + ",v1=" + hmacHex("id:abc123;ts:"+ts+";"), valida: true},
+		{nombre: "con espacios entre las partes", dataID: "123456", firma: "ts=" + ts + ", v1=" + hmacHex("id:123456;ts:"+ts+";"), valida: true},
+		{nombre: "manifiesto con otro data.id", dataID: "123456", firma: "ts=" + ts + ",v1=" + hmacHex("id:654321;ts:"+ts+";")},
+		{nombre: "otro secreto", dataID: "123456", firma: "ts=" + ts + ",v1=" + hex.EncodeToString([]byte("no es el hmac"))},
+		{nombre: "ts fuera de la tolerancia", dataID: "123456", firma: "ts=" + viejo + ",v1=" + hmacHex("id:123456;ts:"+viejo+";")},
+		{nombre: "ts en segundos", dataID: "123456", firma: "ts=1760000000,v1=" + hmacHex("id:123456;ts:1760000000;")},
+		{nombre: "sin ts", dataID: "123456", firma: "v1=" + hmacHex("id:123456;ts:;")},
+		{nombre: "v1 que no es hex", dataID: "123456", firma: "ts=" + ts + ",v1=zz"},
+		{nombre: "sin x-signature"},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			cabeceras := http.Header{}
+			if c.firma != "" {
+				cabeceras.Set("X-Signature", c.firma)
+			}
+			if c.requestID != "" {
+				cabeceras.Set("X-Request-Id", c.requestID)
+			}
+			m := NewMercadoPago("token", secreto)
+			err := m.verificarFirma(cabeceras, c.dataID, ahora)
+			if c.valida && err != nil {
+				t.Fatalf("rechazada: %v", err)
+			}
+			if !c.valida && !errors.Is(err, ErrFirmaMercadoPago) {
+				t.Fatalf("err = %v, se esperaba ErrFirmaMercadoPago", err)
+			}
+		})
+	}
+}
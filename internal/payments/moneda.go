@@ -0,0 +1,183 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"PaymentsGo/internal/model"
+)
+
+// monedaPorDefecto se usa para las rifas que no tienen currency configurada
+const monedaPorDefecto = "usd"
+
+// monedasStripe son los códigos ISO que Stripe acepta para cobrar
+// (https://docs.stripe.com/currencies).
+var monedasStripe = map[string]bool{
+	"usd": true, "aed": true, "afn": true, "all": true, "amd": true, "ang": true, "aoa": true, "ars": true,
+	"aud": true, "awg": true, "azn": true, "bam": true, "bbd": true, "bdt": true, "bgn": true, "bif": true,
+	"bmd": true, "bnd": true, "bob": true, "brl": true, "bsd": true, "bwp": true, "byn": true, "bzd": true,
+	"cad": true, "cdf": true, "chf": true, "clp": true, "cny": true, "cop": true, "crc": true, "cve": true,
+	"czk": true, "djf": true, "dkk": true, "dop": true, "dzd": true, "egp": true, "etb": true, "eur": true,
+	"fjd": true, "fkp": true, "gbp": true, "gel": true, "gip": true, "gmd": true, "gnf": true, "gtq": true,
+	"gyd": true, "hkd": true, "hnl": true, "htg": true, "huf": true, "idr": true, "ils": true, "inr": true,
+	"isk": true, "jmd": true, "jpy": true, "kes": true, "kgs": true, "khr": true, "kmf": true, "krw": true,
+	"kyd": true, "kzt": true, "lak": true, "lbp": true, "lkr": true, "lrd": true, "lsl": true, "mad": true,
+	"mdl": true, "mga": true, "mkd": true, "mmk": true, "mnt": true, "mop": true, "mur": true, "mvr": true,
+	"mwk": true, "mxn": true, "myr": true, "mzn": true, "nad": true, "ngn": true, "nio": true, "nok": true,
+	"npr": true, "nzd": true, "pab": true, "pen": true, "pgk": true, "php": true, "pkr": true, "pln": true,
+	"pyg": true, "qar": true, "ron": true, "rsd": true, "rub": true, "rwf": true, "sar": true, "sbd": true,
+	"scr": true, "sek": true, "sgd": true, "shp": true, "sle": true, "sos": true, "srd": true, "std": true,
+	"szl": true, "thb": true, "tjs": true, "top": true, "try": true, "ttd": true, "twd": true, "tzs": true,
+	"uah": true, "ugx": true, "uyu": true, "uzs": true, "vnd": true, "vuv": true, "wst": true, "xaf": true,
+	"xcd": true, "xof": true, "xpf": true, "yer": true, "zar": true, "zmw": true,
+}
+
+// monedasSinDecimales son las que Stripe cobra en unidades enteras: el monto
+// se manda tal cual, sin multiplicar por 100. Ojo: COP y MXN no están aquí;
+// Stripe los recibe con dos decimales aunque el peso colombiano no use centavos.
+var monedasSinDecimales = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true, "kmf": true, "krw": true, "mga": true,
+	"pyg": true, "rwf": true, "ugx": true, "vnd": true, "vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+var simbolosMoneda = map[string]string{
+	"usd": "$", "cop": "$", "mxn": "$", "ars": "$", "clp": "$", "cad": "$", "aud": "$",
+	"eur": "€", "gbp": "£", "jpy": "¥", "brl": "R$", "pen": "S/", "krw": "₩",
+}
+
+// minimosStripe es el cargo mínimo por moneda en su unidad menor
+// (https://docs.stripe.com/currencies#minimum-and-maximum-charge-amounts).
+// Para las demás Stripe exige el equivalente a 0.50 USD según el tipo de cambio
+// del día, así que sólo lo puede rechazar Stripe al crear el intent.
+var minimosStripe = map[string]int64{
+	"usd": 50, "aed": 200, "aud": 50, "bgn": 100, "brl": 50, "cad": 50, "chf": 50, "czk": 1500,
+	"dkk": 250, "eur": 50, "gbp": 30, "hkd": 400, "huf": 17500, "inr": 50, "jpy": 50, "mxn": 1000,
+	"myr": 200, "nok": 300, "nzd": 50, "pln": 200, "ron": 200, "sek": 300, "sgd": 50, "thb": 1000,
+}
+
+// MinimoStripe devuelve el cargo mínimo de la moneda; false si Stripe lo
+// calcula por tipo de cambio
+func MinimoStripe(moneda string) (int64, bool) {
+	minimo, ok := minimosStripe[NormalizarMoneda(moneda)]
+	return minimo, ok
+}
+
+// NormalizarMoneda pasa el código a minúsculas y aplica el valor por defecto
+func NormalizarMoneda(moneda string) string {
+	moneda = strings.ToLower(strings.TrimSpace(moneda))
+	if moneda == "" {
+		return monedaPorDefecto
+	}
+	return moneda
+}
+
+func MonedaSoportada(moneda string) bool {
+	return monedasStripe[NormalizarMoneda(moneda)]
+}
+
+// decimalesMoneda es la cantidad de decimales de la unidad menor en Stripe
+func decimalesMoneda(moneda string) int {
+	if monedasSinDecimales[NormalizarMoneda(moneda)] {
+		return 0
+	}
+	return 2
+}
+
+// Valores de la columna price_unit: "major" es el precio en unidades enteras
+// (p. ej. dólares) y "minor" en la unidad menor que cobra Stripe (centavos).
+const (
+	unidadMayor = "major"
+	unidadMenor = "minor"
+)
+
+var (
+	ErrUnidadPrecioInvalida = errors.New("price_unit inválido")
+	ErrMontoDesbordado      = errors.New("el monto total no cabe en un int64")
+)
+
+// UnidadPrecio devuelve la unidad del precio de la rifa; si la columna está
+// vacía usa porDefecto (PRICE_UNIT) y, si tampoco está, "major" como hasta ahora.
+func UnidadPrecio(rifa *model.Rifa, porDefecto string) (string, error) {
+	unidad := strings.ToLower(strings.TrimSpace(rifa.PriceUnit))
+	if unidad == "" {
+		unidad = strings.ToLower(strings.TrimSpace(porDefecto))
+	}
+	switch unidad {
+	case "":
+		return unidadMayor, nil
+	case unidadMayor, unidadMenor:
+		return unidad, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnidadPrecioInvalida, unidad)
+}
+
+// MontoStripe calcula el monto a cobrar en la unidad menor de la moneda.
+// Un precio "major" se multiplica por 100 salvo en monedas sin decimales; uno
+// "minor" se cobra tal cual.
+func MontoStripe(precio int64, cantidad int, moneda string, unidad string) (int64, error) {
+	if precio < 0 || cantidad < 0 {
+		return 0, fmt.Errorf("precio o cantidad negativos")
+	}
+	factor := int64(1)
+	if unidad == unidadMayor && decimalesMoneda(moneda) == 2 {
+		factor = 100
+	}
+	total, ok := multiplicar(precio, int64(cantidad))
+	if ok {
+		total, ok = multiplicar(total, factor)
+	}
+	if !ok {
+		return 0, ErrMontoDesbordado
+	}
+	return total, nil
+}
+
+// multiplicar devuelve false si a*b se desborda (a y b no negativos)
+func multiplicar(a, b int64) (int64, bool) {
+	if a != 0 && b > math.MaxInt64/a {
+		return 0, false
+	}
+	return a * b, true
+}
+
+// FormatearMonto da un monto en unidades menores con símbolo y separador de
+// miles, p. ej. "$1,500.00 USD" o "¥3,000 JPY"
+func FormatearMonto(monto int64, moneda string) string {
+	return FormatearMontoCon(monto, moneda, ",", ".")
+}
+
+// FormatearMontoCon es FormatearMonto con los separadores de miles y de
+// decimales de un idioma
+func FormatearMontoCon(monto int64, moneda string, miles string, decimal string) string {
+	moneda = NormalizarMoneda(moneda)
+	signo := ""
+	if monto < 0 {
+		signo, monto = "-", -monto
+	}
+
+	entero, fraccion := monto, ""
+	if decimalesMoneda(moneda) == 2 {
+		entero = monto / 100
+		fraccion = decimal + strconv.FormatInt(monto%100+100, 10)[1:]
+	}
+
+	digitos := strconv.FormatInt(entero, 10)
+	var b strings.Builder
+	for i, d := range digitos {
+		if i > 0 && (len(digitos)-i)%3 == 0 {
+			b.WriteString(miles)
+		}
+		b.WriteRune(d)
+	}
+
+	return signo + simbolosMoneda[moneda] + b.String() + fraccion + " " + strings.ToUpper(moneda)
+}
+
+// ComisionPlataforma es el application_fee_amount de un cobro de monto (en la
+// unidad menor) con la comisión en porcentaje; se redondea al entero más cercano
+func ComisionPlataforma(monto int64, porcentaje float64) int64 {
+	return int64(math.Round(float64(monto) * porcentaje / 100))
+}
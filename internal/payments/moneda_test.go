@@ -0,0 +1,110 @@
+package payments
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"PaymentsGo/internal/model"
+)
+
+func TestMontoStripe(t *testing.T) {
+	casos := []struct {
+		nombre   string
+		precio   int64
+		cantidad int
+		moneda   string
+		unidad   string
+		monto    int64
+		falla    bool
+	}{
+		{nombre: "dólares enteros", precio: 5, cantidad: 3, moneda: "usd", unidad: "major", monto: 1500},
+		{nombre: "moneda vacía es usd", precio: 5, cantidad: 1, moneda: "", unidad: "major", monto: 500},
+		{nombre: "centavos", precio: 350, cantidad: 10, moneda: "usd", unidad: "minor", monto: 3500},
+		{nombre: "pesos mexicanos", precio: 20, cantidad: 2, moneda: "MXN", unidad: "major", monto: 4000},
+		{nombre: "yenes sin decimales", precio: 500, cantidad: 3, moneda: "jpy", unidad: "major", monto: 1500},
+		{nombre: "yenes en unidad menor", precio: 500, cantidad: 3, moneda: "jpy", unidad: "minor", monto: 1500},
+		// Stripe recibe COP con dos decimales aunque el peso no use centavos
+		{nombre: "pesos colombianos", precio: 10000, cantidad: 2, moneda: "cop", unidad: "major", monto: 2000000},
+		{nombre: "cantidad cero", precio: 5, cantidad: 0, moneda: "usd", unidad: "major", monto: 0},
+		{nombre: "precio negativo", precio: -5, cantidad: 1, moneda: "usd", unidad: "major", falla: true},
+		{nombre: "cantidad negativa", precio: 5, cantidad: -1, moneda: "usd", unidad: "major", falla: true},
+		{nombre: "desborde al multiplicar la cantidad", precio: math.MaxInt64 / 2, cantidad: 3, moneda: "jpy", unidad: "major", falla: true},
+		{nombre: "desborde al pasar a centavos", precio: math.MaxInt64 / 50, cantidad: 1, moneda: "usd", unidad: "major", falla: true},
+		{nombre: "al límite sin desbordar", precio: math.MaxInt64 / 100, cantidad: 1, moneda: "usd", unidad: "major", monto: math.MaxInt64 / 100 * 100},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			monto, err := MontoStripe(c.precio, c.cantidad, c.moneda, c.unidad)
+			if c.falla {
+				if err == nil {
+					t.Fatalf("se aceptó con monto %d", monto)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if monto != c.monto {
+				t.Errorf("monto = %d, se esperaba %d", monto, c.monto)
+			}
+		})
+	}
+	if _, err := MontoStripe(math.MaxInt64/2, 3, "usd", "major"); !errors.Is(err, ErrMontoDesbordado) {
+		t.Errorf("err = %v, se esperaba ErrMontoDesbordado", err)
+	}
+}
+
+func TestUnidadPrecio(t *testing.T) {
+	casos := []struct {
+		nombre     string
+		columna    string
+		porDefecto string
+		unidad     string
+		falla      bool
+	}{
+		{nombre: "columna major", columna: "major", porDefecto: "minor", unidad: "major"},
+		{nombre: "columna minor con espacios", columna: " Minor ", unidad: "minor"},
+		{nombre: "sin columna usa PRICE_UNIT", porDefecto: "minor", unidad: "minor"},
+		{nombre: "sin nada es major", unidad: "major"},
+		{nombre: "columna inválida", columna: "cents", falla: true},
+		{nombre: "PRICE_UNIT inválido", porDefecto: "cents", falla: true},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			unidad, err := UnidadPrecio(&model.Rifa{PriceUnit: c.columna}, c.porDefecto)
+			if c.falla {
+				if !errors.Is(err, ErrUnidadPrecioInvalida) {
+					t.Fatalf("unidad = %q, err = %v; se esperaba ErrUnidadPrecioInvalida", unidad, err)
+				}
+				return
+			}
+			if err != nil || unidad != c.unidad {
+				t.Errorf("unidad = %q, err = %v; se esperaba %q", unidad, err, c.unidad)
+			}
+		})
+	}
+}
+
+func TestMinimoStripe(t *testing.T) {
+	casos := []struct {
+		moneda   string
+		minimo   int64
+		conocido bool
+	}{
+		{moneda: "usd", minimo: 50, conocido: true},
+		{moneda: " USD ", minimo: 50, conocido: true},
+		{moneda: "", minimo: 50, conocido: true},
+		{moneda: "mxn", minimo: 1000, conocido: true},
+		{moneda: "jpy", minimo: 50, conocido: true},
+		// sin mínimo fijo: Stripe lo calcula por tipo de cambio al crear el intent
+		{moneda: "cop", minimo: 0, conocido: false},
+		{moneda: "xyz", minimo: 0, conocido: false},
+	}
+	for _, c := range casos {
+		minimo, ok := MinimoStripe(c.moneda)
+		if minimo != c.minimo || ok != c.conocido {
+			t.Errorf("MinimoStripe(%q) = %d, %v; se esperaba %d, %v", c.moneda, minimo, ok, c.minimo, c.conocido)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/tracing"
+)
+
+// Estados de una orden y de una captura de PayPal que se usan del lado nuestro
+const (
+	OrdenPayPalAprobada     = "APPROVED"
+	OrdenPayPalCompletada   = "COMPLETED"
+	CapturaPayPalCompletada = "COMPLETED"
+)
+
+// ErrFirmaPayPal es un webhook que PayPal no reconoce como suyo
+var ErrFirmaPayPal = errors.New("firma del webhook de PayPal inválida")
+
+// ErrPayPal es una respuesta de error de la API; Issue es el primer
+// details[].issue (p. ej. ORDER_ALREADY_CAPTURED) o, si no hay, el name
+type ErrPayPal struct {
+	Status  int
+	Issue   string
+	Mensaje string
+}
+
+func (e *ErrPayPal) Error() string {
+	return fmt.Sprintf("paypal %d %s: %s", e.Status, e.Issue, e.Mensaje)
+}
+
+// NuevaOrdenPayPal es una orden de un solo cobro; Monto va en la unidad menor
+// de Moneda y CustomID vuelve en la orden y en la captura
+type NuevaOrdenPayPal struct {
+	Monto       int64
+	Moneda      string
+	Descripcion string
+	CustomID    string
+}
+
+// OrdenPayPal es lo que se usa de una orden; Aprobar es el enlace al que el
+// frontend manda al comprador y Captura está desde que se cobró
+type OrdenPayPal struct {
+	ID      string
+	Status  string
+	Aprobar string
+	Captura *CapturaPayPal
+}
+
+// CapturaPayPal es el cobro de una orden; Monto va en la unidad menor de Moneda
+type CapturaPayPal struct {
+	ID       string
+	Status   string
+	OrderID  string
+	CustomID string
+	Monto    int64
+	Moneda   string
+	Creada   time.Time
+}
+
+// EventoPayPal es un webhook ya verificado. OrderID viene en los eventos de
+// orden y de captura; Captura sólo en los de captura (PAYMENT.CAPTURE.*).
+type EventoPayPal struct {
+	ID      string
+	Tipo    string
+	OrderID string
+	Captura *CapturaPayPal
+}
+
+// PayPal habla con la API de Orders v2 con un token OAuth de client
+// credentials, que se renueva poco antes de vencer
+type PayPal struct {
+	base      string
+	clientID  string
+	secreto   string
+	webhookID string
+	cliente   *http.Client
+
+	mu    sync.Mutex
+	token string
+	vence time.Time
+}
+
+func NewPayPal(clientID string, secreto string, webhookID string, sandbox bool) *PayPal {
+	base := "https://api-m.paypal.com"
+	if sandbox {
+		base = "https://api-m.sandbox.paypal.com"
+	}
+	return &PayPal{base: base, clientID: clientID, secreto: secreto, webhookID: webhookID, cliente: &http.Client{Timeout: 15 * time.Second}}
+}
+
+// CreateOrder crea la orden con intent CAPTURE; requestID va en
+// PayPal-Request-Id, así un reintento con el mismo devuelve la misma orden
+func (p *PayPal) CreateOrder(ctx context.Context, orden NuevaOrdenPayPal, requestID string) (_ *OrdenPayPal, err error) {
+	ctx, span := tracer.Start(ctx, "paypal.orders.create", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+
+	unidad := map[string]interface{}{
+		"custom_id":   orden.CustomID,
+		"description": recortar(orden.Descripcion, 127),
+		"amount": montoPayPal{
+			Moneda: strings.ToUpper(NormalizarMoneda(orden.Moneda)),
+			Valor:  valorPayPal(orden.Monto, orden.Moneda),
+		},
+	}
+	var respuesta ordenAPI
+	if err := p.llamar(ctx, http.MethodPost, "/v2/checkout/orders", map[string]interface{}{
+		"intent":         "CAPTURE",
+		"purchase_units": []interface{}{unidad},
+	}, requestID, &respuesta); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("paypal.order_id", respuesta.ID))
+	return respuesta.orden()
+}
+
+func (p *PayPal) GetOrder(ctx context.Context, id string) (_ *OrdenPayPal, err error) {
+	ctx, span := tracer.Start(ctx, "paypal.orders.get", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("paypal.order_id", id)))
+	defer func() { tracing.Fin(span, err) }()
+
+	var respuesta ordenAPI
+	if err := p.llamar(ctx, http.MethodGet, "/v2/checkout/orders/"+url.PathEscape(id), nil, "", &respuesta); err != nil {
+		return nil, err
+	}
+	return respuesta.orden()
+}
+
+// CaptureOrder cobra una orden aprobada. Una orden que ya se capturó no es un
+// error: devuelve la orden con su captura.
+func (p *PayPal) CaptureOrder(ctx context.Context, id string, requestID string) (_ *OrdenPayPal, err error) {
+	ctx, span := tracer.Start(ctx, "paypal.orders.capture", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("paypal.order_id", id)))
+	defer func() { tracing.Fin(span, err) }()
+
+	var respuesta ordenAPI
+	err = p.llamar(ctx, http.MethodPost, "/v2/checkout/orders/"+url.PathEscape(id)+"/capture", struct{}{}, requestID, &respuesta)
+	var errPayPal *ErrPayPal
+	if errors.As(err, &errPayPal) && errPayPal.Issue == "ORDER_ALREADY_CAPTURED" {
+		return p.GetOrder(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return respuesta.orden()
+}
+
+// RefundCapture devuelve la captura completa
+func (p *PayPal) RefundCapture(ctx context.Context, captureID string, requestID string) (err error) {
+	ctx, span := tracer.Start(ctx, "paypal.captures.refund", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("paypal.capture_id", captureID)))
+	defer func() { tracing.Fin(span, err) }()
+	return p.llamar(ctx, http.MethodPost, "/v2/payments/captures/"+url.PathEscape(captureID)+"/refund", struct{}{}, requestID, nil)
+}
+
+// VerifyWebhook pide a PayPal que valide la firma con verify-webhook-signature.
+// La alternativa local (bajar el certificado de paypal-cert-url y validar el
+// CRC32) exige confiar en esa URL; la API hace lo mismo del lado de PayPal.
+func (p *PayPal) VerifyWebhook(ctx context.Context, cabeceras http.Header, cuerpo []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "paypal.webhooks.verify", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+
+	if cabeceras.Get("Paypal-Transmission-Id") == "" || cabeceras.Get("Paypal-Transmission-Sig") == "" {
+		return ErrFirmaPayPal
+	}
+	var respuesta struct {
+		VerificationStatus string `json:"verification_status"`
+	}
+	if err := p.llamar(ctx, http.MethodPost, "/v1/notifications/verify-webhook-signature", map[string]interface{}{
+		"auth_algo":         cabeceras.Get("Paypal-Auth-Algo"),
+		"cert_url":          cabeceras.Get("Paypal-Cert-Url"),
+		"transmission_id":   cabeceras.Get("Paypal-Transmission-Id"),
+		"transmission_sig":  cabeceras.Get("Paypal-Transmission-Sig"),
+		"transmission_time": cabeceras.Get("Paypal-Transmission-Time"),
+		"webhook_id":        p.webhookID,
+		"webhook_event":     json.RawMessage(cuerpo),
+	}, "", &respuesta); err != nil {
+		return err
+	}
+	if respuesta.VerificationStatus != "SUCCESS" {
+		return ErrFirmaPayPal
+	}
+	return nil
+}
+
+// ParsearEventoPayPal lee el cuerpo de un webhook ya verificado
+func ParsearEventoPayPal(cuerpo []byte) (*EventoPayPal, error) {
+	var evento struct {
+		ID        string          `json:"id"`
+		EventType string          `json:"event_type"`
+		Resource  json.RawMessage `json:"resource"`
+	}
+	if err := json.Unmarshal(cuerpo, &evento); err != nil {
+		return nil, err
+	}
+	resultado := &EventoPayPal{ID: evento.ID, Tipo: evento.EventType}
+	if strings.HasPrefix(evento.EventType, "PAYMENT.CAPTURE.") {
+		var captura capturaAPI
+		if err := json.Unmarshal(evento.Resource, &captura); err != nil {
+			return nil, err
+		}
+		c, err := captura.captura()
+		if err != nil {
+			return nil, err
+		}
+		resultado.Captura = c
+		resultado.OrderID = resultado.Captura.OrderID
+		return resultado, nil
+	}
+	var orden struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(evento.Resource, &orden); err != nil {
+		return nil, err
+	}
+	resultado.OrderID = orden.ID
+	return resultado, nil
+}
+
+// valorPayPal escribe el monto en unidades menores como el decimal que pide
+// PayPal: 1550 USD es "15.50" y 3000 JPY es "3000"
+func valorPayPal(monto int64, moneda string) string {
+	if decimalesMoneda(moneda) == 0 {
+		return strconv.FormatInt(monto, 10)
+	}
+	return fmt.Sprintf("%d.%02d", monto/100, monto%100)
+}
+
+// montoDesdePayPal es la inversa de valorPayPal
+func montoDesdePayPal(valor string, moneda string) (int64, error) {
+	entero, fraccion, _ := strings.Cut(valor, ".")
+	decimales := decimalesMoneda(moneda)
+	if len(fraccion) > decimales {
+		return 0, fmt.Errorf("monto de PayPal con demasiados decimales: %q", valor)
+	}
+	fraccion += strings.Repeat("0", decimales-len(fraccion))
+	monto, err := strconv.ParseInt(entero+fraccion, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("monto de PayPal inválido: %q", valor)
+	}
+	return monto, nil
+}
+
+type montoPayPal struct {
+	Moneda string `json:"currency_code"`
+	Valor  string `json:"value"`
+}
+
+type capturaAPI struct {
+	ID                string      `json:"id"`
+	Status            string      `json:"status"`
+	CustomID          string      `json:"custom_id"`
+	Amount            montoPayPal `json:"amount"`
+	CreateTime        time.Time   `json:"create_time"`
+	SupplementaryData struct {
+		RelatedIDs struct {
+			OrderID string `json:"order_id"`
+		} `json:"related_ids"`
+	} `json:"supplementary_data"`
+}
+
+func (c capturaAPI) captura() (*CapturaPayPal, error) {
+	moneda := NormalizarMoneda(c.Amount.Moneda)
+	monto, err := montoDesdePayPal(c.Amount.Valor, moneda)
+	if err != nil {
+		return nil, err
+	}
+	return &CapturaPayPal{
+		ID:       c.ID,
+		Status:   c.Status,
+		OrderID:  c.SupplementaryData.RelatedIDs.OrderID,
+		CustomID: c.CustomID,
+		Monto:    monto,
+		Moneda:   moneda,
+		Creada:   c.CreateTime,
+	}, nil
+}
+
+type ordenAPI struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	PurchaseUnits []struct {
+		Payments struct {
+			Captures []capturaAPI `json:"captures"`
+		} `json:"payments"`
+	} `json:"purchase_units"`
+	Links []struct {
+		Href string `json:"href"`
+		Rel  string `json:"rel"`
+	} `json:"links"`
+}
+
+func (o ordenAPI) orden() (*OrdenPayPal, error) {
+	orden := &OrdenPayPal{ID: o.ID, Status: o.Status}
+	for _, l := range o.Links {
+		if l.Rel == "approve" || l.Rel == "payer-action" {
+			orden.Aprobar = l.Href
+		}
+	}
+	for _, u := range o.PurchaseUnits {
+		for _, c := range u.Payments.Captures {
+			captura, err := c.captura()
+			if err != nil {
+				return nil, err
+			}
+			if captura.OrderID == "" {
+				captura.OrderID = o.ID
+			}
+			orden.Captura = captura
+		}
+	}
+	return orden, nil
+}
+
+// llamar hace la petición con el token vigente; destino puede ser nil si no
+// interesa el cuerpo de la respuesta
+func (p *PayPal) llamar(ctx context.Context, metodo string, ruta string, payload interface{}, requestID string, destino interface{}) error {
+	token, err := p.tokenVigente(ctx)
+	if err != nil {
+		return err
+	}
+	var cuerpo io.Reader
+	if payload != nil {
+		datos, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		cuerpo = bytes.NewReader(datos)
+	}
+	req, err := http.NewRequestWithContext(ctx, metodo, p.base+ruta, cuerpo)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	if requestID != "" {
+		req.Header.Set("PayPal-Request-Id", requestID)
+	}
+	return p.hacer(req, destino)
+}
+
+// tokenVigente pide un token nuevo si no hay o le falta menos de un minuto
+func (p *PayPal) tokenVigente(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Until(p.vence) > time.Minute {
+		return p.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.base+"/v1/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(p.clientID, p.secreto)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var respuesta struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := p.hacer(req, &respuesta); err != nil {
+		return "", fmt.Errorf("token de PayPal: %w", err)
+	}
+	p.token = respuesta.AccessToken
+	p.vence = time.Now().Add(time.Duration(respuesta.ExpiresIn) * time.Second)
+	return p.token, nil
+}
+
+func (p *PayPal) hacer(req *http.Request, destino interface{}) error {
+	resp, err := p.cliente.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	cuerpo, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var detalle struct {
+			Name    string `json:"name"`
+			Message string `json:"message"`
+			Details []struct {
+				Issue string `json:"issue"`
+			} `json:"details"`
+			// El endpoint de OAuth responde con el formato de RFC 6749
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		json.Unmarshal(cuerpo, &detalle)
+		e := &ErrPayPal{Status: resp.StatusCode, Issue: detalle.Name, Mensaje: detalle.Message}
+		if len(detalle.Details) > 0 {
+			e.Issue = detalle.Details[0].Issue
+		}
+		if detalle.Error != "" {
+			e.Issue, e.Mensaje = detalle.Error, detalle.ErrorDescription
+		}
+		return e
+	}
+	if destino == nil {
+		return nil
+	}
+	return json.Unmarshal(cuerpo, destino)
+}
+
+// recortar corta el texto a n runas; PayPal rechaza descripciones más largas
+func recortar(texto string, n int) string {
+	runas := []rune(texto)
+	if len(runas) <= n {
+		return texto
+	}
+	return string(runas[:n])
+}
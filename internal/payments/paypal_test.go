@@ -0,0 +1,77 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPayPalVerifyWebhook(t *testing.T) {
+	cuerpo := []byte(`{"id":"WH-1","event_type":"PAYMENT.CAPTURE.COMPLETED"}`)
+	firmado := http.Header{}
+	firmado.Set("Paypal-Auth-Algo", "SHA256withRSA")
+	firmado.Set("Paypal-Cert-Url", "https://api.paypal.com/v1/notifications/certs/CERT-1")
+	firmado.Set("Paypal-Transmission-Id", "tx-1")
+	firmado.Set("Paypal-Transmission-Sig", "firma")
+	firmado.Set("Paypal-Transmission-Time", "2026-10-14T12:00:00Z")
+	sinFirma := firmado.Clone()
+	sinFirma.Del("Paypal-Transmission-Sig")
+	sinTransmision := firmado.Clone()
+	sinTransmision.Del("Paypal-Transmission-Id")
+
+	casos := []struct {
+		nombre     string
+		cabeceras  http.Header
+		estado     string
+		err        error
+		consultada bool
+	}{
+		{nombre: "SUCCESS", cabeceras: firmado, estado: "SUCCESS", consultada: true},
+		{nombre: "FAILURE", cabeceras: firmado, estado: "FAILURE", err: ErrFirmaPayPal, consultada: true},
+		{nombre: "sin Paypal-Transmission-Sig", cabeceras: sinFirma, err: ErrFirmaPayPal},
+		{nombre: "sin Paypal-Transmission-Id", cabeceras: sinTransmision, err: ErrFirmaPayPal},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			consultada := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/oauth2/token":
+					w.Write([]byte(`{"access_token":"A21","expires_in":3600}`))
+				case "/v1/notifications/verify-webhook-signature":
+					consultada = true
+					var pedido struct {
+						TransmissionID  string          `json:"transmission_id"`
+						TransmissionSig string          `json:"transmission_sig"`
+						WebhookID       string          `json:"webhook_id"`
+						WebhookEvent    json.RawMessage `json:"webhook_event"`
+					}
+					if err := json.NewDecoder(r.Body).Decode(&pedido); err != nil {
+						t.Errorf("pedido: %v", err)
+					}
+					if r.Header.Get("Authorization") != "Bearer A21" || pedido.TransmissionID != "tx-1" || pedido.TransmissionSig != "firma" || pedido.WebhookID != "WH-ID" || string(pedido.WebhookEvent) != string(cuerpo) {
+						t.Errorf("pedido = %+v, Authorization = %q", pedido, r.Header.Get("Authorization"))
+					}
+					w.Write([]byte(`{"verification_status":"` + c.estado + `"}`))
+				default:
+					t.Errorf("se llamó a %s %s", r.Method, r.URL.Path)
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+
+			p := NewPayPal("client", "secreto", "WH-ID", true)
+			p.base = srv.URL
+			err := p.VerifyWebhook(context.Background(), c.cabeceras, cuerpo)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err = %v, se esperaba %v", err, c.err)
+			}
+			if consultada != c.consultada {
+				t.Errorf("consultó verify-webhook-signature = %v, se esperaba %v", consultada, c.consultada)
+			}
+		})
+	}
+}
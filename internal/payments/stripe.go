@@ -0,0 +1,144 @@
+// Package payments envuelve a Stripe y las reglas de cada moneda.
+package payments
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"github.com/stripe/stripe-go/v84/balance"
+	"github.com/stripe/stripe-go/v84/paymentintent"
+	"github.com/stripe/stripe-go/v84/refund"
+	"github.com/stripe/stripe-go/v84/webhook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/tracing"
+)
+
+var tracer = otel.Tracer("PaymentsGo/internal/payments")
+
+// StripePagos es el PaymentProvider real. Cada uno lleva su clave en los
+// clientes de stripe-go en lugar de stripe.Key, así el de live y el del
+// sandbox conviven en el mismo proceso.
+type StripePagos struct {
+	secretKey string
+	// webhookSecrets son los secretos del endpoint, el vigente primero: al
+	// rotarlo, el viejo sigue valiendo hasta que se quita
+	webhookSecrets []string
+	tolerancia     time.Duration
+	intents        paymentintent.Client
+	reembolsos     refund.Client
+	balance        balance.Client
+}
+
+// NewStripePagos arma el cliente con la clave secreta y los secretos del
+// webhook; tolerancia es cuánto puede tener de vieja una firma (cero es la de
+// stripe-go)
+func NewStripePagos(secretKey string, webhookSecrets []string, tolerancia time.Duration) *StripePagos {
+	backend := stripe.GetBackend(stripe.APIBackend)
+	return &StripePagos{
+		secretKey:      secretKey,
+		webhookSecrets: webhookSecrets,
+		tolerancia:     tolerancia,
+		intents:        paymentintent.Client{B: backend, Key: secretKey},
+		reembolsos:     refund.Client{B: backend, Key: secretKey},
+		balance:        balance.Client{B: backend, Key: secretKey},
+	}
+}
+
+// CreateIntent crea el PaymentIntent; el span lleva el ID que devolvió Stripe
+func (p *StripePagos) CreateIntent(ctx context.Context, params *stripe.PaymentIntentParams) (pi *stripe.PaymentIntent, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.paymentintent.New", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+	params.Context = ctx
+	pi, err = p.intents.New(params)
+	if err == nil {
+		span.SetAttributes(tracing.PaymentIntentID.String(pi.ID))
+	}
+	return pi, err
+}
+
+func (p *StripePagos) GetIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (pi *stripe.PaymentIntent, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.paymentintent.Get", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(tracing.PaymentIntentID.String(id)))
+	defer func() { tracing.Fin(span, err) }()
+	if params == nil {
+		params = &stripe.PaymentIntentParams{}
+	}
+	params.Context = ctx
+	return p.intents.Get(id, params)
+}
+
+// ListIntents recorre los intents de params; stripe-go pide las páginas a
+// medida que se avanza y fn puede cortar el recorrido devolviendo un error
+func (p *StripePagos) ListIntents(ctx context.Context, params *stripe.PaymentIntentListParams, fn func(*stripe.PaymentIntent) error) (err error) {
+	ctx, span := tracer.Start(ctx, "stripe.paymentintent.List", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.Fin(span, err) }()
+	params.Context = ctx
+	it := p.intents.List(params)
+	for it.Next() {
+		if err = fn(it.PaymentIntent()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (p *StripePagos) CancelIntent(ctx context.Context, id string, params *stripe.PaymentIntentCancelParams) (pi *stripe.PaymentIntent, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.paymentintent.Cancel", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(tracing.PaymentIntentID.String(id)))
+	defer func() { tracing.Fin(span, err) }()
+	if params == nil {
+		params = &stripe.PaymentIntentCancelParams{}
+	}
+	params.Context = ctx
+	return p.intents.Cancel(id, params)
+}
+
+func (p *StripePagos) CreateRefund(ctx context.Context, params *stripe.RefundParams) (r *stripe.Refund, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.refund.New", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(tracing.PaymentIntentID.String(stripe.StringValue(params.PaymentIntent))))
+	defer func() { tracing.Fin(span, err) }()
+	params.Context = ctx
+	return p.reembolsos.New(params)
+}
+
+// ConstructEvent valida la firma con cada secreto del webhook hasta que uno
+// sirve; si ninguno, devuelve el error del vigente. No llama a Stripe, pero su
+// span separa el tiempo de validar la firma del de procesar el evento.
+func (p *StripePagos) ConstructEvent(ctx context.Context, payload []byte, signature string) (event stripe.Event, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.webhook.ConstructEvent")
+	defer func() { tracing.Fin(span, err) }()
+	if len(p.webhookSecrets) == 0 {
+		return stripe.Event{}, errors.New("sin secreto del webhook configurado")
+	}
+	opciones := webhook.ConstructEventOptions{Tolerance: p.tolerancia}
+	var primero error
+	for i, secreto := range p.webhookSecrets {
+		event, err = webhook.ConstructEventWithOptions(payload, signature, secreto, opciones)
+		if err == nil {
+			span.SetAttributes(attribute.Int("stripe.webhook_secret_index", i))
+			if i > 0 {
+				// Mientras aparezca este log el secreto anterior sigue en uso
+				slog.InfoContext(ctx, "webhook validado con un secreto anterior", "secret_index", i, "event_id", event.ID)
+			}
+			return event, nil
+		}
+		if primero == nil {
+			primero = err
+		}
+	}
+	return stripe.Event{}, primero
+}
+
+// Ping consulta el balance, la llamada más barata que exige una clave válida
+func (p *StripePagos) Ping(ctx context.Context) error {
+	if p.secretKey == "" {
+		return errors.New("STRIPE_SECRET_KEY no configurada")
+	}
+	params := &stripe.BalanceParams{}
+	params.Context = ctx
+	_, err := p.balance.Get(params)
+	return err
+}
@@ -0,0 +1,43 @@
+package payments
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"github.com/stripe/stripe-go/v84/webhook"
+)
+
+func TestConstructEvent(t *testing.T) {
+	payload := []byte(`{"id":"evt_1","object":"event","api_version":"` + stripe.APIVersion + `","type":"payment_intent.succeeded"}`)
+	firmar := func(secreto string, hace time.Duration) string {
+		return webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secreto, Timestamp: time.Now().Add(-hace)}).Header
+	}
+	casos := []struct {
+		nombre     string
+		secretos   []string
+		tolerancia time.Duration
+		firma      string
+		valido     bool
+	}{
+		{nombre: "secreto vigente", secretos: []string{"whsec_nuevo", "whsec_viejo"}, firma: firmar("whsec_nuevo", 0), valido: true},
+		{nombre: "secreto anterior", secretos: []string{"whsec_nuevo", "whsec_viejo"}, firma: firmar("whsec_viejo", 0), valido: true},
+		{nombre: "secreto desconocido", secretos: []string{"whsec_nuevo", "whsec_viejo"}, firma: firmar("whsec_otro", 0)},
+		{nombre: "firma vieja", secretos: []string{"whsec_nuevo"}, firma: firmar("whsec_nuevo", 10*time.Minute)},
+		{nombre: "firma vieja con más tolerancia", secretos: []string{"whsec_nuevo"}, tolerancia: 15 * time.Minute, firma: firmar("whsec_nuevo", 10*time.Minute), valido: true},
+		{nombre: "sin secretos", firma: firmar("whsec_nuevo", 0)},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			p := NewStripePagos("sk_test_x", c.secretos, c.tolerancia)
+			event, err := p.ConstructEvent(context.Background(), payload, c.firma)
+			if c.valido && (err != nil || event.ID != "evt_1") {
+				t.Fatalf("evento = %q, err = %v; se esperaba evt_1", event.ID, err)
+			}
+			if !c.valido && err == nil {
+				t.Fatal("se aceptó una firma inválida")
+			}
+		})
+	}
+}
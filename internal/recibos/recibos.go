@@ -0,0 +1,125 @@
+// Package recibos genera el PDF del recibo de una compra que se adjunta al
+// correo de confirmación.
+package recibos
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// Recibo son los datos del PDF. Los montos ya vienen formateados con su
+// moneda; Numero es el folio secuencial de la tabla receipts.
+type Recibo struct {
+	Numero    int64
+	Negocio   string
+	Direccion string
+	Pie       string
+
+	Email           string
+	PaymentIntentID string
+	Fecha           time.Time
+	Moneda          string
+	Lineas          []Linea
+	// Subtotal y Descuento sólo se muestran si hubo descuento
+	Subtotal  string
+	Descuento string
+	Total     string
+}
+
+// Linea es una rifa del recibo; una compra de carrito tiene varias
+type Linea struct {
+	RifaNombre     string
+	Numeros        string
+	Cantidad       int
+	PrecioUnitario string
+	Importe        string
+}
+
+// Nombre es el nombre del archivo adjunto
+func (r *Recibo) Nombre() string {
+	return fmt.Sprintf("recibo-%06d.pdf", r.Numero)
+}
+
+// Generar arma el PDF en una página A4 con las fuentes estándar, que no
+// necesitan archivos de fuente; el texto se pasa a cp1252 para los acentos.
+func Generar(r *Recibo) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(fmt.Sprintf("Recibo %06d", r.Numero), true)
+	pdf.SetAutoPageBreak(true, 20)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 8, tr(r.Negocio), "", 1, "L", false, 0, "")
+	if r.Direccion != "" {
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.MultiCell(0, 5, tr(r.Direccion), "", "L", false)
+	}
+	pdf.Ln(6)
+
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(0, 7, tr(fmt.Sprintf("Recibo N.º %06d", r.Numero)), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, campo := range [][2]string{
+		{"Fecha", r.Fecha.Format("02/01/2006 15:04 MST")},
+		{"Comprador", r.Email},
+		{"Pago", r.PaymentIntentID},
+		{"Moneda", r.Moneda},
+	} {
+		pdf.CellFormat(30, 6, tr(campo[0]+":"), "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 6, tr(campo[1]), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	anchos := []float64{70, 20, 40, 50}
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.SetFillColor(238, 238, 238)
+	for i, titulo := range []string{"Rifa", "Cantidad", "Precio unitario", "Importe"} {
+		alineacion := "R"
+		if i == 0 {
+			alineacion = "L"
+		}
+		pdf.CellFormat(anchos[i], 7, tr(titulo), "B", 0, alineacion, true, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont("Helvetica", "", 10)
+	for _, l := range r.Lineas {
+		pdf.CellFormat(anchos[0], 6, tr(l.RifaNombre), "", 0, "L", false, 0, "")
+		pdf.CellFormat(anchos[1], 6, fmt.Sprint(l.Cantidad), "", 0, "R", false, 0, "")
+		pdf.CellFormat(anchos[2], 6, tr(l.PrecioUnitario), "", 0, "R", false, 0, "")
+		pdf.CellFormat(anchos[3], 6, tr(l.Importe), "", 1, "R", false, 0, "")
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.MultiCell(anchos[0]+anchos[1]+anchos[2], 4, tr("Números: "+l.Numeros), "", "L", false)
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.Ln(1)
+	}
+
+	pdf.Ln(2)
+	totales := [][2]string{}
+	if r.Descuento != "" {
+		totales = append(totales, [2]string{"Subtotal", r.Subtotal}, [2]string{"Descuento", "-" + r.Descuento})
+	}
+	totales = append(totales, [2]string{"Total pagado", r.Total})
+	for i, t := range totales {
+		if i == len(totales)-1 {
+			pdf.SetFont("Helvetica", "B", 11)
+		}
+		pdf.CellFormat(anchos[0]+anchos[1]+anchos[2], 7, tr(t[0]), "T", 0, "R", false, 0, "")
+		pdf.CellFormat(anchos[3], 7, tr(t[1]), "T", 1, "R", false, 0, "")
+	}
+
+	if r.Pie != "" {
+		pdf.Ln(10)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.MultiCell(0, 4, tr(r.Pie), "", "C", false)
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
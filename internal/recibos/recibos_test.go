@@ -0,0 +1,101 @@
+package recibos
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// textoPDF abre el PDF con un lector independiente y devuelve su texto, así
+// la prueba falla si lo generado no es un PDF válido
+func textoPDF(t *testing.T, contenido []byte) string {
+	t.Helper()
+	lector, err := pdf.NewReader(bytes.NewReader(contenido), int64(len(contenido)))
+	if err != nil {
+		t.Fatalf("el PDF no se puede leer: %v", err)
+	}
+	if n := lector.NumPage(); n != 1 {
+		t.Fatalf("páginas = %d, se esperaba 1", n)
+	}
+	plano, err := lector.GetPlainText()
+	if err != nil {
+		t.Fatalf("no se pudo extraer el texto: %v", err)
+	}
+	texto, err := io.ReadAll(plano)
+	if err != nil {
+		t.Fatalf("no se pudo leer el texto: %v", err)
+	}
+	return string(texto)
+}
+
+func TestGenerar(t *testing.T) {
+	r := &Recibo{
+		Numero:          42,
+		Negocio:         "Twins Rifas",
+		Direccion:       "Av. Reforma 123, CDMX",
+		Pie:             "Gracias por tu compra",
+		Email:           "comprador@example.com",
+		PaymentIntentID: "pi_3AbCdEf",
+		Fecha:           time.Date(2026, 3, 1, 18, 30, 0, 0, time.UTC),
+		Moneda:          "MXN",
+		Lineas: []Linea{
+			{RifaNombre: "Moto", Numeros: "7, 21, 33", Cantidad: 3, PrecioUnitario: "$50.00 MXN", Importe: "$150.00 MXN"},
+			{RifaNombre: "Consola", Numeros: "5", Cantidad: 1, PrecioUnitario: "$100.00 MXN", Importe: "$100.00 MXN"},
+		},
+		Subtotal:  "$250.00 MXN",
+		Descuento: "$25.00 MXN",
+		Total:     "$225.00 MXN",
+	}
+	contenido, err := Generar(r)
+	if err != nil {
+		t.Fatalf("Generar: %v", err)
+	}
+	if !bytes.HasPrefix(contenido, []byte("%PDF-")) {
+		t.Fatalf("no empieza con la cabecera PDF: %q", contenido[:min(len(contenido), 8)])
+	}
+
+	texto := textoPDF(t, contenido)
+	for _, esperado := range []string{
+		"Twins Rifas", "Av. Reforma 123, CDMX", "000042", "comprador@example.com", "pi_3AbCdEf",
+		"01/03/2026", "MXN", "Moto", "7, 21, 33", "Consola", "$50.00 MXN",
+		"$250.00 MXN", "-$25.00 MXN", "$225.00 MXN", "Gracias por tu compra",
+	} {
+		if !strings.Contains(texto, esperado) {
+			t.Errorf("falta %q en el texto del PDF:\n%s", esperado, texto)
+		}
+	}
+}
+
+func TestGenerarSinDescuentoNiOpcionales(t *testing.T) {
+	r := &Recibo{
+		Numero:          7,
+		Negocio:         "Twins Rifas",
+		Email:           "otro@example.com",
+		PaymentIntentID: "pi_sin_descuento",
+		Fecha:           time.Now(),
+		Moneda:          "USD",
+		Lineas:          []Linea{{RifaNombre: "Auto", Numeros: "1", Cantidad: 1, PrecioUnitario: "$10.00 USD", Importe: "$10.00 USD"}},
+		Total:           "$10.00 USD",
+	}
+	contenido, err := Generar(r)
+	if err != nil {
+		t.Fatalf("Generar: %v", err)
+	}
+	texto := textoPDF(t, contenido)
+	if !strings.Contains(texto, "$10.00 USD") || !strings.Contains(texto, "pi_sin_descuento") {
+		t.Errorf("faltan el total o el pago en el texto del PDF:\n%s", texto)
+	}
+	if strings.Contains(texto, "Descuento") {
+		t.Errorf("sin descuento no debería aparecer la línea de descuento:\n%s", texto)
+	}
+}
+
+func TestNombre(t *testing.T) {
+	if n := (&Recibo{Numero: 42}).Nombre(); n != "recibo-000042.pdf" {
+		t.Errorf("Nombre() = %q", n)
+	}
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"PaymentsGo/internal/metrics"
+)
+
+// Estados del circuito, como los muestran /readyz y supabase_circuit_state (0, 1, 2)
+const (
+	CircuitoCerrado     = "closed"
+	CircuitoSemiabierto = "half_open"
+	CircuitoAbierto     = "open"
+)
+
+const (
+	// ventanaCircuito son las últimas respuestas sobre las que se calcula la
+	// tasa de error; con menos de minimoTasaCircuito no se calcula
+	ventanaCircuito    = 20
+	minimoTasaCircuito = 10
+	// esperaSondeo es el Retry-After mientras otra petición prueba Supabase
+	esperaSondeo = time.Second
+)
+
+var (
+	estadoCircuito    = metrics.NewGauge("supabase_circuit_state", "Estado del circuito de Supabase: 0 cerrado, 1 semiabierto, 2 abierto")
+	aperturasCircuito = metrics.NewCounter("supabase_circuit_opened_total", "Veces que el circuito de Supabase se abrió")
+	rechazosCircuito  = metrics.NewCounter("supabase_circuit_rejected_total", "Llamadas a Supabase rechazadas sin intentar por el circuito abierto")
+)
+
+// ErrCircuitoAbierto es una llamada que no se hizo porque Supabase viene
+// fallando; ReintentarEn es cuánto falta para volver a probar
+type ErrCircuitoAbierto struct {
+	ReintentarEn time.Duration
+}
+
+func (e *ErrCircuitoAbierto) Error() string {
+	return fmt.Sprintf("supabase no disponible: circuito abierto, reintentar en %s", e.ReintentarEn.Round(time.Millisecond))
+}
+
+// ConfigCircuito son los umbrales del circuito: se abre con Fallas fallas
+// seguidas o con TasaError por ciento de fallas en las últimas respuestas, y
+// queda abierto Pausa antes de dejar pasar una llamada de prueba
+type ConfigCircuito struct {
+	Fallas    int
+	TasaError float64
+	Pausa     time.Duration
+}
+
+// circuito corta las llamadas a Supabase cuando viene fallando, para que las
+// peticiones respondan enseguida en vez de esperar cada una su timeout.
+// Abierto rechaza todo; al vencer la pausa pasa a semiabierto y deja pasar una
+// sola llamada: si sale bien se cierra, si falla vuelve a abrirse.
+type circuito struct {
+	cfg ConfigCircuito
+
+	mu        sync.Mutex
+	estado    string
+	seguidas  int
+	ventana   [ventanaCircuito]bool
+	muestras  int
+	siguiente int
+	abiertoEn time.Time
+	sondeando bool
+}
+
+func nuevoCircuito(cfg ConfigCircuito) *circuito {
+	estadoCircuito.Set(0)
+	return &circuito{cfg: cfg, estado: CircuitoCerrado}
+}
+
+// permitir devuelve *ErrCircuitoAbierto si la llamada no se debe hacer; si la
+// deja pasar, el llamador tiene que avisar el resultado con registrar
+func (c *circuito) permitir() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.estado {
+	case CircuitoAbierto:
+		if falta := c.cfg.Pausa - time.Since(c.abiertoEn); falta > 0 {
+			rechazosCircuito.Inc()
+			return &ErrCircuitoAbierto{ReintentarEn: falta}
+		}
+		c.cambiar(CircuitoSemiabierto)
+		c.sondeando = true
+		return nil
+	case CircuitoSemiabierto:
+		if c.sondeando {
+			rechazosCircuito.Inc()
+			return &ErrCircuitoAbierto{ReintentarEn: esperaSondeo}
+		}
+		c.sondeando = true
+	}
+	return nil
+}
+
+// registrar cuenta el resultado de una llamada que permitir dejó pasar
+func (c *circuito) registrar(ctx context.Context, fallo bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.estado == CircuitoSemiabierto {
+		c.sondeando = false
+		if fallo {
+			c.abrir(ctx, "falló la llamada de prueba")
+			return
+		}
+		c.cambiar(CircuitoCerrado)
+		c.seguidas, c.muestras, c.siguiente = 0, 0, 0
+		slog.InfoContext(ctx, "circuito de Supabase cerrado")
+		return
+	}
+	if c.estado != CircuitoCerrado {
+		return
+	}
+
+	c.ventana[c.siguiente] = fallo
+	c.siguiente = (c.siguiente + 1) % ventanaCircuito
+	c.muestras = min(c.muestras+1, ventanaCircuito)
+	if !fallo {
+		c.seguidas = 0
+		return
+	}
+	c.seguidas++
+	if c.seguidas >= c.cfg.Fallas {
+		c.abrir(ctx, fmt.Sprintf("%d fallas seguidas", c.seguidas))
+		return
+	}
+	if c.muestras >= minimoTasaCircuito && c.cfg.TasaError > 0 {
+		fallas := 0
+		for _, f := range c.ventana[:c.muestras] {
+			if f {
+				fallas++
+			}
+		}
+		if tasa := float64(fallas) * 100 / float64(c.muestras); tasa >= c.cfg.TasaError {
+			c.abrir(ctx, fmt.Sprintf("%.0f%% de fallas en las últimas %d llamadas", tasa, c.muestras))
+		}
+	}
+}
+
+// liberar suelta la llamada de prueba sin resultado, cuando el llamador la
+// cortó antes de saber si Supabase responde
+func (c *circuito) liberar() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.estado == CircuitoSemiabierto {
+		c.sondeando = false
+	}
+}
+
+func (c *circuito) abrir(ctx context.Context, motivo string) {
+	c.cambiar(CircuitoAbierto)
+	c.abiertoEn = time.Now()
+	aperturasCircuito.Inc()
+	slog.WarnContext(ctx, "circuito de Supabase abierto", "motivo", motivo, "pausa", c.cfg.Pausa.String())
+}
+
+func (c *circuito) cambiar(estado string) {
+	c.estado = estado
+	switch estado {
+	case CircuitoCerrado:
+		estadoCircuito.Set(0)
+	case CircuitoSemiabierto:
+		estadoCircuito.Set(1)
+	case CircuitoAbierto:
+		estadoCircuito.Set(2)
+	}
+}
+
+func (c *circuito) actual() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.estado
+}
+
+// esFalloSupabase dice si el error cuenta para el circuito: los de red,
+// timeouts y 5xx. Un 4xx es Supabase respondiendo bien a una petición mala.
+func esFalloSupabase(err error) bool {
+	if err == nil {
+		return false
+	}
+	var errSB *ErrSupabase
+	if errors.As(err, &errSB) {
+		return errSB.Status >= 500
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"PaymentsGo/internal/model"
+)
+
+// almacen es lo que la prueba de conformidad le pide a los dos backends: las
+// operaciones que PostgresClient hace en una transacción
+type almacen interface {
+	CheckNumbers(ctx context.Context, rifaID string, numeros []int) ([]int, error)
+	ReserveNumbers(ctx context.Context, rifaID string, numeros []int, userID string, paymentIntentID string) error
+	ReleaseReservations(ctx context.Context, paymentIntentID string) error
+	InsertTickets(ctx context.Context, rifaID string, numeros []int, userID string, pago model.PagoTickets) ([]model.TicketRegistrado, error)
+}
+
+// backendsDePrueba arma los dos backends contra las tablas _sandbox de un
+// Supabase de prueba. Sin STORE_TEST_SUPABASE_URL, STORE_TEST_SERVICE_ROLE y
+// STORE_TEST_RIFA_ID la prueba se salta; sin STORE_TEST_DATABASE_URL corre
+// sólo contra PostgREST. STORE_TEST_USER_ID es el profile de los tickets.
+func backendsDePrueba(t *testing.T) (rest *SupabaseClient, rifaID string, usuario string, backends map[string]almacen) {
+	t.Helper()
+	url, clave, rifaID := os.Getenv("STORE_TEST_SUPABASE_URL"), os.Getenv("STORE_TEST_SERVICE_ROLE"), os.Getenv("STORE_TEST_RIFA_ID")
+	if url == "" || clave == "" || rifaID == "" {
+		t.Skip("sin STORE_TEST_SUPABASE_URL, STORE_TEST_SERVICE_ROLE y STORE_TEST_RIFA_ID")
+	}
+	rest = NewSupabaseClient(url, clave, 10*time.Minute, os.Getenv("STORE_TEST_TICKETS_RPC") != "off", ConfigCircuito{Fallas: 1000, TasaError: 1, Pausa: time.Second}).Sandbox()
+	backends = map[string]almacen{"supabase": rest}
+	if dsn := os.Getenv("STORE_TEST_DATABASE_URL"); dsn != "" {
+		pg, err := NewPostgresClient(context.Background(), dsn, rest)
+		if err != nil {
+			t.Fatalf("NewPostgresClient: %v", err)
+		}
+		t.Cleanup(pg.Close)
+		backends["postgres"] = pg.Sandbox()
+	}
+	return rest, rifaID, os.Getenv("STORE_TEST_USER_ID"), backends
+}
+
+// compraDePrueba da números y payment intents que no chocan con otra corrida,
+// y borra al terminar lo que quedó de esos intents
+type compraDePrueba struct {
+	base    int
+	intents []string
+}
+
+func nuevaCompraDePrueba(t *testing.T, rest *SupabaseClient) *compraDePrueba {
+	c := &compraDePrueba{base: 1_000_000 + rand.IntN(1_000_000)*10}
+	t.Cleanup(func() {
+		if len(c.intents) == 0 {
+			return
+		}
+		lista := "in.(" + strings.Join(c.intents, ",") + ")"
+		for _, tabla := range []string{"tikect", "ticket_reservation"} {
+			if _, err := rest.do(context.Background(), http.MethodDelete, tabla+"?payment_intent_id="+lista, nil, ""); err != nil {
+				t.Errorf("limpiando %s: %v", tabla, err)
+			}
+		}
+	})
+	return c
+}
+
+func (c *compraDePrueba) numero(i int) int {
+	return c.base + i
+}
+
+func (c *compraDePrueba) intent() string {
+	pi := fmt.Sprintf("pi_conformidad_%d_%d", c.base, len(c.intents))
+	c.intents = append(c.intents, pi)
+	return pi
+}
+
+func ocupadosEsperados(t *testing.T, err error, esperados ...int) {
+	t.Helper()
+	var ocupados *model.ErrNumerosOcupados
+	if !errors.As(err, &ocupados) {
+		t.Fatalf("error = %v, se esperaba *ErrNumerosOcupados", err)
+	}
+	if got := slices.Sorted(slices.Values(ocupados.Numeros)); !slices.Equal(got, esperados) {
+		t.Fatalf("números ocupados = %v, se esperaba %v", got, esperados)
+	}
+}
+
+func TestConformidadStore(t *testing.T) {
+	rest, rifaID, usuario, backends := backendsDePrueba(t)
+	ctx := context.Background()
+
+	for nombre, db := range backends {
+		t.Run(nombre, func(t *testing.T) {
+			t.Run("reserva y conflicto", func(t *testing.T) {
+				c := nuevaCompraDePrueba(t, rest)
+				a, b := c.intent(), c.intent()
+				if err := db.ReserveNumbers(ctx, rifaID, []int{c.numero(1), c.numero(2)}, usuario, a); err != nil {
+					t.Fatalf("primera reserva: %v", err)
+				}
+				err := db.ReserveNumbers(ctx, rifaID, []int{c.numero(2), c.numero(3)}, usuario, b)
+				ocupadosEsperados(t, err, c.numero(2))
+				// Nada de la reserva que chocó se guarda
+				ocupados, err := db.CheckNumbers(ctx, rifaID, []int{c.numero(3)})
+				if err != nil {
+					t.Fatalf("CheckNumbers: %v", err)
+				}
+				if len(ocupados) != 0 {
+					t.Errorf("la reserva rechazada dejó ocupado %v", ocupados)
+				}
+			})
+
+			t.Run("reintento con el mismo intent", func(t *testing.T) {
+				c := nuevaCompraDePrueba(t, rest)
+				a := c.intent()
+				numeros := []int{c.numero(1), c.numero(2)}
+				for intento := 1; intento <= 2; intento++ {
+					if err := db.ReserveNumbers(ctx, rifaID, numeros, usuario, a); err != nil {
+						t.Fatalf("intento %d: %v", intento, err)
+					}
+				}
+			})
+
+			t.Run("liberar", func(t *testing.T) {
+				c := nuevaCompraDePrueba(t, rest)
+				a, b := c.intent(), c.intent()
+				numeros := []int{c.numero(1), c.numero(2)}
+				if err := db.ReserveNumbers(ctx, rifaID, numeros, usuario, a); err != nil {
+					t.Fatalf("reserva: %v", err)
+				}
+				if err := db.ReleaseReservations(ctx, a); err != nil {
+					t.Fatalf("ReleaseReservations: %v", err)
+				}
+				if err := db.ReleaseReservations(ctx, a); err != nil {
+					t.Fatalf("ReleaseReservations sin reservas: %v", err)
+				}
+				if err := db.ReserveNumbers(ctx, rifaID, numeros, usuario, b); err != nil {
+					t.Fatalf("reserva después de liberar: %v", err)
+				}
+			})
+
+			t.Run("registrar tickets", func(t *testing.T) {
+				c := nuevaCompraDePrueba(t, rest)
+				a, b := c.intent(), c.intent()
+				numeros := []int{c.numero(1), c.numero(2)}
+				if err := db.ReserveNumbers(ctx, rifaID, numeros, usuario, a); err != nil {
+					t.Fatalf("reserva: %v", err)
+				}
+				pago := model.PagoTickets{PaymentIntentID: a, Amount: 301, Currency: "mxn", PaidAt: time.Now()}
+				primeros, err := db.InsertTickets(ctx, rifaID, numeros, usuario, pago)
+				if err != nil {
+					t.Fatalf("InsertTickets: %v", err)
+				}
+				if len(primeros) != 2 {
+					t.Fatalf("tickets = %v, se esperaban 2", primeros)
+				}
+				// Un reintento del webhook devuelve los mismos tickets
+				otra, err := db.InsertTickets(ctx, rifaID, numeros, usuario, pago)
+				if err != nil {
+					t.Fatalf("InsertTickets repetido: %v", err)
+				}
+				if !mismosTickets(primeros, otra) {
+					t.Errorf("el reintento devolvió %v, se esperaba %v", otra, primeros)
+				}
+				// La reserva se convirtió en ticket: el número sigue ocupado
+				ocupados, err := db.CheckNumbers(ctx, rifaID, numeros)
+				if err != nil {
+					t.Fatalf("CheckNumbers: %v", err)
+				}
+				if len(ocupados) != 2 {
+					t.Errorf("ocupados = %v, se esperaban los dos números", ocupados)
+				}
+
+				// Otro comprador con un número vendido no se lo lleva. Sin
+				// transacción (REGISTER_TICKETS_RPC=off) el resto sí queda
+				// registrado; el webhook reembolsa la compra entera igual.
+				pagoB := model.PagoTickets{PaymentIntentID: b, Amount: 200, Currency: "mxn", PaidAt: time.Now()}
+				registrados, err := db.InsertTickets(ctx, rifaID, []int{c.numero(2), c.numero(3)}, usuario, pagoB)
+				ocupadosEsperados(t, err, c.numero(2))
+				for _, tk := range registrados {
+					if tk.Number == c.numero(2) {
+						t.Errorf("el número vendido quedó registrado también para el segundo comprador: %v", registrados)
+					}
+				}
+			})
+
+			t.Run("reservas simultáneas", func(t *testing.T) {
+				c := nuevaCompraDePrueba(t, rest)
+				const compradores = 8
+				intents := make([]string, compradores)
+				for i := range intents {
+					intents[i] = c.intent()
+				}
+				var wg sync.WaitGroup
+				errs := make([]error, compradores)
+				for i := range compradores {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						errs[i] = db.ReserveNumbers(ctx, rifaID, []int{c.numero(1)}, usuario, intents[i])
+					}()
+				}
+				wg.Wait()
+				ganadores := 0
+				for _, err := range errs {
+					var ocupados *model.ErrNumerosOcupados
+					switch {
+					case err == nil:
+						ganadores++
+					case !errors.As(err, &ocupados):
+						t.Errorf("error inesperado: %v", err)
+					}
+				}
+				if ganadores != 1 {
+					t.Errorf("%d compradores reservaron el mismo número, se esperaba 1", ganadores)
+				}
+			})
+		})
+	}
+}
+
+func mismosTickets(a, b []model.TicketRegistrado) bool {
+	orden := func(x, y model.TicketRegistrado) int { return x.Number - y.Number }
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.SortFunc(a, orden)
+	slices.SortFunc(b, orden)
+	return slices.Equal(a, b)
+}
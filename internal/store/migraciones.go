@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// archivosMigraciones son las migraciones que van dentro del binario. Cada
+// una es migraciones/NNNN_nombre.sql y se aplica una sola vez, en el orden de
+// NNNN; una migración ya publicada no se edita, se agrega otra. rifa, tikect
+// y profiles son del proyecto de Supabase: 0000 sólo les agrega las columnas
+// del backend, o las crea si la base está vacía, y por eso va primero. Usan
+// "if not exists" para que un proyecto donde las tablas se crearon a mano las
+// adopte sin error.
+//
+//go:embed migraciones/*.sql
+var archivosMigraciones embed.FS
+
+var patronMigracion = regexp.MustCompile(`^(\d{4})_[a-z0-9_]+\.sql$`)
+
+// bloqueoMigraciones es la clave del advisory lock que toma Migrar, para que
+// dos instancias que arrancan juntas no apliquen la misma migración
+const bloqueoMigraciones int64 = 0x72696661_6d696772
+
+// migracion es un archivo de migraciones/
+type migracion struct {
+	Version string
+	Archivo string
+	SQL     string
+}
+
+// ErrMigracion es la migración que falló. Lo anterior quedó aplicado y ella
+// no dejó nada (corre en su transacción), así que la próxima vez se sigue
+// desde ella.
+type ErrMigracion struct {
+	Archivo string
+	Err     error
+}
+
+func (e *ErrMigracion) Error() string {
+	return fmt.Sprintf("migración %s: %v", e.Archivo, e.Err)
+}
+
+func (e *ErrMigracion) Unwrap() error {
+	return e.Err
+}
+
+// migraciones devuelve las migraciones embebidas en orden. Un nombre fuera
+// del formato o una versión repetida es un error de programación que se nota
+// antes de tocar la base.
+func migraciones() ([]migracion, error) {
+	return leerMigraciones(archivosMigraciones, "migraciones")
+}
+
+func leerMigraciones(archivos fs.FS, dir string) ([]migracion, error) {
+	entradas, err := fs.ReadDir(archivos, dir)
+	if err != nil {
+		return nil, err
+	}
+	// ReadDir ordena por nombre y la versión tiene ancho fijo: es el orden de NNNN
+	var lista []migracion
+	for _, e := range entradas {
+		m := patronMigracion.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migración con nombre inválido %q: debe ser NNNN_nombre.sql", e.Name())
+		}
+		if len(lista) > 0 && lista[len(lista)-1].Version == m[1] {
+			return nil, fmt.Errorf("versión de migración repetida: %s y %s", lista[len(lista)-1].Archivo, e.Name())
+		}
+		sql, err := fs.ReadFile(archivos, dir+"/"+e.Name())
+		if err != nil {
+			return nil, err
+		}
+		lista = append(lista, migracion{Version: m[1], Archivo: e.Name(), SQL: string(sql)})
+	}
+	return lista, nil
+}
+
+// Migrar aplica por DATABASE_URL las migraciones que faltan en
+// schema_migrations y devuelve los archivos aplicados. Cada una corre en una
+// transacción con su fila en schema_migrations: si falla, devuelve
+// *ErrMigracion y no sigue con las demás. Necesita una conexión de sesión
+// (la directa o el pooler en modo session), por el advisory lock.
+func Migrar(ctx context.Context, databaseURL string) ([]string, error) {
+	lista, err := migraciones()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pgx.Connect(ctx, databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	// Cerrar la conexión suelta el advisory lock
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if _, err := conn.Exec(ctx, "select pg_advisory_lock($1)", bloqueoMigraciones); err != nil {
+		return nil, fmt.Errorf("bloqueo de migraciones: %w", err)
+	}
+	if _, err := conn.Exec(ctx, `create table if not exists public.schema_migrations (
+		version text primary key,
+		name text not null,
+		applied_at timestamptz not null default now()
+	)`); err != nil {
+		return nil, fmt.Errorf("schema_migrations: %w", err)
+	}
+	filas, err := conn.Query(ctx, "select version from public.schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("schema_migrations: %w", err)
+	}
+	versiones, err := pgx.CollectRows(filas, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("schema_migrations: %w", err)
+	}
+	aplicadas := make(map[string]bool, len(versiones))
+	for _, v := range versiones {
+		aplicadas[v] = true
+	}
+
+	var nuevas []string
+	for _, m := range lista {
+		if aplicadas[m.Version] {
+			continue
+		}
+		inicio := time.Now()
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			// Sin argumentos pgx usa el protocolo simple, que acepta varias sentencias
+			if _, err := tx.Exec(ctx, m.SQL); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "insert into public.schema_migrations (version, name) values ($1, $2)", m.Version, m.Archivo)
+			return err
+		})
+		if err != nil {
+			return nuevas, &ErrMigracion{Archivo: m.Archivo, Err: err}
+		}
+		slog.InfoContext(ctx, "migración aplicada", "migracion", m.Archivo, "duracion", time.Since(inicio).String())
+		nuevas = append(nuevas, m.Archivo)
+	}
+	return nuevas, nil
+}
@@ -0,0 +1,122 @@
+-- rifa, profiles y tikect son del proyecto de Supabase: ahí ya existen y esta
+-- migración sólo les agrega lo que usa el backend. En una base vacía
+-- (desarrollo, TestMigrarBaseVacia) las crea con lo mínimo. Va antes que las
+-- demás porque 0001 toma el tipo de rifa.id y 0007 los de tikect; en una base
+-- que ya tenía aplicadas las otras corre después y no cambia lo que ya estaba.
+
+-- Los roles de la API de Supabase, a los que 0007 les da y les quita permisos.
+-- En Supabase ya existen; en un Postgres vacío se crean sin login.
+do $$
+declare
+	v_rol text;
+begin
+	foreach v_rol in array array['anon', 'authenticated', 'service_role'] loop
+		if not exists (select 1 from pg_roles where rolname = v_rol) then
+			execute format('create role %I nologin', v_rol);
+		end if;
+	end loop;
+end
+$$;
+
+create table if not exists public.profiles (
+	id uuid primary key,
+	email text,
+	created_at timestamptz not null default now()
+);
+
+-- Sin default: la antigüedad de la cuenta (radar) no puede salir de la fecha
+-- de esta migración
+alter table public.profiles
+	add column if not exists email text,
+	add column if not exists created_at timestamptz;
+
+create table if not exists public.rifa (
+	id uuid primary key default gen_random_uuid(),
+	title text not null,
+	price bigint not null,
+	created_at timestamptz not null default now()
+);
+
+-- Las columnas de model.Rifa. Una rifa vieja sin status cuenta como active y
+-- sin providers acepta todos los proveedores configurados.
+alter table public.rifa
+	add column if not exists total_numbers int,
+	add column if not exists allow_anonymous boolean not null default false,
+	add column if not exists currency text,
+	add column if not exists price_unit text,
+	add column if not exists status text,
+	add column if not exists draw_date timestamptz,
+	add column if not exists max_per_user int,
+	add column if not exists price_tiers jsonb,
+	add column if not exists providers text[],
+	add column if not exists organizer_stripe_account text;
+
+-- rifa_id y profile_id toman el tipo de las claves a las que apuntan.
+-- profile_id es null en las compras de invitado.
+do $$
+declare
+	v_rifa text := (select format_type(atttypid, atttypmod) from pg_attribute where attrelid = 'public.rifa'::regclass and attname = 'id');
+	v_perfil text := (select format_type(atttypid, atttypmod) from pg_attribute where attrelid = 'public.profiles'::regclass and attname = 'id');
+begin
+	execute format($sql$
+		create table if not exists public.tikect (
+			id bigint generated by default as identity primary key,
+			rifa_id %s not null references public.rifa (id) on delete cascade,
+			number int not null,
+			profile_id %s references public.profiles (id),
+			created_at timestamptz not null default now()
+		)$sql$, v_rifa, v_perfil);
+end
+$$;
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.tikect_sandbox (like public.tikect including all);
+
+-- Las columnas de filasTickets, en las dos tablas: una tikect_sandbox creada
+-- a mano antes de esta migración no las tiene todas
+do $$
+declare
+	v_tabla text;
+begin
+	foreach v_tabla in array array['tikect', 'tikect_sandbox'] loop
+		execute format($sql$
+			alter table public.%I
+				add column if not exists created_at timestamptz,
+				add column if not exists payment_intent_id text,
+				add column if not exists amount_paid bigint,
+				add column if not exists currency text,
+				add column if not exists paid_at timestamptz,
+				add column if not exists status text,
+				add column if not exists balance_due bigint,
+				add column if not exists payment_provider text,
+				add column if not exists organizer_account text,
+				add column if not exists payment_method text,
+				add column if not exists payment_label text,
+				add column if not exists payment_reference text
+			$sql$, v_tabla);
+		execute format('alter table public.%I alter column created_at set default now()', v_tabla);
+	end loop;
+end
+$$;
+
+-- like no copia las claves foráneas, y sin ellas PostgREST no puede embeber
+-- rifa y profiles desde tikect_sandbox
+do $$
+begin
+	if not exists (select 1 from pg_constraint where conname = 'tikect_sandbox_rifa_id_fkey') then
+		alter table public.tikect_sandbox add constraint tikect_sandbox_rifa_id_fkey foreign key (rifa_id) references public.rifa (id) on delete cascade;
+	end if;
+	if not exists (select 1 from pg_constraint where conname = 'tikect_sandbox_profile_id_fkey') then
+		alter table public.tikect_sandbox add constraint tikect_sandbox_profile_id_fkey foreign key (profile_id) references public.profiles (id);
+	end if;
+end
+$$;
+
+-- Un número lo ocupa un solo ticket que no esté reembolsado: el unique es
+-- parcial para que un número devuelto se pueda volver a vender (ver ticketOcupa)
+create unique index if not exists tikect_numero_vigente on public.tikect (rifa_id, number) where status is distinct from 'refunded';
+create unique index if not exists tikect_sandbox_numero_vigente on public.tikect_sandbox (rifa_id, number) where status is distinct from 'refunded';
+create index if not exists tikect_intent on public.tikect (payment_intent_id);
+create index if not exists tikect_sandbox_intent on public.tikect_sandbox (payment_intent_id);
+
+alter table public.tikect_sandbox enable row level security;
@@ -0,0 +1,34 @@
+-- ticket_reservation aparta los números de un PaymentIntent mientras se paga;
+-- el unique (rifa_id, number) es lo que impide que dos compras reserven el
+-- mismo número. Una fila vencida sigue ocupándolo hasta que ReserveNumbers o
+-- el barrido la borran.
+--
+-- rifa_id toma el tipo de rifa.id (uuid, bigint o text según RIFA_ID_FORMAT):
+-- register_tickets y PostgresClient lo comparan con tikect.rifa_id. user_id
+-- es text porque una compra sin sesión lo deja vacío.
+do $$
+declare
+	v_tipo text := (select format_type(atttypid, atttypmod) from pg_attribute where attrelid = 'public.rifa'::regclass and attname = 'id');
+begin
+	execute format($sql$
+		create table if not exists public.ticket_reservation (
+			id bigint generated always as identity primary key,
+			rifa_id %s not null references public.rifa (id) on delete cascade,
+			number int not null,
+			user_id text,
+			payment_intent_id text not null,
+			expires_at timestamptz not null,
+			created_at timestamptz not null default now(),
+			unique (rifa_id, number)
+		)$sql$, v_tipo);
+end
+$$;
+
+create index if not exists ticket_reservation_intent on public.ticket_reservation (payment_intent_id);
+create index if not exists ticket_reservation_vencimiento on public.ticket_reservation (expires_at);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.ticket_reservation_sandbox (like public.ticket_reservation including all);
+
+alter table public.ticket_reservation enable row level security;
+alter table public.ticket_reservation_sandbox enable row level security;
@@ -0,0 +1,41 @@
+-- purchase_intent es el borrador de la compra (model.PurchaseDraft): los
+-- números, el comprador y lo cobrado viven aquí porque la metadata de Stripe
+-- no alcanza. id sale de la clave de idempotencia, así que un reintento de
+-- create-intent no lo duplica. Con cuotas, payment_intent_id es el intent de
+-- la primera y las columnas installment_* llevan el plan.
+create table if not exists public.purchase_intent (
+	id text primary key,
+	payment_intent_id text not null unique,
+	rifa_id text not null,
+	rifa_title text,
+	numeros jsonb not null default '[]',
+	user_id text,
+	email text,
+	amount bigint not null,
+	expires_at timestamptz,
+	items jsonb,
+	promo_code text,
+	discount bigint,
+	referral_code text,
+	tier_min_qty int,
+	unit_price bigint,
+	recipient_email text,
+	recipient_name text,
+	locale text,
+	installments int,
+	installments_paid int,
+	installment_intents jsonb,
+	next_installment_intent text,
+	installment_due_at timestamptz,
+	installment_status text,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists purchase_intent_comprador on public.purchase_intent (rifa_id, user_id, expires_at);
+create index if not exists purchase_intent_cuotas on public.purchase_intent (installment_due_at) where installment_status is not null;
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.purchase_intent_sandbox (like public.purchase_intent including all);
+
+alter table public.purchase_intent enable row level security;
+alter table public.purchase_intent_sandbox enable row level security;
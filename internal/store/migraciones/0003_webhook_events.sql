@@ -0,0 +1,14 @@
+-- webhook_events anota los eventos de Stripe ya procesados; el worker lo
+-- consulta antes de procesar para que un reintento de Stripe no repita los
+-- efectos
+create table if not exists public.webhook_events (
+	event_id text primary key,
+	event_type text not null,
+	processed_at timestamptz not null default now()
+);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.webhook_events_sandbox (like public.webhook_events including all);
+
+alter table public.webhook_events enable row level security;
+alter table public.webhook_events_sandbox enable row level security;
@@ -0,0 +1,24 @@
+-- pending_jobs es la cola del webhook: HandleStripeWebhook guarda el evento y
+-- responde, y los workers de handlers.IniciarTrabajos lo procesan con sus
+-- reintentos. event_id es unique para que un reintento de Stripe no encole el
+-- evento dos veces.
+create table if not exists public.pending_jobs (
+	id bigint generated always as identity primary key,
+	event_id text not null unique,
+	event_type text not null,
+	payload jsonb not null,
+	request_id text,
+	status text not null default 'pending' check (status in ('pending', 'failed')),
+	attempts int not null default 0,
+	last_error text,
+	next_attempt_at timestamptz not null default now(),
+	created_at timestamptz not null default now()
+);
+
+create index if not exists pending_jobs_pendientes on public.pending_jobs (next_attempt_at) where status = 'pending';
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.pending_jobs_sandbox (like public.pending_jobs including all);
+
+alter table public.pending_jobs enable row level security;
+alter table public.pending_jobs_sandbox enable row level security;
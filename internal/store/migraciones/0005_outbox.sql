@@ -0,0 +1,27 @@
+-- outbox guarda los correos y avisos que deja el webhook junto con el registro
+-- de los tickets; el despachador de handlers.IniciarOutbox los envía y los
+-- reintenta. Una fila pending con next_attempt_at vencido está lista para
+-- salir; al tomarla se le suma un intento y se corre next_attempt_at, así otra
+-- instancia no la envía dos veces.
+create table if not exists public.outbox (
+	id bigint generated always as identity primary key,
+	kind text not null,
+	dedup_key text not null unique,
+	payload jsonb not null,
+	email text,
+	request_id text,
+	status text not null default 'pending' check (status in ('pending', 'sent', 'dead')),
+	attempts int not null default 0,
+	last_error text,
+	next_attempt_at timestamptz not null default now(),
+	created_at timestamptz not null default now(),
+	sent_at timestamptz
+);
+
+create index if not exists outbox_pendientes on public.outbox (next_attempt_at) where status = 'pending';
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.outbox_sandbox (like public.outbox including all);
+
+alter table public.outbox enable row level security;
+alter table public.outbox_sandbox enable row level security;
@@ -0,0 +1,23 @@
+-- audit_log es la bitácora de acciones (model.EntradaAuditoria) que escribe
+-- handlers.IniciarAuditoria y lee GET /admin/audit, de la más reciente a la
+-- más vieja
+create table if not exists public.audit_log (
+	id bigint generated always as identity primary key,
+	actor text not null,
+	actor_id text,
+	action text not null,
+	rifa_id text,
+	payment_intent_id text,
+	entity_id text,
+	detail jsonb,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists audit_log_fecha on public.audit_log (created_at desc, id desc);
+create index if not exists audit_log_rifa on public.audit_log (rifa_id, created_at desc);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.audit_log_sandbox (like public.audit_log including all);
+
+alter table public.audit_log enable row level security;
+alter table public.audit_log_sandbox enable row level security;
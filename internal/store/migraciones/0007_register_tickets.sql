@@ -0,0 +1,83 @@
+-- register_tickets registra los tickets de un pago en una sola transacción,
+-- para que nadie se meta entre verificar los números e insertarlos. La llama
+-- SupabaseClient.InsertTickets por POST /rest/v1/rpc/register_tickets con
+-- REGISTER_TICKETS_RPC=on (el valor por defecto).
+--
+-- p_tickets son las filas de tikect ya armadas (filasTickets), una por número.
+-- Si alguno está vendido a otro intent no inserta nada y devuelve
+-- {"tickets": [], "conflicts": [números]}; si no, inserta los que el intent
+-- todavía no tiene, borra sus reservas de la rifa y devuelve
+-- {"tickets": [{"id", "number"}...], "conflicts": []} con todos los del intent.
+-- Es seguro repetirla: un reintento del webhook sólo devuelve lo que ya está.
+--
+-- Con p_sandbox usa tikect_sandbox y ticket_reservation_sandbox.
+create or replace function public.register_tickets(
+	p_rifa_id tikect.rifa_id%type,
+	p_payment_intent_id tikect.payment_intent_id%type,
+	p_tickets jsonb,
+	p_sandbox boolean default false
+) returns jsonb
+language plpgsql
+as $$
+declare
+	t_tickets text := case when p_sandbox then 'tikect_sandbox' else 'tikect' end;
+	t_reservas text := case when p_sandbox then 'ticket_reservation_sandbox' else 'ticket_reservation' end;
+	v_numeros int[];
+	v_columnas text;
+	v_conflictos int[];
+	v_tickets jsonb;
+begin
+	select coalesce(array_agg((f ->> 'number')::int order by (f ->> 'number')::int), '{}')
+	into v_numeros
+	from jsonb_array_elements(p_tickets) f;
+
+	-- Un lock por número, en orden para que dos pagos con números cruzados no
+	-- se esperen uno al otro. Es el mismo que toma PostgresClient, así los dos
+	-- backends se respetan.
+	perform pg_advisory_xact_lock(hashtextextended(p_rifa_id::text || ':' || n::text, 0))
+	from unnest(v_numeros) n
+	order by n;
+
+	execute format(
+		'select coalesce(array_agg(number order by number), ''{}'') from %I
+		 where rifa_id = $1 and number = any($2) and status is distinct from ''refunded''
+		   and payment_intent_id is distinct from $3',
+		t_tickets)
+	into v_conflictos
+	using p_rifa_id, v_numeros, p_payment_intent_id;
+	if cardinality(v_conflictos) > 0 then
+		return jsonb_build_object('tickets', '[]'::jsonb, 'conflicts', to_jsonb(v_conflictos));
+	end if;
+
+	select string_agg(quote_ident(k), ', ' order by k)
+	into v_columnas
+	from (select distinct jsonb_object_keys(f) k from jsonb_array_elements(p_tickets) f) columnas;
+
+	if v_columnas is not null then
+		execute format(
+			'insert into %1$I (%2$s)
+			 select %2$s from jsonb_populate_recordset(null::%1$I, $1) r
+			 where not exists (
+			   select 1 from %1$I t
+			   where t.payment_intent_id = $2 and t.rifa_id = $3 and t.number = r.number)',
+			t_tickets, v_columnas)
+		using p_tickets, p_payment_intent_id, p_rifa_id;
+	end if;
+
+	-- Sólo las reservas de esta rifa: las de otras rifas del carrito todavía no tienen ticket
+	execute format('delete from %I where payment_intent_id = $1 and rifa_id = $2', t_reservas)
+	using p_payment_intent_id, p_rifa_id;
+
+	execute format(
+		'select coalesce(jsonb_agg(jsonb_build_object(''id'', id, ''number'', number) order by id), ''[]'')
+		 from %I where payment_intent_id = $1 and rifa_id = $2',
+		t_tickets)
+	into v_tickets
+	using p_payment_intent_id, p_rifa_id;
+	return jsonb_build_object('tickets', v_tickets, 'conflicts', '[]'::jsonb);
+end;
+$$;
+
+-- Sólo la clave del servicio registra tickets
+revoke execute on function public.register_tickets from public, anon, authenticated;
+grant execute on function public.register_tickets to service_role;
@@ -0,0 +1,27 @@
+-- price_mismatches guarda los pagos de Stripe cuyo monto no coincide con el
+-- precio esperado (ver PRICE_AUTHORITY). El webhook no registra sus tickets:
+-- los números quedan reservados por el intent hasta que el organizador decide
+-- si registrarlos o reembolsar, y marca la fila con resolved_at.
+create table if not exists public.price_mismatches (
+	id bigint generated always as identity primary key,
+	payment_intent_id text not null unique,
+	purchase_intent_id text,
+	rifa_id text not null,
+	email text,
+	items jsonb not null,
+	expected_amount bigint not null,
+	paid_amount bigint not null,
+	currency text not null,
+	authority text not null check (authority in ('draft', 'current')),
+	created_at timestamptz not null default now(),
+	resolved_at timestamptz,
+	resolution text
+);
+
+create index if not exists price_mismatches_abiertas on public.price_mismatches (created_at) where resolved_at is null;
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.price_mismatches_sandbox (like public.price_mismatches including all);
+
+alter table public.price_mismatches enable row level security;
+alter table public.price_mismatches_sandbox enable row level security;
@@ -0,0 +1,5 @@
+-- Un borrador de carrito lleva los números en items y guarda numeros en null
+-- (model.PurchaseDraft lo manda sin omitempty), así que el not null de 0002 lo
+-- rechazaba
+alter table public.purchase_intent alter column numeros drop not null;
+alter table public.purchase_intent_sandbox alter column numeros drop not null;
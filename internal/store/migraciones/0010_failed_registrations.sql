@@ -0,0 +1,25 @@
+-- failed_registrations deja constancia de los pagos que se devolvieron porque
+-- sus tickets no se pudieron registrar (falloRegistro): lo cobrado, los
+-- números, la causa y el reembolso. payment_intent_id es unique para que un
+-- reintento del webhook no duplique la fila. profile_id es text porque una
+-- compra de invitado lo deja vacío; numeros es null en un carrito.
+create table if not exists public.failed_registrations (
+	id bigint generated always as identity primary key,
+	payment_intent_id text not null unique,
+	rifa_id text,
+	profile_id text,
+	email text,
+	numeros jsonb,
+	items jsonb,
+	amount bigint,
+	error text,
+	metadata jsonb,
+	refund_id text,
+	created_at timestamptz not null default now()
+);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.failed_registrations_sandbox (like public.failed_registrations including all);
+
+alter table public.failed_registrations enable row level security;
+alter table public.failed_registrations_sandbox enable row level security;
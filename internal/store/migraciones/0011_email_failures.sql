@@ -0,0 +1,24 @@
+-- email_failures guarda los correos de confirmación que agotaron sus
+-- reintentos (model.EmailFailure) con lo necesario para volver a armarlos;
+-- POST /admin/emails/retry los reenvía y borra los que salieron.
+create table if not exists public.email_failures (
+	id bigint generated always as identity primary key,
+	email text not null,
+	rifa_title text,
+	numeros jsonb,
+	amount bigint,
+	currency text,
+	discount bigint,
+	items jsonb,
+	gift_from text,
+	recipient_name text,
+	locale text,
+	last_error text,
+	created_at timestamptz not null default now()
+);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.email_failures_sandbox (like public.email_failures including all);
+
+alter table public.email_failures enable row level security;
+alter table public.email_failures_sandbox enable row level security;
@@ -0,0 +1,28 @@
+-- email_events registra cada correo enviado y lo que Resend avisa de él
+-- (entrega, rebote, queja). Un mismo tipo de evento para un mensaje se guarda
+-- una vez: el unique es lo que usa on_conflict en RecordEmailEvent.
+create table if not exists public.email_events (
+	id bigint generated always as identity primary key,
+	message_id text not null,
+	type text not null,
+	email text,
+	template text,
+	detail text,
+	occurred_at timestamptz not null,
+	created_at timestamptz not null default now(),
+	unique (message_id, type)
+);
+
+create index if not exists email_events_email on public.email_events (email);
+
+-- undeliverable_emails son las direcciones con un rebote que no es temporal;
+-- un rebote nuevo reemplaza el motivo y el mensaje del anterior
+create table if not exists public.undeliverable_emails (
+	email text primary key,
+	reason text,
+	message_id text,
+	flagged_at timestamptz not null default now()
+);
+
+alter table public.email_events enable row level security;
+alter table public.undeliverable_emails enable row level security;
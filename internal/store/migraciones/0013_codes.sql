@@ -0,0 +1,34 @@
+-- codes son los códigos de descuento, en mayúsculas; rifa_id null vale para
+-- todas las rifas. times_redeemed lo recalcula RedeemPromoCode a partir de los
+-- canjes confirmados.
+create table if not exists public.codes (
+	code text primary key,
+	rifa_id text,
+	percent_off int,
+	amount_off bigint,
+	max_redemptions int,
+	times_redeemed int not null default 0,
+	expires_at timestamptz,
+	created_at timestamptz not null default now()
+);
+
+-- code_redemptions es un canje por intent: pending desde create-intent hasta
+-- expires_at y redeemed cuando se paga. payment_intent_id es unique para que
+-- un reintento de la misma compra no cuente dos veces.
+create table if not exists public.code_redemptions (
+	id bigint generated always as identity primary key,
+	code text not null,
+	payment_intent_id text not null unique,
+	status text not null check (status in ('pending', 'redeemed')),
+	expires_at timestamptz,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists code_redemptions_codigo on public.code_redemptions (code, status);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.code_redemptions_sandbox (like public.code_redemptions including all);
+
+alter table public.codes enable row level security;
+alter table public.code_redemptions enable row level security;
+alter table public.code_redemptions_sandbox enable row level security;
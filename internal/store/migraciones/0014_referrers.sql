@@ -0,0 +1,35 @@
+-- referrers son los referentes con su código (en mayúsculas) y el porcentaje
+-- de comisión
+create table if not exists public.referrers (
+	code text primary key,
+	email text,
+	name text,
+	commission_percent numeric not null default 0,
+	active boolean not null default true,
+	created_at timestamptz not null default now()
+);
+
+-- referral_credits es la comisión de cada venta con código (model.CreditoReferido);
+-- clawed_back es lo descontado por reembolsos y disputas. payment_intent_id es
+-- unique: un reintento del webhook deja la comisión que ya estaba.
+create table if not exists public.referral_credits (
+	id bigint generated always as identity primary key,
+	code text not null,
+	rifa_id text,
+	payment_intent_id text not null unique,
+	amount bigint not null,
+	currency text not null,
+	commission_percent numeric not null,
+	commission bigint not null,
+	clawed_back bigint not null default 0,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists referral_credits_codigo on public.referral_credits (code, created_at desc);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.referral_credits_sandbox (like public.referral_credits including all);
+
+alter table public.referrers enable row level security;
+alter table public.referral_credits enable row level security;
+alter table public.referral_credits_sandbox enable row level security;
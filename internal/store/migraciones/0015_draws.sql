@@ -0,0 +1,33 @@
+-- draws son los sorteos (model.Sorteo); con seed y tickets_hash cualquiera
+-- puede repetir el cálculo. Un sorteo forzado no borra el anterior: vale el
+-- más reciente. profile_id es text porque el ganador puede ser un ticket de
+-- invitado, sin perfil.
+create table if not exists public.draws (
+	id bigint generated always as identity primary key,
+	rifa_id text not null,
+	winning_number int not null,
+	profile_id text,
+	drawn_at timestamptz not null default now(),
+	seed text not null,
+	tickets_hash text not null,
+	total_tickets int not null,
+	forced boolean not null default false
+);
+
+create index if not exists draws_rifa on public.draws (rifa_id, drawn_at desc);
+
+-- draw_notifications es un correo del anuncio de un sorteo; el unique es el de
+-- on_conflict en ClaimDrawNotification
+create table if not exists public.draw_notifications (
+	id bigint generated always as identity primary key,
+	draw_id bigint not null references public.draws (id) on delete cascade,
+	email text not null,
+	kind text not null check (kind in ('winner', 'participant')),
+	status text not null check (status in ('sending', 'sent', 'failed')),
+	last_error text,
+	created_at timestamptz not null default now(),
+	unique (draw_id, email, kind)
+);
+
+alter table public.draws enable row level security;
+alter table public.draw_notifications enable row level security;
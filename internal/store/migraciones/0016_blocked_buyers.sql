@@ -0,0 +1,19 @@
+-- blocked_buyers son los compradores que no pueden volver a comprar (p. ej.
+-- después de una disputa), por email, por usuario o por los dos. email es
+-- unique pero nullable: dos bloqueos de sólo usuario no chocan.
+create table if not exists public.blocked_buyers (
+	id bigint generated always as identity primary key,
+	email text unique,
+	user_id text,
+	reason text not null,
+	payment_intent_id text,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists blocked_buyers_usuario on public.blocked_buyers (user_id);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.blocked_buyers_sandbox (like public.blocked_buyers including all);
+
+alter table public.blocked_buyers enable row level security;
+alter table public.blocked_buyers_sandbox enable row level security;
@@ -0,0 +1,24 @@
+-- waitlist es la lista de espera de un número vendido (model.EntradaEspera).
+-- Un usuario espera cada número una sola vez mientras la entrada está waiting o
+-- notified: el unique parcial es el 409 que AddWaitlistEntry convierte en
+-- ErrYaEnEspera.
+create table if not exists public.waitlist (
+	id bigint generated always as identity primary key,
+	rifa_id text not null,
+	number int not null,
+	user_id text not null,
+	email text,
+	status text not null check (status in ('waiting', 'notified', 'expired')),
+	created_at timestamptz not null default now(),
+	notified_at timestamptz,
+	claim_expires_at timestamptz
+);
+
+create unique index if not exists waitlist_activa on public.waitlist (rifa_id, number, user_id) where status in ('waiting', 'notified');
+create index if not exists waitlist_ofertas on public.waitlist (claim_expires_at) where status = 'notified';
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.waitlist_sandbox (like public.waitlist including all);
+
+alter table public.waitlist enable row level security;
+alter table public.waitlist_sandbox enable row level security;
@@ -0,0 +1,18 @@
+-- receipts le da a cada compra pagada su número de recibo, que es id. El
+-- sandbox tiene su propia secuencia, así las pruebas no dejan huecos en la
+-- numeración real. payment_intent_id es unique: un reintento del webhook recibe
+-- el recibo que ya tenía.
+create table if not exists public.receipts (
+	id bigint generated always as identity primary key,
+	payment_intent_id text not null unique,
+	email text,
+	amount bigint not null,
+	currency text not null,
+	created_at timestamptz not null default now()
+);
+
+-- La copia del sandbox (ver tablasSandbox)
+create table if not exists public.receipts_sandbox (like public.receipts including all);
+
+alter table public.receipts enable row level security;
+alter table public.receipts_sandbox enable row level security;
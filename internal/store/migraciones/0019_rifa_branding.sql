@@ -0,0 +1,21 @@
+-- rifa_branding es la marca de los correos de una rifa de otro organizador
+-- (model.MarcaRifa). rifa_id es a la vez clave primaria y foránea a rifa: así
+-- PostgREST la embebe en GetRifa como un objeto. Toma el tipo de rifa.id, como
+-- ticket_reservation.
+do $$
+declare
+	v_tipo text := (select format_type(atttypid, atttypmod) from pg_attribute where attrelid = 'public.rifa'::regclass and attname = 'id');
+begin
+	execute format($sql$
+		create table if not exists public.rifa_branding (
+			rifa_id %s primary key references public.rifa (id) on delete cascade,
+			from_name text,
+			from_email text,
+			reply_to text,
+			logo_url text,
+			accent_color text
+		)$sql$, v_tipo);
+end
+$$;
+
+alter table public.rifa_branding enable row level security;
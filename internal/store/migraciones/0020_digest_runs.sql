@@ -0,0 +1,8 @@
+-- digest_runs anota el día (UTC) cuyo resumen ya se envió, para que con varias
+-- instancias salga uno solo; ReleaseDigest borra la fila si el envío falla
+create table if not exists public.digest_runs (
+	day date primary key,
+	sent_at timestamptz not null default now()
+);
+
+alter table public.digest_runs enable row level security;
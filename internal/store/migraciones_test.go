@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"PaymentsGo/internal/model"
+)
+
+func TestMigracionesEmbebidas(t *testing.T) {
+	lista, err := migraciones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lista) == 0 {
+		t.Fatal("no hay migraciones embebidas")
+	}
+	for i, m := range lista {
+		if m.SQL == "" {
+			t.Errorf("%s está vacía", m.Archivo)
+		}
+		if i > 0 && m.Version <= lista[i-1].Version {
+			t.Errorf("%s viene después de %s", m.Archivo, lista[i-1].Archivo)
+		}
+	}
+}
+
+func TestLeerMigraciones(t *testing.T) {
+	casos := []struct {
+		nombre   string
+		archivos []string
+		orden    []string
+		falla    bool
+	}{
+		{nombre: "en orden de versión", archivos: []string{"0002_b.sql", "0010_c.sql", "0001_a.sql"}, orden: []string{"0001", "0002", "0010"}},
+		{nombre: "versión repetida", archivos: []string{"0001_a.sql", "0001_b.sql"}, falla: true},
+		{nombre: "sin versión", archivos: []string{"crear_tablas.sql"}, falla: true},
+		{nombre: "otra extensión", archivos: []string{"0001_a.txt"}, falla: true},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			archivos := fstest.MapFS{}
+			for _, a := range c.archivos {
+				archivos["m/"+a] = &fstest.MapFile{Data: []byte("select 1;")}
+			}
+			lista, err := leerMigraciones(archivos, "m")
+			if c.falla {
+				if err == nil {
+					t.Fatalf("se aceptó %v", c.archivos)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var orden []string
+			for _, m := range lista {
+				orden = append(orden, m.Version)
+			}
+			if !slices.Equal(orden, c.orden) {
+				t.Errorf("versiones = %v, se esperaba %v", orden, c.orden)
+			}
+		})
+	}
+}
+
+// tablasSinSandbox son las tablas que el store usa y que no tienen copia _sandbox
+var tablasSinSandbox = []string{"rifa", "profiles", "codes", "referrers", "draws", "draw_notifications", "email_events", "undeliverable_emails", "rifa_branding", "digest_runs"}
+
+func TestMigracionesCubrenTablas(t *testing.T) {
+	lista, err := migraciones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var todo strings.Builder
+	for _, m := range lista {
+		todo.WriteString(m.SQL)
+	}
+	sql := todo.String()
+	crea := func(tabla string) bool {
+		return strings.Contains(sql, "create table if not exists public."+tabla+" (")
+	}
+	for tabla := range tablasSandbox {
+		if !crea(tabla) {
+			t.Errorf("ninguna migración crea %s", tabla)
+		}
+		if !crea(tabla + "_sandbox") {
+			t.Errorf("ninguna migración crea %s_sandbox", tabla)
+		}
+	}
+	for _, tabla := range tablasSinSandbox {
+		if !crea(tabla) {
+			t.Errorf("ninguna migración crea %s", tabla)
+		}
+	}
+}
+
+// baseVacia crea una base de datos nueva en el servidor de
+// STORE_TEST_POSTGRES_URL (una URL postgres://, con un usuario que pueda
+// crear bases) y la borra al terminar. Sin la variable la prueba se salta.
+func baseVacia(t *testing.T) string {
+	t.Helper()
+	servidor := os.Getenv("STORE_TEST_POSTGRES_URL")
+	if servidor == "" {
+		t.Skip("sin STORE_TEST_POSTGRES_URL")
+	}
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, servidor)
+	if err != nil {
+		t.Fatalf("STORE_TEST_POSTGRES_URL: %v", err)
+	}
+	t.Cleanup(func() { conn.Close(context.Background()) })
+
+	nombre := fmt.Sprintf("migraciones_%d", rand.IntN(1_000_000_000))
+	if _, err := conn.Exec(ctx, "create database "+nombre); err != nil {
+		t.Fatalf("create database: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := conn.Exec(context.Background(), "drop database if exists "+nombre+" with (force)"); err != nil {
+			t.Errorf("drop database %s: %v", nombre, err)
+		}
+	})
+	u, err := url.Parse(servidor)
+	if err != nil {
+		t.Fatalf("STORE_TEST_POSTGRES_URL: %v", err)
+	}
+	u.Path = "/" + nombre
+	return u.String()
+}
+
+func TestMigrarBaseVacia(t *testing.T) {
+	dsn := baseVacia(t)
+	ctx := context.Background()
+
+	lista, err := migraciones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aplicadas, err := Migrar(ctx, dsn)
+	if err != nil {
+		t.Fatalf("Migrar: %v", err)
+	}
+	if len(aplicadas) != len(lista) {
+		t.Fatalf("aplicadas = %v, se esperaban las %d migraciones", aplicadas, len(lista))
+	}
+	if aplicadas, err = Migrar(ctx, dsn); err != nil || len(aplicadas) != 0 {
+		t.Fatalf("segunda corrida: aplicadas = %v, err = %v; no se esperaba ninguna", aplicadas, err)
+	}
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	tablas := slices.Clone(tablasSinSandbox)
+	for tabla := range tablasSandbox {
+		tablas = append(tablas, tabla, tabla+"_sandbox")
+	}
+	for _, tabla := range tablas {
+		var existe bool
+		if err := conn.QueryRow(ctx, "select to_regclass('public.' || $1) is not null", tabla).Scan(&existe); err != nil {
+			t.Fatal(err)
+		}
+		if !existe {
+			t.Errorf("falta la tabla %s", tabla)
+		}
+	}
+
+	var rifaID string
+	if err := conn.QueryRow(ctx, "insert into public.rifa (title, price) values ('Rifa de prueba', 1000) returning id::text").Scan(&rifaID); err != nil {
+		t.Fatalf("rifa: %v", err)
+	}
+	pg, err := NewPostgresClient(ctx, dsn, NewSupabaseClient("http://127.0.0.1:0", "", time.Minute, false, ConfigCircuito{Fallas: 1000, TasaError: 1, Pausa: time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+	// Compras de invitado: profile_id va en null en tikect y en tikect_sandbox
+	for nombre, cliente := range map[string]*PostgresClient{"tikect": pg, "tikect_sandbox": pg.Sandbox()} {
+		pago := model.PagoTickets{PaymentIntentID: "pi_" + nombre, Amount: 2000, Currency: "usd", PaidAt: time.Now()}
+		if _, err := cliente.InsertTickets(ctx, rifaID, []int{1, 2}, "", pago); err != nil {
+			t.Fatalf("%s: InsertTickets: %v", nombre, err)
+		}
+		otro := pago
+		otro.PaymentIntentID = "pi_otro_" + nombre
+		var ocupados *model.ErrNumerosOcupados
+		if _, err := cliente.InsertTickets(ctx, rifaID, []int{2, 3}, "", otro); !errors.As(err, &ocupados) || !slices.Equal(ocupados.Numeros, []int{2}) {
+			t.Errorf("%s: err = %v, se esperaba el 2 ocupado", nombre, err)
+		}
+	}
+	// El unique parcial deja volver a vender un número reembolsado
+	if _, err := conn.Exec(ctx, "update public.tikect set status = $1 where number = 2", EstadoTicketReembolsado); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(ctx, "insert into public.tikect (rifa_id, number, payment_intent_id, status) values ($1::text::uuid, 2, 'pi_reventa', 'paid')", rifaID); err != nil {
+		t.Errorf("reventa del número reembolsado: %v", err)
+	}
+	if _, err := conn.Exec(ctx, "insert into public.tikect (rifa_id, number, payment_intent_id, status) values ($1::text::uuid, 1, 'pi_doble', 'paid')", rifaID); err == nil {
+		t.Error("se aceptó un segundo ticket vigente del número 1")
+	}
+
+	var resultado string
+	filas := filasTickets(rifaID, []int{5}, "", model.PagoTickets{PaymentIntentID: "pi_rpc", Amount: 1000, Currency: "usd", PaidAt: time.Now()}, nil)
+	if err := conn.QueryRow(ctx, "select public.register_tickets($1::text::uuid, $2, $3::jsonb, true)::text", rifaID, "pi_rpc", filas).Scan(&resultado); err != nil {
+		t.Fatalf("register_tickets: %v", err)
+	}
+	if !strings.Contains(resultado, `"conflicts": []`) {
+		t.Errorf("register_tickets = %s, se esperaba sin conflictos", resultado)
+	}
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"PaymentsGo/internal/model"
+)
+
+// PostgresClient reserva y registra tickets con una conexión directa al
+// Postgres de Supabase (DATABASE_URL), dentro de una transacción: PostgREST no
+// tiene transacciones y entre validar los números e insertarlos otra compra
+// se puede meter. Todo lo demás sigue por la API REST del SupabaseClient que
+// lleva adentro, así que los dos ven las mismas tablas.
+type PostgresClient struct {
+	*SupabaseClient
+	pool *pgxpool.Pool
+}
+
+// NewPostgresClient abre el pool de DATABASE_URL; rest atiende lo que no pasa
+// por una transacción
+func NewPostgresClient(ctx context.Context, databaseURL string, rest *SupabaseClient) (*PostgresClient, error) {
+	pool, err := pgxpool.New(ctx, databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	return &PostgresClient{SupabaseClient: rest, pool: pool}, nil
+}
+
+// Close cierra las conexiones del pool
+func (c *PostgresClient) Close() {
+	c.pool.Close()
+}
+
+// Sandbox es como SupabaseClient.Sandbox: el mismo pool contra las tablas _sandbox
+func (c *PostgresClient) Sandbox() *PostgresClient {
+	return &PostgresClient{SupabaseClient: c.SupabaseClient.Sandbox(), pool: c.pool}
+}
+
+// tabla es el nombre de la tabla en este cliente, con _sandbox en el sandbox
+func (c *PostgresClient) tabla(nombre string) string {
+	if c.sandbox && tablasSandbox[nombre] {
+		return nombre + "_sandbox"
+	}
+	return nombre
+}
+
+// Ping verifica la conexión directa y la API REST
+func (c *PostgresClient) Ping(ctx context.Context) error {
+	if err := c.pool.Ping(ctx); err != nil {
+		return fmt.Errorf("postgres: %w", err)
+	}
+	return c.SupabaseClient.Ping(ctx)
+}
+
+// bloquearNumeros toma un lock de la transacción por cada número de la rifa,
+// en orden para que dos compras con números cruzados no se esperen una a la
+// otra. Un número libre no tiene fila a la que hacerle select ... for update,
+// así que el lock es un advisory lock con la rifa y el número; las filas que
+// ya existen se bloquean también, para que nada que pase por PostgREST las
+// cambie mientras dura la transacción.
+func (c *PostgresClient) bloquearNumeros(ctx context.Context, tx pgx.Tx, rifaID string, numeros []int) error {
+	ordenados := slices.Sorted(slices.Values(numeros))
+	if _, err := tx.Exec(ctx, "select pg_advisory_xact_lock(hashtextextended($1::text || ':' || n::text, 0)) from unnest($2::int[]) as n order by n", rifaID, ordenados); err != nil {
+		return err
+	}
+	for _, tabla := range []string{c.tabla("tikect"), c.tabla("ticket_reservation")} {
+		if _, err := tx.Exec(ctx, "select 1 from "+tabla+" where rifa_id = $1 and number = any($2) order by number for update", rifaID, ordenados); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// numerosDe lee la columna number de la consulta
+func numerosDe(ctx context.Context, tx pgx.Tx, consulta string, args ...any) ([]int, error) {
+	filas, err := tx.Query(ctx, consulta, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(filas, pgx.RowTo[int])
+}
+
+// ReserveNumbers es el de SupabaseClient en una transacción: con los números
+// bloqueados, los que están vendidos o reservados por otro intent se devuelven
+// en *ErrNumerosOcupados sin reservar nada, y los del mismo intent (un
+// reintento con la misma clave de idempotencia) no se vuelven a insertar.
+func (c *PostgresClient) ReserveNumbers(ctx context.Context, rifaID string, numeros []int, userID string, paymentIntentID string) error {
+	tickets, reservas := c.tabla("tikect"), c.tabla("ticket_reservation")
+	return pgx.BeginFunc(ctx, c.pool, func(tx pgx.Tx) error {
+		if err := c.bloquearNumeros(ctx, tx, rifaID, numeros); err != nil {
+			return err
+		}
+		// Las reservas vencidas siguen ocupando el unique
+		if _, err := tx.Exec(ctx, "delete from "+reservas+" where rifa_id = $1 and number = any($2) and expires_at < now()", rifaID, numeros); err != nil {
+			return err
+		}
+		ajenos, err := numerosDe(ctx, tx,
+			"select number from "+tickets+" where rifa_id = $1 and number = any($2) and status is distinct from '"+EstadoTicketReembolsado+"'"+
+				" union select number from "+reservas+" where rifa_id = $1 and number = any($2) and expires_at > now() and payment_intent_id is distinct from $3"+
+				" order by 1",
+			rifaID, numeros, paymentIntentID)
+		if err != nil {
+			return fmt.Errorf("%w: %w", model.ErrDisponibilidadNoVerificada, err)
+		}
+		if len(ajenos) > 0 {
+			return &model.ErrNumerosOcupados{Numeros: ajenos}
+		}
+
+		expira := time.Now().Add(c.duracionReserva)
+		lote := &pgx.Batch{}
+		for _, n := range numeros {
+			lote.Queue("insert into "+reservas+" (rifa_id, number, user_id, payment_intent_id, expires_at) values ($1, $2, $3, $4, $5) on conflict (rifa_id, number) do nothing",
+				rifaID, n, userID, paymentIntentID, expira)
+		}
+		return tx.SendBatch(ctx, lote).Close()
+	})
+}
+
+// InsertTickets hace en una transacción lo mismo que register_tickets: con
+// los números bloqueados, si alguno está vendido a otro comprador no inserta
+// nada y lo devuelve en *ErrNumerosOcupados; si no, inserta los que todavía no
+// tienen ticket del intent. Como todo entra o nada, nunca devuelve
+// *ErrTicketsNoRegistrados.
+func (c *PostgresClient) InsertTickets(ctx context.Context, rifaID string, numeros []int, userID string, pago model.PagoTickets) ([]model.TicketRegistrado, error) {
+	paymentIntentID := pago.PaymentIntentID
+	tickets := c.tabla("tikect")
+	var registrados []model.TicketRegistrado
+	var ajenos []int
+	err := pgx.BeginFunc(ctx, c.pool, func(tx pgx.Tx) error {
+		if err := c.bloquearNumeros(ctx, tx, rifaID, numeros); err != nil {
+			return err
+		}
+		filas, err := tx.Query(ctx, "select id, number from "+tickets+" where payment_intent_id = $1 and rifa_id = $2 order by id", paymentIntentID, rifaID)
+		if err != nil {
+			return err
+		}
+		registrados, err = pgx.CollectRows(filas, pgx.RowToStructByPos[model.TicketRegistrado])
+		if err != nil {
+			return err
+		}
+		omitir := map[int]bool{}
+		for _, t := range registrados {
+			omitir[t.Number] = true
+		}
+		ajenos, err = numerosDe(ctx, tx,
+			"select number from "+tickets+" where rifa_id = $1 and number = any($2) and status is distinct from '"+EstadoTicketReembolsado+"' and payment_intent_id is distinct from $3 order by number",
+			rifaID, numeros, paymentIntentID)
+		if err != nil {
+			return err
+		}
+		if len(ajenos) > 0 {
+			return nil
+		}
+
+		nuevas := filasTickets(rifaID, numeros, userID, pago, omitir)
+		if len(nuevas) == 0 {
+			slog.InfoContext(ctx, "tickets ya estaban registrados", "payment_intent_id", paymentIntentID)
+		}
+		for _, fila := range nuevas {
+			consulta, args := insertFila(tickets, fila)
+			var t model.TicketRegistrado
+			if err := tx.QueryRow(ctx, consulta+" returning id, number", args...).Scan(&t.ID, &t.Number); err != nil {
+				return err
+			}
+			registrados = append(registrados, t)
+		}
+		// Sólo las reservas de esta rifa: las de otras rifas del carrito todavía no tienen ticket
+		_, err = tx.Exec(ctx, "delete from "+c.tabla("ticket_reservation")+" where payment_intent_id = $1 and rifa_id = $2", paymentIntentID, rifaID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ajenos) > 0 {
+		return nil, &model.ErrNumerosOcupados{Numeros: ajenos}
+	}
+	return registrados, nil
+}
+
+// ReleaseReservations elimina las reservas del intent, como la de SupabaseClient
+func (c *PostgresClient) ReleaseReservations(ctx context.Context, paymentIntentID string) error {
+	_, err := c.pool.Exec(ctx, "delete from "+c.tabla("ticket_reservation")+" where payment_intent_id = $1", paymentIntentID)
+	return err
+}
+
+// insertFila arma el insert de una fila de filasTickets, con las columnas en
+// orden para que la consulta sea siempre la misma
+func insertFila(tabla string, fila map[string]interface{}) (string, []any) {
+	columnas := make([]string, 0, len(fila))
+	for col := range fila {
+		columnas = append(columnas, col)
+	}
+	slices.Sort(columnas)
+	marcas := make([]string, len(columnas))
+	args := make([]any, len(columnas))
+	for i, col := range columnas {
+		marcas[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = fila[col]
+	}
+	return "insert into " + tabla + " (" + strings.Join(columnas, ", ") + ") values (" + strings.Join(marcas, ", ") + ")", args
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tablasSandbox son las tablas que escribe el checkout. Cada una tiene su
+// copia <tabla>_sandbox con el mismo esquema (y las mismas claves foráneas a
+// rifa y profiles), así las compras de prueba no se mezclan con las reales ni
+// aparecen en las consultas de administración.
+var tablasSandbox = map[string]bool{
+	"tikect":               true,
+	"ticket_reservation":   true,
+	"purchase_intent":      true,
+	"code_redemptions":     true,
+	"referral_credits":     true,
+	"pending_jobs":         true,
+	"outbox":               true,
+	"webhook_events":       true,
+	"email_failures":       true,
+	"failed_registrations": true,
+	"price_mismatches":     true,
+	"receipts":             true,
+	"audit_log":            true,
+	"waitlist":             true,
+	"blocked_buyers":       true,
+}
+
+// funcionesSandbox son las funciones RPC que reciben p_sandbox y eligen ellas
+// las tablas
+var funcionesSandbox = map[string]bool{
+	"rpc/register_tickets": true,
+}
+
+// Sandbox devuelve un cliente que lee y escribe las tablas de tablasSandbox
+// en sus copias _sandbox. Comparte la conexión y el circuito: es el mismo
+// Supabase. Las demás tablas (rifa, codes, profiles...) se leen igual, pero
+// escribirlas es un error para que una prueba no toque datos reales.
+func (c *SupabaseClient) Sandbox() *SupabaseClient {
+	copia := *c
+	copia.sandbox = true
+	return &copia
+}
+
+// rutaSandbox cambia la tabla de path por su copia _sandbox
+func rutaSandbox(method, path string) (string, error) {
+	if funcion, _, _ := strings.Cut(path, "?"); funcionesSandbox[funcion] {
+		return path, nil
+	}
+	fin := strings.IndexAny(path, "?/")
+	if fin < 0 {
+		fin = len(path)
+	}
+	tabla := path[:fin]
+	if !tablasSandbox[tabla] {
+		if method != http.MethodGet {
+			return "", fmt.Errorf("sandbox: %s sobre %s, que no tiene copia _sandbox", method, tabla)
+		}
+		return path, nil
+	}
+	return tabla + "_sandbox" + path[fin:], nil
+}
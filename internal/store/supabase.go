@@ -0,0 +1,1937 @@
+// Package store es el cliente de la API REST de Supabase.
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/model"
+	"PaymentsGo/internal/tracing"
+)
+
+var tracer = otel.Tracer("PaymentsGo/internal/store")
+
+// SupabaseClient habla con la API REST (PostgREST) de Supabase usando la
+// service role. Se construye una sola vez en main y lo comparten los handlers.
+type SupabaseClient struct {
+	baseURL         string
+	serviceKey      string
+	httpClient      *http.Client
+	duracionReserva time.Duration
+	circuito        *circuito
+	// sandbox manda las tablas del checkout a sus copias _sandbox (ver Sandbox)
+	sandbox bool
+	// rpcTickets registra los tickets con la función register_tickets
+	rpcTickets bool
+}
+
+// ErrSupabase es una respuesta con status de error devuelta por PostgREST
+type ErrSupabase struct {
+	Status int
+	Body   string
+}
+
+func (e *ErrSupabase) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Status, e.Body)
+}
+
+// intentosLectura es el número de intentos para las lecturas ante errores de red o 5xx
+const intentosLectura = 3
+
+// NewSupabaseClient arma el cliente; duracionReserva es cuánto quedan
+// bloqueados los números de ReserveNumbers y rpcTickets hace que InsertTickets
+// use register_tickets (migraciones/0007_register_tickets.sql) en lugar de
+// validar e insertar en dos pasos
+func NewSupabaseClient(baseURL, serviceKey string, duracionReserva time.Duration, rpcTickets bool, cfgCircuito ConfigCircuito) *SupabaseClient {
+	return &SupabaseClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		serviceKey: serviceKey,
+		// El transporte de otelhttp agrega un span por cada llamada a PostgREST
+		httpClient:      &http.Client{Timeout: 5 * time.Second, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		duracionReserva: duracionReserva,
+		rpcTickets:      rpcTickets,
+		circuito:        nuevoCircuito(cfgCircuito),
+	}
+}
+
+// CircuitState es el estado del circuito: CircuitoCerrado, CircuitoSemiabierto
+// o CircuitoAbierto
+func (c *SupabaseClient) CircuitState() string {
+	return c.circuito.actual()
+}
+
+// do ejecuta la petición contra /rest/v1/<path> y devuelve el cuerpo de la
+// respuesta. Un status >= 400 se convierte en *ErrSupabase. Con el circuito
+// abierto devuelve *ErrCircuitoAbierto sin llamar a Supabase.
+func (c *SupabaseClient) do(ctx context.Context, method, path string, payload interface{}, prefer string) ([]byte, error) {
+	b, _, err := c.doConCabeceras(ctx, method, path, payload, prefer)
+	return b, err
+}
+
+// doConCabeceras es do devolviendo también las cabeceras de la respuesta, para
+// leer el Content-Range de un count=exact
+func (c *SupabaseClient) doConCabeceras(ctx context.Context, method, path string, payload interface{}, prefer string) ([]byte, http.Header, error) {
+	if err := c.circuito.permitir(); err != nil {
+		return nil, nil, err
+	}
+	b, cabeceras, err := c.llamar(ctx, method, path, payload, prefer)
+	if err != nil && ctx.Err() != nil {
+		// Lo cortó el llamador: no dice nada de Supabase
+		c.circuito.liberar()
+	} else {
+		c.circuito.registrar(ctx, esFalloSupabase(err))
+	}
+	return b, cabeceras, err
+}
+
+func (c *SupabaseClient) llamar(ctx context.Context, method, path string, payload interface{}, prefer string) ([]byte, http.Header, error) {
+	if c.sandbox {
+		var err error
+		if path, err = rutaSandbox(method, path); err != nil {
+			return nil, nil, err
+		}
+	}
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/rest/v1/"+path, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("apikey", c.serviceKey)
+	req.Header.Set("Authorization", "Bearer "+c.serviceKey)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if prefer != "" {
+		req.Header.Set("Prefer", prefer)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, nil, &ErrSupabase{Status: resp.StatusCode, Body: string(b)}
+	}
+	return b, resp.Header, nil
+}
+
+// consulta arma el path de la tabla con los filtros codificados por
+// url.Values: un valor que llega de una petición (un ID, un email) no puede
+// cerrar su filtro con & y agregar otro
+func consulta(tabla string, filtros url.Values) string {
+	return tabla + "?" + filtros.Encode()
+}
+
+// get hace una lectura con reintentos (backoff exponencial) y decodifica el JSON en destino
+func (c *SupabaseClient) get(ctx context.Context, path string, destino interface{}) error {
+	espera := 200 * time.Millisecond
+	for intento := 1; ; intento++ {
+		body, err := c.do(ctx, http.MethodGet, path, nil, "")
+		if err == nil {
+			if err := json.Unmarshal(body, destino); err != nil {
+				return fmt.Errorf("respuesta inválida de supabase: %w", err)
+			}
+			return nil
+		}
+		if intento == intentosLectura || !reintentable(ctx, err) {
+			return err
+		}
+
+		slog.WarnContext(ctx, "supabase falló, reintentando", logging.ConError(err, "path", path, "intento", intento, "max_intentos", intentosLectura)...)
+		select {
+		case <-time.After(espera):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		espera *= 2
+	}
+}
+
+func reintentable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var abierto *ErrCircuitoAbierto
+	if errors.As(err, &abierto) {
+		return false
+	}
+	var errSB *ErrSupabase
+	if errors.As(err, &errSB) {
+		return errSB.Status >= 500
+	}
+	// Error de red o timeout
+	return true
+}
+
+// columnasMarca trae la fila de rifa_branding con la rifa; rifa_id es la clave
+// primaria de rifa_branding, así que PostgREST la devuelve como objeto (o null)
+const columnasMarca = "rifa_branding(from_name,from_email,reply_to,logo_url,accent_color)"
+
+func (c *SupabaseClient) GetRifa(ctx context.Context, id string) (_ *model.Rifa, err error) {
+	ctx, span := tracer.Start(ctx, "store.GetRifa", trace.WithAttributes(tracing.RifaID.String(id)))
+	defer func() { tracing.Fin(span, err) }()
+
+	var data []model.Rifa
+	path := consulta("rifa", url.Values{
+		"id":     {"eq." + id},
+		"select": {"id,price,title,total_numbers,allow_anonymous,currency,price_unit,status,draw_date,max_per_user,price_tiers,providers,organizer_stripe_account," + columnasMarca},
+	})
+	if err = c.get(ctx, path, &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, model.ErrRifaNoEncontrada
+	}
+	return &data[0], nil
+}
+
+// Ping hace la consulta más liviana posible, sin reintentos
+func (c *SupabaseClient) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodGet, "rifa?select=id&limit=1", nil, "")
+	return err
+}
+
+// numeros lee la columna number de una consulta
+func (c *SupabaseClient) numeros(ctx context.Context, path string) ([]int, error) {
+	var filas []struct {
+		Number int `json:"number"`
+	}
+	if err := c.get(ctx, path, &filas); err != nil {
+		return nil, err
+	}
+	numeros := make([]int, 0, len(filas))
+	for _, f := range filas {
+		numeros = append(numeros, f.Number)
+	}
+	return numeros, nil
+}
+
+// paginaNumeros es cuántos números pide numerosPaginados por consulta. Tiene
+// que ser a lo sumo el max-rows de PostgREST (1000 en Supabase): una página
+// más corta que esto se toma como la última.
+const paginaNumeros = 1000
+
+// numerosPaginados es numeros para consultas donde cada número aparece una
+// vez (los ocupados de una rifa), pidiendo de a paginaNumeros ordenados y
+// siguiendo después del último, para que max-rows no corte la lista sin
+// avisar cuando hay muchos
+func (c *SupabaseClient) numerosPaginados(ctx context.Context, tabla string, filtros url.Values) ([]int, error) {
+	var todos []int
+	for {
+		pedido := url.Values{"order": {"number.asc"}, "limit": {strconv.Itoa(paginaNumeros)}}
+		for clave, valores := range filtros {
+			pedido[clave] = slices.Clone(valores)
+		}
+		if len(todos) > 0 {
+			pedido.Add("number", fmt.Sprintf("gt.%d", todos[len(todos)-1]))
+		}
+		pagina, err := c.numeros(ctx, consulta(tabla, pedido))
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, pagina...)
+		if len(pagina) < paginaNumeros {
+			return todos, nil
+		}
+	}
+}
+
+// Estados de un ticket. Los tickets anteriores a la columna status tienen null
+// y cuentan como pagados. EstadoTicketPagoParcial es una compra en cuotas con
+// saldo pendiente y EstadoTicketEnRevision un cargo en revisión de Radar: los
+// dos ocupan el número pero todavía no pueden ganar.
+const (
+	estadoTicketPagado      = "paid"
+	EstadoTicketReembolsado = "refunded"
+	EstadoTicketDisputado   = "disputed"
+	EstadoTicketPagoParcial = "partially_paid"
+	EstadoTicketEnRevision  = "on_hold"
+)
+
+// ticketValido filtra los tickets que pueden ganar: ni reembolsados, ni
+// disputados, ni con cuotas pendientes, ni en revisión
+const ticketValido = "status.is.null,status.eq." + estadoTicketPagado
+
+// ticketOcupa filtra los tickets que ocupan su número: todos menos los
+// reembolsados. El unique de tikect es parcial (rifa_id, number) where status
+// is distinct from 'refunded', así que un número reembolsado se puede volver a vender.
+const ticketOcupa = "status.is.null,status.neq." + EstadoTicketReembolsado
+
+// CheckNumbers devuelve, ordenados, los números que ya están vendidos o con
+// una reserva vigente
+func (c *SupabaseClient) CheckNumbers(ctx context.Context, rifaID string, numeros []int) (_ []int, err error) {
+	ctx, span := tracer.Start(ctx, "store.CheckNumbers", trace.WithAttributes(tracing.RifaID.String(rifaID), attribute.Int("numeros", len(numeros))))
+	defer func() { tracing.Fin(span, err) }()
+
+	pedidos := "in.(" + ListaNumeros(numeros) + ")"
+	ahora := time.Now().UTC().Format(time.RFC3339)
+
+	vendidos, err := c.numerosPaginados(ctx, "tikect", url.Values{
+		"rifa_id": {"eq." + rifaID},
+		"number":  {pedidos},
+		"or":      {"(" + ticketOcupa + ")"},
+		"select":  {"number"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", model.ErrDisponibilidadNoVerificada, err)
+	}
+	reservados, err := c.numerosPaginados(ctx, "ticket_reservation", url.Values{
+		"rifa_id":    {"eq." + rifaID},
+		"number":     {pedidos},
+		"expires_at": {"gt." + ahora},
+		"select":     {"number"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", model.ErrDisponibilidadNoVerificada, err)
+	}
+
+	vistos := map[int]bool{}
+	var ocupados []int
+	for _, n := range append(vendidos, reservados...) {
+		if !vistos[n] {
+			vistos[n] = true
+			ocupados = append(ocupados, n)
+		}
+	}
+	slices.Sort(ocupados)
+	return ocupados, nil
+}
+
+// SoldNumbers devuelve todos los números vendidos de la rifa
+func (c *SupabaseClient) SoldNumbers(ctx context.Context, rifaID string) ([]int, error) {
+	return c.numerosPaginados(ctx, "tikect", url.Values{"rifa_id": {"eq." + rifaID}, "or": {"(" + ticketOcupa + ")"}, "select": {"number"}})
+}
+
+// ReservedNumbers devuelve los números con una reserva vigente en la rifa
+func (c *SupabaseClient) ReservedNumbers(ctx context.Context, rifaID string) ([]int, error) {
+	ahora := time.Now().UTC().Format(time.RFC3339)
+	return c.numerosPaginados(ctx, "ticket_reservation", url.Values{"rifa_id": {"eq." + rifaID}, "expires_at": {"gt." + ahora}, "select": {"number"}})
+}
+
+// CountUserNumbers cuenta los tickets del usuario en la rifa más sus reservas
+// vigentes. Se ignora lo asociado a excluirPI (vacío para no excluir nada).
+func (c *SupabaseClient) CountUserNumbers(ctx context.Context, rifaID string, userID string, excluirPI string) (int, error) {
+	tickets := url.Values{"rifa_id": {"eq." + rifaID}, "profile_id": {"eq." + userID}, "select": {"number"}}
+	reservas := url.Values{
+		"rifa_id":    {"eq." + rifaID},
+		"user_id":    {"eq." + userID},
+		"expires_at": {"gt." + time.Now().UTC().Format(time.RFC3339)},
+		"select":     {"number"},
+	}
+	if excluirPI != "" {
+		// neq solo descarta también los tickets viejos sin payment_intent_id
+		tickets.Set("and", fmt.Sprintf("(or(%s),or(payment_intent_id.is.null,payment_intent_id.neq.%s))", ticketOcupa, excluirPI))
+		reservas.Set("payment_intent_id", "neq."+excluirPI)
+	} else {
+		tickets.Set("or", "("+ticketOcupa+")")
+	}
+
+	vendidos, err := c.numeros(ctx, consulta("tikect", tickets))
+	if err != nil {
+		return 0, err
+	}
+	reservados, err := c.numeros(ctx, consulta("ticket_reservation", reservas))
+	if err != nil {
+		return 0, err
+	}
+	return len(vendidos) + len(reservados), nil
+}
+
+// ReserveNumbers bloquea los números para el PaymentIntent hasta que expire la reserva.
+// La tabla ticket_reservation tiene un unique (rifa_id, number), así que si otro
+// usuario se adelantó el insert falla con 409 y devolvemos los números en conflicto.
+func (c *SupabaseClient) ReserveNumbers(ctx context.Context, rifaID string, numeros []int, userID string, paymentIntentID string) error {
+	ahora := time.Now().UTC()
+
+	// Las reservas vencidas siguen ocupando el unique; se limpian antes de insertar
+	limpieza := consulta("ticket_reservation", url.Values{
+		"rifa_id":    {"eq." + rifaID},
+		"number":     {"in.(" + ListaNumeros(numeros) + ")"},
+		"expires_at": {"lt." + ahora.Format(time.RFC3339)},
+	})
+	if _, err := c.do(ctx, http.MethodDelete, limpieza, nil, ""); err != nil {
+		return err
+	}
+
+	expira := ahora.Add(c.duracionReserva).Format(time.RFC3339)
+	var payload []map[string]interface{}
+	for _, n := range numeros {
+		payload = append(payload, map[string]interface{}{
+			"rifa_id":           rifaID,
+			"number":            n,
+			"user_id":           userID,
+			"payment_intent_id": paymentIntentID,
+			"expires_at":        expira,
+		})
+	}
+
+	_, err := c.do(ctx, http.MethodPost, "ticket_reservation", payload, "")
+	var errSB *ErrSupabase
+	if errors.As(err, &errSB) && errSB.Status == http.StatusConflict {
+		// Un reintento con la misma clave de idempotencia trae el mismo intent,
+		// que puede haber reservado ya estos números
+		propios, err := c.numeros(ctx, consulta("ticket_reservation", url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "rifa_id": {"eq." + rifaID}, "select": {"number"}}))
+		if err != nil {
+			return fmt.Errorf("%w: %w", model.ErrDisponibilidadNoVerificada, err)
+		}
+		esPropio := map[int]bool{}
+		for _, n := range propios {
+			esPropio[n] = true
+		}
+
+		ocupados, err := c.CheckNumbers(ctx, rifaID, numeros)
+		if err != nil {
+			return err
+		}
+		var ajenos []int
+		for _, n := range ocupados {
+			if !esPropio[n] {
+				ajenos = append(ajenos, n)
+			}
+		}
+		if len(ajenos) == 0 && len(propios) > 0 {
+			return nil
+		}
+		return &model.ErrNumerosOcupados{Numeros: ajenos}
+	}
+	return err
+}
+
+// ExtendReservations alarga las reservas del intent (y el vencimiento de su
+// borrador y de su canje de código) hasta la fecha dada, para pagos que se confirman días después
+func (c *SupabaseClient) ExtendReservations(ctx context.Context, paymentIntentID string, hasta time.Time) error {
+	expira := map[string]string{"expires_at": hasta.UTC().Format(time.RFC3339)}
+	delIntent := url.Values{"payment_intent_id": {"eq." + paymentIntentID}}
+	if _, err := c.do(ctx, http.MethodPatch, consulta("ticket_reservation", delIntent), expira, ""); err != nil {
+		return err
+	}
+	if _, err := c.do(ctx, http.MethodPatch, consulta("purchase_intent", delIntent), expira, ""); err != nil {
+		return err
+	}
+	// El canje pendiente del código tiene que seguir contando mientras dure la reserva
+	canje := consulta("code_redemptions", url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "status": {"eq." + canjePendiente}})
+	_, err := c.do(ctx, http.MethodPatch, canje, expira, "")
+	return err
+}
+
+// ReleaseReservations elimina las reservas asociadas a un PaymentIntent; no
+// falla si el intent nunca tuvo reservas.
+func (c *SupabaseClient) ReleaseReservations(ctx context.Context, paymentIntentID string) error {
+	_, err := c.do(ctx, http.MethodDelete, consulta("ticket_reservation", url.Values{"payment_intent_id": {"eq." + paymentIntentID}}), nil, "")
+	return err
+}
+
+// ListReservations devuelve las reservas de la tabla, vencidas o no, de la
+// rifa (o de todas si rifaID está vacío), de la que vence primero a la última
+func (c *SupabaseClient) ListReservations(ctx context.Context, rifaID string, limite int) ([]model.Reserva, error) {
+	filtros := url.Values{"select": {columnasReserva}, "order": {"expires_at.asc,number.asc"}, "limit": {strconv.Itoa(limite)}}
+	if rifaID != "" {
+		filtros.Set("rifa_id", "eq."+rifaID)
+	}
+	var reservas []model.Reserva
+	if err := c.get(ctx, consulta("ticket_reservation", filtros), &reservas); err != nil {
+		return nil, err
+	}
+	return reservas, nil
+}
+
+// ExpiredReservations devuelve hasta limite reservas que ya vencieron
+func (c *SupabaseClient) ExpiredReservations(ctx context.Context, limite int) ([]model.Reserva, error) {
+	path := consulta("ticket_reservation", url.Values{
+		"select":     {columnasReserva},
+		"expires_at": {"lt." + time.Now().UTC().Format(time.RFC3339)},
+		"order":      {"expires_at.asc"},
+		"limit":      {strconv.Itoa(limite)},
+	})
+	var reservas []model.Reserva
+	if err := c.get(ctx, path, &reservas); err != nil {
+		return nil, err
+	}
+	return reservas, nil
+}
+
+// ReleaseExpiredReservations elimina sólo las reservas vencidas del intent: si
+// el webhook las extendió mientras tanto (un pago asíncrono), se quedan
+func (c *SupabaseClient) ReleaseExpiredReservations(ctx context.Context, paymentIntentID string) error {
+	path := consulta("ticket_reservation", url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "expires_at": {"lt." + time.Now().UTC().Format(time.RFC3339)}})
+	_, err := c.do(ctx, http.MethodDelete, path, nil, "")
+	return err
+}
+
+const columnasReserva = "rifa_id,number,user_id,payment_intent_id,expires_at"
+
+// loteTickets es cuántos tickets van en cada POST; una compra grande en un solo
+// array puede pasar el límite del payload y un error la tumba entera
+const loteTickets = 50
+
+// InsertTickets convierte las reservas del PaymentIntent en tickets confirmados
+// y devuelve todos los tickets del intent en la rifa, con su ID.
+// Es seguro re-ejecutarla con el mismo intent (reintentos del webhook de Stripe):
+// sólo inserta los números que todavía no tienen ticket para ese payment_intent_id.
+// Un carrito usa el mismo intent en varias rifas, así que todo se filtra por rifa.
+// Con rpcTickets todo pasa en una transacción de register_tickets: si algún
+// número se vendió a otro comprador no inserta nada y devuelve
+// *ErrNumerosOcupados. Si la función no está instalada sigue en dos pasos
+// (insertarTicketsEnDosPasos).
+func (c *SupabaseClient) InsertTickets(ctx context.Context, rifaID string, numeros []int, userID string, pago model.PagoTickets) ([]model.TicketRegistrado, error) {
+	if c.rpcTickets {
+		registrados, err := c.registrarTicketsRPC(ctx, rifaID, numeros, userID, pago)
+		if !funcionNoInstalada(err) {
+			return registrados, err
+		}
+		slog.WarnContext(ctx, "register_tickets no está instalada, se registra en dos pasos (ver la migración 0007_register_tickets.sql)", "payment_intent_id", pago.PaymentIntentID)
+	}
+	return c.insertarTicketsEnDosPasos(ctx, rifaID, numeros, userID, pago)
+}
+
+// registrarTicketsRPC llama a register_tickets con las filas de todos los
+// números; la función descarta las que el intent ya tiene
+func (c *SupabaseClient) registrarTicketsRPC(ctx context.Context, rifaID string, numeros []int, userID string, pago model.PagoTickets) ([]model.TicketRegistrado, error) {
+	payload := map[string]interface{}{
+		"p_rifa_id":           rifaID,
+		"p_payment_intent_id": pago.PaymentIntentID,
+		"p_tickets":           filasTickets(rifaID, numeros, userID, pago, nil),
+		"p_sandbox":           c.sandbox,
+	}
+	body, err := c.do(ctx, http.MethodPost, "rpc/register_tickets", payload, "")
+	if err != nil {
+		return nil, err
+	}
+	var respuesta struct {
+		Tickets   []model.TicketRegistrado `json:"tickets"`
+		Conflicts []int                    `json:"conflicts"`
+	}
+	if err := json.Unmarshal(body, &respuesta); err != nil {
+		return nil, fmt.Errorf("respuesta inválida de register_tickets: %w", err)
+	}
+	if len(respuesta.Conflicts) > 0 {
+		return nil, &model.ErrNumerosOcupados{Numeros: respuesta.Conflicts}
+	}
+	if len(respuesta.Tickets) < len(numeros) {
+		// La función registra todo o nada: no debería pasar
+		return respuesta.Tickets, &model.ErrTicketsNoRegistrados{Numeros: faltantes(numeros, numerosDeTickets(respuesta.Tickets)), Causa: errors.New("register_tickets devolvió menos tickets que números")}
+	}
+	return respuesta.Tickets, nil
+}
+
+// funcionNoInstalada reconoce el 404 de PostgREST para una función que no
+// existe en su caché de esquema (PGRST202)
+func funcionNoInstalada(err error) bool {
+	var errSB *ErrSupabase
+	return errors.As(err, &errSB) && errSB.Status == http.StatusNotFound && strings.Contains(errSB.Body, "PGRST202")
+}
+
+func numerosDeTickets(tickets []model.TicketRegistrado) []int {
+	numeros := make([]int, len(tickets))
+	for i, t := range tickets {
+		numeros[i] = t.Number
+	}
+	return numeros
+}
+
+// insertarTicketsEnDosPasos es InsertTickets sin register_tickets: lee lo que
+// el intent ya tiene y, si un reintento llega después de un fallo parcial,
+// sólo manda los que faltan.
+// Los tickets se insertan en lotes de loteTickets. Si un lote choca con el
+// unique puede ser otra entrega del mismo evento corriendo a la vez; si después
+// de eso falta algún número es que se vendió a otro comprador y se devuelve
+// *ErrNumerosOcupados. Si un lote falla por otra razón se siguen los demás y
+// se devuelve *ErrTicketsNoRegistrados con los números que no quedaron.
+func (c *SupabaseClient) insertarTicketsEnDosPasos(ctx context.Context, rifaID string, numeros []int, userID string, pago model.PagoTickets) ([]model.TicketRegistrado, error) {
+	paymentIntentID := pago.PaymentIntentID
+	delIntent := consulta("tikect", url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "rifa_id": {"eq." + rifaID}, "select": {"id,number"}})
+	var registrados []model.TicketRegistrado
+	if err := c.get(ctx, delIntent, &registrados); err != nil {
+		return nil, err
+	}
+	yaRegistrados := map[int]bool{}
+	for _, t := range registrados {
+		yaRegistrados[t.Number] = true
+	}
+
+	payload := filasTickets(rifaID, numeros, userID, pago, yaRegistrados)
+	if len(payload) == 0 {
+		slog.InfoContext(ctx, "tickets ya estaban registrados", "payment_intent_id", paymentIntentID)
+	}
+	conflicto := false
+	var errLote error
+	for inicio := 0; inicio < len(payload); inicio += loteTickets {
+		lote := payload[inicio:min(inicio+loteTickets, len(payload))]
+		// El unique es parcial, así que PostgREST no puede usar on_conflict: el
+		// 409 se resuelve mirando qué quedó registrado
+		body, err := c.do(ctx, http.MethodPost, "tikect?select=id,number", lote, "return=representation")
+		var errSB *ErrSupabase
+		switch {
+		case err == nil:
+			var insertados []model.TicketRegistrado
+			if err := json.Unmarshal(body, &insertados); err != nil {
+				return nil, fmt.Errorf("respuesta inválida de supabase: %w", err)
+			}
+			registrados = append(registrados, insertados...)
+		case errors.As(err, &errSB) && errSB.Status == http.StatusConflict:
+			conflicto = true
+		default:
+			slog.WarnContext(ctx, "falló un lote de tickets", logging.ConError(err, "payment_intent_id", paymentIntentID, "rifa_id", rifaID, "desde", lote[0]["number"], "tickets", len(lote))...)
+			if errLote == nil {
+				errLote = err
+			}
+		}
+	}
+
+	if conflicto || errLote != nil {
+		// Lo que quedó registrado, incluido lo de una entrega simultánea
+		registrados = nil
+		if err := c.get(ctx, delIntent, &registrados); err != nil {
+			return nil, err
+		}
+	}
+	if faltan := faltantes(numeros, numerosDeTickets(registrados)); len(faltan) > 0 {
+		if errLote != nil {
+			return registrados, &model.ErrTicketsNoRegistrados{Numeros: faltan, Causa: errLote}
+		}
+		return registrados, &model.ErrNumerosOcupados{Numeros: faltan}
+	}
+
+	// Sólo las reservas de esta rifa: las de otras rifas del carrito todavía no tienen ticket
+	reservas := consulta("ticket_reservation", url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "rifa_id": {"eq." + rifaID}})
+	if _, err := c.do(ctx, http.MethodDelete, reservas, nil, ""); err != nil {
+		// Los tickets ya quedaron registrados; la reserva vencerá sola
+		slog.WarnContext(ctx, "no se pudieron liberar las reservas", logging.ConError(err, "payment_intent_id", paymentIntentID)...)
+	}
+	return registrados, nil
+}
+
+// filasTickets arma las filas de tikect de los números del pago, salvo los de
+// omitir. El monto y el saldo se reparten entre todos los números, así que
+// omitir no cambia lo que le toca a cada uno. Sin userID (compra de invitado)
+// profile_id va en null: "" no es un uuid ni apunta a ningún profile.
+func filasTickets(rifaID string, numeros []int, userID string, pago model.PagoTickets, omitir map[int]bool) []map[string]interface{} {
+	montos := repartirMonto(pago.Amount, len(numeros))
+	saldos := repartirMonto(pago.BalanceDue, len(numeros))
+	pagadoEn := pago.PaidAt.UTC().Format(time.RFC3339)
+	var filas []map[string]interface{}
+	for i, n := range numeros {
+		if omitir[n] {
+			continue
+		}
+		fila := map[string]interface{}{
+			"rifa_id":           rifaID,
+			"number":            n,
+			"profile_id":        nil,
+			"payment_intent_id": pago.PaymentIntentID,
+			"amount_paid":       montos[i],
+			"currency":          pago.Currency,
+			"paid_at":           pagadoEn,
+			"status":            estadoTicketPagado,
+		}
+		if userID != "" {
+			fila["profile_id"] = userID
+		}
+		if pago.BalanceDue > 0 {
+			fila["status"] = EstadoTicketPagoParcial
+			fila["balance_due"] = saldos[i]
+		}
+		if pago.OnHold {
+			fila["status"] = EstadoTicketEnRevision
+		}
+		if pago.Provider != "" {
+			fila["payment_provider"] = pago.Provider
+		}
+		if pago.OrganizerAccount != "" {
+			fila["organizer_account"] = pago.OrganizerAccount
+		}
+		if pago.Method != "" {
+			fila["payment_method"] = pago.Method
+			fila["payment_label"] = pago.Label
+			fila["payment_reference"] = pago.Reference
+		}
+		filas = append(filas, fila)
+	}
+	return filas
+}
+
+// repartirMonto divide el total entre n tickets; el resto de la división va a
+// los primeros para que la suma coincida con lo cobrado
+func repartirMonto(total int64, n int) []int64 {
+	montos := make([]int64, n)
+	if n == 0 {
+		return montos
+	}
+	base, resto := total/int64(n), total%int64(n)
+	for i := range montos {
+		montos[i] = base
+		if int64(i) < resto {
+			montos[i]++
+		}
+	}
+	return montos
+}
+
+// faltantes devuelve los números de esperados que no están en obtenidos
+func faltantes(esperados []int, obtenidos []int) []int {
+	hay := map[int]bool{}
+	for _, n := range obtenidos {
+		hay[n] = true
+	}
+	var faltan []int
+	for _, n := range esperados {
+		if !hay[n] {
+			faltan = append(faltan, n)
+		}
+	}
+	return faltan
+}
+
+// ListTickets devuelve los tickets de la rifa ordenados por número. El email
+// se trae embebiendo profiles por la FK profile_id; si se filtra por email el
+// embed es !inner para que el filtro descarte los tickets de otros perfiles.
+func (c *SupabaseClient) ListTickets(ctx context.Context, rifaID string, filtro model.FiltroTickets) ([]model.TicketAdmin, error) {
+	embed := "profiles(email)"
+	if filtro.Email != "" {
+		embed = "profiles!inner(email)"
+	}
+	filtros := url.Values{
+		"rifa_id": {"eq." + rifaID},
+		"select":  {"number,profile_id,created_at,payment_intent_id,amount_paid,currency,paid_at,status,payment_provider,organizer_account," + embed},
+		"order":   {"number.asc"},
+		"limit":   {strconv.Itoa(filtro.Limit)},
+		"offset":  {strconv.Itoa(filtro.Offset)},
+	}
+	if filtro.Email != "" {
+		filtros.Set("profiles.email", "ilike."+filtro.Email)
+	}
+	if filtro.Number > 0 {
+		filtros.Add("number", fmt.Sprintf("eq.%d", filtro.Number))
+	}
+	if filtro.DespuesDe > 0 {
+		filtros.Add("number", fmt.Sprintf("gt.%d", filtro.DespuesDe))
+	}
+	if filtro.SoloVigentes {
+		filtros.Set("or", "("+ticketValido+")")
+	}
+	path := consulta("tikect", filtros)
+
+	var filas []struct {
+		model.TicketAdmin
+		Profiles *struct {
+			Email string `json:"email"`
+		} `json:"profiles"`
+	}
+	if err := c.get(ctx, path, &filas); err != nil {
+		return nil, err
+	}
+
+	tickets := make([]model.TicketAdmin, len(filas))
+	for i, f := range filas {
+		tickets[i] = f.TicketAdmin
+		if f.Profiles != nil {
+			tickets[i].Email = f.Profiles.Email
+		}
+	}
+	return tickets, nil
+}
+
+// TicketsByPaymentIntent devuelve los números ya registrados para el intent
+func (c *SupabaseClient) TicketsByPaymentIntent(ctx context.Context, paymentIntentID string) ([]int, error) {
+	return c.numeros(ctx, consulta("tikect", url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "select": {"number"}, "order": {"number.asc"}}))
+}
+
+// PaymentIntentTickets devuelve los tickets registrados para el intent, con su estado y monto
+func (c *SupabaseClient) PaymentIntentTickets(ctx context.Context, paymentIntentID string) ([]model.TicketAdmin, error) {
+	var tickets []model.TicketAdmin
+	path := consulta("tikect", url.Values{
+		"payment_intent_id": {"eq." + paymentIntentID},
+		"select":            {"rifa_id,number,profile_id,created_at,payment_intent_id,amount_paid,currency,paid_at,status,payment_provider,organizer_account"},
+		"order":             {"number.asc"},
+	})
+	err := c.get(ctx, path, &tickets)
+	return tickets, err
+}
+
+// VerifiableTickets devuelve los tickets del intent en la rifa con el email del
+// perfil que los compró
+func (c *SupabaseClient) VerifiableTickets(ctx context.Context, rifaID string, paymentIntentID string) ([]model.TicketVerificable, error) {
+	var filas []struct {
+		model.TicketVerificable
+		Profiles *struct {
+			Email string `json:"email"`
+		} `json:"profiles"`
+	}
+	path := consulta("tikect", url.Values{
+		"payment_intent_id": {"eq." + paymentIntentID},
+		"rifa_id":           {"eq." + rifaID},
+		"select":            {"number,status,profiles(email)"},
+		"order":             {"number.asc"},
+	})
+	if err := c.get(ctx, path, &filas); err != nil {
+		return nil, err
+	}
+	tickets := make([]model.TicketVerificable, len(filas))
+	for i, f := range filas {
+		tickets[i] = f.TicketVerificable
+		if f.Profiles != nil {
+			tickets[i].Email = f.Profiles.Email
+		}
+	}
+	return tickets, nil
+}
+
+// SetTicketsStatus cambia el estado de los tickets del intent; con numeros
+// vacío cambia todos. Los reembolsados no se tocan: es un estado final.
+func (c *SupabaseClient) SetTicketsStatus(ctx context.Context, paymentIntentID string, numeros []int, estado string) error {
+	filtros := url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "or": {"(" + ticketOcupa + ")"}}
+	if len(numeros) > 0 {
+		filtros.Set("number", "in.("+ListaNumeros(numeros)+")")
+	}
+	_, err := c.do(ctx, http.MethodPatch, consulta("tikect", filtros), map[string]string{"status": estado}, "")
+	return err
+}
+
+// HoldTickets pasa a on_hold los tickets vigentes del intent (pagados o con
+// cuotas pendientes); devuelve cuántos cambiaron
+func (c *SupabaseClient) HoldTickets(ctx context.Context, paymentIntentID string) (int, error) {
+	path := consulta("tikect", url.Values{
+		"payment_intent_id": {"eq." + paymentIntentID},
+		"or":                {fmt.Sprintf("(%s,status.eq.%s)", ticketValido, EstadoTicketPagoParcial)},
+	})
+	return c.contarFilas(ctx, http.MethodPatch, path, map[string]string{"status": EstadoTicketEnRevision})
+}
+
+// ReleaseHeldTickets devuelve los tickets on_hold del intent a su estado: los
+// que tienen balance_due vuelven a partially_paid y el resto a pagados.
+// Devuelve cuántos cambiaron.
+func (c *SupabaseClient) ReleaseHeldTickets(ctx context.Context, paymentIntentID string) (int, error) {
+	retenidos := url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "status": {"eq." + EstadoTicketEnRevision}}
+	parciales, err := c.contarFilas(ctx, http.MethodPatch, consulta("tikect", retenidos)+"&balance_due=gt.0", map[string]string{"status": EstadoTicketPagoParcial})
+	if err != nil {
+		return 0, err
+	}
+	pagados, err := c.contarFilas(ctx, http.MethodPatch, consulta("tikect", retenidos), map[string]string{"status": estadoTicketPagado})
+	return parciales + pagados, err
+}
+
+// UpdateInstallmentTickets reparte entre los tickets de la compra en cuotas
+// lo pagado hasta ahora y el saldo contra total, como InsertTickets reparte un
+// pago; si ya no queda saldo pasan a pagados. Sólo toca los partially_paid: un
+// ticket ya liberado por un plan vencido no vuelve.
+func (c *SupabaseClient) UpdateInstallmentTickets(ctx context.Context, paymentIntentID string, rifaID string, numeros []int, pagado int64, total int64) error {
+	pagados := repartirMonto(pagado, len(numeros))
+	precios := repartirMonto(total, len(numeros))
+	for i, n := range numeros {
+		cambio := map[string]interface{}{"amount_paid": pagados[i], "balance_due": precios[i] - pagados[i]}
+		if pagado >= total {
+			cambio["status"] = estadoTicketPagado
+		}
+		path := consulta("tikect", url.Values{
+			"payment_intent_id": {"eq." + paymentIntentID},
+			"rifa_id":           {"eq." + rifaID},
+			"number":            {fmt.Sprintf("eq.%d", n)},
+			"status":            {"eq." + EstadoTicketPagoParcial},
+		})
+		if _, err := c.do(ctx, http.MethodPatch, path, cambio, ""); err != nil {
+			return fmt.Errorf("ticket %d: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// DeleteTickets borra los tickets del intent. Sólo para compras gratis y ventas
+// manuales que no se pudieron completar: un ticket pagado en Stripe se marca,
+// nunca se borra.
+func (c *SupabaseClient) DeleteTickets(ctx context.Context, paymentIntentID string) error {
+	_, err := c.do(ctx, http.MethodDelete, consulta("tikect", url.Values{"payment_intent_id": {"eq." + paymentIntentID}}), nil, "")
+	return err
+}
+
+// BlockBuyer agrega el comprador a blocked_buyers. email es unique, así que
+// una segunda disputa del mismo comprador no falla; una fila sin email (sólo
+// el usuario) siempre se inserta.
+func (c *SupabaseClient) BlockBuyer(ctx context.Context, bloqueo *model.CompradorBloqueado) error {
+	payload := map[string]interface{}{
+		"reason": bloqueo.Reason,
+	}
+	// null y no "": dos bloqueos de sólo usuario no chocan en el unique de email
+	if bloqueo.Email != "" {
+		payload["email"] = bloqueo.Email
+	}
+	if bloqueo.UserID != "" {
+		payload["user_id"] = bloqueo.UserID
+	}
+	if bloqueo.PaymentIntentID != "" {
+		payload["payment_intent_id"] = bloqueo.PaymentIntentID
+	}
+	_, err := c.do(ctx, http.MethodPost, "blocked_buyers?on_conflict=email", payload, "resolution=ignore-duplicates")
+	return err
+}
+
+// IsBuyerBlocked indica si el email o el usuario están en blocked_buyers; el
+// email tiene que venir normalizado como se guardó
+func (c *SupabaseClient) IsBuyerBlocked(ctx context.Context, email string, userID string) (bool, error) {
+	var condiciones []string
+	if email != "" {
+		condiciones = append(condiciones, "email.eq."+email)
+	}
+	if userID != "" {
+		condiciones = append(condiciones, "user_id.eq."+userID)
+	}
+	if len(condiciones) == 0 {
+		return false, nil
+	}
+	var filas []map[string]interface{}
+	path := consulta("blocked_buyers", url.Values{"select": {"id"}, "limit": {"1"}, "or": {"(" + strings.Join(condiciones, ",") + ")"}})
+	if err := c.get(ctx, path, &filas); err != nil {
+		return false, err
+	}
+	return len(filas) > 0, nil
+}
+
+// ListBlockedBuyers devuelve los bloqueos, los más recientes primero; email
+// (normalizado) filtra por comprador
+func (c *SupabaseClient) ListBlockedBuyers(ctx context.Context, email string) ([]model.CompradorBloqueado, error) {
+	filtros := url.Values{"select": {"id,email,user_id,reason,payment_intent_id,created_at"}, "order": {"created_at.desc"}, "limit": {"1000"}}
+	if email != "" {
+		filtros.Set("email", "eq."+email)
+	}
+	var filas []model.CompradorBloqueado
+	if err := c.get(ctx, consulta("blocked_buyers", filtros), &filas); err != nil {
+		return nil, err
+	}
+	return filas, nil
+}
+
+// UnblockBuyer borra el bloqueo; false si no existía
+func (c *SupabaseClient) UnblockBuyer(ctx context.Context, id int64) (bool, error) {
+	body, err := c.do(ctx, http.MethodDelete, consulta("blocked_buyers", url.Values{"id": {fmt.Sprintf("eq.%d", id)}}), nil, "return=representation")
+	if err != nil {
+		return false, err
+	}
+	var borradas []map[string]interface{}
+	if err := json.Unmarshal(body, &borradas); err != nil {
+		return false, err
+	}
+	return len(borradas) > 0, nil
+}
+
+// UserTickets devuelve los tickets del usuario ordenados por fecha de compra,
+// embebiendo la rifa por la FK rifa_id
+func (c *SupabaseClient) UserTickets(ctx context.Context, userID string) ([]model.TicketUsuario, error) {
+	var filas []struct {
+		Number    int    `json:"number"`
+		CreatedAt string `json:"created_at"`
+		RifaID    string `json:"rifa_id"`
+		Rifa      *struct {
+			Title    string `json:"title"`
+			DrawDate string `json:"draw_date"`
+		} `json:"rifa"`
+	}
+	path := consulta("tikect", url.Values{
+		"profile_id": {"eq." + userID},
+		"or":         {"(" + ticketOcupa + ")"},
+		"select":     {"number,created_at,rifa_id,rifa(title,draw_date)"},
+		"order":      {"created_at.asc,number.asc"},
+	})
+	if err := c.get(ctx, path, &filas); err != nil {
+		return nil, err
+	}
+
+	tickets := make([]model.TicketUsuario, len(filas))
+	for i, f := range filas {
+		tickets[i] = model.TicketUsuario{Number: f.Number, CreatedAt: f.CreatedAt, RifaID: f.RifaID}
+		if f.Rifa != nil {
+			tickets[i].RifaTitle, tickets[i].DrawDate = f.Rifa.Title, f.Rifa.DrawDate
+		}
+	}
+	return tickets, nil
+}
+
+// TransferTicket pasa el ticket vigente del número al perfil aProfileID, sólo
+// si sigue siendo de deProfileID (vacío es un ticket sin perfil). Devuelve
+// false si otra transferencia o un reembolso lo cambió antes.
+func (c *SupabaseClient) TransferTicket(ctx context.Context, rifaID string, numero int, deProfileID string, aProfileID string) (bool, error) {
+	dueno := "is.null"
+	if deProfileID != "" {
+		dueno = "eq." + deProfileID
+	}
+	path := consulta("tikect", url.Values{
+		"rifa_id":    {"eq." + rifaID},
+		"number":     {fmt.Sprintf("eq.%d", numero)},
+		"profile_id": {dueno},
+		"or":         {"(" + ticketValido + ")"},
+	})
+	body, err := c.do(ctx, http.MethodPatch, path, map[string]string{"profile_id": aProfileID}, "return=representation")
+	if err != nil {
+		return false, err
+	}
+	var filas []model.TicketAdmin
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return false, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	return len(filas) > 0, nil
+}
+
+// GetProfile busca la cuenta por ID o, si id está vacío, por email
+func (c *SupabaseClient) GetProfile(ctx context.Context, id string, email string) (*model.Perfil, error) {
+	filtros := url.Values{"select": {"id,email,created_at"}, "limit": {"1"}}
+	if id != "" {
+		filtros.Set("id", "eq."+id)
+	} else {
+		filtros.Set("email", "ilike."+email)
+	}
+	var perfiles []model.Perfil
+	if err := c.get(ctx, consulta("profiles", filtros), &perfiles); err != nil {
+		return nil, err
+	}
+	if len(perfiles) == 0 {
+		return nil, model.ErrPerfilNoEncontrado
+	}
+	return &perfiles[0], nil
+}
+
+// LatestDraw devuelve el sorteo más reciente de la rifa
+func (c *SupabaseClient) LatestDraw(ctx context.Context, rifaID string) (*model.Sorteo, error) {
+	var data []model.Sorteo
+	path := consulta("draws", url.Values{"rifa_id": {"eq." + rifaID}, "select": {"*"}, "order": {"drawn_at.desc"}, "limit": {"1"}})
+	if err := c.get(ctx, path, &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, model.ErrSorteoNoEncontrado
+	}
+	return &data[0], nil
+}
+
+func (c *SupabaseClient) InsertDraw(ctx context.Context, sorteo *model.Sorteo) error {
+	_, err := c.do(ctx, http.MethodPost, "draws", sorteo, "")
+	return err
+}
+
+// CreateReceipt le asigna al intent su número de recibo. payment_intent_id es
+// unique: un reintento del webhook recibe el recibo que ya tenía, con el mismo número.
+func (c *SupabaseClient) CreateReceipt(ctx context.Context, recibo *model.Recibo) (*model.Recibo, error) {
+	body, err := c.do(ctx, http.MethodPost, "receipts?on_conflict=payment_intent_id", recibo, "resolution=ignore-duplicates,return=representation")
+	if err != nil {
+		return nil, err
+	}
+	var filas []model.Recibo
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return nil, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	if len(filas) == 0 {
+		if err := c.get(ctx, consulta("receipts", url.Values{"select": {"*"}, "payment_intent_id": {"eq." + recibo.PaymentIntentID}}), &filas); err != nil {
+			return nil, err
+		}
+		if len(filas) == 0 {
+			return nil, fmt.Errorf("recibo del intent %s no encontrado", recibo.PaymentIntentID)
+		}
+	}
+	return &filas[0], nil
+}
+
+// ClaimDrawNotification reserva el envío de la notificación antes de mandar el
+// correo: la crea en sending, o pasa a sending una que había quedado failed.
+// Devuelve false si ya existía en otro estado (enviada, o en curso en otra
+// petición), y entonces no hay que enviarla.
+func (c *SupabaseClient) ClaimDrawNotification(ctx context.Context, n *model.NotificacionSorteo) (bool, error) {
+	nueva := *n
+	nueva.Status = model.NotificacionEnviando
+	body, err := c.do(ctx, http.MethodPost, "draw_notifications?on_conflict=draw_id,email,kind", nueva, "resolution=ignore-duplicates,return=representation")
+	if err != nil {
+		return false, err
+	}
+	var filas []model.NotificacionSorteo
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return false, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	if len(filas) > 0 {
+		return true, nil
+	}
+
+	fallida := filtroNotificacion(n)
+	fallida.Set("status", "eq."+model.NotificacionFallida)
+	body, err = c.do(ctx, http.MethodPatch, consulta("draw_notifications", fallida), map[string]string{"status": model.NotificacionEnviando}, "return=representation")
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return false, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	return len(filas) > 0, nil
+}
+
+// FinishDrawNotification guarda el resultado del envío (sent o failed)
+func (c *SupabaseClient) FinishDrawNotification(ctx context.Context, n *model.NotificacionSorteo) error {
+	payload := map[string]string{"status": n.Status, "last_error": n.LastError}
+	_, err := c.do(ctx, http.MethodPatch, consulta("draw_notifications", filtroNotificacion(n)), payload, "")
+	return err
+}
+
+func filtroNotificacion(n *model.NotificacionSorteo) url.Values {
+	return url.Values{"draw_id": {fmt.Sprintf("eq.%d", n.DrawID)}, "email": {"eq." + n.Email}, "kind": {"eq." + n.Kind}}
+}
+
+// loteVendidos es el tamaño de página de TicketsSoldSince
+const loteVendidos = 1000
+
+// TicketsSoldSince devuelve los tickets registrados desde desde que siguen
+// ocupando su número (los reembolsados no cuentan), paginando por id
+func (c *SupabaseClient) TicketsSoldSince(ctx context.Context, desde time.Time) (_ []model.TicketVendido, err error) {
+	ctx, span := tracer.Start(ctx, "store.TicketsSoldSince")
+	defer func() { tracing.Fin(span, err) }()
+
+	var vendidos []model.TicketVendido
+	var ultimo int64
+	for {
+		var filas []struct {
+			model.TicketVendido
+			Rifa *struct {
+				Title string `json:"title"`
+			} `json:"rifa"`
+		}
+		path := consulta("tikect", url.Values{
+			"created_at": {"gte." + desde.UTC().Format(time.RFC3339)},
+			"id":         {fmt.Sprintf("gt.%d", ultimo)},
+			"or":         {"(" + ticketOcupa + ")"},
+			"select":     {"id,rifa_id,payment_intent_id,amount_paid,currency,rifa(title)"},
+			"order":      {"id.asc"},
+			"limit":      {strconv.Itoa(loteVendidos)},
+		})
+		if err = c.get(ctx, path, &filas); err != nil {
+			return nil, err
+		}
+		for _, f := range filas {
+			t := f.TicketVendido
+			if f.Rifa != nil {
+				t.RifaTitle = f.Rifa.Title
+			}
+			vendidos = append(vendidos, t)
+		}
+		if len(filas) < loteVendidos {
+			return vendidos, nil
+		}
+		ultimo = filas[len(filas)-1].ID
+	}
+}
+
+// ClaimDigest reserva el resumen del día (YYYY-MM-DD) en digest_runs; devuelve
+// false si ya lo envió otra instancia o un arranque anterior
+func (c *SupabaseClient) ClaimDigest(ctx context.Context, dia string) (bool, error) {
+	payload := map[string]string{"day": dia, "sent_at": time.Now().UTC().Format(time.RFC3339)}
+	body, err := c.do(ctx, http.MethodPost, "digest_runs?on_conflict=day", payload, "resolution=ignore-duplicates,return=representation")
+	if err != nil {
+		return false, err
+	}
+	var filas []map[string]interface{}
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return false, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	return len(filas) > 0, nil
+}
+
+// ReleaseDigest borra la reserva del día para que el resumen se reintente
+func (c *SupabaseClient) ReleaseDigest(ctx context.Context, dia string) error {
+	_, err := c.do(ctx, http.MethodDelete, consulta("digest_runs", url.Values{"day": {"eq." + dia}}), nil, "")
+	return err
+}
+
+// IsEventProcessed indica si el evento de Stripe ya está en webhook_events
+func (c *SupabaseClient) IsEventProcessed(ctx context.Context, eventID string) (bool, error) {
+	var filas []map[string]interface{}
+	if err := c.get(ctx, consulta("webhook_events", url.Values{"event_id": {"eq." + eventID}, "select": {"event_id"}}), &filas); err != nil {
+		return false, err
+	}
+	return len(filas) > 0, nil
+}
+
+// MarkEventProcessed guarda el evento; event_id es unique, así que un
+// duplicado se ignora en lugar de fallar.
+func (c *SupabaseClient) MarkEventProcessed(ctx context.Context, eventID string, tipo string) error {
+	payload := map[string]interface{}{
+		"event_id":   eventID,
+		"event_type": tipo,
+	}
+	_, err := c.do(ctx, http.MethodPost, "webhook_events?on_conflict=event_id", payload, "resolution=ignore-duplicates")
+	return err
+}
+
+// RecordFailedRegistration deja constancia de un pago que no se pudo convertir
+// en tickets; payment_intent_id es unique para que los reintentos no dupliquen.
+func (c *SupabaseClient) RecordFailedRegistration(ctx context.Context, fallo map[string]interface{}) error {
+	_, err := c.do(ctx, http.MethodPost, "failed_registrations?on_conflict=payment_intent_id", fallo, "resolution=ignore-duplicates")
+	return err
+}
+
+// RecordPriceMismatch guarda el pago con monto distinto del esperado en
+// price_mismatches; un reintento del evento no duplica la fila
+func (c *SupabaseClient) RecordPriceMismatch(ctx context.Context, diferencia *model.DiferenciaPrecio) error {
+	_, err := c.do(ctx, http.MethodPost, "price_mismatches?on_conflict=payment_intent_id", diferencia, "resolution=ignore-duplicates")
+	return err
+}
+
+// SavePurchaseDraft guarda el borrador de la compra asociado al PaymentIntent.
+// El ID sale de la clave de idempotencia, así que un reintento que ya lo
+// guardó se ignora.
+func (c *SupabaseClient) SavePurchaseDraft(ctx context.Context, compra *model.PurchaseDraft) error {
+	_, err := c.do(ctx, http.MethodPost, "purchase_intent?on_conflict=id", compra, "resolution=ignore-duplicates")
+	return err
+}
+
+// BuyerOpenPurchaseDrafts devuelve los borradores vigentes del comprador (por
+// user_id, o por email si compra como invitado) en la rifa, del que vence
+// último al primero
+func (c *SupabaseClient) BuyerOpenPurchaseDrafts(ctx context.Context, rifaID, userID, email string) ([]model.PurchaseDraft, error) {
+	filtros := url.Values{
+		"select":     {"*"},
+		"rifa_id":    {"eq." + rifaID},
+		"user_id":    {"eq." + userID},
+		"expires_at": {"gt." + time.Now().UTC().Format(time.RFC3339)},
+		"order":      {"expires_at.desc"},
+	}
+	if userID == "" {
+		filtros.Set("email", "eq."+email)
+	}
+	var data []model.PurchaseDraft
+	if err := c.get(ctx, consulta("purchase_intent", filtros), &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// OpenPurchaseDrafts devuelve los borradores vigentes del usuario en la rifa,
+// del más reciente al más viejo; un carrito aparece por la rifa de su primer item
+func (c *SupabaseClient) OpenPurchaseDrafts(ctx context.Context, rifaID string, userID string, limite int) ([]model.PurchaseDraft, error) {
+	path := consulta("purchase_intent", url.Values{
+		"select":     {"*"},
+		"rifa_id":    {"eq." + rifaID},
+		"user_id":    {"eq." + userID},
+		"expires_at": {"gt." + time.Now().UTC().Format(time.RFC3339)},
+		"order":      {"expires_at.desc"},
+		"limit":      {strconv.Itoa(limite)},
+	})
+	var data []model.PurchaseDraft
+	if err := c.get(ctx, path, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GetPurchaseDraft busca el borrador por el ID del PaymentIntent
+func (c *SupabaseClient) GetPurchaseDraft(ctx context.Context, paymentIntentID string) (*model.PurchaseDraft, error) {
+	var data []model.PurchaseDraft
+	if err := c.get(ctx, consulta("purchase_intent", url.Values{"select": {"*"}, "payment_intent_id": {"eq." + paymentIntentID}}), &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, model.ErrCompraNoEncontrada
+	}
+	return &data[0], nil
+}
+
+// GetPurchaseDraftByID busca el borrador por su propio ID
+func (c *SupabaseClient) GetPurchaseDraftByID(ctx context.Context, id string) (*model.PurchaseDraft, error) {
+	var data []model.PurchaseDraft
+	if err := c.get(ctx, consulta("purchase_intent", url.Values{"select": {"*"}, "id": {"eq." + id}}), &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, model.ErrCompraNoEncontrada
+	}
+	return &data[0], nil
+}
+
+// UpdateInstallmentPlan cambia el plan de cuotas del borrador sólo si sigue
+// en estado (vacío es sin plan) con pagadas cuotas pagadas; devuelve false si
+// otro proceso lo cambió antes. Así una cuota pagada y el barrido de planes
+// vencidos no pisan el uno al otro.
+func (c *SupabaseClient) UpdateInstallmentPlan(ctx context.Context, compraID string, estado string, pagadas int, cambio model.CambioPlanCuotas) (bool, error) {
+	filtros := url.Values{"id": {"eq." + compraID}, "select": {"id"}}
+	if estado == "" {
+		filtros.Set("installment_status", "is.null")
+	} else {
+		filtros.Set("installment_status", "eq."+estado)
+	}
+	if pagadas == 0 {
+		filtros.Set("or", "(installments_paid.is.null,installments_paid.eq.0)")
+	} else {
+		filtros.Set("installments_paid", fmt.Sprintf("eq.%d", pagadas))
+	}
+	n, err := c.contarFilas(ctx, http.MethodPatch, consulta("purchase_intent", filtros), cambio)
+	return n > 0, err
+}
+
+// OverdueInstallmentPlans devuelve hasta limite borradores con el plan de
+// cuotas vencido antes de ahora, incluidos los que quedaron cancelándose
+func (c *SupabaseClient) OverdueInstallmentPlans(ctx context.Context, ahora time.Time, limite int) ([]model.PurchaseDraft, error) {
+	path := consulta("purchase_intent", url.Values{
+		"select": {"*"},
+		"or":     {fmt.Sprintf("(installment_status.eq.%s,and(installment_status.eq.%s,installment_due_at.lt.%s))", model.PlanCuotasCancelando, model.PlanCuotasActivo, ahora.UTC().Format(time.RFC3339))},
+		"order":  {"installment_due_at.asc"},
+		"limit":  {strconv.Itoa(limite)},
+	})
+	var data []model.PurchaseDraft
+	if err := c.get(ctx, path, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GetPromoCode busca el código en la tabla codes; se guardan en mayúsculas
+func (c *SupabaseClient) GetPromoCode(ctx context.Context, codigo string) (*model.CodigoPromo, error) {
+	var data []model.CodigoPromo
+	path := consulta("codes", url.Values{"select": {"code,rifa_id,percent_off,amount_off,max_redemptions,expires_at"}, "code": {"eq." + codigo}})
+	if err := c.get(ctx, path, &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, model.ErrCodigoNoEncontrado
+	}
+	return &data[0], nil
+}
+
+// Estados de code_redemptions: un canje queda pendiente al crear el intent y
+// se confirma en el webhook cuando se paga
+const (
+	canjePendiente  = "pending"
+	canjeConfirmado = "redeemed"
+)
+
+// CountPromoRedemptions cuenta los canjes confirmados del código más los
+// pendientes que no vencieron
+func (c *SupabaseClient) CountPromoRedemptions(ctx context.Context, codigo string) (int, error) {
+	var filas []map[string]interface{}
+	enUso := fmt.Sprintf("status.eq.%s,expires_at.gt.%s", canjeConfirmado, time.Now().UTC().Format(time.RFC3339))
+	path := consulta("code_redemptions", url.Values{"select": {"payment_intent_id"}, "code": {"eq." + codigo}, "or": {"(" + enUso + ")"}})
+	if err := c.get(ctx, path, &filas); err != nil {
+		return 0, err
+	}
+	return len(filas), nil
+}
+
+// RecordPromoRedemption deja pendiente el canje del código para el intent.
+// payment_intent_id es unique: un reintento de la misma compra no cuenta dos veces.
+func (c *SupabaseClient) RecordPromoRedemption(ctx context.Context, codigo string, paymentIntentID string, expira time.Time) error {
+	payload := map[string]interface{}{
+		"code":              codigo,
+		"payment_intent_id": paymentIntentID,
+		"status":            canjePendiente,
+		"expires_at":        expira.UTC().Format(time.RFC3339),
+	}
+	_, err := c.do(ctx, http.MethodPost, "code_redemptions?on_conflict=payment_intent_id", payload, "resolution=ignore-duplicates")
+	return err
+}
+
+// RedeemPromoCode confirma el canje del intent y recalcula times_redeemed del
+// código a partir de los canjes confirmados, así re-ejecutarla no suma de más
+func (c *SupabaseClient) RedeemPromoCode(ctx context.Context, codigo string, paymentIntentID string) error {
+	confirmado := map[string]string{"status": canjeConfirmado}
+	if _, err := c.do(ctx, http.MethodPatch, consulta("code_redemptions", url.Values{"payment_intent_id": {"eq." + paymentIntentID}}), confirmado, ""); err != nil {
+		return err
+	}
+	var filas []map[string]interface{}
+	path := consulta("code_redemptions", url.Values{"select": {"payment_intent_id"}, "code": {"eq." + codigo}, "status": {"eq." + canjeConfirmado}})
+	if err := c.get(ctx, path, &filas); err != nil {
+		return err
+	}
+	if c.sandbox {
+		// Un canje de prueba no gasta usos del código real
+		return nil
+	}
+	_, err := c.do(ctx, http.MethodPatch, consulta("codes", url.Values{"code": {"eq." + codigo}}), map[string]int{"times_redeemed": len(filas)}, "")
+	return err
+}
+
+// ReleasePromoRedemption borra el canje pendiente del intent; no falla si el
+// intent no usó código. Un canje confirmado no se toca.
+func (c *SupabaseClient) ReleasePromoRedemption(ctx context.Context, paymentIntentID string) error {
+	path := consulta("code_redemptions", url.Values{"payment_intent_id": {"eq." + paymentIntentID}, "status": {"eq." + canjePendiente}})
+	_, err := c.do(ctx, http.MethodDelete, path, nil, "")
+	return err
+}
+
+// GetReferrer busca el referente por su código; se guardan en mayúsculas
+func (c *SupabaseClient) GetReferrer(ctx context.Context, codigo string) (*model.Referente, error) {
+	var data []model.Referente
+	path := consulta("referrers", url.Values{"select": {"code,email,name,commission_percent,active"}, "code": {"eq." + codigo}})
+	if err := c.get(ctx, path, &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, model.ErrReferenteNoEncontrado
+	}
+	return &data[0], nil
+}
+
+// RecordReferralCredit guarda la comisión de la venta; si el intent ya tenía
+// una (reintento del webhook) se deja la que estaba
+func (c *SupabaseClient) RecordReferralCredit(ctx context.Context, credito *model.CreditoReferido) error {
+	_, err := c.do(ctx, http.MethodPost, "referral_credits?on_conflict=payment_intent_id", credito, "resolution=ignore-duplicates")
+	return err
+}
+
+// GetReferralCredit devuelve la comisión del intent; nil si la venta no trajo código
+func (c *SupabaseClient) GetReferralCredit(ctx context.Context, paymentIntentID string) (*model.CreditoReferido, error) {
+	var data []model.CreditoReferido
+	if err := c.get(ctx, consulta("referral_credits", url.Values{"select": {"*"}, "payment_intent_id": {"eq." + paymentIntentID}}), &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return &data[0], nil
+}
+
+// ClawBackReferralCredit fija cuánto de la comisión del intent se descontó;
+// es el total descontado, no un incremento, para que repetirlo no sume dos veces
+func (c *SupabaseClient) ClawBackReferralCredit(ctx context.Context, paymentIntentID string, descontado int64) error {
+	path := consulta("referral_credits", url.Values{"payment_intent_id": {"eq." + paymentIntentID}})
+	_, err := c.do(ctx, http.MethodPatch, path, map[string]int64{"clawed_back": descontado}, "")
+	return err
+}
+
+// ReferralCredits devuelve las comisiones del código, las más recientes primero
+func (c *SupabaseClient) ReferralCredits(ctx context.Context, codigo string) ([]model.CreditoReferido, error) {
+	var data []model.CreditoReferido
+	err := c.get(ctx, consulta("referral_credits", url.Values{"select": {"*"}, "code": {"eq." + codigo}, "order": {"created_at.desc"}}), &data)
+	return data, err
+}
+
+// RecordEmailFailure guarda un correo de confirmación que agotó sus reintentos
+func (c *SupabaseClient) RecordEmailFailure(ctx context.Context, fallo *model.EmailFailure) error {
+	_, err := c.do(ctx, http.MethodPost, "email_failures", fallo, "")
+	return err
+}
+
+// RecordEmailEvent guarda un evento de correo; uno que ya estaba se ignora
+func (c *SupabaseClient) RecordEmailEvent(ctx context.Context, evento *model.EventoCorreo) error {
+	_, err := c.do(ctx, http.MethodPost, "email_events?on_conflict=message_id,type", evento, "resolution=ignore-duplicates")
+	return err
+}
+
+// FlagUndeliverableEmail marca el email en undeliverable_emails; si ya estaba
+// se actualizan el motivo y el mensaje con el último rebote
+func (c *SupabaseClient) FlagUndeliverableEmail(ctx context.Context, email string, motivo string, messageID string) error {
+	payload := map[string]interface{}{
+		"email":      strings.ToLower(email),
+		"reason":     motivo,
+		"message_id": messageID,
+		"flagged_at": time.Now().UTC().Format(time.RFC3339),
+	}
+	_, err := c.do(ctx, http.MethodPost, "undeliverable_emails?on_conflict=email", payload, "resolution=merge-duplicates")
+	return err
+}
+
+// UndeliverableEmails devuelve cuáles de los emails están en undeliverable_emails, en minúsculas
+func (c *SupabaseClient) UndeliverableEmails(ctx context.Context, emails []string) (map[string]bool, error) {
+	marcados := map[string]bool{}
+	if len(emails) == 0 {
+		return marcados, nil
+	}
+	citados := make([]string, len(emails))
+	for i, e := range emails {
+		citados[i] = `"` + strings.ToLower(e) + `"`
+	}
+	var filas []struct {
+		Email string `json:"email"`
+	}
+	path := consulta("undeliverable_emails", url.Values{"select": {"email"}, "email": {"in.(" + strings.Join(citados, ",") + ")"}})
+	if err := c.get(ctx, path, &filas); err != nil {
+		return nil, err
+	}
+	for _, f := range filas {
+		marcados[f.Email] = true
+	}
+	return marcados, nil
+}
+
+// PendingEmailFailures devuelve los correos fallidos más antiguos primero
+func (c *SupabaseClient) PendingEmailFailures(ctx context.Context, limite int) ([]model.EmailFailure, error) {
+	var fallos []model.EmailFailure
+	err := c.get(ctx, consulta("email_failures", url.Values{"select": {"*"}, "order": {"id.asc"}, "limit": {strconv.Itoa(limite)}}), &fallos)
+	return fallos, err
+}
+
+func (c *SupabaseClient) DeleteEmailFailure(ctx context.Context, id int64) error {
+	_, err := c.do(ctx, http.MethodDelete, consulta("email_failures", url.Values{"id": {fmt.Sprintf("eq.%d", id)}}), nil, "")
+	return err
+}
+
+func (c *SupabaseClient) UpdateEmailFailure(ctx context.Context, id int64, ultimoError string) error {
+	_, err := c.do(ctx, http.MethodPatch, consulta("email_failures", url.Values{"id": {fmt.Sprintf("eq.%d", id)}}), map[string]string{"last_error": ultimoError}, "")
+	return err
+}
+
+// EnqueueJob guarda el evento en pending_jobs. Devuelve nil, nil si el evento
+// ya estaba encolado (Stripe lo reintentó antes de que se procesara).
+func (c *SupabaseClient) EnqueueJob(ctx context.Context, trabajo *model.PendingJob) (*model.PendingJob, error) {
+	body, err := c.do(ctx, http.MethodPost, "pending_jobs?on_conflict=event_id", trabajo, "resolution=ignore-duplicates,return=representation")
+	if err != nil {
+		return nil, err
+	}
+	var filas []model.PendingJob
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return nil, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	if len(filas) == 0 {
+		return nil, nil
+	}
+	return &filas[0], nil
+}
+
+// DueJobs devuelve los trabajos pendientes cuyo próximo intento ya venció, los
+// más antiguos primero
+func (c *SupabaseClient) DueJobs(ctx context.Context, limite int) ([]model.PendingJob, error) {
+	var trabajos []model.PendingJob
+	path := consulta("pending_jobs", url.Values{
+		"select":          {"*"},
+		"status":          {"eq." + model.TrabajoPendiente},
+		"next_attempt_at": {"lte." + time.Now().UTC().Format(time.RFC3339)},
+		"order":           {"id.asc"},
+		"limit":           {strconv.Itoa(limite)},
+	})
+	err := c.get(ctx, path, &trabajos)
+	return trabajos, err
+}
+
+// UpdateJob guarda el estado, los intentos, el último error y el próximo intento
+func (c *SupabaseClient) UpdateJob(ctx context.Context, trabajo *model.PendingJob) error {
+	cambios := map[string]interface{}{
+		"status":          trabajo.Status,
+		"attempts":        trabajo.Attempts,
+		"last_error":      trabajo.LastError,
+		"next_attempt_at": trabajo.NextAttemptAt.UTC().Format(time.RFC3339),
+	}
+	_, err := c.do(ctx, http.MethodPatch, consulta("pending_jobs", url.Values{"id": {fmt.Sprintf("eq.%d", trabajo.ID)}}), cambios, "")
+	return err
+}
+
+func (c *SupabaseClient) DeleteJob(ctx context.Context, id int64) error {
+	_, err := c.do(ctx, http.MethodDelete, consulta("pending_jobs", url.Values{"id": {fmt.Sprintf("eq.%d", id)}}), nil, "")
+	return err
+}
+
+// EnqueueOutbox guarda las entradas en outbox en un solo POST; las que ya
+// estaban (mismo dedup_key) se ignoran
+func (c *SupabaseClient) EnqueueOutbox(ctx context.Context, entradas []model.OutboxEntry) error {
+	_, err := c.do(ctx, http.MethodPost, "outbox?on_conflict=dedup_key", entradas, "resolution=ignore-duplicates")
+	return err
+}
+
+// DueOutbox devuelve las entradas pendientes cuyo próximo intento ya venció,
+// las más antiguas primero
+func (c *SupabaseClient) DueOutbox(ctx context.Context, limite int) ([]model.OutboxEntry, error) {
+	var entradas []model.OutboxEntry
+	path := consulta("outbox", url.Values{
+		"select":          {"*"},
+		"status":          {"eq." + model.SalidaPendiente},
+		"next_attempt_at": {"lte." + time.Now().UTC().Format(time.RFC3339)},
+		"order":           {"id.asc"},
+		"limit":           {strconv.Itoa(limite)},
+	})
+	err := c.get(ctx, path, &entradas)
+	return entradas, err
+}
+
+// ClaimOutbox toma la entrada para enviarla: le suma un intento y corre su
+// próximo intento a hasta, siempre que siga pendiente y con los intentos que
+// tenía al leerla. Devuelve false si otra instancia la tomó primero.
+func (c *SupabaseClient) ClaimOutbox(ctx context.Context, entrada *model.OutboxEntry, hasta time.Time) (bool, error) {
+	path := consulta("outbox", url.Values{
+		"id":       {fmt.Sprintf("eq.%d", entrada.ID)},
+		"status":   {"eq." + model.SalidaPendiente},
+		"attempts": {fmt.Sprintf("eq.%d", entrada.Attempts)},
+	})
+	cambios := map[string]interface{}{
+		"attempts":        entrada.Attempts + 1,
+		"next_attempt_at": hasta.UTC().Format(time.RFC3339),
+	}
+	n, err := c.contarFilas(ctx, http.MethodPatch, path, cambios)
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	entrada.Attempts++
+	entrada.NextAttemptAt = hasta
+	return true, nil
+}
+
+// UpdateOutbox guarda el estado, el último error, el próximo intento y cuándo se envió
+func (c *SupabaseClient) UpdateOutbox(ctx context.Context, entrada *model.OutboxEntry) error {
+	cambios := map[string]interface{}{
+		"status":          entrada.Status,
+		"last_error":      entrada.LastError,
+		"next_attempt_at": entrada.NextAttemptAt.UTC().Format(time.RFC3339),
+		"sent_at":         entrada.SentAt,
+	}
+	_, err := c.do(ctx, http.MethodPatch, consulta("outbox", url.Values{"id": {fmt.Sprintf("eq.%d", entrada.ID)}}), cambios, "")
+	return err
+}
+
+// ListOutbox devuelve las entradas con el estado dado, las más nuevas primero
+func (c *SupabaseClient) ListOutbox(ctx context.Context, estado string, limite int) ([]model.OutboxEntry, error) {
+	var entradas []model.OutboxEntry
+	path := consulta("outbox", url.Values{"select": {"*"}, "status": {"eq." + estado}, "order": {"id.desc"}, "limit": {strconv.Itoa(limite)}})
+	err := c.get(ctx, path, &entradas)
+	return entradas, err
+}
+
+// RequeueOutbox vuelve a pendiente una entrada muerta, con los intentos en
+// cero. Devuelve nil, nil si no existe o no está muerta.
+func (c *SupabaseClient) RequeueOutbox(ctx context.Context, id int64) (*model.OutboxEntry, error) {
+	cambios := map[string]interface{}{
+		"status":          model.SalidaPendiente,
+		"attempts":        0,
+		"next_attempt_at": time.Now().UTC().Format(time.RFC3339),
+	}
+	var filas []model.OutboxEntry
+	path := consulta("outbox", url.Values{"id": {fmt.Sprintf("eq.%d", id)}, "status": {"eq." + model.SalidaMuerta}})
+	if err := c.cambiarFilas(ctx, http.MethodPatch, path, cambios, &filas); err != nil {
+		return nil, err
+	}
+	if len(filas) == 0 {
+		return nil, nil
+	}
+	return &filas[0], nil
+}
+
+// OutboxBacklog cuenta las entradas pendientes y devuelve la fecha de la más
+// vieja (cero si no hay ninguna). La cuenta sale del Content-Range de
+// count=exact: traer las filas la cortaría en el max-rows de PostgREST.
+func (c *SupabaseClient) OutboxBacklog(ctx context.Context) (int, time.Time, error) {
+	path := consulta("outbox", url.Values{"select": {"created_at"}, "status": {"eq." + model.SalidaPendiente}, "order": {"created_at.asc"}, "limit": {"1"}})
+	body, cabeceras, err := c.doConCabeceras(ctx, http.MethodGet, path, nil, "count=exact")
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	// Content-Range: 0-0/42, o */0 sin filas
+	_, total, _ := strings.Cut(cabeceras.Get("Content-Range"), "/")
+	pendientes, err := strconv.Atoi(total)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("Content-Range inválido de supabase: %q", cabeceras.Get("Content-Range"))
+	}
+	var filas []struct {
+		CreatedAt time.Time `json:"created_at"`
+	}
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return 0, time.Time{}, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	if len(filas) == 0 {
+		return pendientes, time.Time{}, nil
+	}
+	return pendientes, filas[0].CreatedAt, nil
+}
+
+// RecordAuditEntries inserta las entradas de auditoría en un solo POST
+func (c *SupabaseClient) RecordAuditEntries(ctx context.Context, entradas []model.EntradaAuditoria) error {
+	_, err := c.do(ctx, http.MethodPost, "audit_log", entradas, "")
+	return err
+}
+
+// ListAuditEntries devuelve las entradas de auditoría de la más reciente a la
+// más vieja, filtradas por rifa y por [Desde, Hasta)
+func (c *SupabaseClient) ListAuditEntries(ctx context.Context, filtro model.FiltroAuditoria) ([]model.EntradaAuditoria, error) {
+	filtros := url.Values{
+		"select": {"*"},
+		"order":  {"created_at.desc,id.desc"},
+		"limit":  {strconv.Itoa(filtro.Limit)},
+		"offset": {strconv.Itoa(filtro.Offset)},
+	}
+	if filtro.RifaID != "" {
+		filtros.Set("rifa_id", "eq."+filtro.RifaID)
+	}
+	if !filtro.Desde.IsZero() {
+		filtros.Add("created_at", "gte."+filtro.Desde.UTC().Format(time.RFC3339))
+	}
+	if !filtro.Hasta.IsZero() {
+		filtros.Add("created_at", "lt."+filtro.Hasta.UTC().Format(time.RFC3339))
+	}
+	var entradas []model.EntradaAuditoria
+	if err := c.get(ctx, consulta("audit_log", filtros), &entradas); err != nil {
+		return nil, err
+	}
+	return entradas, nil
+}
+
+// esperaActiva es el filtro de status de las entradas de waitlist que siguen
+// contando para el unique
+const esperaActiva = "in.(" + model.EsperaPendiente + "," + model.EsperaNotificada + ")"
+
+// AddWaitlistEntry anota al usuario en la lista de espera del número y
+// devuelve la fila creada; si ya lo esperaba devuelve model.ErrYaEnEspera
+func (c *SupabaseClient) AddWaitlistEntry(ctx context.Context, entrada *model.EntradaEspera) (*model.EntradaEspera, error) {
+	nueva := *entrada
+	nueva.Status = model.EsperaPendiente
+	body, err := c.do(ctx, http.MethodPost, "waitlist", nueva, "return=representation")
+	var errSB *ErrSupabase
+	if errors.As(err, &errSB) && errSB.Status == http.StatusConflict {
+		return nil, model.ErrYaEnEspera
+	}
+	if err != nil {
+		return nil, err
+	}
+	var filas []model.EntradaEspera
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return nil, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	if len(filas) == 0 {
+		return nil, fmt.Errorf("waitlist no devolvió la entrada de %d", entrada.Number)
+	}
+	return &filas[0], nil
+}
+
+// UserWaitlist devuelve las entradas waiting y notified del usuario en la rifa
+func (c *SupabaseClient) UserWaitlist(ctx context.Context, rifaID string, userID string) ([]model.EntradaEspera, error) {
+	path := consulta("waitlist", url.Values{
+		"rifa_id": {"eq." + rifaID},
+		"user_id": {"eq." + userID},
+		"status":  {esperaActiva},
+		"select":  {"*"},
+		"order":   {"number.asc"},
+	})
+	var entradas []model.EntradaEspera
+	if err := c.get(ctx, path, &entradas); err != nil {
+		return nil, err
+	}
+	return entradas, nil
+}
+
+// CancelWaitlistEntry borra la entrada activa del usuario para el número;
+// devuelve false si no había ninguna
+func (c *SupabaseClient) CancelWaitlistEntry(ctx context.Context, rifaID string, userID string, numero int) (bool, error) {
+	path := consulta("waitlist", url.Values{
+		"rifa_id": {"eq." + rifaID},
+		"user_id": {"eq." + userID},
+		"number":  {fmt.Sprintf("eq.%d", numero)},
+		"status":  {esperaActiva},
+	})
+	body, err := c.do(ctx, http.MethodDelete, path, nil, "return=representation")
+	if err != nil {
+		return false, err
+	}
+	var borradas []model.EntradaEspera
+	if err := json.Unmarshal(body, &borradas); err != nil {
+		return false, err
+	}
+	return len(borradas) > 0, nil
+}
+
+// NextWaitlistEntry devuelve la primera entrada activa del número, en el orden
+// en que se anotaron; nil si nadie lo espera. Puede ser una notified con el
+// número todavía ofrecido.
+func (c *SupabaseClient) NextWaitlistEntry(ctx context.Context, rifaID string, numero int) (*model.EntradaEspera, error) {
+	path := consulta("waitlist", url.Values{
+		"rifa_id": {"eq." + rifaID},
+		"number":  {fmt.Sprintf("eq.%d", numero)},
+		"status":  {esperaActiva},
+		"select":  {"*"},
+		"order":   {"created_at.asc,id.asc"},
+		"limit":   {"1"},
+	})
+	var entradas []model.EntradaEspera
+	if err := c.get(ctx, path, &entradas); err != nil {
+		return nil, err
+	}
+	if len(entradas) == 0 {
+		return nil, nil
+	}
+	return &entradas[0], nil
+}
+
+// MarkWaitlistNotified pasa la entrada de waiting a notified con el número
+// ofrecido hasta la fecha dada. Devuelve false si ya no estaba waiting: otra
+// instancia la notificó o el usuario la canceló.
+func (c *SupabaseClient) MarkWaitlistNotified(ctx context.Context, id int64, hasta time.Time) (bool, error) {
+	payload := map[string]string{
+		"status":           model.EsperaNotificada,
+		"notified_at":      time.Now().UTC().Format(time.RFC3339),
+		"claim_expires_at": hasta.UTC().Format(time.RFC3339),
+	}
+	path := consulta("waitlist", url.Values{"id": {fmt.Sprintf("eq.%d", id)}, "status": {"eq." + model.EsperaPendiente}})
+	body, err := c.do(ctx, http.MethodPatch, path, payload, "return=representation")
+	if err != nil {
+		return false, err
+	}
+	var filas []model.EntradaEspera
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return false, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	return len(filas) > 0, nil
+}
+
+// ExpiredWaitlistClaims devuelve hasta limite entradas notified cuyo plazo
+// para comprar ya venció
+func (c *SupabaseClient) ExpiredWaitlistClaims(ctx context.Context, limite int) ([]model.EntradaEspera, error) {
+	path := consulta("waitlist", url.Values{
+		"status":           {"eq." + model.EsperaNotificada},
+		"claim_expires_at": {"lt." + time.Now().UTC().Format(time.RFC3339)},
+		"select":           {"*"},
+		"order":            {"claim_expires_at.asc"},
+		"limit":            {strconv.Itoa(limite)},
+	})
+	var entradas []model.EntradaEspera
+	if err := c.get(ctx, path, &entradas); err != nil {
+		return nil, err
+	}
+	return entradas, nil
+}
+
+// ExpireWaitlistEntry pasa una entrada notified a expired; devuelve false si
+// ya no estaba notified
+func (c *SupabaseClient) ExpireWaitlistEntry(ctx context.Context, id int64) (bool, error) {
+	path := consulta("waitlist", url.Values{"id": {fmt.Sprintf("eq.%d", id)}, "status": {"eq." + model.EsperaNotificada}})
+	body, err := c.do(ctx, http.MethodPatch, path, map[string]string{"status": model.EsperaVencida}, "return=representation")
+	if err != nil {
+		return false, err
+	}
+	var filas []model.EntradaEspera
+	if err := json.Unmarshal(body, &filas); err != nil {
+		return false, fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	return len(filas) > 0, nil
+}
+
+// patronEmail es el email para un filtro ilike de PostgREST con % y _
+// escapados, para que coincida sólo esa dirección sin importar mayúsculas
+func patronEmail(email string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(email)
+}
+
+// filtroPersona es el valor del or que encuentra las filas del usuario por su
+// columna de usuario o de email; cualquiera de los dos puede venir vacío
+func filtroPersona(columnaUsuario string, userID string, email string) string {
+	var condiciones []string
+	if userID != "" && columnaUsuario != "" {
+		condiciones = append(condiciones, columnaUsuario+".eq."+userID)
+	}
+	if email != "" {
+		// Sin comillas: dentro de ellas PostgREST se come las barras del escape
+		condiciones = append(condiciones, "email.ilike."+patronEmail(email))
+	}
+	return "(" + strings.Join(condiciones, ",") + ")"
+}
+
+// cambiarFilas hace el PATCH o DELETE con return=representation y decodifica
+// las filas afectadas en destino
+func (c *SupabaseClient) cambiarFilas(ctx context.Context, method, path string, payload interface{}, destino interface{}) error {
+	body, err := c.do(ctx, method, path, payload, "return=representation")
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, destino); err != nil {
+		return fmt.Errorf("respuesta inválida de supabase: %w", err)
+	}
+	return nil
+}
+
+// contarFilas es cambiarFilas cuando sólo importa cuántas filas cambiaron
+func (c *SupabaseClient) contarFilas(ctx context.Context, method, path string, payload interface{}) (int, error) {
+	var filas []json.RawMessage
+	err := c.cambiarFilas(ctx, method, path, payload, &filas)
+	return len(filas), err
+}
+
+// EraseUserData borra los datos personales del usuario para un pedido de
+// supresión: sus tickets y sorteos ganados pasan al perfil tombstone y se
+// borran sus borradores de compra, correos fallidos, lista de espera, eventos y
+// rebotes de correo, avisos de sorteo y entradas del outbox; si era
+// destinatario de un regalo se quita del borrador. userID o email pueden venir vacíos (un invitado no tiene
+// perfil). Cada paso es idempotente: si uno falla devuelve lo hecho hasta ahí
+// con el error, y repetir el pedido termina el resto.
+func (c *SupabaseClient) EraseUserData(ctx context.Context, userID string, email string, tombstoneID string) (*model.DatosBorrados, error) {
+	borrados := &model.DatosBorrados{}
+	if strings.Contains(email, "*") {
+		// PostgREST lee * como comodín en ilike y no deja escaparlo
+		return borrados, errors.New("un email con * no se puede filtrar sin comodines")
+	}
+	var err error
+	if userID != "" {
+		sinDueno := map[string]string{"profile_id": tombstoneID}
+		path := consulta("tikect", url.Values{"profile_id": {"eq." + userID}, "select": {"rifa_id,number,payment_intent_id"}})
+		if err := c.cambiarFilas(ctx, http.MethodPatch, path, sinDueno, &borrados.Tickets); err != nil {
+			return borrados, fmt.Errorf("anonimizando tickets: %w", err)
+		}
+		if borrados.Sorteos, err = c.contarFilas(ctx, http.MethodPatch, consulta("draws", url.Values{"profile_id": {"eq." + userID}}), sinDueno); err != nil {
+			return borrados, fmt.Errorf("anonimizando sorteos: %w", err)
+		}
+	}
+
+	var borradores []model.PurchaseDraft
+	delUsuario := consulta("purchase_intent", url.Values{"select": {"payment_intent_id"}, "or": {filtroPersona("user_id", userID, email)}})
+	if err := c.cambiarFilas(ctx, http.MethodDelete, delUsuario, nil, &borradores); err != nil {
+		return borrados, fmt.Errorf("borrando borradores: %w", err)
+	}
+	borrados.Borradores = len(borradores)
+	for _, b := range borradores {
+		if b.PaymentIntentID != "" {
+			borrados.PaymentIntentIDs = append(borrados.PaymentIntentIDs, b.PaymentIntentID)
+		}
+	}
+
+	if email != "" {
+		sinDestinatario := map[string]interface{}{"recipient_email": nil, "recipient_name": nil}
+		delEmail := url.Values{"email": {"ilike." + patronEmail(email)}}
+		pasos := []struct {
+			nombre  string
+			method  string
+			path    string
+			payload interface{}
+			destino *int
+		}{
+			{"regalos", http.MethodPatch, consulta("purchase_intent", url.Values{"recipient_email": {"ilike." + patronEmail(email)}}), sinDestinatario, &borrados.Regalos},
+			{"correos fallidos", http.MethodDelete, consulta("email_failures", delEmail), nil, &borrados.FallosCorreo},
+			{"eventos de correo", http.MethodDelete, consulta("email_events", delEmail), nil, &borrados.EventosCorreo},
+			{"rebotes", http.MethodDelete, consulta("undeliverable_emails", delEmail), nil, &borrados.Rebotes},
+			{"avisos de sorteo", http.MethodDelete, consulta("draw_notifications", delEmail), nil, &borrados.NotificacionesSorteo},
+			{"outbox", http.MethodDelete, consulta("outbox", delEmail), nil, &borrados.Salidas},
+		}
+		for _, p := range pasos {
+			if *p.destino, err = c.contarFilas(ctx, p.method, p.path, p.payload); err != nil {
+				return borrados, fmt.Errorf("borrando %s: %w", p.nombre, err)
+			}
+		}
+	}
+
+	if borrados.Espera, err = c.contarFilas(ctx, http.MethodDelete, consulta("waitlist", url.Values{"or": {filtroPersona("user_id", userID, email)}}), nil); err != nil {
+		return borrados, fmt.Errorf("borrando lista de espera: %w", err)
+	}
+	return borrados, nil
+}
+
+func ListaNumeros(numeros []int) string {
+	partes := make([]string, len(numeros))
+	for i, n := range numeros {
+		partes[i] = strconv.Itoa(n)
+	}
+	return strings.Join(partes, ",")
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"PaymentsGo/internal/model"
+)
+
+func TestInsertTicketsProfile(t *testing.T) {
+	casos := []struct {
+		nombre  string
+		usuario string
+		profile interface{}
+	}{
+		{nombre: "con sesión", usuario: "5d1e2f3a-4b5c-4d6e-8f7a-9b0c1d2e3f4a", profile: "5d1e2f3a-4b5c-4d6e-8f7a-9b0c1d2e3f4a"},
+		{nombre: "invitado", usuario: "", profile: nil},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			var filas []map[string]interface{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/rest/v1/rpc/register_tickets" {
+					t.Errorf("se llamó a %s %s", r.Method, r.URL.Path)
+					http.NotFound(w, r)
+					return
+				}
+				var payload struct {
+					Tickets []map[string]interface{} `json:"p_tickets"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("payload: %v", err)
+				}
+				filas = payload.Tickets
+				w.Write([]byte(`{"tickets":[{"id":1,"number":7},{"id":2,"number":12}],"conflicts":[]}`))
+			}))
+			defer srv.Close()
+
+			db := NewSupabaseClient(srv.URL, "service_role", 10*time.Minute, true, ConfigCircuito{Fallas: 1000, TasaError: 1, Pausa: time.Second})
+			pago := model.PagoTickets{PaymentIntentID: "pi_prueba", Amount: 1000, Currency: "usd", PaidAt: time.Now()}
+			if _, err := db.InsertTickets(context.Background(), "0b7c6a52-3f1e-4d8a-9c2b-5e4f6a7b8c9d", []int{7, 12}, c.usuario, pago); err != nil {
+				t.Fatal(err)
+			}
+			if len(filas) != 2 {
+				t.Fatalf("filas = %v, se esperaban 2", filas)
+			}
+			for _, f := range filas {
+				profile, ok := f["profile_id"]
+				if !ok || profile != c.profile {
+					t.Errorf("profile_id = %#v, se esperaba %#v", profile, c.profile)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Package tracing configura OpenTelemetry: el exportador OTLP, el span raíz de
+// cada petición y los atributos que comparten los demás paquetes.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Atributos de los spans; se llaman igual que en los logs para poder cruzarlos.
+// El email del comprador nunca va en un span, ni siquiera enmascarado.
+const (
+	RifaID          = attribute.Key("rifa_id")
+	PaymentIntentID = attribute.Key("payment_intent_id")
+)
+
+// Configurar instala el TracerProvider global con un exportador OTLP/HTTP.
+// Endpoint, cabeceras, muestreo y nombre del servicio salen de las variables
+// estándar de OpenTelemetry (OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_SERVICE_NAME,
+// OTEL_TRACES_SAMPLER...), que lee el propio SDK. Si habilitado es false no
+// instala nada: el tracer global queda no-op y los spans no cuestan nada.
+// Devuelve la función que exporta los spans pendientes al apagar.
+func Configurar(ctx context.Context, habilitado bool) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !habilitado {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exportador, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME y OTEL_RESOURCE_ATTRIBUTES pisan el nombre por defecto
+	recurso, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("PaymentsGo")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	proveedor := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exportador),
+		sdktrace.WithResource(recurso),
+	)
+	otel.SetTracerProvider(proveedor)
+	return proveedor.Shutdown, nil
+}
+
+// WithSpan abre el span raíz de cada petición. Al terminar, el span toma el
+// nombre del patrón que eligió el ServeMux (/payments/status/{paymentIntentId})
+// y no la URL con el ID; por eso los middlewares entre los dos no deben
+// cambiar la *http.Request. Las sondas y /metrics no generan trazas.
+func WithSpan(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/healthz", "/readyz", "/metrics":
+				return false
+			}
+			return true
+		}),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if r.Pattern != "" {
+				return r.Pattern
+			}
+			return r.Method
+		}),
+	)
+}
+
+// Fin cierra el span y, si hubo error, lo marca como fallido. Se usa con un
+// error con nombre: defer func() { tracing.Fin(span, err) }()
+func Fin(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
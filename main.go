@@ -1,259 +1,302 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
-	"fmt"
-	"io"
-	"log"
+	"flag"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/resend/resend-go/v2"
-	"github.com/stripe/stripe-go/v84"
-	"github.com/stripe/stripe-go/v84/paymentintent"
-	"github.com/stripe/stripe-go/v84/webhook"
-)
-
-// Estructuras de datos
-type PaymentRequest struct {
-	RifaID  string `json:"rifaId"`
-	Numeros []int  `json:"numeros"`
-	UserId  string `json:"userId"`
-	Email   string `json:"email"`
-}
-
-type Rifa struct {
-	ID    string `json:"id"`
-	Price int64  `json:"price"`
-	Title string `json:"title"`
-}
 
-func enableCORS(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	"PaymentsGo/internal/avisos"
+	"PaymentsGo/internal/captcha"
+	"PaymentsGo/internal/config"
+	"PaymentsGo/internal/handlers"
+	"PaymentsGo/internal/logging"
+	"PaymentsGo/internal/mail"
+	"PaymentsGo/internal/metrics"
+	"PaymentsGo/internal/payments"
+	"PaymentsGo/internal/store"
+	"PaymentsGo/internal/tracing"
+)
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		next.ServeHTTP(w, r)
-	}
-}
+// version y commit se fijan al compilar:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version = "dev"
+	commit  = ""
+)
 
 func main() {
+	// -migrate aplica las migraciones y termina, para que un deploy no
+	// arranque la versión nueva si fallan
+	soloMigrar := flag.Bool("migrate", false, "aplica las migraciones pendientes por DATABASE_URL y termina")
+	flag.Parse()
 	godotenv.Load()
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-
-	http.HandleFunc("/payments/create-intent", enableCORS(withCSP(CreatePaymentIntent)))
-	http.HandleFunc("/payments/webhook", enableCORS(withCSP(HandleStripeWebhook)))
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load()
+	logging.ConfigurarLogger(cfg.LogLevel, cfg.LogFormat)
+	var errCfg *config.ErrConfig
+	if errors.As(err, &errCfg) {
+		for _, p := range errCfg.Problemas {
+			slog.Error("configuración inválida", "problema", p)
+		}
+		slog.Error("el servidor no arranca", "problemas", len(errCfg.Problemas))
+		os.Exit(1)
 	}
-
-	log.Printf("✅ Servidor iniciado en puerto %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-}
-
-// 1. Crear el Intento de Pago (ACTUALIZADO PARA APPLE PAY)
-func CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
-	log.Println("--- Nuevo Intento de Pago ---")
-	var req PaymentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("❌ Error decodificando JSON: %v", err)
-		http.Error(w, "JSON inválido", 400)
-		return
+	if cfg.DebugHTTPLogging {
+		slog.Warn("DEBUG_HTTP_LOGGING activo: se registran los cuerpos de la API, con emails y tokens tapados")
 	}
-
-	rifa, err := getRifa(req.RifaID)
+	// Sin trazas el servicio funciona igual, así que un error aquí no lo detiene
+	apagarTrazas, err := tracing.Configurar(context.Background(), cfg.TracingEnabled)
 	if err != nil {
-		log.Printf("❌ Rifa %s no encontrada", req.RifaID)
-		http.Error(w, "Rifa no encontrada", 404)
-		return
+		slog.Error("no se pudo configurar el tracing", logging.ConError(err)...)
+		apagarTrazas = func(context.Context) error { return nil }
 	}
 
-	montoTotal := (rifa.Price * int64(len(req.Numeros))) * 100
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(montoTotal),
-		Currency: stripe.String(string(stripe.CurrencyUSD)),
-		// MODIFICACIÓN CLAVE: Habilitar métodos de pago automáticos para mostrar Apple Pay
-		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
-			Enabled: stripe.Bool(true),
-		},
-		Metadata: map[string]string{
-			"rifa_id":    req.RifaID,
-			"rifa_title": rifa.Title,
-			"user_id":    req.UserId,
-			"user_email": req.Email,
-			"numeros":    toString(req.Numeros),
-		},
+	if *soloMigrar || cfg.MigrateOnStart {
+		if !migrar(ctx, cfg.DatabaseURL) {
+			os.Exit(1)
+		}
+		if *soloMigrar {
+			return
+		}
 	}
 
-	pi, err := paymentintent.New(params)
-	if err != nil {
-		log.Printf("❌ Error Stripe API: %v", err)
-		http.Error(w, "Error Stripe", 500)
-		return
+	var respaldo mail.Proveedor
+	if cfg.SMTPHost != "" {
+		respaldo = mail.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUser, cfg.SMTPPassword)
+	} else {
+		slog.Warn("SMTP_HOST vacío: si Resend falla los correos no tienen respaldo")
 	}
-
-	log.Printf("✅ Intent Creado: %s para %s", pi.ID, req.Email)
-	json.NewEncoder(w).Encode(map[string]string{"clientSecret": pi.ClientSecret})
-}
-
-// 2. Webhook
-func HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
-	log.Println("--- Webhook Recibido ---")
-
-	const MaxBodyBytes = int64(65536)
-	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
-	payload, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("❌ Error leyendo payload: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	correo := mail.NewFailoverMailer(mail.NewResendMailer(cfg.ResendAPIKey), respaldo, cfg.MailFailoverThreshold, cfg.MailFailoverCooldown)
+	var canales []handlers.Notifier
+	if cfg.TelegramBotToken != "" {
+		canales = append(canales, avisos.NewTelegram(cfg.TelegramBotToken, cfg.TelegramChatID))
 	}
-
-	endpointSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-	signature := r.Header.Get("Stripe-Signature")
-
-	event, err := webhook.ConstructEvent(payload, signature, endpointSecret)
-	if err != nil {
-		log.Printf("❌ Falló la validación del Webhook: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if cfg.SlackWebhookURL != "" {
+		canales = append(canales, avisos.NewSlack(cfg.SlackWebhookURL))
 	}
-
-	if event.Type == "payment_intent.succeeded" {
-		var pi stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &pi)
-		if err != nil {
-			log.Printf("❌ Error parseando PaymentIntent: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	// Sin PayPal la interfaz queda en nil, no un *payments.PayPal nil
+	var paypal handlers.PayPalProvider
+	if cfg.PayPalClientID != "" {
+		paypal = payments.NewPayPal(cfg.PayPalClientID, cfg.PayPalClientSecret, cfg.PayPalWebhookID, cfg.PayPalSandbox)
+	}
+	var mercadopago handlers.MercadoPagoProvider
+	if cfg.MercadoPagoAccessToken != "" {
+		mercadopago = payments.NewMercadoPago(cfg.MercadoPagoAccessToken, cfg.MercadoPagoWebhookSecret)
+	}
+	var verificadorCaptcha handlers.CaptchaVerifier
+	if cfg.CaptchaProvider != "" {
+		verificadorCaptcha = captcha.NewVerificador(cfg.CaptchaProvider, cfg.CaptchaSecret, cfg.CaptchaMinScore, cfg.CaptchaTimeout)
+	} else {
+		slog.Warn("CAPTCHA_PROVIDER vacío: create-intent no pide captcha")
+	}
+	supabase := store.NewSupabaseClient(cfg.SupabaseURL, cfg.SupabaseServiceRole, cfg.ReservationTTL, cfg.RegisterTicketsRPC, store.ConfigCircuito{
+		Fallas:    cfg.SupabaseBreakerFailures,
+		TasaError: cfg.SupabaseBreakerErrorRate,
+		Pausa:     cfg.SupabaseBreakerOpen,
+	})
+	var db handlers.Store = supabase
+	var pg *store.PostgresClient
+	if cfg.StoreBackend == "postgres" {
+		var err error
+		if pg, err = store.NewPostgresClient(ctx, cfg.DatabaseURL, supabase); err != nil {
+			slog.Error("no se pudo abrir la conexión a Postgres", logging.ConError(err)...)
+			os.Exit(1)
 		}
-
-		rifaID := pi.Metadata["rifa_id"]
-		rifaTitle := pi.Metadata["rifa_title"]
-		userID := pi.Metadata["user_id"]
-		userEmail := pi.Metadata["user_email"]
-		var numeros []int
-		json.Unmarshal([]byte(pi.Metadata["numeros"]), &numeros)
-
-		if err := registrarTickets(rifaID, numeros, userID); err != nil {
-			log.Printf("❌ ERROR al registrar en Supabase: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		defer pg.Close()
+		db = pg
+	}
+	s := handlers.NewServer(
+		cfg,
+		db,
+		payments.NewStripePagos(cfg.StripeSecretKey, cfg.StripeWebhookSecrets, cfg.StripeWebhookTolerance),
+		paypal,
+		mercadopago,
+		verificadorCaptcha,
+		correo,
+		canales...,
+	)
+	// El sandbox tiene sus propias tablas, su cuenta de Stripe y sus workers
+	var sandbox *handlers.Server
+	if cfg.SandboxConfigurado() {
+		var dbSandbox handlers.Store = supabase.Sandbox()
+		if pg != nil {
+			dbSandbox = pg.Sandbox()
 		}
-
-		go func() {
-			if err := enviarCorreoConfirmacion(userEmail, rifaTitle, numeros); err != nil {
-				log.Printf("⚠️ Error enviando correo: %v", err)
-			}
-		}()
+		sandbox = s.ActivarSandbox(dbSandbox, payments.NewStripePagos(cfg.StripeTestSecretKey, []string{cfg.StripeTestWebhookSecret}, cfg.StripeWebhookTolerance))
+		slog.Info("sandbox activado", "sandbox_mode", cfg.SandboxMode, "tokens", len(cfg.SandboxAdminTokens), "email", logging.EnmascararEmail(cfg.SandboxEmail))
 	}
 
-	w.WriteHeader(http.StatusOK)
-}
-
-// --- Middleware CSP (ACTUALIZADO PARA APPLE PAY) ---
-func withCSP(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Security-Policy",
-			"default-src 'self'; "+
-				"script-src 'self' https://js.stripe.com https://m.stripe.network 'unsafe-inline'; "+
-				"style-src 'self' https://js.stripe.com 'unsafe-inline'; "+
-				// Se agregan dominios de Apple para frames
-				"frame-src https://js.stripe.com https://m.stripe.network https://applepay.apple.com; "+
-				// Se agregan gateways de Apple para la conexión
-				"connect-src 'self' https://api.stripe.com https://m.stripe.network https://apple-pay-gateway.apple.com;")
-
-		next.ServeHTTP(w, r)
+	rutas := http.NewServeMux()
+	// La API se sirve sin prefijo, para los clientes que ya existen, y bajo /v1
+	for _, prefijo := range []string{"", "/v1"} {
+		registrarAPI(rutas, prefijo, handlers.WithAPIVersion(handlers.APIv1), s, cfg)
+	}
+	// Los webhooks no llevan versión: la URL está registrada en Stripe, PayPal,
+	// MercadoPago y Resend, que los llaman desde su servidor y no necesitan CORS
+	rutas.HandleFunc("/payments/webhook", handlers.WithCSP(handlers.WithDeadline(cfg.WebhookTimeout, s.HandleStripeWebhook)))
+	rutas.HandleFunc("POST /payments/paypal/webhook", handlers.WithCSP(handlers.WithDeadline(cfg.WebhookTimeout, s.HandlePayPalWebhook)))
+	rutas.HandleFunc("POST /payments/mercadopago/webhook", handlers.WithCSP(handlers.WithDeadline(cfg.WebhookTimeout, s.HandleMercadoPagoWebhook)))
+	rutas.HandleFunc("POST /email/webhook", handlers.WithCSP(handlers.WithDeadline(cfg.WebhookTimeout, s.HandleResendWebhook)))
+	rutas.HandleFunc("GET /healthz", handlers.Healthz)
+	rutas.HandleFunc("GET /readyz", s.Readyz)
+	rutas.HandleFunc("GET /metrics", metrics.Handler)
+	rutas.HandleFunc("GET /version", handlers.Version(version, commit))
+
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           logging.WithRequestID(tracing.WithSpan(s.WithAccessLog(handlers.WithRecovery(rutas)))),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	// Los streams de eventos no terminan solos: se cortan al empezar Shutdown
+	// y los navegadores reconectan contra otra instancia
+	srv.RegisterOnShutdown(s.CerrarEventos)
+
+	// Los workers, el outbox, el barrido de reservas y la limpieza de los rate
+	// limits paran con la señal; el trabajo en curso se espera con
+	// TareasPendientes y lo que quede en la cola se retoma al volver a arrancar
+	s.IniciarTrabajos(ctx)
+	s.IniciarOutbox(ctx)
+	s.IniciarAuditoria(ctx)
+	s.IniciarBarridoReservas(ctx)
+	s.IniciarResumenDiario(ctx)
+	s.IniciarLimitadores(ctx)
+	if sandbox != nil {
+		sandbox.IniciarTrabajos(ctx)
+		sandbox.IniciarOutbox(ctx)
+		sandbox.IniciarAuditoria(ctx)
+		sandbox.IniciarBarridoReservas(ctx)
+		sandbox.IniciarLimitadores(ctx)
 	}
-}
 
-// --- Funciones de Soporte (Sin cambios necesarios) ---
+	go func() {
+		slog.Info("servidor iniciado", "port", cfg.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error del servidor", logging.ConError(err)...)
+			os.Exit(1)
+		}
+	}()
 
-func enviarCorreoConfirmacion(destinatario string, rifaNombre string, numeros []int) error {
-	client := resend.NewClient(os.Getenv("RESEND_API_KEY"))
-	numsStr := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(numeros)), ", "), "[]")
+	<-ctx.Done()
 
-	html := fmt.Sprintf(`
-		<div style="font-family: sans-serif; max-width: 500px; margin: auto; padding: 25px; border-radius: 20px; border: 1px solid #eee;">
-			<h2 style="color: #ff5252;">¡Compra Exitosa!</h2>
-			<p>Tus números para <b>%s</b>:</p>
-			<h1 style="background: #000; color: #fff; padding: 10px; text-align: center;"># %s</h1>
-		</div>`, rifaNombre, numsStr)
+	gracia := cfg.ShutdownGracePeriod
+	slog.Info("apagando servidor", "gracia", gracia.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracia)
+	defer cancel()
 
-	params := &resend.SendEmailRequest{
-		From:    "Twins Rifas <onboarding@resend.dev>",
-		To:      []string{destinatario},
-		Subject: "Tus números confirmados",
-		Html:    html,
+	// Shutdown espera a los handlers en curso; después esperamos los trabajos del
+	// webhook y los correos que quedaron en segundo plano.
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("tiempo agotado esperando peticiones en curso", logging.ConError(err)...)
 	}
 
-	_, err := client.Emails.Send(params)
-	return err
-}
-
-func getRifa(id string) (*Rifa, error) {
-	url := fmt.Sprintf("%s/rest/v1/rifa?id=eq.%s&select=id,price,title", os.Getenv("SUPABASE_URL"), id)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("apikey", os.Getenv("SUPABASE_SERVICE_ROLE"))
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("SUPABASE_SERVICE_ROLE"))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		return nil, errors.New("error supabase")
+	terminadas := make(chan struct{})
+	go func() {
+		handlers.TareasPendientes.Wait()
+		close(terminadas)
+	}()
+	select {
+	case <-terminadas:
+		slog.Info("servidor detenido correctamente")
+	case <-shutdownCtx.Done():
+		slog.Warn("tiempo de gracia agotado con tareas pendientes")
 	}
-	defer resp.Body.Close()
-
-	var data []Rifa
-	json.NewDecoder(resp.Body).Decode(&data)
-	if len(data) == 0 {
-		return nil, errors.New("404")
+	// Lo que quedó en la cola de audit_log se escribe aunque la gracia se haya agotado
+	s.VaciarAuditoria(shutdownCtx)
+	if sandbox != nil {
+		sandbox.VaciarAuditoria(shutdownCtx)
+	}
+	if err := apagarTrazas(shutdownCtx); err != nil {
+		slog.Warn("no se pudieron exportar las últimas trazas", logging.ConError(err)...)
 	}
-	return &data[0], nil
 }
 
-func registrarTickets(rifaID string, numeros []int, userID string) error {
-	endpoint := fmt.Sprintf("%s/rest/v1/tikect", os.Getenv("SUPABASE_URL"))
-	var payload []map[string]interface{}
-	for _, n := range numeros {
-		payload = append(payload, map[string]interface{}{
-			"rifa_id":    rifaID,
-			"number":     n,
-			"profile_id": userID,
-		})
+// registrarAPI registra las rutas de la API bajo prefijo ("" o "/v1"), cada
+// una envuelta en conVersion para que el handler sepa con qué versión llegó y,
+// con DEBUG_HTTP_LOGGING, en WithDebugHTTP
+func registrarAPI(rutas *http.ServeMux, prefijo string, conVersion func(http.HandlerFunc) http.HandlerFunc, s *handlers.Server, cfg *config.Config) {
+	ruta := func(patron string, h http.HandlerFunc) {
+		if metodo, camino, ok := strings.Cut(patron, " "); ok {
+			patron = metodo + " " + prefijo + camino
+		} else {
+			patron = prefijo + patron
+		}
+		if cfg.DebugHTTPLogging {
+			h = handlers.WithDebugHTTP(h)
+		}
+		rutas.HandleFunc(patron, conVersion(h))
 	}
 
-	body, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", endpoint, bytes.NewBuffer(body))
-	req.Header.Set("apikey", os.Getenv("SUPABASE_SERVICE_ROLE"))
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("SUPABASE_SERVICE_ROLE"))
-	req.Header.Set("Content-Type", "application/json")
+	ruta("/payments/create-intent", s.EnableCORS(handlers.WithCSP(handlers.WithJSONPost(s.WithRateLimit(s.WithSupabaseAuth(handlers.WithDeadline(cfg.CreateIntentTimeout, s.WithSandbox((*handlers.Server).CreatePaymentIntent))))))))
+	ruta("/payments/quote", s.EnableCORS(handlers.WithCSP(s.WithSandbox((*handlers.Server).QuotePayment))))
+	ruta("/payments/config", s.EnableCORS(handlers.WithCSP(s.WithSandbox((*handlers.Server).PaymentConfig))))
+	ruta("/payments/my-tickets", s.EnableCORS(handlers.WithCSP(s.WithSupabaseAuth(s.WithSandbox((*handlers.Server).MyTickets)))))
+	ruta("/payments/intent", s.EnableCORS(handlers.WithCSP(s.WithSupabaseAuth(s.WithSandbox((*handlers.Server).PendingIntent)))))
+	ruta("/payments/installment/{draftId}/next", s.EnableCORS(handlers.WithCSP(s.WithSupabaseAuth(s.WithSandbox((*handlers.Server).NextInstallment)))))
+	ruta("/payments/status/{paymentIntentId}", s.EnableCORS(handlers.WithCSP(s.WithSupabaseAuth(s.WithSandbox((*handlers.Server).PaymentStatus)))))
+	ruta("/payments/cancel-intent", s.EnableCORS(handlers.WithCSP(handlers.WithJSONPost(s.WithSupabaseAuth(s.WithSandbox((*handlers.Server).CancelPaymentIntent))))))
+	ruta("/payments/paypal/create-order", s.EnableCORS(handlers.WithCSP(handlers.WithJSONPost(s.WithRateLimit(s.WithSupabaseAuth(handlers.WithDeadline(cfg.CreateIntentTimeout, s.CreatePayPalOrder)))))))
+	ruta("/payments/mercadopago/create-preference", s.EnableCORS(handlers.WithCSP(handlers.WithJSONPost(s.WithRateLimit(s.WithSupabaseAuth(handlers.WithDeadline(cfg.CreateIntentTimeout, s.CreateMercadoPagoPreference)))))))
+	ruta("/rifas/{id}/numeros", s.EnableCORS(handlers.WithCSP(s.WithSandbox((*handlers.Server).GetNumerosRifa))))
+	ruta("/rifas/{id}/waitlist", s.EnableCORS(handlers.WithCSP(s.WithSupabaseAuth(s.Waitlist))))
+	ruta("/rifas/{id}/events", s.EnableCORS(handlers.WithCSP(s.StreamEventosRifa)))
+	ruta("/rifas/{id}/progress", handlers.EnablePublicCORS(handlers.WithCSP(s.GetProgresoRifa)))
+	ruta("/tickets/verify", s.EnableCORS(handlers.WithCSP(s.VerifyTickets)))
+	ruta("POST /admin/emails/retry", s.RequireAdmin(s.RetryEmailFailures))
+	ruta("POST /admin/emails/resend", s.RequireAdmin(s.ResendConfirmation))
+	ruta("GET /admin/outbox", s.RequireAdmin(s.ListOutbox))
+	ruta("POST /admin/outbox/{id}/requeue", s.RequireAdmin(s.RequeueOutbox))
+	ruta("POST /admin/mail/test", s.RequireAdmin(s.TestMail))
+	ruta("POST /admin/digest/run", s.RequireAdmin(s.RunDigest))
+	ruta("POST /admin/reconcile", s.RequireAdmin(s.Reconcile))
+	ruta("POST /admin/cache/invalidate", s.RequireAdmin(s.InvalidateCache))
+	ruta("POST /admin/tickets/manual", s.RequireAdmin(s.RegisterManualTickets))
+	ruta("POST /admin/tickets/transfer", s.RequireAdmin(s.TransferTicket))
+	ruta("POST /admin/privacy/delete", s.RequireAdmin(s.DeletePersonalData))
+	ruta("GET /admin/blocklist", s.RequireAdmin(s.ListBlockedBuyers))
+	ruta("POST /admin/blocklist", s.RequireAdmin(s.BlockBuyer))
+	ruta("DELETE /admin/blocklist/{id}", s.RequireAdmin(s.UnblockBuyer))
+	ruta("GET /admin/reservations", s.RequireAdmin(s.ListReservations))
+	ruta("GET /admin/audit", s.RequireAdmin(s.ListAuditLog))
+	ruta("GET /admin/referrals/{code}/summary", s.RequireAdmin(s.ReferralSummary))
+	ruta("GET /admin/rifas/{id}/tickets", s.RequireAdmin(s.ListRifaTickets))
+	ruta("GET /admin/rifas/{id}/export.csv", s.RequireAdmin(s.ExportRifaCSV))
+	ruta("POST /admin/rifas/{id}/draw", s.RequireAdmin(s.DrawRifa))
+	ruta("POST /admin/rifas/{id}/announce", s.RequireAdmin(s.AnnounceDraw))
+	ruta("POST /admin/payments/{paymentIntentId}/refund", s.RequireAdmin(s.RefundPayment))
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+// migrar aplica las migraciones pendientes; si alguna falla lo registra con
+// su nombre y devuelve false para que el proceso no siga
+func migrar(ctx context.Context, databaseURL string) bool {
+	if databaseURL == "" {
+		slog.Error("las migraciones necesitan DATABASE_URL")
+		return false
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("status %d: %s", resp.StatusCode, string(b))
+	aplicadas, err := store.Migrar(ctx, databaseURL)
+	var errMigracion *store.ErrMigracion
+	if errors.As(err, &errMigracion) {
+		slog.Error("falló la migración, el servidor no arranca", logging.ConError(errMigracion.Err, "migracion", errMigracion.Archivo, "aplicadas", len(aplicadas))...)
+		return false
 	}
-	return nil
+	if err != nil {
+		slog.Error("no se pudieron aplicar las migraciones", logging.ConError(err)...)
+		return false
+	}
+	slog.Info("migraciones al día", "aplicadas", len(aplicadas))
+	return true
 }
-
-func toString(v interface{}) string {
-	b, _ := json.Marshal(v)
-	return string(b)
-}
\ No newline at end of file